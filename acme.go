@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/tachesimazzoca/go-mproxy/smtp"
+)
+
+// startACME answers the challenges of the manager and keeps its
+// certificate renewed in the background.
+func startACME(m *smtp.ACMEManager, httpAddr, alpnAddr string) {
+	if m.Challenge == "tls-alpn-01" {
+		lsnr, err := tls.Listen("tcp", alpnAddr, &tls.Config{
+			GetCertificate: m.GetCertificate,
+			NextProtos:     []string{"acme-tls/1"},
+		})
+		assertNoError(err)
+		go func() {
+			for {
+				conn, err := lsnr.Accept()
+				if err != nil {
+					log.Print(err)
+					return
+				}
+				go func() {
+					conn.SetDeadline(time.Now().Add(10 * time.Second))
+					conn.(*tls.Conn).Handshake()
+					conn.Close()
+				}()
+			}
+		}()
+	} else {
+		go func() {
+			log.Print(http.ListenAndServe(httpAddr, m.HTTPHandler(nil)))
+		}()
+	}
+	go m.Run(context.Background(), 12*time.Hour, log.Printf)
+}
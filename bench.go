@@ -0,0 +1,70 @@
+package main
+
+import (
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"net"
+	netsmtp "net/smtp"
+	"os"
+	"sort"
+
+	"github.com/tachesimazzoca/go-mproxy/smtp"
+)
+
+func runBench(args []string) error {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	b := smtp.NewBenchmark("")
+	fs.StringVar(&b.HelloName, "helo", b.HelloName, "name to greet the server with")
+	fs.IntVar(&b.Concurrency, "c", b.Concurrency, "number of concurrent clients")
+	fs.IntVar(&b.Messages, "n", b.Messages, "number of messages to send, or 0 for no limit")
+	fs.DurationVar(&b.Duration, "duration", 0, "time to send messages for, e.g. 1m, or 0 for no limit")
+	fs.IntVar(&b.Size, "size", b.Size, "size of the body of the messages in bytes")
+	fs.StringVar(&b.From, "from", b.From, "sender of the messages")
+	fs.StringVar(&b.To, "to", b.To, "recipient of the messages")
+	fs.IntVar(&b.Recipients, "rcpts", b.Recipients, "number of recipients of each message, numbered after -to")
+	fs.IntVar(&b.PerConnection, "per-conn", 0, "number of messages per connection, or 0 to keep connections")
+	fs.DurationVar(&b.Timeout, "timeout", b.Timeout, "timeout of each transaction")
+	startTLS := fs.Bool("starttls", false, "upgrade the connections with STARTTLS")
+	insecure := fs.Bool("insecure", false, "skip the verification of the certificate of the server")
+	user := fs.String("user", "", "user to authenticate with AUTH PLAIN")
+	password := fs.String("password", "", "password of -user")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: mproxy bench [flags] host:port")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	b.Addr = fs.Arg(0)
+	host, _, err := net.SplitHostPort(b.Addr)
+	if err != nil {
+		return err
+	}
+	if *startTLS {
+		b.TLSConfig = &tls.Config{ServerName: host, InsecureSkipVerify: *insecure}
+	}
+	if len(*user) > 0 {
+		b.Auth = netsmtp.PlainAuth("", *user, *password, host)
+	}
+
+	r := b.Run()
+	fmt.Printf("sent:       %d\n", r.Sent)
+	fmt.Printf("failed:     %d\n", r.Failed)
+	fmt.Printf("elapsed:    %v\n", r.Elapsed)
+	fmt.Printf("throughput: %.1f msg/s\n", r.Throughput())
+	for _, p := range []float64{0.5, 0.9, 0.99, 1} {
+		fmt.Printf("p%-9s %v\n", fmt.Sprint(p*100)+":", r.Percentile(p))
+	}
+	errs := make([]string, 0, len(r.Errors))
+	for x := range r.Errors {
+		errs = append(errs, x)
+	}
+	sort.Slice(errs, func(i, j int) bool { return r.Errors[errs[i]] > r.Errors[errs[j]] })
+	for _, x := range errs {
+		fmt.Printf("error:      %d\t%s\n", r.Errors[x], x)
+	}
+	return nil
+}
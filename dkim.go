@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/tachesimazzoca/go-mproxy/smtp"
+)
+
+func loadDKIMKeyRing(domain, path, canonicalization string) (*smtp.DKIMKeyRing, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	ring, err := smtp.ParseDKIMKeyRing(f, domain)
+	if err != nil {
+		return nil, err
+	}
+	xs := strings.SplitN(canonicalization, "/", 2)
+	ring.Signer.HeaderCanonicalization = xs[0]
+	ring.Signer.BodyCanonicalization = "simple"
+	if len(xs) == 2 {
+		ring.Signer.BodyCanonicalization = xs[1]
+	}
+	return ring, nil
+}
+
+// printDKIMRecord prints the record in zone file syntax, split into
+// strings of 255 characters at most.
+func printDKIMRecord(domain, selector, record string) {
+	xs := make([]string, 0)
+	for len(record) > 255 {
+		xs = append(xs, `"`+record[:255]+`"`)
+		record = record[255:]
+	}
+	xs = append(xs, `"`+record+`"`)
+	fmt.Printf("%s._domainkey.%s. IN TXT ( %s )\n", selector, domain, strings.Join(xs, " "))
+}
+
+func runDKIM(args []string) error {
+	fs := flag.NewFlagSet("dkim", flag.ExitOnError)
+	domain := fs.String("domain", "example.com", "signing domain")
+	selector := fs.String("selector", "default", "selector of the key")
+	algorithm := fs.String("algorithm", "rsa", "key algorithm, rsa or ed25519")
+	key := fs.String("key", "", "PEM file of the private key, or env:NAME")
+	keys := fs.String("keys", "", "file of keys in the form of \"selector source [activate]\"")
+	activate := fs.String("activate", "", "time in RFC 3339 to activate a staged key at")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: mproxy dkim [flags] keygen|record|stage|status")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	switch fs.Arg(0) {
+	case "keygen":
+		k, err := smtp.GenerateDKIMKey(*algorithm)
+		if err != nil {
+			return err
+		}
+		b, err := smtp.MarshalDKIMPrivateKey(k)
+		if err != nil {
+			return err
+		}
+		if len(*key) == 0 {
+			os.Stdout.Write(b)
+		} else if err := os.WriteFile(*key, b, 0600); err != nil {
+			return err
+		}
+		record, err := smtp.DKIMRecord(k)
+		if err != nil {
+			return err
+		}
+		printDKIMRecord(*domain, *selector, record)
+	case "record":
+		k, err := smtp.LoadDKIMPrivateKey(*key)
+		if err != nil {
+			return err
+		}
+		record, err := smtp.DKIMRecord(k)
+		if err != nil {
+			return err
+		}
+		printDKIMRecord(*domain, *selector, record)
+	case "stage":
+		if _, err := smtp.LoadDKIMPrivateKey(*key); err != nil {
+			return err
+		}
+		at := time.Now().Add(7 * 24 * time.Hour)
+		if len(*activate) > 0 {
+			t, err := time.Parse(time.RFC3339, *activate)
+			if err != nil {
+				return err
+			}
+			at = t
+		}
+		f, err := os.OpenFile(*keys, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return err
+		}
+		w := bufio.NewWriter(f)
+		fmt.Fprintf(w, "%s %s %s\n", *selector, *key, at.UTC().Format(time.RFC3339))
+		if err := w.Flush(); err != nil {
+			f.Close()
+			return err
+		}
+		return f.Close()
+	case "status":
+		ring, err := loadDKIMKeyRing(*domain, *keys, "relaxed/relaxed")
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		current, _ := ring.Current(now)
+		for _, k := range ring.Keys() {
+			state := "retired"
+			if k.Activate.After(now) {
+				state = "staged"
+			} else if k.Selector == current.Selector {
+				state = "active"
+			}
+			fmt.Printf("%s\t%s\t%s\n", k.Selector, state, k.Activate.Format(time.RFC3339))
+		}
+	default:
+		fs.Usage()
+		os.Exit(2)
+	}
+	return nil
+}
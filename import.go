@@ -0,0 +1,64 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/tachesimazzoca/go-mproxy/smtp"
+)
+
+func runImport(args []string) error {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	dir := fs.String("store", "store", "directory of the message store")
+	key := fs.String("key", "", "AES key to encrypt the messages with at file:PATH or env:NAME")
+	addr := fs.String("smtp", "", "host:port of a server to pass the messages through the pipeline of instead")
+	from := fs.String("from", "", "sender of the messages instead of Return-Path or From")
+	to := fs.String("to", "", "comma-separated recipients of the messages instead of To, Cc and Bcc")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: mproxy import [flags] file.eml|file.mbox...")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	im := &smtp.Importer{Addr: *addr}
+	if len(*addr) == 0 {
+		s, err := smtp.NewMessageStore(*dir)
+		if err != nil {
+			return err
+		}
+		if len(*key) > 0 {
+			b, err := smtp.LoadMessageKey(*key)
+			if err != nil {
+				return err
+			}
+			if s.Cipher, err = smtp.NewMessageCipher(b); err != nil {
+				return err
+			}
+		}
+		im.Store = s
+	}
+	var recipients []string
+	if len(*to) > 0 {
+		recipients = strings.Split(*to, ",")
+	}
+	for _, x := range fs.Args() {
+		data, err := os.ReadFile(x)
+		if err != nil {
+			return err
+		}
+		ids, err := im.Import(data, *from, recipients, len(*addr) > 0)
+		for _, id := range ids {
+			fmt.Printf("%s\t%s\n", id, x)
+		}
+		if err != nil {
+			return errors.New(x + ": " + err.Error())
+		}
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/tachesimazzoca/go-mproxy/smtp"
+)
+
+func runQuarantine(args []string) error {
+	fs := flag.NewFlagSet("quarantine", flag.ExitOnError)
+	dir := fs.String("dir", "quarantine", "quarantine directory")
+	relay := fs.String("relay", "", "upstream host:port to release messages to")
+	key := fs.String("key", "", "AES key of encrypted messages at file:PATH or env:NAME")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: mproxy quarantine [flags] list|show|release|delete [id...]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	q, err := smtp.NewQuarantine(*dir)
+	if err != nil {
+		return err
+	}
+	if len(*key) > 0 {
+		b, err := smtp.LoadMessageKey(*key)
+		if err != nil {
+			return err
+		}
+		if q.Cipher, err = smtp.NewMessageCipher(b); err != nil {
+			return err
+		}
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	ids := fs.Args()[1:]
+	switch fs.Arg(0) {
+	case "list":
+		xs, err := q.List()
+		if err != nil {
+			return err
+		}
+		for _, x := range xs {
+			fmt.Printf("%s\t%s\t%s\t%s\t%s\n", x.ID, x.ReturnTo,
+				strings.Join(x.Recipients, ","), strings.Join(x.Tags, ","), x.Subject)
+		}
+	case "show":
+		for _, id := range ids {
+			f, err := q.Open(id)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(os.Stdout, f)
+			f.Close()
+			if err != nil {
+				return err
+			}
+		}
+	case "release":
+		send := func(st *smtp.SMTPState) error {
+			fmt.Println(st)
+			return nil
+		}
+		if len(*relay) > 0 {
+			send = smtp.NewRouter(*relay).Send
+		}
+		for _, id := range ids {
+			if err := q.Release(id, send); err != nil {
+				return err
+			}
+		}
+	case "delete":
+		for _, id := range ids {
+			if err := q.Delete(id); err != nil {
+				return err
+			}
+		}
+	default:
+		fs.Usage()
+		os.Exit(2)
+	}
+	return nil
+}
@@ -0,0 +1,25 @@
+//go:build !windows
+
+package main
+
+import (
+	"errors"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// upgradeSignal asks serveUpgrades to pass the listeners to a new process.
+var upgradeSignal os.Signal = syscall.SIGUSR2
+
+// notifySignals relays the signals of upgrades and shutdowns to c.
+func notifySignals(c chan<- os.Signal) {
+	signal.Notify(c, syscall.SIGUSR2, syscall.SIGTERM, syscall.SIGINT)
+}
+
+func runService(args []string) (bool, error) {
+	return false, errors.New("service: only supported on Windows, run under systemd or another supervisor instead")
+}
+
+// serviceStopped reports the end of the process to the service manager.
+func serviceStopped() {}
@@ -0,0 +1,264 @@
+//go:build windows
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"syscall"
+	"unsafe"
+
+	"github.com/tachesimazzoca/go-mproxy/smtp"
+)
+
+// upgradeSignal is nil as Windows cannot pass sockets to a new process.
+var upgradeSignal os.Signal
+
+var (
+	advapi32                         = syscall.NewLazyDLL("advapi32.dll")
+	procOpenSCManager                = advapi32.NewProc("OpenSCManagerW")
+	procCreateService                = advapi32.NewProc("CreateServiceW")
+	procOpenService                  = advapi32.NewProc("OpenServiceW")
+	procDeleteService                = advapi32.NewProc("DeleteService")
+	procCloseServiceHandle           = advapi32.NewProc("CloseServiceHandle")
+	procStartServiceCtrlDispatcher   = advapi32.NewProc("StartServiceCtrlDispatcherW")
+	procRegisterServiceCtrlHandlerEx = advapi32.NewProc("RegisterServiceCtrlHandlerExW")
+	procSetServiceStatus             = advapi32.NewProc("SetServiceStatus")
+)
+
+const (
+	scManagerAllAccess      = 0xf003f
+	serviceAllAccess        = 0xf01ff
+	serviceDelete           = 0x10000
+	serviceWin32OwnProcess  = 0x10
+	serviceAutoStart        = 0x2
+	serviceErrorNormal      = 0x1
+	serviceStateStopped     = 0x1
+	serviceStateStopPending = 0x3
+	serviceStateRunning     = 0x4
+	serviceAcceptStop       = 0x1
+	serviceAcceptShutdown   = 0x4
+	serviceControlStop      = 0x1
+	serviceControlInquire   = 0x4
+	serviceControlShutdown  = 0x5
+	errorCallNotImplemented = 120
+)
+
+type serviceStatus struct {
+	ServiceType             uint32
+	CurrentState            uint32
+	ControlsAccepted        uint32
+	Win32ExitCode           uint32
+	ServiceSpecificExitCode uint32
+	CheckPoint              uint32
+	WaitHint                uint32
+}
+
+type serviceTableEntry struct {
+	name *uint16
+	proc uintptr
+}
+
+// service is the state of the process started by the service manager.
+var service struct {
+	name    string
+	handle  uintptr
+	started chan error
+	done    chan struct{}
+
+	mtx     sync.Mutex
+	status  serviceStatus
+	signals []chan<- os.Signal
+}
+
+// notifySignals relays Ctrl+C, the close, logoff and shutdown events of the
+// console, and the stop and shutdown controls of the service manager to c.
+func notifySignals(c chan<- os.Signal) {
+	signal.Notify(c, syscall.SIGTERM, os.Interrupt)
+	service.mtx.Lock()
+	service.signals = append(service.signals, c)
+	service.mtx.Unlock()
+}
+
+func runService(args []string) (bool, error) {
+	fs := flag.NewFlagSet("service", flag.ExitOnError)
+	name := fs.String("name", "mproxy", "name of the service, also the source of its events")
+	display := fs.String("display", "mproxy", "display name of the service")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: mproxy service [flags] install|uninstall|run [server flags]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	switch fs.Arg(0) {
+	case "install":
+		return false, installService(*name, *display, fs.Args()[1:])
+	case "uninstall":
+		return false, uninstallService(*name)
+	case "run":
+		return true, startService(*name, fs.Args()[1:])
+	default:
+		fs.Usage()
+		os.Exit(2)
+		return false, nil
+	}
+}
+
+// installService registers the service started automatically with the
+// server flags, logging to the event log unless -log-output is given.
+func installService(name, display string, serverArgs []string) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	args := []string{exe, "service", "-name", name, "run"}
+	hasLogOutput := false
+	for _, x := range serverArgs {
+		if strings.HasPrefix(strings.TrimLeft(x, "-"), "log-output") {
+			hasLogOutput = true
+		}
+	}
+	if !hasLogOutput {
+		args = append(args, "-log-output", "syslog")
+	}
+	args = append(args, serverArgs...)
+	for i, x := range args {
+		args[i] = syscall.EscapeArg(x)
+	}
+	scm, err := openSCManager()
+	if err != nil {
+		return err
+	}
+	defer procCloseServiceHandle.Call(scm)
+	h, _, err := procCreateService.Call(scm, uintptr(unsafe.Pointer(syscall.StringToUTF16Ptr(name))),
+		uintptr(unsafe.Pointer(syscall.StringToUTF16Ptr(display))), serviceAllAccess,
+		serviceWin32OwnProcess, serviceAutoStart, serviceErrorNormal,
+		uintptr(unsafe.Pointer(syscall.StringToUTF16Ptr(strings.Join(args, " ")))), 0, 0, 0, 0, 0)
+	if h == 0 {
+		return fmt.Errorf("service: %v", err)
+	}
+	procCloseServiceHandle.Call(h)
+	return smtp.InstallEventSource(name)
+}
+
+func uninstallService(name string) error {
+	scm, err := openSCManager()
+	if err != nil {
+		return err
+	}
+	defer procCloseServiceHandle.Call(scm)
+	h, _, err := procOpenService.Call(scm, uintptr(unsafe.Pointer(syscall.StringToUTF16Ptr(name))), serviceDelete)
+	if h == 0 {
+		return fmt.Errorf("service: %v", err)
+	}
+	defer procCloseServiceHandle.Call(h)
+	if r, _, err := procDeleteService.Call(h); r == 0 {
+		return fmt.Errorf("service: %v", err)
+	}
+	return smtp.RemoveEventSource(name)
+}
+
+func openSCManager() (uintptr, error) {
+	scm, _, err := procOpenSCManager.Call(0, 0, scManagerAllAccess)
+	if scm == 0 {
+		return 0, fmt.Errorf("service: %v", err)
+	}
+	return scm, nil
+}
+
+// startService connects to the service manager and reports the service
+// running, then leaves the server to main with the flags of the service.
+// Relative paths of the flags are of the directory of the binary rather
+// than of System32.
+func startService(name string, serverArgs []string) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	if err := os.Chdir(filepath.Dir(exe)); err != nil {
+		return err
+	}
+	os.Args = append([]string{os.Args[0]}, serverArgs...)
+	service.name = name
+	service.started = make(chan error, 1)
+	service.done = make(chan struct{})
+	go func() {
+		runtime.LockOSThread()
+		table := []serviceTableEntry{{syscall.StringToUTF16Ptr(name), syscall.NewCallback(serviceMain)}, {}}
+		// returns once the service is stopped
+		if r, _, err := procStartServiceCtrlDispatcher.Call(uintptr(unsafe.Pointer(&table[0]))); r == 0 {
+			service.started <- fmt.Errorf("service: not started by the service manager: %v", err)
+		}
+	}()
+	return <-service.started
+}
+
+func serviceMain(argc, argv uintptr) uintptr {
+	h, _, err := procRegisterServiceCtrlHandlerEx.Call(uintptr(unsafe.Pointer(syscall.StringToUTF16Ptr(service.name))),
+		syscall.NewCallback(serviceHandler), 0)
+	if h == 0 {
+		service.started <- fmt.Errorf("service: %v", err)
+		return 0
+	}
+	service.handle = h
+	setServiceStatus(serviceStateRunning, serviceAcceptStop|serviceAcceptShutdown)
+	service.started <- nil
+	<-service.done
+	return 0
+}
+
+func serviceHandler(control, eventType, eventData, context uintptr) uintptr {
+	switch control {
+	case serviceControlStop, serviceControlShutdown:
+		setServiceStatus(serviceStateStopPending, 0)
+		service.mtx.Lock()
+		for _, c := range service.signals {
+			select {
+			case c <- syscall.SIGTERM:
+			default:
+			}
+		}
+		service.mtx.Unlock()
+		return 0
+	case serviceControlInquire:
+		service.mtx.Lock()
+		state, accepted := service.status.CurrentState, service.status.ControlsAccepted
+		service.mtx.Unlock()
+		setServiceStatus(state, accepted)
+		return 0
+	}
+	return errorCallNotImplemented
+}
+
+func setServiceStatus(state, accepted uint32) error {
+	service.mtx.Lock()
+	defer service.mtx.Unlock()
+	service.status = serviceStatus{
+		ServiceType:      serviceWin32OwnProcess,
+		CurrentState:     state,
+		ControlsAccepted: accepted,
+	}
+	if r, _, err := procSetServiceStatus.Call(service.handle, uintptr(unsafe.Pointer(&service.status))); r == 0 {
+		return err
+	}
+	return nil
+}
+
+// serviceStopped reports the end of the process to the service manager, if
+// started by it.
+func serviceStopped() {
+	if service.handle == 0 {
+		return
+	}
+	setServiceStatus(serviceStateStopped, 0)
+	close(service.done)
+}
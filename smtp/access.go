@@ -0,0 +1,244 @@
+package smtp
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// AccessMap is a table in the format of the Postfix access(5) tables: a
+// key and an action per line, where lines starting with whitespace
+// continue the previous line.
+//
+//	192.168.1        REJECT
+//	198.51.100.0/24  DEFER Try again later
+//	example.net      OK
+//	spammer@         550 5.7.1 Go away
+//	<>               DUNNO
+//
+// Actions are OK and DUNNO, which stop the lookup without rejecting, a
+// number, which is OK, REJECT and DEFER with optional text, and a reply
+// code of 4xx or 5xx with text.
+type AccessMap struct {
+	entries  map[string]string
+	networks []accessNetwork
+}
+
+type accessNetwork struct {
+	ipnet  *net.IPNet
+	action string
+}
+
+// AccessMaps are the tables applied at each stage: Client to the client
+// IP address at the connection, Helo to the HELO name, Sender to the
+// MAIL address and Recipient to each RCPT address.
+type AccessMaps struct {
+	Client    *AccessMap
+	Helo      *AccessMap
+	Sender    *AccessMap
+	Recipient *AccessMap
+}
+
+// ParseAccessMap reads a table. Keys are compared case-insensitively.
+func ParseAccessMap(r io.Reader) (*AccessMap, error) {
+	m := &AccessMap{entries: make(map[string]string)}
+	lines := make([]string, 0)
+	numbers := make([]int, 0)
+	scanner := bufio.NewScanner(r)
+	n := 0
+	for scanner.Scan() {
+		n++
+		line := scanner.Text()
+		if len(strings.TrimSpace(line)) == 0 || strings.HasPrefix(strings.TrimSpace(line), "#") {
+			continue
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(lines) > 0 {
+			lines[len(lines)-1] += " " + strings.TrimSpace(line)
+			continue
+		}
+		lines = append(lines, strings.TrimSpace(line))
+		numbers = append(numbers, n)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	for i, line := range lines {
+		xs := strings.Fields(line)
+		if len(xs) < 2 {
+			return nil, fmt.Errorf("line %d: missing action", numbers[i])
+		}
+		key, action := strings.ToLower(xs[0]), strings.Join(xs[1:], " ")
+		if !validAccessAction(action) {
+			return nil, fmt.Errorf("line %d: unsupported action: %s", numbers[i], xs[1])
+		}
+		if strings.Contains(key, "/") {
+			_, ipnet, err := net.ParseCIDR(key)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid network: %s", numbers[i], key)
+			}
+			m.networks = append(m.networks, accessNetwork{ipnet, action})
+			continue
+		}
+		m.entries[key] = action
+	}
+	return m, nil
+}
+
+func validAccessAction(action string) bool {
+	verb := strings.ToUpper(strings.Fields(action)[0])
+	switch verb {
+	case "OK", "DUNNO", "REJECT", "DEFER":
+		return true
+	}
+	if _, err := strconv.Atoi(verb); err != nil {
+		return false
+	}
+	return len(verb) != 3 || verb[0] == '4' || verb[0] == '5'
+}
+
+// accessReply returns the reply of the action, or an empty string if it
+// does not reject.
+func accessReply(action string) string {
+	verb, text := action, ""
+	if i := strings.IndexByte(action, ' '); i >= 0 {
+		verb, text = action[:i], action[i+1:]
+	}
+	code := ""
+	switch strings.ToUpper(verb) {
+	case "REJECT":
+		code = "554 5.7.1 "
+	case "DEFER":
+		code = "450 4.7.1 "
+	default:
+		if len(verb) != 3 || (verb[0] != '4' && verb[0] != '5') {
+			return ""
+		}
+		return verb + " " + text
+	}
+	if len(text) == 0 {
+		text = "Access denied"
+	}
+	if hasEnhancedStatusCode(text) {
+		return code[:4] + text
+	}
+	return code + text
+}
+
+// lookup returns the action of the first key found.
+func (m *AccessMap) lookup(keys ...string) (string, bool) {
+	for _, x := range keys {
+		if action, ok := m.entries[strings.ToLower(x)]; ok {
+			return action, true
+		}
+	}
+	return "", false
+}
+
+// domainKeys returns the domain and its parent domains, each also with a
+// leading dot as in the tables without parent_domain_matches_subdomains.
+func domainKeys(domain string) []string {
+	keys := []string{domain}
+	for i := strings.IndexByte(domain, '.'); i >= 0; i = strings.IndexByte(domain, '.') {
+		domain = domain[i+1:]
+		keys = append(keys, "."+domain, domain)
+	}
+	return keys
+}
+
+// CheckClient returns the reply to reject the client IP address, looked
+// up by the address, its shorter octet or group prefixes and networks.
+func (m *AccessMap) CheckClient(ip string) string {
+	if m == nil {
+		return ""
+	}
+	sep := "."
+	if strings.Contains(ip, ":") {
+		sep = ":"
+	}
+	keys := []string{ip}
+	for x := ip; strings.Contains(x, sep); {
+		x = strings.TrimRight(x[:strings.LastIndex(x, sep)], sep)
+		if len(x) > 0 {
+			keys = append(keys, x)
+		}
+	}
+	if action, ok := m.lookup(keys...); ok {
+		return accessReply(action)
+	}
+	if addr := net.ParseIP(ip); addr != nil {
+		for _, x := range m.networks {
+			if x.ipnet.Contains(addr) {
+				return accessReply(x.action)
+			}
+		}
+	}
+	return ""
+}
+
+// CheckHost returns the reply to reject the host name, looked up by the
+// name and its parent domains.
+func (m *AccessMap) CheckHost(name string) string {
+	if m == nil {
+		return ""
+	}
+	action, _ := m.lookup(domainKeys(name)...)
+	return accessReply(action)
+}
+
+// CheckAddress returns the reply to reject the address, looked up by the
+// address, its domain and parent domains, and the local part with "@".
+// The null address is looked up by "<>".
+func (m *AccessMap) CheckAddress(addr string) string {
+	if m == nil {
+		return ""
+	}
+	if len(addr) == 0 {
+		action, _ := m.lookup("<>")
+		return accessReply(action)
+	}
+	keys := []string{addr}
+	if i := strings.LastIndexByte(addr, '@'); i >= 0 {
+		keys = append(append(keys, domainKeys(addr[i+1:])...), addr[:i+1])
+	}
+	action, _ := m.lookup(keys...)
+	return accessReply(action)
+}
+
+// checkAccess logs the rejection of the stage if reply is not empty.
+func checkAccess(conn *SMTPConnection, stage, reply string) string {
+	if len(reply) > 0 {
+		conn.LogSecurityEvent(EventPolicyReject, "stage", "access_"+stage, "reply", reply)
+	}
+	return reply
+}
+
+func (a *AccessMaps) checkClient(conn *SMTPConnection) string {
+	if a == nil {
+		return ""
+	}
+	return checkAccess(conn, "client", a.Client.CheckClient(conn.RemoteIP()))
+}
+
+func (a *AccessMaps) checkHelo(conn *SMTPConnection) string {
+	if a == nil {
+		return ""
+	}
+	return checkAccess(conn, "helo", a.Helo.CheckHost(conn.State().ClientName))
+}
+
+func (a *AccessMaps) checkSender(conn *SMTPConnection) string {
+	if a == nil {
+		return ""
+	}
+	return checkAccess(conn, "sender", a.Sender.CheckAddress(conn.State().ReturnTo))
+}
+
+func (a *AccessMaps) checkRecipient(conn *SMTPConnection, rcpt Address) string {
+	if a == nil {
+		return ""
+	}
+	return checkAccess(conn, "recipient", a.Recipient.CheckAddress(rcpt.String()))
+}
@@ -0,0 +1,71 @@
+package smtp
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseAccessMap(t *testing.T) {
+	m, err := ParseAccessMap(strings.NewReader("# clients\n" +
+		"192.168.1    REJECT\n" +
+		"198.51.100.0/24 DEFER Try\n" +
+		"   again later\n" +
+		"2001:db8     550 Go away\n" +
+		"example.net  OK\n" +
+		".example.org REJECT 5.7.0 Blocked domain\n" +
+		"spammer@     REJECT\n" +
+		"<>           DUNNO\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, x := range [][]string{
+		{m.CheckClient("192.168.1.2"), "554 5.7.1 Access denied"},
+		{m.CheckClient("198.51.100.7"), "450 4.7.1 Try again later"},
+		{m.CheckClient("2001:db8::1"), "550 Go away"},
+		{m.CheckClient("192.0.2.1"), ""},
+		{m.CheckHost("mx.example.org"), "554 5.7.0 Blocked domain"},
+		{m.CheckHost("example.org"), ""},
+		{m.CheckAddress("spammer@example.net"), ""},
+		{m.CheckAddress("spammer@example.com"), "554 5.7.1 Access denied"},
+		{m.CheckAddress("foo@sub.example.org"), "554 5.7.0 Blocked domain"},
+		{m.CheckAddress(""), ""},
+	} {
+		if x[0] != x[1] {
+			t.Errorf("expected: %q, actual: %q", x[1], x[0])
+		}
+	}
+
+	for _, x := range []string{"example.net\n", "example.net HOLD\n", "10.0.0.0/33 OK\n", "example.net 250 OK\n"} {
+		if _, err := ParseAccessMap(strings.NewReader(x)); err == nil {
+			t.Errorf("expected an error: %q", x)
+		}
+	}
+}
+
+func TestAccessMaps(t *testing.T) {
+	parse := func(s string) *AccessMap {
+		m, err := ParseAccessMap(strings.NewReader(s))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return m
+	}
+	conn := NewMockConn([]byte("EHLO spam.example.org\r\n" +
+		"EHLO localhost\r\n" +
+		"MAIL FROM: <foo@example.org>\r\n" +
+		"MAIL FROM: <foo@example.net>\r\n" +
+		"RCPT TO: <user1@example.com>\r\n" +
+		"RCPT TO: <abuse@example.com>\r\n" +
+		"QUIT\r\n"))
+	h := NewSMTPHandler(conn, nil)
+	h.Config.Access = &AccessMaps{
+		Helo:      parse("example.org REJECT\n"),
+		Sender:    parse("example.org DEFER\n"),
+		Recipient: parse("abuse@example.com 550 5.1.1 No such user\n"),
+	}
+	h.Run()
+	expected := "220 554 250 450 250 250 550 221"
+	if actual := replyCodes(conn.CloneOutputBuffer()); actual != expected {
+		t.Errorf("expected: %s, actual: %s", expected, actual)
+	}
+}
@@ -0,0 +1,494 @@
+package smtp
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const LetsEncryptURL = "https://acme-v02.api.letsencrypt.org/directory"
+
+const acmeALPNProto = "acme-tls/1"
+
+var oidACMEIdentifier = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 31}
+
+// ACMEManager obtains and renews a certificate of the host from an ACME
+// CA (RFC 8555), answering either HTTP-01 challenges with HTTPHandler or
+// TLS-ALPN-01 challenges (RFC 8737) with GetCertificate on port 443.
+// The account key and the certificate are kept in CacheDir.
+type ACMEManager struct {
+	DirectoryURL string
+	Email        string
+	Host         string
+	CacheDir     string
+
+	// Challenge is "http-01" or "tls-alpn-01".
+	Challenge string
+
+	// RenewBefore is the time before expiry to renew the certificate.
+	RenewBefore time.Duration
+
+	Client *http.Client
+
+	mtx        sync.Mutex
+	cert       *tls.Certificate
+	tokens     map[string]string
+	alpnCerts  map[string]*tls.Certificate
+	accountKey *ecdsa.PrivateKey
+	kid        string
+	nonce      string
+	directory  struct {
+		NewNonce   string `json:"newNonce"`
+		NewAccount string `json:"newAccount"`
+		NewOrder   string `json:"newOrder"`
+	}
+}
+
+func NewACMEManager(host, email, cacheDir string) *ACMEManager {
+	return &ACMEManager{
+		DirectoryURL: LetsEncryptURL,
+		Email:        email,
+		Host:         host,
+		CacheDir:     cacheDir,
+		Challenge:    "http-01",
+		RenewBefore:  30 * 24 * time.Hour,
+		Client:       &http.Client{Timeout: 30 * time.Second},
+		tokens:       make(map[string]string),
+		alpnCerts:    make(map[string]*tls.Certificate),
+	}
+}
+
+func (m *ACMEManager) certPath() string {
+	return filepath.Join(m.CacheDir, m.Host+".pem")
+}
+
+// GetCertificate returns the certificate, or the challenge certificate of
+// a TLS-ALPN-01 validation. It can be used as tls.Config.GetCertificate.
+func (m *ACMEManager) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	defer m.mtx.Unlock()
+	m.mtx.Lock()
+	for _, x := range hello.SupportedProtos {
+		if x == acmeALPNProto {
+			if cert, ok := m.alpnCerts[strings.ToLower(hello.ServerName)]; ok {
+				return cert, nil
+			}
+			return nil, errors.New("acme: no challenge for " + hello.ServerName)
+		}
+	}
+	if m.cert == nil {
+		return nil, errors.New("acme: no certificate yet")
+	}
+	return m.cert, nil
+}
+
+// HTTPHandler answers HTTP-01 challenges, passing other requests to next,
+// or answering 404 if it is nil.
+func (m *ACMEManager) HTTPHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		const prefix = "/.well-known/acme-challenge/"
+		if strings.HasPrefix(req.URL.Path, prefix) {
+			m.mtx.Lock()
+			keyAuth, ok := m.tokens[req.URL.Path[len(prefix):]]
+			m.mtx.Unlock()
+			if ok {
+				w.Header().Set("Content-Type", "text/plain")
+				io.WriteString(w, keyAuth)
+				return
+			}
+		}
+		if next == nil {
+			http.NotFound(w, req)
+			return
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+// Load reads the cached certificate. It returns false if there is none.
+func (m *ACMEManager) Load() bool {
+	cert, err := tls.LoadX509KeyPair(m.certPath(), m.certPath())
+	if err != nil {
+		return false
+	}
+	cert.Leaf, _ = x509.ParseCertificate(cert.Certificate[0])
+	m.mtx.Lock()
+	m.cert = &cert
+	m.mtx.Unlock()
+	return true
+}
+
+// NeedsRenewal reports whether there is no certificate or it expires
+// within RenewBefore.
+func (m *ACMEManager) NeedsRenewal(now time.Time) bool {
+	defer m.mtx.Unlock()
+	m.mtx.Lock()
+	return m.cert == nil || m.cert.Leaf == nil || now.Add(m.RenewBefore).After(m.cert.Leaf.NotAfter)
+}
+
+// Run loads the cached certificate and obtains a new one whenever it needs
+// renewal, checking every interval until the context is done. Errors are
+// passed to logf and retried at the next check.
+func (m *ACMEManager) Run(ctx context.Context, interval time.Duration, logf func(format string, args ...interface{})) {
+	m.Load()
+	for {
+		if m.NeedsRenewal(time.Now()) {
+			if err := m.Obtain(ctx); err != nil {
+				logf("acme: %v", err)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func (m *ACMEManager) loadAccountKey() error {
+	path := filepath.Join(m.CacheDir, "acme_account.key")
+	if b, err := os.ReadFile(path); err == nil {
+		if block, _ := pem.Decode(b); block != nil {
+			if key, err := x509.ParseECPrivateKey(block.Bytes); err == nil {
+				m.accountKey = key
+				return nil
+			}
+		}
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(m.CacheDir, 0700); err != nil {
+		return err
+	}
+	b := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+	if err := os.WriteFile(path, b, 0600); err != nil {
+		return err
+	}
+	m.accountKey = key
+	return nil
+}
+
+func (m *ACMEManager) jwk() string {
+	pub := m.accountKey.PublicKey
+	x, y := make([]byte, 32), make([]byte, 32)
+	pub.X.FillBytes(x)
+	pub.Y.FillBytes(y)
+	// members in lexicographic order for the thumbprint (RFC 7638)
+	return fmt.Sprintf(`{"crv":"P-256","kty":"EC","x":"%s","y":"%s"}`, b64(x), b64(y))
+}
+
+func (m *ACMEManager) keyAuthorization(token string) string {
+	h := sha256.Sum256([]byte(m.jwk()))
+	return token + "." + b64(h[:])
+}
+
+// post sends a JWS signed request (RFC 8555 section 6.2). A nil payload
+// makes a POST-as-GET.
+func (m *ACMEManager) post(ctx context.Context, url string, payload interface{}, v interface{}) (*http.Response, error) {
+	if len(m.nonce) == 0 {
+		req, err := http.NewRequest("HEAD", m.directory.NewNonce, nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := m.Client.Do(req.WithContext(ctx))
+		if err != nil {
+			return nil, err
+		}
+		resp.Body.Close()
+		m.nonce = resp.Header.Get("Replay-Nonce")
+	}
+	header := fmt.Sprintf(`{"alg":"ES256","nonce":%q,"url":%q,`, m.nonce, url)
+	if len(m.kid) > 0 {
+		header += fmt.Sprintf(`"kid":%q}`, m.kid)
+	} else {
+		header += `"jwk":` + m.jwk() + `}`
+	}
+	body := ""
+	if payload != nil {
+		b, err := json.Marshal(payload)
+		if err != nil {
+			return nil, err
+		}
+		body = b64(b)
+	}
+	protected := b64([]byte(header))
+	h := sha256.Sum256([]byte(protected + "." + body))
+	r, s, err := ecdsa.Sign(rand.Reader, m.accountKey, h[:])
+	if err != nil {
+		return nil, err
+	}
+	sig := make([]byte, 64)
+	r.FillBytes(sig[:32])
+	s.FillBytes(sig[32:])
+	b, _ := json.Marshal(map[string]string{"protected": protected, "payload": body, "signature": b64(sig)})
+	req, err := http.NewRequest("POST", url, bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/jose+json")
+	resp, err := m.Client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	m.nonce = resp.Header.Get("Replay-Nonce")
+	rb, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 400 {
+		return nil, fmt.Errorf("acme: %s: %s", resp.Status, rb)
+	}
+	if raw, ok := v.(*[]byte); ok {
+		*raw = rb
+	} else if v != nil {
+		if err := json.Unmarshal(rb, v); err != nil {
+			return nil, err
+		}
+	}
+	return resp, nil
+}
+
+type acmeOrder struct {
+	Status         string   `json:"status"`
+	Authorizations []string `json:"authorizations"`
+	Finalize       string   `json:"finalize"`
+	Certificate    string   `json:"certificate"`
+}
+
+type acmeAuthorization struct {
+	Status     string `json:"status"`
+	Identifier struct {
+		Value string `json:"value"`
+	} `json:"identifier"`
+	Challenges []struct {
+		Type  string `json:"type"`
+		URL   string `json:"url"`
+		Token string `json:"token"`
+	} `json:"challenges"`
+}
+
+// poll requests the resource until its status is no longer pending or
+// processing.
+func (m *ACMEManager) poll(ctx context.Context, url string, status *string, v interface{}) error {
+	for i := 0; i < 30; i++ {
+		if _, err := m.post(ctx, url, nil, v); err != nil {
+			return err
+		}
+		if *status != "pending" && *status != "processing" {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Second):
+		}
+	}
+	return errors.New("acme: timed out polling " + url)
+}
+
+// alpnCertificate returns the self-signed certificate of a TLS-ALPN-01
+// challenge.
+func alpnCertificate(host, keyAuth string) (*tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	h := sha256.Sum256([]byte(keyAuth))
+	ext, err := asn1.Marshal(h[:])
+	if err != nil {
+		return nil, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:    big.NewInt(1),
+		Subject:         pkix.Name{CommonName: host},
+		DNSNames:        []string{host},
+		NotBefore:       time.Now().Add(-time.Hour),
+		NotAfter:        time.Now().Add(24 * time.Hour),
+		ExtraExtensions: []pkix.Extension{{Id: oidACMEIdentifier, Critical: true, Value: ext}},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+// Obtain orders a certificate of the host, completes the challenge and
+// stores the issued certificate.
+func (m *ACMEManager) Obtain(ctx context.Context) error {
+	if m.accountKey == nil {
+		if err := m.loadAccountKey(); err != nil {
+			return err
+		}
+	}
+	if len(m.directory.NewOrder) == 0 {
+		req, err := http.NewRequest("GET", m.DirectoryURL, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := m.Client.Do(req.WithContext(ctx))
+		if err != nil {
+			return err
+		}
+		err = json.NewDecoder(resp.Body).Decode(&m.directory)
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+	}
+	if len(m.kid) == 0 {
+		account := map[string]interface{}{"termsOfServiceAgreed": true}
+		if len(m.Email) > 0 {
+			account["contact"] = []string{"mailto:" + m.Email}
+		}
+		resp, err := m.post(ctx, m.directory.NewAccount, account, nil)
+		if err != nil {
+			return err
+		}
+		m.kid = resp.Header.Get("Location")
+	}
+
+	var order acmeOrder
+	resp, err := m.post(ctx, m.directory.NewOrder, map[string]interface{}{
+		"identifiers": []map[string]string{{"type": "dns", "value": m.Host}},
+	}, &order)
+	if err != nil {
+		return err
+	}
+	orderURL := resp.Header.Get("Location")
+	for _, authzURL := range order.Authorizations {
+		if err := m.authorize(ctx, authzURL); err != nil {
+			return err
+		}
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: m.Host},
+		DNSNames: []string{m.Host},
+	}, key)
+	if err != nil {
+		return err
+	}
+	if _, err := m.post(ctx, order.Finalize, map[string]string{"csr": b64(csr)}, &order); err != nil {
+		return err
+	}
+	if err := m.poll(ctx, orderURL, &order.Status, &order); err != nil {
+		return err
+	}
+	if order.Status != "valid" {
+		return fmt.Errorf("acme: order is %s", order.Status)
+	}
+	var chain []byte
+	if _, err := m.post(ctx, order.Certificate, nil, &chain); err != nil {
+		return err
+	}
+	return m.store(key, chain)
+}
+
+func (m *ACMEManager) authorize(ctx context.Context, url string) error {
+	var authz acmeAuthorization
+	if _, err := m.post(ctx, url, nil, &authz); err != nil {
+		return err
+	}
+	if authz.Status == "valid" {
+		return nil
+	}
+	for _, c := range authz.Challenges {
+		if c.Type != m.Challenge {
+			continue
+		}
+		keyAuth := m.keyAuthorization(c.Token)
+		host := strings.ToLower(authz.Identifier.Value)
+		m.mtx.Lock()
+		if c.Type == "tls-alpn-01" {
+			cert, err := alpnCertificate(host, keyAuth)
+			if err != nil {
+				m.mtx.Unlock()
+				return err
+			}
+			m.alpnCerts[host] = cert
+		} else {
+			m.tokens[c.Token] = keyAuth
+		}
+		m.mtx.Unlock()
+		defer func() {
+			m.mtx.Lock()
+			delete(m.tokens, c.Token)
+			delete(m.alpnCerts, host)
+			m.mtx.Unlock()
+		}()
+		if _, err := m.post(ctx, c.URL, struct{}{}, nil); err != nil {
+			return err
+		}
+		if err := m.poll(ctx, url, &authz.Status, &authz); err != nil {
+			return err
+		}
+		if authz.Status != "valid" {
+			return fmt.Errorf("acme: authorization of %s is %s", host, authz.Status)
+		}
+		return nil
+	}
+	return fmt.Errorf("acme: no %s challenge for %s", m.Challenge, authz.Identifier.Value)
+}
+
+func (m *ACMEManager) store(key crypto.Signer, chain []byte) error {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+	b := append(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), chain...)
+	cert, err := tls.X509KeyPair(b, b)
+	if err != nil {
+		return err
+	}
+	cert.Leaf, _ = x509.ParseCertificate(cert.Certificate[0])
+	if err := os.MkdirAll(m.CacheDir, 0700); err != nil {
+		return err
+	}
+	tmp := m.certPath() + ".tmp"
+	if err := os.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, m.certPath()); err != nil {
+		return err
+	}
+	m.mtx.Lock()
+	m.cert = &cert
+	m.mtx.Unlock()
+	return nil
+}
@@ -0,0 +1,158 @@
+package smtp
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// serveACME runs a CA answering the requests of a single order, which
+// validates HTTP-01 challenges with the handler.
+func serveACME(t *testing.T, challenge http.Handler, ca tls.Certificate) *httptest.Server {
+	var srv *httptest.Server
+	validated := false
+	var issued []byte
+	payload := func(req *http.Request) []byte {
+		var jws struct {
+			Payload string `json:"payload"`
+		}
+		json.NewDecoder(req.Body).Decode(&jws)
+		b, _ := base64.RawURLEncoding.DecodeString(jws.Payload)
+		return b
+	}
+	order := func() string {
+		status := "pending"
+		if issued != nil {
+			status = "valid"
+		}
+		return fmt.Sprintf(`{"status":%q,"authorizations":[%q],"finalize":%q,"certificate":%q}`,
+			status, srv.URL+"/authz/1", srv.URL+"/finalize/1", srv.URL+"/cert/1")
+	}
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Replay-Nonce", "nonce")
+		switch req.URL.Path {
+		case "/dir":
+			fmt.Fprintf(w, `{"newNonce":%q,"newAccount":%q,"newOrder":%q}`,
+				srv.URL+"/nonce", srv.URL+"/account", srv.URL+"/order")
+		case "/nonce":
+		case "/account":
+			w.Header().Set("Location", srv.URL+"/acct/1")
+			w.WriteHeader(http.StatusCreated)
+		case "/order":
+			w.Header().Set("Location", srv.URL+"/order/1")
+			w.WriteHeader(http.StatusCreated)
+			io.WriteString(w, order())
+		case "/order/1":
+			io.WriteString(w, order())
+		case "/authz/1":
+			status := "pending"
+			if validated {
+				status = "valid"
+			}
+			fmt.Fprintf(w, `{"status":%q,"identifier":{"type":"dns","value":"mx.example.com"},`+
+				`"challenges":[{"type":"http-01","url":%q,"token":"tok"}]}`, status, srv.URL+"/chal/1")
+		case "/chal/1":
+			rec := httptest.NewRecorder()
+			challenge.ServeHTTP(rec, httptest.NewRequest("GET", "/.well-known/acme-challenge/tok", nil))
+			validated = strings.HasPrefix(rec.Body.String(), "tok.")
+			io.WriteString(w, `{}`)
+		case "/finalize/1":
+			var x struct {
+				CSR string `json:"csr"`
+			}
+			json.Unmarshal(payload(req), &x)
+			der, _ := base64.RawURLEncoding.DecodeString(x.CSR)
+			csr, err := x509.ParseCertificateRequest(der)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			tmpl := &x509.Certificate{
+				SerialNumber: big.NewInt(2),
+				DNSNames:     csr.DNSNames,
+				NotBefore:    time.Now().Add(-time.Hour),
+				NotAfter:     time.Now().Add(90 * 24 * time.Hour),
+			}
+			b, _ := x509.CreateCertificate(rand.Reader, tmpl, ca.Leaf, csr.PublicKey, ca.PrivateKey)
+			issued = append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: b}),
+				pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Leaf.Raw})...)
+			io.WriteString(w, order())
+		case "/cert/1":
+			w.Write(issued)
+		default:
+			http.NotFound(w, req)
+		}
+	}))
+	return srv
+}
+
+func TestACMEManager(t *testing.T) {
+	ca, _ := testCertificate(t, "ca.example.com")
+	m := NewACMEManager("mx.example.com", "postmaster@example.com", t.TempDir())
+	srv := serveACME(t, m.HTTPHandler(nil), ca)
+	defer srv.Close()
+	m.DirectoryURL = srv.URL + "/dir"
+	if !m.NeedsRenewal(time.Now()) {
+		t.Errorf("expected renewal without a certificate")
+	}
+	if err := m.Obtain(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	cert, err := m.GetCertificate(&tls.ClientHelloInfo{ServerName: "mx.example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert.Leaf.DNSNames[0] != "mx.example.com" || len(cert.Certificate) != 2 {
+		t.Errorf("unexpected certificate: %v", cert.Leaf.DNSNames)
+	}
+	if m.NeedsRenewal(time.Now()) || !m.NeedsRenewal(time.Now().Add(80*24*time.Hour)) {
+		t.Errorf("unexpected renewal")
+	}
+
+	// the certificate is cached
+	m2 := NewACMEManager("mx.example.com", "", m.CacheDir)
+	if !m2.Load() || m2.NeedsRenewal(time.Now()) {
+		t.Errorf("expected the cached certificate")
+	}
+}
+
+func TestACMEALPNChallenge(t *testing.T) {
+	m := NewACMEManager("mx.example.com", "", t.TempDir())
+	if err := m.loadAccountKey(); err != nil {
+		t.Fatal(err)
+	}
+	keyAuth := m.keyAuthorization("tok")
+	cert, err := alpnCertificate("mx.example.com", keyAuth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.alpnCerts["mx.example.com"] = cert
+	hello := &tls.ClientHelloInfo{ServerName: "mx.example.com", SupportedProtos: []string{acmeALPNProto}}
+	actual, err := m.GetCertificate(hello)
+	if err != nil || actual != cert {
+		t.Fatalf("unexpected certificate: %v", err)
+	}
+	leaf, _ := x509.ParseCertificate(actual.Certificate[0])
+	found := false
+	for _, ext := range leaf.Extensions {
+		found = found || (ext.Id.Equal(oidACMEIdentifier) && ext.Critical)
+	}
+	if !found {
+		t.Errorf("expected the acmeIdentifier extension")
+	}
+	if _, err := m.GetCertificate(&tls.ClientHelloInfo{ServerName: "mx.example.com"}); err == nil {
+		t.Errorf("expected an error without a certificate")
+	}
+}
@@ -0,0 +1,166 @@
+package smtp
+
+import (
+	"errors"
+	"net"
+	"strings"
+)
+
+var ErrInvalidAddress = errors.New("smtp: invalid mailbox address")
+
+// Address is a mailbox of a forward or reverse path as defined in RFC 5321.
+// LocalPart is unquoted, and Domain is either a domain name or an address
+// literal including the enclosing brackets.
+type Address struct {
+	LocalPart string
+	Domain    string
+}
+
+func (a Address) String() string {
+	return quoteLocalPart(a.LocalPart) + "@" + a.Domain
+}
+
+// ParseAddress parses the content of a path without the angle brackets.
+// A leading source route (@a.example,@b.example:) is accepted and ignored.
+func ParseAddress(s string) (Address, error) {
+	if strings.HasPrefix(s, "@") {
+		i := strings.IndexByte(s, ':')
+		if i < 0 {
+			return Address{}, ErrInvalidAddress
+		}
+		for _, x := range strings.Split(s[:i], ",") {
+			if !strings.HasPrefix(x, "@") || !isValidDomain(x[1:]) {
+				return Address{}, ErrInvalidAddress
+			}
+		}
+		s = s[i+1:]
+	}
+	local, rest, err := parseLocalPart(s)
+	if err != nil {
+		return Address{}, err
+	}
+	if !strings.HasPrefix(rest, "@") {
+		return Address{}, ErrInvalidAddress
+	}
+	domain := rest[1:]
+	if strings.HasPrefix(domain, "[") {
+		if !isValidAddressLiteral(domain) {
+			return Address{}, ErrInvalidAddress
+		}
+	} else if !isValidDomain(domain) {
+		return Address{}, ErrInvalidAddress
+	}
+	return Address{LocalPart: local, Domain: domain}, nil
+}
+
+func parseLocalPart(s string) (string, string, error) {
+	if !strings.HasPrefix(s, "\"") {
+		i := strings.LastIndexByte(s, '@')
+		if i < 0 || !isDotString(s[:i]) {
+			return "", "", ErrInvalidAddress
+		}
+		return s[:i], s[i:], nil
+	}
+	local := ""
+	for i := 1; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '"':
+			return local, s[i+1:], nil
+		case c == '\\':
+			if i+1 >= len(s) || s[i+1] < 32 || s[i+1] > 126 {
+				return "", "", ErrInvalidAddress
+			}
+			i++
+			local += s[i : i+1]
+		case c == 32 || c == 33 || (35 <= c && c <= 91) || (93 <= c && c <= 126) ||
+			c >= 0x80:
+			local += s[i : i+1]
+		default:
+			return "", "", ErrInvalidAddress
+		}
+	}
+	return "", "", ErrInvalidAddress
+}
+
+func isAtext(c byte) bool {
+	return ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') ||
+		('0' <= c && c <= '9') || strings.IndexByte("!#$%&'*+-/=?^_`{|}~", c) >= 0 ||
+		c >= 0x80
+}
+
+func isDotString(s string) bool {
+	if len(s) == 0 {
+		return false
+	}
+	// atoms separated by single dots, without splitting s
+	atom := 0
+	for i := 0; i < len(s); i++ {
+		if s[i] == '.' {
+			if atom == 0 {
+				return false
+			}
+			atom = 0
+			continue
+		}
+		if !isAtext(s[i]) {
+			return false
+		}
+		atom++
+	}
+	return atom > 0
+}
+
+func quoteLocalPart(s string) string {
+	if isDotString(s) {
+		return s
+	}
+	q := "\""
+	for i := 0; i < len(s); i++ {
+		if s[i] == '"' || s[i] == '\\' {
+			q += "\\"
+		}
+		q += s[i : i+1]
+	}
+	return q + "\""
+}
+
+func isValidDomain(s string) bool {
+	if len(s) == 0 || len(s) > 255 {
+		return false
+	}
+	for len(s) > 0 {
+		label, rest, found := strings.Cut(s, ".")
+		if found && len(rest) == 0 {
+			// a trailing dot is an empty label
+			return false
+		}
+		s = rest
+		if len(label) == 0 || len(label) > 63 ||
+			label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for i := 0; i < len(label); i++ {
+			c := label[i]
+			isLetDig := ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') ||
+				('0' <= c && c <= '9')
+			if !isLetDig && c != '-' && c < 0x80 {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func isValidAddressLiteral(s string) bool {
+	if len(s) < 3 || s[0] != '[' || s[len(s)-1] != ']' {
+		return false
+	}
+	lit := s[1 : len(s)-1]
+	if strings.HasPrefix(lit, "IPv6:") {
+		ip := net.ParseIP(lit[len("IPv6:"):])
+		return ip != nil && strings.Contains(lit[len("IPv6:"):], ":")
+	}
+	ip := net.ParseIP(lit)
+	return ip != nil && ip.To4() != nil && !strings.Contains(lit, ":")
+}
@@ -0,0 +1,63 @@
+package smtp
+
+import (
+	"testing"
+)
+
+func TestParseAddress(t *testing.T) {
+	tests := map[string]Address{
+		"foo@example.net":                     {"foo", "example.net"},
+		"foo.bar+baz@mail.example.net":        {"foo.bar+baz", "mail.example.net"},
+		"\"foo bar\"@example.net":             {"foo bar", "example.net"},
+		"\"foo\\\"@\\\\bar\"@example.net":     {"foo\"@\\bar", "example.net"},
+		"@a.example,@b.example:foo@c.example": {"foo", "c.example"},
+		"postmaster@[127.0.0.1]":              {"postmaster", "[127.0.0.1]"},
+		"postmaster@[IPv6:2001:db8::1]":       {"postmaster", "[IPv6:2001:db8::1]"},
+		"用户@例子.广告":                            {"用户", "例子.广告"},
+	}
+	for s, expected := range tests {
+		actual, err := ParseAddress(s)
+		if err != nil {
+			t.Errorf("%s: %s", s, err)
+			continue
+		}
+		if actual != expected {
+			t.Errorf("expected: %v, actual: %v", expected, actual)
+		}
+	}
+
+	invalid := []string{
+		"",
+		"foo",
+		"@example.net",
+		"foo@",
+		"foo..bar@example.net",
+		".foo@example.net",
+		"foo bar@example.net",
+		"\"foo@example.net",
+		"foo@-example.net",
+		"foo@example..net",
+		"foo@[127.0.0.256]",
+		"foo@[2001:db8::1]",
+		"@a.example:",
+		"@a.example foo@example.net",
+	}
+	for _, s := range invalid {
+		if _, err := ParseAddress(s); err == nil {
+			t.Errorf("%s must be invalid", s)
+		}
+	}
+}
+
+func TestAddressString(t *testing.T) {
+	tests := map[Address]string{
+		{"foo", "example.net"}:      "foo@example.net",
+		{"foo bar", "example.net"}:  "\"foo bar\"@example.net",
+		{"foo\"bar", "[127.0.0.1]"}: "\"foo\\\"bar\"@[127.0.0.1]",
+	}
+	for addr, expected := range tests {
+		if actual := addr.String(); actual != expected {
+			t.Errorf("expected: %s, actual: %s", expected, actual)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package smtp
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+)
+
+type aliasPattern struct {
+	re      *regexp.Regexp
+	targets []string
+}
+
+// AliasMap rewrites recipients to one or more replacement addresses. Keys
+// are looked up in the order of an exact address, a domain wildcard
+// ("@example.net"), a regular expression ("/^test-.*@/") and the catch-all
+// "*". A target starting with "@" keeps the original local part, and a
+// target of a regular expression may refer to submatches like "$1".
+type AliasMap struct {
+	exact    map[string][]string
+	domains  map[string][]string
+	patterns []aliasPattern
+	catchAll []string
+}
+
+func NewAliasMap() *AliasMap {
+	return &AliasMap{
+		exact:   make(map[string][]string),
+		domains: make(map[string][]string),
+	}
+}
+
+func (m *AliasMap) Add(key string, targets ...string) error {
+	for _, x := range targets {
+		if strings.Contains(x, "$") {
+			continue
+		}
+		if strings.HasPrefix(x, "@") {
+			x = "postmaster" + x
+		}
+		if _, err := ParseAddress(x); err != nil {
+			return fmt.Errorf("invalid target: %s", x)
+		}
+	}
+	switch {
+	case key == "*":
+		m.catchAll = targets
+	case strings.HasPrefix(key, "/") && strings.HasSuffix(key, "/") && len(key) > 1:
+		re, err := regexp.Compile(key[1 : len(key)-1])
+		if err != nil {
+			return err
+		}
+		m.patterns = append(m.patterns, aliasPattern{re, targets})
+	case strings.HasPrefix(key, "@"):
+		m.domains[strings.ToLower(key[1:])] = targets
+	default:
+		addr, err := ParseAddress(key)
+		if err != nil {
+			return err
+		}
+		m.exact[aliasKey(addr)] = targets
+	}
+	return nil
+}
+
+func aliasKey(addr Address) string {
+	return addr.LocalPart + "@" + strings.ToLower(addr.Domain)
+}
+
+// Resolve returns the replacements of the address, or false if no alias
+// matches.
+func (m *AliasMap) Resolve(addr Address) ([]Address, bool, error) {
+	targets, ok := m.exact[aliasKey(addr)]
+	if !ok {
+		targets, ok = m.domains[strings.ToLower(addr.Domain)]
+	}
+	if !ok {
+		s := addr.String()
+		for _, p := range m.patterns {
+			if match := p.re.FindStringSubmatchIndex(s); match != nil {
+				targets = make([]string, len(p.targets))
+				for i, x := range p.targets {
+					targets[i] = string(p.re.ExpandString(nil, x, s, match))
+				}
+				ok = true
+				break
+			}
+		}
+	}
+	if !ok && m.catchAll != nil {
+		targets, ok = m.catchAll, true
+	}
+	if !ok {
+		return nil, false, nil
+	}
+	xs := make([]Address, 0, len(targets))
+	for _, x := range targets {
+		if strings.HasPrefix(x, "@") {
+			x = addr.LocalPart + x
+		}
+		a, err := ParseAddress(x)
+		if err != nil {
+			return nil, true, err
+		}
+		xs = append(xs, a)
+	}
+	return xs, true, nil
+}
+
+// ParseAliasMap reads aliases in the form of "key: target, ...", one per
+// line. Empty lines and lines starting with "#" are ignored.
+func ParseAliasMap(r io.Reader) (*AliasMap, error) {
+	m := NewAliasMap()
+	scanner := bufio.NewScanner(r)
+	n := 0
+	for scanner.Scan() {
+		n++
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.Index(line, ":")
+		if strings.HasPrefix(line, "/") {
+			i = strings.LastIndex(line, "/") + 1
+			if i >= len(line) || line[i] != ':' {
+				i = -1
+			}
+		}
+		if i <= 0 {
+			return nil, fmt.Errorf("line %d: missing ':'", n)
+		}
+		targets := make([]string, 0)
+		for _, x := range strings.Split(line[i+1:], ",") {
+			if x = strings.TrimSpace(x); len(x) > 0 {
+				targets = append(targets, x)
+			}
+		}
+		if len(targets) == 0 {
+			return nil, fmt.Errorf("line %d: missing targets", n)
+		}
+		if err := m.Add(strings.TrimSpace(line[:i]), targets...); err != nil {
+			return nil, fmt.Errorf("line %d: %v", n, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
@@ -0,0 +1,53 @@
+package smtp
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestAliasMap(t *testing.T) {
+	m, err := ParseAliasMap(strings.NewReader(
+		"# redirect everything to the test inbox\n" +
+			"postmaster@example.net: admin1@example.net, admin2@example.net\n" +
+			"@old.example.net: @new.example.net\n" +
+			"/^(.+)\\+test@example\\.org$/: $1@test.example.org\n" +
+			"*: inbox@example.com\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		addr     string
+		expected string
+	}{
+		{"postmaster@EXAMPLE.net", "admin1@example.net admin2@example.net"},
+		{"foo@old.example.net", "foo@new.example.net"},
+		{"foo+test@example.org", "foo@test.example.org"},
+		{"foo@example.com", "inbox@example.com"},
+	}
+	for _, x := range tests {
+		addr, _ := ParseAddress(x.addr)
+		xs, ok, err := m.Resolve(addr)
+		if !ok || err != nil {
+			t.Errorf("expected %s to be resolved: %v", x.addr, err)
+			continue
+		}
+		actual := make([]string, len(xs))
+		for i, a := range xs {
+			actual[i] = a.String()
+		}
+		if strings.Join(actual, " ") != x.expected {
+			t.Errorf("expected: %s, actual: %s", x.expected, actual)
+		}
+	}
+
+	m = NewAliasMap()
+	addr, _ := ParseAddress("foo@example.net")
+	if _, ok, _ := m.Resolve(addr); ok {
+		t.Errorf("expected no alias")
+	}
+	for _, x := range []string{"foo@example.net", "foo@example.net: bar@", "/(/: bar@example.net"} {
+		if _, err := ParseAliasMap(strings.NewReader(x)); err == nil {
+			t.Errorf("expected an error: %s", x)
+		}
+	}
+}
@@ -0,0 +1,325 @@
+package smtp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// AMQPSink publishes each message to an AMQP 0-9-1 exchange with publisher
+// confirms. The routing key is the recipient domain unless RoutingKey is set.
+type AMQPSink struct {
+	Addr        string
+	VirtualHost string
+	Username    string
+	Password    string
+	Exchange    string
+	RoutingKey  string
+	Timeout     time.Duration
+}
+
+func NewAMQPSink(addr string) *AMQPSink {
+	return &AMQPSink{
+		Addr:        addr,
+		VirtualHost: "/",
+		Username:    "guest",
+		Password:    "guest",
+		Timeout:     10 * time.Second,
+	}
+}
+
+const (
+	amqpFrameMethod    = 1
+	amqpFrameHeader    = 2
+	amqpFrameBody      = 3
+	amqpFrameHeartbeat = 8
+	amqpFrameEnd       = 0xce
+)
+
+type amqpConn struct {
+	r        *bufio.Reader
+	w        *bufio.Writer
+	frameMax uint32
+}
+
+func (c *amqpConn) writeFrame(kind byte, channel uint16, payload []byte) error {
+	var b amqpEncoder
+	b.WriteByte(kind)
+	b.short(channel)
+	b.long(uint32(len(payload)))
+	b.Write(payload)
+	b.WriteByte(amqpFrameEnd)
+	_, err := c.w.Write(b.Bytes())
+	return err
+}
+
+func (c *amqpConn) writeMethod(channel, class, method uint16, args []byte) error {
+	var b amqpEncoder
+	b.short(class)
+	b.short(method)
+	b.Write(args)
+	if err := c.writeFrame(amqpFrameMethod, channel, b.Bytes()); err != nil {
+		return err
+	}
+	return c.w.Flush()
+}
+
+// readMethod returns the arguments of the next method, skipping heartbeats.
+// Close methods of the server are returned as errors.
+func (c *amqpConn) readMethod(class, method uint16) (*amqpDecoder, error) {
+	for {
+		var head [7]byte
+		if _, err := io.ReadFull(c.r, head[:]); err != nil {
+			return nil, err
+		}
+		payload := make([]byte, binary.BigEndian.Uint32(head[3:])+1)
+		if _, err := io.ReadFull(c.r, payload); err != nil {
+			return nil, err
+		}
+		if payload[len(payload)-1] != amqpFrameEnd {
+			return nil, errors.New("amqp: malformed frame")
+		}
+		if head[0] == amqpFrameHeartbeat {
+			continue
+		}
+		if head[0] != amqpFrameMethod {
+			return nil, fmt.Errorf("amqp: unexpected frame type %d", head[0])
+		}
+		d := &amqpDecoder{b: payload[:len(payload)-1]}
+		cls, m := d.short(), d.short()
+		if d.err != nil {
+			return nil, d.err
+		}
+		if (cls == 10 || cls == 20) && m == 40 && !(cls == class && m == method) {
+			code := d.short()
+			text := d.shortstr()
+			return nil, fmt.Errorf("amqp: %d %s", code, text)
+		}
+		if cls != class || m != method {
+			return nil, fmt.Errorf("amqp: unexpected method %d.%d", cls, m)
+		}
+		return d, nil
+	}
+}
+
+func (a *AMQPSink) Publish(st *SMTPState) error {
+	records, err := sinkRecords(st)
+	if err != nil {
+		return err
+	}
+	conn, err := net.DialTimeout("tcp", a.Addr, a.Timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(a.Timeout))
+	c := &amqpConn{r: bufio.NewReader(conn), w: bufio.NewWriter(conn)}
+	if err := a.open(c); err != nil {
+		return err
+	}
+	for i, rec := range records {
+		key := a.RoutingKey
+		if len(key) == 0 {
+			key = rec.key
+		}
+		if err := a.publish(c, key, rec); err != nil {
+			return err
+		}
+		d, err := c.readMethod(60, 80)
+		if err != nil {
+			return err
+		}
+		if tag := d.longlong(); tag != uint64(i+1) {
+			return fmt.Errorf("amqp: unexpected delivery tag %d", tag)
+		}
+	}
+	var args amqpEncoder
+	args.short(200)
+	args.shortstr("")
+	args.short(0)
+	args.short(0)
+	if err := c.writeMethod(0, 10, 50, args.Bytes()); err != nil {
+		return err
+	}
+	_, err = c.readMethod(10, 51)
+	return err
+}
+
+// open performs the handshake and puts channel 1 into confirm mode.
+func (a *AMQPSink) open(c *amqpConn) error {
+	if _, err := c.w.WriteString("AMQP\x00\x00\x09\x01"); err != nil {
+		return err
+	}
+	if err := c.w.Flush(); err != nil {
+		return err
+	}
+	if _, err := c.readMethod(10, 10); err != nil {
+		return err
+	}
+	var args amqpEncoder
+	args.table([][2]string{{"product", "mproxy"}})
+	args.shortstr("PLAIN")
+	args.longstr("\x00" + a.Username + "\x00" + a.Password)
+	args.shortstr("en_US")
+	if err := c.writeMethod(0, 10, 11, args.Bytes()); err != nil {
+		return err
+	}
+	d, err := c.readMethod(10, 30)
+	if err != nil {
+		return err
+	}
+	channelMax, frameMax := d.short(), d.long()
+	if frameMax == 0 || frameMax > 131072 {
+		frameMax = 131072
+	}
+	c.frameMax = frameMax
+	args.Reset()
+	args.short(channelMax)
+	args.long(frameMax)
+	args.short(0)
+	if err := c.writeMethod(0, 10, 31, args.Bytes()); err != nil {
+		return err
+	}
+	args.Reset()
+	args.shortstr(a.VirtualHost)
+	args.shortstr("")
+	args.WriteByte(0)
+	if err := c.writeMethod(0, 10, 40, args.Bytes()); err != nil {
+		return err
+	}
+	if _, err := c.readMethod(10, 41); err != nil {
+		return err
+	}
+	args.Reset()
+	args.shortstr("")
+	if err := c.writeMethod(1, 20, 10, args.Bytes()); err != nil {
+		return err
+	}
+	if _, err := c.readMethod(20, 11); err != nil {
+		return err
+	}
+	if err := c.writeMethod(1, 85, 10, []byte{0}); err != nil {
+		return err
+	}
+	_, err = c.readMethod(85, 11)
+	return err
+}
+
+func (a *AMQPSink) publish(c *amqpConn, key string, rec sinkRecord) error {
+	var args amqpEncoder
+	args.short(0)
+	args.shortstr(a.Exchange)
+	args.shortstr(key)
+	args.WriteByte(0)
+	var method amqpEncoder
+	method.short(60)
+	method.short(40)
+	method.Write(args.Bytes())
+	if err := c.writeFrame(amqpFrameMethod, 1, method.Bytes()); err != nil {
+		return err
+	}
+
+	var header amqpEncoder
+	header.short(60)
+	header.short(0)
+	binary.Write(&header, binary.BigEndian, uint64(len(rec.value)))
+	header.short(1<<15 | 1<<13 | 1<<12 | 1<<7)
+	header.shortstr("message/rfc822")
+	header.table(rec.headers)
+	header.WriteByte(2) // persistent
+	messageID := ""
+	for _, h := range rec.headers {
+		if h[0] == "message_id" {
+			messageID = h[1]
+		}
+	}
+	header.shortstr(messageID)
+	if err := c.writeFrame(amqpFrameHeader, 1, header.Bytes()); err != nil {
+		return err
+	}
+
+	max := int(c.frameMax) - 8
+	for b := rec.value; len(b) > 0; {
+		n := len(b)
+		if n > max {
+			n = max
+		}
+		if err := c.writeFrame(amqpFrameBody, 1, b[:n]); err != nil {
+			return err
+		}
+		b = b[n:]
+	}
+	return c.w.Flush()
+}
+
+type amqpEncoder struct {
+	bytes.Buffer
+}
+
+func (e *amqpEncoder) short(v uint16) {
+	binary.Write(e, binary.BigEndian, v)
+}
+
+func (e *amqpEncoder) long(v uint32) {
+	binary.Write(e, binary.BigEndian, v)
+}
+
+func (e *amqpEncoder) shortstr(s string) {
+	if len(s) > 255 {
+		s = s[:255]
+	}
+	e.WriteByte(byte(len(s)))
+	e.WriteString(s)
+}
+
+func (e *amqpEncoder) longstr(s string) {
+	e.long(uint32(len(s)))
+	e.WriteString(s)
+}
+
+func (e *amqpEncoder) table(fields [][2]string) {
+	var b amqpEncoder
+	for _, f := range fields {
+		b.shortstr(f[0])
+		b.WriteByte('S')
+		b.longstr(f[1])
+	}
+	e.long(uint32(b.Len()))
+	e.Write(b.Bytes())
+}
+
+type amqpDecoder struct {
+	b   []byte
+	err error
+}
+
+func (d *amqpDecoder) next(n int) []byte {
+	if d.err != nil || len(d.b) < n {
+		d.err = errors.New("amqp: malformed frame")
+		return make([]byte, n)
+	}
+	x := d.b[:n]
+	d.b = d.b[n:]
+	return x
+}
+
+func (d *amqpDecoder) short() uint16 {
+	return binary.BigEndian.Uint16(d.next(2))
+}
+
+func (d *amqpDecoder) long() uint32 {
+	return binary.BigEndian.Uint32(d.next(4))
+}
+
+func (d *amqpDecoder) longlong() uint64 {
+	return binary.BigEndian.Uint64(d.next(8))
+}
+
+func (d *amqpDecoder) shortstr() string {
+	return string(d.next(int(d.next(1)[0])))
+}
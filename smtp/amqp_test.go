@@ -0,0 +1,156 @@
+package smtp
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+)
+
+type amqpTestMessage struct {
+	exchange   string
+	routingKey string
+	headers    map[string]string
+	body       string
+}
+
+func readAMQPTestFrame(r io.Reader) (byte, *amqpDecoder, error) {
+	var head [7]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return 0, nil, err
+	}
+	payload := make([]byte, binary.BigEndian.Uint32(head[3:])+1)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	return head[0], &amqpDecoder{b: payload[:len(payload)-1]}, nil
+}
+
+// serveAMQP accepts any login and confirms each published message.
+func serveAMQP(t *testing.T, lsnr net.Listener, msgs chan<- amqpTestMessage) {
+	conn, err := lsnr.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	c := &amqpConn{r: r, w: bufio.NewWriter(conn)}
+	proto := make([]byte, 8)
+	io.ReadFull(r, proto)
+	if string(proto) != "AMQP\x00\x00\x09\x01" {
+		t.Errorf("unexpected protocol header: %q", proto)
+		return
+	}
+	var args amqpEncoder
+	args.WriteByte(0)
+	args.WriteByte(9)
+	args.table(nil)
+	args.longstr("PLAIN")
+	args.longstr("en_US")
+	c.writeMethod(0, 10, 10, args.Bytes())
+	tag := uint64(0)
+	var msg amqpTestMessage
+	for {
+		kind, d, err := readAMQPTestFrame(r)
+		if err != nil {
+			return
+		}
+		switch kind {
+		case amqpFrameHeader:
+			d.next(12)
+			d.short()
+			d.shortstr()
+			tb := &amqpDecoder{b: d.next(int(d.long()))}
+			msg.headers = make(map[string]string)
+			for tb.err == nil && len(tb.b) > 0 {
+				k := tb.shortstr()
+				tb.next(1)
+				msg.headers[k] = string(tb.next(int(tb.long())))
+			}
+			continue
+		case amqpFrameBody:
+			msg.body += string(d.b)
+			if len(msg.body) < len("Subject: AMQP\r\n\r\nHello\r\n") {
+				continue
+			}
+			msgs <- msg
+			tag++
+			var ack amqpEncoder
+			binary.Write(&ack, binary.BigEndian, tag)
+			ack.WriteByte(0)
+			c.writeMethod(1, 60, 80, ack.Bytes())
+			continue
+		}
+		class, method := d.short(), d.short()
+		switch {
+		case class == 10 && method == 11:
+			args.Reset()
+			args.short(0)
+			args.long(4096)
+			args.short(0)
+			c.writeMethod(0, 10, 30, args.Bytes())
+		case class == 10 && method == 40:
+			if vhost := d.shortstr(); vhost != "mail" {
+				t.Errorf("expected: mail, actual: %s", vhost)
+			}
+			c.writeMethod(0, 10, 41, []byte{0})
+		case class == 20 && method == 10:
+			c.writeMethod(1, 20, 11, []byte{0, 0, 0, 0})
+		case class == 85 && method == 10:
+			c.writeMethod(1, 85, 11, nil)
+		case class == 60 && method == 40:
+			d.short()
+			msg = amqpTestMessage{exchange: d.shortstr(), routingKey: d.shortstr()}
+		case class == 10 && method == 50:
+			c.writeMethod(0, 10, 51, nil)
+			return
+		}
+	}
+}
+
+func TestAMQPSink(t *testing.T) {
+	lsnr, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip(err)
+	}
+	defer lsnr.Close()
+	msgs := make(chan amqpTestMessage, 4)
+	go serveAMQP(t, lsnr, msgs)
+
+	st := &SMTPState{}
+	st.Reset()
+	st.ReturnTo = "foo@example.net"
+	for _, x := range []string{"user1@example.net", "user2@example.org"} {
+		addr, _ := ParseAddress(x)
+		st.Recipients = append(st.Recipients, x)
+		st.RecipientAddresses = append(st.RecipientAddresses, addr)
+	}
+	st.Headers = []string{"Subject: AMQP"}
+	st.SetContent([]byte("Hello\r\n"))
+	sink, err := NewSink("amqp://user:pass@" + lsnr.Addr().String() + "/mail?exchange=smtp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.Publish(st); err != nil {
+		t.Fatal(err)
+	}
+	close(msgs)
+	expected := []string{"example.net", "example.org"}
+	i := 0
+	for msg := range msgs {
+		if msg.exchange != "smtp" || msg.routingKey != expected[i] {
+			t.Errorf("expected: smtp %s, actual: %s %s", expected[i], msg.exchange, msg.routingKey)
+		}
+		if msg.headers["mail_from"] != "foo@example.net" {
+			t.Errorf("unexpected headers: %v", msg.headers)
+		}
+		if msg.body != "Subject: AMQP\r\n\r\nHello\r\n" {
+			t.Errorf("unexpected body: %q", msg.body)
+		}
+		i++
+	}
+	if i != len(expected) {
+		t.Errorf("expected %d messages, actual: %d", len(expected), i)
+	}
+}
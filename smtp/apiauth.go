@@ -0,0 +1,188 @@
+package smtp
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// APIScope is what a client of the HTTP API may do.
+type APIScope int
+
+const (
+	// ScopeNone is granted to unknown clients.
+	ScopeNone APIScope = iota
+	// ScopeRead allows GET and HEAD.
+	ScopeRead
+	// ScopeAdmin allows any method, e.g. DELETE of sessions and messages.
+	ScopeAdmin
+)
+
+func parseAPIScope(s string) (APIScope, error) {
+	switch s {
+	case "read":
+		return ScopeRead, nil
+	case "admin":
+		return ScopeAdmin, nil
+	}
+	return ScopeNone, fmt.Errorf("unknown scope: %s", s)
+}
+
+type apiUser struct {
+	password string
+	scope    APIScope
+}
+
+// APIAuth authenticates clients of the HTTP API by bearer tokens, basic
+// auth or the common name of a client certificate verified by the TLS
+// listener, each granted a scope.
+type APIAuth struct {
+	tokens map[string]APIScope
+	users  map[string]apiUser
+	certs  map[string]APIScope
+}
+
+func NewAPIAuth() *APIAuth {
+	return &APIAuth{
+		tokens: make(map[string]APIScope),
+		users:  make(map[string]apiUser),
+		certs:  make(map[string]APIScope),
+	}
+}
+
+func (a *APIAuth) AddToken(token string, scope APIScope) {
+	a.tokens[token] = scope
+}
+
+func (a *APIAuth) AddUser(username, password string, scope APIScope) {
+	a.users[username] = apiUser{password, scope}
+}
+
+// AddClientCert grants the scope to verified client certificates of the
+// common name.
+func (a *APIAuth) AddClientCert(commonName string, scope APIScope) {
+	a.certs[commonName] = scope
+}
+
+// ParseAPIAuth reads the credentials in the forms below, one per line.
+//
+//	token  <token>            read|admin
+//	user   <name> <password>  read|admin
+//	cert   <common-name>      read|admin
+func ParseAPIAuth(r io.Reader) (*APIAuth, error) {
+	a := NewAPIAuth()
+	scanner := bufio.NewScanner(r)
+	n := 0
+	for scanner.Scan() {
+		n++
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		xs := strings.Fields(line)
+		arity := map[string]int{"token": 3, "user": 4, "cert": 3}[xs[0]]
+		if arity == 0 {
+			return nil, fmt.Errorf("line %d: unknown credential: %s", n, xs[0])
+		}
+		if len(xs) != arity {
+			return nil, fmt.Errorf("line %d: expected %d fields", n, arity)
+		}
+		scope, err := parseAPIScope(xs[arity-1])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", n, err)
+		}
+		switch xs[0] {
+		case "token":
+			a.AddToken(xs[1], scope)
+		case "user":
+			a.AddUser(xs[1], xs[2], scope)
+		case "cert":
+			a.AddClientCert(xs[1], scope)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func secureEqual(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// Scope returns the highest scope granted to the request.
+func (a *APIAuth) Scope(r *http.Request) APIScope {
+	_, scope := a.identify(r)
+	return scope
+}
+
+// identify returns the highest scope granted to the request, and the
+// user or the common name of the client certificate granted it. Tokens
+// have no identity.
+func (a *APIAuth) identify(r *http.Request) (string, APIScope) {
+	identity, scope := "", ScopeNone
+	grant := func(name string, s APIScope) {
+		if s > scope {
+			identity, scope = name, s
+		}
+	}
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		for k, s := range a.tokens {
+			if secureEqual(k, token) {
+				grant("", s)
+			}
+		}
+	}
+	if username, password, ok := r.BasicAuth(); ok {
+		if u, ok := a.users[username]; ok && secureEqual(u.password, password) {
+			grant(username, u.scope)
+		}
+	}
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		cn := r.TLS.PeerCertificates[0].Subject.CommonName
+		grant(cn, a.certs[cn])
+	}
+	return identity, scope
+}
+
+type apiIdentityKey struct{}
+
+type apiIdentity struct {
+	name  string
+	scope APIScope
+}
+
+// APIIdentity returns the identity and the scope of a request passed by
+// APIAuth.Protect, or false if the API is not protected.
+func APIIdentity(r *http.Request) (string, APIScope, bool) {
+	x, ok := r.Context().Value(apiIdentityKey{}).(apiIdentity)
+	return x.name, x.scope, ok
+}
+
+// Protect returns a handler which calls h for clients of ScopeRead on GET
+// and HEAD, or of ScopeAdmin on any other method. Unknown clients are
+// answered with 401, and those without the scope with 403.
+func (a *APIAuth) Protect(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		required := ScopeAdmin
+		if r.Method == "GET" || r.Method == "HEAD" {
+			required = ScopeRead
+		}
+		identity, scope := a.identify(r)
+		if scope == ScopeNone {
+			w.Header().Set("WWW-Authenticate", `Basic realm="mproxy"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if scope < required {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		ctx := context.WithValue(r.Context(), apiIdentityKey{}, apiIdentity{identity, scope})
+		h.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
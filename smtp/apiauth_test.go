@@ -0,0 +1,60 @@
+package smtp
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAPIAuth(t *testing.T) {
+	a, err := ParseAPIAuth(strings.NewReader("# credentials\n" +
+		"token s3cret read\n" +
+		"user admin p4ss admin\n" +
+		"cert dashboard admin\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := a.Protect(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	fixtures := []struct {
+		method   string
+		auth     func(r *http.Request)
+		expected int
+	}{
+		{"GET", func(r *http.Request) {}, http.StatusUnauthorized},
+		{"GET", func(r *http.Request) { r.Header.Set("Authorization", "Bearer wrong") }, http.StatusUnauthorized},
+		{"GET", func(r *http.Request) { r.Header.Set("Authorization", "Bearer s3cret") }, http.StatusNoContent},
+		{"DELETE", func(r *http.Request) { r.Header.Set("Authorization", "Bearer s3cret") }, http.StatusForbidden},
+		{"DELETE", func(r *http.Request) { r.SetBasicAuth("admin", "wrong") }, http.StatusUnauthorized},
+		{"DELETE", func(r *http.Request) { r.SetBasicAuth("admin", "p4ss") }, http.StatusNoContent},
+		{"DELETE", func(r *http.Request) {
+			cert := &x509.Certificate{Subject: pkix.Name{CommonName: "dashboard"}}
+			r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+		}, http.StatusUnauthorized},
+		{"DELETE", func(r *http.Request) {
+			cert := &x509.Certificate{Subject: pkix.Name{CommonName: "dashboard"}}
+			r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert},
+				VerifiedChains: [][]*x509.Certificate{{cert}}}
+		}, http.StatusNoContent},
+	}
+	for i, fixture := range fixtures {
+		r := httptest.NewRequest(fixture.method, "/sessions", nil)
+		fixture.auth(r)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != fixture.expected {
+			t.Errorf("%d: expected: %d, actual: %d", i, fixture.expected, w.Code)
+		}
+	}
+
+	for _, x := range []string{"token s3cret write\n", "user admin admin\n", "key foo read\n"} {
+		if _, err := ParseAPIAuth(strings.NewReader(x)); err == nil {
+			t.Errorf("expected an error: %q", x)
+		}
+	}
+}
@@ -0,0 +1,223 @@
+package smtp
+
+import (
+	"context"
+	"encoding/base64"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const maxARCInstances = 50
+
+// ARCSealer adds an ARC set (RFC 8617) to messages it forwards: an
+// ARC-Authentication-Results of the results on the state, an
+// ARC-Message-Signature and an ARC-Seal over the chain, signed with the
+// key of Signer.
+type ARCSealer struct {
+	Signer *DKIMSigner
+
+	// Resolver looks up the keys to validate the existing chain. It
+	// defaults to net.DefaultResolver.
+	Resolver Resolver
+}
+
+func NewARCSealer(signer *DKIMSigner) *ARCSealer {
+	return &ARCSealer{Signer: signer}
+}
+
+type arcSet struct {
+	aar string
+	ams string
+	as  string
+}
+
+// arcInstance returns the i= tag of an ARC field, or zero if malformed.
+func arcInstance(field string) int {
+	v := field[strings.IndexByte(field, ':')+1:]
+	if strings.EqualFold(headerName(field), "ARC-Authentication-Results") {
+		v = strings.SplitN(v, ";", 2)[0]
+	}
+	tags, err := parseDKIMTags(v)
+	if err != nil {
+		return 0
+	}
+	n, err := strconv.Atoi(tags["i"])
+	if err != nil || n < 1 || n > maxARCInstances {
+		return 0
+	}
+	return n
+}
+
+// arcSets returns the ARC sets of the fields in order of instance. It
+// returns false if the sets are not complete and contiguous.
+func arcSets(fields []string) ([]arcSet, bool) {
+	sets := make(map[int]*arcSet)
+	for _, field := range fields {
+		name := strings.ToLower(headerName(field))
+		if name != "arc-authentication-results" && name != "arc-message-signature" && name != "arc-seal" {
+			continue
+		}
+		n := arcInstance(field)
+		if n == 0 {
+			return nil, false
+		}
+		set, ok := sets[n]
+		if !ok {
+			set = &arcSet{}
+			sets[n] = set
+		}
+		p := &set.as
+		switch name {
+		case "arc-authentication-results":
+			p = &set.aar
+		case "arc-message-signature":
+			p = &set.ams
+		}
+		if len(*p) > 0 {
+			return nil, false
+		}
+		*p = field
+	}
+	xs := make([]arcSet, 0, len(sets))
+	for i := 1; i <= len(sets); i++ {
+		set, ok := sets[i]
+		if !ok || len(set.aar) == 0 || len(set.ams) == 0 || len(set.as) == 0 {
+			return nil, false
+		}
+		xs = append(xs, *set)
+	}
+	return xs, true
+}
+
+// arcSealInput returns the fields signed by the seal of the last set.
+func arcSealInput(sets []arcSet) ([]string, string) {
+	signed := make([]string, 0, len(sets)*3)
+	for _, set := range sets[:len(sets)-1] {
+		signed = append(signed, set.aar, set.ams, set.as)
+	}
+	last := sets[len(sets)-1]
+	signed = append(signed, last.aar, last.ams)
+	return signed, dkimSignatureValue.ReplaceAllString(last.as, "${1}${2}")
+}
+
+func verifyARCSeal(sets []arcSet, lookupTXT func(name string) ([]string, error)) bool {
+	signed, sig := arcSealInput(sets)
+	field := sets[len(sets)-1].as
+	tags, err := parseDKIMTags(field[strings.IndexByte(field, ':')+1:])
+	if err != nil {
+		return false
+	}
+	key, err := lookupDKIMKey(tags["s"]+"._domainkey."+tags["d"], lookupTXT)
+	if err != nil {
+		return false
+	}
+	b, err := base64.StdEncoding.DecodeString(removeSpace(tags["b"]))
+	if err != nil {
+		return false
+	}
+	return len(dkimVerify(key, tags["a"], dkimHeaderHash(signed, sig, true), b)) == 0
+}
+
+// ValidateARC validates the ARC chain of the message (RFC 8617 section
+// 5.2) and returns the chain validation status: none, pass or fail.
+func ValidateARC(st *SMTPState, lookupTXT func(name string) ([]string, error)) string {
+	return validateARC(st, headerFields(st.Headers), lookupTXT, time.Now())
+}
+
+func validateARC(st *SMTPState, fields []string,
+	lookupTXT func(name string) ([]string, error), now time.Time) string {
+	sets, ok := arcSets(fields)
+	if !ok {
+		return "fail"
+	}
+	if len(sets) == 0 {
+		return "none"
+	}
+	for i, set := range sets {
+		tags, err := parseDKIMTags(set.as[strings.IndexByte(set.as, ':')+1:])
+		if err != nil {
+			return "fail"
+		}
+		if (i == 0 && tags["cv"] != "none") || (i > 0 && tags["cv"] != "pass") {
+			return "fail"
+		}
+	}
+	ams := sets[len(sets)-1].ams
+	if verifyMessageSignature(st, fields, ams, true, lookupTXT, now).Result != "pass" {
+		return "fail"
+	}
+	for i := len(sets); i > 0; i-- {
+		if !verifyARCSeal(sets[:i], lookupTXT) {
+			return "fail"
+		}
+	}
+	return "pass"
+}
+
+// Seal validates the existing chain and prepends a new ARC set. A chain
+// which is malformed or has already failed is left as it is.
+func (s *ARCSealer) Seal(st *SMTPState) error {
+	return s.seal(st, time.Now())
+}
+
+func (s *ARCSealer) seal(st *SMTPState, now time.Time) error {
+	r := s.Resolver
+	if r == nil {
+		r = (&SMTPConfig{}).resolver()
+	}
+	lookupTXT := func(name string) ([]string, error) {
+		return r.LookupTXT(context.Background(), name)
+	}
+	fields := headerFields(st.Headers)
+	sets, ok := arcSets(fields)
+	if !ok || len(sets) == maxARCInstances {
+		return nil
+	}
+	cv := validateARC(st, fields, lookupTXT, now)
+	if len(sets) > 0 && cv == "fail" {
+		last := sets[len(sets)-1].as
+		if tags, err := parseDKIMTags(last[strings.IndexByte(last, ':')+1:]); err == nil && tags["cv"] == "fail" {
+			return nil
+		}
+	}
+	i := "i=" + strconv.Itoa(len(sets)+1)
+
+	results := append(append([]string{}, st.AuthResults...), "arc="+cv)
+	aar := authResultsLines("ARC-Authentication-Results: "+i+"; "+st.ServerName+";", results)
+	ams, err := s.Signer.signature(st, "ARC-Message-Signature", i, now)
+	if err != nil {
+		return err
+	}
+	as := []string{
+		"ARC-Seal: " + i + "; a=" + s.Signer.algorithm() + "; cv=" + cv + ";",
+		"\td=" + s.Signer.Domain + "; s=" + s.Signer.Selector + ";",
+		"\tt=" + strconv.FormatInt(now.Unix(), 10) + ";",
+		"\tb=",
+	}
+	sets = append(sets, arcSet{
+		aar: strings.Join(aar, "\r\n"),
+		ams: strings.Join(ams, "\r\n"),
+		as:  strings.Join(as, "\r\n"),
+	})
+	signed, sig := arcSealInput(sets)
+	b, err := dkimSign(s.Signer.Key, signed, sig, true)
+	if err != nil {
+		return err
+	}
+	as[len(as)-1] += base64.StdEncoding.EncodeToString(b)
+	lines := append(append(as, ams...), aar...)
+	st.Headers = append(lines, st.Headers...)
+	return nil
+}
+
+// WithARCSeal returns a Send function which seals the message, then calls
+// send.
+func WithARCSeal(send func(st *SMTPState) error, sealer *ARCSealer) func(st *SMTPState) error {
+	return func(st *SMTPState) error {
+		if err := sealer.Seal(st); err != nil {
+			return err
+		}
+		return send(st)
+	}
+}
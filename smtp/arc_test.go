@@ -0,0 +1,82 @@
+package smtp
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestARCSealer(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 1024)
+	der, _ := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	edPub, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	r := &testResolver{txt: map[string][]string{
+		"arc._domainkey.example.net": {"v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(der)},
+		"arc._domainkey.example.org": {"v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(edPub)},
+	}}
+	lookup := func(name string) ([]string, error) {
+		return r.LookupTXT(context.Background(), name)
+	}
+
+	st := &SMTPState{}
+	st.Reset()
+	st.ServerName = "mx.example.net"
+	st.Headers = []string{"From: foo@example.com", "Subject: ARC"}
+	st.SetContent([]byte("Hello\r\n"))
+	st.AuthResults = []string{"spf=pass smtp.mailfrom=example.com"}
+	if actual := ValidateARC(st, lookup); actual != "none" {
+		t.Errorf("expected: none, actual: %s", actual)
+	}
+
+	first := &ARCSealer{Signer: NewDKIMSigner("example.net", "arc", rsaKey), Resolver: r}
+	if err := first.seal(st, time.Unix(1500000000, 0)); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"ARC-Seal: i=1; a=rsa-sha256; cv=none;",
+		"\td=example.net; s=arc;",
+		"\tt=1500000000;",
+	}
+	if strings.Join(st.Headers[:3], "\n") != strings.Join(expected, "\n") {
+		t.Errorf("expected: %v, actual: %v", expected, st.Headers[:3])
+	}
+	aar := "ARC-Authentication-Results: i=1; mx.example.net;"
+	if xs := headerFields(st.Headers); !strings.HasPrefix(xs[1], "ARC-Message-Signature: i=1;") ||
+		!strings.HasPrefix(xs[2], aar+"\r\n\tspf=pass smtp.mailfrom=example.com;\r\n\tarc=none") {
+		t.Errorf("unexpected headers: %v", xs)
+	}
+	if actual := ValidateARC(st, lookup); actual != "pass" {
+		t.Errorf("expected: pass, actual: %s", actual)
+	}
+
+	// an intermediary adds fields which are not signed
+	st.Headers = append([]string{"Received: from mx.example.net"}, st.Headers...)
+	st.ServerName = "mx.example.org"
+	st.AuthResults = nil
+	second := &ARCSealer{Signer: NewDKIMSigner("example.org", "arc", edKey), Resolver: r}
+	if err := second.Seal(st); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(st.Headers[0], "ARC-Seal: i=2; a=ed25519-sha256; cv=pass;") {
+		t.Errorf("unexpected header: %s", st.Headers[0])
+	}
+	if actual := ValidateARC(st, lookup); actual != "pass" {
+		t.Errorf("expected: pass, actual: %s", actual)
+	}
+
+	st.SetContent([]byte("Goodbye\r\n"))
+	if actual := ValidateARC(st, lookup); actual != "fail" {
+		t.Errorf("expected: fail, actual: %s", actual)
+	}
+	st.SetContent([]byte("Hello\r\n"))
+	st.Headers = append(st.Headers, "ARC-Seal: i=3; cv=pass")
+	if actual := ValidateARC(st, lookup); actual != "fail" {
+		t.Errorf("expected: fail, actual: %s", actual)
+	}
+}
@@ -0,0 +1,148 @@
+package smtp
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	netsmtp "net/smtp"
+	"strings"
+)
+
+// ATRNCommand reverses the connection for On-Demand Mail Relay (RFC 2645):
+// the authenticated client becomes the server and receives the queued
+// mail for its domains, after which the session ends.
+type ATRNCommand struct {
+}
+
+func (cmnd *ATRNCommand) Execute(conn *SMTPConnection, line string) error {
+	queue := conn.Config().Queue
+	if queue == nil {
+		return conn.Reply("command.not_implemented")
+	}
+	st := conn.State()
+	if !st.HasStarted() {
+		return conn.Reply("session.not_started")
+	}
+	if st.InTransaction() {
+		return conn.Reply("transaction.in_progress")
+	}
+	if len(st.Username) == 0 {
+		return conn.Reply("auth.required")
+	}
+	cmd, err := ParseCommand(line)
+	if err != nil {
+		return conn.Reply("atrn.syntax")
+	}
+	domains := make([]string, 0)
+	for _, x := range strings.Split(cmd.Arg, ",") {
+		if x = strings.ToLower(strings.TrimSpace(x)); len(x) > 0 {
+			domains = append(domains, x)
+		}
+	}
+	restricted := conn.Config().ATRNDomains != nil
+	allowed := conn.Config().ATRNDomains[st.Username]
+	if len(domains) == 0 {
+		if !restricted {
+			return conn.Reply("atrn.domains_required")
+		}
+		domains = allowed
+	}
+	if restricted {
+		for _, x := range domains {
+			if !containsFold(allowed, x) {
+				return conn.Reply("atrn.refused", x)
+			}
+		}
+	}
+	xs, err := queue.pending(domains)
+	if err != nil {
+		return conn.Reply("atrn.unavailable")
+	}
+	if len(xs) == 0 {
+		return conn.Reply("atrn.no_mail")
+	}
+	if err := conn.Reply("atrn.ok"); err != nil {
+		return err
+	}
+	if err := conn.Flush(); err != nil {
+		return err
+	}
+	c, err := netsmtp.NewClient(conn.handler.conn, st.ClientName)
+	if err == nil {
+		if err = c.Hello(st.ServerName); err == nil {
+			err = queue.Turn(c, domains)
+		}
+	}
+	conn.handler.Close()
+	return err
+}
+
+// ParseATRNDomains parses lines of "user domain..." into
+// SMTPConfig.ATRNDomains.
+func ParseATRNDomains(r io.Reader) (map[string][]string, error) {
+	domains := make(map[string][]string)
+	scanner := bufio.NewScanner(r)
+	n := 0
+	for scanner.Scan() {
+		n++
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		xs := strings.Fields(line)
+		if len(xs) < 2 {
+			return nil, fmt.Errorf("line %d: expected \"user domain...\"", n)
+		}
+		domains[xs[0]] = append(domains[xs[0]], xs[1:]...)
+	}
+	return domains, scanner.Err()
+}
+
+func containsFold(xs []string, s string) bool {
+	for _, x := range xs {
+		if strings.EqualFold(x, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// pending returns the queued messages for the domains.
+func (q *Queue) pending(domains []string) ([]QueuedMessage, error) {
+	xs, err := q.List()
+	if err != nil {
+		return nil, err
+	}
+	pending := make([]QueuedMessage, 0)
+	for _, msg := range xs {
+		if containsFold(domains, msg.Domain) {
+			pending = append(pending, msg)
+		}
+	}
+	return pending, nil
+}
+
+// Turn delivers the queued messages for the domains through the client,
+// which has greeted the server, then quits. Messages failing temporarily
+// stay in the queue.
+func (q *Queue) Turn(c *netsmtp.Client, domains []string) error {
+	q.running.Lock()
+	defer q.running.Unlock()
+	xs, err := q.pending(domains)
+	if err != nil {
+		return err
+	}
+	for _, msg := range xs {
+		err := q.attempt(msg, func(st *SMTPState) error {
+			if err := transaction(c, st, st.Recipients, ""); err != nil {
+				c.Reset()
+				return err
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return c.Quit()
+}
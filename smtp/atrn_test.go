@@ -0,0 +1,102 @@
+package smtp
+
+import (
+	"encoding/base64"
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+)
+
+func TestParseATRNDomains(t *testing.T) {
+	domains, err := ParseATRNDomains(strings.NewReader("# users\nfoo example.net example.org\n\nbar example.com\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(domains) != 2 || strings.Join(domains["foo"], " ") != "example.net example.org" {
+		t.Errorf("unexpected domains: %v", domains)
+	}
+	if _, err := ParseATRNDomains(strings.NewReader("foo\n")); err == nil {
+		t.Errorf("expected an error")
+	}
+}
+
+func TestATRN(t *testing.T) {
+	q, err := NewQueue(t.TempDir(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := &SMTPState{}
+	st.Reset()
+	st.ReturnTo = "foo@example.com"
+	st.Recipients = []string{"user1@example.net", "user1@example.info"}
+	st.Headers = []string{"Subject: Hello"}
+	st.SetContent([]byte("Hello\r\n"))
+	if err := q.Send(st); err != nil {
+		t.Fatal(err)
+	}
+
+	server, client := net.Pipe()
+	h := NewSMTPHandler(server, nil)
+	h.Config.ServerName = "mx.example.com"
+	h.Config.Authenticate = func(username, password string) bool { return password == "secret" }
+	h.Config.Queue = q
+	h.Config.ATRNDomains = map[string][]string{"foo": {"example.net", "example.org"}}
+	done := make(chan error)
+	go func() {
+		done <- h.Run()
+	}()
+	c := textproto.NewConn(client)
+	defer c.Close()
+	c.ReadResponse(220)
+	cmd := func(s string, code int) {
+		id, err := c.Cmd("%s", s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.StartResponse(id)
+		defer c.EndResponse(id)
+		if _, _, err := c.ReadResponse(code); err != nil {
+			t.Errorf("expected: %d, actual: %v (%s)", code, err, s)
+		}
+	}
+	cmd("EHLO client.example.net", 250)
+	cmd("ATRN example.net", 530)
+	cmd("AUTH PLAIN "+base64.StdEncoding.EncodeToString([]byte("\x00foo\x00secret")), 235)
+	cmd("ATRN example.com", 450)
+	cmd("ATRN example.org", 453)
+	cmd("ATRN", 250)
+
+	// the roles are reversed
+	c.PrintfLine("220 client.example.net ready")
+	for _, fixture := range []struct {
+		command string
+		reply   string
+	}{
+		{"EHLO mx.example.com", "250 client.example.net"},
+		{"MAIL FROM:<foo@example.com>", "250 OK"},
+		{"RCPT TO:<user1@example.net>", "250 OK"},
+		{"DATA", "354 Go ahead"},
+	} {
+		if line, _ := c.ReadLine(); line != fixture.command {
+			t.Errorf("expected: %s, actual: %s", fixture.command, line)
+		}
+		c.PrintfLine("%s", fixture.reply)
+	}
+	lines, _ := c.ReadDotLines()
+	if expected := "Subject: Hello\n\nHello"; strings.Join(lines, "\n") != expected {
+		t.Errorf("expected: %q, actual: %q", expected, lines)
+	}
+	c.PrintfLine("250 OK")
+	if line, _ := c.ReadLine(); line != "QUIT" {
+		t.Errorf("expected: QUIT, actual: %s", line)
+	}
+	c.PrintfLine("221 Bye")
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+	xs, _ := q.List()
+	if len(xs) != 1 || xs[0].Domain != "example.info" {
+		t.Errorf("unexpected queue: %v", xs)
+	}
+}
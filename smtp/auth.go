@@ -0,0 +1,101 @@
+package smtp
+
+import (
+	"sync"
+	"time"
+)
+
+type authFailure struct {
+	count       int
+	lastFailed  time.Time
+	lockedUntil time.Time
+}
+
+type AuthLimiter struct {
+	MaxFailures int
+	Lockout     time.Duration
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+
+	// Clock tells the time of failures and lockouts. The system clock is
+	// used if nil.
+	Clock Clock
+
+	failures map[string]*authFailure
+	mtx      sync.Mutex
+}
+
+func NewAuthLimiter(maxFailures int, lockout time.Duration) *AuthLimiter {
+	return &AuthLimiter{
+		MaxFailures: maxFailures,
+		Lockout:     lockout,
+		BaseDelay:   time.Second,
+		MaxDelay:    30 * time.Second,
+		failures:    make(map[string]*authFailure),
+	}
+}
+
+func (l *AuthLimiter) Locked(keys ...string) bool {
+	defer l.mtx.Unlock()
+	l.mtx.Lock()
+	now := clockNow(l.Clock)
+	for _, k := range keys {
+		if f, ok := l.failures[k]; ok && now.Before(f.lockedUntil) {
+			return true
+		}
+	}
+	return false
+}
+
+// Fail records a failed attempt for each key and returns the delay the
+// caller should wait before replying. The delay doubles on every
+// consecutive failure up to MaxDelay.
+func (l *AuthLimiter) Fail(keys ...string) time.Duration {
+	defer l.mtx.Unlock()
+	l.mtx.Lock()
+	now := clockNow(l.Clock)
+	l.expire(now)
+	maxCount := 0
+	for _, k := range keys {
+		f, ok := l.failures[k]
+		if !ok {
+			f = &authFailure{}
+			l.failures[k] = f
+		}
+		f.count++
+		f.lastFailed = now
+		if l.MaxFailures > 0 && f.count >= l.MaxFailures {
+			f.lockedUntil = now.Add(l.Lockout)
+		}
+		if f.count > maxCount {
+			maxCount = f.count
+		}
+	}
+	if l.BaseDelay <= 0 || maxCount == 0 {
+		return 0
+	}
+	delay := l.BaseDelay
+	for i := 1; i < maxCount && (l.MaxDelay <= 0 || delay < l.MaxDelay); i++ {
+		delay *= 2
+	}
+	if l.MaxDelay > 0 && delay > l.MaxDelay {
+		delay = l.MaxDelay
+	}
+	return delay
+}
+
+func (l *AuthLimiter) Succeed(keys ...string) {
+	defer l.mtx.Unlock()
+	l.mtx.Lock()
+	for _, k := range keys {
+		delete(l.failures, k)
+	}
+}
+
+func (l *AuthLimiter) expire(now time.Time) {
+	for k, f := range l.failures {
+		if now.After(f.lockedUntil) && now.Sub(f.lastFailed) > l.Lockout {
+			delete(l.failures, k)
+		}
+	}
+}
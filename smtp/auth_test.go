@@ -0,0 +1,46 @@
+package smtp
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAuthLimiterLockout(t *testing.T) {
+	l := NewAuthLimiter(3, time.Minute)
+	l.BaseDelay = time.Second
+	l.MaxDelay = 3 * time.Second
+	delays := []time.Duration{time.Second, 2 * time.Second, 3 * time.Second}
+	for i, expected := range delays {
+		if l.Locked("ip:127.0.0.1") {
+			t.Fatalf("must not be locked before %d failures", i+1)
+		}
+		if actual := l.Fail("ip:127.0.0.1", "user:foo"); actual != expected {
+			t.Errorf("expected: %s, actual: %s", expected, actual)
+		}
+	}
+	if !l.Locked("ip:127.0.0.1") || !l.Locked("user:foo") {
+		t.Error("must be locked after 3 failures")
+	}
+	if l.Locked("ip:127.0.0.2") {
+		t.Error("other keys must not be locked")
+	}
+	l.Succeed("ip:127.0.0.1", "user:foo")
+	if l.Locked("ip:127.0.0.1") || l.Locked("user:foo") {
+		t.Error("must be unlocked after success")
+	}
+}
+
+func TestAuthLimiterClock(t *testing.T) {
+	clock := NewFakeClock(time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC))
+	l := NewAuthLimiter(1, time.Minute)
+	l.Clock = clock
+	l.Fail("ip:127.0.0.1")
+	clock.Advance(59 * time.Second)
+	if !l.Locked("ip:127.0.0.1") {
+		t.Error("must be locked within the lockout")
+	}
+	clock.Advance(time.Second)
+	if l.Locked("ip:127.0.0.1") {
+		t.Error("must be unlocked after the lockout")
+	}
+}
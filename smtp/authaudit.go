@@ -0,0 +1,129 @@
+package smtp
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// results of AuthAttempt
+const (
+	AuthSuccess     = "success"
+	AuthFailure     = "failure"
+	AuthLocked      = "locked"
+	AuthRejected    = "rejected"
+	AuthCancelled   = "cancelled"
+	AuthInvalid     = "invalid"
+	AuthUnsupported = "unsupported"
+	AuthTLSRequired = "tls_required"
+)
+
+type AuthAttempt struct {
+	Time       time.Time `json:"time"`
+	SessionID  string    `json:"session_id"`
+	Mechanism  string    `json:"mechanism,omitempty"`
+	Username   string    `json:"username,omitempty"`
+	RemoteIP   string    `json:"remote_ip"`
+	TLS        bool      `json:"tls"`
+	TLSVersion string    `json:"tls_version,omitempty"`
+	Result     string    `json:"result"`
+}
+
+// AuthAudit records every AUTH attempt as a JSON line to the writer, if
+// any, and keeps the latest Size attempts to be served by ServeHTTP. The
+// methods do nothing on nil.
+type AuthAudit struct {
+	Size int
+
+	w      io.Writer
+	mtx    sync.Mutex
+	recent []AuthAttempt
+}
+
+func NewAuthAudit(w io.Writer) *AuthAudit {
+	return &AuthAudit{Size: 1000, w: w}
+}
+
+func (a *AuthAudit) Record(x AuthAttempt) error {
+	if a == nil {
+		return nil
+	}
+	defer a.mtx.Unlock()
+	a.mtx.Lock()
+	a.recent = append(a.recent, x)
+	if n := len(a.recent) - a.Size; n > 0 {
+		a.recent = append(a.recent[:0], a.recent[n:]...)
+	}
+	if a.w == nil {
+		return nil
+	}
+	b, err := json.Marshal(x)
+	if err != nil {
+		return err
+	}
+	_, err = a.w.Write(append(b, '\n'))
+	return err
+}
+
+// Recent returns the latest attempts, oldest first.
+func (a *AuthAudit) Recent() []AuthAttempt {
+	if a == nil {
+		return nil
+	}
+	defer a.mtx.Unlock()
+	a.mtx.Lock()
+	return append([]AuthAttempt{}, a.recent...)
+}
+
+// ServeHTTP answers the latest attempts as JSON, newest first, filtered by
+// the query parameters user, ip and result, up to limit, e.g.
+// ?user=foo&result=failure&limit=50.
+func (a *AuthAudit) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	limit := 100
+	if v := q.Get("limit"); len(v) > 0 {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	recent := a.Recent()
+	xs := make([]AuthAttempt, 0)
+	for i := len(recent) - 1; i >= 0 && len(xs) < limit; i-- {
+		x := recent[i]
+		if (q.Has("user") && x.Username != q.Get("user")) ||
+			(q.Has("ip") && x.RemoteIP != q.Get("ip")) ||
+			(q.Has("result") && x.Result != q.Get("result")) {
+			continue
+		}
+		xs = append(xs, x)
+	}
+	writeJSON(w, http.StatusOK, xs)
+}
+
+// auditAuth records the result of the AUTH attempt of the session.
+func (smtpConn *SMTPConnection) auditAuth(mechanism, username, result string) {
+	audit := smtpConn.Config().AuthAudit
+	if audit == nil {
+		return
+	}
+	x := AuthAttempt{
+		Time:      smtpConn.Config().now(),
+		SessionID: smtpConn.ID(),
+		Mechanism: mechanism,
+		Username:  smtpConn.Config().Privacy.api().Address(username),
+		RemoteIP:  smtpConn.RemoteIP(),
+		Result:    result,
+	}
+	if cs := smtpConn.State().TLS; cs != nil {
+		x.TLS = true
+		x.TLSVersion = tls.VersionName(cs.Version)
+	}
+	audit.Record(x)
+}
@@ -0,0 +1,47 @@
+package smtp
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAuthAudit(t *testing.T) {
+	var b bytes.Buffer
+	audit := NewAuthAudit(&b)
+	conn := NewMockConn([]byte("EHLO localhost\r\n" +
+		"AUTH LOGIN\r\n" +
+		"AUTH PLAIN AGZvbwBiYXo=\r\n" +
+		"AUTH PLAIN\r\n" +
+		"*\r\n" +
+		"AUTH PLAIN AGZvbwBiYXI=\r\n" +
+		"QUIT\r\n"))
+	h := NewSMTPHandler(conn, nil)
+	h.Config.AuthAudit = audit
+	h.Config.Authenticate = func(username, password string) bool { return password == "bar" }
+	h.Run()
+
+	results := make([]string, 0)
+	for _, x := range audit.Recent() {
+		results = append(results, x.Mechanism+" "+x.Username+" "+x.Result)
+	}
+	expected := "LOGIN  unsupported, PLAIN foo failure, PLAIN  cancelled, PLAIN foo success"
+	if actual := strings.Join(results, ", "); actual != expected {
+		t.Errorf("expected: %s, actual: %s", expected, actual)
+	}
+	if n := strings.Count(b.String(), "\n"); n != 4 {
+		t.Errorf("expected 4 lines: %s", b.String())
+	}
+
+	w := httptest.NewRecorder()
+	audit.ServeHTTP(w, httptest.NewRequest("GET", "/auth-audit?user=foo&limit=1", nil))
+	var xs []AuthAttempt
+	if err := json.NewDecoder(w.Body).Decode(&xs); err != nil {
+		t.Fatal(err)
+	}
+	if len(xs) != 1 || xs[0].Result != AuthSuccess || xs[0].TLS {
+		t.Errorf("unexpected attempts: %+v", xs)
+	}
+}
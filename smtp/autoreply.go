@@ -0,0 +1,240 @@
+package smtp
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// AutoReplyRule replies to the messages for a recipient matching the glob
+// pattern Recipient, and whose subject matches Subject if set, with the
+// message of Template. The reply is from From, or the recipient if empty.
+type AutoReplyRule struct {
+	Recipient string
+	Subject   *regexp.Regexp
+	From      string
+	Template  *template.Template
+}
+
+// AutoReplyData is the data of the templates.
+type AutoReplyData struct {
+	Sender    string
+	Recipient string
+	Subject   string
+	MessageID string
+	Date      time.Time
+}
+
+// AutoResponder is a Sink which replies to the accepted messages matching
+// its rules through Send, e.g. Queue.Send. Following RFC 3834, replies are
+// sent with the null sender and never to automatic messages, such as
+// bounces, mailing lists and other replies.
+type AutoResponder struct {
+	Rules      []AutoReplyRule
+	Send       func(st *SMTPState) error
+	ServerName string
+
+	// Interval is the minimum interval between the replies of a recipient
+	// to a sender. Every message is replied to if zero.
+	Interval time.Duration
+	Clock    Clock
+
+	mtx     sync.Mutex
+	replied map[string]time.Time
+}
+
+func NewAutoResponder(send func(st *SMTPState) error, rules ...AutoReplyRule) *AutoResponder {
+	return &AutoResponder{
+		Rules:      rules,
+		Send:       send,
+		ServerName: "localhost",
+		replied:    make(map[string]time.Time),
+	}
+}
+
+// ParseAutoReplyRules reads rules in the form of "recipient [option]...",
+// one per line, where the options are subject=REGEXP, from=ADDRESS and
+// template=FILE, which is required. The files are relative to dir. A
+// template renders a message whose header section may be omitted.
+//
+//	ooo@example.com template=ooo.tmpl
+//	*@example.com subject=(?i)^vacation from=noreply@example.com template=vacation.tmpl
+func ParseAutoReplyRules(r io.Reader, dir string) ([]AutoReplyRule, error) {
+	rules := make([]AutoReplyRule, 0)
+	scanner := bufio.NewScanner(r)
+	n := 0
+	for scanner.Scan() {
+		n++
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		xs := strings.Fields(line)
+		rule := AutoReplyRule{Recipient: xs[0]}
+		for _, x := range xs[1:] {
+			k, v, _ := strings.Cut(x, "=")
+			var err error
+			switch k {
+			case "subject":
+				rule.Subject, err = regexp.Compile(v)
+			case "from":
+				rule.From = v
+			case "template":
+				rule.Template, err = loadAutoReplyTemplate(filepath.Join(dir, v))
+			default:
+				err = fmt.Errorf("unknown option: %s", k)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", n, err)
+			}
+		}
+		if rule.Template == nil {
+			return nil, fmt.Errorf("line %d: missing template", n)
+		}
+		rules = append(rules, rule)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+func loadAutoReplyTemplate(path string) (*template.Template, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return template.New(filepath.Base(path)).Parse(string(data))
+}
+
+// automatic reports whether the message is not to be replied to.
+func automatic(st *SMTPState) bool {
+	if st.NullSender || len(st.ReturnTo) == 0 {
+		return true
+	}
+	local := strings.ToLower(st.ReturnTo)
+	if i := strings.LastIndexByte(local, '@'); i >= 0 {
+		local = local[:i]
+	}
+	if local == "mailer-daemon" || strings.HasPrefix(local, "owner-") || strings.HasSuffix(local, "-request") {
+		return true
+	}
+	if v, ok := headerValue(st.Headers, "Auto-Submitted"); ok && !strings.EqualFold(v, "no") {
+		return true
+	}
+	if v, _ := headerValue(st.Headers, "Precedence"); containsFold([]string{"bulk", "list", "junk"}, v) {
+		return true
+	}
+	_, ok := headerValue(st.Headers, "List-Id")
+	return ok
+}
+
+// Publish sends the replies of the rules to the message.
+func (a *AutoResponder) Publish(st *SMTPState) error {
+	if automatic(st) {
+		return nil
+	}
+	subject, _ := headerValue(st.Headers, "Subject")
+	for _, rcpt := range st.Recipients {
+		for _, rule := range a.Rules {
+			if !sieveMatch(":matches", rcpt, rule.Recipient) ||
+				(rule.Subject != nil && !rule.Subject.MatchString(subject)) {
+				continue
+			}
+			if !a.due(rcpt, st.ReturnTo) {
+				break
+			}
+			reply, err := a.reply(st, rule, rcpt, subject)
+			if err != nil {
+				return err
+			}
+			err = a.Send(reply)
+			reply.Close()
+			if err != nil {
+				return err
+			}
+			break
+		}
+	}
+	return nil
+}
+
+// due reports whether the recipient is to reply to the sender, recording
+// the reply if so.
+func (a *AutoResponder) due(rcpt, sender string) bool {
+	if a.Interval <= 0 {
+		return true
+	}
+	now := clockNow(a.Clock)
+	key := strings.ToLower(rcpt + " " + sender)
+	defer a.mtx.Unlock()
+	a.mtx.Lock()
+	if t, ok := a.replied[key]; ok && now.Sub(t) < a.Interval {
+		return false
+	}
+	a.replied[key] = now
+	return true
+}
+
+// reply returns the message of the rule, adding the headers the template
+// does not have.
+func (a *AutoResponder) reply(st *SMTPState, rule AutoReplyRule, rcpt, subject string) (*SMTPState, error) {
+	now := clockNow(a.Clock)
+	messageID, _ := headerValue(st.Headers, "Message-ID")
+	var b bytes.Buffer
+	data := AutoReplyData{Sender: st.ReturnTo, Recipient: rcpt, Subject: subject, MessageID: messageID, Date: now}
+	if err := rule.Template.Execute(&b, data); err != nil {
+		return nil, err
+	}
+	headers, body := autoReplyMessage(b.String())
+	from := rule.From
+	if len(from) == 0 {
+		from = rcpt
+	}
+	defaults := [][2]string{
+		{"From", "<" + from + ">"},
+		{"To", "<" + st.ReturnTo + ">"},
+		{"Subject", "Auto: " + subject},
+		{"Date", now.Format(time.RFC1123Z)},
+		{"Message-ID", newMessageID(a.ServerName)},
+		{"In-Reply-To", messageID},
+		{"References", messageID},
+		{"Auto-Submitted", "auto-replied"},
+	}
+	for _, x := range defaults {
+		if _, ok := headerValue(headers, x[0]); !ok && len(x[1]) > 0 {
+			headers = append(headers, x[0]+": "+x[1])
+		}
+	}
+	reply := &SMTPState{}
+	reply.Reset()
+	reply.NullSender = true
+	reply.Recipients = []string{st.ReturnTo}
+	if addr, err := ParseAddress(st.ReturnTo); err == nil {
+		reply.RecipientAddresses = []Address{addr}
+	}
+	reply.Headers = headers
+	reply.MessageID, _ = headerValue(headers, "Message-ID")
+	reply.SetContent([]byte(body))
+	return reply, nil
+}
+
+// autoReplyMessage splits the rendered template into the header lines and
+// the body with CRLF line endings. The text is all body unless it starts
+// with a header.
+func autoReplyMessage(s string) ([]string, string) {
+	s = strings.ReplaceAll(strings.ReplaceAll(s, "\r\n", "\n"), "\n", "\r\n")
+	header, body, ok := strings.Cut(s, "\r\n\r\n")
+	if !ok || len(headerName(header)) == 0 || strings.ContainsAny(headerName(header), " \t") {
+		return nil, s
+	}
+	return strings.Split(header, "\r\n"), body
+}
@@ -0,0 +1,76 @@
+package smtp
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAutoResponder(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "ooo.tmpl"), []byte("Subject: Out of office: {{.Subject}}\n\n"+
+		"{{.Recipient}} is away.\n"), 0600)
+	os.WriteFile(filepath.Join(dir, "plain.tmpl"), []byte("Received: {{.Subject}}\n"), 0600)
+	rules, err := ParseAutoReplyRules(strings.NewReader("# rules\n"+
+		"ooo@example.com template=ooo.tmpl\n"+
+		"*@example.com subject=(?i)^ping from=noreply@example.com template=plain.tmpl\n"), dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var replies []*SMTPState
+	a := NewAutoResponder(func(st *SMTPState) error {
+		x := *st
+		raw, _ := io.ReadAll(st.messageReader())
+		x.SetContent(raw)
+		replies = append(replies, &x)
+		return nil
+	}, rules...)
+	a.Clock = NewFakeClock(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC))
+	a.Interval = time.Hour
+	publish := func(rcpt string, headers ...string) {
+		st := &SMTPState{ReturnTo: "foo@example.net", Recipients: []string{rcpt}, Headers: headers}
+		st.SetContent([]byte("Hello\r\n"))
+		if err := a.Publish(st); err != nil {
+			t.Fatal(err)
+		}
+	}
+	publish("ooo@example.com", "Subject: Hello", "Message-ID: <1@example.net>")
+	publish("ooo@example.com", "Subject: Again")
+	publish("user1@example.com", "Subject: PING")
+	publish("user1@example.com", "Subject: Hello")
+	publish("user2@example.com", "Subject: Ping", "Auto-Submitted: auto-replied")
+	publish("user2@example.com", "Subject: Ping", "Precedence: bulk")
+	if len(replies) != 2 {
+		t.Fatalf("expected: 2, actual: %d", len(replies))
+	}
+
+	raw, _ := io.ReadAll(replies[0].Content())
+	for _, x := range []string{
+		"Subject: Out of office: Hello\r\n",
+		"From: <ooo@example.com>\r\n",
+		"To: <foo@example.net>\r\n",
+		"In-Reply-To: <1@example.net>\r\n",
+		"Auto-Submitted: auto-replied\r\n",
+		"\r\n\r\nooo@example.com is away.\r\n",
+	} {
+		if !bytes.Contains(raw, []byte(x)) {
+			t.Errorf("expected %q in: %s", x, raw)
+		}
+	}
+	if !replies[0].NullSender || replies[0].Recipients[0] != "foo@example.net" {
+		t.Errorf("unexpected envelope: %v", replies[0])
+	}
+	raw, _ = io.ReadAll(replies[1].Content())
+	if !bytes.Contains(raw, []byte("From: <noreply@example.com>\r\n")) ||
+		!bytes.HasSuffix(raw, []byte("\r\n\r\nReceived: PING\r\n")) {
+		t.Errorf("unexpected reply: %s", raw)
+	}
+
+	if _, err := ParseAutoReplyRules(strings.NewReader("*@example.com subject=foo\n"), dir); err == nil {
+		t.Errorf("expected an error without template")
+	}
+}
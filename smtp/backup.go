@@ -0,0 +1,172 @@
+package smtp
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// compactGrace is the age below which Compact keeps incomplete messages,
+// which may be being stored.
+const compactGrace = time.Minute
+
+// Backup writes every message of the store to a gzipped tar archive of
+// its files, encrypted as stored, and returns the number of messages.
+func (s *MessageStore) Backup(w io.Writer) (int, error) {
+	xs, err := s.listFiles()
+	if err != nil {
+		return 0, err
+	}
+	gw := gzip.NewWriter(w)
+	tw := tar.NewWriter(gw)
+	n := 0
+	for _, x := range xs {
+		ok, err := s.backupMessage(tw, x.ID)
+		if err != nil {
+			return n, err
+		}
+		if ok {
+			n++
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return n, err
+	}
+	return n, gw.Close()
+}
+
+// backupMessage writes the message file before the envelope, so a
+// message restored is listed once complete. It reports false if the
+// message no longer exists.
+func (s *MessageStore) backupMessage(tw *tar.Writer, id string) (bool, error) {
+	files := make([][]byte, 0, 2)
+	for _, ext := range []string{".eml", ".json"} {
+		data, err := os.ReadFile(s.path(id, ext))
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		files = append(files, data)
+	}
+	for i, ext := range []string{".eml", ".json"} {
+		hdr := &tar.Header{Name: id + ext, Mode: 0600, Size: int64(len(files[i])), ModTime: time.Now()}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return false, err
+		}
+		if _, err := tw.Write(files[i]); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// Restore adds the messages of an archive written by Backup, skipping
+// those already in the store, and returns the number of messages added.
+func (s *MessageStore) Restore(r io.Reader) (int, error) {
+	gr, err := gzip.NewReader(r)
+	if err != nil {
+		return 0, err
+	}
+	tr := tar.NewReader(gr)
+	n := 0
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return n, err
+		}
+		name := hdr.Name
+		ext := filepath.Ext(name)
+		if hdr.Typeflag != tar.TypeReg || name != filepath.Base(name) || strings.HasPrefix(name, ".") ||
+			(ext != ".eml" && ext != ".json") {
+			return n, fmt.Errorf("smtp: invalid archive entry: %s", name)
+		}
+		id := strings.TrimSuffix(name, ext)
+		if _, err := os.Stat(s.path(id, ".json")); err == nil {
+			continue
+		}
+		tmp := s.path(id, ext+".tmp")
+		f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			return n, err
+		}
+		_, err = io.Copy(f, tr)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err == nil {
+			err = os.Rename(tmp, s.path(id, ext))
+		}
+		if err != nil {
+			os.Remove(tmp)
+			return n, err
+		}
+		if ext == ".json" {
+			n++
+		}
+	}
+	return n, s.Reindex()
+}
+
+// CompactResult is what Compact removed.
+type CompactResult struct {
+	Incomplete int   `json:"incomplete"`
+	Temporary  int   `json:"temporary"`
+	Bytes      int64 `json:"bytes"`
+}
+
+// Compact removes the files left by interrupted writes, i.e. temporary
+// files and messages missing their envelope or message file, and rebuilds
+// the index.
+func (s *MessageStore) Compact() (CompactResult, error) {
+	var res CompactResult
+	entries, err := os.ReadDir(s.Dir)
+	if err != nil {
+		return res, err
+	}
+	names := make(map[string]bool)
+	for _, x := range entries {
+		names[x.Name()] = true
+	}
+	cutoff := time.Now().Add(-compactGrace)
+	for _, x := range entries {
+		name := x.Name()
+		var other string
+		temporary := strings.HasSuffix(name, ".tmp")
+		switch {
+		case temporary:
+		case strings.HasSuffix(name, ".eml"):
+			other = strings.TrimSuffix(name, ".eml") + ".json"
+		case strings.HasSuffix(name, ".json"):
+			other = strings.TrimSuffix(name, ".json") + ".eml"
+		default:
+			continue
+		}
+		if !temporary && names[other] {
+			continue
+		}
+		fi, err := x.Info()
+		if err != nil || x.IsDir() || fi.ModTime().After(cutoff) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(s.Dir, name)); err != nil && !os.IsNotExist(err) {
+			return res, err
+		}
+		if temporary {
+			res.Temporary++
+		} else {
+			res.Incomplete++
+		}
+		res.Bytes += fi.Size()
+	}
+	return res, s.Reindex()
+}
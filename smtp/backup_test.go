@@ -0,0 +1,90 @@
+package smtp
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBackupRestore(t *testing.T) {
+	src, err := NewMessageStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := &SMTPState{ReturnTo: "foo@example.net", Recipients: []string{"user1@example.com"}, Headers: []string{"Subject: Backup"}}
+	st.SetContent([]byte("Hello\r\n"))
+	id1, _ := src.Put(st)
+	id2, _ := src.Put(st)
+	src.Tag(id2, []string{"fixture"}, nil)
+
+	var b bytes.Buffer
+	if n, err := src.Backup(&b); err != nil || n != 2 {
+		t.Fatalf("unexpected backup: %d, %v", n, err)
+	}
+	dst, err := NewMessageStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst.List("")
+	if n, err := dst.Restore(bytes.NewReader(b.Bytes())); err != nil || n != 2 {
+		t.Fatalf("unexpected restore: %d, %v", n, err)
+	}
+	xs, _ := dst.List("")
+	if len(xs) != 2 || xs[0].ID != id1 || xs[1].Tags[0] != "fixture" || xs[1].Subject != "Backup" {
+		t.Errorf("unexpected messages: %v", xs)
+	}
+	if n, err := dst.Restore(bytes.NewReader(b.Bytes())); err != nil || n != 0 {
+		t.Errorf("expected the messages restored to be skipped: %d, %v", n, err)
+	}
+
+	b.Reset()
+	gw := gzip.NewWriter(&b)
+	tw := tar.NewWriter(gw)
+	tw.WriteHeader(&tar.Header{Name: "../evil.json", Mode: 0600, Typeflag: tar.TypeReg})
+	tw.Close()
+	gw.Close()
+	if _, err := dst.Restore(&b); err == nil {
+		t.Errorf("expected an error of the entry")
+	}
+}
+
+func TestCompact(t *testing.T) {
+	s, err := NewMessageStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := &SMTPState{ReturnTo: "foo@example.net", Recipients: []string{"user1@example.com"}}
+	st.SetContent([]byte("Hello\r\n"))
+	id, _ := s.Put(st)
+	old := time.Now().Add(-time.Hour)
+	for name, data := range map[string]string{
+		"a.eml":      "orphan",
+		"b.json":     "{}",
+		"c.json.tmp": "{}",
+		"d.eml":      "recent",
+	} {
+		path := filepath.Join(s.Dir, name)
+		os.WriteFile(path, []byte(data), 0600)
+		if name != "d.eml" {
+			os.Chtimes(path, old, old)
+		}
+	}
+	res, err := s.Compact()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Incomplete != 2 || res.Temporary != 1 || res.Bytes != 10 {
+		t.Errorf("unexpected result: %v", res)
+	}
+	entries, _ := os.ReadDir(s.Dir)
+	if len(entries) != 3 {
+		t.Errorf("unexpected files: %v", entries)
+	}
+	if xs, _ := s.List(""); len(xs) != 1 || xs[0].ID != id {
+		t.Errorf("unexpected messages: %v", xs)
+	}
+}
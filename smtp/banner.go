@@ -0,0 +1,153 @@
+package smtp
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Banners replaces the text of the greeting, the first line of the EHLO
+// reply and other replies with templates, e.g. to hide the software or to
+// match the banner some client tests expect. Replies are looked up by
+// the reply code with the enhanced status code, then by the reply code.
+type Banners struct {
+	Greeting *template.Template
+	Ehlo     *template.Template
+	Replies  map[string]*template.Template
+}
+
+// BannerData is the data of the templates, with the code and the text of
+// the reply replaced.
+type BannerData struct {
+	ServerName   string
+	ClientIP     string
+	ClientName   string
+	Date         string
+	Code         string
+	EnhancedCode string
+	Text         string
+}
+
+// ParseBanners reads templates in the form of "key template", one per
+// line, where the key is "greeting", "ehlo", a reply code or a reply code
+// with an enhanced status code, e.g.
+//
+//	greeting {{.ServerName}} ESMTP ready at {{.Date}}
+//	ehlo {{.ServerName}} greets {{.ClientIP}}
+//	221 Bye
+//	550 5.1.1 No such user here
+func ParseBanners(r io.Reader) (*Banners, error) {
+	b := &Banners{Replies: make(map[string]*template.Template)}
+	scanner := bufio.NewScanner(r)
+	n := 0
+	for scanner.Scan() {
+		n++
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, rest := cutField(line)
+		if isReplyCode(key) {
+			if x, next := cutField(rest); hasEnhancedStatusCode(x) {
+				key, rest = key+" "+x, next
+			}
+		} else if key = strings.ToLower(key); key != "greeting" && key != "ehlo" {
+			return nil, fmt.Errorf("line %d: unknown key: %s", n, key)
+		}
+		if len(rest) == 0 {
+			return nil, fmt.Errorf("line %d: missing template", n)
+		}
+		t, err := template.New(key).Parse(rest)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", n, err)
+		}
+		switch key {
+		case "greeting":
+			b.Greeting = t
+		case "ehlo":
+			b.Ehlo = t
+		default:
+			b.Replies[key] = t
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func isReplyCode(s string) bool {
+	return len(s) == 3 && '2' <= s[0] && s[0] <= '5' &&
+		'0' <= s[1] && s[1] <= '9' && '0' <= s[2] && s[2] <= '9'
+}
+
+func bannerData(conn *SMTPConnection, now time.Time) BannerData {
+	st := conn.State()
+	return BannerData{
+		ServerName: st.ServerName,
+		ClientIP:   conn.RemoteIP(),
+		ClientName: st.ClientName,
+		Date:       now.Format(time.RFC1123Z),
+	}
+}
+
+// execute returns the text of t, or def if t is nil or fails, which is
+// logged.
+func (b *Banners) execute(conn *SMTPConnection, t *template.Template, data BannerData, def string) string {
+	if t == nil {
+		return def
+	}
+	var sb strings.Builder
+	if err := t.Execute(&sb, data); err != nil {
+		conn.Logger().Warn("banner", "error", err.Error())
+		return def
+	}
+	return oneLine(sb.String())
+}
+
+// greeting returns the 220 reply to the connection.
+func (b *Banners) greeting(conn *SMTPConnection) string {
+	def := "Simple Mail Transfer service ready"
+	if b == nil {
+		return "220 " + def
+	}
+	return "220 " + b.execute(conn, b.Greeting, bannerData(conn, conn.Config().now()), def)
+}
+
+// ehlo returns the text of the first line of the EHLO reply.
+func (b *Banners) ehlo(conn *SMTPConnection) string {
+	def := conn.State().ServerName
+	if b == nil {
+		return def
+	}
+	return b.execute(conn, b.Ehlo, bannerData(conn, conn.Config().now()), def)
+}
+
+// reply replaces the text of the last line of a reply.
+func (b *Banners) reply(conn *SMTPConnection, line string) string {
+	if b == nil || len(b.Replies) == 0 || len(line) < 4 || line[3] != ' ' {
+		return line
+	}
+	code, text := line[:3], line[4:]
+	enhanced := ""
+	if x, rest := cutField(text); hasEnhancedStatusCode(x) {
+		enhanced, text = x, rest
+	}
+	t, ok := b.Replies[code+" "+enhanced]
+	if !ok {
+		t, ok = b.Replies[code]
+	}
+	if !ok {
+		return line
+	}
+	data := bannerData(conn, conn.Config().now())
+	data.Code, data.EnhancedCode, data.Text = code, enhanced, text
+	text = b.execute(conn, t, data, text)
+	if len(enhanced) > 0 {
+		return code + " " + enhanced + " " + text
+	}
+	return code + " " + text
+}
@@ -0,0 +1,62 @@
+package smtp
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseBanners(t *testing.T) {
+	for _, x := range []string{
+		"hello world",
+		"greeting",
+		"250 {{.Foo",
+	} {
+		if _, err := ParseBanners(strings.NewReader(x)); err == nil {
+			t.Errorf("expected an error: %s", x)
+		}
+	}
+}
+
+func TestBanners(t *testing.T) {
+	banners, err := ParseBanners(strings.NewReader(`# banners
+greeting {{.ServerName}} ESMTP ready at {{.Date}}
+ehlo {{.ServerName}} greets {{.ClientName}}
+221 See you
+550 5.1.1 {{.Code}} {{.EnhancedCode}} No such user
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock := NewFakeClock(time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC))
+	conn := NewMockConn([]byte("EHLO localhost\r\nQUIT\r\n"))
+	h := NewSMTPHandler(conn, nil)
+	h.Config.ServerName = "mx.example.com"
+	h.Config.Clock = clock
+	h.Config.Banners = banners
+	h.Run()
+	actual := string(conn.CloneOutputBuffer())
+	for _, expected := range []string{
+		"220 mx.example.com ESMTP ready at Tue, 02 Jan 2024 03:04:05 +0000\r\n",
+		"250-mx.example.com greets localhost\r\n",
+		"221 2.0.0 See you\r\n",
+	} {
+		if !strings.Contains(actual, expected) {
+			t.Errorf("expected: %q, actual: %q", expected, actual)
+		}
+	}
+
+	conn = NewMockConn(nil)
+	h = NewSMTPHandler(conn, nil)
+	h.Config.Banners = banners
+	smtpConn := NewSMTPConnection(h)
+	for _, x := range [][2]string{
+		{"550 5.1.1 User unknown", "550 5.1.1 550 5.1.1 No such user"},
+		{"550 5.7.1 Denied", "550 5.7.1 Denied"},
+		{"250-PIPELINING", "250-PIPELINING"},
+	} {
+		if actual := banners.reply(smtpConn, x[0]); actual != x[1] {
+			t.Errorf("expected: %s, actual: %s", x[1], actual)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package smtp
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// benchConn reads the input from a bytes.Reader and discards the output,
+// so that the benchmarks measure the handler rather than the MockConn.
+type benchConn struct {
+	MockConn
+	r *bytes.Reader
+	n int64
+}
+
+func (c *benchConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *benchConn) Write(b []byte) (int, error) {
+	c.n += int64(len(b))
+	return len(b), nil
+}
+
+func benchmarkSession(b *testing.B, input []byte) {
+	b.ReportAllocs()
+	b.SetBytes(int64(len(input)))
+	conn := &benchConn{}
+	send := func(st *SMTPState) error { return nil }
+	for i := 0; i < b.N; i++ {
+		conn.r = bytes.NewReader(input)
+		h := NewSMTPHandler(conn, send)
+		if err := h.Run(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkCommandLoop(b *testing.B) {
+	var input strings.Builder
+	input.WriteString("EHLO localhost\r\n")
+	for i := 0; i < 10; i++ {
+		input.WriteString("MAIL FROM:<foo@example.net> SIZE=1000\r\n")
+		fmt.Fprintf(&input, "RCPT TO:<user%d@example.com>\r\n", i)
+		input.WriteString("NOOP\r\n")
+		input.WriteString("RSET\r\n")
+	}
+	input.WriteString("QUIT\r\n")
+	benchmarkSession(b, []byte(input.String()))
+}
+
+func benchmarkData(b *testing.B, lines int) {
+	var input strings.Builder
+	input.WriteString("EHLO localhost\r\n" +
+		"MAIL FROM:<foo@example.net>\r\n" +
+		"RCPT TO:<user1@example.com>\r\n" +
+		"DATA\r\n" +
+		"From: foo@example.net\r\n" +
+		"To: user1@example.com\r\n" +
+		"Subject: Benchmark\r\n" +
+		"\r\n")
+	for i := 0; i < lines; i++ {
+		input.WriteString("The quick brown fox jumps over the lazy dog, again and again and again.\r\n")
+	}
+	input.WriteString(".\r\nQUIT\r\n")
+	benchmarkSession(b, []byte(input.String()))
+}
+
+func BenchmarkData1K(b *testing.B) {
+	benchmarkData(b, 14)
+}
+
+func BenchmarkData100K(b *testing.B) {
+	benchmarkData(b, 1400)
+}
+
+func BenchmarkParseCommand(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		ParseCommand("MAIL FROM:<foo@example.net> SIZE=1000 BODY=8BITMIME")
+	}
+}
@@ -0,0 +1,241 @@
+package smtp
+
+import (
+	"crypto/tls"
+	"fmt"
+	"math"
+	"net"
+	netsmtp "net/smtp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Benchmark sends messages to an SMTP server from concurrent clients to
+// measure its throughput and latency, e.g. to size the proxy itself or a
+// downstream MTA. Each client keeps its connection for PerConnection
+// messages, or as long as it succeeds if zero.
+type Benchmark struct {
+	Addr      string
+	HelloName string
+
+	// Concurrency is the number of clients.
+	Concurrency int
+
+	// Messages is the number of messages to send, or unlimited if zero,
+	// and Duration the time to send them for, or unlimited if zero.
+	Messages int
+	Duration time.Duration
+
+	// Size is the size of the body of the messages in bytes.
+	Size int
+
+	// The messages are sent from From to Recipients addresses: To, and
+	// local+N@domain of To beyond the first.
+	From       string
+	To         string
+	Recipients int
+
+	PerConnection int
+
+	// TLSConfig upgrades the connections with STARTTLS if set, and Auth
+	// authenticates them if set.
+	TLSConfig *tls.Config
+	Auth      netsmtp.Auth
+
+	Timeout time.Duration
+}
+
+// BenchmarkResult is the outcome of a Benchmark. The latency of a message
+// is the time of its transaction, with the connection and greeting if it
+// is the first of its connection.
+type BenchmarkResult struct {
+	Sent      int
+	Failed    int
+	Elapsed   time.Duration
+	Latencies []time.Duration
+	Errors    map[string]int
+}
+
+func NewBenchmark(addr string) *Benchmark {
+	return &Benchmark{
+		Addr:        addr,
+		HelloName:   "localhost",
+		Concurrency: 10,
+		Messages:    1000,
+		Size:        4096,
+		From:        "bench@example.net",
+		To:          "user@example.com",
+		Recipients:  1,
+		Timeout:     30 * time.Second,
+	}
+}
+
+// recipients returns the addresses the messages are sent to.
+func (b *Benchmark) recipients() []string {
+	xs := []string{b.To}
+	local, domain, _ := strings.Cut(b.To, "@")
+	for i := 1; i < b.Recipients; i++ {
+		xs = append(xs, local+"+"+strconv.Itoa(i)+"@"+domain)
+	}
+	return xs
+}
+
+// body returns lines of text of size bytes.
+func (b *Benchmark) body() []byte {
+	line := strings.Repeat("x", 76) + "\r\n"
+	var sb strings.Builder
+	for sb.Len()+len(line) <= b.Size {
+		sb.WriteString(line)
+	}
+	if n := b.Size - sb.Len(); n > 2 {
+		sb.WriteString(line[:n-2] + "\r\n")
+	}
+	return []byte(sb.String())
+}
+
+// connect returns a client which has greeted the server with the
+// connection of the client.
+func (b *Benchmark) connect() (*netsmtp.Client, net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", b.Addr, b.Timeout)
+	if err != nil {
+		return nil, nil, err
+	}
+	b.extend(conn)
+	host, _, _ := net.SplitHostPort(b.Addr)
+	c, err := netsmtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	err = c.Hello(b.HelloName)
+	if err == nil && b.TLSConfig != nil {
+		err = c.StartTLS(b.TLSConfig)
+	}
+	if err == nil && b.Auth != nil {
+		err = c.Auth(b.Auth)
+	}
+	if err != nil {
+		c.Close()
+		return nil, nil, err
+	}
+	return c, conn, nil
+}
+
+// extend sets the deadline of the connection Timeout ahead.
+func (b *Benchmark) extend(conn net.Conn) {
+	if b.Timeout > 0 {
+		conn.SetDeadline(time.Now().Add(b.Timeout))
+	}
+}
+
+// Run sends the messages and returns the result once every client has
+// finished.
+func (b *Benchmark) Run() *BenchmarkResult {
+	result := &BenchmarkResult{Errors: make(map[string]int)}
+	var mtx sync.Mutex
+	var count atomic.Int64
+	start := time.Now()
+	next := func() bool {
+		if b.Duration > 0 && time.Since(start) >= b.Duration {
+			return false
+		}
+		return b.Messages <= 0 || count.Add(1) <= int64(b.Messages)
+	}
+	record := func(d time.Duration, err error) {
+		defer mtx.Unlock()
+		mtx.Lock()
+		if err != nil {
+			result.Failed++
+			result.Errors[err.Error()]++
+			return
+		}
+		result.Sent++
+		result.Latencies = append(result.Latencies, d)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < b.Concurrency; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			b.client(i, next, record)
+		}(i)
+	}
+	wg.Wait()
+	result.Elapsed = time.Since(start)
+	sort.Slice(result.Latencies, func(i, j int) bool { return result.Latencies[i] < result.Latencies[j] })
+	return result
+}
+
+// client sends messages while next returns true.
+func (b *Benchmark) client(id int, next func() bool, record func(time.Duration, error)) {
+	st := &SMTPState{ReturnTo: b.From}
+	st.SetContent(b.body())
+	defer st.Close()
+	recipients := b.recipients()
+	var c *netsmtp.Client
+	var conn net.Conn
+	defer func() {
+		if c != nil {
+			c.Quit()
+		}
+	}()
+	n := 0
+	for next() {
+		n++
+		st.Headers = []string{
+			"From: " + b.From,
+			"To: " + b.To,
+			fmt.Sprintf("Subject: Benchmark %d-%d", id, n),
+			"Date: " + time.Now().Format(time.RFC1123Z),
+			fmt.Sprintf("Message-ID: <bench.%d.%d.%d@%s>", time.Now().UnixNano(), id, n, b.HelloName),
+		}
+		start := time.Now()
+		var err error
+		if c == nil {
+			c, conn, err = b.connect()
+		} else {
+			b.extend(conn)
+		}
+		if err == nil {
+			err = transaction(c, st, recipients, "")
+		}
+		record(time.Since(start), err)
+		if err != nil {
+			if c != nil {
+				c.Close()
+				c = nil
+			}
+		} else if b.PerConnection > 0 && n%b.PerConnection == 0 {
+			c.Quit()
+			c = nil
+		}
+	}
+}
+
+// Throughput returns the messages sent per second.
+func (r *BenchmarkResult) Throughput() float64 {
+	if r.Elapsed <= 0 {
+		return 0
+	}
+	return float64(r.Sent) / r.Elapsed.Seconds()
+}
+
+// Percentile returns the latency below which the fraction p of the
+// messages sent were, by the nearest rank.
+func (r *BenchmarkResult) Percentile(p float64) time.Duration {
+	if len(r.Latencies) == 0 {
+		return 0
+	}
+	i := int(math.Ceil(p*float64(len(r.Latencies)))) - 1
+	if i < 0 {
+		i = 0
+	}
+	if i >= len(r.Latencies) {
+		i = len(r.Latencies) - 1
+	}
+	return r.Latencies[i]
+}
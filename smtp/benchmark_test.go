@@ -0,0 +1,118 @@
+package smtp
+
+import (
+	"net"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// serveBenchmark accepts connections of a fake server recording the
+// recipients and the size of the messages, and rejecting recipients at
+// example.org.
+func serveBenchmark(lsnr net.Listener, mtx *sync.Mutex, received *[]string) {
+	for {
+		conn, err := lsnr.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			tc := textproto.NewConn(conn)
+			defer tc.Close()
+			tc.PrintfLine("220 localhost")
+			rcpts := ""
+			for {
+				line, err := tc.ReadLine()
+				if err != nil {
+					return
+				}
+				switch strings.Fields(line)[0] {
+				case "EHLO":
+					tc.PrintfLine("250 localhost")
+				case "RCPT":
+					if strings.Contains(line, "@example.org") {
+						tc.PrintfLine("550 No such user")
+						continue
+					}
+					rcpts += " " + line[len("RCPT TO:"):]
+					tc.PrintfLine("250 OK")
+				case "DATA":
+					tc.PrintfLine("354 Go ahead")
+					b, _ := tc.ReadDotBytes()
+					mtx.Lock()
+					*received = append(*received, strings.TrimSpace(rcpts))
+					mtx.Unlock()
+					rcpts = ""
+					tc.PrintfLine("250 OK %d", len(b))
+				case "QUIT":
+					tc.PrintfLine("221 Bye")
+					return
+				default:
+					tc.PrintfLine("250 OK")
+				}
+			}
+		}()
+	}
+}
+
+func TestBenchmark(t *testing.T) {
+	lsnr, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip(err)
+	}
+	defer lsnr.Close()
+	var mtx sync.Mutex
+	var received []string
+	go serveBenchmark(lsnr, &mtx, &received)
+
+	b := NewBenchmark(lsnr.Addr().String())
+	b.Concurrency = 3
+	b.Messages = 20
+	b.Recipients = 2
+	b.PerConnection = 4
+	result := b.Run()
+	if result.Sent != 20 || result.Failed != 0 || len(result.Latencies) != 20 {
+		t.Fatalf("unexpected result: %d sent, %d failed, %v", result.Sent, result.Failed, result.Errors)
+	}
+	if result.Throughput() <= 0 || result.Percentile(0.5) > result.Percentile(0.99) {
+		t.Errorf("unexpected statistics: %f, %v, %v", result.Throughput(), result.Percentile(0.5), result.Percentile(0.99))
+	}
+	mtx.Lock()
+	expected := "<user@example.com> <user+1@example.com>"
+	if len(received) != 20 || received[0] != expected {
+		t.Errorf("expected: %s, actual: %v", expected, received)
+	}
+	mtx.Unlock()
+
+	b.To = "user@example.org"
+	b.Messages = 0
+	b.Duration = 100 * time.Millisecond
+	result = b.Run()
+	if result.Sent != 0 || result.Failed == 0 || len(result.Errors) != 1 {
+		t.Errorf("unexpected result: %d sent, %d failed, %v", result.Sent, result.Failed, result.Errors)
+	}
+}
+
+func TestBenchmarkBody(t *testing.T) {
+	b := NewBenchmark("")
+	for _, size := range []int{0, 100, 4096} {
+		b.Size = size
+		if actual := len(b.body()); actual != size {
+			t.Errorf("expected: %d, actual: %d", size, actual)
+		}
+	}
+}
+
+func TestBenchmarkPercentile(t *testing.T) {
+	r := &BenchmarkResult{}
+	for i := 1; i <= 100; i++ {
+		r.Latencies = append(r.Latencies, time.Duration(i)*time.Millisecond)
+	}
+	for p, expected := range map[float64]time.Duration{0: time.Millisecond, 0.5: 50 * time.Millisecond, 0.99: 99 * time.Millisecond, 1: 100 * time.Millisecond} {
+		if actual := r.Percentile(p); actual != expected {
+			t.Errorf("%v: expected: %v, actual: %v", p, expected, actual)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package smtp
+
+import (
+	"errors"
+	"sync"
+)
+
+var ErrInsufficientStorage = errors.New("smtp: memory budget exceeded")
+
+// MemoryBudget tracks the bytes buffered by in-flight DATA and BDAT
+// transfers across all connections sharing it.
+type MemoryBudget struct {
+	Limit int64
+
+	used int64
+	mtx  sync.Mutex
+}
+
+func NewMemoryBudget(limit int64) *MemoryBudget {
+	return &MemoryBudget{Limit: limit}
+}
+
+// Reserve accounts n bytes and reports whether they fit in the budget.
+// Nothing is reserved when it returns false.
+func (b *MemoryBudget) Reserve(n int64) bool {
+	if b == nil {
+		return true
+	}
+	defer b.mtx.Unlock()
+	b.mtx.Lock()
+	if b.Limit > 0 && b.used+n > b.Limit {
+		return false
+	}
+	b.used += n
+	return true
+}
+
+func (b *MemoryBudget) Release(n int64) {
+	if b == nil {
+		return
+	}
+	defer b.mtx.Unlock()
+	b.mtx.Lock()
+	b.used -= n
+	if b.used < 0 {
+		b.used = 0
+	}
+}
+
+func (b *MemoryBudget) Used() int64 {
+	if b == nil {
+		return 0
+	}
+	defer b.mtx.Unlock()
+	b.mtx.Lock()
+	return b.used
+}
@@ -0,0 +1,27 @@
+package smtp
+
+import (
+	"testing"
+)
+
+func TestMemoryBudget(t *testing.T) {
+	b := NewMemoryBudget(100)
+	if !b.Reserve(60) {
+		t.Errorf("expected 60 bytes to be reserved")
+	}
+	if b.Reserve(50) {
+		t.Errorf("expected 50 bytes to exceed the budget")
+	}
+	if actual := b.Used(); actual != 60 {
+		t.Errorf("expected: 60, actual: %d", actual)
+	}
+	b.Release(60)
+	if !b.Reserve(100) {
+		t.Errorf("expected 100 bytes to be reserved")
+	}
+
+	var unlimited *MemoryBudget
+	if !unlimited.Reserve(1 << 30) {
+		t.Errorf("nil budget must not limit")
+	}
+}
@@ -0,0 +1,188 @@
+package smtp
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CaptureRecord is a chunk of the bytes of a recorded session, sent by the
+// client if Dir is "C" or by the server if "S".
+type CaptureRecord struct {
+	Offset time.Duration `json:"offset"`
+	Dir    string        `json:"dir"`
+	Data   []byte        `json:"data"`
+}
+
+// Capture records the complete bytes of a session as JSON lines of
+// CaptureRecord, to be replayed with Replay. The bytes after STARTTLS are
+// recorded as decrypted, so such sessions can not be replayed.
+type Capture struct {
+	f     *os.File
+	enc   *json.Encoder
+	start time.Time
+	mtx   sync.Mutex
+}
+
+// OpenCapture creates the capture file of the session in dir.
+func OpenCapture(dir, sessionID string, now time.Time) (*Capture, error) {
+	name := now.UTC().Format("20060102T150405") + "-" + sessionID + ".jsonl"
+	f, err := os.OpenFile(filepath.Join(dir, name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &Capture{f: f, enc: json.NewEncoder(f), start: now}, nil
+}
+
+func (c *Capture) record(dir string, b []byte) {
+	defer c.mtx.Unlock()
+	c.mtx.Lock()
+	c.enc.Encode(CaptureRecord{Offset: time.Since(c.start), Dir: dir, Data: b})
+}
+
+func (c *Capture) Close() error {
+	return c.f.Close()
+}
+
+type captureReader struct {
+	r io.Reader
+	c *Capture
+}
+
+func (cr captureReader) Read(b []byte) (int, error) {
+	n, err := cr.r.Read(b)
+	if n > 0 {
+		cr.c.record("C", b[:n])
+	}
+	return n, err
+}
+
+type captureWriter struct {
+	w io.Writer
+	c *Capture
+}
+
+func (cw captureWriter) Write(b []byte) (int, error) {
+	cw.c.record("S", b)
+	return cw.w.Write(b)
+}
+
+// ReadCapture reads the records of a capture file.
+func ReadCapture(r io.Reader) ([]CaptureRecord, error) {
+	records := make([]CaptureRecord, 0)
+	dec := json.NewDecoder(r)
+	for {
+		var x CaptureRecord
+		err := dec.Decode(&x)
+		if err == io.EOF {
+			return records, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, x)
+	}
+}
+
+// isFinalReply reports whether the line is the last line of a reply.
+func isFinalReply(line string) bool {
+	return len(line) == 3 || (len(line) > 3 && line[3] == ' ')
+}
+
+func countFinalReplies(b []byte) int {
+	n := 0
+	for _, x := range strings.Split(string(b), "\n") {
+		if isFinalReply(strings.TrimSuffix(x, "\r")) {
+			n++
+		}
+	}
+	return n
+}
+
+// Replay sends the client side of the records to a server on conn and
+// returns the bytes it replies. Before each client record, it waits for as
+// many replies as the server sent before the record in the capture, so
+// that the session is replayed in the same order regardless of the speed
+// of the server. If timing is true, the recorded delays are kept as well.
+// A read from the server times out after timeout.
+func Replay(conn net.Conn, records []CaptureRecord, timing bool, timeout time.Duration) ([]byte, error) {
+	r := bufio.NewReader(conn)
+	out := make([]byte, 0)
+	replies := 0
+	wait := func(n int) error {
+		for replies < n {
+			conn.SetReadDeadline(time.Now().Add(timeout))
+			line, err := r.ReadString('\n')
+			out = append(out, line...)
+			if err != nil {
+				return err
+			}
+			if isFinalReply(strings.TrimRight(line, "\r\n")) {
+				replies++
+			}
+		}
+		return nil
+	}
+	start := time.Now()
+	var server []byte
+	for _, x := range records {
+		if x.Dir != "C" {
+			server = append(server, x.Data...)
+			continue
+		}
+		if err := wait(countFinalReplies(server)); err != nil {
+			return out, err
+		}
+		if d := time.Until(start.Add(x.Offset)); timing && d > 0 {
+			time.Sleep(d)
+		}
+		if _, err := conn.Write(x.Data); err != nil {
+			return out, err
+		}
+	}
+	if err := wait(countFinalReplies(server)); err != nil && err != io.EOF {
+		return out, err
+	}
+	return out, nil
+}
+
+func finalReplyCodes(b []byte) []string {
+	codes := make([]string, 0)
+	for _, x := range strings.Split(string(b), "\n") {
+		if x = strings.TrimSuffix(x, "\r"); isFinalReply(x) {
+			codes = append(codes, x[:3])
+		}
+	}
+	return codes
+}
+
+// CompareReplies returns an error describing the first reply of the
+// replayed session whose code differs from the recorded one.
+func CompareReplies(records []CaptureRecord, replayed []byte) error {
+	var server []byte
+	for _, x := range records {
+		if x.Dir == "S" {
+			server = append(server, x.Data...)
+		}
+	}
+	expected, actual := finalReplyCodes(server), finalReplyCodes(replayed)
+	for i, x := range expected {
+		if i >= len(actual) {
+			return fmt.Errorf("smtp: reply %d: expected %s, actual none", i+1, x)
+		}
+		if actual[i] != x {
+			return fmt.Errorf("smtp: reply %d: expected %s, actual %s", i+1, x, actual[i])
+		}
+	}
+	if len(actual) > len(expected) {
+		return fmt.Errorf("smtp: reply %d: expected none, actual %s", len(expected)+1, actual[len(expected)])
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package smtp
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCaptureReplay(t *testing.T) {
+	dir := t.TempDir()
+	conn := NewMockConn([]byte("EHLO localhost\r\n" +
+		"MAIL FROM: <foo@example.net>\r\n" +
+		"RCPT TO: <user1@example.com>\r\n" +
+		"DATA\r\n" +
+		"Subject: Capture\r\n" +
+		"\r\n" +
+		"Hello\r\n" +
+		".\r\n" +
+		"QUIT\r\n"))
+	h := NewSMTPHandler(conn, func(st *SMTPState) error { return nil })
+	h.Config.CaptureDir = dir
+	h.Run()
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*.jsonl"))
+	if len(files) != 1 {
+		t.Fatalf("expected a capture: %v", files)
+	}
+	f, err := os.Open(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	records, err := ReadCapture(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) == 0 || records[0].Dir != "S" {
+		t.Fatalf("expected the greeting first: %v", records)
+	}
+
+	replay := func(send func(st *SMTPState) error) error {
+		client, server := net.Pipe()
+		defer client.Close()
+		go NewSMTPHandler(server, send).Run()
+		out, err := Replay(client, records, false, 5*time.Second)
+		if err != nil {
+			return err
+		}
+		return CompareReplies(records, out)
+	}
+	if err := replay(func(st *SMTPState) error { return nil }); err != nil {
+		t.Error(err)
+	}
+	err = replay(func(st *SMTPState) error { return errors.New("failed") })
+	expected := "smtp: reply 6: expected 250, actual 554"
+	if err == nil || err.Error() != expected {
+		t.Errorf("expected: %s, actual: %v", expected, err)
+	}
+}
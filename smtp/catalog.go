@@ -0,0 +1,192 @@
+package smtp
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// defaultReplies are the replies of the situations in a session, with
+// "%s" in place of the argument of those taking one.
+var defaultReplies = map[string]string{
+	"session.not_started":         "503 5.5.1 Session has not started yet.",
+	"session.draining":            "421 4.3.2 Service not available, closing transmission channel",
+	"session.shutdown":            "421 4.3.2 %s Service closing transmission channel",
+	"session.terminated":          "421 4.3.2 Session terminated by the administrator",
+	"command.unknown":             "500 5.5.2 Command not recognized",
+	"command.empty":               "500 5.5.2 Command must not be empty",
+	"command.too_long":            "500 5.5.2 Line too long",
+	"command.not_implemented":     "502 5.5.1 Command not implemented",
+	"transaction.in_progress":     "503 5.5.1 Mail transaction in progress",
+	"storage.insufficient":        "452 4.3.1 Insufficient system storage",
+	"param.unsupported":           "555 5.5.4 Unsupported parameter %s",
+	"address.not_utf8":            "501 5.6.7 Address is not valid UTF-8",
+	"address.needs_smtputf8":      "553 5.6.7 Non-ASCII address requires SMTPUTF8",
+	"helo.syntax":                 "501 5.5.4 Invalid syntax (EHLO|HELO) domain",
+	"starttls.required":           "530 5.7.0 Must issue a STARTTLS command first",
+	"starttls.unavailable":        "454 4.7.0 TLS not available",
+	"starttls.active":             "503 5.5.1 TLS already active",
+	"starttls.syntax":             "501 5.5.4 Syntax error (no parameters allowed)",
+	"starttls.ready":              "220 2.0.0 Ready to start TLS",
+	"auth.required":               "530 5.7.0 Authentication required",
+	"auth.unavailable":            "502 5.5.1 Authentication not available",
+	"auth.encryption_required":    "538 5.7.11 Encryption required",
+	"auth.already":                "503 Already authenticated",
+	"auth.in_transaction":         "503 5.5.1 AUTH not permitted during a mail transaction",
+	"auth.syntax":                 "501 Invalid syntax AUTH mechanism [initial-response]",
+	"auth.unknown_mechanism":      "504 Unrecognized authentication type",
+	"auth.cancelled":              "501 5.7.0 Authentication cancelled",
+	"auth.plain_invalid":          "501 Invalid PLAIN authentication response",
+	"auth.ok":                     "235 Authentication successful",
+	"auth.invalid":                "535 Authentication credentials invalid",
+	"auth.too_many_failures":      "421 4.7.0 Too many authentication failures",
+	"mail.sender_exists":          "503 5.5.1 Sender already specified",
+	"mail.syntax":                 "501 5.5.4 Invalid syntax MAIL FROM: <foo@example.net>",
+	"mail.size_invalid":           "501 Invalid SIZE parameter",
+	"mail.body_invalid":           "501 Invalid BODY parameter",
+	"mail.smtputf8_value":         "501 SMTPUTF8 takes no value",
+	"mail.requiretls_value":       "501 REQUIRETLS takes no value",
+	"mail.requiretls_without_tls": "530 5.7.10 REQUIRETLS needs a TLS session",
+	"mail.ret_invalid":            "501 Invalid RET parameter",
+	"mail.envid_invalid":          "501 Invalid ENVID parameter",
+	"mail.priority_invalid":       "501 5.5.4 Invalid MT-PRIORITY parameter",
+	"mail.by_invalid":             "501 5.5.4 Invalid BY parameter",
+	"mail.bad_address":            "501 5.1.7 Bad sender address syntax",
+	"mail.not_owned":              "553 5.7.1 Sender address not owned by the authenticated user",
+	"mail.domain_lookup_failed":   "451 4.4.3 Sender address domain lookup failed",
+	"mail.null_mx":                "550 5.7.27 Sender address has null MX",
+	"mail.domain_not_found":       "550 5.1.8 Sender address domain not found",
+	"mail.spf_failed":             "550 5.7.23 SPF validation failed",
+	"mail.ok":                     "250 2.1.0 OK",
+	"rcpt.need_mail":              "503 5.5.1 Need MAIL before RCPT",
+	"rcpt.too_many":               "452 4.5.3 Too many recipients",
+	"rcpt.syntax":                 "501 5.5.4 Invalid syntax RCPT TO: <foo@example.net>",
+	"rcpt.notify_invalid":         "501 Invalid NOTIFY parameter",
+	"rcpt.orcpt_invalid":          "501 Invalid ORCPT parameter",
+	"rcpt.bad_address":            "501 5.1.3 Bad recipient address syntax",
+	"rcpt.relay_denied":           "550 5.7.1 Relay access denied",
+	"rcpt.bad_alias":              "550 5.1.1 Bad alias for recipient address",
+	"rcpt.mailbox_full":           "452 4.2.2 Mailbox full",
+	"rcpt.unknown":                "550 5.1.1 Recipient address rejected: User unknown",
+	"rcpt.verify_failed":          "451 4.3.0 Recipient address verification failed, try again later",
+	"rcpt.bad_bounce_signature":   "550 5.7.1 Invalid bounce address signature",
+	"rcpt.ok":                     "250 2.1.5 OK",
+	"data.need_rcpt":              "503 5.5.1 Need RCPT before DATA",
+	"data.start":                  "354 Start mail input; end with <CRLF>.<CRLF>",
+	"data.queued":                 "250 2.0.0 Ok: queued as %s",
+	"bdat.need_rcpt":              "503 5.5.1 Need RCPT before BDAT",
+	"bdat.syntax":                 "501 Invalid syntax BDAT size [LAST]",
+	"bdat.chunk_invalid":          "501 Invalid chunk size",
+	"bdat.chunk_ok":               "250 %s octets received",
+	"lmtp.accepted":               "250 2.0.0 Message accepted",
+	"lmtp.failed":                 "550 5.1.1 <%s> Delivery failed",
+	"message.too_big":             "552 Message size exceeds fixed maximum message size",
+	"message.line_too_long":       "552 5.3.4 Message line too long",
+	"message.too_many_headers":    "552 5.3.4 Too many header lines",
+	"message.bare_line_ending":    "554 5.6.0 Message contains bare CR or LF",
+	"message.loop":                "554 5.4.6 Routing loop detected",
+	"message.deliver_at_invalid":  "554 5.6.0 Invalid %s header",
+	"message.local_error":         "451 4.3.0 Local error in processing",
+	"message.requiretls":          "550 5.7.10 REQUIRETLS support required",
+	"message.smtputf8":            "553 5.6.7 SMTPUTF8 not supported downstream",
+	"message.failed":              "554 5.3.0 Transaction failed",
+	"message.deferred":            "451 4.3.0 Delivery failed temporarily, try again later",
+	"message.dmarc_rejected":      "550 5.7.1 Rejected by DMARC policy of %s",
+	"message.scanner_unavailable": "451 4.7.1 Content scanner unavailable",
+	"message.spam":                "550 5.7.1 Message rejected as spam",
+	"rset.ok":                     "250 OK",
+	"noop.ok":                     "250 OK",
+	"vrfy.not_supported":          "502 5.5.1 VRFY not supported",
+	"vrfy.syntax":                 "501 5.5.4 Syntax: VRFY <address>",
+	"expn.not_supported":          "502 5.5.1 EXPN not supported",
+	"expn.syntax":                 "501 5.5.4 Syntax: EXPN <list>",
+	"expn.invalid_address":        "501 5.1.3 Invalid address",
+	"expn.no_list":                "550 5.1.1 No such mailing list",
+	"help.syntax":                 "501 5.5.4 Syntax: HELP [command]",
+	"help.unknown":                "504 5.5.1 HELP topic unknown: %s",
+	"quit.ok":                     "221 Bye",
+	"etrn.syntax":                 "501 5.5.4 Invalid syntax ETRN domain",
+	"etrn.unavailable":            "458 4.3.0 Unable to queue messages for node %s",
+	"etrn.denied":                 "459 4.7.1 Node %s not allowed",
+	"etrn.no_messages":            "251 2.0.0 OK, no messages waiting for node %s",
+	"etrn.ok":                     "250 2.0.0 OK, queuing for node %s started",
+	"atrn.syntax":                 "501 5.5.4 Invalid syntax ATRN [domain[,domain]...]",
+	"atrn.domains_required":       "501 5.5.4 Domains required",
+	"atrn.refused":                "450 4.7.0 ATRN request refused for %s",
+	"atrn.unavailable":            "451 4.3.0 Unable to process ATRN request now",
+	"atrn.no_mail":                "453 4.3.0 You have no mail",
+	"atrn.ok":                     "250 2.0.0 OK now reversing the connection",
+	"xclient.denied":              "550 5.7.0 Insufficient authorization",
+	"xclient.syntax":              "501 5.5.4 Invalid syntax XCLIENT attribute=value...",
+	"xclient.bad_attribute":       "501 5.5.4 Bad XCLIENT attribute: %s",
+	"xclient.bad_value":           "501 5.5.4 Bad XCLIENT attribute value: %s",
+	"xclient.bad_address":         "501 5.5.4 Bad XCLIENT address",
+	"xclient.bad_protocol":        "501 5.5.4 Bad XCLIENT protocol: %s",
+}
+
+// Catalog replaces the replies of the situations in a session, e.g. to
+// match the wording expected by compliance tests and legacy clients, or
+// to translate them. The methods of a nil Catalog return the defaults.
+type Catalog struct {
+	replies map[string]string
+}
+
+// ParseCatalog reads replies in the form of "situation reply", one per
+// line, e.g.
+//
+//	rcpt.relay_denied 554 5.7.1 Relaying denied
+//	data.start 354 Send message content; end with <CRLF>.<CRLF>
+//	data.queued 250 2.0.0 Queued as %s
+//
+// A reply keeps the code of the default, and "%s" is replaced by the
+// argument of situations taking one, e.g. the queue ID of data.queued.
+func ParseCatalog(r io.Reader) (*Catalog, error) {
+	c := &Catalog{replies: make(map[string]string)}
+	scanner := bufio.NewScanner(r)
+	n := 0
+	for scanner.Scan() {
+		n++
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, reply := cutField(line)
+		def, ok := defaultReplies[key]
+		if !ok {
+			return nil, fmt.Errorf("line %d: unknown situation: %s", n, key)
+		}
+		if len(reply) < 4 || reply[:4] != def[:4] {
+			return nil, fmt.Errorf("line %d: %s must begin with %s", n, key, def[:3])
+		}
+		c.replies[key] = reply
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Reply returns the reply of the situation, with the arguments in place
+// of "%s" in order. The arguments are not themselves substituted.
+func (c *Catalog) Reply(key string, args ...string) string {
+	reply, ok := "", false
+	if c != nil {
+		reply, ok = c.replies[key]
+	}
+	if !ok {
+		reply = defaultReplies[key]
+	}
+	if len(args) == 0 {
+		return reply
+	}
+	parts := strings.SplitN(reply, "%s", len(args)+1)
+	var b strings.Builder
+	for i, x := range parts {
+		if i > 0 {
+			b.WriteString(args[i-1])
+		}
+		b.WriteString(x)
+	}
+	return b.String()
+}
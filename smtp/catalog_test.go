@@ -0,0 +1,98 @@
+package smtp
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseCatalog(t *testing.T) {
+	c, err := ParseCatalog(strings.NewReader("# legacy wording\n" +
+		"data.start 354 Go ahead\n" +
+		"data.queued 250 2.0.0 Queued as %s\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected, actual := "354 Go ahead", c.Reply("data.start"); expected != actual {
+		t.Errorf("expected: %s, actual: %s", expected, actual)
+	}
+	if expected, actual := "250 2.0.0 Queued as 0ABC", c.Reply("data.queued", "0ABC"); expected != actual {
+		t.Errorf("expected: %s, actual: %s", expected, actual)
+	}
+	if expected, actual := "221 Bye", c.Reply("quit.ok"); expected != actual {
+		t.Errorf("expected: %s, actual: %s", expected, actual)
+	}
+	var nilCatalog *Catalog
+	if expected, actual := "555 5.5.4 Unsupported parameter FOO", nilCatalog.Reply("param.unsupported", "FOO"); expected != actual {
+		t.Errorf("expected: %s, actual: %s", expected, actual)
+	}
+
+	for _, x := range []string{"data.begin 354 Go ahead", "data.start 250 Go ahead", "quit.ok"} {
+		if _, err := ParseCatalog(strings.NewReader(x)); err == nil {
+			t.Errorf("expected an error: %s", x)
+		}
+	}
+}
+
+func TestCatalogReplies(t *testing.T) {
+	conn := NewMockConn([]byte("EHLO localhost\r\n" +
+		"MAIL FROM: <foo@example.net>\r\n" +
+		"RCPT TO: <user1@example.com>\r\n" +
+		"DATA\r\n" +
+		"Subject: Catalog\r\n" +
+		"\r\n" +
+		".\r\n" +
+		"QUIT\r\n"))
+	h := NewSMTPHandler(conn, func(st *SMTPState) error { return nil })
+	c, err := ParseCatalog(strings.NewReader("mail.ok 250 Absender OK\n" +
+		"rcpt.ok 250 2.1.5 Empfänger OK\n" +
+		"data.start 354 Daten senden\n" +
+		"quit.ok 221 Tschüss\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.Config.Catalog = c
+	h.Run()
+	out := string(conn.CloneOutputBuffer())
+	for _, x := range []string{"250 2.0.0 Absender OK\r\n", "250 2.1.5 Empfänger OK\r\n", "354 Daten senden\r\n", "221 2.0.0 Tschüss\r\n"} {
+		if !strings.Contains(out, x) {
+			t.Errorf("expected %q: %s", x, out)
+		}
+	}
+}
+
+func TestCatalogReplyArgs(t *testing.T) {
+	var c *Catalog
+	for _, fixture := range []struct {
+		key      string
+		args     []string
+		expected string
+	}{
+		{"session.shutdown", []string{"mx.example.net"}, "421 4.3.2 mx.example.net Service closing transmission channel"},
+		{"session.shutdown", []string{"%s%s"}, "421 4.3.2 %s%s Service closing transmission channel"},
+		{"session.shutdown", []string{"a", "b"}, "421 4.3.2 a Service closing transmission channel"},
+		{"session.shutdown", nil, "421 4.3.2 %s Service closing transmission channel"},
+	} {
+		if actual := c.Reply(fixture.key, fixture.args...); actual != fixture.expected {
+			t.Errorf("%v: expected: %s, actual: %s", fixture.args, fixture.expected, actual)
+		}
+	}
+	c, err := ParseCatalog(strings.NewReader("data.queued 250 2.0.0 %s queued as %s\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected, actual := "250 2.0.0 100%s queued as x", c.Reply("data.queued", "100%s", "x"); expected != actual {
+		t.Errorf("expected: %s, actual: %s", expected, actual)
+	}
+}
+
+func TestDefaultRepliesStatusClass(t *testing.T) {
+	for k, x := range defaultReplies {
+		fields := strings.Fields(x)
+		if len(fields) < 2 || strings.Count(fields[1], ".") != 2 {
+			continue
+		}
+		if fields[0][0] != fields[1][0] {
+			t.Errorf("unexpected class of the enhanced status code: %s %s", k, x)
+		}
+	}
+}
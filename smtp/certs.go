@@ -0,0 +1,96 @@
+package smtp
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"os"
+	"sync"
+	"time"
+)
+
+// CertificateLoader serves a certificate from PEM files, reloading them
+// when they are modified so renewed certificates take effect without a
+// restart. It is used as tls.Config.GetCertificate.
+type CertificateLoader struct {
+	CertFile string
+	KeyFile  string
+
+	// CheckInterval is the minimum interval between checks of the files.
+	CheckInterval time.Duration
+
+	mtx     sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+	checked time.Time
+}
+
+// NewCertificateLoader loads the files, failing if they are invalid.
+func NewCertificateLoader(certFile, keyFile string) (*CertificateLoader, error) {
+	l := &CertificateLoader{
+		CertFile:      certFile,
+		KeyFile:       keyFile,
+		CheckInterval: 10 * time.Second,
+	}
+	if err := l.Reload(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *CertificateLoader) lastModified() (time.Time, error) {
+	var t time.Time
+	for _, x := range []string{l.CertFile, l.KeyFile} {
+		fi, err := os.Stat(x)
+		if err != nil {
+			return t, err
+		}
+		if fi.ModTime().After(t) {
+			t = fi.ModTime()
+		}
+	}
+	return t, nil
+}
+
+// Reload loads the files regardless of their modification time.
+func (l *CertificateLoader) Reload() error {
+	t, err := l.lastModified()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(l.CertFile, l.KeyFile)
+	if err != nil {
+		return err
+	}
+	if cert.Leaf == nil {
+		if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return err
+		}
+	}
+	defer l.mtx.Unlock()
+	l.mtx.Lock()
+	l.cert, l.modTime, l.checked = &cert, t, time.Now()
+	return nil
+}
+
+// GetCertificate returns the current certificate, reloading the files if
+// modified since they were loaded. The previous certificate is kept while
+// the files are invalid, e.g. in the middle of being replaced.
+func (l *CertificateLoader) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	l.mtx.Lock()
+	cert, modTime := l.cert, l.modTime
+	check := time.Since(l.checked) >= l.CheckInterval
+	if check {
+		l.checked = time.Now()
+	}
+	l.mtx.Unlock()
+	if check {
+		if t, err := l.lastModified(); err == nil && !t.Equal(modTime) {
+			if l.Reload() == nil {
+				l.mtx.Lock()
+				cert = l.cert
+				l.mtx.Unlock()
+			}
+		}
+	}
+	return cert, nil
+}
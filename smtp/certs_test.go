@@ -0,0 +1,56 @@
+package smtp
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeTestCertificate(t *testing.T, dir string, cert tls.Certificate, modTime time.Time) (string, string) {
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	der, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600)
+	os.Chtimes(certFile, modTime, modTime)
+	os.Chtimes(keyFile, modTime, modTime)
+	return certFile, keyFile
+}
+
+func TestCertificateLoader(t *testing.T) {
+	dir := t.TempDir()
+	first, _ := testCertificate(t, "mx.example.com")
+	second, _ := testCertificate(t, "mx.example.com")
+	now := time.Now()
+	certFile, keyFile := writeTestCertificate(t, dir, first, now.Add(-time.Hour))
+	l, err := NewCertificateLoader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.CheckInterval = 0
+	cert, _ := l.GetCertificate(nil)
+	if string(cert.Certificate[0]) != string(first.Certificate[0]) {
+		t.Errorf("expected the first certificate")
+	}
+	writeTestCertificate(t, dir, second, now)
+	cert, _ = l.GetCertificate(nil)
+	if string(cert.Certificate[0]) != string(second.Certificate[0]) {
+		t.Errorf("expected the second certificate")
+	}
+	// an invalid file keeps the current certificate
+	os.WriteFile(keyFile, []byte("broken"), 0600)
+	os.Chtimes(keyFile, now.Add(time.Hour), now.Add(time.Hour))
+	cert, _ = l.GetCertificate(nil)
+	if string(cert.Certificate[0]) != string(second.Certificate[0]) {
+		t.Errorf("expected the second certificate")
+	}
+	if _, err := NewCertificateLoader(certFile, keyFile); err == nil {
+		t.Errorf("expected an error")
+	}
+}
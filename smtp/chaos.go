@@ -0,0 +1,232 @@
+package smtp
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ChaosRule rejects a stage of sessions with the probability, or delays
+// the reply to a command, or the greeting for the connect stage, by Delay,
+// or by a random duration up to MaxDelay if longer. A rule of the data
+// stage with Disconnect drops the connection after the octets of message
+// data instead. A rejected data stage is replied after the final dot, so
+// the message is read but not delivered.
+type ChaosRule struct {
+	// Stage is one of connect, auth, mail, rcpt or data, or the verb of
+	// a command to delay.
+	Stage       string
+	Probability float64
+	Code        int
+	Delay       time.Duration
+	MaxDelay    time.Duration
+	Disconnect  int64
+}
+
+// Chaos injects failures to test the retry and error handling of clients
+// against an uncooperative server. It is registered to the hooks, so the
+// failures replace the replies after the checks of the commands.
+type Chaos struct {
+	Rules []ChaosRule
+
+	// Rand returns a number in [0.0, 1.0). It defaults to math/rand.
+	Rand func() float64
+}
+
+var chaosStages = []string{"connect", "auth", "mail", "rcpt", "data"}
+
+// ParseChaos parses rules in the form of
+// "stage [probability=P] [code=NNN | delay=D[-D] | disconnect=N]", e.g.
+// "rcpt probability=0.2 code=450", "ehlo delay=1s-5s" or
+// "data disconnect=1024". The probability
+// defaults to 1 and the code to 421 for connect and 451 for the others.
+func ParseChaos(r io.Reader) (*Chaos, error) {
+	c := &Chaos{}
+	scanner := bufio.NewScanner(r)
+	n := 0
+	for scanner.Scan() {
+		n++
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		xs := strings.Fields(line)
+		rule := ChaosRule{Stage: strings.ToLower(xs[0]), Probability: 1}
+		for _, x := range xs[1:] {
+			kv := strings.SplitN(x, "=", 2)
+			if len(kv) != 2 {
+				return nil, fmt.Errorf("line %d: unknown option: %s", n, x)
+			}
+			switch kv[0] {
+			case "probability":
+				p, err := strconv.ParseFloat(kv[1], 64)
+				if err != nil || p < 0 || p > 1 {
+					return nil, fmt.Errorf("line %d: invalid probability: %s", n, kv[1])
+				}
+				rule.Probability = p
+			case "code":
+				code, err := strconv.Atoi(kv[1])
+				if err != nil || code < 400 || code > 599 {
+					return nil, fmt.Errorf("line %d: invalid code: %s", n, kv[1])
+				}
+				rule.Code = code
+			case "delay":
+				d, max, err := parseDelayRange(kv[1])
+				if err != nil {
+					return nil, fmt.Errorf("line %d: invalid delay: %s", n, kv[1])
+				}
+				rule.Delay, rule.MaxDelay = d, max
+			case "disconnect":
+				v, err := strconv.ParseInt(kv[1], 10, 64)
+				if err != nil || v <= 0 {
+					return nil, fmt.Errorf("line %d: invalid disconnect: %s", n, kv[1])
+				}
+				rule.Disconnect = v
+			default:
+				return nil, fmt.Errorf("line %d: unknown option: %s", n, x)
+			}
+		}
+		effects := 0
+		for _, x := range []bool{rule.Code != 0, rule.Delay != 0, rule.Disconnect != 0} {
+			if x {
+				effects++
+			}
+		}
+		if effects > 1 {
+			return nil, fmt.Errorf("line %d: more than one of code, delay and disconnect", n)
+		}
+		if rule.Disconnect != 0 && rule.Stage != "data" {
+			return nil, fmt.Errorf("line %d: disconnect of stage: %s", n, xs[0])
+		}
+		if rule.Delay == 0 && rule.Disconnect == 0 {
+			if !containsFold(chaosStages, rule.Stage) {
+				return nil, fmt.Errorf("line %d: unknown stage: %s", n, xs[0])
+			}
+			if rule.Code == 0 && rule.Stage == "connect" {
+				rule.Code = 421
+			} else if rule.Code == 0 {
+				rule.Code = 451
+			}
+		}
+		c.Rules = append(c.Rules, rule)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// parseDelayRange parses a duration or a range of durations, e.g. 1s-5s.
+func parseDelayRange(s string) (time.Duration, time.Duration, error) {
+	xs := strings.SplitN(s, "-", 2)
+	d, err := time.ParseDuration(xs[0])
+	if err != nil || d <= 0 {
+		return 0, 0, fmt.Errorf("invalid duration: %s", xs[0])
+	}
+	if len(xs) == 1 {
+		return d, 0, nil
+	}
+	max, err := time.ParseDuration(xs[1])
+	if err != nil || max < d {
+		return 0, 0, fmt.Errorf("invalid duration: %s", xs[1])
+	}
+	return d, max, nil
+}
+
+func (c *Chaos) Register(h *Hooks) {
+	h.OnConnect(func(conn *SMTPConnection) string {
+		c.delay("connect")
+		return c.fail("connect")
+	})
+	h.OnCommand(func(conn *SMTPConnection, verb string) string {
+		c.delay(strings.ToLower(verb))
+		if verb == "DATA" || verb == "BDAT" {
+			if n := c.disconnect(); n > 0 {
+				conn.dropAfter(n)
+			}
+		}
+		return ""
+	})
+	h.OnAuth(func(conn *SMTPConnection) string { return c.fail("auth") })
+	h.OnMail(func(conn *SMTPConnection) string { return c.fail("mail") })
+	h.OnRcpt(func(conn *SMTPConnection, rcpt Address) string { return c.fail("rcpt") })
+	h.OnData(func(conn *SMTPConnection) string { return c.fail("data") })
+}
+
+// fail returns the reply of the first rule of the stage which fires, or an
+// empty string.
+func (c *Chaos) fail(stage string) string {
+	for _, rule := range c.Rules {
+		if rule.Code == 0 || rule.Stage != stage || c.random() >= rule.Probability {
+			continue
+		}
+		return fmt.Sprintf("%d Injected failure", rule.Code)
+	}
+	return ""
+}
+
+// delay sleeps for the rules of the stage which fire.
+func (c *Chaos) delay(stage string) {
+	for _, rule := range c.Rules {
+		if rule.Delay == 0 || rule.Stage != stage || c.random() >= rule.Probability {
+			continue
+		}
+		d := rule.Delay
+		if rule.MaxDelay > d {
+			d += time.Duration(c.random() * float64(rule.MaxDelay-d))
+		}
+		time.Sleep(d)
+	}
+}
+
+// disconnect returns the octets of the first disconnect rule which fires,
+// or 0.
+func (c *Chaos) disconnect() int64 {
+	for _, rule := range c.Rules {
+		if rule.Disconnect == 0 || c.random() >= rule.Probability {
+			continue
+		}
+		return rule.Disconnect
+	}
+	return 0
+}
+
+func (c *Chaos) random() float64 {
+	if c.Rand != nil {
+		return c.Rand()
+	}
+	return rand.Float64()
+}
+
+var errChaosDisconnect = errors.New("smtp: connection dropped by chaos")
+
+// dropAfter closes the connection after n more octets are read.
+func (smtpConn *SMTPConnection) dropAfter(n int64) {
+	r := &dropReader{r: smtpConn.reader.R, n: n, conn: smtpConn}
+	smtpConn.reader = textproto.NewReader(bufio.NewReader(r))
+}
+
+type dropReader struct {
+	r    io.Reader
+	n    int64
+	conn *SMTPConnection
+}
+
+func (r *dropReader) Read(p []byte) (int, error) {
+	if r.n <= 0 {
+		r.conn.handler.Close()
+		return 0, errChaosDisconnect
+	}
+	if int64(len(p)) > r.n {
+		p = p[:r.n]
+	}
+	n, err := r.r.Read(p)
+	r.n -= int64(n)
+	return n, err
+}
@@ -0,0 +1,119 @@
+package smtp
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseChaos(t *testing.T) {
+	c, err := ParseChaos(strings.NewReader("# failures\n" +
+		"connect probability=0.1\n" +
+		"RCPT probability=0.5 code=550\n" +
+		"ehlo delay=1s-5s\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []ChaosRule{
+		{Stage: "connect", Probability: 0.1, Code: 421},
+		{Stage: "rcpt", Probability: 0.5, Code: 550},
+		{Stage: "ehlo", Probability: 1, Delay: time.Second, MaxDelay: 5 * time.Second},
+	}
+	if len(c.Rules) != len(expected) {
+		t.Fatalf("expected: %v, actual: %v", expected, c.Rules)
+	}
+	for i, x := range expected {
+		if c.Rules[i] != x {
+			t.Errorf("expected: %v, actual: %v", x, c.Rules[i])
+		}
+	}
+	for _, x := range []string{"helo", "mail probability=2", "data code=250",
+		"data code=451 delay=1s", "ehlo code=550", "ehlo delay=2s-1s"} {
+		if _, err := ParseChaos(strings.NewReader(x)); err == nil {
+			t.Errorf("expected an error: %s", x)
+		}
+	}
+}
+
+func TestChaos(t *testing.T) {
+	c, _ := ParseChaos(strings.NewReader("rcpt probability=0.5 code=550\n" +
+		"data\n"))
+	xs := []float64{0.7, 0.2}
+	conn := NewMockConn([]byte("EHLO localhost\r\n" +
+		"MAIL FROM: <foo@example.net>\r\n" +
+		"RCPT TO: <user1@example.com>\r\n" +
+		"RCPT TO: <user2@example.com>\r\n" +
+		"BDAT 7 LAST\r\n" +
+		"Hello\r\n" +
+		"QUIT\r\n"))
+	h := NewSMTPHandler(conn, func(st *SMTPState) error { return nil })
+	h.Config.Hooks = &Hooks{}
+	c.Rand = func() float64 {
+		x := xs[0]
+		xs = append(xs[1:], 0)
+		return x
+	}
+	c.Register(h.Config.Hooks)
+	h.Run()
+	expected := "220 250 250 250 550 451 221"
+	if actual := replyCodes(conn.CloneOutputBuffer()); actual != expected {
+		t.Errorf("expected: %s, actual: %s", expected, actual)
+	}
+	if !strings.Contains(string(conn.CloneOutputBuffer()), "451 4.3.0 Injected failure\r\n") {
+		t.Errorf("unexpected replies: %s", conn.CloneOutputBuffer())
+	}
+}
+
+func TestChaosDelay(t *testing.T) {
+	c, _ := ParseChaos(strings.NewReader("connect delay=20ms\n" +
+		"noop delay=20ms-40ms\n"))
+	conn := NewMockConn([]byte("EHLO localhost\r\n" +
+		"NOOP\r\n" +
+		"QUIT\r\n"))
+	h := NewSMTPHandler(conn, nil)
+	h.Config.Hooks = &Hooks{}
+	c.Register(h.Config.Hooks)
+	start := time.Now()
+	h.Run()
+	if elapsed := time.Since(start); elapsed < 40*time.Millisecond {
+		t.Errorf("expected the delays: %v", elapsed)
+	}
+	expected := "220 250 250 221"
+	if actual := replyCodes(conn.CloneOutputBuffer()); actual != expected {
+		t.Errorf("expected: %s, actual: %s", expected, actual)
+	}
+}
+
+func TestChaosDisconnect(t *testing.T) {
+	c, _ := ParseChaos(strings.NewReader("data disconnect=10\n"))
+	delivered := false
+	conn := NewMockConn([]byte("EHLO localhost\r\n" +
+		"MAIL FROM: <foo@example.net>\r\n" +
+		"RCPT TO: <user1@example.com>\r\n" +
+		"DATA\r\n" +
+		"Subject: Disconnect\r\n" +
+		"\r\n" +
+		"Hello\r\n" +
+		".\r\n" +
+		"QUIT\r\n"))
+	h := NewSMTPHandler(conn, func(st *SMTPState) error {
+		delivered = true
+		return nil
+	})
+	h.Config.Hooks = &Hooks{}
+	c.Register(h.Config.Hooks)
+	if err := h.Run(); !errors.Is(err, errChaosDisconnect) {
+		t.Errorf("expected: %v, actual: %v", errChaosDisconnect, err)
+	}
+	if delivered {
+		t.Errorf("unexpected delivery")
+	}
+	expected := "220 250 250 250 354"
+	if actual := replyCodes(conn.CloneOutputBuffer()); actual != expected {
+		t.Errorf("expected: %s, actual: %s", expected, actual)
+	}
+	if _, err := ParseChaos(strings.NewReader("rcpt disconnect=10\n")); err == nil {
+		t.Errorf("expected an error of the rcpt stage")
+	}
+}
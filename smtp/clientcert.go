@@ -0,0 +1,64 @@
+package smtp
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// ConfigureClientAuth requests client certificates on the listener,
+// verified against the CA certificates in the PEM file. mode is "request"
+// to verify a certificate if presented, or "require" to refuse clients
+// without one.
+func ConfigureClientAuth(config *tls.Config, caFile, mode string) error {
+	switch mode {
+	case "request":
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	case "require":
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return fmt.Errorf("tls: client auth must be request or require: %s", mode)
+	}
+	b, err := os.ReadFile(caFile)
+	if err != nil {
+		return err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return errors.New("tls: no CA certificate in " + caFile)
+	}
+	config.ClientCAs = pool
+	return nil
+}
+
+// setTLS records the state of the handshake and the identity of a verified
+// client certificate.
+func (st *SMTPState) setTLS(cs tls.ConnectionState) {
+	st.TLS = &cs
+	st.ClientCN = ""
+	st.ClientSANs = nil
+	if len(cs.VerifiedChains) == 0 || len(cs.PeerCertificates) == 0 {
+		return
+	}
+	cert := cs.PeerCertificates[0]
+	st.ClientCN = cert.Subject.CommonName
+	st.ClientSANs = append(st.ClientSANs, cert.DNSNames...)
+	st.ClientSANs = append(st.ClientSANs, cert.EmailAddresses...)
+	for _, u := range cert.URIs {
+		st.ClientSANs = append(st.ClientSANs, u.String())
+	}
+}
+
+// matchClientCert reports whether the CN or a SAN of the client
+// certificate matches the pattern.
+func matchClientCert(st *SMTPState, pattern string) bool {
+	for _, x := range append([]string{st.ClientCN}, st.ClientSANs...) {
+		if len(x) > 0 && sieveMatch(":matches", strings.ToLower(x), strings.ToLower(pattern)) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,110 @@
+package smtp
+
+import (
+	"crypto/tls"
+	"encoding/pem"
+	"net"
+	netsmtp "net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestClientCertificate(t *testing.T) {
+	cert, pool := testCertificate(t, "mx.example.com")
+	client, _ := testCertificate(t, "client.example.net", "*.example.net")
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: client.Certificate[0]}), 0600)
+	config := &tls.Config{Certificates: []tls.Certificate{cert}}
+	if err := ConfigureClientAuth(config, caFile, "require"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ConfigureClientAuth(&tls.Config{}, caFile, "optional"); err == nil {
+		t.Errorf("expected an error of the mode")
+	}
+	policy, err := ParsePolicy(strings.NewReader("rcpt auth no cert no reject 550 5.7.1 Relay access denied\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lsnr, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip(err)
+	}
+	defer lsnr.Close()
+	accepted := make(chan *SMTPState, 1)
+	go func() {
+		conn, err := tls.NewListener(lsnr, config).Accept()
+		if err != nil {
+			close(accepted)
+			return
+		}
+		h := NewSMTPHandler(conn, nil)
+		h.Config.TLSConfig = config
+		h.Config.Policy = policy
+		h.Config.Hooks = &Hooks{}
+		h.Config.Hooks.OnRcpt(func(conn *SMTPConnection, rcpt Address) string {
+			x := *conn.State()
+			accepted <- &x
+			return ""
+		})
+		h.Run()
+	}()
+	conn, err := tls.Dial("tcp", lsnr.Addr().String(), &tls.Config{
+		ServerName:   "mx.example.com",
+		RootCAs:      pool,
+		Certificates: []tls.Certificate{client},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := netsmtp.NewClient(conn, "mx.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := c.Mail("foo@example.net"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Rcpt("user1@example.org"); err != nil {
+		t.Errorf("expected the recipient to be accepted: %v", err)
+	}
+	c.Quit()
+	st := <-accepted
+	if st == nil {
+		t.Fatal("expected a session")
+	}
+	if expected, actual := "client.example.net", st.ClientCN; expected != actual {
+		t.Errorf("expected: %s, actual: %s", expected, actual)
+	}
+	if expected, actual := "client.example.net *.example.net", strings.Join(st.ClientSANs, " "); expected != actual {
+		t.Errorf("expected: %s, actual: %s", expected, actual)
+	}
+	if !matchClientCert(st, "CLIENT.example.net") || matchClientCert(st, "mx.example.com") {
+		t.Errorf("unexpected match of %v", st.ClientSANs)
+	}
+}
+
+func TestClientCertificatePolicy(t *testing.T) {
+	policy, err := ParsePolicy(strings.NewReader("rcpt auth no cert no reject 550 5.7.1 Relay access denied\n" +
+		"rcpt cert *.internal.example.net accept\n" +
+		"rcpt cert yes reject 550 5.7.1 Unknown client\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := &SMTPState{}
+	st.Reset()
+	if d := policy.Evaluate(StageRcpt, st, "", "user1@example.org"); d.Action != PolicyReject {
+		t.Errorf("expected the recipient to be rejected: %v", d)
+	}
+	st.ClientCN = "relay1.internal.example.net"
+	if d := policy.Evaluate(StageRcpt, st, "", "user1@example.org"); d.Action != PolicyAccept {
+		t.Errorf("expected the recipient to be accepted: %v", d)
+	}
+	st.ClientCN = ""
+	st.ClientSANs = []string{"relay@example.com"}
+	if d := policy.Evaluate(StageRcpt, st, "", "user1@example.org"); d.Reply != "550 5.7.1 Unknown client" {
+		t.Errorf("expected the client to be rejected: %v", d)
+	}
+}
@@ -0,0 +1,99 @@
+package smtp
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock tells the time of timestamps and schedules, so that tests and
+// replays can control it. The system clock is used where a Clock is nil.
+type Clock interface {
+	Now() time.Time
+	// After returns a channel which receives the time once d has passed.
+	After(d time.Duration) <-chan time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+// SystemClock tells the time of the system.
+var SystemClock Clock = systemClock{}
+
+func clockNow(c Clock) time.Time {
+	if c == nil {
+		return time.Now()
+	}
+	return c.Now()
+}
+
+func clockAfter(c Clock, d time.Duration) <-chan time.Time {
+	if c == nil {
+		return time.After(d)
+	}
+	return c.After(d)
+}
+
+// FakeClock is a Clock which only moves when set or advanced, firing the
+// channels of After whose time has come.
+type FakeClock struct {
+	mtx    sync.Mutex
+	t      time.Time
+	timers []fakeTimer
+}
+
+type fakeTimer struct {
+	at time.Time
+	c  chan time.Time
+}
+
+func NewFakeClock(t time.Time) *FakeClock {
+	return &FakeClock{t: t}
+}
+
+func (c *FakeClock) Now() time.Time {
+	defer c.mtx.Unlock()
+	c.mtx.Lock()
+	return c.t
+}
+
+func (c *FakeClock) Set(t time.Time) {
+	defer c.mtx.Unlock()
+	c.mtx.Lock()
+	c.t = t
+	c.fire()
+}
+
+func (c *FakeClock) Advance(d time.Duration) {
+	defer c.mtx.Unlock()
+	c.mtx.Lock()
+	c.t = c.t.Add(d)
+	c.fire()
+}
+
+func (c *FakeClock) After(d time.Duration) <-chan time.Time {
+	defer c.mtx.Unlock()
+	c.mtx.Lock()
+	ch := make(chan time.Time, 1)
+	c.timers = append(c.timers, fakeTimer{at: c.t.Add(d), c: ch})
+	c.fire()
+	return ch
+}
+
+func (c *FakeClock) fire() {
+	timers := c.timers[:0]
+	for _, x := range c.timers {
+		if c.t.Before(x.at) {
+			timers = append(timers, x)
+		} else {
+			x.c <- c.t
+		}
+	}
+	c.timers = timers
+}
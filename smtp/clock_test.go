@@ -0,0 +1,54 @@
+package smtp
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFakeClock(t *testing.T) {
+	start := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	clock := NewFakeClock(start)
+	clock.Advance(time.Minute)
+	if expected := start.Add(time.Minute); !clock.Now().Equal(expected) {
+		t.Errorf("expected: %s, actual: %s", expected, clock.Now())
+	}
+
+	var received string
+	conn := NewMockConn([]byte("EHLO localhost\r\n" +
+		"MAIL FROM: <foo@example.net>\r\n" +
+		"RCPT TO: <user1@example.com>\r\n" +
+		"BDAT 7 LAST\r\n" +
+		"Hello\r\n" +
+		"QUIT\r\n"))
+	h := NewSMTPHandler(conn, func(st *SMTPState) error {
+		received = strings.Join(st.Headers, "\r\n")
+		return nil
+	})
+	h.Config.AddReceived = true
+	h.Config.Clock = clock
+	h.Run()
+	expected := "Tue, 02 Jan 2024 03:05:05 +0000"
+	if !strings.Contains(received, expected) {
+		t.Errorf("expected: %s, actual: %s", expected, received)
+	}
+}
+
+func TestFakeClockAfter(t *testing.T) {
+	start := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	clock := NewFakeClock(start)
+	after := clock.After(time.Second)
+	clock.Advance(999 * time.Millisecond)
+	select {
+	case <-after:
+		t.Error("expected After not to fire yet")
+	default:
+	}
+	clock.Advance(time.Millisecond)
+	if expected, actual := start.Add(time.Second), <-after; !actual.Equal(expected) {
+		t.Errorf("expected: %s, actual: %s", expected, actual)
+	}
+	if actual := <-clock.After(0); !actual.Equal(clock.Now()) {
+		t.Errorf("expected: %s, actual: %s", clock.Now(), actual)
+	}
+}
@@ -0,0 +1,56 @@
+package smtp
+
+import (
+	"sort"
+	"strings"
+)
+
+// SMTPCommandFunc is an adapter to use a function as an SMTPCommand.
+type SMTPCommandFunc func(conn *SMTPConnection, line string) error
+
+func (f SMTPCommandFunc) Execute(conn *SMTPConnection, line string) error {
+	return f(conn, line)
+}
+
+// SMTPCommandHelp is implemented by commands describing themselves for
+// HELP.
+type SMTPCommandHelp interface {
+	Help() (syntax, description string)
+}
+
+// RegisterCommand adds a command of the verb, overriding the built-in one
+// if any, or removes the command if cmnd is nil. Commands must be
+// registered before the config is used by any session.
+func (config *SMTPConfig) RegisterCommand(verb string, cmnd SMTPCommand) {
+	if config.commands == nil {
+		config.commands = make(map[string]SMTPCommand)
+	}
+	config.commands[strings.ToUpper(verb)] = cmnd
+}
+
+// command returns the command of the verb, registered or built-in.
+func (config *SMTPConfig) command(verb string) (SMTPCommand, bool) {
+	if cmnd, ok := config.commands[verb]; ok {
+		return cmnd, cmnd != nil
+	}
+	cmnd, ok := smtpCommandMap[verb]
+	return cmnd, ok
+}
+
+// Commands returns the sorted verbs of the registered and built-in
+// commands.
+func (config *SMTPConfig) Commands() []string {
+	verbs := make([]string, 0, len(smtpCommandMap)+len(config.commands))
+	for verb := range smtpCommandMap {
+		if _, ok := config.commands[verb]; !ok {
+			verbs = append(verbs, verb)
+		}
+	}
+	for verb, cmnd := range config.commands {
+		if cmnd != nil {
+			verbs = append(verbs, verb)
+		}
+	}
+	sort.Strings(verbs)
+	return verbs
+}
@@ -0,0 +1,58 @@
+package smtp
+
+import (
+	"strings"
+	"testing"
+)
+
+type debugCommand struct {
+}
+
+func (cmnd *debugCommand) Execute(conn *SMTPConnection, line string) error {
+	return conn.Write("250 " + conn.State().ClientName)
+}
+
+func (cmnd *debugCommand) Help() (string, string) {
+	return "XDEBUG", "Shows the client name."
+}
+
+func TestRegisterCommand(t *testing.T) {
+	conn := NewMockConn([]byte("EHLO localhost\r\n" +
+		"XDEBUG\r\n" +
+		"NOOP\r\n" +
+		"RSET\r\n" +
+		"HELP\r\n" +
+		"HELP XDEBUG\r\n" +
+		"HELP NOOP\r\n" +
+		"QUIT\r\n"))
+	h := NewSMTPHandler(conn, nil)
+	h.Config.RegisterCommand("xdebug", &debugCommand{})
+	h.Config.RegisterCommand("NOOP", SMTPCommandFunc(func(conn *SMTPConnection, line string) error {
+		return conn.Write("250 Overridden")
+	}))
+	h.Config.RegisterCommand("RSET", nil)
+	h.Run()
+	expected := "220 250 250 250 500 214 214 214 221"
+	if actual := replyCodes(conn.CloneOutputBuffer()); actual != expected {
+		t.Errorf("expected: %s, actual: %s", expected, actual)
+	}
+	out := string(conn.CloneOutputBuffer())
+	for _, x := range []string{
+		"250 2.0.0 localhost\r\n",
+		"250 2.0.0 Overridden\r\n",
+		"214-2.0.0 Commands: AUTH BDAT DATA EHLO HELO HELP MAIL NOOP QUIT RCPT XDEBUG\r\n",
+		"214 2.0.0 Shows the client name.\r\n",
+		"214-2.0.0 NOOP\r\n214 2.0.0 No description.\r\n",
+	} {
+		if !strings.Contains(out, x) {
+			t.Errorf("expected: %q, actual: %q", x, out)
+		}
+	}
+
+	// the registry belongs to the config
+	conn = NewMockConn([]byte("XDEBUG\r\nQUIT\r\n"))
+	NewSMTPHandler(conn, nil).Run()
+	if expected := "220 500 221"; replyCodes(conn.CloneOutputBuffer()) != expected {
+		t.Errorf("expected: %s, actual: %s", expected, replyCodes(conn.CloneOutputBuffer()))
+	}
+}
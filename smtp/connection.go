@@ -0,0 +1,74 @@
+package smtp
+
+import (
+	"crypto/tls"
+	"strings"
+	"time"
+)
+
+// ConnectionInfo is the transport of a session, recorded with the
+// messages received over it.
+type ConnectionInfo struct {
+	RemoteAddr     string    `json:"remote_addr,omitempty"`
+	LocalAddr      string    `json:"local_addr,omitempty"`
+	ConnectedAt    time.Time `json:"connected_at,omitempty"`
+	TLS            bool      `json:"tls"`
+	TLSVersion     string    `json:"tls_version,omitempty"`
+	TLSCipherSuite string    `json:"tls_cipher_suite,omitempty"`
+	ClientCN       string    `json:"client_cn,omitempty"`
+	ClientSANs     []string  `json:"client_sans,omitempty"`
+}
+
+// TLSVersion returns the name of the negotiated TLS version, e.g.
+// "TLS 1.3", or an empty string without TLS.
+func (st *SMTPState) TLSVersion() string {
+	if st.TLS == nil {
+		return ""
+	}
+	return tls.VersionName(st.TLS.Version)
+}
+
+// TLSCipherSuite returns the name of the negotiated cipher suite, or an
+// empty string without TLS.
+func (st *SMTPState) TLSCipherSuite() string {
+	if st.TLS == nil {
+		return ""
+	}
+	return tls.CipherSuiteName(st.TLS.CipherSuite)
+}
+
+// Connection returns the transport of the session.
+func (st *SMTPState) Connection() ConnectionInfo {
+	return ConnectionInfo{
+		RemoteAddr:     st.RemoteAddr,
+		LocalAddr:      st.LocalAddr,
+		ConnectedAt:    st.ConnectedAt,
+		TLS:            st.TLS != nil,
+		TLSVersion:     st.TLSVersion(),
+		TLSCipherSuite: st.TLSCipherSuite(),
+		ClientCN:       st.ClientCN,
+		ClientSANs:     st.ClientSANs,
+	}
+}
+
+// connection returns the transport of the session, or nil if the state
+// was not received over a connection, e.g. imported.
+func (st *SMTPState) connection() *ConnectionInfo {
+	if len(st.RemoteAddr) == 0 && st.TLS == nil {
+		return nil
+	}
+	x := st.Connection()
+	return &x
+}
+
+// matchTLS reports whether the session is over TLS for "yes", without it
+// for "no", or over the TLS version, e.g. "1.3".
+func matchTLS(st *SMTPState, value string) bool {
+	switch strings.ToLower(value) {
+	case "yes":
+		return st.TLS != nil
+	case "no":
+		return st.TLS == nil
+	}
+	return st.TLS != nil && strings.TrimPrefix(st.TLSVersion(), "TLS ") == value
+}
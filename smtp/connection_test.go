@@ -0,0 +1,80 @@
+package smtp
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"net"
+	netsmtp "net/smtp"
+	"strings"
+	"testing"
+)
+
+func TestConnectionInfo(t *testing.T) {
+	cert, pool := testCertificate(t, "mx.example.com")
+	lsnr, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip(err)
+	}
+	defer lsnr.Close()
+	accepted := serveTLS(lsnr, cert)
+
+	c, err := netsmtp.Dial(lsnr.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := c.StartTLS(&tls.Config{ServerName: "mx.example.com", RootCAs: pool, MinVersion: tls.VersionTLS13}); err != nil {
+		t.Fatal(err)
+	}
+	c.Mail("foo@example.net")
+	c.Rcpt("user1@example.com")
+	w, err := c.Data()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("Subject: TLS\r\n\r\nHello\r\n"))
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	c.Quit()
+	st := <-accepted
+	if st == nil {
+		t.Fatal("expected a session")
+	}
+	x := st.Connection()
+	if !x.TLS || x.TLSVersion != "TLS 1.3" || len(x.TLSCipherSuite) == 0 {
+		t.Errorf("unexpected TLS: %v", x)
+	}
+	if !strings.HasPrefix(x.RemoteAddr, "127.0.0.1:") || x.LocalAddr != lsnr.Addr().String() || x.ConnectedAt.IsZero() {
+		t.Errorf("unexpected connection: %v", x)
+	}
+	b, _ := json.Marshal(st.connection())
+	if !strings.Contains(string(b), `"tls_version":"TLS 1.3"`) {
+		t.Errorf("unexpected JSON: %s", b)
+	}
+
+	if (&SMTPState{}).connection() != nil {
+		t.Errorf("expected no connection of an imported message")
+	}
+}
+
+func TestTLSPolicy(t *testing.T) {
+	policy, err := ParsePolicy(strings.NewReader("mail tls no reject 530 5.7.0 Must issue a STARTTLS command first\n" +
+		"mail tls 1.2 tag legacy-tls\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := &SMTPState{}
+	st.Reset()
+	if d := policy.Evaluate(StageMail, st, "", ""); d.Action != PolicyReject {
+		t.Errorf("expected the sender to be rejected: %v", d)
+	}
+	st.TLS = &tls.ConnectionState{Version: tls.VersionTLS12, CipherSuite: tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256}
+	d := policy.Evaluate(StageMail, st, "", "")
+	if d.Action != PolicyAccept || strings.Join(d.Tags, " ") != "legacy-tls" {
+		t.Errorf("unexpected decision: %v", d)
+	}
+	if expected, actual := "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", st.TLSCipherSuite(); expected != actual {
+		t.Errorf("expected: %s, actual: %s", expected, actual)
+	}
+}
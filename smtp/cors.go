@@ -0,0 +1,76 @@
+package smtp
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CORS allows browsers of other origins to call the HTTP API, e.g. test
+// dashboards. Preflight requests are answered without calling the
+// handler, so they need no credentials.
+type CORS struct {
+	// AllowedOrigins are the origins allowed, or "*" for any.
+	AllowedOrigins []string
+	AllowedMethods []string
+	AllowedHeaders []string
+
+	// AllowCredentials lets browsers send cookies and authorization
+	// headers, answering the origin itself rather than "*".
+	AllowCredentials bool
+	MaxAge           time.Duration
+}
+
+func NewCORS(origins ...string) *CORS {
+	return &CORS{
+		AllowedOrigins: origins,
+		AllowedMethods: []string{"GET", "HEAD", "DELETE"},
+		AllowedHeaders: []string{"Authorization", "Content-Type"},
+		MaxAge:         10 * time.Minute,
+	}
+}
+
+func (c *CORS) allowed(origin string) bool {
+	for _, x := range c.AllowedOrigins {
+		if x == "*" || strings.EqualFold(x, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// Handler returns a handler adding the CORS headers to the responses of h
+// to allowed origins.
+func (c *CORS) Handler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if len(origin) == 0 || !c.allowed(origin) {
+			if r.Method == "OPTIONS" && len(r.Header.Get("Access-Control-Request-Method")) > 0 {
+				http.Error(w, "origin not allowed", http.StatusForbidden)
+				return
+			}
+			h.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Origin")
+		if c.AllowCredentials || !c.allowed("*") {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+		} else {
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+		}
+		if c.AllowCredentials {
+			w.Header().Set("Access-Control-Allow-Credentials", "true")
+		}
+		if r.Method != "OPTIONS" || len(r.Header.Get("Access-Control-Request-Method")) == 0 {
+			h.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("Access-Control-Allow-Methods", strings.Join(c.AllowedMethods, ", "))
+		w.Header().Set("Access-Control-Allow-Headers", strings.Join(c.AllowedHeaders, ", "))
+		if c.MaxAge > 0 {
+			w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(c.MaxAge.Seconds())))
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
@@ -0,0 +1,62 @@
+package smtp
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCORS(t *testing.T) {
+	c := NewCORS("https://dashboard.example.com")
+	a := NewAPIAuth()
+	a.AddToken("s3cret", ScopeRead)
+	h := c.Handler(a.Protect(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})))
+
+	r := httptest.NewRequest("OPTIONS", "/stats", nil)
+	r.Header.Set("Origin", "https://dashboard.example.com")
+	r.Header.Set("Access-Control-Request-Method", "GET")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusNoContent {
+		t.Errorf("expected: %d, actual: %d", http.StatusNoContent, w.Code)
+	}
+	for k, v := range map[string]string{
+		"Access-Control-Allow-Origin":  "https://dashboard.example.com",
+		"Access-Control-Allow-Methods": "GET, HEAD, DELETE",
+		"Access-Control-Allow-Headers": "Authorization, Content-Type",
+		"Access-Control-Max-Age":       "600",
+	} {
+		if actual := w.Header().Get(k); actual != v {
+			t.Errorf("%s expected: %s, actual: %s", k, v, actual)
+		}
+	}
+
+	r = httptest.NewRequest("GET", "/stats", nil)
+	r.Header.Set("Origin", "https://dashboard.example.com")
+	r.Header.Set("Authorization", "Bearer s3cret")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusOK || w.Header().Get("Access-Control-Allow-Origin") != "https://dashboard.example.com" {
+		t.Errorf("unexpected response: %d, %v", w.Code, w.Header())
+	}
+
+	r = httptest.NewRequest("OPTIONS", "/stats", nil)
+	r.Header.Set("Origin", "https://evil.example.net")
+	r.Header.Set("Access-Control-Request-Method", "DELETE")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusForbidden || len(w.Header().Get("Access-Control-Allow-Origin")) > 0 {
+		t.Errorf("unexpected response: %d, %v", w.Code, w.Header())
+	}
+
+	c = NewCORS("*")
+	r = httptest.NewRequest("GET", "/stats", nil)
+	r.Header.Set("Origin", "https://any.example.net")
+	w = httptest.NewRecorder()
+	c.Handler(http.NotFoundHandler()).ServeHTTP(w, r)
+	if actual := w.Header().Get("Access-Control-Allow-Origin"); actual != "*" {
+		t.Errorf("expected: *, actual: %s", actual)
+	}
+}
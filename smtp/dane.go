@@ -0,0 +1,321 @@
+package smtp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// TLSARecord is a TLSA resource record (RFC 6698).
+type TLSARecord struct {
+	Usage        uint8
+	Selector     uint8
+	MatchingType uint8
+	Data         []byte
+}
+
+// TLSAResolver looks up TLSA records. secure reports whether the answer
+// was validated with DNSSEC.
+type TLSAResolver interface {
+	LookupTLSA(ctx context.Context, name string) (records []TLSARecord, secure bool, err error)
+}
+
+// DNSClient queries a validating recursive resolver, trusting its AD flag
+// as the DNSSEC status of answers. It should be a resolver on the host or
+// reached over a trusted network.
+type DNSClient struct {
+	Server  string
+	Timeout time.Duration
+}
+
+// NewDNSClient returns a client of the first nameserver in
+// /etc/resolv.conf, or 127.0.0.1 if there is none.
+func NewDNSClient() *DNSClient {
+	c := &DNSClient{Server: "127.0.0.1:53", Timeout: 5 * time.Second}
+	f, err := os.Open("/etc/resolv.conf")
+	if err != nil {
+		return c
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		xs := strings.Fields(scanner.Text())
+		if len(xs) >= 2 && xs[0] == "nameserver" {
+			c.Server = net.JoinHostPort(xs[1], "53")
+			break
+		}
+	}
+	return c
+}
+
+const (
+	dnsTypeTLSA = 52
+	dnsTypeOPT  = 41
+)
+
+func dnsQuery(id uint16, name string, qtype uint16) ([]byte, error) {
+	var b bytes.Buffer
+	// RD and AD, with an OPT record setting DO
+	binary.Write(&b, binary.BigEndian, []uint16{id, 0x0120, 1, 0, 0, 1})
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return nil, fmt.Errorf("dns: invalid name %s", name)
+		}
+		b.WriteByte(byte(len(label)))
+		b.WriteString(label)
+	}
+	b.WriteByte(0)
+	binary.Write(&b, binary.BigEndian, []uint16{qtype, 1})
+	b.WriteByte(0)
+	binary.Write(&b, binary.BigEndian, []uint16{dnsTypeOPT, 4096, 0, 0x8000, 0})
+	return b.Bytes(), nil
+}
+
+// dnsSkipName returns the offset following the name at i.
+func dnsSkipName(msg []byte, i int) (int, error) {
+	for i < len(msg) {
+		n := int(msg[i])
+		switch {
+		case n == 0:
+			return i + 1, nil
+		case n&0xc0 == 0xc0:
+			return i + 2, nil
+		}
+		i += n + 1
+	}
+	return 0, errors.New("dns: malformed message")
+}
+
+// parseTLSAResponse returns the TLSA records in the answer section and
+// whether the AD flag is set.
+func parseTLSAResponse(msg []byte, id uint16) ([]TLSARecord, bool, error) {
+	if len(msg) < 12 || binary.BigEndian.Uint16(msg) != id {
+		return nil, false, errors.New("dns: malformed message")
+	}
+	flags := binary.BigEndian.Uint16(msg[2:])
+	secure := flags&0x0020 != 0
+	switch rcode := flags & 0x000f; rcode {
+	case 0:
+	case 3:
+		return nil, secure, nil
+	default:
+		return nil, false, fmt.Errorf("dns: rcode %d", rcode)
+	}
+	qd, an := binary.BigEndian.Uint16(msg[4:]), binary.BigEndian.Uint16(msg[6:])
+	i := 12
+	var err error
+	for ; qd > 0; qd-- {
+		if i, err = dnsSkipName(msg, i); err != nil {
+			return nil, false, err
+		}
+		i += 4
+	}
+	records := make([]TLSARecord, 0)
+	for ; an > 0; an-- {
+		if i, err = dnsSkipName(msg, i); err != nil {
+			return nil, false, err
+		}
+		if i+10 > len(msg) {
+			return nil, false, errors.New("dns: malformed message")
+		}
+		rtype := binary.BigEndian.Uint16(msg[i:])
+		rdlen := int(binary.BigEndian.Uint16(msg[i+8:]))
+		i += 10
+		if i+rdlen > len(msg) {
+			return nil, false, errors.New("dns: malformed message")
+		}
+		if rtype == dnsTypeTLSA && rdlen >= 3 {
+			rd := msg[i : i+rdlen]
+			records = append(records, TLSARecord{rd[0], rd[1], rd[2], append([]byte{}, rd[3:]...)})
+		}
+		i += rdlen
+	}
+	return records, secure, nil
+}
+
+func (c *DNSClient) exchange(ctx context.Context, network string, query []byte) ([]byte, error) {
+	d := net.Dialer{Timeout: c.Timeout}
+	conn, err := d.DialContext(ctx, network, c.Server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(c.Timeout))
+	if network == "udp" {
+		if _, err := conn.Write(query); err != nil {
+			return nil, err
+		}
+		b := make([]byte, 65535)
+		n, err := conn.Read(b)
+		if err != nil {
+			return nil, err
+		}
+		return b[:n], nil
+	}
+	if _, err := conn.Write(append([]byte{byte(len(query) >> 8), byte(len(query))}, query...)); err != nil {
+		return nil, err
+	}
+	var n uint16
+	if err := binary.Read(conn, binary.BigEndian, &n); err != nil {
+		return nil, err
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(conn, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func (c *DNSClient) LookupTLSA(ctx context.Context, name string) ([]TLSARecord, bool, error) {
+	var x [2]byte
+	rand.Read(x[:])
+	id := binary.BigEndian.Uint16(x[:])
+	query, err := dnsQuery(id, name, dnsTypeTLSA)
+	if err != nil {
+		return nil, false, err
+	}
+	msg, err := c.exchange(ctx, "udp", query)
+	if err == nil && len(msg) >= 4 && msg[2]&0x02 != 0 {
+		// truncated
+		msg, err = c.exchange(ctx, "tcp", query)
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return parseTLSAResponse(msg, id)
+}
+
+// usableTLSA returns the DANE-TA(2) and DANE-EE(3) records, the only usages
+// applicable to SMTP (RFC 7672 section 3.1.3).
+func usableTLSA(records []TLSARecord) []TLSARecord {
+	xs := make([]TLSARecord, 0)
+	for _, x := range records {
+		if (x.Usage == 2 || x.Usage == 3) && x.Selector <= 1 && x.MatchingType <= 2 {
+			xs = append(xs, x)
+		}
+	}
+	return xs
+}
+
+func (rec TLSARecord) matches(cert *x509.Certificate) bool {
+	data := cert.Raw
+	if rec.Selector == 1 {
+		data = cert.RawSubjectPublicKeyInfo
+	}
+	switch rec.MatchingType {
+	case 1:
+		h := sha256.Sum256(data)
+		data = h[:]
+	case 2:
+		h := sha512.Sum512(data)
+		data = h[:]
+	}
+	return bytes.Equal(data, rec.Data)
+}
+
+// VerifyDANE verifies the certificates presented by the server against the
+// records. A DANE-EE record matches the leaf regardless of its names and
+// validity period; a DANE-TA record matches an issuer in the chain, which
+// must then validate the leaf for serverName.
+func VerifyDANE(records []TLSARecord, certs []*x509.Certificate, serverName string) error {
+	if len(certs) == 0 {
+		return errors.New("dane: no certificate")
+	}
+	for _, rec := range usableTLSA(records) {
+		if rec.Usage == 3 {
+			if rec.matches(certs[0]) {
+				return nil
+			}
+			continue
+		}
+		for _, ta := range certs[1:] {
+			if !rec.matches(ta) {
+				continue
+			}
+			roots := x509.NewCertPool()
+			roots.AddCert(ta)
+			intermediates := x509.NewCertPool()
+			for _, x := range certs[1:] {
+				intermediates.AddCert(x)
+			}
+			_, err := certs[0].Verify(x509.VerifyOptions{
+				DNSName:       serverName,
+				Roots:         roots,
+				Intermediates: intermediates,
+			})
+			if err == nil {
+				return nil
+			}
+		}
+	}
+	return errors.New("dane: no TLSA record matched the certificate")
+}
+
+// DANE authenticates MX hosts with their TLSA records (RFC 7672).
+// Fallback is the behaviour when a host publishes secure records which do
+// not match its certificate: "reject" (the default) refuses the host,
+// "pkix" accepts a certificate valid for the host name with the system
+// roots, and "none" delivers regardless.
+type DANE struct {
+	Resolver TLSAResolver
+	Fallback string
+}
+
+func NewDANE() *DANE {
+	return &DANE{Resolver: NewDNSClient(), Fallback: "reject"}
+}
+
+// lookup returns the usable records of the host, or none if they are not
+// secure.
+func (dane *DANE) lookup(ctx context.Context, host, port string) ([]TLSARecord, error) {
+	records, secure, err := dane.Resolver.LookupTLSA(ctx, "_"+port+"._tcp."+host)
+	if err != nil {
+		return nil, err
+	}
+	if !secure {
+		return nil, nil
+	}
+	return usableTLSA(records), nil
+}
+
+// configure sets up the TLS config to verify the connection with the
+// records.
+func (dane *DANE) configure(tlsConfig *tls.Config, records []TLSARecord) {
+	roots := tlsConfig.RootCAs
+	tlsConfig.InsecureSkipVerify = true
+	tlsConfig.VerifyConnection = func(cs tls.ConnectionState) error {
+		err := VerifyDANE(records, cs.PeerCertificates, tlsConfig.ServerName)
+		if err == nil {
+			return nil
+		}
+		switch dane.Fallback {
+		case "none":
+			return nil
+		case "pkix":
+			intermediates := x509.NewCertPool()
+			for _, x := range cs.PeerCertificates[1:] {
+				intermediates.AddCert(x)
+			}
+			_, err := cs.PeerCertificates[0].Verify(x509.VerifyOptions{
+				DNSName:       tlsConfig.ServerName,
+				Roots:         roots,
+				Intermediates: intermediates,
+			})
+			return err
+		}
+		return err
+	}
+}
@@ -0,0 +1,125 @@
+package smtp
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+type testTLSAResolver struct {
+	records []TLSARecord
+	secure  bool
+}
+
+func (r *testTLSAResolver) LookupTLSA(ctx context.Context, name string) ([]TLSARecord, bool, error) {
+	return r.records, r.secure, nil
+}
+
+func TestVerifyDANE(t *testing.T) {
+	cert, _ := testCertificate(t, "mx.example.com")
+	spki := sha256.Sum256(cert.Leaf.RawSubjectPublicKeyInfo)
+	full := sha256.Sum256(cert.Leaf.Raw)
+	certs := []*x509.Certificate{cert.Leaf}
+	for _, x := range []struct {
+		records    []TLSARecord
+		certs      []*x509.Certificate
+		serverName string
+		ok         bool
+	}{
+		{[]TLSARecord{{3, 1, 1, spki[:]}}, certs, "other.example.com", true},
+		{[]TLSARecord{{3, 0, 0, cert.Leaf.Raw}}, certs, "", true},
+		{[]TLSARecord{{3, 1, 1, full[:]}}, certs, "", false},
+		{[]TLSARecord{{1, 1, 1, spki[:]}}, certs, "", false},
+		{[]TLSARecord{{2, 0, 1, full[:]}}, append(certs, cert.Leaf), "mx.example.com", true},
+		{[]TLSARecord{{2, 0, 1, full[:]}}, append(certs, cert.Leaf), "other.example.com", false},
+	} {
+		err := VerifyDANE(x.records, x.certs, x.serverName)
+		if (err == nil) != x.ok {
+			t.Errorf("%v expected: %v, actual: %v", x.records[0].Usage, x.ok, err)
+		}
+	}
+}
+
+func TestDNSClientLookupTLSA(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip(err)
+	}
+	defer pc.Close()
+	data := make([]byte, 32)
+	go func() {
+		b := make([]byte, 512)
+		n, addr, err := pc.ReadFrom(b)
+		if err != nil {
+			return
+		}
+		q := b[:n]
+		qend, _ := dnsSkipName(q, 12)
+		qend += 4
+		msg := append([]byte{}, q[:2]...)
+		msg = append(msg, 0x81, 0xa0, 0, 1, 0, 1, 0, 0, 0, 0)
+		msg = append(msg, q[12:qend]...)
+		msg = append(msg, 0xc0, 12, 0, dnsTypeTLSA, 0, 1, 0, 0, 0, 60, 0, 35, 3, 1, 1)
+		msg = append(msg, data...)
+		pc.WriteTo(msg, addr)
+	}()
+	c := &DNSClient{Server: pc.LocalAddr().String(), Timeout: NewDNSClient().Timeout}
+	records, secure, err := c.LookupTLSA(context.Background(), "_25._tcp.mx.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !secure || len(records) != 1 || records[0].Usage != 3 || len(records[0].Data) != 32 {
+		t.Errorf("unexpected records: %v %v", records, secure)
+	}
+	query, _ := dnsQuery(1, "_25._tcp.mx.example.com", dnsTypeTLSA)
+	if binary.BigEndian.Uint16(query[2:]) != 0x0120 || binary.BigEndian.Uint16(query[10:]) != 1 {
+		t.Errorf("unexpected query: %x", query)
+	}
+}
+
+func TestDeliverMXDANE(t *testing.T) {
+	cert, _ := testCertificate(t, "mx.example.com")
+	other, _ := testCertificate(t, "mx.example.com")
+	spki := sha256.Sum256(cert.Leaf.RawSubjectPublicKeyInfo)
+	otherSPKI := sha256.Sum256(other.Leaf.RawSubjectPublicKeyInfo)
+	for _, x := range []struct {
+		data     []byte
+		secure   bool
+		fallback string
+		ok       bool
+	}{
+		{spki[:], true, "reject", true},
+		{otherSPKI[:], true, "reject", false},
+		{otherSPKI[:], true, "none", true},
+		{otherSPKI[:], false, "reject", true},
+	} {
+		lsnr, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Skip(err)
+		}
+		received := serveUpstream(lsnr, &cert)
+		_, port, _ := net.SplitHostPort(lsnr.Addr().String())
+		router := NewRouter("mx")
+		router.Resolver = &testResolver{
+			mx: map[string][]string{"example.com": {"mx.example.com"}},
+			ip: map[string][]string{"mx.example.com": {"127.0.0.1"}},
+		}
+		router.MXPort = port
+		router.TLSConfig = &tls.Config{}
+		router.DANE = &DANE{
+			Resolver: &testTLSAResolver{[]TLSARecord{{3, 1, 1, x.data}}, x.secure},
+			Fallback: x.fallback,
+		}
+		st := &SMTPState{ReturnTo: "foo@example.net", Recipients: []string{"user1@example.com"}}
+		st.SetContent([]byte("Hello\r\n"))
+		if err := router.Send(st); (err == nil) != x.ok {
+			t.Errorf("%v %s expected: %v, actual: %v", x.secure, x.fallback, x.ok, err)
+		}
+		lsnr.Close()
+		<-received
+	}
+}
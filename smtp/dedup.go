@@ -0,0 +1,92 @@
+package smtp
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// DedupMessageID detects duplicates by the Message-ID header.
+	// Messages without one are never duplicates.
+	DedupMessageID = "message-id"
+	// DedupContent detects duplicates by a hash of the message without
+	// its trace headers, i.e. Received and Return-Path.
+	DedupContent = "content"
+)
+
+// DuplicateTag is the tag of the duplicates stored with DedupTag set.
+const DuplicateTag = "duplicate"
+
+// dedupKey returns the key of the message to detect its duplicates, or an
+// empty string if it has none. The key covers the sender and recipients
+// too, so a message split into several transactions is not a duplicate.
+func (s *MessageStore) dedupKey(st *SMTPState) string {
+	h := sha256.New()
+	recipients := make([]string, len(st.Recipients))
+	for i, x := range st.Recipients {
+		recipients[i] = strings.ToLower(x)
+	}
+	sort.Strings(recipients)
+	io.WriteString(h, strings.ToLower(st.ReturnTo)+"\x00"+strings.Join(recipients, ",")+"\x00")
+	switch s.Dedup {
+	case DedupMessageID:
+		id, ok := headerValue(st.Headers, "Message-ID")
+		if !ok || len(id) == 0 {
+			return ""
+		}
+		io.WriteString(h, id)
+	case DedupContent:
+		trace := false
+		for _, x := range st.Headers {
+			if len(x) == 0 || (x[0] != ' ' && x[0] != '\t') {
+				name := headerName(x)
+				trace = strings.EqualFold(name, "Received") || strings.EqualFold(name, "Return-Path")
+			}
+			if !trace {
+				io.WriteString(h, x+"\r\n")
+			}
+		}
+		io.WriteString(h, "\r\n")
+		if _, err := io.Copy(h, st.Content()); err != nil {
+			return ""
+		}
+	default:
+		return ""
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// original returns the message stored first with the key within the
+// window. s.mtx must be held.
+func (s *MessageStore) original(key string, now time.Time) (StoredMessage, bool) {
+	idx, err := s.loadIndex()
+	if err != nil {
+		return StoredMessage{}, false
+	}
+	id, ok := idx.dedup[key]
+	if !ok {
+		return StoredMessage{}, false
+	}
+	msg := idx.msgs[id]
+	if s.DedupWindow > 0 && now.Sub(msg.Received) > s.DedupWindow {
+		return StoredMessage{}, false
+	}
+	return msg, true
+}
+
+// collapse counts a duplicate of the message instead of storing it.
+// s.mtx must be held.
+func (s *MessageStore) collapse(msg StoredMessage) error {
+	msg.Duplicates++
+	if err := s.writeEnvelope(msg); err != nil {
+		return err
+	}
+	if s.index != nil {
+		s.index.add(msg)
+	}
+	return nil
+}
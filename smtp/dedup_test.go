@@ -0,0 +1,106 @@
+package smtp
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDedup(t *testing.T) {
+	s, err := NewMessageStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Dedup = DedupContent
+	put := func(received, rcpt string) string {
+		st := &SMTPState{ReturnTo: "foo@example.net", Recipients: []string{rcpt}}
+		st.Headers = []string{"Received: " + received, "Subject: Retry"}
+		st.SetContent([]byte("Hello\r\n"))
+		id, err := s.Put(st)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return id
+	}
+	id := put("from a", "user1@example.com")
+	if actual := put("from b", "user1@example.com"); actual != id {
+		t.Errorf("expected: %s, actual: %s", id, actual)
+	}
+	if actual := put("from a", "user2@example.com"); actual == id {
+		t.Errorf("unexpected duplicate for another recipient")
+	}
+	if msg, _ := s.Get(id); msg.Duplicates != 1 {
+		t.Errorf("expected: 1, actual: %d", msg.Duplicates)
+	}
+	if xs, _ := s.List(""); len(xs) != 2 {
+		t.Errorf("expected: 2, actual: %d", len(xs))
+	}
+
+	// the index rebuilt from the envelopes keeps the keys
+	s.Reindex()
+	s.DedupTag = true
+	dup := put("from c", "user1@example.com")
+	msg, _ := s.Get(dup)
+	if dup == id || msg.DuplicateOf != id || !containsFold(msg.Tags, DuplicateTag) {
+		t.Errorf("unexpected duplicate: %v", msg)
+	}
+
+	s.DedupWindow = time.Nanosecond
+	time.Sleep(time.Millisecond)
+	if msg, _ := s.Get(put("from d", "user1@example.com")); len(msg.DuplicateOf) > 0 {
+		t.Errorf("unexpected duplicate beyond the window: %v", msg)
+	}
+}
+
+func TestDedupMessageID(t *testing.T) {
+	s, err := NewMessageStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Dedup = DedupMessageID
+	ids := make([]string, 0)
+	for _, x := range []string{"Message-ID: <1@example.net>", "Message-ID: <1@example.net>", "Subject: None", "Subject: None"} {
+		st := &SMTPState{ReturnTo: "foo@example.net", Recipients: []string{"user1@example.com"}, Headers: []string{x}}
+		st.SetContent([]byte("Hello\r\n"))
+		id, err := s.Put(st)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	if ids[0] != ids[1] || ids[2] == ids[3] {
+		t.Errorf("unexpected IDs: %v", ids)
+	}
+}
+
+func TestDedupClock(t *testing.T) {
+	s, err := NewMessageStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock := NewFakeClock(time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC))
+	s.Clock = clock
+	s.Dedup = DedupContent
+	s.DedupWindow = time.Hour
+	put := func() StoredMessage {
+		st := &SMTPState{ReturnTo: "foo@example.net", Recipients: []string{"user1@example.com"}}
+		st.SetContent([]byte("Hello\r\n"))
+		id, err := s.Put(st)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg, _ := s.Get(id)
+		return msg
+	}
+	msg := put()
+	if !msg.Received.Equal(clock.Now()) {
+		t.Errorf("expected: %v, actual: %v", clock.Now(), msg.Received)
+	}
+	clock.Advance(30 * time.Minute)
+	if actual := put(); actual.ID != msg.ID {
+		t.Errorf("expected: %s, actual: %s", msg.ID, actual.ID)
+	}
+	clock.Advance(time.Hour)
+	if actual := put(); actual.ID == msg.ID {
+		t.Errorf("unexpected duplicate beyond the window: %v", actual)
+	}
+}
@@ -0,0 +1,48 @@
+package smtp
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// parseDeliverBy parses the BY parameter of MAIL (RFC 2852) in the form of
+// "<seconds>;<mode>", and returns the deadline from now and the mode: R to
+// return the message if it cannot be delivered in time, or N to notify the
+// sender, followed by T to request trace notifications. The time must be
+// positive in R mode.
+func parseDeliverBy(v string, now time.Time) (time.Time, string, error) {
+	xs := strings.SplitN(v, ";", 2)
+	if len(xs) != 2 || len(strings.TrimLeft(xs[0], "+-")) > 9 {
+		return time.Time{}, "", fmt.Errorf("smtp: invalid BY parameter: %s", v)
+	}
+	n, err := strconv.Atoi(xs[0])
+	if err != nil {
+		return time.Time{}, "", fmt.Errorf("smtp: invalid BY parameter: %s", v)
+	}
+	mode := strings.ToUpper(xs[1])
+	switch mode {
+	case "R", "RT":
+		if n <= 0 {
+			return time.Time{}, "", fmt.Errorf("smtp: BY time must be positive in R mode: %s", v)
+		}
+	case "N", "NT":
+	default:
+		return time.Time{}, "", fmt.Errorf("smtp: invalid BY mode: %s", v)
+	}
+	return now.Add(time.Duration(n) * time.Second), mode, nil
+}
+
+// deliverByParam returns the BY parameter with the time left until the
+// deadline.
+func (st *SMTPState) deliverByParam(now time.Time) string {
+	left := st.DeliverBy.Sub(now).Truncate(time.Second)
+	return fmt.Sprintf("%d;%s", int64(left/time.Second), st.ByMode)
+}
+
+// deliverByExpired reports whether the message can no longer be relayed
+// in R mode.
+func (st *SMTPState) deliverByExpired(now time.Time) bool {
+	return strings.HasPrefix(st.ByMode, "R") && st.DeliverBy.Sub(now) < time.Second
+}
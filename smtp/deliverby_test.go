@@ -0,0 +1,74 @@
+package smtp
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseDeliverBy(t *testing.T) {
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	for _, fixture := range []struct {
+		param    string
+		deadline time.Duration
+		mode     string
+	}{
+		{"120;R", 2 * time.Minute, "R"},
+		{"120;rt", 2 * time.Minute, "RT"},
+		{"-60;N", -time.Minute, "N"},
+		{"0;NT", 0, "NT"},
+	} {
+		deadline, mode, err := parseDeliverBy(fixture.param, now)
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+			continue
+		}
+		if !deadline.Equal(now.Add(fixture.deadline)) || mode != fixture.mode {
+			t.Errorf("expected: %s %s, actual: %s %s", now.Add(fixture.deadline), fixture.mode, deadline, mode)
+		}
+	}
+	for _, x := range []string{"120", "0;R", "-1;R", "60;X", "x;N", "1000000000;N"} {
+		if _, _, err := parseDeliverBy(x, now); err == nil {
+			t.Errorf("expected an error: %s", x)
+		}
+	}
+
+	st := &SMTPState{DeliverBy: now.Add(90 * time.Second), ByMode: "R"}
+	if expected, actual := "60;R", st.deliverByParam(now.Add(29500*time.Millisecond)); actual != expected {
+		t.Errorf("expected: %s, actual: %s", expected, actual)
+	}
+	if st.deliverByExpired(now.Add(89 * time.Second)) {
+		t.Errorf("unexpected expiry")
+	}
+	if !st.deliverByExpired(now.Add(89500 * time.Millisecond)) {
+		t.Errorf("expected expiry")
+	}
+	st.ByMode = "N"
+	if st.deliverByExpired(now.Add(time.Hour)) {
+		t.Errorf("unexpected expiry in N mode")
+	}
+}
+
+func TestMailDeliverBy(t *testing.T) {
+	for _, fixture := range []struct {
+		line     string
+		expected string
+		mode     string
+	}{
+		{"MAIL FROM: <foo@example.net> BY=3600;R", "250", "R"},
+		{"MAIL FROM: <foo@example.net> BY=-10;NT", "250", "NT"},
+		{"MAIL FROM: <foo@example.net> BY=0;R", "501", ""},
+		{"MAIL FROM: <foo@example.net> BY=3600", "501", ""},
+	} {
+		conn := NewMockConn([]byte{})
+		smtpConn := NewSMTPConnection(NewSMTPHandler(conn, nil))
+		st := smtpConn.State()
+		st.Hello = "EHLO"
+		(&MailCommand{}).Execute(smtpConn, fixture.line)
+		if actual := replyCodes(conn.CloneOutputBuffer()); actual != fixture.expected {
+			t.Errorf("expected: %s, actual: %s (%s)", fixture.expected, actual, fixture.line)
+		}
+		if st.ByMode != fixture.mode {
+			t.Errorf("expected: %s, actual: %s (%s)", fixture.mode, st.ByMode, fixture.line)
+		}
+	}
+}
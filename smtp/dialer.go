@@ -0,0 +1,178 @@
+package smtp
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+)
+
+type AddressFamily string
+
+const (
+	FamilyAny        AddressFamily = ""
+	FamilyIPv4       AddressFamily = "ipv4"
+	FamilyIPv6       AddressFamily = "ipv6"
+	FamilyPreferIPv4 AddressFamily = "prefer-ipv4"
+	FamilyPreferIPv6 AddressFamily = "prefer-ipv6"
+)
+
+func ParseAddressFamily(s string) (AddressFamily, error) {
+	switch x := AddressFamily(s); x {
+	case FamilyAny, FamilyIPv4, FamilyIPv6, FamilyPreferIPv4, FamilyPreferIPv6:
+		return x, nil
+	}
+	return "", fmt.Errorf("smtp: unknown address family: %s", s)
+}
+
+// Dialer connects to upstreams. The addresses of a host are tried in
+// order within each family, the family of the first address or the
+// preferred one first, and the other family after FallbackDelay as Happy
+// Eyeballs (RFC 8305) does, or only when the first fails if it is
+// negative.
+type Dialer struct {
+	// Timeout is the limit of each connection attempt.
+	Timeout time.Duration
+
+	// KeepAlive is the interval of TCP keep-alive probes, 15 seconds if
+	// zero, or disabled if negative.
+	KeepAlive time.Duration
+
+	// FallbackDelay is 300 milliseconds if zero.
+	FallbackDelay time.Duration
+
+	Family AddressFamily
+}
+
+var DefaultDialer = &Dialer{Timeout: 30 * time.Second}
+
+// order returns the addresses of the families to try first and next.
+func (d *Dialer) order(ips []net.IP) (primary, fallback []net.IP) {
+	if len(ips) == 0 {
+		return nil, nil
+	}
+	v4 := ips[0].To4() != nil
+	switch d.Family {
+	case FamilyIPv4, FamilyPreferIPv4:
+		v4 = true
+	case FamilyIPv6, FamilyPreferIPv6:
+		v4 = false
+	}
+	for _, ip := range ips {
+		if (ip.To4() != nil) == v4 {
+			primary = append(primary, ip)
+		} else if d.Family != FamilyIPv4 && d.Family != FamilyIPv6 {
+			fallback = append(fallback, ip)
+		}
+	}
+	return primary, fallback
+}
+
+// Dial connects to the address from the source address. See sourceIP.
+func (d *Dialer) Dial(addr, source string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ips := []net.IP{net.ParseIP(host)}
+	if ips[0] == nil {
+		ctx := context.Background()
+		if d.Timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, d.Timeout)
+			defer cancel()
+		}
+		if ips, err = net.DefaultResolver.LookupIP(ctx, "ip", host); err != nil {
+			return nil, err
+		}
+	}
+	conn, _, err := d.dialIPs(ips, port, source)
+	return conn, err
+}
+
+type dialResult struct {
+	conn net.Conn
+	ip   net.IP
+	err  error
+}
+
+// dialIPs connects to one of the addresses and returns the connection and
+// the address.
+func (d *Dialer) dialIPs(ips []net.IP, port, source string) (net.Conn, net.IP, error) {
+	primary, fallback := d.order(ips)
+	if len(primary) == 0 {
+		return nil, nil, fmt.Errorf("smtp: no %s address in %v", d.Family, ips)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if len(fallback) == 0 || d.FallbackDelay < 0 {
+		return d.dialSerial(ctx, append(primary, fallback...), port, source)
+	}
+	results := make(chan dialResult)
+	pending := 0
+	start := func(ips []net.IP) {
+		pending++
+		go func() {
+			conn, ip, err := d.dialSerial(ctx, ips, port, source)
+			results <- dialResult{conn, ip, err}
+		}()
+	}
+	start(primary)
+	delay := d.FallbackDelay
+	if delay == 0 {
+		delay = 300 * time.Millisecond
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	fallbackC := timer.C
+	var err error
+	for {
+		select {
+		case <-fallbackC:
+			fallbackC = nil
+			start(fallback)
+		case res := <-results:
+			pending--
+			if res.err == nil {
+				go func(n int) {
+					// close the connection of the loser if any
+					for ; n > 0; n-- {
+						if res := <-results; res.err == nil {
+							res.conn.Close()
+						}
+					}
+				}(pending)
+				return res.conn, res.ip, nil
+			}
+			if err == nil {
+				err = res.err
+			}
+			if fallbackC != nil {
+				fallbackC = nil
+				start(fallback)
+			} else if pending == 0 {
+				return nil, nil, err
+			}
+		}
+	}
+}
+
+// dialSerial connects to the first address accepting it.
+func (d *Dialer) dialSerial(ctx context.Context, ips []net.IP, port, source string) (net.Conn, net.IP, error) {
+	var err error
+	for _, ip := range ips {
+		dialer := &net.Dialer{Timeout: d.Timeout, KeepAlive: d.KeepAlive}
+		if len(source) > 0 {
+			var local net.IP
+			if local, err = sourceIP(source, ip); err != nil {
+				continue
+			}
+			dialer.LocalAddr = &net.TCPAddr{IP: local}
+		}
+		var conn net.Conn
+		if conn, err = dialer.DialContext(ctx, "tcp", net.JoinHostPort(ip.String(), port)); err == nil {
+			return conn, ip, nil
+		}
+	}
+	return nil, nil, err
+}
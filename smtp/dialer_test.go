@@ -0,0 +1,69 @@
+package smtp
+
+import (
+	"fmt"
+	"net"
+	"testing"
+)
+
+func TestDialerOrder(t *testing.T) {
+	ips := []net.IP{net.ParseIP("192.0.2.1"), net.ParseIP("2001:db8::1"), net.ParseIP("192.0.2.2")}
+	for _, fixture := range []struct {
+		family   AddressFamily
+		expected string
+	}{
+		{FamilyAny, "[192.0.2.1 192.0.2.2] [2001:db8::1]"},
+		{FamilyIPv4, "[192.0.2.1 192.0.2.2] []"},
+		{FamilyIPv6, "[2001:db8::1] []"},
+		{FamilyPreferIPv6, "[2001:db8::1] [192.0.2.1 192.0.2.2]"},
+	} {
+		d := &Dialer{Family: fixture.family}
+		primary, fallback := d.order(ips)
+		if actual := fmt.Sprint(primary, " ", fallback); actual != fixture.expected {
+			t.Errorf("expected: %s, actual: %s (%s)", fixture.expected, actual, fixture.family)
+		}
+	}
+	if _, err := ParseAddressFamily("ipv5"); err == nil {
+		t.Errorf("expected an error for an unknown family")
+	}
+}
+
+func TestDialerFallback(t *testing.T) {
+	lsnr, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skip(err)
+	}
+	defer lsnr.Close()
+	go func() {
+		for {
+			conn, err := lsnr.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(lsnr.Addr().String())
+	ips := []net.IP{net.ParseIP("127.0.0.1"), net.ParseIP("::1")}
+
+	// nothing listens on the port of IPv4
+	d := &Dialer{FallbackDelay: -1}
+	conn, ip, err := d.dialIPs(ips, port, "")
+	if err != nil {
+		t.Skip(err)
+	}
+	conn.Close()
+	if !ip.Equal(net.ParseIP("::1")) {
+		t.Errorf("expected: ::1, actual: %s", ip)
+	}
+	d = &Dialer{}
+	if conn, ip, err = d.dialIPs(ips, port, ""); err != nil || !ip.Equal(net.ParseIP("::1")) {
+		t.Errorf("expected: ::1, actual: %s %v", ip, err)
+	} else {
+		conn.Close()
+	}
+	d = &Dialer{Family: FamilyIPv4}
+	if _, _, err := d.dialIPs(ips, port, ""); err == nil {
+		t.Errorf("expected an error only with IPv4")
+	}
+}
@@ -0,0 +1,196 @@
+package smtp
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+var ErrDialProxy = errors.New("smtp: proxy refused the connection")
+
+// socks5Errors are the replies of SOCKS5 (RFC 1928 section 6).
+var socks5Errors = []string{
+	1: "general SOCKS server failure",
+	2: "connection not allowed by ruleset",
+	3: "network unreachable",
+	4: "host unreachable",
+	5: "connection refused",
+	6: "TTL expired",
+	7: "command not supported",
+	8: "address type not supported",
+}
+
+// ParseDialProxy parses the URL of a proxy to dial upstreams through,
+// "socks5://[user:password@]host:port" or
+// "http://[user:password@]host:port" for HTTP CONNECT.
+func ParseDialProxy(s string) (*url.URL, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "socks5", "http":
+	default:
+		return nil, fmt.Errorf("smtp: unsupported proxy scheme: %s", u.Scheme)
+	}
+	if _, _, err := net.SplitHostPort(u.Host); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// proxyConnect asks the proxy connected with conn to connect to the
+// address, and returns the connection to it.
+func proxyConnect(conn net.Conn, proxy *url.URL, addr string, timeout time.Duration) (net.Conn, error) {
+	if timeout > 0 {
+		conn.SetDeadline(time.Now().Add(timeout))
+		defer conn.SetDeadline(time.Time{})
+	}
+	if proxy.Scheme == "http" {
+		return httpConnect(conn, proxy, addr)
+	}
+	return conn, socks5Connect(conn, proxy, addr)
+}
+
+// socks5Connect sends CONNECT of SOCKS5 (RFC 1928), authenticated with the
+// username and password of the URL (RFC 1929) if any.
+func socks5Connect(conn net.Conn, proxy *url.URL, addr string) error {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return err
+	}
+	method := byte(0)
+	if proxy.User != nil {
+		method = 2
+	}
+	if _, err := conn.Write([]byte{5, 1, method}); err != nil {
+		return err
+	}
+	b := make([]byte, 2)
+	if _, err := io.ReadFull(conn, b); err != nil {
+		return err
+	}
+	if b[0] != 5 || b[1] != method {
+		return fmt.Errorf("%w: no acceptable authentication method", ErrDialProxy)
+	}
+	if method == 2 {
+		user := proxy.User.Username()
+		password, _ := proxy.User.Password()
+		if len(user) > 255 || len(password) > 255 {
+			return fmt.Errorf("smtp: too long proxy credentials")
+		}
+		req := append([]byte{1, byte(len(user))}, user...)
+		req = append(append(req, byte(len(password))), password...)
+		if _, err := conn.Write(req); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, b); err != nil {
+			return err
+		}
+		if b[1] != 0 {
+			return fmt.Errorf("%w: authentication failed", ErrDialProxy)
+		}
+	}
+
+	req := []byte{5, 1, 0}
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return fmt.Errorf("smtp: too long host name: %s", host)
+		}
+		req = append(append(req, 3, byte(len(host))), host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		req = append(append(req, 1), ip4...)
+	} else {
+		req = append(append(req, 4), ip.To16()...)
+	}
+	req = binary.BigEndian.AppendUint16(req, uint16(port))
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+	resp := make([]byte, 4)
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return err
+	}
+	if resp[0] != 5 {
+		return fmt.Errorf("%w: unexpected version %d", ErrDialProxy, resp[0])
+	}
+	if resp[1] != 0 {
+		reason := "unknown error"
+		if int(resp[1]) < len(socks5Errors) {
+			reason = socks5Errors[resp[1]]
+		}
+		return fmt.Errorf("%w: %s", ErrDialProxy, reason)
+	}
+	// skip the bound address and port
+	var n int
+	switch resp[3] {
+	case 1:
+		n = 4
+	case 4:
+		n = 16
+	case 3:
+		if _, err := io.ReadFull(conn, b[:1]); err != nil {
+			return err
+		}
+		n = int(b[0])
+	default:
+		return fmt.Errorf("%w: unexpected address type %d", ErrDialProxy, resp[3])
+	}
+	_, err = io.ReadFull(conn, make([]byte, n+2))
+	return err
+}
+
+// bufferedConn reads the bytes buffered beyond the response of the proxy
+// before the connection.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// httpConnect sends CONNECT of HTTP (RFC 9110 section 9.3.6), with the
+// username and password of the URL in Proxy-Authorization if any.
+func httpConnect(conn net.Conn, proxy *url.URL, addr string) (net.Conn, error) {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if proxy.User != nil {
+		password, _ := proxy.User.Password()
+		credentials := proxy.User.Username() + ":" + password
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(credentials)))
+	}
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%w: %s", ErrDialProxy, resp.Status)
+	}
+	if r.Buffered() > 0 {
+		return &bufferedConn{conn, r}, nil
+	}
+	return conn, nil
+}
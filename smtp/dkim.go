@@ -0,0 +1,264 @@
+package smtp
+
+import (
+	"bufio"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var DefaultDKIMHeaders = []string{
+	"From", "Reply-To", "Subject", "Date", "To", "Cc", "Message-ID",
+	"In-Reply-To", "References", "MIME-Version", "Content-Type",
+	"Content-Transfer-Encoding",
+}
+
+// DKIMSigner adds a DKIM-Signature (RFC 6376) to messages with an RSA or
+// Ed25519 key.
+type DKIMSigner struct {
+	Domain   string
+	Selector string
+	Key      crypto.Signer
+
+	// Headers are the names of the fields to sign if present.
+	Headers []string
+
+	// HeaderCanonicalization and BodyCanonicalization are "simple" or
+	// "relaxed".
+	HeaderCanonicalization string
+	BodyCanonicalization   string
+
+	// Expiration sets x= to the signing time plus the duration if non-zero.
+	Expiration time.Duration
+}
+
+func NewDKIMSigner(domain, selector string, key crypto.Signer) *DKIMSigner {
+	return &DKIMSigner{
+		Domain:                 domain,
+		Selector:               selector,
+		Key:                    key,
+		Headers:                DefaultDKIMHeaders,
+		HeaderCanonicalization: "relaxed",
+		BodyCanonicalization:   "relaxed",
+	}
+}
+
+// ParseDKIMPrivateKey reads an RSA or Ed25519 key in PEM, either PKCS #1
+// or PKCS #8.
+func ParseDKIMPrivateKey(b []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, errors.New("dkim: no PEM data")
+	}
+	if block.Type == "RSA PRIVATE KEY" {
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		return k, nil
+	case ed25519.PrivateKey:
+		return k, nil
+	}
+	return nil, fmt.Errorf("dkim: unsupported key type %T", key)
+}
+
+func (s *DKIMSigner) algorithm() string {
+	if _, ok := s.Key.(ed25519.PrivateKey); ok {
+		return "ed25519-sha256"
+	}
+	return "rsa-sha256"
+}
+
+// Sign prepends a DKIM-Signature header to the message.
+func (s *DKIMSigner) Sign(st *SMTPState) error {
+	return s.sign(st, time.Now())
+}
+
+func (s *DKIMSigner) sign(st *SMTPState, now time.Time) error {
+	lines, err := s.signature(st, "DKIM-Signature", "v=1", now)
+	if err != nil {
+		return err
+	}
+	st.Headers = append(lines, st.Headers...)
+	return nil
+}
+
+// signature returns the lines of a signature field of the name, starting
+// with the tag, e.g. v=1.
+func (s *DKIMSigner) signature(st *SMTPState, name, tag string, now time.Time) ([]string, error) {
+	relaxedHeader := s.HeaderCanonicalization == "relaxed"
+	relaxedBody := s.BodyCanonicalization == "relaxed"
+	bh, err := dkimBodyHash(st.Content(), relaxedBody)
+	if err != nil {
+		return nil, err
+	}
+	fields := headerFields(st.Headers)
+	names := make([]string, 0)
+	signed := make([]string, 0)
+	for _, name := range s.Headers {
+		xs := dkimSelectFields(fields, name, -1)
+		for _, x := range xs {
+			names = append(names, name)
+			signed = append(signed, x)
+		}
+	}
+	c := func(relaxed bool) string {
+		if relaxed {
+			return "relaxed"
+		}
+		return "simple"
+	}
+	tags := fmt.Sprintf("%s; a=%s; c=%s/%s; d=%s; s=%s;", tag, s.algorithm(),
+		c(relaxedHeader), c(relaxedBody), s.Domain, s.Selector)
+	lines := []string{name + ": " + tags}
+	ts := "\tt=" + strconv.FormatInt(now.Unix(), 10) + ";"
+	if s.Expiration > 0 {
+		ts += " x=" + strconv.FormatInt(now.Add(s.Expiration).Unix(), 10) + ";"
+	}
+	lines = append(lines, ts,
+		"\th="+strings.Join(names, ":")+";",
+		"\tbh="+base64.StdEncoding.EncodeToString(bh)+";",
+		"\tb=")
+	b, err := dkimSign(s.Key, signed, strings.Join(lines, "\r\n"), relaxedHeader)
+	if err != nil {
+		return nil, err
+	}
+	lines[len(lines)-1] += base64.StdEncoding.EncodeToString(b)
+	return lines, nil
+}
+
+// MessageSigner signs messages, e.g. a DKIMSigner or a DKIMKeyRing.
+type MessageSigner interface {
+	Sign(st *SMTPState) error
+}
+
+// WithDKIMSignature returns a Send function which signs the message, then
+// calls send.
+func WithDKIMSignature(send func(st *SMTPState) error, signer MessageSigner) func(st *SMTPState) error {
+	return func(st *SMTPState) error {
+		if err := signer.Sign(st); err != nil {
+			return err
+		}
+		return send(st)
+	}
+}
+
+// dkimSelectFields returns the fields of the name from the bottom up as
+// they are signed. n limits the number of fields if non-negative.
+func dkimSelectFields(fields []string, name string, n int) []string {
+	xs := make([]string, 0)
+	for i := len(fields) - 1; i >= 0 && (n < 0 || len(xs) < n); i-- {
+		if strings.EqualFold(headerName(fields[i]), name) {
+			xs = append(xs, fields[i])
+		}
+	}
+	return xs
+}
+
+// dkimHeaderHash hashes the signed fields followed by the signature field
+// without its trailing CRLF.
+func dkimHeaderHash(signed []string, sig string, relaxed bool) []byte {
+	h := sha256.New()
+	for _, x := range signed {
+		io.WriteString(h, dkimCanonicalHeader(x, relaxed)+"\r\n")
+	}
+	io.WriteString(h, dkimCanonicalHeader(sig, relaxed))
+	return h.Sum(nil)
+}
+
+func dkimSign(key crypto.Signer, signed []string, sig string, relaxed bool) ([]byte, error) {
+	digest := dkimHeaderHash(signed, sig, relaxed)
+	if _, ok := key.(ed25519.PrivateKey); ok {
+		return key.Sign(rand.Reader, digest, crypto.Hash(0))
+	}
+	return key.Sign(rand.Reader, digest, crypto.SHA256)
+}
+
+func dkimCanonicalHeader(field string, relaxed bool) string {
+	if !relaxed {
+		return field
+	}
+	i := strings.IndexByte(field, ':')
+	if i < 0 {
+		return field
+	}
+	name := strings.ToLower(strings.TrimRight(field[:i], " \t"))
+	value := strings.Replace(field[i+1:], "\r\n", "", -1)
+	return name + ":" + strings.TrimSpace(dkimCompressSpace(value))
+}
+
+func dkimCompressSpace(s string) string {
+	var b strings.Builder
+	space := false
+	for i := 0; i < len(s); i++ {
+		if s[i] == ' ' || s[i] == '\t' {
+			space = true
+			continue
+		}
+		if space {
+			b.WriteByte(' ')
+			space = false
+		}
+		b.WriteByte(s[i])
+	}
+	if space {
+		b.WriteByte(' ')
+	}
+	return b.String()
+}
+
+// dkimBodyHash returns the SHA-256 hash of the canonicalized body.
+func dkimBodyHash(r io.Reader, relaxed bool) ([]byte, error) {
+	h := sha256.New()
+	if err := dkimCanonicalBody(h, r, relaxed); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+func dkimCanonicalBody(h io.Writer, r io.Reader, relaxed bool) error {
+	br := bufio.NewReader(r)
+	blank := 0
+	empty := true
+	for {
+		line, err := br.ReadString('\n')
+		if len(line) > 0 {
+			line = strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r")
+			if relaxed {
+				line = strings.TrimRight(dkimCompressSpace(line), " ")
+			}
+			if len(line) == 0 {
+				blank++
+			} else {
+				io.WriteString(h, strings.Repeat("\r\n", blank)+line+"\r\n")
+				blank = 0
+				empty = false
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if empty && !relaxed {
+		io.WriteString(h, "\r\n")
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+package smtp
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDKIMCanonicalization(t *testing.T) {
+	// RFC 6376 section 3.4.6
+	fields := headerFields([]string{"A: X", "B : Y\t", "\tZ  "})
+	expected := "a:X\r\nb:Y Z\r\n"
+	actual := ""
+	for _, x := range fields {
+		actual += dkimCanonicalHeader(x, true) + "\r\n"
+	}
+	if actual != expected {
+		t.Errorf("expected: %q, actual: %q", expected, actual)
+	}
+
+	body := " C \r\nD \t E\r\n\r\n\r\n"
+	for _, relaxed := range []bool{true, false} {
+		expected := " C\r\nD E\r\n"
+		if !relaxed {
+			expected = " C \r\nD \t E\r\n"
+		}
+		actual, _ := dkimBodyHash(strings.NewReader(body), relaxed)
+		x, _ := dkimBodyHash(strings.NewReader(expected), false)
+		if !bytes.Equal(actual, x) {
+			t.Errorf("unexpected body hash for relaxed=%v", relaxed)
+		}
+	}
+	// an empty body is a single CRLF in simple and nothing in relaxed
+	simple, _ := dkimBodyHash(strings.NewReader(""), false)
+	if x := base64.StdEncoding.EncodeToString(simple); x != "frcCV1k9oG9oKj3dpUqdJg1PxRT2RSN/XKdLCPjaYaY=" {
+		t.Errorf("unexpected empty simple body hash: %s", x)
+	}
+	relaxed, _ := dkimBodyHash(strings.NewReader(""), true)
+	if x := base64.StdEncoding.EncodeToString(relaxed); x != "47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU=" {
+		t.Errorf("unexpected empty relaxed body hash: %s", x)
+	}
+}
+
+func TestParseDKIMPrivateKey(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 1024)
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	pkcs8, _ := x509.MarshalPKCS8PrivateKey(edKey)
+	for _, block := range []*pem.Block{
+		{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)},
+		{Type: "PRIVATE KEY", Bytes: pkcs8},
+	} {
+		if _, err := ParseDKIMPrivateKey(pem.EncodeToMemory(block)); err != nil {
+			t.Errorf("%s: %v", block.Type, err)
+		}
+	}
+	if _, err := ParseDKIMPrivateKey([]byte("garbage")); err == nil {
+		t.Errorf("expected an error")
+	}
+}
+
+func TestDKIMSigner(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 1024)
+	edPub, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	for _, key := range []crypto.Signer{rsaKey, edKey} {
+		st := &SMTPState{}
+		st.Reset()
+		st.Headers = []string{"From: foo@example.net", "To: user1@example.net",
+			"Subject: DKIM", "\ttest", "X-Unsigned: yes"}
+		st.SetContent([]byte("Hello\r\n\r\n"))
+		s := NewDKIMSigner("example.net", "sel", key)
+		if err := s.sign(st, time.Unix(1500000000, 0)); err != nil {
+			t.Fatal(err)
+		}
+		fields := headerFields(st.Headers)
+		sig := fields[0]
+		if !strings.HasPrefix(sig, "DKIM-Signature: v=1; a="+s.algorithm()+"; c=relaxed/relaxed; d=example.net; s=sel;") ||
+			!strings.Contains(sig, "\r\n\tt=1500000000;\r\n\th=From:Subject:To;\r\n") {
+			t.Fatalf("unexpected signature: %s", sig)
+		}
+		i := strings.LastIndex(sig, "b=")
+		b, err := base64.StdEncoding.DecodeString(sig[i+2:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		digest := dkimHeaderHash([]string{fields[1], fields[3], fields[2]}, sig[:i+2], true)
+		switch key.(type) {
+		case *rsa.PrivateKey:
+			err = rsa.VerifyPKCS1v15(&rsaKey.PublicKey, crypto.SHA256, digest, b)
+		case ed25519.PrivateKey:
+			if !ed25519.Verify(edPub, digest, b) {
+				t.Errorf("invalid Ed25519 signature")
+			}
+		}
+		if err != nil {
+			t.Error(err)
+		}
+	}
+}
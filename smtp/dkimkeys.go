@@ -0,0 +1,189 @@
+package smtp
+
+import (
+	"bufio"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// GenerateDKIMKey generates a signing key of the algorithm, "rsa" (2048
+// bits) or "ed25519".
+func GenerateDKIMKey(algorithm string) (crypto.Signer, error) {
+	switch algorithm {
+	case "rsa":
+		return rsa.GenerateKey(rand.Reader, 2048)
+	case "ed25519":
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		return key, err
+	}
+	return nil, fmt.Errorf("dkim: unsupported algorithm %s", algorithm)
+}
+
+// MarshalDKIMPrivateKey encodes the key in PEM as PKCS #8.
+func MarshalDKIMPrivateKey(key crypto.Signer) ([]byte, error) {
+	b, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: b}), nil
+}
+
+// DKIMRecord returns the TXT record to publish the public key of the key
+// at <selector>._domainkey.<domain>.
+func DKIMRecord(key crypto.Signer) (string, error) {
+	switch k := key.Public().(type) {
+	case *rsa.PublicKey:
+		b, err := x509.MarshalPKIXPublicKey(k)
+		if err != nil {
+			return "", err
+		}
+		return "v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(b), nil
+	case ed25519.PublicKey:
+		return "v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(k), nil
+	}
+	return "", fmt.Errorf("dkim: unsupported key type %T", key)
+}
+
+// LoadDKIMPrivateKey reads a key in PEM from the file, or from the
+// environment variable if the source is of the form "env:NAME".
+func LoadDKIMPrivateKey(source string) (crypto.Signer, error) {
+	if strings.HasPrefix(source, "env:") {
+		v, ok := os.LookupEnv(source[4:])
+		if !ok {
+			return nil, fmt.Errorf("dkim: %s is not set", source[4:])
+		}
+		return ParseDKIMPrivateKey([]byte(v))
+	}
+	b, err := os.ReadFile(source)
+	if err != nil {
+		return nil, err
+	}
+	return ParseDKIMPrivateKey(b)
+}
+
+// DKIMKey is a key of a selector which is used for signing from Activate.
+type DKIMKey struct {
+	Selector string
+	Key      crypto.Signer
+	Activate time.Time
+}
+
+// DKIMKeyRing holds the keys of the selectors of a domain and signs with
+// the most recently activated one. A new selector can be staged to
+// activate once its record has been published, and the previous one kept
+// until signatures made with it no longer need to verify.
+type DKIMKeyRing struct {
+	// Signer is the template of the signers. Its Selector and Key are
+	// replaced with the current ones.
+	Signer DKIMSigner
+
+	mtx  sync.RWMutex
+	keys []DKIMKey
+}
+
+func NewDKIMKeyRing(domain string) *DKIMKeyRing {
+	return &DKIMKeyRing{Signer: *NewDKIMSigner(domain, "", nil)}
+}
+
+// Add adds or replaces the key of the selector.
+func (ring *DKIMKeyRing) Add(selector string, key crypto.Signer, activate time.Time) {
+	defer ring.mtx.Unlock()
+	ring.mtx.Lock()
+	ring.remove(selector)
+	ring.keys = append(ring.keys, DKIMKey{selector, key, activate})
+	sort.SliceStable(ring.keys, func(i, j int) bool {
+		return ring.keys[i].Activate.Before(ring.keys[j].Activate)
+	})
+}
+
+// Remove retires the key of the selector.
+func (ring *DKIMKeyRing) Remove(selector string) {
+	defer ring.mtx.Unlock()
+	ring.mtx.Lock()
+	ring.remove(selector)
+}
+
+func (ring *DKIMKeyRing) remove(selector string) {
+	for i, x := range ring.keys {
+		if x.Selector == selector {
+			ring.keys = append(ring.keys[:i], ring.keys[i+1:]...)
+			return
+		}
+	}
+}
+
+// Keys returns the keys in order of activation.
+func (ring *DKIMKeyRing) Keys() []DKIMKey {
+	defer ring.mtx.RUnlock()
+	ring.mtx.RLock()
+	return append([]DKIMKey{}, ring.keys...)
+}
+
+// Current returns the most recently activated key at the time.
+func (ring *DKIMKeyRing) Current(now time.Time) (DKIMKey, bool) {
+	defer ring.mtx.RUnlock()
+	ring.mtx.RLock()
+	for i := len(ring.keys) - 1; i >= 0; i-- {
+		if !ring.keys[i].Activate.After(now) {
+			return ring.keys[i], true
+		}
+	}
+	return DKIMKey{}, false
+}
+
+// Sign prepends a DKIM-Signature header with the current key.
+func (ring *DKIMKeyRing) Sign(st *SMTPState) error {
+	now := time.Now()
+	k, ok := ring.Current(now)
+	if !ok {
+		return fmt.Errorf("dkim: no active key for %s", ring.Signer.Domain)
+	}
+	signer := ring.Signer
+	signer.Selector, signer.Key = k.Selector, k.Key
+	return signer.sign(st, now)
+}
+
+// ParseDKIMKeyRing reads keys in the form of "selector source [activate]"
+// per line, where source is a file or "env:NAME" and activate is a time in
+// RFC 3339. Lines starting with "#" are ignored.
+func ParseDKIMKeyRing(r io.Reader, domain string) (*DKIMKeyRing, error) {
+	ring := NewDKIMKeyRing(domain)
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 || len(fields) > 3 {
+			return nil, fmt.Errorf("line %d: malformed key", n)
+		}
+		key, err := LoadDKIMPrivateKey(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", n, err)
+		}
+		var activate time.Time
+		if len(fields) == 3 {
+			if activate, err = time.Parse(time.RFC3339, fields[2]); err != nil {
+				return nil, fmt.Errorf("line %d: %v", n, err)
+			}
+		}
+		ring.Add(fields[0], key, activate)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return ring, nil
+}
@@ -0,0 +1,97 @@
+package smtp
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDKIMRecord(t *testing.T) {
+	for _, algorithm := range []string{"rsa", "ed25519"} {
+		key, err := GenerateDKIMKey(algorithm)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := MarshalDKIMPrivateKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ParseDKIMPrivateKey(b); err != nil {
+			t.Errorf("%s: %v", algorithm, err)
+		}
+		record, err := DKIMRecord(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(record, "v=DKIM1; k="+algorithm+"; p=") {
+			t.Errorf("unexpected record: %s", record)
+		}
+		st := &SMTPState{}
+		st.Reset()
+		st.Headers = []string{"From: foo@example.net"}
+		st.SetContent([]byte("Hello\r\n"))
+		NewDKIMSigner("example.net", "sel", key).Sign(st)
+		lookup := dkimTestLookup(map[string]string{"sel._domainkey.example.net": record})
+		if res := VerifyDKIM(st, lookup); len(res) != 1 || res[0].Result != "pass" {
+			t.Errorf("%s: unexpected result: %v", algorithm, res)
+		}
+	}
+	if _, err := GenerateDKIMKey("dsa"); err == nil {
+		t.Errorf("expected an error")
+	}
+}
+
+func TestDKIMKeyRing(t *testing.T) {
+	dir := t.TempDir()
+	key1, _ := GenerateDKIMKey("ed25519")
+	key2, _ := GenerateDKIMKey("ed25519")
+	b1, _ := MarshalDKIMPrivateKey(key1)
+	b2, _ := MarshalDKIMPrivateKey(key2)
+	path := filepath.Join(dir, "key1.pem")
+	os.WriteFile(path, b1, 0600)
+	os.Setenv("DKIM_TEST_KEY2", string(b2))
+	defer os.Unsetenv("DKIM_TEST_KEY2")
+
+	ring, err := ParseDKIMKeyRing(strings.NewReader("# selectors\n"+
+		"s1 "+path+"\n"+
+		"s2 env:DKIM_TEST_KEY2 2100-01-01T00:00:00Z\n"), "example.net")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k, ok := ring.Current(time.Now()); !ok || k.Selector != "s1" {
+		t.Errorf("expected: s1, actual: %v", k.Selector)
+	}
+	if k, ok := ring.Current(time.Date(2100, 1, 1, 0, 0, 0, 0, time.UTC)); !ok || k.Selector != "s2" {
+		t.Errorf("expected: s2, actual: %v", k.Selector)
+	}
+
+	st := &SMTPState{}
+	st.Reset()
+	st.Headers = []string{"From: foo@example.net"}
+	st.SetContent([]byte("Hello\r\n"))
+	if err := ring.Sign(st); err != nil {
+		t.Fatal(err)
+	}
+	r1, _ := DKIMRecord(key1)
+	lookup := dkimTestLookup(map[string]string{"s1._domainkey.example.net": r1})
+	if res := VerifyDKIM(st, lookup); len(res) != 1 || res[0].String() != "dkim=pass header.d=example.net header.s=s1" {
+		t.Errorf("unexpected result: %v", res)
+	}
+
+	// activate the staged selector now and retire the previous one
+	ring.Add("s2", key2, time.Now().Add(-time.Minute))
+	ring.Remove("s1")
+	if xs := ring.Keys(); len(xs) != 1 || xs[0].Selector != "s2" {
+		t.Errorf("unexpected keys: %v", xs)
+	}
+	ring.Remove("s2")
+	if err := ring.Sign(st); err == nil {
+		t.Errorf("expected an error")
+	}
+
+	if _, err := ParseDKIMKeyRing(strings.NewReader("s1 env:DKIM_TEST_MISSING\n"), "example.net"); err == nil {
+		t.Errorf("expected an error")
+	}
+}
@@ -0,0 +1,343 @@
+package smtp
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DKIMResult is the result of verifying a DKIM-Signature: pass, fail,
+// neutral, temperror or permerror (RFC 8601).
+type DKIMResult struct {
+	Result   string
+	Domain   string
+	Selector string
+	Reason   string
+}
+
+func (res DKIMResult) String() string {
+	s := "dkim=" + res.Result
+	if len(res.Reason) > 0 {
+		s += " reason=" + strconv.Quote(res.Reason)
+	}
+	if len(res.Domain) > 0 {
+		s += " header.d=" + res.Domain
+	}
+	if len(res.Selector) > 0 {
+		s += " header.s=" + res.Selector
+	}
+	return s
+}
+
+const maxDKIMSignatures = 5
+
+var dkimSignatureValue = regexp.MustCompile(`(^|[;:\s])(b[ \t\r\n]*=)[^;]*`)
+
+// VerifyDKIM verifies the DKIM signatures of the message, looking up the
+// public keys with lookupTXT, e.g. net.LookupTXT.
+func VerifyDKIM(st *SMTPState, lookupTXT func(name string) ([]string, error)) []DKIMResult {
+	results := make([]DKIMResult, 0)
+	fields := headerFields(st.Headers)
+	for _, field := range fields {
+		if !strings.EqualFold(headerName(field), "DKIM-Signature") {
+			continue
+		}
+		if len(results) == maxDKIMSignatures {
+			break
+		}
+		results = append(results, verifyDKIMSignature(st, fields, field, lookupTXT, time.Now()))
+	}
+	return results
+}
+
+// parseDKIMTags parses a tag-list (RFC 6376 section 3.2).
+func parseDKIMTags(s string) (map[string]string, error) {
+	tags := make(map[string]string)
+	for _, x := range strings.Split(s, ";") {
+		x = strings.TrimSpace(x)
+		if len(x) == 0 {
+			continue
+		}
+		i := strings.IndexByte(x, '=')
+		if i <= 0 {
+			return nil, fmt.Errorf("malformed tag: %s", x)
+		}
+		name := strings.TrimSpace(x[:i])
+		if _, ok := tags[name]; ok {
+			return nil, fmt.Errorf("duplicate tag: %s", name)
+		}
+		tags[name] = strings.TrimSpace(x[i+1:])
+	}
+	return tags, nil
+}
+
+func removeSpace(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r == ' ' || r == '\t' || r == '\r' || r == '\n' {
+			return -1
+		}
+		return r
+	}, s)
+}
+
+func verifyDKIMSignature(st *SMTPState, fields []string, field string,
+	lookupTXT func(name string) ([]string, error), now time.Time) DKIMResult {
+	return verifyMessageSignature(st, fields, field, false, lookupTXT, now)
+}
+
+// verifyMessageSignature verifies a DKIM-Signature, or an
+// ARC-Message-Signature if arc is true, which has i= in place of v=.
+func verifyMessageSignature(st *SMTPState, fields []string, field string, arc bool,
+	lookupTXT func(name string) ([]string, error), now time.Time) DKIMResult {
+	res := DKIMResult{Result: "permerror"}
+	tags, err := parseDKIMTags(field[strings.IndexByte(field, ':')+1:])
+	if err != nil {
+		res.Reason = err.Error()
+		return res
+	}
+	res.Domain, res.Selector = tags["d"], tags["s"]
+	version := "v"
+	if arc {
+		version = "i"
+	}
+	for _, x := range []string{version, "a", "b", "bh", "d", "h", "s"} {
+		if _, ok := tags[x]; !ok {
+			res.Reason = "missing tag " + x
+			return res
+		}
+	}
+	if !arc && tags["v"] != "1" {
+		res.Reason = "unsupported version"
+		return res
+	}
+	algorithm := tags["a"]
+	if algorithm != "rsa-sha256" && algorithm != "ed25519-sha256" {
+		res.Result, res.Reason = "neutral", "unsupported algorithm"
+		return res
+	}
+	names := strings.Split(removeSpace(tags["h"]), ":")
+	hasFrom := false
+	for _, x := range names {
+		hasFrom = hasFrom || strings.EqualFold(x, "From")
+	}
+	if !hasFrom {
+		res.Reason = "From not signed"
+		return res
+	}
+	if x, ok := tags["x"]; ok {
+		if t, err := strconv.ParseInt(x, 10, 64); err == nil && now.Unix() > t {
+			res.Reason = "signature expired"
+			return res
+		}
+	}
+	relaxedHeader, relaxedBody := false, false
+	if c, ok := tags["c"]; ok {
+		xs := strings.SplitN(c, "/", 2)
+		relaxedHeader = xs[0] == "relaxed"
+		relaxedBody = len(xs) == 2 && xs[1] == "relaxed"
+	}
+
+	key, err := lookupDKIMKey(res.Selector+"._domainkey."+res.Domain, lookupTXT)
+	if err != nil {
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.Temporary() {
+			res.Result = "temperror"
+		}
+		res.Reason = err.Error()
+		return res
+	}
+
+	res.Result = "fail"
+	var w io.Writer
+	h := sha256.New()
+	w = h
+	if l, ok := tags["l"]; ok {
+		n, err := strconv.ParseInt(l, 10, 64)
+		if err != nil {
+			res.Result, res.Reason = "permerror", "invalid body length"
+			return res
+		}
+		w = &limitWriter{w: h, n: n}
+	}
+	if err := dkimCanonicalBody(w, st.Content(), relaxedBody); err != nil {
+		res.Result, res.Reason = "temperror", err.Error()
+		return res
+	}
+	if base64.StdEncoding.EncodeToString(h.Sum(nil)) != removeSpace(tags["bh"]) {
+		res.Reason = "body hash did not verify"
+		return res
+	}
+
+	signed := make([]string, 0)
+	used := make(map[string]int)
+	for _, name := range names {
+		key := strings.ToLower(name)
+		xs := dkimSelectFields(fields, name, used[key]+1)
+		if len(xs) > used[key] {
+			signed = append(signed, xs[used[key]])
+		}
+		used[key]++
+	}
+	digest := dkimHeaderHash(signed, dkimSignatureValue.ReplaceAllString(field, "${1}${2}"), relaxedHeader)
+	sig, err := base64.StdEncoding.DecodeString(removeSpace(tags["b"]))
+	if err != nil {
+		res.Result, res.Reason = "permerror", "malformed signature"
+		return res
+	}
+	if res.Reason = dkimVerify(key, algorithm, digest, sig); len(res.Reason) > 0 {
+		return res
+	}
+	res.Result = "pass"
+	return res
+}
+
+// dkimVerify verifies the signature of the digest. It returns the reason
+// of a failure or an empty string.
+func dkimVerify(key crypto.PublicKey, algorithm string, digest, sig []byte) string {
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if algorithm != "rsa-sha256" {
+			return "key type mismatch"
+		}
+		if err := rsa.VerifyPKCS1v15(k, crypto.SHA256, digest, sig); err != nil {
+			return "signature did not verify"
+		}
+	case ed25519.PublicKey:
+		if algorithm != "ed25519-sha256" {
+			return "key type mismatch"
+		}
+		if !ed25519.Verify(k, digest, sig) {
+			return "signature did not verify"
+		}
+	}
+	return ""
+}
+
+// lookupDKIMKey returns the public key of the key record (RFC 6376 section
+// 3.6.1).
+func lookupDKIMKey(name string, lookupTXT func(name string) ([]string, error)) (crypto.PublicKey, error) {
+	txts, err := lookupTXT(name)
+	if err != nil && !isNotFound(err) {
+		return nil, err
+	}
+	if len(txts) == 0 {
+		return nil, errors.New("no key for signature")
+	}
+	tags, err := parseDKIMTags(strings.Join(txts, ""))
+	if err != nil {
+		return nil, err
+	}
+	if v, ok := tags["v"]; ok && v != "DKIM1" {
+		return nil, errors.New("unsupported key version")
+	}
+	p := removeSpace(tags["p"])
+	if len(p) == 0 {
+		return nil, errors.New("key revoked")
+	}
+	b, err := base64.StdEncoding.DecodeString(p)
+	if err != nil {
+		return nil, errors.New("malformed key")
+	}
+	switch k := tags["k"]; k {
+	case "", "rsa":
+		if key, err := x509.ParsePKIXPublicKey(b); err == nil {
+			if rsaKey, ok := key.(*rsa.PublicKey); ok {
+				return rsaKey, nil
+			}
+			return nil, errors.New("key type mismatch")
+		}
+		return x509.ParsePKCS1PublicKey(b)
+	case "ed25519":
+		if len(b) != ed25519.PublicKeySize {
+			return nil, errors.New("malformed key")
+		}
+		return ed25519.PublicKey(b), nil
+	default:
+		return nil, errors.New("unsupported key type " + k)
+	}
+}
+
+type limitWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (lw *limitWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	if int64(len(p)) > lw.n {
+		p = p[:lw.n]
+	}
+	lw.n -= int64(len(p))
+	if _, err := lw.w.Write(p); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// authResultsHeader returns the lines of an Authentication-Results header
+// (RFC 8601) of the results on the state.
+func authResultsHeader(st *SMTPState) []string {
+	return authResultsLines("Authentication-Results: "+st.ServerName+";", st.AuthResults)
+}
+
+func authResultsLines(first string, results []string) []string {
+	lines := []string{first}
+	if len(results) == 0 {
+		return []string{first + " none"}
+	}
+	for i, x := range results {
+		if i < len(results)-1 {
+			x += ";"
+		}
+		lines = append(lines, "\t"+x)
+	}
+	return lines
+}
+
+// removeAuthResults removes Authentication-Results headers claiming to be
+// from the server (RFC 8601 section 5).
+func removeAuthResults(headers []string, serverName string) []string {
+	xs := make([]string, 0, len(headers))
+	for _, x := range headerFields(headers) {
+		if strings.EqualFold(headerName(x), "Authentication-Results") {
+			v := strings.TrimSpace(x[strings.IndexByte(x, ':')+1:])
+			id := strings.TrimSpace(strings.SplitN(v, ";", 2)[0])
+			if strings.EqualFold(id, serverName) {
+				continue
+			}
+		}
+		xs = append(xs, strings.Split(x, "\r\n")...)
+	}
+	return xs
+}
+
+// applyDKIM verifies the signatures and records the results on the state.
+func applyDKIM(conn *SMTPConnection) {
+	config := conn.Config()
+	if !config.VerifyDKIM && !config.CheckDMARC {
+		return
+	}
+	st := conn.State()
+	lookupTXT := func(name string) ([]string, error) {
+		return config.resolver().LookupTXT(context.Background(), name)
+	}
+	st.DKIMResults = VerifyDKIM(st, lookupTXT)
+	if len(st.DKIMResults) == 0 {
+		st.AuthResults = append(st.AuthResults, "dkim=none")
+	}
+	for _, res := range st.DKIMResults {
+		st.AuthResults = append(st.AuthResults, res.String())
+	}
+}
@@ -0,0 +1,121 @@
+package smtp
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+func dkimTestLookup(records map[string]string) func(name string) ([]string, error) {
+	r := &testResolver{txt: make(map[string][]string)}
+	for k, v := range records {
+		r.txt[k] = []string{v}
+	}
+	return func(name string) ([]string, error) {
+		return r.LookupTXT(context.Background(), name)
+	}
+}
+
+func TestVerifyDKIM(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 1024)
+	der, _ := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	edPub, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	lookup := dkimTestLookup(map[string]string{
+		"rsa._domainkey.example.net":     "v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(der),
+		"ed._domainkey.example.org":      "v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(edPub),
+		"revoked._domainkey.example.net": "v=DKIM1; p=",
+	})
+
+	newState := func() *SMTPState {
+		st := &SMTPState{}
+		st.Reset()
+		st.Headers = []string{"From: foo@example.net", "Subject: DKIM", "\tfolded  line"}
+		st.SetContent([]byte("Hello  \r\n\r\n"))
+		return st
+	}
+	st := newState()
+	NewDKIMSigner("example.net", "rsa", rsaKey).Sign(st)
+	signer := NewDKIMSigner("example.org", "ed", edKey)
+	signer.HeaderCanonicalization = "simple"
+	signer.BodyCanonicalization = "simple"
+	signer.Sign(st)
+	NewDKIMSigner("example.net", "revoked", rsaKey).Sign(st)
+	NewDKIMSigner("example.net", "missing", rsaKey).Sign(st)
+	// unsigned headers may be added without breaking the signatures
+	st.Headers = append([]string{"Received: from localhost"}, st.Headers...)
+
+	actual := make([]string, 0)
+	for _, res := range VerifyDKIM(st, lookup) {
+		actual = append(actual, res.String())
+	}
+	expected := []string{
+		`dkim=permerror reason="no key for signature" header.d=example.net header.s=missing`,
+		`dkim=permerror reason="key revoked" header.d=example.net header.s=revoked`,
+		`dkim=pass header.d=example.org header.s=ed`,
+		`dkim=pass header.d=example.net header.s=rsa`,
+	}
+	if strings.Join(actual, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("expected: %v, actual: %v", expected, actual)
+	}
+
+	tampered := newState()
+	NewDKIMSigner("example.net", "rsa", rsaKey).Sign(tampered)
+	tampered.SetContent([]byte("Goodbye\r\n"))
+	if res := VerifyDKIM(tampered, lookup); len(res) != 1 || res[0].Reason != "body hash did not verify" {
+		t.Errorf("unexpected result: %v", res)
+	}
+	tampered = newState()
+	NewDKIMSigner("example.net", "rsa", rsaKey).Sign(tampered)
+	tampered.Headers = append(tampered.Headers, "Subject: Another")
+	if res := VerifyDKIM(tampered, lookup); len(res) != 1 || res[0].Result != "fail" {
+		t.Errorf("unexpected result: %v", res)
+	}
+}
+
+func TestVerifyDKIMSession(t *testing.T) {
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	st := &SMTPState{}
+	st.Reset()
+	st.Headers = []string{"From: foo@example.net", "Subject: DKIM"}
+	st.SetContent([]byte("Hello\r\n"))
+	NewDKIMSigner("example.net", "ed", edKey).Sign(st)
+	input := "EHLO localhost\r\n" +
+		"MAIL FROM: <foo@example.net>\r\n" +
+		"RCPT TO: <user1@example.net>\r\n" +
+		"DATA\r\n" +
+		"Authentication-Results: localhost; dkim=pass\r\n" +
+		strings.Join(st.Headers, "\r\n") + "\r\n" +
+		"\r\n" +
+		"Hello\r\n" +
+		".\r\n" +
+		"QUIT\r\n"
+
+	var headers, tags []string
+	conn := NewMockConn([]byte(input))
+	h := NewSMTPHandler(conn, func(st *SMTPState) error {
+		headers, tags = st.Headers, st.Tags
+		return nil
+	})
+	h.Config.ServerName = "localhost"
+	h.Config.VerifyDKIM = true
+	h.Config.Resolver = &testResolver{}
+	policy, _ := ParsePolicy(strings.NewReader("data dkim permerror tag dkim-error\n"))
+	h.Config.Policy = policy
+	h.Run()
+	expected := []string{
+		"Authentication-Results: localhost;",
+		"\tdkim=permerror reason=\"no key for signature\" header.d=example.net header.s=ed",
+	}
+	if len(headers) < 3 || strings.Join(headers[:2], "\n") != strings.Join(expected, "\n") ||
+		!strings.HasPrefix(headers[2], "DKIM-Signature:") {
+		t.Errorf("unexpected headers: %v", headers)
+	}
+	if len(tags) != 1 || tags[0] != "dkim-error" {
+		t.Errorf("unexpected tags: %v", tags)
+	}
+}
@@ -0,0 +1,352 @@
+package smtp
+
+import (
+	"context"
+	"encoding/xml"
+	"math/rand"
+	"net/mail"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DMARCResult is the result of a DMARC evaluation (RFC 7489) for the domain
+// of the From header. Disposition is the policy to apply: none, quarantine
+// or reject.
+type DMARCResult struct {
+	Result      string
+	Domain      string
+	Policy      string
+	Disposition string
+	DKIM        string
+	SPF         string
+}
+
+func (res DMARCResult) String() string {
+	s := "dmarc=" + res.Result
+	if len(res.Policy) > 0 {
+		s += " (p=" + res.Policy + " dis=" + res.Disposition + ")"
+	}
+	if len(res.Domain) > 0 {
+		s += " header.from=" + res.Domain
+	}
+	return s
+}
+
+type dmarcRecord struct {
+	policy          string
+	subdomainPolicy string
+	strictDKIM      bool
+	strictSPF       bool
+	pct             int
+	rua             []string
+}
+
+// organizationalDomain approximates the organizational domain without the
+// public suffix list: the last two labels, or three if the second-level
+// label is short under a country code, as in "example.co.uk".
+func organizationalDomain(domain string) string {
+	labels := strings.Split(strings.ToLower(strings.TrimSuffix(domain, ".")), ".")
+	n := 2
+	if len(labels) >= 3 && len(labels[len(labels)-1]) == 2 && len(labels[len(labels)-2]) <= 3 {
+		n = 3
+	}
+	if len(labels) <= n {
+		return strings.Join(labels, ".")
+	}
+	return strings.Join(labels[len(labels)-n:], ".")
+}
+
+func parseDMARCRecord(s string) (dmarcRecord, bool) {
+	rec := dmarcRecord{pct: 100}
+	tags, err := parseDKIMTags(s)
+	if err != nil || tags["v"] != "DMARC1" {
+		return rec, false
+	}
+	rec.policy = strings.ToLower(tags["p"])
+	switch rec.policy {
+	case "none", "quarantine", "reject":
+	default:
+		// an invalid policy is treated as none if rua is given
+		if _, ok := tags["rua"]; !ok {
+			return rec, false
+		}
+		rec.policy = "none"
+	}
+	rec.subdomainPolicy = rec.policy
+	switch sp := strings.ToLower(tags["sp"]); sp {
+	case "none", "quarantine", "reject":
+		rec.subdomainPolicy = sp
+	}
+	rec.strictDKIM = strings.ToLower(tags["adkim"]) == "s"
+	rec.strictSPF = strings.ToLower(tags["aspf"]) == "s"
+	if x, err := strconv.Atoi(tags["pct"]); err == nil && x >= 0 && x <= 100 {
+		rec.pct = x
+	}
+	for _, x := range strings.Split(tags["rua"], ",") {
+		if x = strings.TrimSpace(x); len(x) > 0 {
+			rec.rua = append(rec.rua, x)
+		}
+	}
+	return rec, true
+}
+
+// lookupDMARC returns the record of the domain, or of its organizational
+// domain, and whether it is the latter.
+func lookupDMARC(ctx context.Context, r Resolver, domain string) (dmarcRecord, bool, string) {
+	org := organizationalDomain(domain)
+	for _, x := range []string{domain, org} {
+		txts, err := r.LookupTXT(ctx, "_dmarc."+x)
+		if err != nil && !isNotFound(err) {
+			return dmarcRecord{}, false, "temperror"
+		}
+		found := make([]dmarcRecord, 0)
+		for _, txt := range txts {
+			if rec, ok := parseDMARCRecord(txt); ok {
+				found = append(found, rec)
+			}
+		}
+		if len(found) == 1 {
+			return found[0], x != domain, ""
+		}
+		if len(found) > 1 {
+			return dmarcRecord{}, false, "permerror"
+		}
+		if x == org {
+			break
+		}
+	}
+	return dmarcRecord{}, false, "none"
+}
+
+func dmarcAligned(domain, from string, strict bool) bool {
+	domain, from = strings.ToLower(domain), strings.ToLower(from)
+	if strict {
+		return domain == from
+	}
+	return organizationalDomain(domain) == organizationalDomain(from)
+}
+
+// fromDomain returns the domain of the single author in the From header.
+func fromDomain(headers []string) (string, bool) {
+	if len(headerValues(headers, "From")) != 1 {
+		return "", false
+	}
+	v, _ := headerValue(headers, "From")
+	addrs, err := mail.ParseAddressList(v)
+	if err != nil || len(addrs) != 1 {
+		return "", false
+	}
+	at := strings.LastIndex(addrs[0].Address, "@")
+	if at < 0 {
+		return "", false
+	}
+	return strings.ToLower(addrs[0].Address[at+1:]), true
+}
+
+// EvaluateDMARC combines the SPF and DKIM results on the state with the
+// DMARC record of the From domain.
+func EvaluateDMARC(ctx context.Context, r Resolver, st *SMTPState) DMARCResult {
+	res := DMARCResult{Result: "permerror", DKIM: "none", SPF: "none"}
+	domain, ok := fromDomain(st.Headers)
+	if !ok {
+		return res
+	}
+	res.Domain = domain
+	rec, inherited, errResult := lookupDMARC(ctx, r, domain)
+	if len(errResult) > 0 {
+		res.Result = errResult
+		return res
+	}
+	res.Policy = rec.policy
+	if inherited && domain != organizationalDomain(domain) {
+		res.Policy = rec.subdomainPolicy
+	}
+	for _, x := range st.DKIMResults {
+		if x.Result == "pass" {
+			if dmarcAligned(x.Domain, domain, rec.strictDKIM) {
+				res.DKIM = "pass"
+				break
+			}
+		}
+		res.DKIM = "fail"
+	}
+	if len(st.SPF.Result) > 0 && st.SPF.Result != "none" {
+		res.SPF = "fail"
+		if st.SPF.Result == "pass" && dmarcAligned(st.SPF.Domain, domain, rec.strictSPF) {
+			res.SPF = "pass"
+		}
+	}
+	res.Disposition = "none"
+	if res.DKIM == "pass" || res.SPF == "pass" {
+		res.Result = "pass"
+		return res
+	}
+	res.Result = "fail"
+	if rec.pct == 100 || rand.Intn(100) < rec.pct {
+		res.Disposition = res.Policy
+	} else if res.Policy == "reject" {
+		res.Disposition = "quarantine"
+	}
+	return res
+}
+
+// applyDMARC evaluates DMARC and records the result on the state. It
+// returns the reply of a rejection or an empty string.
+func applyDMARC(conn *SMTPConnection) string {
+	config := conn.Config()
+	if !config.CheckDMARC {
+		return ""
+	}
+	st := conn.State()
+	st.DMARC = EvaluateDMARC(context.Background(), config.resolver(), st)
+	st.AuthResults = append(st.AuthResults, st.DMARC.String())
+	if config.DMARCReports != nil && len(st.DMARC.Policy) > 0 {
+		config.DMARCReports.Add(st.DMARC, conn.RemoteIP(), time.Now())
+	}
+	if !config.EnforceDMARC {
+		return ""
+	}
+	switch st.DMARC.Disposition {
+	case "reject":
+		conn.LogSecurityEvent(EventPolicyReject, "stage", "dmarc", "domain", st.DMARC.Domain)
+		return conn.Config().Catalog.Reply("message.dmarc_rejected", st.DMARC.Domain)
+	case "quarantine":
+		st.Quarantined = true
+	}
+	return ""
+}
+
+// DMARCReports collects the results of evaluated messages as the data of
+// aggregate reports (RFC 7489 section 7.2), grouped by the From domain.
+type DMARCReports struct {
+	OrgName string
+	Email   string
+
+	mtx     sync.Mutex
+	domains map[string]*dmarcDomainReport
+}
+
+type dmarcDomainReport struct {
+	policy string
+	begin  time.Time
+	end    time.Time
+	rows   map[dmarcRowKey]int
+}
+
+type dmarcRowKey struct {
+	ip          string
+	disposition string
+	dkim        string
+	spf         string
+}
+
+func NewDMARCReports(orgName, email string) *DMARCReports {
+	return &DMARCReports{
+		OrgName: orgName,
+		Email:   email,
+		domains: make(map[string]*dmarcDomainReport),
+	}
+}
+
+func (reports *DMARCReports) Add(res DMARCResult, ip string, now time.Time) {
+	defer reports.mtx.Unlock()
+	reports.mtx.Lock()
+	d, ok := reports.domains[res.Domain]
+	if !ok {
+		d = &dmarcDomainReport{begin: now, rows: make(map[dmarcRowKey]int)}
+		reports.domains[res.Domain] = d
+	}
+	d.policy, d.end = res.Policy, now
+	d.rows[dmarcRowKey{ip, res.Disposition, res.DKIM, res.SPF}]++
+}
+
+// Domains returns the domains with pending report data.
+func (reports *DMARCReports) Domains() []string {
+	defer reports.mtx.Unlock()
+	reports.mtx.Lock()
+	xs := make([]string, 0, len(reports.domains))
+	for x := range reports.domains {
+		xs = append(xs, x)
+	}
+	sort.Strings(xs)
+	return xs
+}
+
+type dmarcFeedback struct {
+	XMLName  xml.Name `xml:"feedback"`
+	Metadata struct {
+		OrgName   string `xml:"org_name"`
+		Email     string `xml:"email"`
+		ReportID  string `xml:"report_id"`
+		DateRange struct {
+			Begin int64 `xml:"begin"`
+			End   int64 `xml:"end"`
+		} `xml:"date_range"`
+	} `xml:"report_metadata"`
+	Policy struct {
+		Domain string `xml:"domain"`
+		P      string `xml:"p"`
+	} `xml:"policy_published"`
+	Records []dmarcFeedbackRecord `xml:"record"`
+}
+
+type dmarcFeedbackRecord struct {
+	Row struct {
+		SourceIP        string `xml:"source_ip"`
+		Count           int    `xml:"count"`
+		PolicyEvaluated struct {
+			Disposition string `xml:"disposition"`
+			DKIM        string `xml:"dkim"`
+			SPF         string `xml:"spf"`
+		} `xml:"policy_evaluated"`
+	} `xml:"row"`
+	Identifiers struct {
+		HeaderFrom string `xml:"header_from"`
+	} `xml:"identifiers"`
+}
+
+// Feedback returns the aggregate report of the domain in XML and clears
+// its data.
+func (reports *DMARCReports) Feedback(domain string) ([]byte, bool) {
+	reports.mtx.Lock()
+	d, ok := reports.domains[domain]
+	delete(reports.domains, domain)
+	reports.mtx.Unlock()
+	if !ok {
+		return nil, false
+	}
+	var fb dmarcFeedback
+	fb.Metadata.OrgName = reports.OrgName
+	fb.Metadata.Email = reports.Email
+	fb.Metadata.ReportID = domain + "." + strconv.FormatInt(d.begin.Unix(), 10)
+	fb.Metadata.DateRange.Begin = d.begin.Unix()
+	fb.Metadata.DateRange.End = d.end.Unix()
+	fb.Policy.Domain = domain
+	fb.Policy.P = d.policy
+	keys := make([]dmarcRowKey, 0, len(d.rows))
+	for k := range d.rows {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].ip+keys[i].disposition+keys[i].dkim+keys[i].spf <
+			keys[j].ip+keys[j].disposition+keys[j].dkim+keys[j].spf
+	})
+	for _, k := range keys {
+		var rec dmarcFeedbackRecord
+		rec.Row.SourceIP = k.ip
+		rec.Row.Count = d.rows[k]
+		rec.Row.PolicyEvaluated.Disposition = k.disposition
+		rec.Row.PolicyEvaluated.DKIM = k.dkim
+		rec.Row.PolicyEvaluated.SPF = k.spf
+		rec.Identifiers.HeaderFrom = domain
+		fb.Records = append(fb.Records, rec)
+	}
+	b, err := xml.MarshalIndent(fb, "", "  ")
+	if err != nil {
+		return nil, false
+	}
+	return append([]byte(xml.Header), b...), true
+}
@@ -0,0 +1,129 @@
+package smtp
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOrganizationalDomain(t *testing.T) {
+	for x, expected := range map[string]string{
+		"example.net":        "example.net",
+		"mail.example.net":   "example.net",
+		"a.b.example.co.uk":  "example.co.uk",
+		"example.co.uk":      "example.co.uk",
+		"Mail.Example.NET.":  "example.net",
+		"sub.example.travel": "example.travel",
+		"localhost":          "localhost",
+	} {
+		if actual := organizationalDomain(x); actual != expected {
+			t.Errorf("%s expected: %s, actual: %s", x, expected, actual)
+		}
+	}
+}
+
+func TestEvaluateDMARC(t *testing.T) {
+	r := &testResolver{txt: map[string][]string{
+		"_dmarc.example.net": {"v=DMARC1; p=reject; sp=quarantine; adkim=s; rua=mailto:dmarc@example.net"},
+		"_dmarc.example.org": {"v=DMARC1; p=none"},
+	}}
+	for _, x := range []struct {
+		from     string
+		dkim     []DKIMResult
+		spf      SPFResult
+		expected string
+	}{
+		{"foo@example.net", []DKIMResult{{Result: "pass", Domain: "example.net"}}, SPFResult{},
+			"dmarc=pass (p=reject dis=none) header.from=example.net"},
+		{"foo@example.net", []DKIMResult{{Result: "pass", Domain: "mail.example.net"}}, SPFResult{},
+			"dmarc=fail (p=reject dis=reject) header.from=example.net"},
+		{"foo@example.net", nil, SPFResult{Result: "pass", Domain: "bounce.example.net"},
+			"dmarc=pass (p=reject dis=none) header.from=example.net"},
+		{"foo@example.net", nil, SPFResult{Result: "pass", Domain: "example.org"},
+			"dmarc=fail (p=reject dis=reject) header.from=example.net"},
+		{"foo@mail.example.net", nil, SPFResult{Result: "fail", Domain: "example.net"},
+			"dmarc=fail (p=quarantine dis=quarantine) header.from=mail.example.net"},
+		{"\"Foo\" <foo@example.org>", nil, SPFResult{}, "dmarc=fail (p=none dis=none) header.from=example.org"},
+		{"foo@example.com", nil, SPFResult{}, "dmarc=none header.from=example.com"},
+	} {
+		st := &SMTPState{}
+		st.Reset()
+		st.Headers = []string{"From: " + x.from}
+		st.DKIMResults = x.dkim
+		st.SPF = x.spf
+		if actual := EvaluateDMARC(context.Background(), r, st).String(); actual != x.expected {
+			t.Errorf("expected: %s, actual: %s", x.expected, actual)
+		}
+	}
+	st := &SMTPState{}
+	st.Reset()
+	st.Headers = []string{"From: foo@example.net", "From: bar@example.org"}
+	if res := EvaluateDMARC(context.Background(), r, st); res.Result != "permerror" {
+		t.Errorf("expected: permerror, actual: %s", res.Result)
+	}
+}
+
+func TestDMARCReports(t *testing.T) {
+	reports := NewDMARCReports("example.com", "dmarc@example.com")
+	now := time.Unix(1500000000, 0)
+	res := DMARCResult{Result: "fail", Domain: "example.net", Policy: "reject",
+		Disposition: "reject", DKIM: "fail", SPF: "none"}
+	reports.Add(res, "192.0.2.1", now)
+	reports.Add(res, "192.0.2.1", now.Add(time.Hour))
+	if xs := reports.Domains(); len(xs) != 1 || xs[0] != "example.net" {
+		t.Errorf("unexpected domains: %v", xs)
+	}
+	b, ok := reports.Feedback("example.net")
+	if !ok {
+		t.Fatal("expected a report")
+	}
+	for _, x := range []string{
+		"<org_name>example.com</org_name>",
+		"<begin>1500000000</begin>",
+		"<end>1500003600</end>",
+		"<source_ip>192.0.2.1</source_ip>",
+		"<count>2</count>",
+		"<disposition>reject</disposition>",
+		"<header_from>example.net</header_from>",
+	} {
+		if !strings.Contains(string(b), x) {
+			t.Errorf("expected %s in %s", x, b)
+		}
+	}
+	if _, ok := reports.Feedback("example.net"); ok {
+		t.Errorf("expected the data to be cleared")
+	}
+}
+
+func TestEnforceDMARC(t *testing.T) {
+	r := &testResolver{txt: map[string][]string{
+		"example.net":        {"v=spf1 -all"},
+		"_dmarc.example.net": {"v=DMARC1; p=reject"},
+	}}
+	conn := &tcpMockConn{NewMockConn([]byte("EHLO localhost\r\n" +
+		"MAIL FROM: <foo@example.net>\r\n" +
+		"RCPT TO: <user1@example.org>\r\n" +
+		"DATA\r\n" +
+		"From: foo@example.net\r\n" +
+		"\r\n" +
+		"Hello\r\n" +
+		".\r\n" +
+		"QUIT\r\n")), "192.0.2.1:25"}
+	h := NewSMTPHandler(conn, func(st *SMTPState) error {
+		t.Errorf("unexpected message: %s", st)
+		return nil
+	})
+	h.Config.CheckDMARC = true
+	h.Config.EnforceDMARC = true
+	h.Config.DMARCReports = NewDMARCReports("example.org", "dmarc@example.org")
+	h.Config.Resolver = r
+	h.Run()
+	expected := "220 250 250 250 354 550 221"
+	if actual := replyCodes(conn.CloneOutputBuffer()); actual != expected {
+		t.Errorf("expected: %s, actual: %s", expected, actual)
+	}
+	if xs := h.Config.DMARCReports.Domains(); len(xs) != 1 {
+		t.Errorf("unexpected domains: %v", xs)
+	}
+}
@@ -0,0 +1,121 @@
+package smtp
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var errDraining = errors.New("smtp: draining")
+
+// Drain refuses new sessions and transactions with 421 while it is on,
+// e.g. before a planned restart, and lets those in progress finish.
+// Starting it flushes Queue. The methods do nothing on nil.
+type Drain struct {
+	Queue    *Queue
+	Sessions *Sessions
+
+	mtx   sync.Mutex
+	since time.Time
+}
+
+type DrainStatus struct {
+	Draining   bool      `json:"draining"`
+	Since      time.Time `json:"since,omitempty"`
+	Sessions   int       `json:"sessions"`
+	QueueDepth int       `json:"queue_depth"`
+}
+
+func NewDrain() *Drain {
+	return &Drain{}
+}
+
+// Start turns on the drain mode and flushes the queue.
+func (d *Drain) Start() error {
+	if d == nil {
+		return nil
+	}
+	d.mtx.Lock()
+	if d.since.IsZero() {
+		d.since = time.Now()
+	}
+	d.mtx.Unlock()
+	if d.Queue == nil {
+		return nil
+	}
+	_, err := d.Queue.Flush("")
+	return err
+}
+
+// Stop turns off the drain mode.
+func (d *Drain) Stop() {
+	if d == nil {
+		return
+	}
+	defer d.mtx.Unlock()
+	d.mtx.Lock()
+	d.since = time.Time{}
+}
+
+func (d *Drain) Draining() bool {
+	if d == nil {
+		return false
+	}
+	defer d.mtx.Unlock()
+	d.mtx.Lock()
+	return !d.since.IsZero()
+}
+
+// Status returns the mode with the sessions and messages left.
+func (d *Drain) Status() DrainStatus {
+	if d == nil {
+		return DrainStatus{}
+	}
+	d.mtx.Lock()
+	status := DrainStatus{Draining: !d.since.IsZero(), Since: d.since}
+	d.mtx.Unlock()
+	status.Sessions = len(d.Sessions.List())
+	if d.Queue != nil {
+		if xs, err := d.Queue.List(); err == nil {
+			status.QueueDepth = len(xs)
+		}
+	}
+	return status
+}
+
+// Wait waits until no sessions are left, or timeout, reporting whether
+// they are finished.
+func (d *Drain) Wait(timeout time.Duration) bool {
+	if d == nil {
+		return true
+	}
+	deadline := time.Now().Add(timeout)
+	for len(d.Sessions.List()) > 0 {
+		if !time.Now().Before(deadline) {
+			return false
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return true
+}
+
+// ServeHTTP replies the status on GET, starts the drain mode on POST and
+// stops it on DELETE, replying the status.
+func (d *Drain) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+	case "POST":
+		if err := d.Start(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	case "DELETE":
+		d.Stop()
+	default:
+		w.Header().Set("Allow", "GET, POST, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, d.Status())
+}
@@ -0,0 +1,70 @@
+package smtp
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestDrain(t *testing.T) {
+	drain := NewDrain()
+	conn := NewMockConn([]byte("EHLO localhost\r\n" +
+		"MAIL FROM: <foo@example.net>\r\n" +
+		"RCPT TO: <user1@example.com>\r\n" +
+		"DATA\r\n" +
+		"Hello\r\n" +
+		".\r\n" +
+		"MAIL FROM: <bar@example.net>\r\n" +
+		"QUIT\r\n"))
+	var accepted int
+	h := NewSMTPHandler(conn, func(st *SMTPState) error {
+		accepted++
+		drain.Start()
+		return nil
+	})
+	h.Config.Drain = drain
+	h.Run()
+	expected := "220 250 250 250 354 250 421"
+	if actual := replyCodes(conn.CloneOutputBuffer()); actual != expected {
+		t.Errorf("expected: %s, actual: %s", expected, actual)
+	}
+	if accepted != 1 {
+		t.Errorf("expected the transaction in progress to finish: %d", accepted)
+	}
+
+	conn = NewMockConn([]byte("EHLO localhost\r\nQUIT\r\n"))
+	h = NewSMTPHandler(conn, nil)
+	h.Config.Drain = drain
+	h.Run()
+	if actual := replyCodes(conn.CloneOutputBuffer()); actual != "421" {
+		t.Errorf("expected: 421, actual: %s", actual)
+	}
+
+	health := NewHealth()
+	health.Drain = drain
+	if report := health.Check(); report.Status != "fail" || !report.Draining {
+		t.Errorf("unexpected report while draining: %v", report)
+	}
+
+	for _, x := range []struct {
+		method   string
+		draining bool
+	}{
+		{"GET", true},
+		{"DELETE", false},
+		{"POST", true},
+	} {
+		w := httptest.NewRecorder()
+		drain.ServeHTTP(w, httptest.NewRequest(x.method, "/drain", nil))
+		var status DrainStatus
+		json.NewDecoder(w.Body).Decode(&status)
+		if w.Code != http.StatusOK || status.Draining != x.draining {
+			t.Errorf("%s: unexpected status: %d %v", x.method, w.Code, status)
+		}
+	}
+	drain.Stop()
+	if report := health.Check(); report.Status != "ok" {
+		t.Errorf("unexpected report after draining: %v", report)
+	}
+}
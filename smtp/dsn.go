@@ -0,0 +1,207 @@
+package smtp
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// dsnStatus returns the status code (RFC 3463) and the diagnostic code of
+// the error for the action, "failed", "delayed" or "relayed".
+func dsnStatus(action string, err error) (string, string) {
+	if action == "relayed" {
+		return "2.0.0", ""
+	}
+	status := "5.4.7"
+	if action == "delayed" {
+		status = "4.4.7"
+	}
+	var tpErr *textproto.Error
+	switch {
+	case errors.As(err, &tpErr):
+		diagnostic := fmt.Sprintf("%d %s", tpErr.Code, tpErr.Msg)
+		if m := enhancedStatusCodePattern.FindString(tpErr.Msg); len(m) > 0 {
+			return strings.TrimSpace(m), diagnostic
+		}
+		return fmt.Sprintf("%d.0.0", tpErr.Code/100), diagnostic
+	case errors.Is(err, ErrRequireTLS):
+		status = "5.7.10"
+	case errors.Is(err, ErrSMTPUTF8):
+		status = "5.6.7"
+	}
+	return status, ""
+}
+
+// deliveryStatus returns a delivery status notification (RFC 3464) of the
+// queued message to its sender, with the original message or its header
+// as RET asks.
+func (q *Queue) deliveryStatus(msg QueuedMessage, action string, cause error, now time.Time) (*SMTPState, error) {
+	f, err := q.Open(msg.ID)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	original, err := io.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	serverName := q.ServerName
+	if len(serverName) == 0 {
+		serverName = "localhost"
+	}
+	b := make([]byte, 12)
+	rand.Read(b)
+	boundary := hex.EncodeToString(b)
+	subject := "Delivery Status Notification (Failure)"
+	text := "Your message could not be delivered to the following recipients."
+	switch action {
+	case "delayed":
+		subject = "Delivery Status Notification (Delay)"
+		text = "Your message has not been delivered to the following recipients yet.\r\n" +
+			"Delivery will still be attempted."
+	case "relayed":
+		subject = "Delivery Status Notification (Relay)"
+		text = "Your message has been relayed to the following recipients.\r\n" +
+			"No further notifications may be sent."
+	}
+	// the errors of partial deliveries are reported per recipient
+	var errs RecipientErrors
+	if errors.As(cause, &errs) {
+		reported := make(RecipientErrors)
+		for _, x := range msg.Recipients {
+			if err, ok := errs[x]; ok {
+				reported[x] = err
+			}
+		}
+		cause, errs = reported, reported
+	}
+
+	var body bytes.Buffer
+	fmt.Fprintf(&body, "--%s\r\n", boundary)
+	body.WriteString("Content-Type: text/plain; charset=us-ascii\r\n\r\n")
+	body.WriteString(text + "\r\n\r\n")
+	for _, x := range msg.Recipients {
+		body.WriteString("  " + x + "\r\n")
+	}
+	if cause != nil {
+		fmt.Fprintf(&body, "\r\nReason: %s\r\n", cause)
+	}
+	body.WriteString("\r\n")
+	fmt.Fprintf(&body, "--%s\r\n", boundary)
+	body.WriteString("Content-Type: message/delivery-status\r\n\r\n")
+	fmt.Fprintf(&body, "Reporting-MTA: dns; %s\r\n", serverName)
+	if len(msg.EnvID) > 0 {
+		fmt.Fprintf(&body, "Original-Envelope-Id: %s\r\n", msg.EnvID)
+	}
+	fmt.Fprintf(&body, "Arrival-Date: %s\r\n", msg.Queued.Format(time.RFC1123Z))
+	for i, x := range msg.Recipients {
+		body.WriteString("\r\n")
+		if addrType, addr, ok := strings.Cut(msg.recipientDSN(i).ORcpt, ";"); ok {
+			if v, ok := decodeXText(addr); ok {
+				fmt.Fprintf(&body, "Original-Recipient: %s; %s\r\n", addrType, v)
+			}
+		}
+		fmt.Fprintf(&body, "Final-Recipient: rfc822; %s\r\n", x)
+		err, ok := errs[x]
+		if !ok {
+			err = cause
+		}
+		status, diagnostic := dsnStatus(action, err)
+		fmt.Fprintf(&body, "Action: %s\r\n", action)
+		fmt.Fprintf(&body, "Status: %s\r\n", status)
+		if len(diagnostic) > 0 {
+			fmt.Fprintf(&body, "Diagnostic-Code: smtp; %s\r\n", diagnostic)
+		}
+		fmt.Fprintf(&body, "Last-Attempt-Date: %s\r\n", now.Format(time.RFC1123Z))
+		if action == "delayed" {
+			fmt.Fprintf(&body, "Will-Retry-Until: %s\r\n", msg.Queued.Add(q.Expire).Format(time.RFC1123Z))
+		}
+	}
+	fmt.Fprintf(&body, "\r\n--%s\r\n", boundary)
+	if msg.Ret == "HDRS" {
+		header, _ := splitMessage(original)
+		body.WriteString("Content-Type: text/rfc822-headers\r\n\r\n")
+		body.Write(header)
+	} else {
+		body.WriteString("Content-Type: message/rfc822\r\n\r\n")
+		body.Write(original)
+	}
+	fmt.Fprintf(&body, "\r\n--%s--\r\n", boundary)
+
+	st := &SMTPState{}
+	st.Reset()
+	st.NullSender = true
+	st.Recipients = []string{msg.ReturnTo}
+	if addr, err := ParseAddress(msg.ReturnTo); err == nil {
+		st.RecipientAddresses = []Address{addr}
+	}
+	st.MessageID = newMessageID(serverName)
+	st.Headers = []string{
+		"From: Mail Delivery System <MAILER-DAEMON@" + serverName + ">",
+		"To: <" + msg.ReturnTo + ">",
+		"Subject: " + subject,
+		"Date: " + now.Format(time.RFC1123Z),
+		"Message-ID: " + st.MessageID,
+		"Auto-Submitted: auto-replied",
+		"MIME-Version: 1.0",
+		"Content-Type: multipart/report; report-type=delivery-status; boundary=\"" + boundary + "\"",
+	}
+	st.SetContent(body.Bytes())
+	return st, nil
+}
+
+// notifies reports whether the recipient asks for the notification of the
+// action, by default of "failed" and "delayed" only.
+func (dsn RecipientDSN) notifies(action string) bool {
+	if len(dsn.Notify) == 0 {
+		return action != "relayed"
+	}
+	keyword := map[string]string{"failed": "FAILURE", "delayed": "DELAY", "relayed": "SUCCESS"}[action]
+	for _, x := range dsn.Notify {
+		if x == keyword {
+			return true
+		}
+	}
+	return false
+}
+
+// recipientDSN returns the DSN parameters given to the i-th recipient.
+func (msg QueuedMessage) recipientDSN(i int) RecipientDSN {
+	if i < len(msg.RecipientDSNs) {
+		return msg.RecipientDSNs[i]
+	}
+	return RecipientDSN{}
+}
+
+// notify queues the notification of the message to the recipients asking
+// for it with NOTIFY, if Notify is set. The senders of notifications are
+// never notified.
+func (q *Queue) notify(msg QueuedMessage, action string, cause error) error {
+	if !q.Notify || len(msg.ReturnTo) == 0 {
+		return nil
+	}
+	var recipients []string
+	var dsns []RecipientDSN
+	for i, x := range msg.Recipients {
+		if dsn := msg.recipientDSN(i); dsn.notifies(action) {
+			recipients = append(recipients, x)
+			dsns = append(dsns, dsn)
+		}
+	}
+	if len(recipients) == 0 {
+		return nil
+	}
+	msg.Recipients, msg.RecipientDSNs = recipients, dsns
+	st, err := q.deliveryStatus(msg, action, cause, q.now())
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+	return q.Send(st)
+}
@@ -0,0 +1,136 @@
+package smtp
+
+import (
+	"errors"
+	"io"
+	"net/textproto"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDSNStatus(t *testing.T) {
+	for _, fixture := range []struct {
+		action     string
+		err        error
+		status     string
+		diagnostic string
+	}{
+		{"failed", &textproto.Error{Code: 550, Msg: "5.1.1 No such user"}, "5.1.1", "550 5.1.1 No such user"},
+		{"failed", &textproto.Error{Code: 554, Msg: "Rejected"}, "5.0.0", "554 Rejected"},
+		{"failed", errors.New("connection refused"), "5.4.7", ""},
+		{"delayed", ErrDeliverBy, "4.4.7", ""},
+		{"failed", ErrRequireTLS, "5.7.10", ""},
+		{"failed", ErrSMTPUTF8, "5.6.7", ""},
+	} {
+		status, diagnostic := dsnStatus(fixture.action, fixture.err)
+		if status != fixture.status || diagnostic != fixture.diagnostic {
+			t.Errorf("expected: %s %s, actual: %s %s", fixture.status, fixture.diagnostic, status, diagnostic)
+		}
+	}
+}
+
+func TestDeliveryStatus(t *testing.T) {
+	q, err := NewQueue(t.TempDir(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.ServerName = "mx.example.com"
+	st := &SMTPState{}
+	st.Reset()
+	st.ReturnTo = "foo@example.net"
+	st.Recipients = []string{"user1@example.org"}
+	st.EnvID = "QQ314159"
+	st.Ret = "HDRS"
+	st.Headers = []string{"Subject: Hello"}
+	st.SetContent([]byte("Secret\r\n"))
+	id, err := q.Put(st, "example.org", st.Recipients)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, _ := q.Get(id)
+	dsn, err := q.deliveryStatus(msg, "failed", &textproto.Error{Code: 550, Msg: "5.1.1 No such user"}, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !dsn.NullSender || len(dsn.Recipients) != 1 || dsn.Recipients[0] != "foo@example.net" {
+		t.Errorf("unexpected envelope: %s", dsn)
+	}
+	if v, _ := headerValue(dsn.Headers, "From"); v != "Mail Delivery System <MAILER-DAEMON@mx.example.com>" {
+		t.Errorf("unexpected From: %s", v)
+	}
+	b, _ := io.ReadAll(dsn.Content())
+	body := string(b)
+	for _, x := range []string{
+		"Reporting-MTA: dns; mx.example.com\r\n",
+		"Original-Envelope-Id: QQ314159\r\n",
+		"Final-Recipient: rfc822; user1@example.org\r\n",
+		"Action: failed\r\nStatus: 5.1.1\r\nDiagnostic-Code: smtp; 550 5.1.1 No such user\r\n",
+		"Content-Type: text/rfc822-headers\r\n\r\nSubject: Hello\r\n",
+	} {
+		if !strings.Contains(body, x) {
+			t.Errorf("expected %q in %s", x, body)
+		}
+	}
+	if strings.Contains(body, "Secret") {
+		t.Errorf("unexpected content with RET=HDRS: %s", body)
+	}
+}
+
+func TestQueueNotifyRecipients(t *testing.T) {
+	q, err := NewQueue(t.TempDir(), func(st *SMTPState) error {
+		switch {
+		case len(st.ReturnTo) == 0:
+			return errors.New("hold notifications")
+		case st.Recipients[0] == "user3@example.com":
+			return nil
+		}
+		return &textproto.Error{Code: 550, Msg: "5.1.1 No such user"}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.Notify = true
+	st := &SMTPState{}
+	st.Reset()
+	st.ReturnTo = "foo@example.net"
+	st.Recipients = []string{"user1@example.org", "user2@example.org", "user3@example.com"}
+	st.RecipientDSNs = []RecipientDSN{
+		{Notify: []string{"NEVER"}},
+		{Notify: []string{"FAILURE"}, ORcpt: "rfc822;bar+2Bbaz@example.org"},
+		{Notify: []string{"SUCCESS"}},
+	}
+	st.SetContent([]byte("Hello\r\n"))
+	if err := q.Send(st); err != nil {
+		t.Fatal(err)
+	}
+	q.Process()
+	reports := make([]string, 0)
+	xs, _ := q.List()
+	for _, x := range xs {
+		if len(x.ReturnTo) > 0 {
+			t.Errorf("unexpected message left: %v", x)
+			continue
+		}
+		f, _ := q.Open(x.ID)
+		b, _ := io.ReadAll(f)
+		f.Close()
+		_, report, _ := strings.Cut(string(b), "Content-Type: message/delivery-status\r\n")
+		report, _, _ = strings.Cut(report, "\r\n--")
+		reports = append(reports, report)
+	}
+	sort.Strings(reports)
+	for i, x := range []string{
+		"Final-Recipient: rfc822; user3@example.com\r\nAction: relayed\r\nStatus: 2.0.0\r\n",
+		"Original-Recipient: rfc822; bar+baz@example.org\r\n" +
+			"Final-Recipient: rfc822; user2@example.org\r\nAction: failed\r\n",
+	} {
+		if i >= len(reports) || !strings.Contains(reports[i], x) {
+			t.Errorf("expected %q in %v", x, reports)
+		}
+	}
+	if len(reports) != 2 || strings.Contains(reports[0]+reports[1], "user1@example.org") {
+		t.Errorf("unexpected reports: %v", reports)
+	}
+}
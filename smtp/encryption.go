@@ -0,0 +1,235 @@
+package smtp
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// encryptedMagic begins an encrypted message, followed by the nonce
+// prefix and the chunks.
+const encryptedMagic = "MPXE\x01"
+
+const (
+	encryptedChunkSize   = 64 << 10
+	encryptedNoncePrefix = 7
+)
+
+var ErrEncryptedMessage = errors.New("smtp: message encrypted without a key")
+
+// MessageCipher encrypts stored messages with AES-GCM in chunks of 64KB,
+// so they need not be held in memory. The nonce of each chunk is a random
+// prefix of the message, the index of the chunk and a flag of the last
+// one, so chunks cannot be reordered or truncated unnoticed.
+type MessageCipher struct {
+	aead cipher.AEAD
+}
+
+// NewMessageCipher returns a cipher of a key of 16, 24 or 32 bytes for
+// AES-128, AES-192 or AES-256.
+func NewMessageCipher(key []byte) (*MessageCipher, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &MessageCipher{aead: aead}, nil
+}
+
+// LoadMessageKey reads a key in hex or base64 from "file:PATH" or
+// "env:NAME".
+func LoadMessageKey(source string) ([]byte, error) {
+	var s string
+	switch {
+	case strings.HasPrefix(source, "file:"):
+		b, err := os.ReadFile(strings.TrimPrefix(source, "file:"))
+		if err != nil {
+			return nil, err
+		}
+		s = string(b)
+	case strings.HasPrefix(source, "env:"):
+		name := strings.TrimPrefix(source, "env:")
+		v, ok := os.LookupEnv(name)
+		if !ok {
+			return nil, fmt.Errorf("smtp: missing key in $%s", name)
+		}
+		s = v
+	default:
+		return nil, fmt.Errorf("smtp: unsupported key source: %s", source)
+	}
+	s = strings.TrimSpace(s)
+	if key, err := hex.DecodeString(s); err == nil {
+		return key, nil
+	}
+	return base64.StdEncoding.DecodeString(s)
+}
+
+func (c *MessageCipher) nonce(prefix []byte, i uint32, last bool) []byte {
+	nonce := make([]byte, c.aead.NonceSize())
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[encryptedNoncePrefix:], i)
+	if last {
+		nonce[len(nonce)-1] = 1
+	}
+	return nonce
+}
+
+type encryptWriter struct {
+	c      *MessageCipher
+	w      io.WriteCloser
+	prefix []byte
+	i      uint32
+	buf    []byte
+}
+
+// NewWriter returns a writer encrypting into w, which is closed by Close
+// after writing the last chunk.
+func (c *MessageCipher) NewWriter(w io.WriteCloser) (io.WriteCloser, error) {
+	prefix := make([]byte, encryptedNoncePrefix)
+	rand.Read(prefix)
+	if _, err := io.WriteString(w, encryptedMagic); err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(prefix); err != nil {
+		return nil, err
+	}
+	return &encryptWriter{c: c, w: w, prefix: prefix, buf: make([]byte, 0, encryptedChunkSize)}, nil
+}
+
+func (ew *encryptWriter) seal(last bool) error {
+	b := ew.c.aead.Seal(nil, ew.c.nonce(ew.prefix, ew.i, last), ew.buf, nil)
+	ew.i++
+	ew.buf = ew.buf[:0]
+	_, err := ew.w.Write(b)
+	return err
+}
+
+func (ew *encryptWriter) Write(b []byte) (int, error) {
+	n := 0
+	for len(b) > 0 {
+		if len(ew.buf) == encryptedChunkSize {
+			if err := ew.seal(false); err != nil {
+				return n, err
+			}
+		}
+		m := copy(ew.buf[len(ew.buf):cap(ew.buf)], b)
+		ew.buf = ew.buf[:len(ew.buf)+m]
+		b = b[m:]
+		n += m
+	}
+	return n, nil
+}
+
+// Close seals the last chunk, which is shorter than the others and may be
+// empty, so the reader tells it by its length.
+func (ew *encryptWriter) Close() error {
+	var err error
+	if len(ew.buf) == encryptedChunkSize {
+		err = ew.seal(false)
+	}
+	if err == nil {
+		err = ew.seal(true)
+	}
+	if cerr := ew.w.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+type decryptReader struct {
+	c      *MessageCipher
+	r      io.Reader
+	closer io.Closer
+	prefix []byte
+	i      uint32
+	chunk  []byte
+	buf    []byte
+	done   bool
+}
+
+func (dr *decryptReader) Read(b []byte) (int, error) {
+	for len(dr.buf) == 0 {
+		if dr.done {
+			return 0, io.EOF
+		}
+		n, err := io.ReadFull(dr.r, dr.chunk)
+		last := err == io.EOF || err == io.ErrUnexpectedEOF
+		if err != nil && !last {
+			return 0, err
+		}
+		plain, err := dr.c.aead.Open(dr.chunk[:0], dr.c.nonce(dr.prefix, dr.i, last), dr.chunk[:n], nil)
+		if err != nil {
+			return 0, fmt.Errorf("smtp: corrupted message: %w", err)
+		}
+		dr.i++
+		dr.buf = plain
+		dr.done = last
+	}
+	n := copy(b, dr.buf)
+	dr.buf = dr.buf[n:]
+	return n, nil
+}
+
+func (dr *decryptReader) Close() error {
+	return dr.closer.Close()
+}
+
+// createMessage creates the file of a message, encrypted if c is non-nil.
+func createMessage(c *MessageCipher, path string) (io.WriteCloser, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil || c == nil {
+		return f, err
+	}
+	w, err := c.NewWriter(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+// openMessage opens the file of a message, decrypting it if encrypted.
+// Messages stored before the encryption was enabled are read as they are.
+func openMessage(c *MessageCipher, path string) (io.ReadCloser, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	r := bufio.NewReader(f)
+	magic, _ := r.Peek(len(encryptedMagic))
+	if string(magic) != encryptedMagic {
+		return struct {
+			io.Reader
+			io.Closer
+		}{r, f}, nil
+	}
+	if c == nil {
+		f.Close()
+		return nil, ErrEncryptedMessage
+	}
+	r.Discard(len(encryptedMagic))
+	prefix := make([]byte, encryptedNoncePrefix)
+	if _, err := io.ReadFull(r, prefix); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("smtp: corrupted message: %w", err)
+	}
+	return &decryptReader{
+		c:      c,
+		r:      r,
+		closer: f,
+		prefix: prefix,
+		chunk:  make([]byte, encryptedChunkSize+c.aead.Overhead()),
+	}, nil
+}
@@ -0,0 +1,98 @@
+package smtp
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMessageCipher(t *testing.T) {
+	c, err := NewMessageCipher(bytes.Repeat([]byte{1}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	for _, size := range []int{0, 100, encryptedChunkSize, 2*encryptedChunkSize + 1} {
+		path := filepath.Join(dir, "message")
+		os.Remove(path)
+		plain := bytes.Repeat([]byte("x"), size)
+		w, err := createMessage(c, path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(plain)
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		b, _ := os.ReadFile(path)
+		if size > 0 && bytes.Contains(b, plain[:size/2+1]) {
+			t.Errorf("unexpected plaintext of %d bytes", size)
+		}
+		r, err := openMessage(c, path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		actual, err := io.ReadAll(r)
+		r.Close()
+		if err != nil || !bytes.Equal(actual, plain) {
+			t.Errorf("expected: %d bytes, actual: %d bytes, %v", size, len(actual), err)
+		}
+		if size == 2*encryptedChunkSize+1 {
+			// truncated at the end of a chunk
+			os.WriteFile(path, b[:len(encryptedMagic)+encryptedNoncePrefix+encryptedChunkSize+16], 0600)
+			r, _ := openMessage(c, path)
+			if _, err := io.ReadAll(r); err == nil {
+				t.Errorf("expected an error of the truncated message")
+			}
+			r.Close()
+		}
+	}
+	if _, err := openMessage(nil, filepath.Join(dir, "message")); !errors.Is(err, ErrEncryptedMessage) {
+		t.Errorf("expected: %v, actual: %v", ErrEncryptedMessage, err)
+	}
+}
+
+func TestEncryptedStore(t *testing.T) {
+	s, err := NewMessageStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := &SMTPState{ReturnTo: "foo@example.net", Recipients: []string{"user1@example.com"}}
+	st.SetContent([]byte("Hello\r\n"))
+	// stored before the encryption
+	plainID, _ := s.Put(st)
+
+	t.Setenv("MPROXY_TEST_KEY", strings.Repeat("ab", 16))
+	key, err := LoadMessageKey("env:MPROXY_TEST_KEY")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Cipher, err = NewMessageCipher(key); err != nil {
+		t.Fatal(err)
+	}
+	id, err := s.Put(st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := os.ReadFile(s.path(id, ".eml")); bytes.Contains(b, []byte("Hello")) {
+		t.Errorf("unexpected plaintext: %q", b)
+	}
+	for _, x := range []string{plainID, id} {
+		f, err := s.Open(x)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(f)
+		f.Close()
+		if !strings.HasSuffix(string(b), "\r\nHello\r\n") {
+			t.Errorf("unexpected message: %q", b)
+		}
+	}
+	if _, err := LoadMessageKey("kms:alias/mproxy"); err == nil {
+		t.Errorf("expected an error of the unsupported source")
+	}
+}
@@ -0,0 +1,58 @@
+package smtp
+
+// Envelope is a read-only snapshot of the envelope of a transaction with
+// the transport it was received over, for hooks which need not know the
+// rest of SMTPState. It is not a part of the state: the envelope is still
+// the fields of SMTPState, which are the ones to change.
+type Envelope struct {
+	// ReturnPath is the zero Address for the null sender.
+	ReturnPath Address
+	NullSender bool
+	Params     ESMTPParams
+	Recipients []EnvelopeRecipient
+
+	// Username is the user authenticated by AUTH, if any.
+	Username   string
+	ClientName string
+	Connection ConnectionInfo
+}
+
+type EnvelopeRecipient struct {
+	Address Address
+	Params  ESMTPParams
+	DSN     RecipientDSN
+}
+
+// EnvelopeSnapshot returns a copy of the envelope of the transaction as it
+// is now. Changes to the copy are not those of the state, and changes to
+// the state after are not those of the copy.
+func (st *SMTPState) EnvelopeSnapshot() Envelope {
+	e := Envelope{
+		ReturnPath: st.ReturnToAddress,
+		NullSender: st.NullSender,
+		Params:     st.MailParams,
+		Recipients: make([]EnvelopeRecipient, len(st.RecipientAddresses)),
+		Username:   st.Username,
+		ClientName: st.ClientName,
+		Connection: st.Connection(),
+	}
+	for i, x := range st.RecipientAddresses {
+		e.Recipients[i].Address = x
+		if i < len(st.RecipientParams) {
+			e.Recipients[i].Params = st.RecipientParams[i]
+		}
+		if i < len(st.RecipientDSNs) {
+			e.Recipients[i].DSN = st.RecipientDSNs[i]
+		}
+	}
+	return e
+}
+
+// Addresses returns the addresses of the recipients.
+func (e Envelope) Addresses() []Address {
+	xs := make([]Address, len(e.Recipients))
+	for i, x := range e.Recipients {
+		xs[i] = x.Address
+	}
+	return xs
+}
@@ -0,0 +1,83 @@
+package smtp
+
+import (
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestEnvelope(t *testing.T) {
+	conn := NewMockConn([]byte("EHLO client.example.net\r\n" +
+		"MAIL FROM: <foo@example.net> RET=HDRS\r\n" +
+		"RCPT TO: <user1@example.com> NOTIFY=SUCCESS\r\n" +
+		"RCPT TO: <user2@example.com>\r\n" +
+		"DATA\r\n" +
+		"Subject: Envelope\r\n" +
+		"\r\n" +
+		"Hello\r\n" +
+		".\r\n" +
+		"QUIT\r\n"))
+	var e Envelope
+	h := NewSMTPHandler(conn, func(st *SMTPState) error {
+		e = st.EnvelopeSnapshot()
+		return nil
+	})
+	h.Run()
+	if expected, actual := "foo@example.net", e.ReturnPath.String(); expected != actual {
+		t.Errorf("expected: %s, actual: %s", expected, actual)
+	}
+	if expected, actual := "HDRS", e.Params["RET"]; expected != actual {
+		t.Errorf("expected: %s, actual: %s", expected, actual)
+	}
+	if len(e.Recipients) != 2 || e.Recipients[1].Address.String() != "user2@example.com" {
+		t.Fatalf("unexpected recipients: %v", e.Recipients)
+	}
+	if expected, actual := "SUCCESS", strings.Join(e.Recipients[0].DSN.Notify, ","); expected != actual {
+		t.Errorf("expected: %s, actual: %s", expected, actual)
+	}
+	if expected, actual := "client.example.net", e.ClientName; expected != actual {
+		t.Errorf("expected: %s, actual: %s", expected, actual)
+	}
+	if len(e.Addresses()) != 2 || e.Connection.TLS || e.Connection.ConnectedAt.IsZero() {
+		t.Errorf("unexpected envelope: %v", e)
+	}
+}
+
+func TestMessage(t *testing.T) {
+	st := &SMTPState{}
+	st.Reset()
+	st.Headers = []string{"Received: from a", "\tby b", "Subject: Hello", "received: from c"}
+	st.SetContent([]byte("Body\r\n"))
+	m := st.Message()
+	h := m.Header()
+	if expected, actual := "from a\tby b", h.Get("RECEIVED"); expected != actual {
+		t.Errorf("expected: %q, actual: %q", expected, actual)
+	}
+	if xs := h.Values("Received"); len(xs) != 2 || xs[1] != "from c" {
+		t.Errorf("unexpected values: %v", xs)
+	}
+	if xs := h.Fields(); len(xs) != 3 || xs[1] != (HeaderField{"Subject", "Hello"}) {
+		t.Errorf("unexpected fields: %v", xs)
+	}
+
+	h.Del("Received")
+	h.Set("Subject", "Changed")
+	h.Add("X-Test", "1")
+	if expected, actual := "Subject: Changed X-Test: 1", strings.Join(st.Headers, " "); expected != actual {
+		t.Errorf("expected: %s, actual: %s", expected, actual)
+	}
+	if h.Has("Received") || !h.Has("x-test") {
+		t.Errorf("unexpected header: %v", *h)
+	}
+	body, _ := io.ReadAll(m.Body())
+	if expected, actual := "Body\r\n", string(body); expected != actual {
+		t.Errorf("expected: %q, actual: %q", expected, actual)
+	}
+	expected := "Subject: Changed\r\nX-Test: 1\r\n\r\nBody\r\n"
+	if actual := string(m.Bytes()); actual != expected {
+		t.Errorf("expected: %q, actual: %q", expected, actual)
+	}
+	if m.Size() != int64(len(expected)) {
+		t.Errorf("expected: %d, actual: %d", len(expected), m.Size())
+	}
+}
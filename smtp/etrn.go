@@ -0,0 +1,56 @@
+package smtp
+
+import "strings"
+
+// ETRNCommand flushes the queued mail for a domain (RFC 1985). The node
+// "@example.net" flushes example.net and its subdomains; queue names of
+// the form "#name" are not supported.
+type ETRNCommand struct {
+}
+
+func (cmnd *ETRNCommand) Execute(conn *SMTPConnection, line string) error {
+	queue := conn.Config().Queue
+	if queue == nil {
+		return conn.Reply("command.not_implemented")
+	}
+	st := conn.State()
+	if !st.HasStarted() {
+		return conn.Reply("session.not_started")
+	}
+	if st.InTransaction() {
+		return conn.Reply("transaction.in_progress")
+	}
+	cmd, err := ParseCommand(line)
+	node := strings.TrimSpace(cmd.Arg)
+	if err != nil || len(node) == 0 || strings.ContainsAny(node, " \t") {
+		return conn.Reply("etrn.syntax")
+	}
+	if strings.HasPrefix(node, "#") {
+		return conn.Reply("etrn.unavailable", node)
+	}
+	if !etrnAllowed(conn.Config().ETRNDomains, node) {
+		return conn.Reply("etrn.denied", node)
+	}
+	n, err := queue.Flush(node)
+	if err != nil {
+		return conn.Reply("etrn.unavailable", node)
+	}
+	if n == 0 {
+		return conn.Reply("etrn.no_messages", node)
+	}
+	return conn.Reply("etrn.ok", node)
+}
+
+// etrnAllowed reports whether the node is one of the domains, or any node
+// if there are none.
+func etrnAllowed(domains []string, node string) bool {
+	if len(domains) == 0 {
+		return true
+	}
+	for _, x := range domains {
+		if strings.EqualFold(x, strings.TrimPrefix(node, "@")) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,50 @@
+package smtp
+
+import (
+	"testing"
+)
+
+func TestETRN(t *testing.T) {
+	conn := NewMockConn([]byte("ETRN example.net\r\n" +
+		"EHLO localhost\r\n" +
+		"ETRN example.net\r\n" +
+		"QUIT\r\n"))
+	h := NewSMTPHandler(conn, nil)
+	h.Run()
+	if expected, actual := "220 502 250 502 221", replyCodes(conn.CloneOutputBuffer()); actual != expected {
+		t.Errorf("expected: %s, actual: %s", expected, actual)
+	}
+
+	q, err := NewQueue(t.TempDir(), func(st *SMTPState) error {
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := &SMTPState{}
+	st.Reset()
+	st.Recipients = []string{"user1@example.net", "user1@mail.example.org"}
+	st.SetContent([]byte("Hello\r\n"))
+	if err := q.Send(st); err != nil {
+		t.Fatal(err)
+	}
+	conn = NewMockConn([]byte("ETRN example.net\r\n" +
+		"EHLO localhost\r\n" +
+		"ETRN\r\n" +
+		"ETRN example.net\r\n" +
+		"ETRN example.com\r\n" +
+		"ETRN @example.org\r\n" +
+		"ETRN #queue\r\n" +
+		"ETRN example.info\r\n" +
+		"MAIL FROM:<foo@example.net>\r\n" +
+		"ETRN example.net\r\n" +
+		"QUIT\r\n"))
+	h = NewSMTPHandler(conn, nil)
+	h.Config.Queue = q
+	h.Config.ETRNDomains = []string{"example.net", "example.com", "example.org"}
+	h.Run()
+	expected := "220 503 250 501 250 251 250 458 459 250 503 221"
+	if actual := replyCodes(conn.CloneOutputBuffer()); actual != expected {
+		t.Errorf("expected: %s, actual: %s", expected, actual)
+	}
+}
@@ -0,0 +1,151 @@
+//go:build windows
+
+package smtp
+
+import (
+	"bytes"
+	"log/slog"
+	"syscall"
+	"unsafe"
+)
+
+var (
+	advapi32                  = syscall.NewLazyDLL("advapi32.dll")
+	procRegisterEventSource   = advapi32.NewProc("RegisterEventSourceW")
+	procDeregisterEventSource = advapi32.NewProc("DeregisterEventSource")
+	procReportEvent           = advapi32.NewProc("ReportEventW")
+	procRegCreateKeyEx        = advapi32.NewProc("RegCreateKeyExW")
+	procRegSetValueEx         = advapi32.NewProc("RegSetValueExW")
+	procRegDeleteKey          = advapi32.NewProc("RegDeleteKeyW")
+	eventLogKey               = `SYSTEM\CurrentControlSet\Services\EventLog\Application\`
+	eventLogMessageFile       = `%SystemRoot%\System32\EventCreate.exe`
+)
+
+const hkeyLocalMachine = 0x80000002
+
+// event types of ReportEvent
+const (
+	eventLogError       = 0x1
+	eventLogWarning     = 0x2
+	eventLogInformation = 0x4
+)
+
+// EventLog writes each write as an event of the Application event log,
+// which is where the logs of Windows services are expected.
+type EventLog struct {
+	handle uintptr
+
+	// Type is the type of every event, or 0 to take it from the level of
+	// the JSON logs of NewLogger.
+	Type uint16
+}
+
+// NewEventLog opens the event log of the source, which InstallEventSource
+// registers.
+func NewEventLog(source string) (*EventLog, error) {
+	name, err := syscall.UTF16PtrFromString(source)
+	if err != nil {
+		return nil, err
+	}
+	h, _, err := procRegisterEventSource.Call(0, uintptr(unsafe.Pointer(name)))
+	if h == 0 {
+		return nil, err
+	}
+	return &EventLog{handle: h}, nil
+}
+
+func (l *EventLog) Write(p []byte) (int, error) {
+	typ := l.Type
+	if typ == 0 {
+		typ = eventLogInformation
+		if bytes.Contains(p, []byte(`"level":"ERROR`)) {
+			typ = eventLogError
+		} else if bytes.Contains(p, []byte(`"level":"WARN`)) {
+			typ = eventLogWarning
+		}
+	}
+	s, err := syscall.UTF16PtrFromString(string(bytes.TrimRight(p, "\r\n")))
+	if err != nil {
+		return 0, err
+	}
+	// the message file echoes the string of the event IDs 1 to 1000
+	if r, _, err := procReportEvent.Call(l.handle, uintptr(typ), 0, 1, 0, 1, 0,
+		uintptr(unsafe.Pointer(&s)), 0); r == 0 {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (l *EventLog) Close() error {
+	if r, _, err := procDeregisterEventSource.Call(l.handle); r == 0 {
+		return err
+	}
+	return nil
+}
+
+// InstallEventSource registers the source of the Application event log so
+// its events are displayed without a message file of its own.
+func InstallEventSource(source string) error {
+	subkey, err := syscall.UTF16PtrFromString(eventLogKey + source)
+	if err != nil {
+		return err
+	}
+	var key syscall.Handle
+	if r, _, _ := procRegCreateKeyEx.Call(hkeyLocalMachine, uintptr(unsafe.Pointer(subkey)), 0, 0, 0,
+		syscall.KEY_ALL_ACCESS, 0, uintptr(unsafe.Pointer(&key)), 0); r != 0 {
+		return syscall.Errno(r)
+	}
+	defer syscall.RegCloseKey(key)
+	file, _ := syscall.UTF16FromString(eventLogMessageFile)
+	if err := setRegistryValue(key, "EventMessageFile", syscall.REG_EXPAND_SZ,
+		unsafe.Pointer(&file[0]), 2*len(file)); err != nil {
+		return err
+	}
+	types := uint32(eventLogError | eventLogWarning | eventLogInformation)
+	return setRegistryValue(key, "TypesSupported", syscall.REG_DWORD, unsafe.Pointer(&types), 4)
+}
+
+func setRegistryValue(key syscall.Handle, name string, typ uint32, data unsafe.Pointer, size int) error {
+	p, err := syscall.UTF16PtrFromString(name)
+	if err != nil {
+		return err
+	}
+	if r, _, _ := procRegSetValueEx.Call(uintptr(key), uintptr(unsafe.Pointer(p)), 0, uintptr(typ),
+		uintptr(data), uintptr(size)); r != 0 {
+		return syscall.Errno(r)
+	}
+	return nil
+}
+
+// RemoveEventSource unregisters the source of InstallEventSource.
+func RemoveEventSource(source string) error {
+	subkey, err := syscall.UTF16PtrFromString(eventLogKey + source)
+	if err != nil {
+		return err
+	}
+	if r, _, _ := procRegDeleteKey.Call(hkeyLocalMachine, uintptr(unsafe.Pointer(subkey))); r != 0 {
+		return syscall.Errno(r)
+	}
+	return nil
+}
+
+// NewSyslogSecurityLogger writes the security events as warnings of the
+// Application event log, the system log of Windows.
+func NewSyslogSecurityLogger(tag string) (*SecurityLogger, error) {
+	l, err := NewEventLog(tag)
+	if err != nil {
+		return nil, err
+	}
+	l.Type = eventLogWarning
+	return NewSecurityLogger(l), nil
+}
+
+// NewSyslogLogger returns a logger like NewLogger writing to the
+// Application event log, the system log of Windows.
+func NewSyslogLogger(tag, level string) (*slog.Logger, error) {
+	l, err := NewEventLog(tag)
+	if err != nil {
+		return nil, err
+	}
+	return NewLogger(l, level)
+}
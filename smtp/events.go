@@ -0,0 +1,133 @@
+package smtp
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Event is one of SessionStarted, CommandReceived, MessageAccepted,
+// MessageRejected and SessionClosed.
+type Event interface {
+	EventTime() time.Time
+}
+
+type SessionStarted struct {
+	SessionID  string    `json:"session_id"`
+	RemoteAddr string    `json:"remote_addr"`
+	Time       time.Time `json:"time"`
+}
+
+type CommandReceived struct {
+	SessionID string    `json:"session_id"`
+	Verb      string    `json:"verb"`
+	Time      time.Time `json:"time"`
+}
+
+type MessageAccepted struct {
+	SessionID   string    `json:"session_id"`
+	QueueID     string    `json:"queue_id,omitempty"`
+	MessageID   string    `json:"message_id,omitempty"`
+	ReturnTo    string    `json:"return_to"`
+	Recipients  []string  `json:"recipients"`
+	Headers     []string  `json:"headers,omitempty"`
+	Size        int64     `json:"size"`
+	Tags        []string  `json:"tags,omitempty"`
+	Quarantined bool      `json:"quarantined,omitempty"`
+	Time        time.Time `json:"time"`
+}
+
+type MessageRejected struct {
+	SessionID  string    `json:"session_id"`
+	ReturnTo   string    `json:"return_to"`
+	Recipients []string  `json:"recipients"`
+	Reply      string    `json:"reply"`
+	Time       time.Time `json:"time"`
+}
+
+type SessionClosed struct {
+	SessionID string    `json:"session_id"`
+	Time      time.Time `json:"time"`
+}
+
+func (e SessionStarted) EventTime() time.Time  { return e.Time }
+func (e CommandReceived) EventTime() time.Time { return e.Time }
+func (e MessageAccepted) EventTime() time.Time { return e.Time }
+func (e MessageRejected) EventTime() time.Time { return e.Time }
+func (e SessionClosed) EventTime() time.Time   { return e.Time }
+
+// EventBus delivers published events to every subscriber. Each subscriber
+// runs in its own goroutine with a buffer, and events are dropped rather
+// than blocking a session when the buffer is full.
+type EventBus struct {
+	BufferSize int
+
+	subscribers map[int]chan Event
+	nextID      int
+	dropped     int64
+	wg          sync.WaitGroup
+	mtx         sync.RWMutex
+}
+
+func NewEventBus() *EventBus {
+	return &EventBus{
+		BufferSize:  256,
+		subscribers: make(map[int]chan Event),
+	}
+}
+
+// Subscribe calls f for each event until the returned function is called.
+func (bus *EventBus) Subscribe(f func(e Event)) func() {
+	defer bus.mtx.Unlock()
+	bus.mtx.Lock()
+	ch := make(chan Event, bus.BufferSize)
+	id := bus.nextID
+	bus.nextID++
+	bus.subscribers[id] = ch
+	bus.wg.Add(1)
+	go func() {
+		defer bus.wg.Done()
+		for e := range ch {
+			f(e)
+		}
+	}()
+	return func() {
+		defer bus.mtx.Unlock()
+		bus.mtx.Lock()
+		if _, ok := bus.subscribers[id]; ok {
+			delete(bus.subscribers, id)
+			close(ch)
+		}
+	}
+}
+
+func (bus *EventBus) Publish(e Event) {
+	if bus == nil {
+		return
+	}
+	defer bus.mtx.RUnlock()
+	bus.mtx.RLock()
+	for _, ch := range bus.subscribers {
+		select {
+		case ch <- e:
+		default:
+			atomic.AddInt64(&bus.dropped, 1)
+		}
+	}
+}
+
+func (bus *EventBus) Dropped() int64 {
+	return atomic.LoadInt64(&bus.dropped)
+}
+
+// Close unsubscribes everyone and waits for the pending events to be
+// consumed.
+func (bus *EventBus) Close() {
+	bus.mtx.Lock()
+	for id, ch := range bus.subscribers {
+		delete(bus.subscribers, id)
+		close(ch)
+	}
+	bus.mtx.Unlock()
+	bus.wg.Wait()
+}
@@ -0,0 +1,55 @@
+package smtp
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestEventBus(t *testing.T) {
+	conn := NewMockConn([]byte("EHLO localhost\r\n" +
+		"MAIL FROM: <foo@example.net>\r\n" +
+		"RCPT TO: <user1@example.net>\r\n" +
+		"DATA\r\n" +
+		"Subject: Events\r\n" +
+		"\r\n" +
+		"Hello\r\n" +
+		".\r\n" +
+		"QUIT\r\n"))
+	h := NewSMTPHandler(conn, func(st *SMTPState) error {
+		return nil
+	})
+	bus := NewEventBus()
+	var mtx sync.Mutex
+	events := make([]string, 0)
+	for i := 0; i < 2; i++ {
+		bus.Subscribe(func(e Event) {
+			if i > 0 {
+				return
+			}
+			mtx.Lock()
+			defer mtx.Unlock()
+			switch e := e.(type) {
+			case SessionStarted:
+				events = append(events, "started")
+			case CommandReceived:
+				events = append(events, e.Verb)
+			case MessageAccepted:
+				events = append(events, fmt.Sprintf("accepted %s %d", e.ReturnTo, e.Size))
+			case SessionClosed:
+				events = append(events, "closed")
+			}
+		})
+	}
+	h.Config.Events = bus
+	h.Run()
+	bus.Close()
+	expected := "started,EHLO,MAIL,RCPT,DATA,accepted foo@example.net 26,QUIT,closed"
+	if actual := strings.Join(events, ","); actual != expected {
+		t.Errorf("expected: %s, actual: %s", expected, actual)
+	}
+	if bus.Dropped() != 0 {
+		t.Errorf("expected no events to be dropped, actual: %d", bus.Dropped())
+	}
+}
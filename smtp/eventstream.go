@@ -0,0 +1,149 @@
+package smtp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// EventName returns the name of the event in the event stream, e.g.
+// "message.accepted".
+func EventName(e Event) string {
+	switch e.(type) {
+	case SessionStarted:
+		return "session.started"
+	case CommandReceived:
+		return "command.received"
+	case MessageAccepted:
+		return "message.accepted"
+	case MessageRejected:
+		return "message.rejected"
+	case SessionClosed:
+		return "session.closed"
+	}
+	return ""
+}
+
+// ServeHTTP streams the events as server-sent events with the names of
+// EventName and the events in JSON, limited to the comma separated names
+// of the "events" parameter if any. Events are dropped while the client is
+// slower than the sessions.
+func (bus *EventBus) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	var names map[string]bool
+	if x := r.URL.Query().Get("events"); len(x) > 0 {
+		names = make(map[string]bool)
+		for _, name := range strings.Split(x, ",") {
+			names[strings.TrimSpace(name)] = true
+		}
+	}
+	ch := make(chan Event, bus.BufferSize)
+	done := r.Context().Done()
+	unsubscribe := bus.Subscribe(func(e Event) {
+		if names != nil && !names[EventName(e)] {
+			return
+		}
+		select {
+		case ch <- e:
+		case <-done:
+		}
+	})
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	for {
+		select {
+		case <-done:
+			return
+		case e := <-ch:
+			data, err := json.Marshal(e)
+			if err != nil {
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", EventName(e), data); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// ReadEvents calls f for each event of a stream served by
+// EventBus.ServeHTTP until the end of r or an error of f. Unknown events
+// are skipped.
+func ReadEvents(r io.Reader, f func(e Event) error) error {
+	var name string
+	var data bytes.Buffer
+	sc := bufio.NewScanner(r)
+	sc.Buffer(nil, 1<<20)
+	for sc.Scan() {
+		line := sc.Text()
+		if len(line) > 0 {
+			if x, ok := strings.CutPrefix(line, "event:"); ok {
+				name = strings.TrimSpace(x)
+			} else if x, ok := strings.CutPrefix(line, "data:"); ok {
+				if data.Len() > 0 {
+					data.WriteByte('\n')
+				}
+				data.WriteString(strings.TrimPrefix(x, " "))
+			}
+			continue
+		}
+		e, err := decodeEvent(name, data.Bytes())
+		name = ""
+		data.Reset()
+		if err != nil {
+			return err
+		}
+		if e == nil {
+			continue
+		}
+		if err := f(e); err != nil {
+			return err
+		}
+	}
+	return sc.Err()
+}
+
+func decodeEvent(name string, data []byte) (Event, error) {
+	var err error
+	switch name {
+	case "session.started":
+		var e SessionStarted
+		err = json.Unmarshal(data, &e)
+		return e, err
+	case "command.received":
+		var e CommandReceived
+		err = json.Unmarshal(data, &e)
+		return e, err
+	case "message.accepted":
+		var e MessageAccepted
+		err = json.Unmarshal(data, &e)
+		return e, err
+	case "message.rejected":
+		var e MessageRejected
+		err = json.Unmarshal(data, &e)
+		return e, err
+	case "session.closed":
+		var e SessionClosed
+		err = json.Unmarshal(data, &e)
+		return e, err
+	}
+	return nil, nil
+}
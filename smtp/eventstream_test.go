@@ -0,0 +1,69 @@
+package smtp
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEventStream(t *testing.T) {
+	bus := NewEventBus()
+	server := httptest.NewServer(bus)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "?events=message.accepted")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if actual := resp.Header.Get("Content-Type"); actual != "text/event-stream" {
+		t.Errorf("expected: text/event-stream, actual: %s", actual)
+	}
+	now := time.Now().UTC().Truncate(time.Second)
+	bus.Publish(SessionStarted{SessionID: "s1", Time: now})
+	bus.Publish(MessageAccepted{SessionID: "s1", ReturnTo: "foo@example.net",
+		Recipients: []string{"user1@example.com"}, Headers: []string{"Subject: Hello"}, Size: 7, Time: now})
+
+	received := make(chan MessageAccepted, 1)
+	go ReadEvents(resp.Body, func(e Event) error {
+		if x, ok := e.(MessageAccepted); ok {
+			received <- x
+		} else {
+			t.Errorf("unexpected event: %v", e)
+		}
+		return nil
+	})
+	select {
+	case e := <-received:
+		if e.ReturnTo != "foo@example.net" || Header(e.Headers).Get("Subject") != "Hello" || !e.Time.Equal(now) {
+			t.Errorf("unexpected event: %v", e)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out")
+	}
+}
+
+func TestReadEvents(t *testing.T) {
+	stream := ": comment\n\n" +
+		"event: session.started\ndata: {\"session_id\":\"s1\",\n" +
+		"data: \"remote_addr\":\"192.0.2.1:25\"}\n\n" +
+		"event: unknown\ndata: {}\n\n" +
+		"event: message.rejected\ndata: {\"return_to\":\"foo@example.net\",\"reply\":\"550 No\"}\n\n"
+	names := make([]string, 0)
+	err := ReadEvents(strings.NewReader(stream), func(e Event) error {
+		names = append(names, EventName(e))
+		if x, ok := e.(SessionStarted); ok && x.RemoteAddr != "192.0.2.1:25" {
+			t.Errorf("unexpected event: %v", x)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "session.started message.rejected"
+	if actual := strings.Join(names, " "); actual != expected {
+		t.Errorf("expected: %s, actual: %s", expected, actual)
+	}
+}
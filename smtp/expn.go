@@ -0,0 +1,90 @@
+package smtp
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// MailingLists are the members of lists by the address of each list, for
+// EXPN.
+type MailingLists struct {
+	lists map[string][]string
+}
+
+func NewMailingLists() *MailingLists {
+	return &MailingLists{lists: make(map[string][]string)}
+}
+
+func (m *MailingLists) Add(list string, members ...string) {
+	m.lists[strings.ToLower(list)] = members
+}
+
+// Members returns the members of the list, compared case-insensitively.
+func (m *MailingLists) Members(list string) ([]string, bool) {
+	members, ok := m.lists[strings.ToLower(list)]
+	return members, ok
+}
+
+// ParseMailingLists reads lists in the form of "list member...", one per
+// line.
+//
+//	staff@example.com  alice@example.com bob@example.com
+func ParseMailingLists(r io.Reader) (*MailingLists, error) {
+	m := NewMailingLists()
+	scanner := bufio.NewScanner(r)
+	n := 0
+	for scanner.Scan() {
+		n++
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		xs := strings.Fields(line)
+		for _, x := range xs {
+			if _, err := ParseAddress(x); err != nil {
+				return nil, fmt.Errorf("line %d: invalid address: %s", n, x)
+			}
+		}
+		if len(xs) < 2 {
+			return nil, fmt.Errorf("line %d: expected \"list member...\"", n)
+		}
+		m.Add(xs[0], xs[1:]...)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+type ExpandCommand struct {
+}
+
+func (cmnd *ExpandCommand) Execute(conn *SMTPConnection, line string) error {
+	lists := conn.Config().MailingLists
+	if lists == nil {
+		return conn.Reply("expn.not_supported")
+	}
+	cmd, err := ParseCommand(line)
+	if err != nil || len(cmd.Arg) == 0 {
+		return conn.Reply("expn.syntax")
+	}
+	addr, ok := verifyAddress(cmd.Arg)
+	if !ok {
+		return conn.Reply("expn.invalid_address")
+	}
+	members, ok := lists.Members(addr.String())
+	if !ok {
+		return conn.Reply("expn.no_list")
+	}
+	replies := make([]string, len(members))
+	for i, x := range members {
+		sep := "-"
+		if i == len(members)-1 {
+			sep = " "
+		}
+		replies[i] = "250" + sep + "<" + x + ">"
+	}
+	return conn.Write(replies...)
+}
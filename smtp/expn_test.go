@@ -0,0 +1,39 @@
+package smtp
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestExpand(t *testing.T) {
+	lists, err := ParseMailingLists(strings.NewReader("# lists\n" +
+		"staff@example.com alice@example.com bob@example.com\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := NewMockConn([]byte("EHLO localhost\r\n" +
+		"EXPN Staff@example.com\r\n" +
+		"EXPN other@example.com\r\n" +
+		"EXPN\r\n" +
+		"QUIT\r\n"))
+	h := NewSMTPHandler(conn, nil)
+	h.Config.MailingLists = lists
+	h.Run()
+	expected := "220 250 250 550 501 221"
+	if actual := replyCodes(conn.CloneOutputBuffer()); actual != expected {
+		t.Errorf("expected: %s, actual: %s", expected, actual)
+	}
+	expected = "250-2.0.0 <alice@example.com>\r\n250 2.0.0 <bob@example.com>\r\n"
+	if !strings.Contains(string(conn.CloneOutputBuffer()), expected) {
+		t.Errorf("expected: %s, actual: %s", expected, conn.CloneOutputBuffer())
+	}
+
+	conn = NewMockConn([]byte("EXPN staff@example.com\r\nQUIT\r\n"))
+	NewSMTPHandler(conn, nil).Run()
+	if expected := "220 502 221"; replyCodes(conn.CloneOutputBuffer()) != expected {
+		t.Errorf("expected: %s, actual: %s", expected, replyCodes(conn.CloneOutputBuffer()))
+	}
+	if _, err := ParseMailingLists(strings.NewReader("staff@example.com\n")); err == nil {
+		t.Errorf("expected an error of a list without members")
+	}
+}
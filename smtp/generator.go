@@ -0,0 +1,179 @@
+package smtp
+
+import (
+	"encoding/base64"
+	"fmt"
+	"math/rand/v2"
+	"strings"
+	"time"
+)
+
+var generatorWords = strings.Fields(`account agenda budget calendar client
+	deadline delivery draft estimate feedback follow invoice meeting minutes
+	notes offer order plan project proposal quarter receipt report request
+	review schedule status summary team ticket travel update weekly welcome`)
+
+var generatorNames = strings.Fields(`alice bob carol dave erin frank grace
+	heidi ivan judy mallory oscar peggy trent victor walter`)
+
+// Generator produces realistic messages for seeding stores and testing
+// clients: random senders and recipients, plain or multipart bodies with
+// attachments, and broken encodings. The same seed produces the same
+// messages.
+type Generator struct {
+	// Domains of the addresses, example.com, example.net and example.org
+	// by default.
+	Domains []string
+
+	// MaxRecipients is the maximum number of recipients of a message.
+	MaxRecipients int
+
+	// Multipart is the probability of a multipart message with a text and
+	// an HTML part, and an attachment of each of AttachmentSizes.
+	Multipart       float64
+	AttachmentSizes []int
+
+	// Broken is the probability of a message with a broken encoding,
+	// i.e. an invalid base64 part, an invalid encoded-word or undeclared
+	// 8-bit text.
+	Broken float64
+
+	// Clock tells the Date of the messages. The system clock is used if
+	// nil.
+	Clock Clock
+
+	rand *rand.Rand
+}
+
+func NewGenerator(seed uint64) *Generator {
+	return &Generator{
+		Domains:         []string{"example.com", "example.net", "example.org"},
+		MaxRecipients:   3,
+		Multipart:       0.5,
+		AttachmentSizes: []int{4096},
+		Broken:          0.1,
+		rand:            rand.New(rand.NewPCG(seed, seed)),
+	}
+}
+
+// Generate sends n messages, e.g. to Router.Send to deliver them to a
+// server or MessageStore.Publish to store them.
+func (g *Generator) Generate(n int, send func(st *SMTPState) error) error {
+	for i := 0; i < n; i++ {
+		if err := send(g.Next()); err != nil {
+			return fmt.Errorf("smtp: generated message %d: %w", i+1, err)
+		}
+	}
+	return nil
+}
+
+// Next returns the state of a transaction of a new message.
+func (g *Generator) Next() *SMTPState {
+	st := &SMTPState{}
+	st.Reset()
+	st.ReturnTo = g.address()
+	n := 1
+	if g.MaxRecipients > 1 {
+		n += g.rand.IntN(g.MaxRecipients)
+	}
+	for i := 0; i < n; i++ {
+		st.Recipients = append(st.Recipients, g.address())
+	}
+	broken := -1
+	if g.rand.Float64() < g.Broken {
+		broken = g.rand.IntN(3)
+	}
+	subject := g.sentence(3 + g.rand.IntN(4))
+	if broken == 1 {
+		subject = "=?UTF-8?B?" + subject + "?="
+	}
+	st.Headers = []string{
+		"From: " + st.ReturnTo,
+		"To: " + strings.Join(st.Recipients, ", "),
+		"Subject: " + subject,
+		"Date: " + clockNow(g.Clock).Format(time.RFC1123Z),
+		fmt.Sprintf("Message-ID: <%016x@%s>", g.rand.Uint64(), g.domain()),
+		"MIME-Version: 1.0",
+	}
+	text := g.paragraphs()
+	if broken == 2 {
+		// Latin-1 without a charset
+		text += "Caf\xe9 na\xefve r\xe9sum\xe9\r\n"
+	}
+	if g.rand.Float64() >= g.Multipart {
+		if broken == 2 {
+			st.Headers = append(st.Headers, "Content-Type: text/plain")
+		} else {
+			st.Headers = append(st.Headers, "Content-Type: text/plain; charset=UTF-8")
+		}
+		if broken == 0 {
+			st.Headers = append(st.Headers, "Content-Transfer-Encoding: base64")
+			text = "This is not base64!\r\n"
+		}
+		st.SetContent([]byte(text))
+		return st
+	}
+	boundary := fmt.Sprintf("%016x", g.rand.Uint64())
+	st.Headers = append(st.Headers, fmt.Sprintf("Content-Type: multipart/mixed; boundary=\"%s\"", boundary))
+	var b strings.Builder
+	b.WriteString("--" + boundary + "\r\n")
+	b.WriteString("Content-Type: text/plain; charset=UTF-8\r\n\r\n")
+	b.WriteString(text)
+	b.WriteString("--" + boundary + "\r\n")
+	b.WriteString("Content-Type: text/html; charset=UTF-8\r\n\r\n")
+	b.WriteString("<html><body><p>" + strings.ReplaceAll(strings.TrimSpace(text), "\r\n\r\n", "</p><p>") + "</p></body></html>\r\n")
+	for i, size := range g.AttachmentSizes {
+		data := make([]byte, size)
+		for j := range data {
+			data[j] = byte(g.rand.Uint32())
+		}
+		encoded := base64.StdEncoding.EncodeToString(data)
+		if broken == 0 && i == 0 {
+			encoded = "!!" + encoded
+		}
+		b.WriteString("--" + boundary + "\r\n")
+		fmt.Fprintf(&b, "Content-Type: application/octet-stream\r\n"+
+			"Content-Disposition: attachment; filename=\"%s-%d.bin\"\r\n"+
+			"Content-Transfer-Encoding: base64\r\n\r\n", g.word(), i+1)
+		for len(encoded) > 76 {
+			b.WriteString(encoded[:76] + "\r\n")
+			encoded = encoded[76:]
+		}
+		b.WriteString(encoded + "\r\n")
+	}
+	b.WriteString("--" + boundary + "--\r\n")
+	st.SetContent([]byte(b.String()))
+	return st
+}
+
+func (g *Generator) word() string {
+	return generatorWords[g.rand.IntN(len(generatorWords))]
+}
+
+func (g *Generator) domain() string {
+	return g.Domains[g.rand.IntN(len(g.Domains))]
+}
+
+func (g *Generator) address() string {
+	return generatorNames[g.rand.IntN(len(generatorNames))] + "@" + g.domain()
+}
+
+func (g *Generator) sentence(n int) string {
+	xs := make([]string, n)
+	for i := range xs {
+		xs[i] = g.word()
+	}
+	s := strings.Join(xs, " ")
+	return strings.ToUpper(s[:1]) + s[1:]
+}
+
+func (g *Generator) paragraphs() string {
+	var b strings.Builder
+	for i, n := 0, 1+g.rand.IntN(3); i < n; i++ {
+		for j, m := 0, 1+g.rand.IntN(4); j < m; j++ {
+			b.WriteString(g.sentence(5+g.rand.IntN(8)) + ".\r\n")
+		}
+		b.WriteString("\r\n")
+	}
+	return b.String()
+}
@@ -0,0 +1,90 @@
+package smtp
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"strings"
+	"testing"
+	"time"
+)
+
+func generatedMessage(st *SMTPState) []byte {
+	var b bytes.Buffer
+	b.WriteString(strings.Join(st.Headers, "\r\n") + "\r\n\r\n")
+	io.Copy(&b, st.Content())
+	return b.Bytes()
+}
+
+func TestGenerator(t *testing.T) {
+	clock := NewFakeClock(time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC))
+	g1, g2 := NewGenerator(1), NewGenerator(1)
+	g1.Clock, g2.Clock = clock, clock
+	for i := 0; i < 10; i++ {
+		if !bytes.Equal(generatedMessage(g1.Next()), generatedMessage(g2.Next())) {
+			t.Fatalf("expected the same messages of the same seed")
+		}
+	}
+
+	g := NewGenerator(2)
+	g.Multipart, g.Broken = 1, 0
+	g.AttachmentSizes = []int{100, 2000}
+	st := g.Next()
+	if len(st.Recipients) < 1 || len(st.Recipients) > 3 {
+		t.Errorf("unexpected recipients: %v", st.Recipients)
+	}
+	msg, err := mail.ReadMessage(bytes.NewReader(generatedMessage(st)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sizes := make([]int, 0)
+	r := multipart.NewReader(msg.Body, params["boundary"])
+	for {
+		p, err := r.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := io.ReadAll(p)
+		if p.Header.Get("Content-Transfer-Encoding") == "base64" {
+			b, err = io.ReadAll(base64.NewDecoder(base64.StdEncoding, bytes.NewReader(b)))
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(p.FileName()) > 0 {
+			sizes = append(sizes, len(b))
+		}
+	}
+	if len(sizes) != 2 || sizes[0] != 100 || sizes[1] != 2000 {
+		t.Errorf("unexpected attachments: %v", sizes)
+	}
+
+	g = NewGenerator(3)
+	g.Broken = 1
+	for i := 0; i < 5; i++ {
+		if _, err := mail.ReadMessage(bytes.NewReader(generatedMessage(g.Next()))); err != nil {
+			t.Errorf("expected a parsable message: %v", err)
+		}
+	}
+
+	store, err := NewMessageStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := NewGenerator(4).Generate(3, store.Publish); err != nil {
+		t.Fatal(err)
+	}
+	if xs, _ := store.List(""); len(xs) != 3 {
+		t.Errorf("expected: 3, actual: %d", len(xs))
+	}
+}
@@ -0,0 +1,171 @@
+package smtp
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// headerName returns the field name of a header line, or an empty string
+// for a continuation line.
+func headerName(line string) string {
+	if len(line) == 0 || line[0] == ' ' || line[0] == '\t' {
+		return ""
+	}
+	i := strings.IndexByte(line, ':')
+	if i <= 0 {
+		return ""
+	}
+	return strings.TrimRight(line[:i], " \t")
+}
+
+func countHeaders(headers []string, name string) int {
+	n := 0
+	for _, x := range headers {
+		if strings.EqualFold(headerName(x), name) {
+			n++
+		}
+	}
+	return n
+}
+
+// receivedHeader returns the lines of a Received trace header (RFC 5321
+// section 4.4) for the current transaction.
+func receivedHeader(st *SMTPState, ip string, now time.Time) []string {
+	from := "from " + st.ClientName
+	if len(ip) > 0 {
+		if strings.Contains(ip, ":") {
+			ip = "IPv6:" + ip
+		}
+		if len(st.RemoteName) > 0 {
+			from += " (" + st.RemoteName + " [" + ip + "])"
+		} else {
+			from += " ([" + ip + "])"
+		}
+	}
+	by := "by " + st.ServerName + " with " + receivedProtocol(st)
+	if st.TLS != nil {
+		by += fmt.Sprintf(" (version=%s cipher=%s)",
+			strings.ReplaceAll(st.TLSVersion(), " ", ""), st.TLSCipherSuite())
+	}
+	if len(st.Recipients) == 1 {
+		by += fmt.Sprintf(" for <%s>", st.Recipients[0])
+	}
+	return []string{
+		"Received: " + from,
+		"\t" + by + ";",
+		"\t" + now.Format(time.RFC1123Z),
+	}
+}
+
+// receivedProtocol returns the "with" protocol type registered by RFC 3848,
+// with S after STARTTLS or on implicit TLS and A after AUTH.
+func receivedProtocol(st *SMTPState) string {
+	protocol := "ESMTP"
+	switch strings.ToUpper(st.Hello) {
+	case "EHLO":
+	case "LHLO":
+		protocol = "LMTP"
+	default:
+		return "SMTP"
+	}
+	if st.TLS != nil {
+		protocol += "S"
+	}
+	if len(st.Username) > 0 {
+		protocol += "A"
+	}
+	return protocol
+}
+
+// headerValue returns the unfolded value of the first header with the name.
+func headerValue(headers []string, name string) (string, bool) {
+	for i, x := range headers {
+		if !strings.EqualFold(headerName(x), name) {
+			continue
+		}
+		v := x[strings.IndexByte(x, ':')+1:]
+		for _, y := range headers[i+1:] {
+			if len(y) == 0 || (y[0] != ' ' && y[0] != '\t') {
+				break
+			}
+			v += y
+		}
+		return strings.TrimSpace(v), true
+	}
+	return "", false
+}
+
+// headerValues returns the unfolded values of all headers with the name.
+func headerValues(headers []string, name string) []string {
+	values := make([]string, 0)
+	for i, x := range headers {
+		if strings.EqualFold(headerName(x), name) {
+			v, _ := headerValue(headers[i:], name)
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+// newMessageID returns a Message-ID with a random local part.
+func newMessageID(domain string) string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return messageID(hex.EncodeToString(b), domain)
+}
+
+// messageID returns the Message-ID <local@domain>, at the host name, or at
+// localhost if unknown, when the domain is empty.
+func messageID(local, domain string) string {
+	if len(domain) == 0 {
+		domain, _ = os.Hostname()
+	}
+	if len(domain) == 0 {
+		domain = "localhost"
+	}
+	return "<" + local + "@" + domain + ">"
+}
+
+// fixupHeaders adds Message-ID and Date headers, and From if addFrom is
+// true, when the message lacks them as a submission server does (RFC 6409
+// section 8), then sets st.MessageID. An added Message-ID has the queue ID,
+// which the message is stored by, as its local part.
+func fixupHeaders(st *SMTPState, now time.Time, addFrom bool) {
+	added := make([]string, 0)
+	if addFrom && !st.NullSender && len(st.ReturnTo) > 0 {
+		if _, ok := headerValue(st.Headers, "From"); !ok {
+			added = append(added, "From: <"+st.ReturnTo+">")
+		}
+	}
+	if _, ok := headerValue(st.Headers, "Date"); !ok {
+		added = append(added, "Date: "+now.Format(time.RFC1123Z))
+	}
+	id, ok := headerValue(st.Headers, "Message-ID")
+	if !ok {
+		id = newMessageID(st.ServerName)
+		if len(st.QueueID) > 0 {
+			id = messageID(st.QueueID, st.ServerName)
+		}
+		added = append(added, "Message-ID: "+id)
+	}
+	st.MessageID = id
+	st.Headers = append(st.Headers, added...)
+}
+
+// headerFields returns each header field with its continuation lines
+// joined by CRLF.
+func headerFields(headers []string) []string {
+	fields := make([]string, 0, len(headers))
+	for _, x := range headers {
+		if n := len(fields); n > 0 && len(headerName(x)) == 0 {
+			fields[n-1] += "\r\n" + x
+			continue
+		}
+		fields = append(fields, x)
+	}
+	return fields
+}
@@ -0,0 +1,170 @@
+package smtp
+
+import (
+	"crypto/tls"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCountHeaders(t *testing.T) {
+	headers := []string{
+		"Received: from a.example.net",
+		"\tby b.example.net",
+		"received : from c.example.net",
+		"Subject: Received: twice",
+		" Received: folded",
+	}
+	if actual := countHeaders(headers, "Received"); actual != 2 {
+		t.Errorf("expected: 2, actual: %d", actual)
+	}
+}
+
+func TestReceivedHeader(t *testing.T) {
+	st := &SMTPState{
+		Hello:      "EHLO",
+		ClientName: "client.example.net",
+		ServerName: "mx.example.net",
+		Recipients: []string{"user1@example.net"},
+	}
+	now := time.Date(2006, 1, 2, 15, 4, 5, 0, time.UTC)
+	expected := "Received: from client.example.net ([192.0.2.1])\r\n" +
+		"\tby mx.example.net with ESMTP for <user1@example.net>;\r\n" +
+		"\tMon, 02 Jan 2006 15:04:05 +0000"
+	actual := strings.Join(receivedHeader(st, "192.0.2.1", now), "\r\n")
+	if actual != expected {
+		t.Errorf("expected: %s, actual: %s", expected, actual)
+	}
+
+	st.Hello = "HELO"
+	st.Recipients = append(st.Recipients, "user2@example.net")
+	expected = "Received: from client.example.net ([IPv6:2001:db8::1])\r\n" +
+		"\tby mx.example.net with SMTP;\r\n" +
+		"\tMon, 02 Jan 2006 15:04:05 +0000"
+	actual = strings.Join(receivedHeader(st, "2001:db8::1", now), "\r\n")
+	if actual != expected {
+		t.Errorf("expected: %s, actual: %s", expected, actual)
+	}
+
+	st.TLS = &tls.ConnectionState{Version: tls.VersionTLS13, CipherSuite: tls.TLS_AES_128_GCM_SHA256}
+	expected = "\tby mx.example.net with SMTP (version=TLS1.3 cipher=TLS_AES_128_GCM_SHA256);"
+	if actual := receivedHeader(st, "192.0.2.1", now)[1]; actual != expected {
+		t.Errorf("expected: %s, actual: %s", expected, actual)
+	}
+}
+
+func TestReceivedProtocol(t *testing.T) {
+	for _, fixture := range []struct {
+		hello    string
+		tls      bool
+		username string
+		expected string
+	}{
+		{"HELO", true, "", "SMTP"},
+		{"EHLO", false, "", "ESMTP"},
+		{"EHLO", true, "", "ESMTPS"},
+		{"EHLO", false, "user1", "ESMTPA"},
+		{"EHLO", true, "user1", "ESMTPSA"},
+		{"LHLO", false, "", "LMTP"},
+		{"LHLO", true, "", "LMTPS"},
+		{"LHLO", false, "user1", "LMTPA"},
+		{"LHLO", true, "user1", "LMTPSA"},
+	} {
+		st := &SMTPState{Hello: fixture.hello, Username: fixture.username}
+		if fixture.tls {
+			st.TLS = &tls.ConnectionState{}
+		}
+		if actual := receivedProtocol(st); actual != fixture.expected {
+			t.Errorf("%+v: expected: %s, actual: %s", fixture, fixture.expected, actual)
+		}
+	}
+}
+
+func TestFixupHeaders(t *testing.T) {
+	st := &SMTPState{
+		ServerName: "mx.example.net",
+		ReturnTo:   "foo@example.net",
+		Headers:    []string{"Subject: Fixup"},
+	}
+	now := time.Date(2006, 1, 2, 15, 4, 5, 0, time.UTC)
+	fixupHeaders(st, now, true)
+	if len(st.Headers) != 4 {
+		t.Fatalf("expected 4 headers, actual: %s", st.Headers)
+	}
+	if st.Headers[1] != "From: <foo@example.net>" {
+		t.Errorf("expected: From: <foo@example.net>, actual: %s", st.Headers[1])
+	}
+	if st.Headers[2] != "Date: Mon, 02 Jan 2006 15:04:05 +0000" {
+		t.Errorf("expected: Date: Mon, 02 Jan 2006 15:04:05 +0000, actual: %s", st.Headers[2])
+	}
+	if !strings.HasSuffix(st.MessageID, "@mx.example.net>") ||
+		st.Headers[3] != "Message-ID: "+st.MessageID {
+		t.Errorf("unexpected Message-ID: %s", st.Headers[3])
+	}
+
+	st.Headers = []string{
+		"From: Foo <foo@example.net>",
+		"Date: Mon, 02 Jan 2006 15:04:05 +0000",
+		"Message-Id:",
+		" <1234@example.net>",
+	}
+	fixupHeaders(st, now, true)
+	if len(st.Headers) != 4 {
+		t.Errorf("expected no headers to be added, actual: %s", st.Headers)
+	}
+	if st.MessageID != "<1234@example.net>" {
+		t.Errorf("expected: <1234@example.net>, actual: %s", st.MessageID)
+	}
+
+	st.QueueID = "20060102150405000000000-0123456789abcdef"
+	st.Headers = []string{"Subject: Fixup"}
+	fixupHeaders(st, now, false)
+	if expected := "<" + st.QueueID + "@mx.example.net>"; st.MessageID != expected {
+		t.Errorf("expected: %s, actual: %s", expected, st.MessageID)
+	}
+}
+
+func TestFixupHeadersStored(t *testing.T) {
+	s, err := NewMessageStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := NewMockConn([]byte("EHLO localhost\r\n" +
+		"MAIL FROM: <foo@example.net>\r\n" +
+		"RCPT TO: <user1@example.net>\r\n" +
+		"DATA\r\n" +
+		"Subject: Fixup\r\n" +
+		"\r\n" +
+		"Hello\r\n" +
+		".\r\n" +
+		"QUIT\r\n"))
+	var id, messageID string
+	h := NewSMTPHandler(conn, func(st *SMTPState) error {
+		messageID = st.MessageID
+		id, err = s.Put(st)
+		return err
+	})
+	h.Config.ServerName = "mx.example.net"
+	h.Config.FixupHeaders = true
+	h.Run()
+	if expected := "<" + id + "@mx.example.net>"; len(id) == 0 || messageID != expected {
+		t.Errorf("expected: %s, actual: %s", expected, messageID)
+	}
+	if _, err := s.Get(id); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestNewMessageID(t *testing.T) {
+	host, err := os.Hostname()
+	if err != nil || len(host) == 0 {
+		host = "localhost"
+	}
+	if id := newMessageID(""); !strings.HasSuffix(id, "@"+host+">") {
+		t.Errorf("expected the host name %s, actual: %s", host, id)
+	}
+	if id := newMessageID("mx.example.net"); len(id) != 49 || !strings.HasSuffix(id, "@mx.example.net>") {
+		t.Errorf("unexpected Message-ID: %s", id)
+	}
+}
@@ -0,0 +1,214 @@
+package smtp
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Health reports the status of the process for orchestrators: /healthz
+// as long as it serves HTTP, and /readyz while every listener accepts
+// connections, the store is writable, the upstreams are reachable, the
+// queue is not deeper than MaxQueueDepth and Drain is off.
+type Health struct {
+	Store *MessageStore
+	Queue *Queue
+	Drain *Drain
+
+	// MaxQueueDepth is the number of queued messages beyond which the
+	// process is not ready, or 0 for no limit.
+	MaxQueueDepth int
+
+	// Upstreams are "host:port" to connect to within Timeout.
+	Upstreams []string
+	Timeout   time.Duration
+
+	mtx       sync.Mutex
+	listeners []*healthListener
+}
+
+// HealthCheck is the result of a component.
+type HealthCheck struct {
+	Name  string `json:"name"`
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+type HealthReport struct {
+	Status     string        `json:"status"`
+	Checks     []HealthCheck `json:"checks"`
+	QueueDepth int           `json:"queue_depth"`
+	Draining   bool          `json:"draining,omitempty"`
+}
+
+func NewHealth() *Health {
+	return &Health{Timeout: 5 * time.Second}
+}
+
+type healthListener struct {
+	net.Listener
+	name string
+	mtx  sync.Mutex
+	err  error
+}
+
+// Accept retries temporary errors, e.g. of running out of file
+// descriptors or of connections aborted before accepted, backing off as
+// net/http does, and fails the listener on others.
+func (l *healthListener) Accept() (net.Conn, error) {
+	var delay time.Duration
+	for {
+		conn, err := l.Listener.Accept()
+		if err == nil {
+			return conn, nil
+		}
+		if !temporaryAcceptError(err) {
+			l.fail(err)
+			return conn, err
+		}
+		if delay == 0 {
+			delay = 5 * time.Millisecond
+		} else if delay *= 2; delay > time.Second {
+			delay = time.Second
+		}
+		time.Sleep(delay)
+	}
+}
+
+func temporaryAcceptError(err error) bool {
+	if errors.Is(err, syscall.ECONNABORTED) || errors.Is(err, syscall.ECONNRESET) {
+		return true
+	}
+	var ne net.Error
+	return !errors.Is(err, net.ErrClosed) && errors.As(err, &ne) && ne.Temporary()
+}
+
+func (l *healthListener) Close() error {
+	l.fail(net.ErrClosed)
+	return l.Listener.Close()
+}
+
+func (l *healthListener) fail(err error) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	if l.err == nil {
+		l.err = err
+	}
+}
+
+func (l *healthListener) check() HealthCheck {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	c := HealthCheck{Name: "listener " + l.name, OK: l.err == nil}
+	if l.err != nil {
+		c.Error = l.err.Error()
+	}
+	return c
+}
+
+// Listener returns the listener watched until Accept fails permanently or
+// it is closed. It returns lsnr as it is if h is nil.
+func (h *Health) Listener(name string, lsnr net.Listener) net.Listener {
+	if h == nil {
+		return lsnr
+	}
+	l := &healthListener{Listener: lsnr, name: name}
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	h.listeners = append(h.listeners, l)
+	return l
+}
+
+// Check returns the status of every component.
+func (h *Health) Check() HealthReport {
+	report := HealthReport{Status: "ok", Checks: make([]HealthCheck, 0)}
+	add := func(name string, err error) {
+		c := HealthCheck{Name: name, OK: err == nil}
+		if err != nil {
+			c.Error = err.Error()
+			report.Status = "fail"
+		}
+		report.Checks = append(report.Checks, c)
+	}
+	h.mtx.Lock()
+	listeners := append([]*healthListener{}, h.listeners...)
+	h.mtx.Unlock()
+	for _, l := range listeners {
+		c := l.check()
+		if !c.OK {
+			report.Status = "fail"
+		}
+		report.Checks = append(report.Checks, c)
+	}
+	if h.Store != nil {
+		add("store", checkWritable(h.Store.Dir))
+	}
+	if h.Queue != nil {
+		xs, err := h.Queue.List()
+		if err == nil {
+			report.QueueDepth = len(xs)
+			if h.MaxQueueDepth > 0 && len(xs) > h.MaxQueueDepth {
+				err = errQueueTooDeep
+			}
+		}
+		add("queue", err)
+	}
+	if h.Drain != nil {
+		var err error
+		if report.Draining = h.Drain.Draining(); report.Draining {
+			err = errDraining
+		}
+		add("drain", err)
+	}
+	for _, x := range h.Upstreams {
+		conn, err := net.DialTimeout("tcp", x, h.Timeout)
+		if err == nil {
+			conn.Close()
+		}
+		add("upstream "+x, err)
+	}
+	return report
+}
+
+var errQueueTooDeep = errors.New("smtp: too many queued messages")
+
+// checkWritable creates and removes a file in the directory.
+func checkWritable(dir string) error {
+	f, err := os.CreateTemp(dir, ".health-*")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// LivenessHandler answers /healthz.
+func (h *Health) LivenessHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+	})
+}
+
+// ReadinessHandler answers /readyz with the report, with the status 503
+// if any check fails.
+func (h *Health) ReadinessHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		report := h.Check()
+		status := http.StatusOK
+		if report.Status != "ok" {
+			status = http.StatusServiceUnavailable
+		}
+		writeJSON(w, status, report)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
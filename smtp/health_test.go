@@ -0,0 +1,114 @@
+package smtp
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestHealth(t *testing.T) {
+	lsnr, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip(err)
+	}
+	store, err := NewMessageStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	q, err := NewQueue(t.TempDir(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := NewHealth()
+	h.Store = store
+	h.Queue = q
+	h.Upstreams = []string{lsnr.Addr().String()}
+	h.Timeout = time.Second
+	smtpLsnr := h.Listener("smtp", lsnr)
+
+	readyz := func() (int, HealthReport) {
+		var report HealthReport
+		w := httptest.NewRecorder()
+		h.ReadinessHandler().ServeHTTP(w, httptest.NewRequest("GET", "/readyz", nil))
+		json.Unmarshal(w.Body.Bytes(), &report)
+		return w.Code, report
+	}
+	if code, report := readyz(); code != http.StatusOK || len(report.Checks) != 4 {
+		t.Errorf("unexpected report: %d %v", code, report)
+	}
+
+	st := &SMTPState{Recipients: []string{"user1@example.net"}}
+	st.SetContent([]byte("Hello\r\n"))
+	q.Send(st)
+	q.Send(st)
+	h.MaxQueueDepth = 1
+	code, report := readyz()
+	if code != http.StatusServiceUnavailable || report.QueueDepth != 2 || report.Checks[2].OK {
+		t.Errorf("unexpected report: %d %v", code, report)
+	}
+	h.MaxQueueDepth = 0
+
+	smtpLsnr.Close()
+	code, report = readyz()
+	if code != http.StatusServiceUnavailable || report.Checks[0].OK || report.Checks[3].OK {
+		t.Errorf("unexpected report: %d %v", code, report)
+	}
+
+	w := httptest.NewRecorder()
+	h.LivenessHandler().ServeHTTP(w, httptest.NewRequest("GET", "/healthz", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("expected: %d, actual: %d", http.StatusOK, w.Code)
+	}
+	if l := (*Health)(nil).Listener("smtp", lsnr); l != lsnr {
+		t.Errorf("expected the listener as it is without Health")
+	}
+}
+
+// errListener fails Accept with the errors in order, then accepts.
+type errListener struct {
+	net.Listener
+	errs []error
+}
+
+func (l *errListener) Accept() (net.Conn, error) {
+	if len(l.errs) > 0 {
+		err := l.errs[0]
+		l.errs = l.errs[1:]
+		return nil, err
+	}
+	client, server := net.Pipe()
+	client.Close()
+	return server, nil
+}
+
+func TestHealthListenerTemporary(t *testing.T) {
+	h := NewHealth()
+	accept := func(op string, err error) *net.OpError {
+		return &net.OpError{Op: op, Net: "tcp", Err: os.NewSyscallError(op, err)}
+	}
+	lsnr := h.Listener("smtp", &errListener{errs: []error{
+		accept("accept", syscall.EMFILE),
+		accept("accept", syscall.ECONNABORTED),
+	}})
+	conn, err := lsnr.Accept()
+	if err != nil {
+		t.Fatalf("expected the temporary errors to be retried: %v", err)
+	}
+	conn.Close()
+	if report := h.Check(); report.Status != "ok" {
+		t.Errorf("unexpected report: %v", report)
+	}
+
+	lsnr = h.Listener("smtp", &errListener{errs: []error{accept("accept", syscall.EINVAL)}})
+	if _, err := lsnr.Accept(); err == nil {
+		t.Fatal("expected an error")
+	}
+	if report := h.Check(); report.Status != "fail" || report.Checks[1].OK {
+		t.Errorf("unexpected report: %v", report)
+	}
+}
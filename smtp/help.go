@@ -0,0 +1,96 @@
+package smtp
+
+import (
+	"strings"
+)
+
+// commandHelp is the syntax and the description of each command for HELP.
+var commandHelp = map[string][2]string{
+	"HELO":     {"HELO <domain>", "Identifies the client."},
+	"EHLO":     {"EHLO <domain>", "Identifies the client and lists the extensions."},
+	"LHLO":     {"LHLO <domain>", "Identifies the LMTP client and lists the extensions."},
+	"MAIL":     {"MAIL FROM:<reverse-path> [parameters]", "Starts a mail transaction."},
+	"RCPT":     {"RCPT TO:<forward-path> [parameters]", "Adds a recipient to the transaction."},
+	"AUTH":     {"AUTH PLAIN [initial-response]", "Authenticates the client."},
+	"RSET":     {"RSET", "Aborts the transaction."},
+	"VRFY":     {"VRFY <address>", "Verifies an address."},
+	"EXPN":     {"EXPN <list>", "Expands a mailing list."},
+	"NOOP":     {"NOOP", "Does nothing."},
+	"HELP":     {"HELP [command]", "Describes the commands."},
+	"QUIT":     {"QUIT", "Closes the session."},
+	"DATA":     {"DATA", "Sends the message, ending with a line of a single dot."},
+	"BDAT":     {"BDAT <size> [LAST]", "Sends a chunk of the message."},
+	"ATRN":     {"ATRN [domain,...]", "Reverses the session to deliver the queued messages."},
+	"ETRN":     {"ETRN <domain>", "Starts the delivery of the queued messages of the domain."},
+	"STARTTLS": {"STARTTLS", "Starts TLS."},
+	"XCLIENT":  {"XCLIENT attribute=value...", "Overrides the attributes of the client."},
+}
+
+// commandEnabled reports whether the command is available for the
+// connection, rather than always refused by the configuration.
+func commandEnabled(conn *SMTPConnection, verb string) bool {
+	config := conn.Config()
+	switch verb {
+	case "HELO", "EHLO":
+		return !config.LMTP
+	case "LHLO":
+		return config.LMTP
+	case "AUTH":
+		return !config.AuthRequiresTLS || conn.State().TLS != nil
+	case "VRFY":
+		return config.Verify != nil
+	case "EXPN":
+		return config.MailingLists != nil
+	case "ATRN", "ETRN":
+		return config.Queue != nil
+	case "STARTTLS":
+		return config.TLSConfig != nil && conn.State().TLS == nil
+	case "XCLIENT":
+		return xclientTrusted(conn)
+	}
+	return true
+}
+
+// enabledCommands returns the sorted verbs of the commands enabled for the
+// connection.
+func enabledCommands(conn *SMTPConnection) []string {
+	verbs := make([]string, 0, len(smtpCommandMap))
+	for _, verb := range conn.Config().Commands() {
+		if commandEnabled(conn, verb) {
+			verbs = append(verbs, verb)
+		}
+	}
+	return verbs
+}
+
+type HelpCommand struct {
+}
+
+// Execute lists the commands and the extensions enabled for the
+// connection, or describes the command given as the argument.
+func (cmnd *HelpCommand) Execute(conn *SMTPConnection, line string) error {
+	cmd, err := ParseCommand(line)
+	if err != nil {
+		return conn.Reply("help.syntax")
+	}
+	if len(cmd.Arg) == 0 {
+		return conn.Write(
+			"214-Commands: "+strings.Join(enabledCommands(conn), " "),
+			"214-Extensions: "+strings.Join(extensions(conn), ", "),
+			"214 HELP <command> for more information")
+	}
+	verb := strings.ToUpper(cmd.Arg)
+	target, ok := conn.Config().command(verb)
+	if !ok || !commandEnabled(conn, verb) {
+		return conn.Reply("help.unknown", cmd.Arg)
+	}
+	var syntax, description string
+	if x, ok := target.(SMTPCommandHelp); ok {
+		syntax, description = x.Help()
+	} else if help, ok := commandHelp[verb]; ok && target == smtpCommandMap[verb] {
+		syntax, description = help[0], help[1]
+	} else {
+		syntax, description = verb, "No description."
+	}
+	return conn.Write("214-"+syntax, "214 "+description)
+}
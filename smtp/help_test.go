@@ -0,0 +1,42 @@
+package smtp
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestHelp(t *testing.T) {
+	conn := NewMockConn([]byte("HELP\r\n" +
+		"HELP mail\r\n" +
+		"HELP EXPN\r\n" +
+		"HELP XDEBUG\r\n" +
+		"QUIT\r\n"))
+	NewSMTPHandler(conn, nil).Run()
+	expected := "220 214 214 504 504 221"
+	if actual := replyCodes(conn.CloneOutputBuffer()); actual != expected {
+		t.Errorf("expected: %s, actual: %s", expected, actual)
+	}
+	out := string(conn.CloneOutputBuffer())
+	for _, x := range []string{
+		"214-2.0.0 Commands: AUTH BDAT DATA EHLO HELO HELP MAIL NOOP QUIT RCPT RSET\r\n",
+		"214-2.0.0 Extensions: PIPELINING, 8BITMIME,",
+		"214-2.0.0 MAIL FROM:<reverse-path> [parameters]\r\n214 2.0.0 Starts a mail transaction.\r\n",
+	} {
+		if !strings.Contains(out, x) {
+			t.Errorf("expected: %q, actual: %q", x, out)
+		}
+	}
+
+	conn = NewMockConn([]byte("HELP\r\nHELP EXPN\r\nQUIT\r\n"))
+	h := NewSMTPHandler(conn, nil)
+	h.Config.LMTP = true
+	h.Config.MailingLists = NewMailingLists()
+	h.Run()
+	expected = "214-2.0.0 Commands: AUTH BDAT DATA EXPN HELP LHLO MAIL NOOP QUIT RCPT RSET\r\n"
+	if !strings.Contains(string(conn.CloneOutputBuffer()), expected) {
+		t.Errorf("expected: %q, actual: %q", expected, conn.CloneOutputBuffer())
+	}
+	if expected := "220 214 214 221"; replyCodes(conn.CloneOutputBuffer()) != expected {
+		t.Errorf("expected: %s, actual: %s", expected, replyCodes(conn.CloneOutputBuffer()))
+	}
+}
@@ -0,0 +1,141 @@
+package smtp
+
+// HookFunc is called on a session event. A non-empty return value is written
+// as the reply instead of the default one, and the remaining hooks are not
+// called.
+type HookFunc func(conn *SMTPConnection) string
+
+type RcptHookFunc func(conn *SMTPConnection, rcpt Address) string
+
+type CommandHookFunc func(conn *SMTPConnection, verb string) string
+
+// Hooks is the chain of handlers called in the order of registration. The
+// zero value is ready to use.
+//
+//	OnConnect  before the greeting
+//	OnCommand  before a known command is processed
+//	OnHelo     after HELO/EHLO has set the client name
+//	OnAuth     after the credentials are verified and Username is set
+//	OnMail     after MAIL has set the sender
+//	OnRcpt     before RCPT adds the recipient
+//	OnData     before the message is sent
+//	OnClose    after the connection is closed
+type Hooks struct {
+	connect []HookFunc
+	command []CommandHookFunc
+	helo    []HookFunc
+	auth    []HookFunc
+	mail    []HookFunc
+	rcpt    []RcptHookFunc
+	data    []HookFunc
+	close   []func(conn *SMTPConnection)
+}
+
+func (h *Hooks) OnConnect(f HookFunc) {
+	h.connect = append(h.connect, f)
+}
+
+func (h *Hooks) OnCommand(f CommandHookFunc) {
+	h.command = append(h.command, f)
+}
+
+func (h *Hooks) OnHelo(f HookFunc) {
+	h.helo = append(h.helo, f)
+}
+
+func (h *Hooks) OnAuth(f HookFunc) {
+	h.auth = append(h.auth, f)
+}
+
+func (h *Hooks) OnMail(f HookFunc) {
+	h.mail = append(h.mail, f)
+}
+
+func (h *Hooks) OnRcpt(f RcptHookFunc) {
+	h.rcpt = append(h.rcpt, f)
+}
+
+func (h *Hooks) OnData(f HookFunc) {
+	h.data = append(h.data, f)
+}
+
+func (h *Hooks) OnClose(f func(conn *SMTPConnection)) {
+	h.close = append(h.close, f)
+}
+
+func runHooks(hooks []HookFunc, conn *SMTPConnection) string {
+	for _, f := range hooks {
+		if reply := f(conn); len(reply) > 0 {
+			return reply
+		}
+	}
+	return ""
+}
+
+func (h *Hooks) runConnect(conn *SMTPConnection) string {
+	if h == nil {
+		return ""
+	}
+	return runHooks(h.connect, conn)
+}
+
+func (h *Hooks) runCommand(conn *SMTPConnection, verb string) string {
+	if h == nil {
+		return ""
+	}
+	for _, f := range h.command {
+		if reply := f(conn, verb); len(reply) > 0 {
+			return reply
+		}
+	}
+	return ""
+}
+
+func (h *Hooks) runHelo(conn *SMTPConnection) string {
+	if h == nil {
+		return ""
+	}
+	return runHooks(h.helo, conn)
+}
+
+func (h *Hooks) runAuth(conn *SMTPConnection) string {
+	if h == nil {
+		return ""
+	}
+	return runHooks(h.auth, conn)
+}
+
+func (h *Hooks) runMail(conn *SMTPConnection) string {
+	if h == nil {
+		return ""
+	}
+	return runHooks(h.mail, conn)
+}
+
+func (h *Hooks) runRcpt(conn *SMTPConnection, rcpt Address) string {
+	if h == nil {
+		return ""
+	}
+	for _, f := range h.rcpt {
+		if reply := f(conn, rcpt); len(reply) > 0 {
+			return reply
+		}
+	}
+	return ""
+}
+
+func (h *Hooks) runData(conn *SMTPConnection) string {
+	if h == nil {
+		return ""
+	}
+	return runHooks(h.data, conn)
+}
+
+func (h *Hooks) runClose(conn *SMTPConnection) {
+	if h == nil {
+		return
+	}
+	for _, f := range h.close {
+		f(conn)
+	}
+}
@@ -0,0 +1,52 @@
+package smtp
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestHooks(t *testing.T) {
+	conn := NewMockConn([]byte("EHLO localhost\r\n" +
+		"MAIL FROM: <foo@example.net>\r\n" +
+		"RCPT TO: <user1@example.net>\r\n" +
+		"RCPT TO: <blocked@example.net>\r\n" +
+		"QUIT\r\n"))
+	h := NewSMTPHandler(conn, nil)
+	events := make([]string, 0)
+	hooks := &Hooks{}
+	hooks.OnConnect(func(conn *SMTPConnection) string {
+		events = append(events, "connect")
+		return ""
+	})
+	hooks.OnHelo(func(conn *SMTPConnection) string {
+		events = append(events, "helo "+conn.State().ClientName)
+		return ""
+	})
+	hooks.OnMail(func(conn *SMTPConnection) string {
+		events = append(events, "mail "+conn.State().ReturnTo)
+		return ""
+	})
+	hooks.OnRcpt(func(conn *SMTPConnection, rcpt Address) string {
+		if rcpt.LocalPart == "blocked" {
+			return "550 5.7.1 Recipient blocked"
+		}
+		return ""
+	})
+	hooks.OnRcpt(func(conn *SMTPConnection, rcpt Address) string {
+		events = append(events, "rcpt "+rcpt.String())
+		return ""
+	})
+	hooks.OnClose(func(conn *SMTPConnection) {
+		events = append(events, "close")
+	})
+	h.Config.Hooks = hooks
+	h.Run()
+	expected := "connect,helo localhost,mail foo@example.net,rcpt user1@example.net,close"
+	if actual := strings.Join(events, ","); actual != expected {
+		t.Errorf("expected: %s, actual: %s", expected, actual)
+	}
+	expected = "220 250 250 250 550 221"
+	if actual := replyCodes(conn.CloneOutputBuffer()); actual != expected {
+		t.Errorf("expected: %s, actual: %s", expected, actual)
+	}
+}
@@ -0,0 +1,869 @@
+package smtp
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/mail"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const maxIMAPLiteralSize = 64 << 10
+
+var errIMAPSyntax = errors.New("imap: syntax error")
+
+// IMAPHandler serves a subset of IMAP4rev1 (RFC 3501) over the message
+// store: LOGIN, LIST, SELECT and EXAMINE of INBOX, FETCH, SEARCH, STORE
+// and their UID forms, EXPUNGE, CLOSE and IDLE (RFC 2177). The mailbox of
+// a user is the same as with POP3. Flags other than \Deleted last for the
+// session, and UIDs are valid until the mailbox is selected again.
+type IMAPHandler struct {
+	conn  net.Conn
+	Store *MessageStore
+
+	// Authenticate verifies LOGIN. No credentials are accepted if nil.
+	Authenticate func(username, password string) bool
+
+	// IdleInterval is the interval to check the store for new messages
+	// during IDLE.
+	IdleInterval time.Duration
+}
+
+func NewIMAPHandler(conn net.Conn, store *MessageStore) *IMAPHandler {
+	return &IMAPHandler{conn: conn, Store: store, IdleInterval: time.Second}
+}
+
+type imapMessage struct {
+	StoredMessage
+	uid     int
+	seen    bool
+	deleted bool
+}
+
+func (m *imapMessage) flags() string {
+	xs := make([]string, 0, 2)
+	if m.seen {
+		xs = append(xs, `\Seen`)
+	}
+	if m.deleted {
+		xs = append(xs, `\Deleted`)
+	}
+	return "(" + strings.Join(xs, " ") + ")"
+}
+
+type imapSession struct {
+	h             *IMAPHandler
+	r             *bufio.Reader
+	w             *bufio.Writer
+	username      string
+	authenticated bool
+	selected      bool
+	readOnly      bool
+	messages      []*imapMessage
+	known         map[string]bool
+	uidNext       int
+}
+
+func (s *imapSession) reply(format string, args ...interface{}) error {
+	fmt.Fprintf(s.w, format+"\r\n", args...)
+	return s.w.Flush()
+}
+
+// imapCommand is a command line split into text parts, each but the last
+// followed by a literal.
+type imapCommand struct {
+	parts    []string
+	literals []string
+	part     int
+	pos      int
+}
+
+// trailingLiteral returns the size of the literal announced at the end of
+// the line and whether the client waits for a continuation request.
+func trailingLiteral(line string) (int, bool, bool) {
+	i := strings.LastIndexByte(line, '{')
+	if i < 0 || !strings.HasSuffix(line, "}") {
+		return 0, false, false
+	}
+	x := line[i+1 : len(line)-1]
+	sync := !strings.HasSuffix(x, "+")
+	n, err := strconv.Atoi(strings.TrimSuffix(x, "+"))
+	if err != nil || n < 0 {
+		return 0, false, false
+	}
+	return n, sync, true
+}
+
+// readCommand reads a command with its literals, sending a continuation
+// request for each synchronizing literal.
+func (s *imapSession) readCommand() (*imapCommand, error) {
+	c := &imapCommand{}
+	for {
+		line, err := s.r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		c.parts = append(c.parts, line)
+		n, sync, ok := trailingLiteral(line)
+		if !ok {
+			return c, nil
+		}
+		if n > maxIMAPLiteralSize {
+			return nil, errors.New("imap: literal too large")
+		}
+		if sync {
+			if err := s.reply("+ Ready for literal data"); err != nil {
+				return nil, err
+			}
+		}
+		b := make([]byte, n)
+		if _, err := io.ReadFull(s.r, b); err != nil {
+			return nil, err
+		}
+		c.literals = append(c.literals, string(b))
+	}
+}
+
+// parse returns the items up to the end of the command, or up to the end
+// of the list at depth > 0, as strings and []interface{} for lists.
+func (c *imapCommand) parse(depth int) ([]interface{}, error) {
+	items := make([]interface{}, 0)
+	for {
+		line := c.parts[c.part]
+		if c.pos >= len(line) {
+			if depth > 0 {
+				return nil, errIMAPSyntax
+			}
+			return items, nil
+		}
+		switch line[c.pos] {
+		case ' ':
+			c.pos++
+		case '(':
+			c.pos++
+			list, err := c.parse(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, list)
+		case ')':
+			if depth == 0 {
+				return nil, errIMAPSyntax
+			}
+			c.pos++
+			return items, nil
+		case '"':
+			x, err := c.quoted()
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, x)
+		case '{':
+			if c.part >= len(c.literals) || strings.LastIndexByte(line, '{') != c.pos {
+				return nil, errIMAPSyntax
+			}
+			items = append(items, c.literals[c.part])
+			c.part++
+			c.pos = 0
+		default:
+			items = append(items, c.atom())
+		}
+	}
+}
+
+func (c *imapCommand) quoted() (string, error) {
+	line := c.parts[c.part]
+	var b strings.Builder
+	for c.pos++; c.pos < len(line); c.pos++ {
+		switch line[c.pos] {
+		case '\\':
+			c.pos++
+			if c.pos < len(line) {
+				b.WriteByte(line[c.pos])
+			}
+		case '"':
+			c.pos++
+			return b.String(), nil
+		default:
+			b.WriteByte(line[c.pos])
+		}
+	}
+	return "", errIMAPSyntax
+}
+
+// atom reads an atom, including the section of a fetch item such as
+// BODY[HEADER.FIELDS (Subject)] as a whole.
+func (c *imapCommand) atom() string {
+	line := c.parts[c.part]
+	start, brackets := c.pos, 0
+	for ; c.pos < len(line); c.pos++ {
+		switch line[c.pos] {
+		case '[':
+			brackets++
+		case ']':
+			brackets--
+		case ' ', '(', ')':
+			if brackets <= 0 {
+				return line[start:c.pos]
+			}
+		}
+	}
+	return line[start:]
+}
+
+func imapStrings(items []interface{}) ([]string, bool) {
+	xs := make([]string, 0, len(items))
+	for _, x := range items {
+		s, ok := x.(string)
+		if !ok {
+			return nil, false
+		}
+		xs = append(xs, s)
+	}
+	return xs, true
+}
+
+// imapList returns the item as a list, wrapping a single atom.
+func imapList(item interface{}) ([]string, bool) {
+	if s, ok := item.(string); ok {
+		return []string{s}, true
+	}
+	if list, ok := item.([]interface{}); ok {
+		return imapStrings(list)
+	}
+	return nil, false
+}
+
+func (h *IMAPHandler) Run() error {
+	defer h.conn.Close()
+	s := &imapSession{h: h, r: bufio.NewReader(h.conn), w: bufio.NewWriter(h.conn)}
+	if err := s.reply("* OK IMAP4rev1 server ready"); err != nil {
+		return err
+	}
+	for {
+		c, err := s.readCommand()
+		if err != nil {
+			return err
+		}
+		tag := "*"
+		if xs := strings.Fields(c.parts[0]); len(xs) > 0 {
+			tag = xs[0]
+		}
+		items, err := c.parse(0)
+		if err != nil || len(items) < 2 {
+			if err := s.reply("%s BAD syntax error", tag); err != nil {
+				return err
+			}
+			continue
+		}
+		verb, ok := items[1].(string)
+		if _, isAtom := items[0].(string); !ok || !isAtom {
+			if err := s.reply("%s BAD syntax error", tag); err != nil {
+				return err
+			}
+			continue
+		}
+		logout, err := s.execute(tag, strings.ToUpper(verb), items[2:])
+		if err != nil || logout {
+			return err
+		}
+	}
+}
+
+func (s *imapSession) execute(tag, verb string, args []interface{}) (bool, error) {
+	switch verb {
+	case "CAPABILITY":
+		s.reply("* CAPABILITY IMAP4rev1 LITERAL+ IDLE")
+		return false, s.reply("%s OK CAPABILITY completed", tag)
+	case "NOOP", "CHECK":
+		if s.selected {
+			if err := s.poll(); err != nil {
+				return false, err
+			}
+		}
+		return false, s.reply("%s OK %s completed", tag, verb)
+	case "LOGOUT":
+		s.reply("* BYE logging out")
+		return true, s.reply("%s OK LOGOUT completed", tag)
+	case "LOGIN":
+		xs, ok := imapStrings(args)
+		if !ok || len(xs) != 2 {
+			return false, s.reply("%s BAD syntax error", tag)
+		}
+		if s.authenticated {
+			return false, s.reply("%s BAD already authenticated", tag)
+		}
+		if s.h.Authenticate == nil || !s.h.Authenticate(xs[0], xs[1]) {
+			return false, s.reply("%s NO [AUTHENTICATIONFAILED] invalid credentials", tag)
+		}
+		s.username, s.authenticated = xs[0], true
+		return false, s.reply("%s OK LOGIN completed", tag)
+	}
+	if !s.authenticated {
+		return false, s.reply("%s BAD not authenticated", tag)
+	}
+	switch verb {
+	case "LIST":
+		xs, ok := imapStrings(args)
+		if !ok || len(xs) != 2 {
+			return false, s.reply("%s BAD syntax error", tag)
+		}
+		switch strings.ToUpper(xs[1]) {
+		case "":
+			s.reply(`* LIST (\Noselect) "/" ""`)
+		case "*", "%", "INBOX":
+			s.reply(`* LIST (\HasNoChildren) "/" INBOX`)
+		}
+		return false, s.reply("%s OK LIST completed", tag)
+	case "SELECT", "EXAMINE":
+		xs, ok := imapStrings(args)
+		if !ok || len(xs) != 1 {
+			return false, s.reply("%s BAD syntax error", tag)
+		}
+		s.selected = false
+		if !strings.EqualFold(xs[0], "INBOX") {
+			return false, s.reply("%s NO no such mailbox", tag)
+		}
+		return false, s.selectInbox(tag, verb == "EXAMINE")
+	}
+	if !s.selected {
+		return false, s.reply("%s BAD no mailbox selected", tag)
+	}
+	uid := false
+	if verb == "UID" && len(args) > 0 {
+		sub, _ := args[0].(string)
+		verb, args, uid = strings.ToUpper(sub), args[1:], true
+		if verb != "FETCH" && verb != "STORE" && verb != "SEARCH" {
+			return false, s.reply("%s BAD unknown command", tag)
+		}
+	}
+	switch verb {
+	case "FETCH":
+		return false, s.fetch(tag, args, uid)
+	case "STORE":
+		return false, s.store(tag, args, uid)
+	case "SEARCH":
+		return false, s.search(tag, args, uid)
+	case "EXPUNGE":
+		if s.readOnly {
+			return false, s.reply("%s NO mailbox is read-only", tag)
+		}
+		if err := s.expunge(true); err != nil {
+			return false, s.reply("%s NO %s", tag, err)
+		}
+		return false, s.reply("%s OK EXPUNGE completed", tag)
+	case "CLOSE":
+		if !s.readOnly {
+			if err := s.expunge(false); err != nil {
+				return false, s.reply("%s NO %s", tag, err)
+			}
+		}
+		s.selected = false
+		return false, s.reply("%s OK CLOSE completed", tag)
+	case "IDLE":
+		return false, s.idle(tag)
+	}
+	return false, s.reply("%s BAD unknown command", tag)
+}
+
+func (s *imapSession) selectInbox(tag string, readOnly bool) error {
+	s.messages, s.known, s.uidNext = nil, make(map[string]bool), 1
+	xs, err := s.h.Store.List(s.username)
+	if err != nil {
+		return s.reply("%s NO %s", tag, err)
+	}
+	s.add(xs)
+	s.selected, s.readOnly = true, readOnly
+	s.reply(`* FLAGS (\Seen \Deleted)`)
+	s.reply(`* OK [PERMANENTFLAGS (\Seen \Deleted)] flags permitted`)
+	s.reply("* %d EXISTS", len(s.messages))
+	s.reply("* 0 RECENT")
+	s.reply("* OK [UIDVALIDITY %d] UIDs valid", time.Now().Unix())
+	s.reply("* OK [UIDNEXT %d] predicted next UID", s.uidNext)
+	access := "READ-WRITE"
+	if readOnly {
+		access = "READ-ONLY"
+	}
+	return s.reply("%s OK [%s] SELECT completed", tag, access)
+}
+
+// add appends the messages not seen in the session yet.
+func (s *imapSession) add(xs []StoredMessage) int {
+	n := 0
+	for _, x := range xs {
+		if s.known[x.ID] {
+			continue
+		}
+		s.known[x.ID] = true
+		s.messages = append(s.messages, &imapMessage{StoredMessage: x, uid: s.uidNext})
+		s.uidNext++
+		n++
+	}
+	return n
+}
+
+// poll reports the messages stored since the mailbox was selected.
+func (s *imapSession) poll() error {
+	xs, err := s.h.Store.List(s.username)
+	if err != nil {
+		return nil
+	}
+	if s.add(xs) > 0 {
+		return s.reply("* %d EXISTS", len(s.messages))
+	}
+	return nil
+}
+
+func (s *imapSession) idle(tag string) error {
+	if err := s.reply("+ idling"); err != nil {
+		return err
+	}
+	var line string
+	done := make(chan error, 1)
+	go func() {
+		var err error
+		line, err = s.r.ReadString('\n')
+		done <- err
+	}()
+	ticker := time.NewTicker(s.h.IdleInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case err := <-done:
+			if err != nil {
+				return err
+			}
+			if !strings.EqualFold(strings.TrimRight(line, "\r\n"), "DONE") {
+				return s.reply("%s BAD expected DONE", tag)
+			}
+			return s.reply("%s OK IDLE terminated", tag)
+		case <-ticker.C:
+			if err := s.poll(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// sequence returns the indexes of the messages in the set of sequence
+// numbers, or of UIDs if uid is set.
+func (s *imapSession) sequence(set string, uid bool) ([]int, error) {
+	max := len(s.messages)
+	if uid {
+		max = s.uidNext - 1
+	}
+	number := func(x string) (int, error) {
+		if x == "*" {
+			return max, nil
+		}
+		n, err := strconv.Atoi(x)
+		if err != nil || n < 1 {
+			return 0, errIMAPSyntax
+		}
+		return n, nil
+	}
+	ranges := make([][2]int, 0)
+	for _, x := range strings.Split(set, ",") {
+		bounds := strings.SplitN(x, ":", 2)
+		lo, err := number(bounds[0])
+		if err != nil {
+			return nil, err
+		}
+		hi := lo
+		if len(bounds) == 2 {
+			if hi, err = number(bounds[1]); err != nil {
+				return nil, err
+			}
+		}
+		if lo > hi {
+			lo, hi = hi, lo
+		}
+		ranges = append(ranges, [2]int{lo, hi})
+	}
+	xs := make([]int, 0)
+	for i, m := range s.messages {
+		n := i + 1
+		if uid {
+			n = m.uid
+		}
+		for _, r := range ranges {
+			if n >= r[0] && n <= r[1] {
+				xs = append(xs, i)
+				break
+			}
+		}
+	}
+	return xs, nil
+}
+
+func (s *imapSession) load(m *imapMessage) ([]byte, error) {
+	f, err := s.h.Store.Open(m.ID)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(f)
+}
+
+// splitMessage returns the header including the blank line, and the body.
+func splitMessage(raw []byte) ([]byte, []byte) {
+	if i := bytes.Index(raw, []byte("\r\n\r\n")); i >= 0 {
+		return raw[:i+4], raw[i+4:]
+	}
+	return raw, nil
+}
+
+// selectHeaderFields returns the fields of the header with the names,
+// followed by a blank line.
+func selectHeaderFields(header []byte, names []string) []byte {
+	lines := strings.Split(strings.TrimSuffix(string(header), "\r\n\r\n"), "\r\n")
+	var b bytes.Buffer
+	for _, x := range headerFields(lines) {
+		for _, name := range names {
+			if strings.EqualFold(headerName(x), name) {
+				b.WriteString(x + "\r\n")
+				break
+			}
+		}
+	}
+	b.WriteString("\r\n")
+	return b.Bytes()
+}
+
+// fetchSection returns the section of a BODY[section] or
+// BODY.PEEK[section] item.
+func fetchSection(item string) (string, bool, bool) {
+	upper := strings.ToUpper(item)
+	for _, prefix := range []string{"BODY[", "BODY.PEEK["} {
+		if strings.HasPrefix(upper, prefix) && strings.HasSuffix(upper, "]") {
+			return upper[len(prefix) : len(upper)-1], prefix == "BODY.PEEK[", true
+		}
+	}
+	return "", false, false
+}
+
+// fetchItem appends the item of the message to the response, loading the
+// message into raw if needed.
+func (s *imapSession) fetchItem(b *bytes.Buffer, m *imapMessage, item string, raw *[]byte) error {
+	literal := func(name string, data []byte) {
+		fmt.Fprintf(b, "%s {%d}\r\n", name, len(data))
+		b.Write(data)
+	}
+	body := func(seen bool) ([]byte, []byte, error) {
+		if *raw == nil {
+			x, err := s.load(m)
+			if err != nil {
+				return nil, nil, err
+			}
+			*raw = x
+		}
+		if seen && !s.readOnly {
+			m.seen = true
+		}
+		header, text := splitMessage(*raw)
+		return header, text, nil
+	}
+	switch item {
+	case "UID":
+		fmt.Fprintf(b, "UID %d", m.uid)
+	case "FLAGS":
+		fmt.Fprintf(b, "FLAGS %s", m.flags())
+	case "RFC822.SIZE":
+		fmt.Fprintf(b, "RFC822.SIZE %d", m.Size)
+	case "INTERNALDATE":
+		fmt.Fprintf(b, `INTERNALDATE "%s"`, m.Received.Format("02-Jan-2006 15:04:05 -0700"))
+	case "RFC822", "RFC822.HEADER", "RFC822.TEXT":
+		header, text, err := body(item != "RFC822.HEADER")
+		if err != nil {
+			return err
+		}
+		switch item {
+		case "RFC822":
+			literal(item, *raw)
+		case "RFC822.HEADER":
+			literal(item, header)
+		default:
+			literal(item, text)
+		}
+	default:
+		section, peek, ok := fetchSection(item)
+		if !ok {
+			return errIMAPSyntax
+		}
+		header, text, err := body(!peek)
+		if err != nil {
+			return err
+		}
+		name := "BODY[" + section + "]"
+		switch {
+		case section == "":
+			literal(name, *raw)
+		case section == "HEADER":
+			literal(name, header)
+		case section == "TEXT":
+			literal(name, text)
+		case strings.HasPrefix(section, "HEADER.FIELDS (") && strings.HasSuffix(section, ")"):
+			names := strings.Fields(section[len("HEADER.FIELDS (") : len(section)-1])
+			literal(name, selectHeaderFields(header, names))
+		default:
+			return errIMAPSyntax
+		}
+	}
+	return nil
+}
+
+func (s *imapSession) fetch(tag string, args []interface{}, uid bool) error {
+	if len(args) != 2 {
+		return s.reply("%s BAD syntax error", tag)
+	}
+	set, _ := args[0].(string)
+	indexes, err := s.sequence(set, uid)
+	if err != nil {
+		return s.reply("%s BAD syntax error", tag)
+	}
+	items, ok := imapList(args[1])
+	if !ok {
+		return s.reply("%s BAD syntax error", tag)
+	}
+	attrs := make([]string, 0, len(items)+1)
+	if uid {
+		attrs = append(attrs, "UID")
+	}
+	for _, x := range items {
+		x = strings.ToUpper(x)
+		switch x {
+		case "FAST":
+			attrs = append(attrs, "FLAGS", "INTERNALDATE", "RFC822.SIZE")
+		case "UID":
+			if !uid {
+				attrs = append(attrs, x)
+			}
+		default:
+			attrs = append(attrs, x)
+		}
+	}
+	for _, i := range indexes {
+		m := s.messages[i]
+		seen := m.seen
+		var raw []byte
+		var b bytes.Buffer
+		fmt.Fprintf(&b, "* %d FETCH (", i+1)
+		for j, x := range attrs {
+			if j > 0 {
+				b.WriteByte(' ')
+			}
+			if err := s.fetchItem(&b, m, x, &raw); err == errIMAPSyntax {
+				return s.reply("%s BAD unsupported fetch item %s", tag, x)
+			} else if err != nil {
+				return s.reply("%s NO %s", tag, err)
+			}
+		}
+		if m.seen != seen {
+			fmt.Fprintf(&b, " FLAGS %s", m.flags())
+		}
+		b.WriteString(")")
+		if err := s.reply("%s", b.String()); err != nil {
+			return err
+		}
+	}
+	return s.reply("%s OK FETCH completed", tag)
+}
+
+func (s *imapSession) store(tag string, args []interface{}, uid bool) error {
+	if len(args) != 3 {
+		return s.reply("%s BAD syntax error", tag)
+	}
+	if s.readOnly {
+		return s.reply("%s NO mailbox is read-only", tag)
+	}
+	set, _ := args[0].(string)
+	item, _ := args[1].(string)
+	flags, ok := imapList(args[2])
+	indexes, err := s.sequence(set, uid)
+	if !ok || err != nil {
+		return s.reply("%s BAD syntax error", tag)
+	}
+	item = strings.ToUpper(item)
+	silent := strings.HasSuffix(item, ".SILENT")
+	item = strings.TrimSuffix(item, ".SILENT")
+	if item != "FLAGS" && item != "+FLAGS" && item != "-FLAGS" {
+		return s.reply("%s BAD syntax error", tag)
+	}
+	for _, i := range indexes {
+		m := s.messages[i]
+		value := item != "-FLAGS"
+		if item == "FLAGS" {
+			m.seen, m.deleted = false, false
+		}
+		for _, x := range flags {
+			switch strings.ToLower(x) {
+			case `\seen`:
+				m.seen = value
+			case `\deleted`:
+				m.deleted = value
+			}
+		}
+		if silent {
+			continue
+		}
+		var err error
+		if uid {
+			err = s.reply("* %d FETCH (UID %d FLAGS %s)", i+1, m.uid, m.flags())
+		} else {
+			err = s.reply("* %d FETCH (FLAGS %s)", i+1, m.flags())
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return s.reply("%s OK STORE completed", tag)
+}
+
+// searchKey returns the predicate of the search key at args[0] and the
+// number of arguments it takes.
+func (s *imapSession) searchKey(args []interface{}) (func(i int) bool, int, error) {
+	key, ok := args[0].(string)
+	if !ok {
+		return nil, 0, errIMAPSyntax
+	}
+	argument := func() (string, error) {
+		if len(args) < 2 {
+			return "", errIMAPSyntax
+		}
+		x, ok := args[1].(string)
+		if !ok {
+			return "", errIMAPSyntax
+		}
+		return x, nil
+	}
+	contains := func(f func(raw []byte) string) (func(i int) bool, int, error) {
+		x, err := argument()
+		if err != nil {
+			return nil, 0, err
+		}
+		x = strings.ToLower(x)
+		return func(i int) bool {
+			raw, err := s.load(s.messages[i])
+			return err == nil && strings.Contains(strings.ToLower(f(raw)), x)
+		}, 2, nil
+	}
+	header := func(name string) func(raw []byte) string {
+		return func(raw []byte) string {
+			msg, err := mail.ReadMessage(bytes.NewReader(raw))
+			if err != nil {
+				return ""
+			}
+			return msg.Header.Get(name)
+		}
+	}
+	switch strings.ToUpper(key) {
+	case "ALL":
+		return func(i int) bool { return true }, 1, nil
+	case "SEEN":
+		return func(i int) bool { return s.messages[i].seen }, 1, nil
+	case "UNSEEN":
+		return func(i int) bool { return !s.messages[i].seen }, 1, nil
+	case "DELETED":
+		return func(i int) bool { return s.messages[i].deleted }, 1, nil
+	case "UNDELETED":
+		return func(i int) bool { return !s.messages[i].deleted }, 1, nil
+	case "FROM", "TO", "CC", "SUBJECT":
+		return contains(header(key))
+	case "BODY":
+		return contains(func(raw []byte) string {
+			_, text := splitMessage(raw)
+			return string(text)
+		})
+	case "TEXT":
+		return contains(func(raw []byte) string { return string(raw) })
+	case "UID":
+		x, err := argument()
+		if err != nil {
+			return nil, 0, err
+		}
+		f, err := s.inSequence(x, true)
+		return f, 2, err
+	}
+	f, err := s.inSequence(key, false)
+	return f, 1, err
+}
+
+func (s *imapSession) inSequence(set string, uid bool) (func(i int) bool, error) {
+	indexes, err := s.sequence(set, uid)
+	if err != nil {
+		return nil, err
+	}
+	members := make(map[int]bool)
+	for _, x := range indexes {
+		members[x] = true
+	}
+	return func(i int) bool { return members[i] }, nil
+}
+
+func (s *imapSession) search(tag string, args []interface{}, uid bool) error {
+	if len(args) >= 2 {
+		if x, ok := args[0].(string); ok && strings.EqualFold(x, "CHARSET") {
+			args = args[2:]
+		}
+	}
+	keys := make([]func(i int) bool, 0)
+	for len(args) > 0 {
+		f, n, err := s.searchKey(args)
+		if err != nil {
+			return s.reply("%s BAD unsupported search criteria", tag)
+		}
+		keys = append(keys, f)
+		args = args[n:]
+	}
+	xs := []string{"* SEARCH"}
+	for i, m := range s.messages {
+		matched := true
+		for _, f := range keys {
+			if !f(i) {
+				matched = false
+				break
+			}
+		}
+		if !matched {
+			continue
+		}
+		if uid {
+			xs = append(xs, strconv.Itoa(m.uid))
+		} else {
+			xs = append(xs, strconv.Itoa(i+1))
+		}
+	}
+	if err := s.reply("%s", strings.Join(xs, " ")); err != nil {
+		return err
+	}
+	return s.reply("%s OK SEARCH completed", tag)
+}
+
+// expunge removes the messages flagged as deleted from the store, reporting
+// each sequence number if report is set.
+func (s *imapSession) expunge(report bool) error {
+	kept := make([]*imapMessage, 0, len(s.messages))
+	n := 0
+	for i, m := range s.messages {
+		if !m.deleted {
+			kept = append(kept, m)
+			continue
+		}
+		if err := s.h.Store.Delete(m.ID); err != nil {
+			s.messages = append(kept, s.messages[i:]...)
+			return err
+		}
+		if report {
+			s.reply("* %d EXPUNGE", i+1-n)
+		}
+		n++
+	}
+	s.messages = kept
+	return nil
+}
@@ -0,0 +1,169 @@
+package smtp
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+type imapClient struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func (c *imapClient) readLine() string {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	line = strings.TrimRight(line, "\r\n")
+	// inline literals
+	if n, _, ok := trailingLiteral(line); ok {
+		b := make([]byte, n)
+		if _, err := io.ReadFull(c.r, b); err != nil {
+			c.t.Fatal(err)
+		}
+		line = line[:strings.LastIndexByte(line, '{')] + fmt.Sprintf("%q", b) + c.readLine()
+	}
+	return line
+}
+
+// command sends the command and returns the untagged responses and the
+// tagged one.
+func (c *imapClient) command(tag, s string) ([]string, string) {
+	fmt.Fprintf(c.conn, "%s %s\r\n", tag, s)
+	xs := make([]string, 0)
+	for {
+		line := c.readLine()
+		if strings.HasPrefix(line, tag+" ") {
+			return xs, line
+		}
+		xs = append(xs, line)
+	}
+}
+
+func TestIMAPHandler(t *testing.T) {
+	store, err := NewMessageStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	storeMessage(t, store, []string{"user1@example.net"}, "one\r\n")
+	storeMessage(t, store, []string{"user2@example.net"}, "two\r\n")
+	id3 := storeMessage(t, store, []string{"user1@example.net"}, "three\r\n")
+
+	server, client := net.Pipe()
+	h := NewIMAPHandler(server, store)
+	h.Authenticate = func(username, password string) bool {
+		return password == "secret"
+	}
+	h.IdleInterval = 10 * time.Millisecond
+	done := make(chan error)
+	go func() {
+		done <- h.Run()
+	}()
+	c := &imapClient{t: t, conn: client, r: bufio.NewReader(client)}
+	defer client.Close()
+	if line := c.readLine(); !strings.HasPrefix(line, "* OK") {
+		t.Fatalf("unexpected greeting: %s", line)
+	}
+
+	for _, fixture := range []struct {
+		command  string
+		expected string
+	}{
+		{"SELECT INBOX", "a BAD"},
+		{"LOGIN user1@example.net wrong", "a NO [AUTHENTICATIONFAILED]"},
+		{`LOGIN "user1@example.net" "secret"`, "a OK"},
+		{"FETCH 1 FLAGS", "a BAD"},
+		{"SELECT Trash", "a NO"},
+		{"SELECT INBOX", "a OK [READ-WRITE]"},
+		{"FETCH 1 (ENVELOPE)", "a BAD"},
+		{"FETCH x FLAGS", "a BAD"},
+		{"FOO", "a BAD"},
+	} {
+		if _, line := c.command("a", fixture.command); !strings.HasPrefix(line, fixture.expected) {
+			t.Errorf("expected: %s, actual: %s (%s)", fixture.expected, line, fixture.command)
+		}
+	}
+
+	xs, _ := c.command("b", "FETCH 1:* (FLAGS RFC822.SIZE)")
+	expected := []string{
+		"* 1 FETCH (FLAGS () RFC822.SIZE 23)",
+		"* 2 FETCH (FLAGS () RFC822.SIZE 25)",
+	}
+	if strings.Join(xs, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("expected: %v, actual: %v", expected, xs)
+	}
+	xs, _ = c.command("c", "FETCH 1 (BODY.PEEK[HEADER.FIELDS (SUBJECT)] BODY[TEXT])")
+	expected = []string{
+		`* 1 FETCH (BODY[HEADER.FIELDS (SUBJECT)] "Subject: Hello\r\n\r\n" BODY[TEXT] "one\r\n" FLAGS (\Seen))`,
+	}
+	if strings.Join(xs, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("expected: %v, actual: %v", expected, xs)
+	}
+	xs, _ = c.command("d", "UID FETCH 2 BODY[]")
+	expected = []string{
+		`* 2 FETCH (UID 2 BODY[] "Subject: Hello\r\n\r\nthree\r\n" FLAGS (\Seen))`,
+	}
+	if strings.Join(xs, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("expected: %v, actual: %v", expected, xs)
+	}
+
+	if xs, _ = c.command("e", "SEARCH UNSEEN"); len(xs) != 1 || xs[0] != "* SEARCH" {
+		t.Errorf("unexpected search: %v", xs)
+	}
+	if xs, _ = c.command("e", "UID SEARCH TEXT three"); len(xs) != 1 || xs[0] != "* SEARCH 2" {
+		t.Errorf("unexpected search: %v", xs)
+	}
+	if xs, _ = c.command("e", "SEARCH SUBJECT hello 2"); len(xs) != 1 || xs[0] != "* SEARCH 2" {
+		t.Errorf("unexpected search: %v", xs)
+	}
+
+	xs, line := c.command("f", `STORE 1 +FLAGS (\Deleted)`)
+	if len(xs) != 1 || xs[0] != `* 1 FETCH (FLAGS (\Seen \Deleted))` || !strings.HasPrefix(line, "f OK") {
+		t.Errorf("unexpected store: %v %s", xs, line)
+	}
+	if xs, _ = c.command("g", "EXPUNGE"); len(xs) != 1 || xs[0] != "* 1 EXPUNGE" {
+		t.Errorf("unexpected expunge: %v", xs)
+	}
+	if xs, _ := store.List("user1@example.net"); len(xs) != 1 || xs[0].ID != id3 {
+		t.Errorf("unexpected list: %v", xs)
+	}
+
+	fmt.Fprintf(client, "h IDLE\r\n")
+	if line := c.readLine(); !strings.HasPrefix(line, "+") {
+		t.Errorf("expected: +, actual: %s", line)
+	}
+	storeMessage(t, store, []string{"user1@example.net"}, "four\r\n")
+	if line := c.readLine(); line != "* 2 EXISTS" {
+		t.Errorf("expected: * 2 EXISTS, actual: %s", line)
+	}
+	fmt.Fprintf(client, "DONE\r\n")
+	if line := c.readLine(); !strings.HasPrefix(line, "h OK") {
+		t.Errorf("expected: h OK, actual: %s", line)
+	}
+	if xs, _ = c.command("i", "UID FETCH 3 UID"); len(xs) != 1 || xs[0] != "* 2 FETCH (UID 3)" {
+		t.Errorf("unexpected fetch: %v", xs)
+	}
+
+	fmt.Fprintf(client, "j LOGIN {4}\r\n")
+	if line := c.readLine(); !strings.HasPrefix(line, "+") {
+		t.Errorf("expected: +, actual: %s", line)
+	}
+	fmt.Fprintf(client, "user {6+}\r\nsecret\r\n")
+	if line := c.readLine(); !strings.HasPrefix(line, "j BAD already authenticated") {
+		t.Errorf("expected: j BAD already authenticated, actual: %s", line)
+	}
+
+	if _, line := c.command("z", "LOGOUT"); !strings.HasPrefix(line, "z OK") {
+		t.Errorf("expected: z OK, actual: %s", line)
+	}
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,264 @@
+package smtp
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/mail"
+	netsmtp "net/smtp"
+	"strings"
+)
+
+var ErrNoRecipients = errors.New("smtp: no recipients")
+
+// MboxMessage is a message of an mbox archive with the sender of its
+// "From " line.
+type MboxMessage struct {
+	Sender string
+	Data   []byte
+}
+
+// IsMbox reports whether the data is an mbox archive rather than a
+// message, i.e. begins with a "From " line.
+func IsMbox(data []byte) bool {
+	return bytes.HasPrefix(data, []byte("From "))
+}
+
+// ReadMbox splits an mbox archive into its messages, unescaping the lines
+// quoted as ">From " in the mboxrd format.
+func ReadMbox(r io.Reader) ([]MboxMessage, error) {
+	xs := make([]MboxMessage, 0)
+	var cur *MboxMessage
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadString('\n')
+		if len(line) > 0 {
+			text := strings.TrimRight(line, "\r\n")
+			if strings.HasPrefix(text, "From ") {
+				xs = append(xs, MboxMessage{})
+				cur = &xs[len(xs)-1]
+				if fields := strings.Fields(text); len(fields) > 1 && fields[1] != "MAILER-DAEMON" {
+					cur.Sender = fields[1]
+				}
+			} else if cur != nil {
+				if t := strings.TrimLeft(text, ">"); len(t) < len(text) && strings.HasPrefix(t, "From ") {
+					text = text[1:]
+				}
+				cur.Data = append(append(cur.Data, text...), crlf...)
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	for i := range xs {
+		// the blank line before the next "From " line is the separator
+		xs[i].Data = bytes.TrimSuffix(xs[i].Data, crlf)
+	}
+	return xs, nil
+}
+
+// ParseMessage returns the state of a transaction of the message. The
+// sender is from, or the address of Return-Path or From if empty, and the
+// recipients are to, or the addresses of To, Cc and Bcc if empty.
+func ParseMessage(data []byte, from string, to []string) (*SMTPState, error) {
+	m, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if len(from) == 0 {
+		if x := m.Header.Get("Return-Path"); len(x) > 0 {
+			from = strings.Trim(strings.TrimSpace(x), "<>")
+		} else if addrs, err := mail.ParseAddressList(m.Header.Get("From")); err == nil && len(addrs) > 0 {
+			from = addrs[0].Address
+		}
+	}
+	if len(to) == 0 {
+		for _, k := range []string{"To", "Cc", "Bcc"} {
+			addrs, _ := mail.ParseAddressList(m.Header.Get(k))
+			for _, x := range addrs {
+				to = append(to, x.Address)
+			}
+		}
+	}
+	if len(to) == 0 {
+		return nil, ErrNoRecipients
+	}
+	st := &SMTPState{ReturnTo: from, Recipients: to, Headers: make([]string, 0)}
+	br := bufio.NewReader(bytes.NewReader(data))
+	for {
+		line, err := br.ReadString('\n')
+		line = strings.TrimRight(line, "\r\n")
+		if len(strings.TrimSpace(line)) == 0 || err != nil {
+			break
+		}
+		st.Headers = append(st.Headers, line)
+	}
+	var body bytes.Buffer
+	for {
+		line, err := br.ReadString('\n')
+		if len(line) > 0 {
+			body.WriteString(strings.TrimRight(line, "\r\n"))
+			body.Write(crlf)
+		}
+		if err != nil {
+			break
+		}
+	}
+	st.SetContent(body.Bytes())
+	if id, ok := headerValue(st.Headers, "Message-ID"); ok {
+		st.MessageID = id
+	}
+	return st, nil
+}
+
+// Importer adds messages of .eml files or mbox archives to Store, or
+// passes them through the pipeline of a session of Config and Send, with
+// the hooks, policy and sinks, so test fixtures can be loaded before a
+// run. The pipeline is that of the server at Addr if set.
+type Importer struct {
+	Store  *MessageStore
+	Config *SMTPConfig
+	Send   func(st *SMTPState) error
+	Addr   string
+}
+
+// Import adds the message or the messages of the mbox archive, and
+// returns their IDs in the store, or their queue IDs through the
+// pipeline.
+func (im *Importer) Import(data []byte, from string, to []string, pipeline bool) ([]string, error) {
+	msgs := []MboxMessage{{Data: data}}
+	if IsMbox(data) {
+		var err error
+		if msgs, err = ReadMbox(bytes.NewReader(data)); err != nil {
+			return nil, err
+		}
+	}
+	ids := make([]string, 0, len(msgs))
+	for _, x := range msgs {
+		sender := from
+		if len(sender) == 0 {
+			sender = x.Sender
+		}
+		st, err := ParseMessage(x.Data, sender, to)
+		if err != nil {
+			return ids, err
+		}
+		var id string
+		if pipeline {
+			id, err = im.inject(st)
+		} else {
+			id, err = im.Store.Put(st)
+		}
+		st.Close()
+		if err != nil {
+			return ids, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// inject sends the message through a session over a pipe, or to Addr,
+// and returns the queue ID of the reply.
+func (im *Importer) inject(st *SMTPState) (string, error) {
+	if len(im.Addr) > 0 {
+		c, err := netsmtp.Dial(im.Addr)
+		if err != nil {
+			return "", err
+		}
+		defer c.Close()
+		return SendMessage(c, "localhost", st)
+	}
+	client, server := net.Pipe()
+	h := NewSMTPHandler(server, im.Send)
+	if im.Config != nil {
+		h.Config = im.Config
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		h.Run()
+	}()
+	defer func() {
+		client.Close()
+		<-done
+	}()
+	c, err := netsmtp.NewClient(client, "localhost")
+	if err != nil {
+		return "", err
+	}
+	return SendMessage(c, "localhost", st)
+}
+
+// SendMessage sends the message of the transaction through the client and
+// returns the text of the reply to the message, e.g. with its queue ID.
+func SendMessage(c *netsmtp.Client, helloName string, st *SMTPState) (string, error) {
+	if err := c.Hello(helloName); err != nil {
+		return "", err
+	}
+	if err := c.Mail(st.ReturnTo); err != nil {
+		return "", err
+	}
+	for _, x := range st.Recipients {
+		if err := c.Rcpt(x); err != nil {
+			return "", err
+		}
+	}
+	id, err := c.Text.Cmd("DATA")
+	if err != nil {
+		return "", err
+	}
+	c.Text.StartResponse(id)
+	_, _, err = c.Text.ReadResponse(354)
+	c.Text.EndResponse(id)
+	if err != nil {
+		return "", err
+	}
+	w := c.Text.DotWriter()
+	if _, err := io.Copy(w, st.messageReader()); err != nil {
+		return "", err
+	}
+	if err := w.Close(); err != nil {
+		return "", err
+	}
+	_, msg, err := c.Text.ReadResponse(250)
+	if err != nil {
+		return "", err
+	}
+	c.Quit()
+	if i := strings.Index(msg, "queued as "); i >= 0 {
+		return msg[i+len("queued as "):], nil
+	}
+	return msg, nil
+}
+
+// ServeHTTP imports the .eml or mbox archive of the body on POST, with
+// the sender of the parameter from and the recipients of to, which may be
+// repeated, and through the pipeline if the parameter pipeline is true,
+// and replies the IDs as JSON. The messages before a failure are kept.
+func (im *Importer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	q := r.URL.Query()
+	ids, err := im.Import(data, q.Get("from"), q["to"], q.Get("pipeline") == "true")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"ids": ids})
+}
@@ -0,0 +1,108 @@
+package smtp
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const testMbox = "From foo@example.net Mon Jan  1 00:00:00 2024\n" +
+	"From: Foo <foo@example.net>\n" +
+	"To: user1@example.com, User 2 <user2@example.com>\n" +
+	"Subject: First\n" +
+	"\n" +
+	">From the archive\n" +
+	"\n" +
+	"From MAILER-DAEMON Mon Jan  1 00:00:01 2024\n" +
+	"From: Bar <bar@example.net>\n" +
+	"To: user3@example.com\n" +
+	"Subject: Second\n" +
+	"\n" +
+	"Hello\n"
+
+func TestReadMbox(t *testing.T) {
+	xs, err := ReadMbox(strings.NewReader(testMbox))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(xs) != 2 || xs[0].Sender != "foo@example.net" || xs[1].Sender != "" {
+		t.Fatalf("unexpected messages: %v", xs)
+	}
+	if !strings.HasSuffix(string(xs[0].Data), "\r\n\r\nFrom the archive\r\n") {
+		t.Errorf("unexpected data: %q", xs[0].Data)
+	}
+}
+
+func TestParseMessage(t *testing.T) {
+	data := []byte("Return-Path: <bounce@example.net>\r\n" +
+		"From: foo@example.net\r\n" +
+		"Cc: user1@example.com\r\n" +
+		"Subject: Hi\r\n" +
+		"\r\n" +
+		"Hello\n")
+	st, err := ParseMessage(data, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.ReturnTo != "bounce@example.net" || strings.Join(st.Recipients, ",") != "user1@example.com" {
+		t.Errorf("unexpected envelope: %s %v", st.ReturnTo, st.Recipients)
+	}
+	if b, _ := io.ReadAll(st.Content()); len(st.Headers) != 4 || string(b) != "Hello\r\n" {
+		t.Errorf("unexpected message: %v %q", st.Headers, b)
+	}
+	if _, err := ParseMessage([]byte("Subject: Hi\r\n\r\nHello\r\n"), "", nil); err != ErrNoRecipients {
+		t.Errorf("expected: %v, actual: %v", ErrNoRecipients, err)
+	}
+}
+
+func TestImporter(t *testing.T) {
+	store, err := NewMessageStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	im := &Importer{Store: store}
+	ids, err := im.Import([]byte(testMbox), "", []string{"fixture@example.com"}, false)
+	if err != nil || len(ids) != 2 {
+		t.Fatalf("unexpected import: %v, %v", ids, err)
+	}
+	msg, _ := store.Get(ids[0])
+	if msg.ReturnTo != "foo@example.net" || msg.Subject != "First" || msg.Recipients[0] != "fixture@example.com" {
+		t.Errorf("unexpected message: %v", msg)
+	}
+
+	var hooked []string
+	im.Config = &SMTPConfig{Hooks: &Hooks{}}
+	im.Config.Hooks.OnRcpt(func(conn *SMTPConnection, rcpt Address) string {
+		hooked = append(hooked, rcpt.String())
+		if rcpt.Domain == "example.com" && rcpt.LocalPart == "user3" {
+			return "550 5.1.1 No such user"
+		}
+		return ""
+	})
+	im.Send = store.Publish
+	w := httptest.NewRecorder()
+	im.ServeHTTP(w, httptest.NewRequest("POST", "/messages/import?pipeline=true", strings.NewReader(testMbox)))
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "No such user") {
+		t.Errorf("unexpected response: %d %s", w.Code, w.Body.String())
+	}
+	if strings.Join(hooked, " ") != "user1@example.com user2@example.com user3@example.com" {
+		t.Errorf("unexpected hooks: %v", hooked)
+	}
+
+	w = httptest.NewRecorder()
+	eml := "From: foo@example.net\r\nTo: user1@example.com\r\nSubject: Piped\r\n\r\nHello\r\n"
+	im.ServeHTTP(w, httptest.NewRequest("POST", "/messages/import?pipeline=true", strings.NewReader(eml)))
+	var res struct {
+		IDs []string `json:"ids"`
+	}
+	json.NewDecoder(w.Body).Decode(&res)
+	if w.Code != http.StatusOK || len(res.IDs) != 1 {
+		t.Fatalf("unexpected response: %d %v", w.Code, res)
+	}
+	if msg, err := store.Get(res.IDs[0]); err != nil || msg.Subject != "Piped" {
+		t.Errorf("expected the message stored by the queue ID: %v %v", msg, err)
+	}
+}
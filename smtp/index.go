@@ -0,0 +1,199 @@
+package smtp
+
+import (
+	"sort"
+	"strings"
+)
+
+// messageIndex looks up the envelopes of a MessageStore by sender,
+// recipient, subject and tenant without reading every envelope file. Each
+// list of IDs is sorted, i.e. in the order of arrival.
+type messageIndex struct {
+	msgs     map[string]StoredMessage
+	ids      []string
+	from     map[string][]string
+	to       map[string][]string
+	subjects map[string][]string
+	tenants  map[string][]string
+
+	// dedup maps the keys of the messages which are not duplicates to
+	// their IDs.
+	dedup map[string]string
+}
+
+func newMessageIndex() *messageIndex {
+	return &messageIndex{
+		msgs:     make(map[string]StoredMessage),
+		from:     make(map[string][]string),
+		to:       make(map[string][]string),
+		subjects: make(map[string][]string),
+		tenants:  make(map[string][]string),
+		dedup:    make(map[string]string),
+	}
+}
+
+func insertID(ids []string, id string) []string {
+	i := sort.SearchStrings(ids, id)
+	if i < len(ids) && ids[i] == id {
+		return ids
+	}
+	ids = append(ids, "")
+	copy(ids[i+1:], ids[i:])
+	ids[i] = id
+	return ids
+}
+
+func removeID(ids []string, id string) []string {
+	i := sort.SearchStrings(ids, id)
+	if i == len(ids) || ids[i] != id {
+		return ids
+	}
+	return append(ids[:i], ids[i+1:]...)
+}
+
+// keys returns the keys of the message in each secondary index.
+func (idx *messageIndex) keys(msg StoredMessage) []struct {
+	m   map[string][]string
+	key string
+} {
+	xs := []struct {
+		m   map[string][]string
+		key string
+	}{
+		{idx.from, strings.ToLower(msg.ReturnTo)},
+		{idx.subjects, strings.ToLower(msg.Subject)},
+	}
+	for _, x := range msg.Recipients {
+		xs = append(xs, struct {
+			m   map[string][]string
+			key string
+		}{idx.to, strings.ToLower(x)})
+	}
+	for _, x := range msg.Tenants {
+		xs = append(xs, struct {
+			m   map[string][]string
+			key string
+		}{idx.tenants, x})
+	}
+	return xs
+}
+
+func (idx *messageIndex) add(msg StoredMessage) {
+	if _, ok := idx.msgs[msg.ID]; ok {
+		idx.remove(msg.ID)
+	}
+	idx.msgs[msg.ID] = msg
+	idx.ids = insertID(idx.ids, msg.ID)
+	for _, x := range idx.keys(msg) {
+		x.m[x.key] = insertID(x.m[x.key], msg.ID)
+	}
+	if len(msg.DedupKey) > 0 && len(msg.DuplicateOf) == 0 {
+		idx.dedup[msg.DedupKey] = msg.ID
+	}
+}
+
+func (idx *messageIndex) remove(id string) {
+	msg, ok := idx.msgs[id]
+	if !ok {
+		return
+	}
+	delete(idx.msgs, id)
+	idx.ids = removeID(idx.ids, id)
+	for _, x := range idx.keys(msg) {
+		if ids := removeID(x.m[x.key], id); len(ids) > 0 {
+			x.m[x.key] = ids
+		} else {
+			delete(x.m, x.key)
+		}
+	}
+	if idx.dedup[msg.DedupKey] == id {
+		delete(idx.dedup, msg.DedupKey)
+	}
+}
+
+// candidates returns the sorted IDs of the messages which may match the
+// query, from the narrowest index of the tenant, the sender, a recipient
+// and the subject.
+func (idx *messageIndex) candidates(q MessageQuery) []string {
+	ids := idx.ids
+	narrow := func(xs []string) {
+		if len(xs) < len(ids) {
+			ids = xs
+		}
+	}
+	if q.Tenant != nil {
+		narrow(idx.tenants[*q.Tenant])
+	}
+	if len(q.From) > 0 {
+		narrow(idx.from[strings.ToLower(q.From)])
+	}
+	if len(q.To) > 0 {
+		narrow(idx.to[strings.ToLower(q.To)])
+	}
+	if len(q.Subject) > 0 {
+		// subjects repeat in captured mail, so there are far fewer of
+		// them than messages
+		sub := strings.ToLower(q.Subject)
+		var xs []string
+		for k, v := range idx.subjects {
+			if strings.Contains(k, sub) {
+				xs = append(xs, v...)
+			}
+		}
+		sort.Strings(xs)
+		narrow(xs)
+	}
+	return ids
+}
+
+func (idx *messageIndex) messages(ids []string) []StoredMessage {
+	xs := make([]StoredMessage, len(ids))
+	for i, id := range ids {
+		xs[i] = idx.msgs[id]
+	}
+	return xs
+}
+
+// loadIndex returns the index, building it from the envelope files on the
+// first call. s.mtx must be held.
+func (s *MessageStore) loadIndex() (*messageIndex, error) {
+	if s.index != nil {
+		return s.index, nil
+	}
+	xs, err := s.listFiles()
+	if err != nil {
+		return nil, err
+	}
+	idx := newMessageIndex()
+	for _, x := range xs {
+		idx.add(x)
+	}
+	s.index = idx
+	return idx, nil
+}
+
+// Reindex rebuilds the index from the envelope files, e.g. after they are
+// changed by another process.
+func (s *MessageStore) Reindex() error {
+	defer s.mtx.Unlock()
+	s.mtx.Lock()
+	s.index = nil
+	_, err := s.loadIndex()
+	return err
+}
+
+func (s *MessageStore) indexAdd(msg StoredMessage) {
+	defer s.mtx.Unlock()
+	s.mtx.Lock()
+	if s.index != nil {
+		s.index.add(msg)
+	}
+}
+
+func (s *MessageStore) indexRemove(id string) {
+	defer s.mtx.Unlock()
+	s.mtx.Lock()
+	if s.index != nil {
+		s.index.remove(id)
+	}
+}
@@ -0,0 +1,74 @@
+package smtp
+
+import (
+	"fmt"
+	"os"
+	"testing"
+)
+
+func TestMessageIndex(t *testing.T) {
+	s, err := NewMessageStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	put := func(from, to, subject string) string {
+		st := &SMTPState{ReturnTo: from, Recipients: []string{to}}
+		st.Headers = []string{"Subject: " + subject}
+		st.SetContent([]byte("Hello\r\n"))
+		id, err := s.Put(st)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return id
+	}
+	for i := 0; i < 10; i++ {
+		put("foo@example.net", fmt.Sprintf("user%d@example.com", i%3), "Newsletter")
+	}
+	// the index is built by the first lookup, then kept up to date
+	xs, _ := s.List("user1@example.com")
+	if len(xs) != 3 {
+		t.Errorf("expected 3 messages: %v", xs)
+	}
+	id := put("bar@example.net", "User1@example.com", "Password reset")
+	xs, _ = s.List("user1@example.com")
+	if len(xs) != 4 || xs[3].ID != id {
+		t.Errorf("expected the new message: %v", xs)
+	}
+
+	idx := s.index
+	for _, fixture := range []struct {
+		q        MessageQuery
+		expected int
+	}{
+		{MessageQuery{}, 11},
+		{MessageQuery{From: "BAR@example.net"}, 1},
+		{MessageQuery{To: "user2@example.com"}, 3},
+		{MessageQuery{To: "user1@example.com", Subject: "reset"}, 1},
+		{MessageQuery{Subject: "none"}, 0},
+	} {
+		if actual := len(idx.candidates(fixture.q)); actual != fixture.expected {
+			t.Errorf("%v expected: %d, actual: %d", fixture.q, fixture.expected, actual)
+		}
+	}
+
+	s.Delete(id)
+	if len(idx.from["bar@example.net"]) != 0 || len(idx.subjects["password reset"]) != 0 {
+		t.Errorf("unexpected keys of the deleted message")
+	}
+	if page, _ := s.Query(MessageQuery{To: "user1@example.com"}); len(page.Messages) != 3 {
+		t.Errorf("expected 3 messages: %v", page.Messages)
+	}
+
+	// changed by another store of the directory
+	other := &MessageStore{Dir: s.Dir}
+	other.Delete(xs[0].ID)
+	if _, err := os.Stat(other.path(xs[0].ID, ".json")); !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	if err := s.Reindex(); err != nil {
+		t.Fatal(err)
+	}
+	if xs, _ := s.List("user1@example.com"); len(xs) != 2 {
+		t.Errorf("expected 2 messages: %v", xs)
+	}
+}
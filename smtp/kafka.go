@@ -0,0 +1,292 @@
+package smtp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// KafkaSink publishes each message to a Kafka topic with acks=all, keyed
+// and partitioned by the recipient domain. It speaks the Kafka protocol
+// directly with Metadata v0 and Produce v3 requests.
+type KafkaSink struct {
+	Brokers  []string
+	Topic    string
+	ClientID string
+	Timeout  time.Duration
+
+	correlationID int32
+	mtx           sync.Mutex
+}
+
+func NewKafkaSink(brokers []string, topic string) *KafkaSink {
+	return &KafkaSink{
+		Brokers:  brokers,
+		Topic:    topic,
+		ClientID: "mproxy",
+		Timeout:  10 * time.Second,
+	}
+}
+
+type kafkaPartition struct {
+	id     int32
+	leader string
+}
+
+func (k *KafkaSink) Publish(st *SMTPState) error {
+	records, err := sinkRecords(st)
+	if err != nil {
+		return err
+	}
+	defer k.mtx.Unlock()
+	k.mtx.Lock()
+	partitions, err := k.metadata()
+	if err != nil {
+		return err
+	}
+	for _, r := range records {
+		p := partitions[crc32.ChecksumIEEE([]byte(r.key))%uint32(len(partitions))]
+		if err := k.produce(p, r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (k *KafkaSink) request(addr string, apiKey, apiVersion int16, body []byte) ([]byte, error) {
+	conn, err := net.DialTimeout("tcp", addr, k.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(k.Timeout))
+	k.correlationID++
+	var b kafkaEncoder
+	b.int16(apiKey)
+	b.int16(apiVersion)
+	b.int32(k.correlationID)
+	b.string(k.ClientID)
+	b.Write(body)
+	var req kafkaEncoder
+	req.int32(int32(b.Len()))
+	req.Write(b.Bytes())
+	if _, err := conn.Write(req.Bytes()); err != nil {
+		return nil, err
+	}
+	r := bufio.NewReader(conn)
+	var size int32
+	if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+		return nil, err
+	}
+	resp := make([]byte, size)
+	if _, err := io.ReadFull(r, resp); err != nil {
+		return nil, err
+	}
+	d := &kafkaDecoder{b: resp}
+	if id := d.int32(); id != k.correlationID {
+		return nil, fmt.Errorf("kafka: unexpected correlation id %d", id)
+	}
+	return resp[4:], nil
+}
+
+func (k *KafkaSink) metadata() ([]kafkaPartition, error) {
+	var body kafkaEncoder
+	body.int32(1)
+	body.string(k.Topic)
+	var lastErr error
+	for _, broker := range k.Brokers {
+		resp, err := k.request(broker, 3, 0, body.Bytes())
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		d := &kafkaDecoder{b: resp}
+		brokers := make(map[int32]string)
+		for n := d.int32(); n > 0 && d.err == nil; n-- {
+			id := d.int32()
+			host := d.string()
+			port := d.int32()
+			brokers[id] = net.JoinHostPort(host, strconv.Itoa(int(port)))
+		}
+		for n := d.int32(); n > 0 && d.err == nil; n-- {
+			code := d.int16()
+			name := d.string()
+			partitions := make([]kafkaPartition, 0)
+			for m := d.int32(); m > 0 && d.err == nil; m-- {
+				d.int16()
+				id := d.int32()
+				leader := d.int32()
+				d.int32Array()
+				d.int32Array()
+				partitions = append(partitions, kafkaPartition{id, brokers[leader]})
+			}
+			if name != k.Topic {
+				continue
+			}
+			if d.err != nil {
+				return nil, d.err
+			}
+			if code != 0 || len(partitions) == 0 {
+				return nil, fmt.Errorf("kafka: topic %s unavailable (error %d)", name, code)
+			}
+			return partitions, nil
+		}
+		if d.err != nil {
+			lastErr = d.err
+			continue
+		}
+		lastErr = fmt.Errorf("kafka: topic %s not found", k.Topic)
+	}
+	if lastErr == nil {
+		lastErr = errors.New("kafka: no brokers")
+	}
+	return nil, lastErr
+}
+
+func (k *KafkaSink) produce(p kafkaPartition, r sinkRecord) error {
+	batch := kafkaRecordBatch(r, time.Now())
+	var body kafkaEncoder
+	body.int16(-1) // null transactional id
+	body.int16(-1) // acks from all in-sync replicas
+	body.int32(int32(k.Timeout / time.Millisecond))
+	body.int32(1)
+	body.string(k.Topic)
+	body.int32(1)
+	body.int32(p.id)
+	body.int32(int32(len(batch)))
+	body.Write(batch)
+	resp, err := k.request(p.leader, 0, 3, body.Bytes())
+	if err != nil {
+		return err
+	}
+	d := &kafkaDecoder{b: resp}
+	for n := d.int32(); n > 0 && d.err == nil; n-- {
+		d.string()
+		for m := d.int32(); m > 0 && d.err == nil; m-- {
+			d.int32()
+			if code := d.int16(); code != 0 {
+				return fmt.Errorf("kafka: produce failed (error %d)", code)
+			}
+			d.int64()
+			d.int64()
+		}
+	}
+	return d.err
+}
+
+// kafkaRecordBatch encodes the record in the v2 message format.
+func kafkaRecordBatch(r sinkRecord, now time.Time) []byte {
+	var rec kafkaEncoder
+	rec.WriteByte(0) // attributes
+	rec.varint(0)    // timestamp delta
+	rec.varint(0)    // offset delta
+	rec.varbytes([]byte(r.key))
+	rec.varbytes(r.value)
+	rec.varint(int64(len(r.headers)))
+	for _, h := range r.headers {
+		rec.varbytes([]byte(h[0]))
+		rec.varbytes([]byte(h[1]))
+	}
+
+	var tail kafkaEncoder
+	tail.int16(0) // attributes
+	tail.int32(0) // last offset delta
+	ts := now.UnixNano() / int64(time.Millisecond)
+	tail.int64(ts)
+	tail.int64(ts)
+	tail.int64(-1) // producer id
+	tail.int16(-1) // producer epoch
+	tail.int32(-1) // base sequence
+	tail.int32(1)
+	tail.varint(int64(rec.Len()))
+	tail.Write(rec.Bytes())
+
+	var b kafkaEncoder
+	b.int64(0)                             // base offset
+	b.int32(int32(4 + 1 + 4 + tail.Len())) // batch length
+	b.int32(-1)                            // partition leader epoch
+	b.WriteByte(2)                         // magic
+	b.int32(int32(crc32.Checksum(tail.Bytes(), crc32.MakeTable(crc32.Castagnoli))))
+	b.Write(tail.Bytes())
+	return b.Bytes()
+}
+
+type kafkaEncoder struct {
+	bytes.Buffer
+}
+
+func (e *kafkaEncoder) int16(v int16) {
+	binary.Write(e, binary.BigEndian, v)
+}
+
+func (e *kafkaEncoder) int32(v int32) {
+	binary.Write(e, binary.BigEndian, v)
+}
+
+func (e *kafkaEncoder) int64(v int64) {
+	binary.Write(e, binary.BigEndian, v)
+}
+
+func (e *kafkaEncoder) string(s string) {
+	e.int16(int16(len(s)))
+	e.WriteString(s)
+}
+
+func (e *kafkaEncoder) varint(v int64) {
+	b := make([]byte, binary.MaxVarintLen64)
+	e.Write(b[:binary.PutVarint(b, v)])
+}
+
+func (e *kafkaEncoder) varbytes(b []byte) {
+	e.varint(int64(len(b)))
+	e.Write(b)
+}
+
+type kafkaDecoder struct {
+	b   []byte
+	err error
+}
+
+func (d *kafkaDecoder) next(n int) []byte {
+	if d.err != nil || len(d.b) < n {
+		d.err = errors.New("kafka: malformed response")
+		return make([]byte, n)
+	}
+	x := d.b[:n]
+	d.b = d.b[n:]
+	return x
+}
+
+func (d *kafkaDecoder) int16() int16 {
+	return int16(binary.BigEndian.Uint16(d.next(2)))
+}
+
+func (d *kafkaDecoder) int32() int32 {
+	return int32(binary.BigEndian.Uint32(d.next(4)))
+}
+
+func (d *kafkaDecoder) int64() int64 {
+	return int64(binary.BigEndian.Uint64(d.next(8)))
+}
+
+func (d *kafkaDecoder) string() string {
+	n := d.int16()
+	if n < 0 {
+		return ""
+	}
+	return string(d.next(int(n)))
+}
+
+func (d *kafkaDecoder) int32Array() {
+	for n := d.int32(); n > 0 && d.err == nil; n-- {
+		d.int32()
+	}
+}
@@ -0,0 +1,173 @@
+package smtp
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+)
+
+type kafkaTestRecord struct {
+	partition int32
+	key       string
+	value     string
+	headers   map[string]string
+}
+
+// serveKafka answers Metadata v0 with the given number of partitions, all
+// led by the server itself, and decodes Produce v3 requests.
+func serveKafka(t *testing.T, lsnr net.Listener, partitions int32, records chan<- kafkaTestRecord) {
+	host, port, _ := net.SplitHostPort(lsnr.Addr().String())
+	portNum, _ := strconv.Atoi(port)
+	for {
+		conn, err := lsnr.Accept()
+		if err != nil {
+			return
+		}
+		var size int32
+		if err := binary.Read(conn, binary.BigEndian, &size); err != nil {
+			conn.Close()
+			continue
+		}
+		req := make([]byte, size)
+		io.ReadFull(conn, req)
+		d := &kafkaDecoder{b: req}
+		apiKey := d.int16()
+		d.int16()
+		correlationID := d.int32()
+		d.string()
+		var resp kafkaEncoder
+		resp.int32(correlationID)
+		switch apiKey {
+		case 3:
+			resp.int32(1)
+			resp.int32(0)
+			resp.string(host)
+			resp.int32(int32(portNum))
+			resp.int32(1)
+			resp.int16(0)
+			resp.string("mail")
+			resp.int32(partitions)
+			for i := int32(0); i < partitions; i++ {
+				resp.int16(0)
+				resp.int32(i)
+				resp.int32(0)
+				resp.int32(0)
+				resp.int32(0)
+			}
+		case 0:
+			d.int16()
+			d.int16()
+			d.int32()
+			d.int32()
+			topic := d.string()
+			d.int32()
+			partition := d.int32()
+			batch := d.next(int(d.int32()))
+			records <- decodeKafkaBatch(t, partition, batch)
+			resp.int32(1)
+			resp.string(topic)
+			resp.int32(1)
+			resp.int32(partition)
+			resp.int16(0)
+			resp.int64(0)
+			resp.int64(-1)
+			resp.int32(0)
+		}
+		binary.Write(conn, binary.BigEndian, int32(resp.Len()))
+		conn.Write(resp.Bytes())
+		conn.Close()
+	}
+}
+
+func decodeKafkaBatch(t *testing.T, partition int32, batch []byte) kafkaTestRecord {
+	d := &kafkaDecoder{b: batch}
+	d.int64()
+	d.int32()
+	d.int32()
+	if magic := d.next(1)[0]; magic != 2 {
+		t.Errorf("expected magic 2, actual: %d", magic)
+	}
+	crc := uint32(d.int32())
+	if crc != crc32.Checksum(d.b, crc32.MakeTable(crc32.Castagnoli)) {
+		t.Errorf("CRC mismatch")
+	}
+	d.next(2 + 4 + 8 + 8 + 8 + 2 + 4 + 4)
+	varint := func() int64 {
+		v, n := binary.Varint(d.b)
+		d.next(n)
+		return v
+	}
+	varint()
+	d.next(1)
+	varint()
+	varint()
+	rec := kafkaTestRecord{partition: partition, headers: make(map[string]string)}
+	rec.key = string(d.next(int(varint())))
+	rec.value = string(d.next(int(varint())))
+	for n := varint(); n > 0; n-- {
+		k := string(d.next(int(varint())))
+		rec.headers[k] = string(d.next(int(varint())))
+	}
+	if d.err != nil {
+		t.Error(d.err)
+	}
+	return rec
+}
+
+func TestKafkaSink(t *testing.T) {
+	lsnr, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip(err)
+	}
+	defer lsnr.Close()
+	records := make(chan kafkaTestRecord, 4)
+	go serveKafka(t, lsnr, 4, records)
+
+	st := &SMTPState{}
+	st.Reset()
+	st.ReturnTo = "foo@example.net"
+	st.MessageID = "<1234@example.net>"
+	for _, x := range []string{"user1@example.net", "user2@example.org", "user3@example.net"} {
+		addr, _ := ParseAddress(x)
+		st.Recipients = append(st.Recipients, x)
+		st.RecipientAddresses = append(st.RecipientAddresses, addr)
+	}
+	st.Headers = []string{"Subject: Kafka"}
+	st.SetContent([]byte("Hello\r\n"))
+	sink := NewKafkaSink([]string{lsnr.Addr().String()}, "mail")
+	if err := sink.Publish(st); err != nil {
+		t.Fatal(err)
+	}
+	close(records)
+	expected := []kafkaTestRecord{
+		{int32(crc32.ChecksumIEEE([]byte("example.net")) % 4), "example.net", "",
+			map[string]string{"rcpt_to": "user1@example.net,user3@example.net"}},
+		{int32(crc32.ChecksumIEEE([]byte("example.org")) % 4), "example.org", "",
+			map[string]string{"rcpt_to": "user2@example.org"}},
+	}
+	i := 0
+	for rec := range records {
+		if i >= len(expected) {
+			t.Fatalf("unexpected record: %v", rec)
+		}
+		x := expected[i]
+		if rec.partition != x.partition || rec.key != x.key {
+			t.Errorf("expected: %d %s, actual: %d %s", x.partition, x.key, rec.partition, rec.key)
+		}
+		if rec.value != "Subject: Kafka\r\n\r\nHello\r\n" {
+			t.Errorf("unexpected value: %q", rec.value)
+		}
+		if rec.headers["rcpt_to"] != x.headers["rcpt_to"] ||
+			rec.headers["mail_from"] != "foo@example.net" ||
+			rec.headers["message_id"] != "<1234@example.net>" {
+			t.Errorf("unexpected headers: %v", rec.headers)
+		}
+		i++
+	}
+	if i != len(expected) {
+		t.Errorf("expected %d records, actual: %d", len(expected), i)
+	}
+}
@@ -0,0 +1,72 @@
+package smtp
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// maxLineLength is the limit of a line of a message in RFC 5322 section
+// 2.1.1, excluding CRLF.
+const maxLineLength = 998
+
+// singleHeaders are the headers which must not occur more than once in
+// RFC 5322 section 3.6.
+var singleHeaders = []string{
+	"Date", "From", "Sender", "Reply-To", "To", "Cc", "Bcc",
+	"Message-ID", "In-Reply-To", "References", "Subject",
+}
+
+// LintMessage returns the warnings of common problems of the message as
+// received: a missing Date, From or Message-ID header, a duplicate header
+// which must occur once, 8-bit data without BODY=8BITMIME or SMTPUTF8 and
+// lines longer than 998 octets.
+func LintMessage(st *SMTPState) []string {
+	var warnings []string
+	counts := make(map[string]int)
+	eightBit, long := 0, 0
+	inBody := false
+	r := bufio.NewReader(st.Raw())
+	for n := 1; ; n++ {
+		line, err := r.ReadString('\n')
+		if len(line) == 0 && err != nil {
+			if err != io.EOF {
+				warnings = append(warnings, "unreadable message: "+err.Error())
+			}
+			break
+		}
+		line = strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r")
+		if len(line) > maxLineLength && long == 0 {
+			long = n
+		}
+		if eightBit == 0 && strings.IndexFunc(line, func(c rune) bool { return c >= 0x80 }) >= 0 {
+			eightBit = n
+		}
+		if inBody {
+			continue
+		}
+		if len(line) == 0 {
+			inBody = true
+		} else if line[0] != ' ' && line[0] != '\t' {
+			counts[strings.ToLower(headerName(line))]++
+		}
+	}
+	for _, x := range []string{"Date", "From", "Message-ID"} {
+		if counts[strings.ToLower(x)] == 0 {
+			warnings = append(warnings, "missing "+x+" header")
+		}
+	}
+	for _, x := range singleHeaders {
+		if counts[strings.ToLower(x)] > 1 {
+			warnings = append(warnings, fmt.Sprintf("duplicate %s header", x))
+		}
+	}
+	if eightBit > 0 && st.Body != "8BITMIME" && !st.SMTPUTF8 {
+		warnings = append(warnings, fmt.Sprintf("8-bit data without BODY=8BITMIME at line %d", eightBit))
+	}
+	if long > 0 {
+		warnings = append(warnings, fmt.Sprintf("line %d longer than %d octets", long, maxLineLength))
+	}
+	return warnings
+}
@@ -0,0 +1,60 @@
+package smtp
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLintMessage(t *testing.T) {
+	st := &SMTPState{}
+	st.Headers = []string{
+		"Date: Thu, 1 Jan 2026 00:00:00 +0000",
+		"From: foo@example.net",
+		"Message-ID: <1@example.net>",
+		"Subject: Hello",
+	}
+	st.SetContent([]byte("Hello\r\n"))
+	if xs := LintMessage(st); len(xs) != 0 {
+		t.Errorf("unexpected warnings: %v", xs)
+	}
+
+	st.Headers = []string{"Subject: One", "Subject: Two", "Received: a", "Received: b"}
+	st.SetContent([]byte("Caf\xc3\xa9\r\n" + strings.Repeat("x", 999) + "\r\n"))
+	expected := "missing Date header|missing From header|missing Message-ID header|" +
+		"duplicate Subject header|8-bit data without BODY=8BITMIME at line 6|line 7 longer than 998 octets"
+	if actual := strings.Join(LintMessage(st), "|"); actual != expected {
+		t.Errorf("expected: %s, actual: %s", expected, actual)
+	}
+	st.Body = "8BITMIME"
+	if actual := strings.Join(LintMessage(st), "|"); strings.Contains(actual, "8-bit") {
+		t.Errorf("unexpected 8-bit warning: %s", actual)
+	}
+}
+
+func TestStoreWarnings(t *testing.T) {
+	s, err := NewMessageStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, x := range [][]string{
+		{"Date: Thu, 1 Jan 2026 00:00:00 +0000", "From: foo@example.net", "Message-ID: <1@example.net>"},
+		{"Subject: Hello"},
+	} {
+		st := &SMTPState{ReturnTo: "foo@example.net", Recipients: []string{"user1@example.com"}, Headers: x}
+		st.SetContent([]byte("Hello\r\n"))
+		if _, err := s.Put(st); err != nil {
+			t.Fatal(err)
+		}
+	}
+	q, err := ParseMessageQuery(map[string][]string{"has_warnings": {"true"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	page, err := s.Query(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Messages) != 1 || len(page.Messages[0].Warnings) != 3 {
+		t.Errorf("unexpected messages: %v", page.Messages)
+	}
+}
@@ -0,0 +1,199 @@
+package smtp
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ListenerConfig is a listener with the settings which differ from the
+// base configuration of the process.
+type ListenerConfig struct {
+	Name string
+
+	// Address is "host:port", or "unix:" followed by a path with Mode.
+	Address string
+	Mode    os.FileMode
+
+	// Submission applies the settings of message submission (RFC 6409).
+	Submission bool
+
+	LMTP bool
+
+	ImplicitTLS     bool
+	DisableTLS      bool
+	ProxyProtocol   bool
+	RequireAuth     bool
+	AuthRequiresTLS bool
+	MaxMessageSize  int64
+
+	// PolicyFile is the path of the policy rules of the listener, to be
+	// loaded into Policy by the caller.
+	PolicyFile string
+	Policy     *Policy
+
+	// MutationsFile is the path of the mutations of the listener, to be
+	// loaded into Mutations by the caller.
+	MutationsFile string
+	Mutations     Mutations
+}
+
+// ParseListeners reads listeners in the form of "name address [option]...",
+// one per line. The options are submission (STARTTLS and AUTH required,
+// senders owned by the user and headers fixed up), lmtp, tls (implicit TLS),
+// notls (no STARTTLS),
+// proxy (PROXY protocol), auth (AUTH required before MAIL), auth-tls (AUTH
+// only over TLS), size=<max message size>, mode=<octal permissions of a
+// Unix socket>, policy=<file> and mutations=<file>.
+//
+//	smtp        localhost:1025
+//	smtps       :1465            tls size=20000000
+//	submission  :1587            submission policy=submission.rules
+//	local       unix:/run/mproxy/smtp.sock mode=0660
+func ParseListeners(r io.Reader) ([]ListenerConfig, error) {
+	listeners := make([]ListenerConfig, 0)
+	names := make(map[string]bool)
+	scanner := bufio.NewScanner(r)
+	n := 0
+	for scanner.Scan() {
+		n++
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		xs := strings.Fields(line)
+		if len(xs) < 2 {
+			return nil, fmt.Errorf("line %d: expected \"name address [option]...\"", n)
+		}
+		if names[xs[0]] {
+			return nil, fmt.Errorf("line %d: duplicate listener %s", n, xs[0])
+		}
+		names[xs[0]] = true
+		lc := ListenerConfig{Name: xs[0], Address: xs[1], Mode: 0660}
+		for _, x := range xs[2:] {
+			if err := lc.setOption(x); err != nil {
+				return nil, fmt.Errorf("line %d: %v", n, err)
+			}
+		}
+		if lc.DisableTLS && (lc.ImplicitTLS || lc.Submission) {
+			return nil, fmt.Errorf("line %d: notls is exclusive with tls and submission", n)
+		}
+		listeners = append(listeners, lc)
+	}
+	return listeners, scanner.Err()
+}
+
+func (lc *ListenerConfig) setOption(x string) error {
+	kv := strings.SplitN(x, "=", 2)
+	if len(kv) == 2 {
+		switch kv[0] {
+		case "size":
+			size, err := strconv.ParseInt(kv[1], 10, 64)
+			if err != nil || size <= 0 {
+				return fmt.Errorf("invalid size: %s", kv[1])
+			}
+			lc.MaxMessageSize = size
+		case "mode":
+			mode, err := strconv.ParseUint(kv[1], 8, 32)
+			if err != nil {
+				return fmt.Errorf("invalid mode: %s", kv[1])
+			}
+			lc.Mode = os.FileMode(mode)
+		case "policy":
+			lc.PolicyFile = kv[1]
+		case "mutations":
+			lc.MutationsFile = kv[1]
+		default:
+			return fmt.Errorf("unknown option: %s", kv[0])
+		}
+		return nil
+	}
+	switch x {
+	case "submission":
+		lc.Submission = true
+	case "lmtp":
+		lc.LMTP = true
+	case "tls":
+		lc.ImplicitTLS = true
+	case "notls":
+		lc.DisableTLS = true
+	case "proxy":
+		lc.ProxyProtocol = true
+	case "auth":
+		lc.RequireAuth = true
+	case "auth-tls":
+		lc.AuthRequiresTLS = true
+	default:
+		return fmt.Errorf("unknown option: %s", x)
+	}
+	return nil
+}
+
+// Config returns a copy of the base configuration with the settings of the
+// listener.
+func (lc *ListenerConfig) Config(base *SMTPConfig) *SMTPConfig {
+	config := *base
+	config.ListenerName = lc.Name
+	if lc.Submission {
+		config.submission()
+	}
+	if lc.LMTP {
+		config.LMTP = true
+	}
+	if lc.DisableTLS {
+		config.TLSConfig = nil
+	}
+	if lc.RequireAuth {
+		config.RequireAuth = true
+	}
+	if lc.AuthRequiresTLS {
+		config.AuthRequiresTLS = true
+	}
+	if lc.MaxMessageSize > 0 {
+		config.MaxMessageSize = lc.MaxMessageSize
+	}
+	if lc.Policy != nil {
+		config.Policy = lc.Policy
+	}
+	if lc.Mutations != nil {
+		config.Mutations = lc.Mutations
+	}
+	return &config
+}
+
+// Listen opens the listener for the configuration returned by Config,
+// or takes it over from the old process by config.Upgrader.
+func (lc *ListenerConfig) Listen(config *SMTPConfig) (net.Listener, error) {
+	if (lc.ImplicitTLS || lc.Submission) && config.TLSConfig == nil {
+		return nil, errors.New("listener " + lc.Name + ": tls requires a certificate")
+	}
+	if config.RequireAuth && config.Authenticate == nil {
+		return nil, errors.New("listener " + lc.Name + ": auth requires users to authenticate")
+	}
+	lsnr, err := config.Upgrader.Listen(lc.Name, func() (net.Listener, error) {
+		if strings.HasPrefix(lc.Address, "unix:") {
+			return ListenUnix(lc.Address[5:], lc.Mode)
+		}
+		return net.Listen("tcp", lc.Address)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if lc.ProxyProtocol {
+		if len(config.ProxyNetworks) == 0 && !strings.HasPrefix(lc.Address, "unix:") {
+			lsnr.Close()
+			return nil, errors.New("listener " + lc.Name + ": proxy requires trusted networks")
+		}
+		lsnr = NewProxyListener(lsnr, config.ProxyNetworks)
+	}
+	if lc.ImplicitTLS {
+		lsnr = tls.NewListener(lsnr, config.TLSConfig)
+	}
+	return lsnr, nil
+}
@@ -0,0 +1,88 @@
+package smtp
+
+import (
+	"crypto/tls"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseListeners(t *testing.T) {
+	listeners, err := ParseListeners(strings.NewReader(`
+# name      address
+smtp        127.0.0.1:0
+smtps       127.0.0.1:0   tls proxy size=20000000
+submission  127.0.0.1:0   notls auth auth-tls policy=submission.rules
+local       unix:/run/mproxy/smtp.sock mode=0600
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listeners) != 4 {
+		t.Fatalf("unexpected listeners: %v", listeners)
+	}
+	if x := listeners[1]; !x.ImplicitTLS || !x.ProxyProtocol || x.MaxMessageSize != 20000000 {
+		t.Errorf("unexpected listener: %v", x)
+	}
+	if x := listeners[2]; !x.DisableTLS || !x.RequireAuth || !x.AuthRequiresTLS || x.PolicyFile != "submission.rules" {
+		t.Errorf("unexpected listener: %v", x)
+	}
+	if x := listeners[3]; x.Address != "unix:/run/mproxy/smtp.sock" || x.Mode != 0600 {
+		t.Errorf("unexpected listener: %v", x)
+	}
+
+	base := &SMTPConfig{ServerName: "mx.example.com", MaxMessageSize: 1000, TLSConfig: &tls.Config{}}
+	config := listeners[2].Config(base)
+	if config.TLSConfig != nil || !config.RequireAuth || config.MaxMessageSize != 1000 ||
+		config.ListenerName != "submission" || config.ServerName != "mx.example.com" {
+		t.Errorf("unexpected config: %v", config)
+	}
+	if base.RequireAuth || base.TLSConfig == nil || len(base.ListenerName) > 0 {
+		t.Errorf("expected the base config to be unchanged: %v", base)
+	}
+	if _, err := listeners[1].Listen(listeners[2].Config(base)); err == nil {
+		t.Errorf("expected an error of tls without a certificate")
+	}
+
+	invalid := []string{
+		"smtp",
+		"smtp :25 starttls",
+		"smtp :25 size=0",
+		"smtp :25 mode=0999",
+		"smtp :25 tls notls",
+		"smtp :25\nsmtp :587",
+	}
+	for _, x := range invalid {
+		if _, err := ParseListeners(strings.NewReader(x)); err == nil {
+			t.Errorf("expected an error: %s", x)
+		}
+	}
+}
+
+func TestListenerConfig(t *testing.T) {
+	lc := ListenerConfig{Name: "local", Address: "unix:" + filepath.Join(t.TempDir(), "smtp.sock"), RequireAuth: true}
+	if _, err := lc.Listen(lc.Config(&SMTPConfig{})); err == nil {
+		t.Errorf("expected an error of auth without users")
+	}
+	config := lc.Config(&SMTPConfig{Authenticate: func(username, password string) bool { return false }})
+	lsnr, err := lc.Listen(config)
+	if err != nil {
+		t.Skip(err)
+	}
+	defer lsnr.Close()
+	if _, ok := lsnr.Addr().(*net.UnixAddr); !ok {
+		t.Errorf("unexpected address: %v", lsnr.Addr())
+	}
+
+	conn := NewMockConn([]byte("EHLO localhost\r\n" +
+		"MAIL FROM:<foo@example.net>\r\n" +
+		"QUIT\r\n"))
+	h := NewSMTPHandler(conn, nil)
+	h.Config = config
+	h.Run()
+	expected := "220 250 530 221"
+	if actual := replyCodes(conn.CloneOutputBuffer()); actual != expected {
+		t.Errorf("expected: %s, actual: %s", expected, actual)
+	}
+}
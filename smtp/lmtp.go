@@ -0,0 +1,48 @@
+package smtp
+
+import (
+	"sort"
+	"strings"
+)
+
+// RecipientErrors reports the recipients a message could not be delivered
+// to, keyed by address. In LMTP mode, Send can return it to fail only
+// those recipients.
+type RecipientErrors map[string]error
+
+func (e RecipientErrors) Error() string {
+	xs := make([]string, 0, len(e))
+	for k, err := range e {
+		xs = append(xs, k+": "+err.Error())
+	}
+	sort.Strings(xs)
+	return "smtp: delivery failed for " + strings.Join(xs, ", ")
+}
+
+// lmtpReplies answers each accepted RCPT command after the message data
+// (RFC 2033 section 4.2). reply is called with the recipients of the
+// command, which are several if it has been expanded by aliases.
+func (smtpConn *SMTPConnection) lmtpReplies(reply func(recipients []string) string) error {
+	for _, xs := range smtpConn.State().rcptGroups {
+		if err := smtpConn.Write(reply(xs)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deliverRecipients answers the recipients of a partially delivered
+// message.
+func (smtpConn *SMTPConnection) deliverRecipients(errs RecipientErrors, success string) error {
+	if err := smtpConn.acceptMessage(""); err != nil {
+		return err
+	}
+	return smtpConn.lmtpReplies(func(recipients []string) string {
+		for _, x := range recipients {
+			if _, ok := errs[x]; ok {
+				return smtpConn.Config().Catalog.Reply("lmtp.failed", x)
+			}
+		}
+		return success
+	})
+}
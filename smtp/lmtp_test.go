@@ -0,0 +1,49 @@
+package smtp
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestLMTP(t *testing.T) {
+	input := "EHLO localhost\r\n" +
+		"LHLO localhost\r\n" +
+		"MAIL FROM:<foo@example.net>\r\n" +
+		"RCPT TO:<user1@example.com>\r\n" +
+		"RCPT TO:<user2@example.com>\r\n" +
+		"DATA\r\n" +
+		"Subject: Hello\r\n\r\nHello\r\n.\r\n" +
+		"QUIT\r\n"
+	for _, x := range []struct {
+		err      error
+		expected string
+	}{
+		{nil, "220 500 250 250 250 250 354 250 250 221"},
+		{RecipientErrors{"user2@example.com": errors.New("mailbox full")}, "220 500 250 250 250 250 354 250 550 221"},
+		{errors.New("unavailable"), "220 500 250 250 250 250 354 554 554 221"},
+	} {
+		var received *SMTPState
+		conn := NewMockConn([]byte(input))
+		h := NewSMTPHandler(conn, func(st *SMTPState) error {
+			y := *st
+			received = &y
+			return x.err
+		})
+		h.Config.LMTP = true
+		h.Config.AddReceived = true
+		h.Run()
+		if actual := replyCodes(conn.CloneOutputBuffer()); actual != x.expected {
+			t.Errorf("expected: %s, actual: %s", x.expected, actual)
+		}
+		if received == nil || !strings.Contains(strings.Join(received.Headers, "\r\n"), "with LMTP") {
+			t.Errorf("unexpected message: %v", received)
+		}
+	}
+
+	conn := NewMockConn([]byte("LHLO localhost\r\nQUIT\r\n"))
+	NewSMTPHandler(conn, nil).Run()
+	if expected, actual := "220 500 221", replyCodes(conn.CloneOutputBuffer()); expected != actual {
+		t.Errorf("expected: %s, actual: %s", expected, actual)
+	}
+}
@@ -0,0 +1,70 @@
+package smtp
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+var discardLogger = slog.New(slog.DiscardHandler)
+
+// NewLogger returns a logger writing JSON records of the level, one of
+// debug, info, warn and error, and above to w.
+func NewLogger(w io.Writer, level string) (*slog.Logger, error) {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(level)); err != nil {
+		return nil, err
+	}
+	return slog.New(slog.NewJSONHandler(w, &slog.HandlerOptions{Level: l})), nil
+}
+
+func newTransactionID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// newQueueID returns an ID of an accepted message. The IDs sort in the
+// order of arrival by the nanoseconds.
+func newQueueID(now time.Time) string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	now = now.UTC()
+	return fmt.Sprintf("%s%09d-%s", now.Format("20060102150405"), now.Nanosecond(), hex.EncodeToString(b))
+}
+
+// Logger returns SMTPConfig.Logger tagging records with the session ID,
+// the remote address and the IDs of the current transaction and its
+// message, if any.
+func (smtpConn *SMTPConnection) Logger() *slog.Logger {
+	l := smtpConn.Config().Logger
+	if l == nil {
+		return discardLogger
+	}
+	st := smtpConn.State()
+	l = l.With("session_id", smtpConn.ID(), "remote_addr", st.RemoteAddr)
+	if len(st.TransactionID) > 0 {
+		l = l.With("transaction_id", st.TransactionID)
+	}
+	if len(st.QueueID) > 0 {
+		l = l.With("queue_id", st.QueueID)
+	}
+	return l
+}
+
+// logCommand logs the verb of a command with the reply at the debug
+// level, leaving out the arguments which may be credentials.
+func (smtpConn *SMTPConnection) logCommand(verb, reply string) {
+	if l := smtpConn.Config().Logger; l == nil || !l.Enabled(context.Background(), slog.LevelDebug) {
+		return
+	}
+	if code, _, ok := strings.Cut(reply, " "); ok {
+		reply = code
+	}
+	smtpConn.Logger().Debug("command", "verb", verb, "reply", reply)
+}
@@ -0,0 +1,57 @@
+package smtp
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestLogger(t *testing.T) {
+	conn := NewMockConn([]byte("EHLO localhost\r\n" +
+		"MAIL FROM: <foo@example.net>\r\n" +
+		"RCPT TO: <user1@example.com>\r\n" +
+		"DATA\r\n" +
+		"Hello\r\n" +
+		".\r\n" +
+		"QUIT\r\n"))
+	var b bytes.Buffer
+	h := NewSMTPHandler(conn, func(st *SMTPState) error { return nil })
+	h.Config.Logger, _ = NewLogger(&b, "debug")
+	h.Run()
+
+	msgs := make([]string, 0)
+	var sessionID, transactionID string
+	for _, line := range strings.Split(strings.TrimSpace(b.String()), "\n") {
+		var x map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &x); err != nil {
+			t.Fatal(err)
+		}
+		msg := x["msg"].(string)
+		if msg == "command" {
+			msg += " " + x["verb"].(string) + " " + x["reply"].(string)
+		}
+		msgs = append(msgs, msg)
+		if id, _ := x["session_id"].(string); id != sessionID {
+			if len(sessionID) > 0 {
+				t.Errorf("unexpected session_id: %s", line)
+			}
+			sessionID = id
+		}
+		if x["msg"] == "message accepted" {
+			transactionID, _ = x["transaction_id"].(string)
+		}
+	}
+	expected := "session started, command EHLO 250, command MAIL 250, command RCPT 250," +
+		" message accepted, command DATA 250, command QUIT 221, session closed"
+	if actual := strings.Join(msgs, ", "); actual != expected {
+		t.Errorf("expected: %s, actual: %s", expected, actual)
+	}
+	if len(sessionID) == 0 || len(transactionID) == 0 {
+		t.Errorf("expected the IDs: %q, %q", sessionID, transactionID)
+	}
+
+	if _, err := NewLogger(&b, "verbose"); err == nil {
+		t.Errorf("expected an error for an unknown level")
+	}
+}
@@ -0,0 +1,296 @@
+package smtp
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/mail"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MailHogPrefix is where MailHogHandler is mounted.
+const MailHogPrefix = "/api/"
+
+// MailHogMessage is a message in the JSON of the MailHog API.
+type MailHogMessage struct {
+	ID      string
+	From    *MailHogPath
+	To      []*MailHogPath
+	Content *MailHogContent
+	Created time.Time
+	MIME    *MailHogMIME
+	Raw     *MailHogRaw
+}
+
+type MailHogPath struct {
+	Relays  []string
+	Mailbox string
+	Domain  string
+	Params  string
+}
+
+type MailHogContent struct {
+	Headers map[string][]string
+	Body    string
+	Size    int
+	MIME    *MailHogMIME
+}
+
+type MailHogMIME struct {
+	Parts []*MailHogContent
+}
+
+type MailHogRaw struct {
+	From string
+	To   []string
+	Data string
+	Helo string
+}
+
+// MailHogMessages is a page of messages of the v2 API.
+type MailHogMessages struct {
+	Total int               `json:"total"`
+	Count int               `json:"count"`
+	Start int               `json:"start"`
+	Items []*MailHogMessage `json:"items"`
+}
+
+func mailHogPath(addr string) *MailHogPath {
+	p := &MailHogPath{Relays: []string{}}
+	if i := strings.LastIndex(addr, "@"); i >= 0 {
+		p.Mailbox, p.Domain = addr[:i], addr[i+1:]
+	} else {
+		p.Mailbox = addr
+	}
+	return p
+}
+
+// mailHogContent parses a message or a part of it.
+func mailHogContent(data []byte) *MailHogContent {
+	c := &MailHogContent{Headers: map[string][]string{}, Size: len(data)}
+	m, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		c.Body = string(data)
+		return c
+	}
+	c.Headers = m.Header
+	body, _ := io.ReadAll(m.Body)
+	c.Body = string(body)
+	mediaType, params, err := mime.ParseMediaType(m.Header.Get("Content-Type"))
+	if err != nil || !strings.HasPrefix(mediaType, "multipart/") || len(params["boundary"]) == 0 {
+		return c
+	}
+	mr := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+	c.MIME = &MailHogMIME{Parts: []*MailHogContent{}}
+	for {
+		p, err := mr.NextRawPart()
+		if err != nil {
+			break
+		}
+		b, _ := io.ReadAll(p)
+		part := &MailHogContent{Headers: p.Header, Body: string(b), Size: len(b)}
+		c.MIME.Parts = append(c.MIME.Parts, part)
+	}
+	return c
+}
+
+// mailHogMessage reads the stored message in the JSON of the MailHog API.
+func (s *MessageStore) mailHogMessage(msg StoredMessage) (*MailHogMessage, error) {
+	r, err := s.Open(msg.ID)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	x := &MailHogMessage{
+		ID:      msg.ID,
+		From:    mailHogPath(msg.ReturnTo),
+		To:      make([]*MailHogPath, len(msg.Recipients)),
+		Content: mailHogContent(data),
+		Created: msg.Received,
+		Raw:     &MailHogRaw{From: msg.ReturnTo, To: msg.Recipients, Data: string(data)},
+	}
+	for i, rcpt := range msg.Recipients {
+		x.To[i] = mailHogPath(rcpt)
+	}
+	x.MIME = x.Content.MIME
+	return x, nil
+}
+
+// mailHogSearch reports whether the message matches the kind of search of
+// the MailHog API, "from", "to" or "containing", case-insensitively.
+func mailHogSearch(x *MailHogMessage, kind, query string) bool {
+	query = strings.ToLower(query)
+	contains := func(xs ...string) bool {
+		for _, s := range xs {
+			if strings.Contains(strings.ToLower(s), query) {
+				return true
+			}
+		}
+		return false
+	}
+	switch kind {
+	case "from":
+		return contains(append([]string{x.Raw.From}, x.Content.Headers["From"]...)...)
+	case "to":
+		return contains(append(append([]string{}, x.Raw.To...), x.Content.Headers["To"]...)...)
+	case "containing":
+		return contains(x.Raw.Data)
+	}
+	return false
+}
+
+// MailHogHandler serves the stored messages by the endpoints of the
+// MailHog API that test tools use, mounted at MailHogPrefix:
+//
+//	GET    /api/v2/messages?start=0&limit=50
+//	GET    /api/v2/search?kind=from|to|containing&query=...
+//	GET    /api/v1/messages
+//	DELETE /api/v1/messages
+//	GET    /api/v1/messages/{id}
+//	DELETE /api/v1/messages/{id}
+//	GET    /api/v1/messages/{id}/download
+//
+// Messages are listed from the newest, regardless of the tenancy.
+func (s *MessageStore) MailHogHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := strings.TrimPrefix(r.URL.Path, MailHogPrefix)
+		switch {
+		case path == "v2/messages" || path == "v2/search":
+			if r.Method != "GET" {
+				w.Header().Set("Allow", "GET")
+				http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			s.serveMailHogMessages(w, r, path == "v2/search")
+		case path == "v1/messages":
+			switch r.Method {
+			case "GET":
+				s.serveMailHogMessages(w, r, false)
+			case "DELETE":
+				xs, err := s.List("")
+				for i := 0; err == nil && i < len(xs); i++ {
+					err = s.Delete(xs[i].ID)
+				}
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+				}
+			default:
+				w.Header().Set("Allow", "GET, DELETE")
+				http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			}
+		case strings.HasPrefix(path, "v1/messages/"):
+			s.serveMailHogMessage(w, r, strings.TrimPrefix(path, "v1/messages/"))
+		default:
+			http.NotFound(w, r)
+		}
+	})
+}
+
+func (s *MessageStore) serveMailHogMessages(w http.ResponseWriter, r *http.Request, search bool) {
+	q := r.URL.Query()
+	start, limit := 0, DefaultQueryLimit
+	for k, p := range map[string]*int{"start": &start, "limit": &limit} {
+		if x := q.Get(k); len(x) > 0 {
+			n, err := strconv.Atoi(x)
+			if err != nil || n < 0 {
+				http.Error(w, "invalid "+k, http.StatusBadRequest)
+				return
+			}
+			*p = n
+		}
+	}
+	kind := q.Get("kind")
+	if search && kind != "from" && kind != "to" && kind != "containing" {
+		http.Error(w, "invalid kind", http.StatusBadRequest)
+		return
+	}
+	xs, err := s.List("")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	items := make([]*MailHogMessage, 0)
+	total := 0
+	for i := len(xs) - 1; i >= 0; i-- {
+		// only the messages of the page are read unless searching
+		if !search {
+			total++
+			if total <= start || len(items) >= limit {
+				continue
+			}
+		}
+		x, err := s.mailHogMessage(xs[i])
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if search {
+			if !mailHogSearch(x, kind, q.Get("query")) {
+				continue
+			}
+			total++
+			if total <= start || len(items) >= limit {
+				continue
+			}
+		}
+		items = append(items, x)
+	}
+	if r.URL.Path == MailHogPrefix+"v1/messages" {
+		writeJSON(w, http.StatusOK, items)
+		return
+	}
+	writeJSON(w, http.StatusOK, MailHogMessages{Total: total, Count: len(items), Start: start, Items: items})
+}
+
+func (s *MessageStore) serveMailHogMessage(w http.ResponseWriter, r *http.Request, id string) {
+	download := strings.HasSuffix(id, "/download")
+	id = strings.TrimSuffix(id, "/download")
+	if r.Method != "GET" && (download || r.Method != "DELETE") {
+		allow := "GET, DELETE"
+		if download {
+			allow = "GET"
+		}
+		w.Header().Set("Allow", allow)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	msg, err := s.Get(id)
+	if os.IsNotExist(err) {
+		http.Error(w, "no such message", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if r.Method == "DELETE" {
+		if err := s.Delete(id); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	x, err := s.mailHogMessage(msg)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if download {
+		w.Header().Set("Content-Type", "message/rfc822")
+		w.Header().Set("Content-Disposition", `attachment; filename="`+msg.ID+`.eml"`)
+		io.WriteString(w, x.Raw.Data)
+		return
+	}
+	writeJSON(w, http.StatusOK, x)
+}
@@ -0,0 +1,80 @@
+package smtp
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMailHogHandler(t *testing.T) {
+	s, err := NewMessageStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := &SMTPState{ReturnTo: "foo@example.net", Recipients: []string{"user1@example.com"}}
+	st.Headers = []string{"From: Foo <foo@example.net>", "Subject: First"}
+	st.SetContent([]byte("Hello\r\n"))
+	id1, _ := s.Put(st)
+	st = &SMTPState{ReturnTo: "bar@example.net", Recipients: []string{"user2@example.com", "user3@example.com"}}
+	st.Headers = []string{"Subject: Second", "Content-Type: multipart/mixed; boundary=b"}
+	st.SetContent([]byte("--b\r\nContent-Type: text/plain\r\n\r\nWorld\r\n--b--\r\n"))
+	id2, _ := s.Put(st)
+
+	h := s.MailHogHandler()
+	get := func(method, url string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(method, url, nil))
+		return w
+	}
+
+	var page MailHogMessages
+	w := get("GET", "/api/v2/messages?limit=1")
+	json.NewDecoder(w.Body).Decode(&page)
+	if w.Code != http.StatusOK || page.Total != 2 || page.Count != 1 || page.Items[0].ID != id2 {
+		t.Fatalf("unexpected page: %d %v", w.Code, page)
+	}
+	x := page.Items[0]
+	if x.From.Mailbox != "bar" || x.From.Domain != "example.net" || len(x.To) != 2 {
+		t.Errorf("unexpected paths: %v %v", x.From, x.To)
+	}
+	if x.Content.Headers["Subject"][0] != "Second" || len(x.MIME.Parts) != 1 || x.MIME.Parts[0].Body != "World" {
+		t.Errorf("unexpected content: %v %v", x.Content, x.MIME)
+	}
+
+	for _, c := range []struct {
+		query    string
+		expected string
+	}{
+		{"kind=from&query=FOO@", id1},
+		{"kind=to&query=user3", id2},
+		{"kind=containing&query=world", id2},
+	} {
+		page = MailHogMessages{}
+		json.NewDecoder(get("GET", "/api/v2/search?"+c.query).Body).Decode(&page)
+		if page.Total != 1 || page.Items[0].ID != c.expected {
+			t.Errorf("%s: unexpected page: %v", c.query, page)
+		}
+	}
+	if w := get("GET", "/api/v2/search?kind=bcc&query=x"); w.Code != http.StatusBadRequest {
+		t.Errorf("expected: 400, actual: %d", w.Code)
+	}
+
+	w = get("GET", "/api/v1/messages/"+id1+"/download")
+	if !strings.HasSuffix(w.Body.String(), "Subject: First\r\n\r\nHello\r\n") {
+		t.Errorf("unexpected download: %q", w.Body.String())
+	}
+	if w := get("DELETE", "/api/v1/messages/"+id1); w.Code != http.StatusOK {
+		t.Errorf("expected: 200, actual: %d", w.Code)
+	}
+	if w := get("GET", "/api/v1/messages/"+id1); w.Code != http.StatusNotFound {
+		t.Errorf("expected: 404, actual: %d", w.Code)
+	}
+	get("DELETE", "/api/v1/messages")
+	var items []*MailHogMessage
+	json.NewDecoder(get("GET", "/api/v1/messages").Body).Decode(&items)
+	if len(items) != 0 {
+		t.Errorf("unexpected messages after the deletion: %d", len(items))
+	}
+}
@@ -0,0 +1,116 @@
+package smtp
+
+import (
+	"bytes"
+	"io"
+	"strings"
+)
+
+// Header is the header section of a message as its lines in order, with
+// the continuation lines of folded fields.
+type Header []string
+
+type HeaderField struct {
+	Name  string
+	Value string
+}
+
+// Get returns the unfolded value of the first field of the name, or an
+// empty string.
+func (h Header) Get(name string) string {
+	v, _ := headerValue(h, name)
+	return v
+}
+
+// Has reports whether the header has a field of the name.
+func (h Header) Has(name string) bool {
+	_, ok := headerValue(h, name)
+	return ok
+}
+
+// Values returns the unfolded values of the fields of the name in order.
+func (h Header) Values(name string) []string {
+	return headerValues(h, name)
+}
+
+// Fields returns the fields in order with their values unfolded.
+func (h Header) Fields() []HeaderField {
+	xs := make([]HeaderField, 0, len(h))
+	for i, x := range h {
+		if name := headerName(x); len(name) > 0 {
+			v, _ := headerValue(h[i:], name)
+			xs = append(xs, HeaderField{name, v})
+		}
+	}
+	return xs
+}
+
+// Add appends a field.
+func (h *Header) Add(name, value string) {
+	*h = append(*h, name+": "+value)
+}
+
+// Del removes the fields of the name.
+func (h *Header) Del(name string) {
+	xs := make([]string, 0, len(*h))
+	skip := false
+	for _, x := range *h {
+		if n := headerName(x); len(n) > 0 {
+			skip = strings.EqualFold(n, name)
+		}
+		if !skip {
+			xs = append(xs, x)
+		}
+	}
+	*h = xs
+}
+
+// Set replaces the fields of the name by a field appended.
+func (h *Header) Set(name, value string) {
+	h.Del(name)
+	h.Add(name, value)
+}
+
+// Message is the message of a transaction. It is a view of SMTPState, so
+// changes to the Header are those of SMTPState.Headers.
+type Message struct {
+	st *SMTPState
+}
+
+// Message returns the message received by DATA or BDAT.
+func (st *SMTPState) Message() *Message {
+	return &Message{st}
+}
+
+// Header returns the header of the message, to be modified in place.
+func (m *Message) Header() *Header {
+	return (*Header)(&m.st.Headers)
+}
+
+// Body returns a new reader of the body.
+func (m *Message) Body() io.Reader {
+	return m.st.Content()
+}
+
+// Reader returns a new reader of the message with the Header.
+func (m *Message) Reader() io.Reader {
+	return m.st.messageReader()
+}
+
+// Raw returns a new reader of the message as received.
+func (m *Message) Raw() io.Reader {
+	return m.st.Raw()
+}
+
+// Bytes returns the message with the Header.
+func (m *Message) Bytes() []byte {
+	var b bytes.Buffer
+	b.Grow(int(m.Size()))
+	io.Copy(&b, m.Reader())
+	return b.Bytes()
+}
+
+// Size returns the size of the message with the Header.
+func (m *Message) Size() int64 {
+	return m.st.MessageSize()
+}
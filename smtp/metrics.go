@@ -0,0 +1,266 @@
+package smtp
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// metricDefs are the metrics in the text exposition format of Prometheus.
+var metricDefs = map[string][2]string{
+	"mproxy_sessions_active":      {"gauge", "Number of SMTP sessions in progress."},
+	"mproxy_sessions_total":       {"counter", "Number of SMTP sessions started."},
+	"mproxy_commands_total":       {"counter", "Number of SMTP commands by verb and reply code."},
+	"mproxy_messages_total":       {"counter", "Number of messages by result, accepted or rejected."},
+	"mproxy_relayed_total":        {"counter", "Number of messages relayed by result, ok or error."},
+	"mproxy_received_bytes_total": {"counter", "Bytes received from SMTP clients."},
+	"mproxy_auth_failures_total":  {"counter", "Number of failed AUTH attempts."},
+	"mproxy_tls_handshakes_total": {"counter", "Number of TLS handshakes by result, ok or error."},
+	"mproxy_queue_depth":          {"gauge", "Number of queued messages."},
+	"mproxy_session_panics_total": {"counter", "Number of SMTP sessions ended by a panic."},
+
+	"mproxy_connections_shed_total": {"counter", "Number of connections replied 421 by a saturated worker pool."},
+	"mproxy_store_evicted_total":    {"counter", "Number of stored messages evicted by the retention by reason, age, count or bytes."},
+
+	"mproxy_command_duration_seconds": {"histogram", "Time from receipt of SMTP commands to the flush of their replies by verb."},
+}
+
+// durationBuckets are the upper bounds of the buckets of duration
+// histograms in seconds.
+var durationBuckets = []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// Metrics counts the activity of the sessions sharing it, served by
+// ServeHTTP as /metrics for Prometheus. The methods do nothing on nil.
+type Metrics struct {
+	// Queue reports its depth if set.
+	Queue *Queue
+
+	mtx        sync.Mutex
+	values     map[string]map[string]float64
+	histograms map[string]map[string]*histogram
+}
+
+func NewMetrics() *Metrics {
+	m := &Metrics{
+		values:     make(map[string]map[string]float64),
+		histograms: make(map[string]map[string]*histogram),
+	}
+	for _, name := range []string{"mproxy_sessions_active", "mproxy_sessions_total",
+		"mproxy_received_bytes_total", "mproxy_auth_failures_total", "mproxy_session_panics_total"} {
+		m.add(name, 0)
+	}
+	return m
+}
+
+func labelKey(labels []string) string {
+	xs := make([]string, 0, len(labels)/2)
+	for i := 0; i+1 < len(labels); i += 2 {
+		xs = append(xs, fmt.Sprintf("%s=%q", labels[i], labels[i+1]))
+	}
+	return strings.Join(xs, ",")
+}
+
+// add adds v to the metric with the labels, in pairs of a name and a
+// value.
+func (m *Metrics) add(name string, v float64, labels ...string) {
+	if m == nil {
+		return
+	}
+	key := labelKey(labels)
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	if _, ok := m.values[name]; !ok {
+		m.values[name] = make(map[string]float64)
+	}
+	m.values[name][key] += v
+}
+
+// observe adds v to the histogram with the labels.
+func (m *Metrics) observe(name string, v float64, labels ...string) {
+	if m == nil {
+		return
+	}
+	key := labelKey(labels)
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	if _, ok := m.histograms[name]; !ok {
+		m.histograms[name] = make(map[string]*histogram)
+	}
+	h, ok := m.histograms[name][key]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(durationBuckets))}
+		m.histograms[name][key] = h
+	}
+	for i, x := range durationBuckets {
+		if v <= x {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+func (m *Metrics) sessionStarted() {
+	m.add("mproxy_sessions_active", 1)
+	m.add("mproxy_sessions_total", 1)
+}
+
+func (m *Metrics) sessionClosed() {
+	m.add("mproxy_sessions_active", -1)
+}
+
+// command counts the verb, which is "other" for an unknown one, with the
+// code of the last reply.
+func (m *Metrics) command(verb, reply string) {
+	code := "none"
+	if len(reply) >= 3 {
+		code = reply[:3]
+	}
+	m.add("mproxy_commands_total", 1, "verb", verb, "code", code)
+}
+
+func (m *Metrics) handshake(err error) {
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+	m.add("mproxy_tls_handshakes_total", 1, "result", result)
+}
+
+type pendingCommand struct {
+	verb  string
+	start time.Time
+}
+
+// commandDone observes the duration of the command once its reply is
+// flushed, which may be after the following pipelined commands.
+func (smtpConn *SMTPConnection) commandDone(verb string, start time.Time) {
+	if smtpConn.Config().Metrics == nil {
+		return
+	}
+	smtpConn.pending = append(smtpConn.pending, pendingCommand{verb, start})
+	if smtpConn.writer.W.Buffered() == 0 {
+		smtpConn.observePending()
+	}
+}
+
+func (smtpConn *SMTPConnection) observePending() {
+	now := time.Now()
+	for _, x := range smtpConn.pending {
+		smtpConn.Config().Metrics.observe("mproxy_command_duration_seconds", now.Sub(x.start).Seconds(), "verb", x.verb)
+	}
+	smtpConn.pending = smtpConn.pending[:0]
+}
+
+// countingReader counts the bytes read into the metrics.
+type countingReader struct {
+	r       io.Reader
+	metrics *Metrics
+}
+
+func (r countingReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	if n > 0 {
+		r.metrics.add("mproxy_received_bytes_total", float64(n))
+	}
+	return n, err
+}
+
+// WithRelayMetrics counts the results of send as relayed messages.
+func WithRelayMetrics(send func(st *SMTPState) error, m *Metrics) func(st *SMTPState) error {
+	if m == nil {
+		return send
+	}
+	return func(st *SMTPState) error {
+		err := send(st)
+		result := "ok"
+		if err != nil {
+			result = "error"
+		}
+		m.add("mproxy_relayed_total", 1, "result", result)
+		return err
+	}
+}
+
+// WriteTo writes the metrics in the text exposition format.
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	if m.Queue != nil {
+		if xs, err := m.Queue.List(); err == nil {
+			m.mtx.Lock()
+			m.values["mproxy_queue_depth"] = map[string]float64{"": float64(len(xs))}
+			m.mtx.Unlock()
+		}
+	}
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	names := make([]string, 0, len(m.values)+len(m.histograms))
+	for name := range m.values {
+		names = append(names, name)
+	}
+	for name := range m.histograms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	for _, name := range names {
+		def := metricDefs[name]
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", name, def[1], name, def[0])
+		if hs, ok := m.histograms[name]; ok {
+			writeHistograms(&b, name, hs)
+			continue
+		}
+		keys := make([]string, 0, len(m.values[name]))
+		for key := range m.values[name] {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			if len(key) > 0 {
+				fmt.Fprintf(&b, "%s{%s} %g\n", name, key, m.values[name][key])
+			} else {
+				fmt.Fprintf(&b, "%s %g\n", name, m.values[name][key])
+			}
+		}
+	}
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+func writeHistograms(b *strings.Builder, name string, hs map[string]*histogram) {
+	keys := make([]string, 0, len(hs))
+	for key := range hs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		h := hs[key]
+		prefix := ""
+		if len(key) > 0 {
+			prefix = key + ","
+		}
+		for i, x := range durationBuckets {
+			fmt.Fprintf(b, "%s_bucket{%sle=%q} %d\n", name, prefix, strconv.FormatFloat(x, 'g', -1, 64), h.counts[i])
+		}
+		fmt.Fprintf(b, "%s_bucket{%sle=\"+Inf\"} %d\n", name, prefix, h.count)
+		if len(key) > 0 {
+			key = "{" + key + "}"
+		}
+		fmt.Fprintf(b, "%s_sum%s %g\n%s_count%s %d\n", name, key, h.sum, name, key, h.count)
+	}
+}
+
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	m.WriteTo(w)
+}
@@ -0,0 +1,97 @@
+package smtp
+
+import (
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetrics(t *testing.T) {
+	m := NewMetrics()
+	input := "EHLO localhost\r\n" +
+		"MAIL FROM: <foo@example.net>\r\n" +
+		"RCPT TO: <user1@example.com>\r\n" +
+		"DATA\r\n" +
+		"Subject: Hello\r\n" +
+		"\r\n" +
+		"Hello\r\n" +
+		".\r\n" +
+		"AUTH PLAIN AGZvbwBiYXI=\r\n" +
+		"FOO\r\n" +
+		"QUIT\r\n"
+	conn := NewMockConn([]byte(input))
+	h := NewSMTPHandler(conn, WithRelayMetrics(func(st *SMTPState) error {
+		return errors.New("connection refused")
+	}, m))
+	h.Config.Metrics = m
+	h.Config.Authenticate = func(username, password string) bool { return false }
+	h.Run()
+
+	w := httptest.NewRecorder()
+	m.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	for _, expected := range []string{
+		"# TYPE mproxy_commands_total counter\n",
+		"mproxy_commands_total{verb=\"MAIL\",code=\"250\"} 1\n",
+		"mproxy_commands_total{verb=\"other\",code=\"500\"} 1\n",
+		"mproxy_messages_total{result=\"rejected\"} 1\n",
+		"mproxy_relayed_total{result=\"error\"} 1\n",
+		"mproxy_auth_failures_total 1\n",
+		"mproxy_sessions_active 0\n",
+		"mproxy_sessions_total 1\n",
+		fmt.Sprintf("mproxy_received_bytes_total %d\n", len(input)),
+		"# TYPE mproxy_command_duration_seconds histogram\n",
+		"mproxy_command_duration_seconds_bucket{verb=\"other\",le=\"+Inf\"} 1\n",
+		"mproxy_command_duration_seconds_count{verb=\"MAIL\"} 1\n",
+		"mproxy_command_duration_seconds_count{verb=\"QUIT\"} 1\n",
+	} {
+		if !strings.Contains(w.Body.String(), expected) {
+			t.Errorf("expected: %s, actual: %s", expected, w.Body.String())
+		}
+	}
+}
+
+func TestMetricsHistogram(t *testing.T) {
+	m := NewMetrics()
+	m.observe("mproxy_command_duration_seconds", 0.003, "verb", "DATA")
+	m.observe("mproxy_command_duration_seconds", 20, "verb", "DATA")
+	var b strings.Builder
+	m.WriteTo(&b)
+	for _, expected := range []string{
+		"mproxy_command_duration_seconds_bucket{verb=\"DATA\",le=\"0.0025\"} 0\n",
+		"mproxy_command_duration_seconds_bucket{verb=\"DATA\",le=\"0.005\"} 1\n",
+		"mproxy_command_duration_seconds_bucket{verb=\"DATA\",le=\"10\"} 1\n",
+		"mproxy_command_duration_seconds_bucket{verb=\"DATA\",le=\"+Inf\"} 2\n",
+		"mproxy_command_duration_seconds_sum{verb=\"DATA\"} 20.003\n",
+		"mproxy_command_duration_seconds_count{verb=\"DATA\"} 2\n",
+	} {
+		if !strings.Contains(b.String(), expected) {
+			t.Errorf("expected: %s, actual: %s", expected, b.String())
+		}
+	}
+}
+
+func TestSessionPanic(t *testing.T) {
+	m := NewMetrics()
+	conn := NewMockConn([]byte("EHLO localhost\r\n" +
+		"AUTH PLAIN AGZvbwBiYXI=\r\n" +
+		"QUIT\r\n"))
+	h := NewSMTPHandler(conn, nil)
+	h.Config.Metrics = m
+	h.Config.Authenticate = func(username, password string) bool { panic("broken") }
+	if err := h.Run(); err == nil || !strings.Contains(err.Error(), "broken") {
+		t.Errorf("expected the panic: %v", err)
+	}
+	expected := "220 250 421"
+	if actual := replyCodes(conn.CloneOutputBuffer()); actual != expected {
+		t.Errorf("expected: %s, actual: %s", expected, actual)
+	}
+	var b strings.Builder
+	m.WriteTo(&b)
+	for _, expected := range []string{"mproxy_session_panics_total 1\n", "mproxy_sessions_active 0\n"} {
+		if !strings.Contains(b.String(), expected) {
+			t.Errorf("expected: %s, actual: %s", expected, b.String())
+		}
+	}
+}
@@ -0,0 +1,544 @@
+package smtp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Milter is a client of the Sendmail milter protocol (version 6). Register
+// adds hooks which consult the milter at each stage of a session, and apply
+// the modifications it asks for at the end of the message.
+type Milter struct {
+	Network  string
+	Addr     string
+	Timeout  time.Duration
+	FailOpen bool
+
+	mtx      sync.Mutex
+	sessions map[string]*milterSession
+}
+
+// NewMilter returns a milter for an address in the form of "inet:host:port",
+// "unix:/path/to/socket" or "host:port".
+func NewMilter(addr string) *Milter {
+	network := "tcp"
+	if strings.HasPrefix(addr, "unix:") {
+		network, addr = "unix", addr[5:]
+	} else if strings.HasPrefix(addr, "inet:") {
+		addr = addr[5:]
+	}
+	return &Milter{
+		Network:  network,
+		Addr:     addr,
+		Timeout:  30 * time.Second,
+		sessions: make(map[string]*milterSession),
+	}
+}
+
+const (
+	milterVersion = 6
+
+	milterAddHeaders    = 0x01
+	milterChangeBody    = 0x02
+	milterAddRcpt       = 0x04
+	milterDeleteRcpt    = 0x08
+	milterChangeHeaders = 0x10
+	milterQuarantine    = 0x20
+
+	// protocol flags the milter may set to skip a command or its reply
+	milterNoConnect   = 0x01
+	milterNoHelo      = 0x02
+	milterNoMail      = 0x04
+	milterNoRcpt      = 0x08
+	milterNoBody      = 0x10
+	milterNoHeaders   = 0x20
+	milterNoEOH       = 0x40
+	milterNRHeader    = 0x80
+	milterNRConnect   = 0x1000
+	milterNRHelo      = 0x2000
+	milterNRMail      = 0x4000
+	milterNRRcpt      = 0x8000
+	milterNREOH       = 0x40000
+	milterNRBody      = 0x80000
+	milterProtocolAll = 0x7f | milterNRHeader | milterNRConnect | milterNRHelo |
+		milterNRMail | milterNRRcpt | milterNREOH | milterNRBody
+
+	milterChunkSize = 65535
+)
+
+const milterErrorReply = "451 4.3.0 Local error in processing"
+
+type milterSession struct {
+	conn     net.Conn
+	r        *bufio.Reader
+	protocol uint32
+	accepted bool // for the session
+	skip     bool // for the transaction
+	discard  bool
+	inTx     bool
+}
+
+func (m *Milter) Register(h *Hooks) {
+	h.OnConnect(m.connect)
+	h.OnHelo(m.helo)
+	h.OnMail(m.mail)
+	h.OnRcpt(m.rcpt)
+	h.OnData(m.data)
+	h.OnClose(m.close)
+}
+
+func (m *Milter) session(conn *SMTPConnection) *milterSession {
+	defer m.mtx.Unlock()
+	m.mtx.Lock()
+	return m.sessions[conn.ID()]
+}
+
+// fail closes the session and returns the reply for the failure.
+func (m *Milter) fail(conn *SMTPConnection, s *milterSession) string {
+	if s != nil {
+		s.conn.Close()
+		s.accepted, s.skip = true, true
+	}
+	m.mtx.Lock()
+	delete(m.sessions, conn.ID())
+	m.mtx.Unlock()
+	if m.FailOpen {
+		return ""
+	}
+	return milterErrorReply
+}
+
+func (m *Milter) connect(conn *SMTPConnection) string {
+	c, err := net.DialTimeout(m.Network, m.Addr, m.Timeout)
+	if err != nil {
+		return m.fail(conn, nil)
+	}
+	s := &milterSession{conn: c, r: bufio.NewReader(c)}
+	var b milterEncoder
+	b.uint32(milterVersion)
+	b.uint32(milterAddHeaders | milterChangeBody | milterAddRcpt |
+		milterDeleteRcpt | milterChangeHeaders | milterQuarantine)
+	b.uint32(milterProtocolAll)
+	if err := s.write(m, 'O', b.Bytes()); err != nil {
+		return m.fail(conn, s)
+	}
+	cmd, data, err := s.read(m)
+	if err != nil || cmd != 'O' || len(data) < 12 {
+		return m.fail(conn, s)
+	}
+	s.protocol = binary.BigEndian.Uint32(data[8:]) & milterProtocolAll
+	m.mtx.Lock()
+	m.sessions[conn.ID()] = s
+	m.mtx.Unlock()
+
+	ip := conn.RemoteIP()
+	port := 0
+	if _, x, err := net.SplitHostPort(conn.State().RemoteAddr); err == nil {
+		port, _ = strconv.Atoi(x)
+	}
+	s.macros(m, 'C', "j", conn.Config().ServerName, "{daemon_name}", "mproxy",
+		"{client_addr}", ip)
+	b.Reset()
+	b.cstring("[" + ip + "]")
+	switch x := net.ParseIP(ip); {
+	case x == nil:
+		b.WriteByte('U')
+	case x.To4() != nil:
+		b.WriteByte('4')
+	default:
+		b.WriteByte('6')
+	}
+	if x := net.ParseIP(ip); x != nil {
+		binary.Write(&b, binary.BigEndian, uint16(port))
+		b.cstring(ip)
+	}
+	return m.command(conn, s, 'C', b.Bytes(), milterNoConnect, milterNRConnect)
+}
+
+func (m *Milter) helo(conn *SMTPConnection) string {
+	s := m.session(conn)
+	if s == nil || s.accepted {
+		return ""
+	}
+	var b milterEncoder
+	b.cstring(conn.State().ClientName)
+	return m.command(conn, s, 'H', b.Bytes(), milterNoHelo, milterNRHelo)
+}
+
+func (m *Milter) mail(conn *SMTPConnection) string {
+	s := m.session(conn)
+	if s == nil || s.accepted {
+		return ""
+	}
+	if s.inTx {
+		if err := s.write(m, 'A', nil); err != nil {
+			return m.fail(conn, s)
+		}
+	}
+	s.inTx, s.skip, s.discard = true, false, false
+	st := conn.State()
+	s.macros(m, 'M', "{mail_addr}", st.ReturnTo, "{auth_authen}", st.Username)
+	var b milterEncoder
+	b.cstring("<" + st.ReturnTo + ">")
+	keys := make([]string, 0, len(st.MailParams))
+	for k := range st.MailParams {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if v := st.MailParams[k]; len(v) > 0 {
+			b.cstring(k + "=" + v)
+		} else {
+			b.cstring(k)
+		}
+	}
+	return m.command(conn, s, 'M', b.Bytes(), milterNoMail, milterNRMail)
+}
+
+func (m *Milter) rcpt(conn *SMTPConnection, rcpt Address) string {
+	s := m.session(conn)
+	if s == nil || s.accepted || s.skip {
+		return ""
+	}
+	s.macros(m, 'R', "{rcpt_addr}", rcpt.String())
+	var b milterEncoder
+	b.cstring("<" + rcpt.String() + ">")
+	return m.command(conn, s, 'R', b.Bytes(), milterNoRcpt, milterNRRcpt)
+}
+
+func (m *Milter) data(conn *SMTPConnection) string {
+	s := m.session(conn)
+	if s == nil || s.accepted {
+		return ""
+	}
+	s.inTx = false
+	if s.skip {
+		return ""
+	}
+	st := conn.State()
+	if s.discard {
+		st.discarded = true
+		return ""
+	}
+	if s.protocol&milterNoHeaders == 0 {
+		for _, f := range milterHeaderFields(st.Headers) {
+			var b milterEncoder
+			b.cstring(f[0])
+			b.cstring(f[1])
+			if reply := m.command(conn, s, 'L', b.Bytes(), 0, milterNRHeader); len(reply) > 0 || s.skip {
+				return m.endOfData(conn, s, reply)
+			}
+		}
+	}
+	if reply := m.command(conn, s, 'N', nil, milterNoEOH, milterNREOH); len(reply) > 0 || s.skip {
+		return m.endOfData(conn, s, reply)
+	}
+	if s.protocol&milterNoBody == 0 {
+		r := st.Content()
+		buf := make([]byte, milterChunkSize)
+		for {
+			n, err := io.ReadFull(r, buf)
+			if n > 0 {
+				reply := m.command(conn, s, 'B', buf[:n], 0, milterNRBody)
+				if len(reply) > 0 || s.skip {
+					return m.endOfData(conn, s, reply)
+				}
+			}
+			if err != nil {
+				break
+			}
+		}
+	}
+	s.macros(m, 'E', "i", conn.ID())
+	if err := s.write(m, 'E', nil); err != nil {
+		return m.fail(conn, s)
+	}
+	body := make([]byte, 0)
+	replaced := false
+	for {
+		cmd, data, err := s.read(m)
+		if err != nil {
+			return m.fail(conn, s)
+		}
+		switch cmd {
+		case 'p':
+		case 'h':
+			if xs := milterStrings(data); len(xs) >= 2 {
+				st.Headers = append(st.Headers, milterHeaderLines(xs[0], xs[1])...)
+			}
+		case 'i', 'm':
+			if len(data) < 4 {
+				return m.fail(conn, s)
+			}
+			i := int(binary.BigEndian.Uint32(data))
+			if xs := milterStrings(data[4:]); len(xs) >= 2 {
+				if cmd == 'i' {
+					st.Headers = insertHeader(st.Headers, i, milterHeaderLines(xs[0], xs[1]))
+				} else {
+					st.Headers = changeHeader(st.Headers, xs[0], i, xs[1])
+				}
+			}
+		case '+', '2':
+			if xs := milterStrings(data); len(xs) >= 1 {
+				if addr, err := ParseAddress(strings.Trim(xs[0], "<>")); err == nil {
+					addRecipient(st, addr)
+				}
+			}
+		case '-':
+			if xs := milterStrings(data); len(xs) >= 1 {
+				removeRecipient(st, strings.Trim(xs[0], "<>"))
+			}
+		case 'b':
+			body = append(body, data...)
+			replaced = true
+		case 'q':
+			st.Quarantined = true
+		default:
+			if replaced {
+				st.SetContent(body)
+			}
+			reply, ok := s.reply(cmd, data)
+			if !ok {
+				return m.fail(conn, s)
+			}
+			if s.discard {
+				st.discarded = true
+			}
+			return reply
+		}
+	}
+}
+
+// endOfData finishes a message the milter decided before its end.
+func (m *Milter) endOfData(conn *SMTPConnection, s *milterSession, reply string) string {
+	if s.discard {
+		conn.State().discarded = true
+	}
+	return reply
+}
+
+func (m *Milter) close(conn *SMTPConnection) {
+	s := m.session(conn)
+	if s == nil {
+		return
+	}
+	s.write(m, 'Q', nil)
+	s.conn.Close()
+	m.mtx.Lock()
+	delete(m.sessions, conn.ID())
+	m.mtx.Unlock()
+}
+
+// command sends the command unless the milter asked to skip it, and returns
+// the reply of a rejection.
+func (m *Milter) command(conn *SMTPConnection, s *milterSession, cmd byte, data []byte, no, noReply uint32) string {
+	if s.protocol&no != 0 {
+		return ""
+	}
+	if err := s.write(m, cmd, data); err != nil {
+		return m.fail(conn, s)
+	}
+	if s.protocol&noReply != 0 {
+		return ""
+	}
+	for {
+		code, data, err := s.read(m)
+		if err != nil {
+			return m.fail(conn, s)
+		}
+		if code == 'p' {
+			continue
+		}
+		reply, ok := s.reply(code, data)
+		if !ok {
+			return m.fail(conn, s)
+		}
+		return reply
+	}
+}
+
+// reply interprets a response which ends a command.
+func (s *milterSession) reply(code byte, data []byte) (string, bool) {
+	switch code {
+	case 'c':
+		return "", true
+	case 'a':
+		if s.inTx {
+			s.skip = true
+		} else {
+			s.accepted = true
+		}
+		return "", true
+	case 's':
+		s.skip = true
+		return "", true
+	case 'd':
+		s.discard, s.skip = true, true
+		return "", true
+	case 'r':
+		return "550 5.7.1 Command rejected", true
+	case 't':
+		return "451 4.7.1 Service unavailable - try again later", true
+	case 'y':
+		reply := strings.TrimRight(string(data), "\x00")
+		if len(reply) < 3 || (reply[0] != '4' && reply[0] != '5') {
+			return "", false
+		}
+		return strings.Replace(reply, "\r\n", " ", -1), true
+	}
+	return "", false
+}
+
+func (s *milterSession) write(m *Milter, cmd byte, data []byte) error {
+	s.conn.SetDeadline(time.Now().Add(m.Timeout))
+	b := make([]byte, 5, 5+len(data))
+	binary.BigEndian.PutUint32(b, uint32(len(data)+1))
+	b[4] = cmd
+	_, err := s.conn.Write(append(b, data...))
+	return err
+}
+
+func (s *milterSession) read(m *Milter) (byte, []byte, error) {
+	s.conn.SetDeadline(time.Now().Add(m.Timeout))
+	var size uint32
+	if err := binary.Read(s.r, binary.BigEndian, &size); err != nil {
+		return 0, nil, err
+	}
+	if size == 0 || size > 1<<24 {
+		return 0, nil, fmt.Errorf("milter: invalid packet size %d", size)
+	}
+	b := make([]byte, size)
+	if _, err := io.ReadFull(s.r, b); err != nil {
+		return 0, nil, err
+	}
+	return b[0], b[1:], nil
+}
+
+// macros defines the macros for the next command. Empty values are omitted.
+func (s *milterSession) macros(m *Milter, cmd byte, kvs ...string) error {
+	var b milterEncoder
+	b.WriteByte(cmd)
+	for i := 0; i+1 < len(kvs); i += 2 {
+		if len(kvs[i+1]) > 0 {
+			b.cstring(kvs[i])
+			b.cstring(kvs[i+1])
+		}
+	}
+	return s.write(m, 'D', b.Bytes())
+}
+
+type milterEncoder struct {
+	bytes.Buffer
+}
+
+func (e *milterEncoder) uint32(v uint32) {
+	binary.Write(e, binary.BigEndian, v)
+}
+
+func (e *milterEncoder) cstring(s string) {
+	e.WriteString(s)
+	e.WriteByte(0)
+}
+
+func milterStrings(b []byte) []string {
+	return strings.Split(strings.TrimSuffix(string(b), "\x00"), "\x00")
+}
+
+// milterHeaderFields unfolds the header lines into names and values, where
+// continuation lines are joined with "\n".
+func milterHeaderFields(headers []string) [][2]string {
+	fields := make([][2]string, 0)
+	for _, line := range headers {
+		name := headerName(line)
+		if len(name) == 0 {
+			if n := len(fields); n > 0 {
+				fields[n-1][1] += "\n" + line
+			}
+			continue
+		}
+		fields = append(fields, [2]string{name, strings.TrimLeft(line[strings.IndexByte(line, ':')+1:], " ")})
+	}
+	return fields
+}
+
+func milterHeaderLines(name, value string) []string {
+	return strings.Split(strings.Replace(name+": "+value, "\r\n", "\n", -1), "\n")
+}
+
+// insertHeader inserts the lines before the i-th field.
+func insertHeader(headers []string, i int, lines []string) []string {
+	pos := len(headers)
+	n := 0
+	for j, line := range headers {
+		if len(headerName(line)) == 0 {
+			continue
+		}
+		if n == i {
+			pos = j
+			break
+		}
+		n++
+	}
+	xs := append([]string{}, headers[:pos]...)
+	xs = append(xs, lines...)
+	return append(xs, headers[pos:]...)
+}
+
+// changeHeader replaces the i-th (1-based) field of the name, or deletes it
+// if the value is empty. A missing field is added.
+func changeHeader(headers []string, name string, i int, value string) []string {
+	n := 0
+	for j := 0; j < len(headers); j++ {
+		if !strings.EqualFold(headerName(headers[j]), name) {
+			continue
+		}
+		n++
+		if n != i {
+			continue
+		}
+		end := j + 1
+		for end < len(headers) && len(headerName(headers[end])) == 0 {
+			end++
+		}
+		xs := append([]string{}, headers[:j]...)
+		if len(value) > 0 {
+			xs = append(xs, milterHeaderLines(name, value)...)
+		}
+		return append(xs, headers[end:]...)
+	}
+	if len(value) == 0 {
+		return headers
+	}
+	return append(headers, milterHeaderLines(name, value)...)
+}
+
+func addRecipient(st *SMTPState, addr Address) {
+	st.Recipients = append(st.Recipients, addr.String())
+	st.RecipientAddresses = append(st.RecipientAddresses, addr)
+	st.RecipientParams = append(st.RecipientParams, ESMTPParams{})
+	st.RecipientDSNs = append(st.RecipientDSNs, RecipientDSN{})
+	st.RecipientMailboxes = append(st.RecipientMailboxes, addr.String())
+}
+
+func removeRecipient(st *SMTPState, rcpt string) {
+	for i := 0; i < len(st.Recipients); i++ {
+		if !strings.EqualFold(st.Recipients[i], rcpt) {
+			continue
+		}
+		st.Recipients = append(st.Recipients[:i], st.Recipients[i+1:]...)
+		st.RecipientAddresses = append(st.RecipientAddresses[:i], st.RecipientAddresses[i+1:]...)
+		st.RecipientParams = append(st.RecipientParams[:i], st.RecipientParams[i+1:]...)
+		st.RecipientDSNs = append(st.RecipientDSNs[:i], st.RecipientDSNs[i+1:]...)
+		st.RecipientMailboxes = append(st.RecipientMailboxes[:i], st.RecipientMailboxes[i+1:]...)
+		i--
+	}
+}
@@ -0,0 +1,149 @@
+package smtp
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+func writeMilterTestPacket(w io.Writer, cmd byte, data string) {
+	binary.Write(w, binary.BigEndian, uint32(len(data)+1))
+	w.Write(append([]byte{cmd}, data...))
+}
+
+// serveMilter rejects recipients named "blocked", and adds a header, changes
+// the subject and adds a recipient at the end of the message.
+func serveMilter(lsnr net.Listener, commands chan<- string) {
+	conn, err := lsnr.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	defer close(commands)
+	for {
+		var size uint32
+		if err := binary.Read(conn, binary.BigEndian, &size); err != nil {
+			return
+		}
+		b := make([]byte, size)
+		if _, err := io.ReadFull(conn, b); err != nil {
+			return
+		}
+		cmd, data := b[0], strings.Replace(string(b[1:]), "\x00", " ", -1)
+		if cmd == 'O' {
+			commands <- "O"
+		} else if cmd != 'D' {
+			commands <- string(cmd) + strings.TrimSpace(data)
+		}
+		switch cmd {
+		case 'O':
+			writeMilterTestPacket(conn, 'O', "\x00\x00\x00\x06\x00\x00\x00\x3f\x00\x00\x00\x00")
+		case 'C', 'H', 'M', 'L', 'N', 'B':
+			writeMilterTestPacket(conn, 'c', "")
+		case 'R':
+			if strings.Contains(data, "blocked") {
+				writeMilterTestPacket(conn, 'y', "550 5.7.1 Blocked by milter\x00")
+			} else {
+				writeMilterTestPacket(conn, 'c', "")
+			}
+		case 'E':
+			writeMilterTestPacket(conn, 'p', "")
+			writeMilterTestPacket(conn, 'h', "X-Milter\x00yes\x00")
+			writeMilterTestPacket(conn, 'm', "\x00\x00\x00\x01Subject\x00Changed\x00")
+			writeMilterTestPacket(conn, '+', "<user2@example.net>\x00")
+			writeMilterTestPacket(conn, 'a', "")
+		case 'Q':
+			return
+		}
+	}
+}
+
+func TestMilter(t *testing.T) {
+	lsnr, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip(err)
+	}
+	defer lsnr.Close()
+	commands := make(chan string, 32)
+	go serveMilter(lsnr, commands)
+
+	conn := NewMockConn([]byte("EHLO localhost\r\n" +
+		"MAIL FROM: <foo@example.net>\r\n" +
+		"RCPT TO: <user1@example.net>\r\n" +
+		"RCPT TO: <blocked@example.net>\r\n" +
+		"DATA\r\n" +
+		"Subject: Milter\r\n" +
+		"X-Folded: a\r\n" +
+		" b\r\n" +
+		"\r\n" +
+		"Hello\r\n" +
+		".\r\n" +
+		"QUIT\r\n"))
+	var sent string
+	h := NewSMTPHandler(conn, func(st *SMTPState) error {
+		sent = st.String()
+		return nil
+	})
+	h.Config.Hooks = &Hooks{}
+	NewMilter("inet:" + lsnr.Addr().String()).Register(h.Config.Hooks)
+	h.Run()
+
+	expected := "220 250 250 250 550 354 250 221"
+	if actual := replyCodes(conn.CloneOutputBuffer()); actual != expected {
+		t.Errorf("expected: %s, actual: %s", expected, actual)
+	}
+	expected = "MAIL FROM: <foo@example.net>\r\n" +
+		"RCPT TO: <user1@example.net>\r\n" +
+		"RCPT TO: <user2@example.net>\r\n" +
+		"DATA\r\n" +
+		"Subject: Changed\r\n" +
+		"X-Folded: a\r\n" +
+		" b\r\n" +
+		"X-Milter: yes\r\n" +
+		"\r\n" +
+		"Hello\r\n"
+	if sent != expected {
+		t.Errorf("expected: %s, actual: %s", expected, sent)
+	}
+	actual := make([]string, 0)
+	for x := range commands {
+		actual = append(actual, x)
+	}
+	expected = "O|C[] U|Hlocalhost|M<foo@example.net>|R<user1@example.net>|R<blocked@example.net>|" +
+		"LSubject Milter|LX-Folded a\n b|N|BHello|E|Q"
+	if strings.Join(actual, "|") != expected {
+		t.Errorf("expected: %s, actual: %s", expected, strings.Join(actual, "|"))
+	}
+}
+
+func TestMilterUnavailable(t *testing.T) {
+	lsnr, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip(err)
+	}
+	addr := lsnr.Addr().String()
+	lsnr.Close()
+
+	conn := NewMockConn([]byte("EHLO localhost\r\nQUIT\r\n"))
+	h := NewSMTPHandler(conn, nil)
+	h.Config.Hooks = &Hooks{}
+	NewMilter(addr).Register(h.Config.Hooks)
+	h.Run()
+	if actual := replyCodes(conn.CloneOutputBuffer()); !strings.HasPrefix(actual, "451") {
+		t.Errorf("expected: 451, actual: %s", actual)
+	}
+
+	conn = NewMockConn([]byte("EHLO localhost\r\nQUIT\r\n"))
+	h = NewSMTPHandler(conn, nil)
+	h.Config.Hooks = &Hooks{}
+	m := NewMilter(addr)
+	m.FailOpen = true
+	m.Register(h.Config.Hooks)
+	h.Run()
+	expected := "220 250 221"
+	if actual := replyCodes(conn.CloneOutputBuffer()); actual != expected {
+		t.Errorf("expected: %s, actual: %s", expected, actual)
+	}
+}
@@ -0,0 +1,193 @@
+package smtp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const maxMTASTSPolicySize = 64 << 10
+
+// MTASTSPolicy is an MTA-STS policy (RFC 8461) of a recipient domain. Mode
+// is enforce, testing or none.
+type MTASTSPolicy struct {
+	ID     string
+	Mode   string
+	MX     []string
+	MaxAge time.Duration
+}
+
+// ParseMTASTSPolicy parses the policy file served at
+// https://mta-sts.<domain>/.well-known/mta-sts.txt.
+func ParseMTASTSPolicy(b []byte) (*MTASTSPolicy, error) {
+	p := &MTASTSPolicy{}
+	version := ""
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		i := strings.IndexByte(line, ':')
+		if i < 0 {
+			continue
+		}
+		v := strings.TrimSpace(line[i+1:])
+		switch strings.TrimSpace(line[:i]) {
+		case "version":
+			version = v
+		case "mode":
+			p.Mode = v
+		case "mx":
+			p.MX = append(p.MX, strings.ToLower(v))
+		case "max_age":
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || n < 0 || n > 31557600 {
+				return nil, fmt.Errorf("mta-sts: invalid max_age: %s", v)
+			}
+			p.MaxAge = time.Duration(n) * time.Second
+		}
+	}
+	if version != "STSv1" {
+		return nil, errors.New("mta-sts: unsupported version")
+	}
+	switch p.Mode {
+	case "enforce", "testing":
+		if len(p.MX) == 0 {
+			return nil, errors.New("mta-sts: no mx")
+		}
+	case "none":
+	default:
+		return nil, fmt.Errorf("mta-sts: invalid mode: %s", p.Mode)
+	}
+	return p, nil
+}
+
+// Match reports whether the MX host is permitted by the policy. A pattern
+// "*.example.net" matches a single leftmost label.
+func (p *MTASTSPolicy) Match(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, x := range p.MX {
+		if strings.HasPrefix(x, "*.") {
+			i := strings.IndexByte(host, '.')
+			if i > 0 && host[i:] == x[1:] {
+				return true
+			}
+		} else if host == x {
+			return true
+		}
+	}
+	return false
+}
+
+type mtastsEntry struct {
+	policy  *MTASTSPolicy
+	expires time.Time
+}
+
+// MTASTSCache fetches the policies of recipient domains and keeps them for
+// their max_age, refreshing them when the id of the TXT record changes.
+type MTASTSCache struct {
+	Resolver Resolver
+	Client   *http.Client
+
+	mtx      sync.Mutex
+	policies map[string]mtastsEntry
+}
+
+func NewMTASTSCache() *MTASTSCache {
+	return &MTASTSCache{
+		Client: &http.Client{
+			Timeout: 60 * time.Second,
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		policies: make(map[string]mtastsEntry),
+	}
+}
+
+// lookupMTASTSID returns the id of the _mta-sts TXT record of the domain,
+// or an empty string if there is none.
+func lookupMTASTSID(ctx context.Context, r Resolver, domain string) (string, error) {
+	txts, err := r.LookupTXT(ctx, "_mta-sts."+domain)
+	if err != nil && !isNotFound(err) {
+		return "", err
+	}
+	ids := make([]string, 0)
+	for _, txt := range txts {
+		tags, err := parseDKIMTags(txt)
+		if err == nil && tags["v"] == "STSv1" && len(tags["id"]) > 0 {
+			ids = append(ids, tags["id"])
+		}
+	}
+	if len(ids) != 1 {
+		return "", nil
+	}
+	return ids[0], nil
+}
+
+func (c *MTASTSCache) fetch(ctx context.Context, domain string) (*MTASTSPolicy, error) {
+	req, err := http.NewRequest("GET", "https://mta-sts."+domain+"/.well-known/mta-sts.txt", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.Client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("mta-sts: %s", resp.Status)
+	}
+	if !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/plain") {
+		return nil, errors.New("mta-sts: unexpected content type")
+	}
+	b, err := io.ReadAll(io.LimitReader(resp.Body, maxMTASTSPolicySize))
+	if err != nil {
+		return nil, err
+	}
+	return ParseMTASTSPolicy(b)
+}
+
+// Policy returns the policy of the domain, or nil if the domain has none or
+// it cannot be fetched and none is cached, in which case delivery falls
+// back to opportunistic TLS.
+func (c *MTASTSCache) Policy(ctx context.Context, domain string) *MTASTSPolicy {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	now := time.Now()
+	c.mtx.Lock()
+	cached, ok := c.policies[domain]
+	c.mtx.Unlock()
+	if ok && now.After(cached.expires) {
+		ok = false
+	}
+	r := c.Resolver
+	if r == nil {
+		r = (&SMTPConfig{}).resolver()
+	}
+	id, err := lookupMTASTSID(ctx, r, domain)
+	if err != nil || len(id) == 0 || (ok && cached.policy.ID == id) {
+		if ok {
+			return cached.policy
+		}
+		return nil
+	}
+	p, err := c.fetch(ctx, domain)
+	if err != nil {
+		if ok {
+			return cached.policy
+		}
+		return nil
+	}
+	p.ID = id
+	c.mtx.Lock()
+	c.policies[domain] = mtastsEntry{p, now.Add(p.MaxAge)}
+	c.mtx.Unlock()
+	return p
+}
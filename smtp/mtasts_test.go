@@ -0,0 +1,139 @@
+package smtp
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestParseMTASTSPolicy(t *testing.T) {
+	p, err := ParseMTASTSPolicy([]byte("version: STSv1\r\n" +
+		"mode: enforce\r\n" +
+		"mx: mail.example.com\r\n" +
+		"mx: *.example.net\r\n" +
+		"max_age: 86400\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Mode != "enforce" || p.MaxAge != 24*time.Hour {
+		t.Errorf("unexpected policy: %v", p)
+	}
+	for host, expected := range map[string]bool{
+		"mail.example.com":    true,
+		"MAIL.example.com.":   true,
+		"mx1.example.net":     true,
+		"a.mx1.example.net":   false,
+		"example.net":         false,
+		"mail2.example.com":   false,
+		"mail.example.com.cn": false,
+	} {
+		if actual := p.Match(host); actual != expected {
+			t.Errorf("%s expected: %v, actual: %v", host, expected, actual)
+		}
+	}
+	for _, x := range []string{
+		"version: STSv2\nmode: none\n",
+		"version: STSv1\nmode: enforce\nmax_age: 86400\n",
+		"version: STSv1\nmode: strict\nmx: mail.example.com\n",
+	} {
+		if _, err := ParseMTASTSPolicy([]byte(x)); err == nil {
+			t.Errorf("expected an error: %q", x)
+		}
+	}
+}
+
+func TestMTASTSCache(t *testing.T) {
+	fetched := 0
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Host != "mta-sts.example.com" || req.URL.Path != "/.well-known/mta-sts.txt" {
+			http.NotFound(w, req)
+			return
+		}
+		fetched++
+		w.Header().Set("Content-Type", "text/plain")
+		fmt.Fprint(w, "version: STSv1\nmode: enforce\nmx: mx.example.com\nmax_age: 3600\n")
+	}))
+	defer srv.Close()
+	r := &testResolver{txt: map[string][]string{
+		"_mta-sts.example.com": {"v=STSv1; id=20260101"},
+	}}
+	c := NewMTASTSCache()
+	c.Client = srv.Client()
+	c.Resolver = r
+	for i := 0; i < 2; i++ {
+		p := c.Policy(context.Background(), "example.com")
+		if p == nil || p.Mode != "enforce" || p.ID != "20260101" {
+			t.Fatalf("unexpected policy: %v", p)
+		}
+	}
+	if fetched != 1 {
+		t.Errorf("expected: 1, actual: %d", fetched)
+	}
+	r.txt["_mta-sts.example.com"] = []string{"v=STSv1; id=20260102"}
+	if p := c.Policy(context.Background(), "example.com"); p == nil || p.ID != "20260102" || fetched != 2 {
+		t.Errorf("unexpected policy: %v", p)
+	}
+	// the cached policy is used while the record is unavailable
+	delete(r.txt, "_mta-sts.example.com")
+	if p := c.Policy(context.Background(), "example.com"); p == nil {
+		t.Errorf("expected the cached policy")
+	}
+	if p := c.Policy(context.Background(), "sub.example.com"); p != nil {
+		t.Errorf("unexpected policy: %v", p)
+	}
+}
+
+func TestDeliverMX(t *testing.T) {
+	cert, pool := testCertificate(t, "mx.example.com")
+	for _, x := range []struct {
+		mx       string
+		starttls bool
+		expected string
+	}{
+		{"mx.example.com", true, "TLS\r\nMAIL FROM:<foo@example.net>\r\n"},
+		{"mx.example.com", false, ""},
+		{"*.example.org", true, ""},
+	} {
+		lsnr, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Skip(err)
+		}
+		var c *tls.Certificate
+		if x.starttls {
+			c = &cert
+		}
+		received := serveUpstream(lsnr, c)
+		_, port, _ := net.SplitHostPort(lsnr.Addr().String())
+
+		router := NewRouter("mx")
+		router.Resolver = &testResolver{
+			mx: map[string][]string{"example.com": {"mx.example.com"}},
+			ip: map[string][]string{"mx.example.com": {"127.0.0.1"}},
+		}
+		router.MXPort = port
+		router.TLSConfig = &tls.Config{RootCAs: pool}
+		router.MTASTS = NewMTASTSCache()
+		router.MTASTS.policies["example.com"] = mtastsEntry{
+			&MTASTSPolicy{ID: "1", Mode: "enforce", MX: []string{x.mx}},
+			time.Now().Add(time.Hour),
+		}
+		st := &SMTPState{ReturnTo: "foo@example.net", Recipients: []string{"user1@example.com"}}
+		st.SetContent([]byte("Hello\r\n"))
+		err = router.Send(st)
+		if len(x.expected) > 0 && err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		if len(x.expected) == 0 && err == nil {
+			t.Errorf("%s %v expected an error", x.mx, x.starttls)
+		}
+		lsnr.Close()
+		if actual := <-received; len(x.expected) > 0 && actual[:len(x.expected)] != x.expected {
+			t.Errorf("expected: %q, actual: %q", x.expected, actual)
+		}
+	}
+}
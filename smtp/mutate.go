@@ -0,0 +1,192 @@
+package smtp
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// MutationAction is what a Mutation changes of a message.
+type MutationAction string
+
+const (
+	MutateSubject MutationAction = "subject"
+	MutateHeader  MutationAction = "header"
+	MutatePrepend MutationAction = "prepend"
+	MutateAppend  MutationAction = "append"
+)
+
+// Mutation rewrites a message with the text of Template: it replaces the
+// Subject, adds the header Name, or prepends or appends the text to the
+// body. It applies to the messages whose sender matches the glob pattern
+// From and a recipient of which matches To, where set.
+type Mutation struct {
+	Action   MutationAction
+	Name     string
+	From     string
+	To       string
+	Template *template.Template
+}
+
+type Mutations []Mutation
+
+// MutationData is the data of the templates.
+type MutationData struct {
+	Sender        string
+	Recipients    []string
+	Subject       string
+	MessageID     string
+	TransactionID string
+	Username      string
+	Listener      string
+	Date          time.Time
+}
+
+var mutationFuncs = template.FuncMap{
+	"env":  os.Getenv,
+	"join": strings.Join,
+}
+
+// ParseMutations reads mutations in the form of "action [option]...
+// template", one per line, where the options are from=GLOB and to=GLOB,
+// and the header action takes the name of the header first. In the text
+// of prepend and append, "\n" is a line break.
+//
+//	subject [TEST] {{.Subject}}
+//	header X-CI-Run {{env "CI_RUN_ID"}}
+//	append to=*@example.com \n-- \nSent to {{join .Recipients ", "}}\n
+func ParseMutations(r io.Reader) (Mutations, error) {
+	mutations := make(Mutations, 0)
+	scanner := bufio.NewScanner(r)
+	n := 0
+	for scanner.Scan() {
+		n++
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		m, err := parseMutation(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", n, err)
+		}
+		mutations = append(mutations, m)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return mutations, nil
+}
+
+// cutField returns the first field of s and the rest without the leading
+// whitespace.
+func cutField(s string) (string, string) {
+	if i := strings.IndexAny(s, " \t"); i >= 0 {
+		return s[:i], strings.TrimLeft(s[i+1:], " \t")
+	}
+	return s, ""
+}
+
+func parseMutation(line string) (Mutation, error) {
+	action, rest := cutField(line)
+	m := Mutation{Action: MutationAction(strings.ToLower(action))}
+	switch m.Action {
+	case MutateSubject, MutatePrepend, MutateAppend:
+	case MutateHeader:
+		m.Name, rest = cutField(rest)
+		if len(m.Name) == 0 || strings.ContainsAny(m.Name, ":") {
+			return m, fmt.Errorf("invalid header name: %s", m.Name)
+		}
+	default:
+		return m, fmt.Errorf("unknown action: %s", action)
+	}
+	for {
+		x, next := cutField(rest)
+		if strings.HasPrefix(x, "from=") {
+			m.From = x[5:]
+		} else if strings.HasPrefix(x, "to=") {
+			m.To = x[3:]
+		} else {
+			break
+		}
+		rest = next
+	}
+	if len(rest) == 0 {
+		return m, fmt.Errorf("missing template")
+	}
+	t, err := template.New(string(m.Action)).Funcs(mutationFuncs).Parse(rest)
+	if err != nil {
+		return m, err
+	}
+	m.Template = t
+	return m, nil
+}
+
+func (m Mutation) matches(st *SMTPState) bool {
+	if len(m.From) > 0 && !sieveMatch(":matches", st.ReturnTo, m.From) {
+		return false
+	}
+	if len(m.To) == 0 {
+		return true
+	}
+	for _, x := range st.Recipients {
+		if sieveMatch(":matches", x, m.To) {
+			return true
+		}
+	}
+	return false
+}
+
+// Apply rewrites the message of the transaction by the matching mutations
+// in order. The data of each template reflects the previous mutations.
+func (mutations Mutations) Apply(st *SMTPState, listener string, now time.Time) error {
+	for _, m := range mutations {
+		if !m.matches(st) {
+			continue
+		}
+		subject, _ := headerValue(st.Headers, "Subject")
+		data := MutationData{
+			Sender:        st.ReturnTo,
+			Recipients:    st.Recipients,
+			Subject:       subject,
+			MessageID:     st.MessageID,
+			TransactionID: st.TransactionID,
+			Username:      st.Username,
+			Listener:      listener,
+			Date:          now,
+		}
+		var b bytes.Buffer
+		if err := m.Template.Execute(&b, data); err != nil {
+			return err
+		}
+		text := b.String()
+		switch m.Action {
+		case MutateSubject:
+			st.Headers = HeaderRule{Action: HeaderRemove, Name: "Subject"}.remove(st.Headers)
+			st.Headers = append(st.Headers, "Subject: "+oneLine(text))
+		case MutateHeader:
+			st.Headers = append(st.Headers, m.Name+": "+oneLine(text))
+		case MutatePrepend, MutateAppend:
+			text = strings.ReplaceAll(text, `\n`, "\r\n")
+			body, err := io.ReadAll(st.Content())
+			if err != nil {
+				return err
+			}
+			if m.Action == MutatePrepend {
+				st.SetContent(append([]byte(text), body...))
+			} else {
+				st.SetContent(append(body, text...))
+			}
+		}
+	}
+	return nil
+}
+
+// oneLine returns the text without line breaks for a header value.
+func oneLine(s string) string {
+	return strings.TrimSpace(strings.NewReplacer("\r\n", " ", "\n", " ", "\r", " ").Replace(s))
+}
@@ -0,0 +1,64 @@
+package smtp
+
+import (
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestParseMutations(t *testing.T) {
+	for _, x := range []string{
+		"replace foo",
+		"subject",
+		"header X-Foo: {{.Subject}}",
+		"subject to=*@example.com",
+		"subject {{.Unknown",
+	} {
+		if _, err := ParseMutations(strings.NewReader(x)); err == nil {
+			t.Errorf("expected an error: %s", x)
+		}
+	}
+}
+
+func TestMutations(t *testing.T) {
+	os.Setenv("MPROXY_TEST_RUN", "42")
+	defer os.Unsetenv("MPROXY_TEST_RUN")
+	mutations, err := ParseMutations(strings.NewReader("# mutations\n" +
+		"subject [TEST] {{.Subject}}\n" +
+		"header X-CI-Run {{env \"MPROXY_TEST_RUN\"}}\n" +
+		"prepend to=*@example.org [{{.Listener}}]\\n\n" +
+		"append from=foo@* --\\nSent to {{join .Recipients \", \"}}\\n\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := NewMockConn([]byte("EHLO localhost\r\n" +
+		"MAIL FROM: <foo@example.net>\r\n" +
+		"RCPT TO: <user1@example.com>\r\n" +
+		"RCPT TO: <user2@example.com>\r\n" +
+		"DATA\r\n" +
+		"Subject: Hello\r\n" +
+		"\r\n" +
+		"Hello\r\n" +
+		".\r\n" +
+		"QUIT\r\n"))
+	var headers []string
+	var body string
+	h := NewSMTPHandler(conn, func(st *SMTPState) error {
+		headers = st.Headers
+		b, _ := io.ReadAll(st.Content())
+		body = string(b)
+		return nil
+	})
+	h.Config.ListenerName = "smtp"
+	h.Config.Mutations = mutations
+	h.Run()
+	expected := "Subject: [TEST] Hello|X-CI-Run: 42"
+	if actual := strings.Join(headers, "|"); actual != expected {
+		t.Errorf("expected: %s, actual: %s", expected, actual)
+	}
+	expected = "Hello\r\n--\r\nSent to user1@example.com, user2@example.com\r\n"
+	if body != expected {
+		t.Errorf("expected: %q, actual: %q", expected, body)
+	}
+}
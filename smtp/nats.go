@@ -0,0 +1,133 @@
+package smtp
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// NATSSink publishes each message to a JetStream subject and waits for the
+// stream to acknowledge it. Headers of the envelope are sent with HPUB.
+type NATSSink struct {
+	Addr    string
+	Subject string
+	Timeout time.Duration
+}
+
+func NewNATSSink(addr, subject string) *NATSSink {
+	return &NATSSink{
+		Addr:    addr,
+		Subject: subject,
+		Timeout: 10 * time.Second,
+	}
+}
+
+type natsPubAck struct {
+	Stream string `json:"stream"`
+	Seq    uint64 `json:"seq"`
+	Error  *struct {
+		Code        int    `json:"code"`
+		Description string `json:"description"`
+	} `json:"error"`
+}
+
+func (n *NATSSink) Publish(st *SMTPState) error {
+	records, err := sinkRecords(st)
+	if err != nil {
+		return err
+	}
+	conn, err := net.DialTimeout("tcp", n.Addr, n.Timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(n.Timeout))
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(line, "INFO ") {
+		return fmt.Errorf("nats: unexpected greeting: %s", strings.TrimSpace(line))
+	}
+	b := make([]byte, 8)
+	rand.Read(b)
+	inbox := "_INBOX." + hex.EncodeToString(b)
+	fmt.Fprintf(w, "CONNECT {\"verbose\":false,\"pedantic\":false,\"headers\":true,\"no_responders\":true,\"name\":\"mproxy\"}\r\n")
+	fmt.Fprintf(w, "SUB %s.* 1\r\n", inbox)
+	for i, rec := range records {
+		hdr := "NATS/1.0\r\n"
+		for _, h := range append(rec.headers, [2]string{"domain", rec.key}) {
+			hdr += h[0] + ": " + h[1] + "\r\n"
+		}
+		hdr += "\r\n"
+		fmt.Fprintf(w, "HPUB %s %s.%d %d %d\r\n", n.Subject, inbox, i, len(hdr), len(hdr)+len(rec.value))
+		w.WriteString(hdr)
+		w.Write(rec.value)
+		w.WriteString("\r\n")
+		if err := w.Flush(); err != nil {
+			return err
+		}
+		if err := n.waitAck(r, w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (n *NATSSink) waitAck(r *bufio.Reader, w *bufio.Writer) error {
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		xs := strings.Fields(line)
+		if len(xs) == 0 {
+			continue
+		}
+		switch strings.ToUpper(xs[0]) {
+		case "PING":
+			w.WriteString("PONG\r\n")
+			if err := w.Flush(); err != nil {
+				return err
+			}
+		case "+OK", "PONG", "INFO":
+		case "-ERR":
+			return fmt.Errorf("nats: %s", strings.TrimSpace(line[4:]))
+		case "MSG", "HMSG":
+			hdrLen := 0
+			if strings.ToUpper(xs[0]) == "HMSG" && len(xs) >= 5 {
+				hdrLen, _ = strconv.Atoi(xs[len(xs)-2])
+			}
+			size, err := strconv.Atoi(xs[len(xs)-1])
+			if err != nil {
+				return fmt.Errorf("nats: malformed message: %s", line)
+			}
+			msg := make([]byte, size+2)
+			if _, err := io.ReadFull(r, msg); err != nil {
+				return err
+			}
+			hdr, payload := string(msg[:hdrLen]), msg[hdrLen:size]
+			if status := strings.Fields(strings.SplitN(hdr, "\r\n", 2)[0]); len(status) > 1 && status[1] != "200" {
+				return fmt.Errorf("nats: %s", strings.Join(status[1:], " "))
+			}
+			var ack natsPubAck
+			if err := json.Unmarshal(payload, &ack); err != nil {
+				return fmt.Errorf("nats: malformed acknowledgment: %s", payload)
+			}
+			if ack.Error != nil {
+				return fmt.Errorf("nats: %d %s", ack.Error.Code, ack.Error.Description)
+			}
+			return nil
+		}
+	}
+}
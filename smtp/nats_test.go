@@ -0,0 +1,114 @@
+package smtp
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+type natsTestMessage struct {
+	subject string
+	headers string
+	payload string
+}
+
+// serveNATS acknowledges published messages as a JetStream stream, or
+// answers with the given error.
+func serveNATS(lsnr net.Listener, ackErr string, msgs chan<- natsTestMessage) {
+	conn, err := lsnr.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	fmt.Fprintf(conn, "INFO {\"server_id\":\"test\",\"headers\":true}\r\n")
+	seq := 0
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		xs := strings.Fields(line)
+		if len(xs) == 0 || xs[0] != "HPUB" {
+			continue
+		}
+		hdrLen, _ := strconv.Atoi(xs[3])
+		total, _ := strconv.Atoi(xs[4])
+		b := make([]byte, total+2)
+		io.ReadFull(r, b)
+		msgs <- natsTestMessage{xs[1], string(b[:hdrLen]), string(b[hdrLen:total])}
+		seq++
+		ack := fmt.Sprintf("{\"stream\":\"MAIL\",\"seq\":%d}", seq)
+		if len(ackErr) > 0 {
+			ack = ackErr
+		}
+		fmt.Fprintf(conn, "PING\r\nMSG %s 1 %d\r\n%s\r\n", xs[2], len(ack), ack)
+	}
+}
+
+func TestNATSSink(t *testing.T) {
+	lsnr, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip(err)
+	}
+	defer lsnr.Close()
+	msgs := make(chan natsTestMessage, 4)
+	go serveNATS(lsnr, "", msgs)
+
+	st := &SMTPState{}
+	st.Reset()
+	st.ReturnTo = "foo@example.net"
+	for _, x := range []string{"user1@example.net", "user2@example.org"} {
+		addr, _ := ParseAddress(x)
+		st.Recipients = append(st.Recipients, x)
+		st.RecipientAddresses = append(st.RecipientAddresses, addr)
+	}
+	st.Headers = []string{"Subject: NATS"}
+	st.SetContent([]byte("Hello\r\n"))
+	sink := NewNATSSink(lsnr.Addr().String(), "mail.inbound")
+	if err := sink.Publish(st); err != nil {
+		t.Fatal(err)
+	}
+	close(msgs)
+	expected := []string{"example.net", "example.org"}
+	i := 0
+	for msg := range msgs {
+		if msg.subject != "mail.inbound" {
+			t.Errorf("expected: mail.inbound, actual: %s", msg.subject)
+		}
+		if !strings.HasPrefix(msg.headers, "NATS/1.0\r\n") ||
+			!strings.Contains(msg.headers, "\r\nmail_from: foo@example.net\r\n") ||
+			!strings.Contains(msg.headers, "\r\ndomain: "+expected[i]+"\r\n") {
+			t.Errorf("unexpected headers: %q", msg.headers)
+		}
+		if msg.payload != "Subject: NATS\r\n\r\nHello\r\n" {
+			t.Errorf("unexpected payload: %q", msg.payload)
+		}
+		i++
+	}
+	if i != len(expected) {
+		t.Errorf("expected %d messages, actual: %d", len(expected), i)
+	}
+}
+
+func TestNATSSinkError(t *testing.T) {
+	lsnr, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip(err)
+	}
+	defer lsnr.Close()
+	go serveNATS(lsnr, "{\"error\":{\"code\":503,\"description\":\"no stream\"}}", make(chan natsTestMessage, 1))
+
+	st := &SMTPState{}
+	st.Reset()
+	st.Recipients = []string{"user1@example.net"}
+	st.SetContent([]byte("Hello\r\n"))
+	err = NewNATSSink(lsnr.Addr().String(), "mail").Publish(st)
+	if err == nil || err.Error() != "nats: 503 no stream" {
+		t.Errorf("expected: nats: 503 no stream, actual: %v", err)
+	}
+}
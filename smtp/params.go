@@ -0,0 +1,100 @@
+package smtp
+
+import (
+	"errors"
+	"strings"
+)
+
+var ErrInvalidPath = errors.New("smtp: invalid path syntax")
+
+// ESMTPParams holds the KEY=VALUE parameters following the path of MAIL or
+// RCPT. Keys are upper-cased. A keyword without a value maps to "".
+type ESMTPParams map[string]string
+
+// Unsupported returns the first key that is not contained in supported,
+// or an empty string if all keys are supported.
+func (params ESMTPParams) Unsupported(supported []string) string {
+	for k := range params {
+		found := false
+		for _, x := range supported {
+			if k == x {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return k
+		}
+	}
+	return ""
+}
+
+// parsePath splits the argument of MAIL FROM: or RCPT TO: into the address
+// enclosed in angle brackets and the trailing ESMTP parameters.
+func parsePath(s string) (string, ESMTPParams, error) {
+	s = strings.TrimLeft(s, " \t")
+	if !strings.HasPrefix(s, "<") {
+		return "", nil, ErrInvalidPath
+	}
+	end := closingBracketIndex(s)
+	if end < 0 {
+		return "", nil, ErrInvalidPath
+	}
+	addr := s[1:end]
+	rest := s[end+1:]
+	if len(rest) > 0 && !isWhitespace(rest[0]) {
+		return "", nil, ErrInvalidPath
+	}
+	params := ESMTPParams{}
+	for _, x := range strings.Fields(rest) {
+		kv := strings.SplitN(x, "=", 2)
+		key := strings.ToUpper(kv[0])
+		if !isESMTPKeyword(key) {
+			return "", nil, ErrInvalidPath
+		}
+		if _, ok := params[key]; ok {
+			return "", nil, ErrInvalidPath
+		}
+		if len(kv) == 2 {
+			params[key] = kv[1]
+		} else {
+			params[key] = ""
+		}
+	}
+	return addr, params, nil
+}
+
+// closingBracketIndex returns the index of the '>' closing the path,
+// skipping over quoted strings in the local part.
+func closingBracketIndex(s string) int {
+	quoted := false
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			if quoted {
+				i++
+			}
+		case '"':
+			quoted = !quoted
+		case '>':
+			if !quoted {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+func isESMTPKeyword(s string) bool {
+	if len(s) == 0 {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		isAlnum := ('A' <= c && c <= 'Z') || ('0' <= c && c <= '9')
+		if !isAlnum && (i == 0 || c != '-') {
+			return false
+		}
+	}
+	return true
+}
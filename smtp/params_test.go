@@ -0,0 +1,48 @@
+package smtp
+
+import (
+	"testing"
+)
+
+func TestParsePath(t *testing.T) {
+	addr, params, err := parsePath(" <foo@example.net> SIZE=1024 smtputf8 X-FOO=bar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr != "foo@example.net" {
+		t.Errorf("expected: foo@example.net, actual: %s", addr)
+	}
+	expected := ESMTPParams{"SIZE": "1024", "SMTPUTF8": "", "X-FOO": "bar"}
+	if len(params) != len(expected) {
+		t.Errorf("expected: %v, actual: %v", expected, params)
+	}
+	for k, v := range expected {
+		if actual, ok := params[k]; !ok || actual != v {
+			t.Errorf("expected: %s=%s, actual: %s=%s", k, v, k, actual)
+		}
+	}
+
+	invalid := []string{
+		"foo@example.net",
+		"<foo@example.net",
+		"<foo@example.net>SIZE=1",
+		"<foo@example.net> SIZE=1 SIZE=2",
+		"<foo@example.net> -FOO",
+		"<foo@example.net> =1",
+	}
+	for _, x := range invalid {
+		if _, _, err := parsePath(x); err == nil {
+			t.Errorf("%s must be invalid", x)
+		}
+	}
+}
+
+func TestESMTPParamsUnsupported(t *testing.T) {
+	params := ESMTPParams{"SIZE": "1024", "BODY": "8BITMIME"}
+	if key := params.Unsupported([]string{"SIZE", "BODY"}); key != "" {
+		t.Errorf("expected no unsupported key, actual: %s", key)
+	}
+	if key := params.Unsupported([]string{"SIZE"}); key != "BODY" {
+		t.Errorf("expected: BODY, actual: %s", key)
+	}
+}
@@ -0,0 +1,136 @@
+package smtp
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+)
+
+var (
+	ErrEmptyCommand   = errors.New("smtp: empty command")
+	ErrInvalidVerb    = errors.New("smtp: invalid command verb")
+	ErrInvalidSyntax  = errors.New("smtp: invalid command syntax")
+	ErrIncompleteData = errors.New("smtp: message data without the terminating dot")
+)
+
+// Command is a command line split into the upper-cased verb and the
+// argument with surrounding whitespace removed.
+type Command struct {
+	Verb string
+	Arg  string
+}
+
+func isWhitespace(c byte) bool {
+	return c == ' ' || c == '\t'
+}
+
+func trimWhitespace(s string) string {
+	return strings.Trim(s, " \t\r\n")
+}
+
+// ParseCommand splits a command line into its verb and argument. Verbs are
+// case-insensitive and may be separated from the argument by any run of
+// spaces or tabs.
+func ParseCommand(line string) (Command, error) {
+	s := trimWhitespace(line)
+	if len(s) == 0 {
+		return Command{}, ErrEmptyCommand
+	}
+	i := 0
+	for i < len(s) && !isWhitespace(s[i]) {
+		c := s[i]
+		if !('A' <= c && c <= 'Z') && !('a' <= c && c <= 'z') && !('0' <= c && c <= '9') {
+			return Command{}, ErrInvalidVerb
+		}
+		i++
+	}
+	return Command{
+		Verb: strings.ToUpper(s[:i]),
+		Arg:  trimWhitespace(s[i:]),
+	}, nil
+}
+
+// ParsePathArgument parses the argument of MAIL or RCPT such as
+// "FROM:<foo@example.net> SIZE=1024", where keyword is "FROM" or "TO".
+// The keyword is case-insensitive, whitespace is allowed around the colon,
+// and a bare address without angle brackets is accepted.
+func ParsePathArgument(arg, keyword string) (string, ESMTPParams, error) {
+	if len(arg) < len(keyword) || !strings.EqualFold(arg[:len(keyword)], keyword) {
+		return "", nil, ErrInvalidSyntax
+	}
+	s := strings.TrimLeft(arg[len(keyword):], " \t")
+	if !strings.HasPrefix(s, ":") {
+		return "", nil, ErrInvalidSyntax
+	}
+	s = strings.TrimLeft(s[1:], " \t")
+	if len(s) > 0 && s[0] != '<' {
+		i := strings.IndexAny(s, " \t")
+		if i < 0 {
+			i = len(s)
+		}
+		s = "<" + s[:i] + ">" + s[i:]
+	}
+	return parsePath(s)
+}
+
+// TrimLineEnding removes the line ending from a line read up to LF, also
+// reporting whether the line is terminated by a bare LF or contains a bare
+// CR instead of ending with CRLF.
+func TrimLineEnding(b []byte) ([]byte, bool) {
+	bare := true
+	if bytes.HasSuffix(b, []byte("\r\n")) {
+		b = b[:len(b)-2]
+		bare = false
+	} else if bytes.HasSuffix(b, []byte("\n")) {
+		b = b[:len(b)-1]
+	}
+	if bytes.IndexByte(b, '\r') >= 0 {
+		bare = true
+	}
+	return b, bare
+}
+
+// UnstuffDataLine removes the leading dot of a line of message data (RFC
+// 5321 section 4.5.2), also reporting whether it is the terminating dot.
+func UnstuffDataLine(line []byte) ([]byte, bool) {
+	if len(line) == 1 && line[0] == '.' {
+		return nil, true
+	}
+	if len(line) > 0 && line[0] == '.' {
+		return line[1:], false
+	}
+	return line, false
+}
+
+// DecodeData decodes message data up to the terminating dot as DATA reads
+// it, returning the unstuffed lines and the number of bytes consumed. With
+// strict, lines with a bare CR or LF are skipped, so that only CRLF.CRLF
+// ends the data, and ErrBareLineEnding is returned without the lines once
+// the data ends.
+// ErrIncompleteData is returned if b lacks the terminating dot.
+func DecodeData(b []byte, strict bool) ([][]byte, int, error) {
+	lines := make([][]byte, 0)
+	var err error
+	n := 0
+	for n < len(b) {
+		i := bytes.IndexByte(b[n:], '\n')
+		if i < 0 {
+			break
+		}
+		line, bare := TrimLineEnding(b[n : n+i+1])
+		n += i + 1
+		if strict && bare {
+			err = ErrBareLineEnding
+			continue
+		}
+		line, end := UnstuffDataLine(line)
+		if end && err != nil {
+			return nil, n, err
+		}
+		if end {
+			return lines, n, nil
+		}
+		lines = append(lines, line)
+	}
+	return nil, n, ErrIncompleteData
+}
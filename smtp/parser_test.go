@@ -0,0 +1,149 @@
+package smtp
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestParseCommand(t *testing.T) {
+	tests := map[string]Command{
+		"QUIT":                          {"QUIT", ""},
+		"quit\r\n":                      {"QUIT", ""},
+		"  Ehlo   test-client  ":        {"EHLO", "test-client"},
+		"mail from:<foo@example.net>":   {"MAIL", "from:<foo@example.net>"},
+		"RCPT\tTO: <user1@example.net>": {"RCPT", "TO: <user1@example.net>"},
+	}
+	for line, expected := range tests {
+		actual, err := ParseCommand(line)
+		if err != nil {
+			t.Errorf("%q: %s", line, err)
+			continue
+		}
+		if actual != expected {
+			t.Errorf("expected: %v, actual: %v", expected, actual)
+		}
+	}
+	if _, err := ParseCommand(" \t"); err != ErrEmptyCommand {
+		t.Errorf("expected: %s, actual: %v", ErrEmptyCommand, err)
+	}
+	if _, err := ParseCommand("MA:L FROM:<foo@example.net>"); err != ErrInvalidVerb {
+		t.Errorf("expected: %s, actual: %v", ErrInvalidVerb, err)
+	}
+}
+
+func TestParsePathArgument(t *testing.T) {
+	tests := map[string]string{
+		"FROM:<foo@example.net>":           "foo@example.net",
+		"from:<foo@example.net>":           "foo@example.net",
+		"From: <foo@example.net>":          "foo@example.net",
+		"FROM : <foo@example.net>":         "foo@example.net",
+		"FROM:\t<foo@example.net>\tSIZE=1": "foo@example.net",
+		"FROM:foo@example.net SIZE=1":      "foo@example.net",
+		"FROM:<>":                          "",
+	}
+	for arg, expected := range tests {
+		actual, _, err := ParsePathArgument(arg, "FROM")
+		if err != nil {
+			t.Errorf("%q: %s", arg, err)
+			continue
+		}
+		if actual != expected {
+			t.Errorf("expected: %s, actual: %s", expected, actual)
+		}
+	}
+	invalid := []string{
+		"TO:<foo@example.net>",
+		"FROM<foo@example.net>",
+		"FRO:<foo@example.net>",
+		"FROM:<foo@example.net",
+	}
+	for _, arg := range invalid {
+		if _, _, err := ParsePathArgument(arg, "FROM"); err == nil {
+			t.Errorf("%q must be invalid", arg)
+		}
+	}
+}
+
+func TestDecodeData(t *testing.T) {
+	b := []byte("Subject: Hello\r\n\r\n..dot\r\nbare\nline\r\n.\r\nQUIT\r\n")
+	lines, n, err := DecodeData(b, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "[Subject: Hello  .dot bare line]"
+	if actual := fmt.Sprintf("%s", lines); actual != expected {
+		t.Errorf("expected: %s, actual: %s", expected, actual)
+	}
+	if rest := string(b[n:]); rest != "QUIT\r\n" {
+		t.Errorf("unexpected rest: %q", rest)
+	}
+	if _, _, err := DecodeData(b, true); err != ErrBareLineEnding {
+		t.Errorf("expected: %v, actual: %v", ErrBareLineEnding, err)
+	}
+	if _, _, err := DecodeData([]byte("Hello\r\n.\n"), true); err != ErrIncompleteData {
+		t.Errorf("expected: %v, actual: %v", ErrIncompleteData, err)
+	}
+}
+
+func FuzzParseCommand(f *testing.F) {
+	for _, x := range []string{"QUIT", "  Ehlo   test-client  ", "MAIL FROM:<foo@example.net> SIZE=1", "MA:L", " \t"} {
+		f.Add(x)
+	}
+	f.Fuzz(func(t *testing.T, line string) {
+		cmd, err := ParseCommand(line)
+		if err != nil {
+			return
+		}
+		if len(cmd.Verb) == 0 || cmd.Verb != strings.ToUpper(cmd.Verb) {
+			t.Errorf("invalid verb: %q", cmd.Verb)
+		}
+		if cmd.Arg != trimWhitespace(cmd.Arg) {
+			t.Errorf("untrimmed argument: %q", cmd.Arg)
+		}
+		// parsing is idempotent
+		again, err := ParseCommand(cmd.Verb + " " + cmd.Arg)
+		if err != nil || again != cmd {
+			t.Errorf("expected: %v, actual: %v, %v", cmd, again, err)
+		}
+	})
+}
+
+func FuzzParsePathArgument(f *testing.F) {
+	for _, x := range []string{"FROM:<foo@example.net>", "FROM:<> BODY=8BITMIME", "FROM:foo@example.net SIZE=1", "FROM:<\"a b\"@[127.0.0.1]>"} {
+		f.Add(x)
+	}
+	f.Fuzz(func(t *testing.T, arg string) {
+		ParsePathArgument(arg, "FROM")
+	})
+}
+
+// FuzzDecodeData checks that DecodeData frames message data as a session
+// reads it.
+func FuzzDecodeData(f *testing.F) {
+	for _, x := range []string{"Hello\r\n.\r\n", "..dot\r\n.\r\n", "bare\nCR\rline\r\n.\r\n", ".\n.\r\n"} {
+		f.Add([]byte(x), false)
+		f.Add([]byte(x), true)
+	}
+	f.Fuzz(func(t *testing.T, b []byte, strict bool) {
+		lines, _, err := DecodeData(b, strict)
+		if err == ErrIncompleteData {
+			return
+		}
+		h := NewSMTPHandler(NewMockConn(b), nil)
+		h.Config.StrictLineEndings = strict
+		read := make([][]byte, 0)
+		readErr := NewSMTPConnection(h).ReadDotLinesFunc(0, 0, func(line string) error {
+			read = append(read, []byte(line))
+			return nil
+		})
+		if readErr != err {
+			t.Errorf("expected: %v, actual: %v", readErr, err)
+		}
+		// the lines are discarded once the data is invalid
+		if err == nil && (len(read) != len(lines) || !bytes.Equal(bytes.Join(read, []byte("\n")), bytes.Join(lines, []byte("\n")))) {
+			t.Errorf("expected: %q, actual: %q", read, lines)
+		}
+	})
+}
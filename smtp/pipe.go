@@ -0,0 +1,166 @@
+package smtp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/textproto"
+	"os"
+	"os/exec"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Pipe delivers accepted messages to the standard input of a command, a
+// local delivery agent such as procmail, with the envelope in the
+// environment: SENDER, RECIPIENT, RECIPIENTS, USER and DOMAIN of the
+// recipient, CLIENT_ADDRESS, CLIENT_HELO, SASL_USERNAME, QUEUE_ID and
+// MESSAGE_ID. It is a Sink.
+type Pipe struct {
+	// Args are the templates of the command and its arguments, executed
+	// with PipeData.
+	Args []*template.Template
+
+	// PerRecipient runs the command once for each recipient rather than
+	// once for the message.
+	PerRecipient bool
+
+	// TemporaryCodes are the exit codes of temporary failures, which are
+	// retried, EX_TEMPFAIL (75) by default. Other non-zero exit codes are
+	// permanent failures.
+	TemporaryCodes []int
+
+	Timeout time.Duration
+}
+
+// PipeData is the data of the argument templates. Recipient, User and
+// Domain are those of the first recipient unless PerRecipient.
+type PipeData struct {
+	Sender     string
+	Recipient  string
+	Recipients []string
+	User       string
+	Domain     string
+	QueueID    string
+	MessageID  string
+}
+
+// NewPipe parses the command line, whose fields are the argument
+// templates, e.g. "/usr/bin/procmail -d {{.User}}".
+func NewPipe(command string) (*Pipe, error) {
+	xs := strings.Fields(command)
+	if len(xs) == 0 {
+		return nil, errors.New("pipe: empty command")
+	}
+	p := &Pipe{TemporaryCodes: []int{75}, Timeout: 5 * time.Minute}
+	for i, x := range xs {
+		t, err := template.New(fmt.Sprintf("arg%d", i)).Option("missingkey=error").Parse(x)
+		if err != nil {
+			return nil, fmt.Errorf("pipe: %v", err)
+		}
+		p.Args = append(p.Args, t)
+	}
+	return p, nil
+}
+
+// Publish runs the command for the message, or for each recipient. If it
+// fails for some recipients only, the error is RecipientErrors.
+func (p *Pipe) Publish(st *SMTPState) error {
+	if !p.PerRecipient {
+		return p.run(st, st.Recipients)
+	}
+	errs := make(RecipientErrors)
+	var first error
+	for _, x := range st.Recipients {
+		if err := p.run(st, []string{x}); err != nil {
+			errs[x] = err
+			if first == nil {
+				first = err
+			}
+		}
+	}
+	if len(errs) == len(st.Recipients) {
+		return first
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func (p *Pipe) run(st *SMTPState, recipients []string) error {
+	data := PipeData{
+		Sender:     st.ReturnTo,
+		Recipients: recipients,
+		QueueID:    st.QueueID,
+		MessageID:  st.MessageID,
+	}
+	if len(recipients) > 0 {
+		data.Recipient = recipients[0]
+		if addr, err := ParseAddress(data.Recipient); err == nil {
+			data.User, data.Domain = addr.LocalPart, addr.Domain
+		}
+	}
+	args := make([]string, len(p.Args))
+	for i, t := range p.Args {
+		var b strings.Builder
+		if err := t.Execute(&b, data); err != nil {
+			return &textproto.Error{Code: 451, Msg: "4.3.5 Pipe misconfigured: " + err.Error()}
+		}
+		args[i] = b.String()
+	}
+	ctx := context.Background()
+	if p.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.Timeout)
+		defer cancel()
+	}
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Env = append(os.Environ(),
+		"SENDER="+data.Sender,
+		"RECIPIENT="+data.Recipient,
+		"RECIPIENTS="+strings.Join(recipients, " "),
+		"USER="+data.User,
+		"DOMAIN="+data.Domain,
+		"CLIENT_ADDRESS="+clientAddress(st.RemoteAddr),
+		"CLIENT_HELO="+st.ClientName,
+		"SASL_USERNAME="+st.Username,
+		"QUEUE_ID="+st.QueueID,
+		"MESSAGE_ID="+st.MessageID,
+	)
+	cmd.Stdin = st.messageReader()
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if err == nil {
+		return nil
+	}
+	detail := oneLine(strings.TrimSpace(stderr.String()))
+	if len(detail) == 0 {
+		detail = err.Error()
+	}
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) || ctx.Err() != nil || exitErr.ExitCode() < 0 || p.temporary(exitErr.ExitCode()) {
+		return &textproto.Error{Code: 451, Msg: "4.3.0 Pipe failed: " + detail}
+	}
+	return &textproto.Error{Code: 554, Msg: "5.3.0 Pipe failed: " + detail}
+}
+
+func clientAddress(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+func (p *Pipe) temporary(code int) bool {
+	for _, x := range p.TemporaryCodes {
+		if x == code {
+			return true
+		}
+	}
+	return false
+}
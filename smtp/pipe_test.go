@@ -0,0 +1,108 @@
+//go:build !windows && !plan9
+
+package smtp
+
+import (
+	"errors"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"text/template"
+)
+
+func TestPipe(t *testing.T) {
+	if _, err := os.Stat("/bin/sh"); err != nil {
+		t.Skip(err)
+	}
+	out := filepath.Join(t.TempDir(), "out")
+	st := &SMTPState{
+		ReturnTo:   "foo@example.net",
+		Recipients: []string{"user1@example.com", "user2@example.com"},
+		ClientName: "client.example.net",
+		RemoteAddr: "192.0.2.1:25",
+	}
+	st.Headers = []string{"Subject: Pipe"}
+	st.SetContent([]byte("Hello\r\n"))
+
+	p := &Pipe{Args: pipeArgs("/bin/sh", "-c",
+		"echo $SENDER $RECIPIENTS $CLIENT_ADDRESS $CLIENT_HELO $1 >>$0; cat >>$0", out, "{{.User}}")}
+	if err := p.Publish(st); err != nil {
+		t.Fatal(err)
+	}
+	raw, _ := os.ReadFile(out)
+	expected := "foo@example.net user1@example.com user2@example.com 192.0.2.1 client.example.net user1\n" +
+		"Subject: Pipe\r\n\r\nHello\r\n"
+	if actual := string(raw); actual != expected {
+		t.Errorf("expected: %q, actual: %q", expected, actual)
+	}
+
+	os.Remove(out)
+	p.PerRecipient = true
+	if err := p.Publish(st); err != nil {
+		t.Fatal(err)
+	}
+	raw, _ = os.ReadFile(out)
+	if actual := strings.Count(string(raw), "Subject: Pipe"); actual != 2 {
+		t.Errorf("expected: 2, actual: %d", actual)
+	}
+}
+
+func TestPipeExitCodes(t *testing.T) {
+	if _, err := os.Stat("/bin/sh"); err != nil {
+		t.Skip(err)
+	}
+	st := &SMTPState{ReturnTo: "foo@example.net", Recipients: []string{"user1@example.com", "user2@example.com"}}
+	st.SetContent([]byte("Hello\r\n"))
+	for _, x := range []struct {
+		status string
+		code   int
+	}{
+		{"1", 554},
+		{"75", 451},
+	} {
+		p, err := NewPipe("/bin/sh")
+		if err != nil {
+			t.Fatal(err)
+		}
+		p.Args = pipeArgs("/bin/sh", "-c", "exit "+x.status)
+		var protoErr *textproto.Error
+		if err := p.Publish(st); !errors.As(err, &protoErr) || protoErr.Code != x.code {
+			t.Errorf("expected: %d, actual: %v", x.code, err)
+		}
+	}
+
+	// only the second recipient fails
+	p := &Pipe{Args: pipeArgs("/bin/sh", "-c", "test $RECIPIENT = user1@example.com"), PerRecipient: true}
+	var errs RecipientErrors
+	if err := p.Publish(st); !errors.As(err, &errs) || len(errs) != 1 || errs["user2@example.com"] == nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func pipeArgs(args ...string) []*template.Template {
+	xs := make([]*template.Template, len(args))
+	for i, x := range args {
+		xs[i] = template.Must(template.New("").Parse(x))
+	}
+	return xs
+}
+
+func TestPipeDeferred(t *testing.T) {
+	conn := NewMockConn([]byte("EHLO localhost\r\n" +
+		"MAIL FROM: <foo@example.net>\r\n" +
+		"RCPT TO: <user1@example.com>\r\n" +
+		"DATA\r\n" +
+		"Hello\r\n" +
+		".\r\n" +
+		"QUIT\r\n"))
+	h := NewSMTPHandler(conn, func(st *SMTPState) error {
+		return &textproto.Error{Code: 451, Msg: "4.3.0 Pipe failed"}
+	})
+	h.Run()
+	expected := "220 250 250 250 354 451 221"
+	if actual := replyCodes(conn.CloneOutputBuffer()); actual != expected {
+		t.Errorf("expected: %s, actual: %s", expected, actual)
+	}
+}
@@ -0,0 +1,326 @@
+package smtp
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type PolicyStage string
+
+const (
+	StageConnect PolicyStage = "connect"
+	StageMail    PolicyStage = "mail"
+	StageRcpt    PolicyStage = "rcpt"
+	StageData    PolicyStage = "data"
+)
+
+type PolicyAction string
+
+const (
+	PolicyAccept     PolicyAction = "accept"
+	PolicyReject     PolicyAction = "reject"
+	PolicyQuarantine PolicyAction = "quarantine"
+	PolicyTag        PolicyAction = "tag"
+	PolicyHold       PolicyAction = "hold"
+)
+
+type policyCondition struct {
+	kind  string
+	name  string
+	value string
+	ipnet *net.IPNet
+	op    byte
+	size  int64
+}
+
+type policyRule struct {
+	stage      PolicyStage
+	conditions []policyCondition
+	action     PolicyAction
+	arg        string
+	hold       time.Duration
+}
+
+// Policy is a list of rules evaluated in order at each stage of a session.
+// The first matching rule decides the stage, except for tag and hold rules
+// which go on to the next rule.
+type Policy struct {
+	rules []policyRule
+}
+
+// PolicyDecision is the result of a stage. Reply is set for reject, and
+// Hold is the longest delay of the matching hold rules.
+type PolicyDecision struct {
+	Action PolicyAction
+	Reply  string
+	Tags   []string
+	Hold   time.Duration
+}
+
+// ParsePolicy reads rules in the form of "stage [condition]... action",
+// one per line.
+//
+//	connect ip 192.0.2.0/24 reject 554 5.7.1 Access denied
+//	mail auth no sender *@example.net reject 530 5.7.0 Authentication required
+//	rcpt recipient postmaster@* accept
+//	rcpt auth no cert no reject 550 5.7.1 Relay access denied
+//	mail tls no reject 530 5.7.0 Must issue a STARTTLS command first
+//	data header Subject *[SPAM]* size >1000000 quarantine
+//	data header X-Mailer *Test* tag test
+//	data sender *@bulk.example.net hold 30m
+//
+// Conditions are ip (address or CIDR), sender, recipient and header with a
+// glob pattern, size with "<" or ">", auth with "yes", "no" or a username
+// pattern, cert with "yes", "no" or a pattern of the CN or a SAN of a
+// verified client certificate, tls with "yes", "no" or a version such as
+// "1.3", and spf, dkim and dmarc with a result such as "pass" or "fail". A hold rule keeps the message in the queue for the
+// duration before it is delivered.
+func ParsePolicy(r io.Reader) (*Policy, error) {
+	policy := &Policy{}
+	scanner := bufio.NewScanner(r)
+	n := 0
+	for scanner.Scan() {
+		n++
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		rule, err := parsePolicyRule(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", n, err)
+		}
+		policy.rules = append(policy.rules, rule)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return policy, nil
+}
+
+func parsePolicyRule(line string) (policyRule, error) {
+	xs := strings.Fields(line)
+	rule := policyRule{stage: PolicyStage(strings.ToLower(xs[0]))}
+	switch rule.stage {
+	case StageConnect, StageMail, StageRcpt, StageData:
+	default:
+		return rule, fmt.Errorf("unknown stage: %s", xs[0])
+	}
+	for i := 1; i < len(xs); {
+		kind := strings.ToLower(xs[i])
+		switch PolicyAction(kind) {
+		case PolicyAccept, PolicyQuarantine:
+			if i != len(xs)-1 {
+				return rule, fmt.Errorf("unexpected arguments of %s", kind)
+			}
+			rule.action = PolicyAction(kind)
+			return rule, nil
+		case PolicyHold:
+			if rule.stage == StageConnect {
+				return rule, fmt.Errorf("hold is not available at connect")
+			}
+			if i != len(xs)-2 {
+				return rule, fmt.Errorf("missing duration of hold")
+			}
+			d, err := time.ParseDuration(xs[i+1])
+			if err != nil || d <= 0 {
+				return rule, fmt.Errorf("invalid duration: %s", xs[i+1])
+			}
+			rule.action, rule.hold = PolicyHold, d
+			return rule, nil
+		case PolicyReject, PolicyTag:
+			rule.action = PolicyAction(kind)
+			rule.arg = strings.Join(xs[i+1:], " ")
+			if rule.action == PolicyTag && len(rule.arg) == 0 {
+				return rule, fmt.Errorf("missing tag")
+			}
+			if rule.action == PolicyReject {
+				if len(rule.arg) == 0 {
+					rule.arg = "550 5.7.1 Rejected by policy"
+				}
+				code := strings.Fields(rule.arg)[0]
+				if n, err := strconv.Atoi(code); err != nil || n < 400 || n > 599 {
+					return rule, fmt.Errorf("invalid reply code: %s", code)
+				}
+			}
+			return rule, nil
+		}
+		cond := policyCondition{kind: kind}
+		if kind == "header" {
+			if i+2 >= len(xs) {
+				return rule, fmt.Errorf("incomplete header condition")
+			}
+			cond.name = xs[i+1]
+			i++
+		}
+		if i+1 >= len(xs) {
+			return rule, fmt.Errorf("incomplete %s condition", kind)
+		}
+		cond.value = xs[i+1]
+		switch kind {
+		case "ip":
+			if !strings.Contains(cond.value, "/") {
+				if strings.Contains(cond.value, ":") {
+					cond.value += "/128"
+				} else {
+					cond.value += "/32"
+				}
+			}
+			_, ipnet, err := net.ParseCIDR(cond.value)
+			if err != nil {
+				return rule, err
+			}
+			cond.ipnet = ipnet
+		case "size":
+			if len(cond.value) < 2 || (cond.value[0] != '<' && cond.value[0] != '>') {
+				return rule, fmt.Errorf("invalid size: %s", cond.value)
+			}
+			size, err := strconv.ParseInt(cond.value[1:], 10, 64)
+			if err != nil {
+				return rule, fmt.Errorf("invalid size: %s", cond.value)
+			}
+			cond.op, cond.size = cond.value[0], size
+		case "sender", "recipient", "header", "auth", "cert", "tls", "dkim", "spf", "dmarc":
+		default:
+			return rule, fmt.Errorf("unknown condition: %s", kind)
+		}
+		rule.conditions = append(rule.conditions, cond)
+		i += 2
+	}
+	return rule, fmt.Errorf("missing action")
+}
+
+// Evaluate applies the rules of the stage. rcpt is the recipient of the
+// RCPT command being processed.
+func (policy *Policy) Evaluate(stage PolicyStage, st *SMTPState, ip, rcpt string) PolicyDecision {
+	decision := PolicyDecision{Action: PolicyAccept}
+	for _, rule := range policy.rules {
+		if rule.stage != stage || !rule.matches(st, ip, rcpt) {
+			continue
+		}
+		if rule.action == PolicyTag {
+			decision.Tags = append(decision.Tags, rule.arg)
+			continue
+		}
+		if rule.action == PolicyHold {
+			if rule.hold > decision.Hold {
+				decision.Hold = rule.hold
+			}
+			continue
+		}
+		decision.Action = rule.action
+		if rule.action == PolicyReject {
+			decision.Reply = rule.arg
+		}
+		break
+	}
+	return decision
+}
+
+func (rule policyRule) matches(st *SMTPState, ip, rcpt string) bool {
+	for _, cond := range rule.conditions {
+		if !cond.matches(st, ip, rcpt) {
+			return false
+		}
+	}
+	return true
+}
+
+func (cond policyCondition) matches(st *SMTPState, ip, rcpt string) bool {
+	switch cond.kind {
+	case "ip":
+		x := net.ParseIP(ip)
+		return x != nil && cond.ipnet.Contains(x)
+	case "sender":
+		return sieveMatch(":matches", st.ReturnTo, cond.value)
+	case "recipient":
+		if len(rcpt) > 0 {
+			return sieveMatch(":matches", rcpt, cond.value)
+		}
+		for _, x := range st.Recipients {
+			if sieveMatch(":matches", x, cond.value) {
+				return true
+			}
+		}
+		return false
+	case "header":
+		for _, x := range headerValues(st.Headers, cond.name) {
+			if sieveMatch(":matches", x, cond.value) {
+				return true
+			}
+		}
+		return false
+	case "size":
+		size := st.Size
+		if st.content != nil {
+			size = st.MessageSize()
+		}
+		if cond.op == '<' {
+			return size < cond.size
+		}
+		return size > cond.size
+	case "spf":
+		return strings.EqualFold(st.SPF.Result, cond.value)
+	case "dmarc":
+		return strings.EqualFold(st.DMARC.Result, cond.value)
+	case "dkim":
+		if len(st.DKIMResults) == 0 {
+			return strings.EqualFold(cond.value, "none")
+		}
+		for _, res := range st.DKIMResults {
+			if strings.EqualFold(res.Result, cond.value) {
+				return true
+			}
+		}
+		return false
+	case "auth":
+		switch strings.ToLower(cond.value) {
+		case "yes":
+			return len(st.Username) > 0
+		case "no":
+			return len(st.Username) == 0
+		}
+		return len(st.Username) > 0 && sieveMatch(":matches", st.Username, cond.value)
+	case "cert":
+		switch strings.ToLower(cond.value) {
+		case "yes":
+			return len(st.ClientCN) > 0 || len(st.ClientSANs) > 0
+		case "no":
+			return len(st.ClientCN) == 0 && len(st.ClientSANs) == 0
+		}
+		return matchClientCert(st, cond.value)
+	case "tls":
+		return matchTLS(st, cond.value)
+	}
+	return false
+}
+
+// applyPolicy evaluates the stage and records tags and quarantine on the
+// state. It returns the reply of a rejection or an empty string.
+func applyPolicy(conn *SMTPConnection, stage PolicyStage, rcpt string) string {
+	policy := conn.Config().Policy
+	if policy == nil {
+		return ""
+	}
+	st := conn.State()
+	decision := policy.Evaluate(stage, st, conn.RemoteIP(), rcpt)
+	st.Tags = append(st.Tags, decision.Tags...)
+	if stage == StageConnect {
+		st.sessionTags = append(st.sessionTags, decision.Tags...)
+	}
+	if decision.Hold > 0 {
+		st.holdUntil(conn.Config().now().Add(decision.Hold))
+	}
+	switch decision.Action {
+	case PolicyReject:
+		conn.LogSecurityEvent(EventPolicyReject, "stage", string(stage), "reply", decision.Reply)
+		return decision.Reply
+	case PolicyQuarantine:
+		st.Quarantined = true
+	}
+	return ""
+}
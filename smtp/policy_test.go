@@ -0,0 +1,75 @@
+package smtp
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPolicy(t *testing.T) {
+	policy, err := ParsePolicy(strings.NewReader(`
+# sample policy
+connect ip 192.0.2.0/24 reject 554 5.7.1 Access denied
+mail auth no sender *@example.net reject 530 5.7.0 Authentication required
+rcpt recipient postmaster@* accept
+rcpt recipient *@internal.example.net reject
+data header X-Mailer *Test* tag test
+data header X-Mailer *Test* hold 5m
+data header X-Mailer * hold 1m
+data header Subject *[SPAM]* size >10 quarantine
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := &SMTPState{}
+	st.Reset()
+	if d := policy.Evaluate(StageConnect, st, "192.0.2.1", ""); d.Reply != "554 5.7.1 Access denied" {
+		t.Errorf("expected the connection to be rejected: %v", d)
+	}
+	if d := policy.Evaluate(StageConnect, st, "198.51.100.1", ""); d.Action != PolicyAccept {
+		t.Errorf("expected the connection to be accepted: %v", d)
+	}
+	st.ReturnTo = "foo@example.net"
+	if d := policy.Evaluate(StageMail, st, "", ""); d.Action != PolicyReject {
+		t.Errorf("expected the sender to be rejected: %v", d)
+	}
+	st.Username = "foo"
+	if d := policy.Evaluate(StageMail, st, "", ""); d.Action != PolicyAccept {
+		t.Errorf("expected the sender to be accepted: %v", d)
+	}
+	if d := policy.Evaluate(StageRcpt, st, "", "postmaster@internal.example.net"); d.Action != PolicyAccept {
+		t.Errorf("expected the recipient to be accepted: %v", d)
+	}
+	d := policy.Evaluate(StageRcpt, st, "", "user1@internal.example.net")
+	if d.Reply != "550 5.7.1 Rejected by policy" {
+		t.Errorf("expected the recipient to be rejected: %v", d)
+	}
+	st.Headers = []string{"Subject: [SPAM] Buy now", "X-Mailer: TestMailer"}
+	st.SetContent([]byte("Buy now\r\n"))
+	d = policy.Evaluate(StageData, st, "", "")
+	if d.Action != PolicyQuarantine || strings.Join(d.Tags, ",") != "test" {
+		t.Errorf("expected the message to be quarantined with a tag: %v", d)
+	}
+	if d.Hold != 5*time.Minute {
+		t.Errorf("expected: %v, actual: %v", 5*time.Minute, d.Hold)
+	}
+
+	invalid := []string{
+		"helo reject",
+		"mail sender",
+		"mail sender *@example.net",
+		"connect ip 192.0.2.0/33 reject",
+		"data size 100 reject",
+		"mail reject 250 OK",
+		"data country JP reject",
+		"rcpt accept now",
+		"connect hold 5m",
+		"data hold",
+		"data hold 5",
+	}
+	for _, x := range invalid {
+		if _, err := ParsePolicy(strings.NewReader(x)); err == nil {
+			t.Errorf("expected an error: %s", x)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package smtp
+
+import (
+	"bufio"
+	"io"
+	"sync"
+)
+
+// maxPooledLine is the capacity beyond which a line buffer is left to the
+// GC, so that a long line does not keep its memory in the pool.
+const maxPooledLine = 64 << 10
+
+// The buffers of the sessions are reused across sessions to reduce the
+// garbage under high connection churn.
+var (
+	readerPool = sync.Pool{New: func() interface{} { return bufio.NewReader(nil) }}
+	writerPool = sync.Pool{New: func() interface{} { return bufio.NewWriter(nil) }}
+	linePool   = sync.Pool{New: func() interface{} { b := make([]byte, 0, 1024); return &b }}
+)
+
+func newPooledReader(r io.Reader) *bufio.Reader {
+	br := readerPool.Get().(*bufio.Reader)
+	br.Reset(r)
+	return br
+}
+
+func putPooledReader(br *bufio.Reader) {
+	br.Reset(nil)
+	readerPool.Put(br)
+}
+
+func newPooledWriter(w io.Writer) *bufio.Writer {
+	bw := writerPool.Get().(*bufio.Writer)
+	bw.Reset(w)
+	return bw
+}
+
+// release returns the buffers of the session to the pools. The connection
+// must not be used afterwards.
+func (smtpConn *SMTPConnection) release() {
+	if smtpConn.reader != nil {
+		putPooledReader(smtpConn.reader.R)
+		smtpConn.reader = nil
+	}
+	if smtpConn.writer != nil {
+		smtpConn.writer.W.Reset(nil)
+		writerPool.Put(smtpConn.writer.W)
+		smtpConn.writer = nil
+	}
+	if cap(smtpConn.line) <= maxPooledLine {
+		b := smtpConn.line[:0]
+		linePool.Put(&b)
+	}
+	smtpConn.line = nil
+}
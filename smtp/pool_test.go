@@ -0,0 +1,29 @@
+package smtp
+
+import (
+	"testing"
+)
+
+func TestSessionBuffersReleased(t *testing.T) {
+	for i := 0; i < 3; i++ {
+		conn := NewMockConn([]byte("EHLO localhost\r\nNOOP\r\nQUIT\r\n"))
+		h := NewSMTPHandler(conn, nil)
+		h.Run()
+		expected := "220 250 250 221"
+		if actual := replyCodes(conn.CloneOutputBuffer()); actual != expected {
+			t.Errorf("expected: %s, actual: %s", expected, actual)
+		}
+	}
+
+	h := NewSMTPHandler(NewMockConn(nil), nil)
+	smtpConn := NewSMTPConnection(h)
+	smtpConn.line = make([]byte, 0, maxPooledLine+1)
+	smtpConn.release()
+	if smtpConn.reader != nil || smtpConn.writer != nil || smtpConn.line != nil {
+		t.Errorf("expected the buffers released")
+	}
+	b := linePool.Get().(*[]byte)
+	if cap(*b) > maxPooledLine {
+		t.Errorf("unexpected line buffer in the pool: %d", cap(*b))
+	}
+}
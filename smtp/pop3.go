@@ -0,0 +1,234 @@
+package smtp
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+)
+
+// POP3Handler serves a POP3 (RFC 1939) session over the message store so
+// mail clients can fetch the messages accepted by the server. A user
+// logging in with an address sees the messages addressed to it; any other
+// name sees every message.
+type POP3Handler struct {
+	conn  net.Conn
+	Store *MessageStore
+
+	// Authenticate verifies USER and PASS. No credentials are accepted if
+	// nil.
+	Authenticate func(username, password string) bool
+}
+
+func NewPOP3Handler(conn net.Conn, store *MessageStore) *POP3Handler {
+	return &POP3Handler{conn: conn, Store: store}
+}
+
+type pop3Session struct {
+	text     *textproto.Conn
+	store    *MessageStore
+	messages []StoredMessage
+	deleted  []bool
+}
+
+func (s *pop3Session) reply(format string, args ...interface{}) error {
+	return s.text.PrintfLine(format, args...)
+}
+
+// message returns the index of the message numbered by arg.
+func (s *pop3Session) message(arg string) (int, error) {
+	n, err := strconv.Atoi(arg)
+	if err != nil || n < 1 || n > len(s.messages) {
+		return -1, fmt.Errorf("no such message")
+	}
+	if s.deleted[n-1] {
+		return -1, fmt.Errorf("message %d already deleted", n)
+	}
+	return n - 1, nil
+}
+
+func (s *pop3Session) stat() (int, int64) {
+	count, size := 0, int64(0)
+	for i, x := range s.messages {
+		if !s.deleted[i] {
+			count++
+			size += x.Size
+		}
+	}
+	return count, size
+}
+
+// list replies a single line for the message numbered by args, or a
+// multi-line listing of every message without args.
+func (s *pop3Session) list(args []string, f func(i int) string) error {
+	if len(args) > 0 {
+		i, err := s.message(args[0])
+		if err != nil {
+			return s.reply("-ERR %s", err)
+		}
+		return s.reply("+OK %d %s", i+1, f(i))
+	}
+	count, _ := s.stat()
+	if err := s.reply("+OK %d messages", count); err != nil {
+		return err
+	}
+	w := s.text.DotWriter()
+	for i := range s.messages {
+		if !s.deleted[i] {
+			fmt.Fprintf(w, "%d %s\r\n", i+1, f(i))
+		}
+	}
+	return w.Close()
+}
+
+func (s *pop3Session) retrieve(i int) error {
+	f, err := s.store.Open(s.messages[i].ID)
+	if err != nil {
+		return s.reply("-ERR %s", err)
+	}
+	defer f.Close()
+	if err := s.reply("+OK %d octets", s.messages[i].Size); err != nil {
+		return err
+	}
+	w := s.text.DotWriter()
+	if _, err := io.Copy(w, f); err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+// update deletes the messages marked as deleted.
+func (s *pop3Session) update() error {
+	for i, x := range s.messages {
+		if s.deleted[i] {
+			if err := s.store.Delete(x.ID); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (h *POP3Handler) Run() error {
+	defer h.conn.Close()
+	s := &pop3Session{text: textproto.NewConn(h.conn), store: h.Store}
+	if err := s.reply("+OK POP3 server ready"); err != nil {
+		return err
+	}
+	username := ""
+	authenticated := false
+	for {
+		line, err := s.text.ReadLine()
+		if err != nil {
+			return err
+		}
+		args := strings.Fields(line)
+		if len(args) == 0 {
+			if err := s.reply("-ERR command must not be empty"); err != nil {
+				return err
+			}
+			continue
+		}
+		verb := strings.ToUpper(args[0])
+		args = args[1:]
+		if !authenticated {
+			switch verb {
+			case "CAPA":
+				err = s.reply("+OK capability list follows\r\nUSER\r\nUIDL\r\n.")
+			case "USER":
+				if len(args) != 1 {
+					err = s.reply("-ERR syntax error")
+					break
+				}
+				username = args[0]
+				err = s.reply("+OK send PASS")
+			case "PASS":
+				if len(username) == 0 {
+					err = s.reply("-ERR send USER first")
+					break
+				}
+				password := strings.TrimSpace(line[len("PASS"):])
+				if h.Authenticate == nil || !h.Authenticate(username, password) {
+					username = ""
+					err = s.reply("-ERR [AUTH] invalid credentials")
+					break
+				}
+				if s.messages, err = h.Store.List(username); err != nil {
+					s.reply("-ERR [SYS/TEMP] %s", err)
+					return err
+				}
+				s.deleted = make([]bool, len(s.messages))
+				authenticated = true
+				count, size := s.stat()
+				err = s.reply("+OK maildrop has %d messages (%d octets)", count, size)
+			case "QUIT":
+				s.reply("+OK bye")
+				return nil
+			default:
+				err = s.reply("-ERR unknown command")
+			}
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		switch verb {
+		case "CAPA":
+			err = s.reply("+OK capability list follows\r\nUSER\r\nUIDL\r\n.")
+		case "STAT":
+			count, size := s.stat()
+			err = s.reply("+OK %d %d", count, size)
+		case "LIST":
+			err = s.list(args, func(i int) string {
+				return strconv.FormatInt(s.messages[i].Size, 10)
+			})
+		case "UIDL":
+			err = s.list(args, func(i int) string {
+				return s.messages[i].ID
+			})
+		case "RETR":
+			if len(args) != 1 {
+				err = s.reply("-ERR syntax error")
+				break
+			}
+			i, merr := s.message(args[0])
+			if merr != nil {
+				err = s.reply("-ERR %s", merr)
+				break
+			}
+			err = s.retrieve(i)
+		case "DELE":
+			if len(args) != 1 {
+				err = s.reply("-ERR syntax error")
+				break
+			}
+			i, merr := s.message(args[0])
+			if merr != nil {
+				err = s.reply("-ERR %s", merr)
+				break
+			}
+			s.deleted[i] = true
+			err = s.reply("+OK message %d deleted", i+1)
+		case "NOOP":
+			err = s.reply("+OK")
+		case "RSET":
+			s.deleted = make([]bool, len(s.messages))
+			count, size := s.stat()
+			err = s.reply("+OK maildrop has %d messages (%d octets)", count, size)
+		case "QUIT":
+			if err := s.update(); err != nil {
+				s.reply("-ERR some deleted messages not removed")
+				return err
+			}
+			s.reply("+OK bye")
+			return nil
+		default:
+			err = s.reply("-ERR unknown command")
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
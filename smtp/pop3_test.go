@@ -0,0 +1,114 @@
+package smtp
+
+import (
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+)
+
+func TestPOP3Handler(t *testing.T) {
+	store, err := NewMessageStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	id1 := storeMessage(t, store, []string{"user1@example.net"}, "one\r\n.dot\r\n")
+	storeMessage(t, store, []string{"user2@example.net"}, "two\r\n")
+	id3 := storeMessage(t, store, []string{"user1@example.net"}, "three\r\n")
+
+	server, client := net.Pipe()
+	h := NewPOP3Handler(server, store)
+	h.Authenticate = func(username, password string) bool {
+		return password == "secret"
+	}
+	done := make(chan error)
+	go func() {
+		done <- h.Run()
+	}()
+	c := textproto.NewConn(client)
+	defer c.Close()
+	line, _ := c.ReadLine()
+	if !strings.HasPrefix(line, "+OK") {
+		t.Fatalf("unexpected greeting: %s", line)
+	}
+	cmd := func(s string) string {
+		if err := c.PrintfLine("%s", s); err != nil {
+			t.Fatal(err)
+		}
+		line, err := c.ReadLine()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return line
+	}
+	lines := func() []string {
+		xs, err := c.ReadDotLines()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return xs
+	}
+
+	for _, fixture := range []struct {
+		command  string
+		expected string
+	}{
+		{"STAT", "-ERR"},
+		{"PASS secret", "-ERR"},
+		{"USER user1@example.net", "+OK"},
+		{"PASS wrong", "-ERR [AUTH]"},
+		{"USER user1@example.net", "+OK"},
+		{"PASS secret", "+OK maildrop has 2 messages"},
+		{"RETR 3", "-ERR"},
+		{"DELE 0", "-ERR"},
+	} {
+		if line := cmd(fixture.command); !strings.HasPrefix(line, fixture.expected) {
+			t.Errorf("expected: %s, actual: %s (%s)", fixture.expected, line, fixture.command)
+		}
+	}
+
+	if line := cmd("STAT"); line != "+OK 2 54" {
+		t.Errorf("expected: +OK 2 54, actual: %s", line)
+	}
+	cmd("LIST")
+	if xs := lines(); len(xs) != 2 || xs[0] != "1 29" || xs[1] != "2 25" {
+		t.Errorf("unexpected listing: %v", xs)
+	}
+	if line := cmd("UIDL 2"); line != "+OK 2 "+id3 {
+		t.Errorf("expected: +OK 2 %s, actual: %s", id3, line)
+	}
+	if line := cmd("RETR 1"); line != "+OK 29 octets" {
+		t.Errorf("expected: +OK 29 octets, actual: %s", line)
+	}
+	expected := []string{"Subject: Hello", "", "one", ".dot"}
+	if xs := lines(); strings.Join(xs, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("expected: %q, actual: %q", expected, xs)
+	}
+
+	if line := cmd("DELE 1"); !strings.HasPrefix(line, "+OK") {
+		t.Errorf("expected: +OK, actual: %s", line)
+	}
+	if line := cmd("DELE 1"); !strings.HasPrefix(line, "-ERR") {
+		t.Errorf("expected: -ERR, actual: %s", line)
+	}
+	if line := cmd("RSET"); !strings.HasPrefix(line, "+OK maildrop has 2") {
+		t.Errorf("expected: +OK maildrop has 2, actual: %s", line)
+	}
+	cmd("DELE 1")
+	cmd("UIDL")
+	if xs := lines(); len(xs) != 1 || xs[0] != "2 "+id3 {
+		t.Errorf("unexpected listing: %v", xs)
+	}
+	if line := cmd("QUIT"); !strings.HasPrefix(line, "+OK") {
+		t.Errorf("expected: +OK, actual: %s", line)
+	}
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+	if _, err := store.Get(id1); err == nil {
+		t.Errorf("expected the message %s to be deleted", id1)
+	}
+	if xs, _ := store.List(""); len(xs) != 2 {
+		t.Errorf("expected: 2, actual: %d", len(xs))
+	}
+}
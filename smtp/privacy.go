@@ -0,0 +1,91 @@
+package smtp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const (
+	PrivacyHash = "hash"
+	PrivacyMask = "mask"
+)
+
+var addressPattern = regexp.MustCompile(`[A-Za-z0-9.!#$%&'*+/=?^_{|}~-]+@[A-Za-z0-9.-]+`)
+
+// Privacy redacts email addresses in logs, security events and
+// transcripts, where message bodies are omitted, for sessions with real
+// customer data. Metrics have no labels of addresses. The methods of a nil
+// Privacy return the values as they are.
+type Privacy struct {
+	// Mode is PrivacyHash to replace the local part with a keyed hash of
+	// the address, so the same address can still be correlated, or
+	// PrivacyMask to keep only the first character of the local part.
+	Mode string
+	Key  []byte
+
+	// APIs redacts the addresses of the stats and the usernames of the
+	// auth audit served over HTTP too.
+	APIs bool
+}
+
+// NewPrivacy returns a Privacy of the mode with a random key.
+func NewPrivacy(mode string) (*Privacy, error) {
+	if mode != PrivacyHash && mode != PrivacyMask {
+		return nil, fmt.Errorf("smtp: unknown privacy mode: %s", mode)
+	}
+	key := make([]byte, 32)
+	rand.Read(key)
+	return &Privacy{Mode: mode, Key: key}, nil
+}
+
+// Address redacts an address, or any other identifier such as a username.
+func (p *Privacy) Address(s string) string {
+	if p == nil || len(s) == 0 {
+		return s
+	}
+	local, domain := s, ""
+	if i := strings.LastIndexByte(s, '@'); i >= 0 {
+		local, domain = s[:i], s[i:]
+	}
+	if p.Mode == PrivacyMask {
+		if len(local) == 0 {
+			return s
+		}
+		return local[:1] + "***" + domain
+	}
+	mac := hmac.New(sha256.New, p.Key)
+	mac.Write([]byte(strings.ToLower(s)))
+	return hex.EncodeToString(mac.Sum(nil))[:16] + domain
+}
+
+func (p *Privacy) Addresses(xs []string) []string {
+	if p == nil {
+		return xs
+	}
+	ys := make([]string, len(xs))
+	for i, x := range xs {
+		ys[i] = p.Address(x)
+	}
+	return ys
+}
+
+// Text redacts the addresses in a line of text.
+func (p *Privacy) Text(s string) string {
+	if p == nil {
+		return s
+	}
+	return addressPattern.ReplaceAllStringFunc(s, p.Address)
+}
+
+// api returns p if the APIs are redacted too, or nil.
+func (p *Privacy) api() *Privacy {
+	if p == nil || !p.APIs {
+		return nil
+	}
+	return p
+}
@@ -0,0 +1,67 @@
+package smtp
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPrivacyAddress(t *testing.T) {
+	p := &Privacy{Mode: PrivacyMask}
+	if actual := p.Address("foo@example.net"); actual != "f***@example.net" {
+		t.Errorf("expected: f***@example.net, actual: %s", actual)
+	}
+	p = &Privacy{Mode: PrivacyHash, Key: []byte("secret")}
+	x := p.Address("foo@example.net")
+	if x != p.Address("FOO@example.net") || !strings.HasSuffix(x, "@example.net") || strings.HasPrefix(x, "foo") {
+		t.Errorf("unexpected hash: %s", x)
+	}
+	if actual := p.Text("550 <foo@example.net> rejected"); actual != "550 <"+x+"> rejected" {
+		t.Errorf("expected: %s, actual: %s", x, actual)
+	}
+	var nilPrivacy *Privacy
+	if actual := nilPrivacy.Address("foo@example.net"); actual != "foo@example.net" {
+		t.Errorf("expected: foo@example.net, actual: %s", actual)
+	}
+	if _, err := NewPrivacy("none"); err == nil {
+		t.Errorf("expected an error of an unknown mode")
+	}
+}
+
+func TestPrivacy(t *testing.T) {
+	dir := t.TempDir()
+	conn := NewMockConn([]byte("EHLO localhost\r\n" +
+		"MAIL FROM: <foo@example.net>\r\n" +
+		"RCPT TO: <user1@example.com>\r\n" +
+		"BDAT 21 LAST\r\n" +
+		"Subject: Secret\r\n" +
+		"\r\n" +
+		"Hi\r\n" +
+		"QUIT\r\n"))
+	var logs bytes.Buffer
+	h := NewSMTPHandler(conn, nil)
+	h.Config.Logger, _ = NewLogger(&logs, "info")
+	h.Config.TranscriptDir = dir
+	h.Config.Privacy = &Privacy{Mode: PrivacyMask}
+	h.Run()
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*.log"))
+	if len(files) != 1 {
+		t.Fatalf("expected a transcript: %v", files)
+	}
+	b, _ := os.ReadFile(files[0])
+	for _, x := range [][]byte{b, logs.Bytes()} {
+		if bytes.Contains(x, []byte("foo@example.net")) || bytes.Contains(x, []byte("user1@")) ||
+			bytes.Contains(x, []byte("Secret")) {
+			t.Errorf("unexpected personal data: %s", x)
+		}
+	}
+	if !bytes.Contains(b, []byte("C: MAIL FROM: <f***@example.net>")) {
+		t.Errorf("expected the masked address: %s", b)
+	}
+	if !bytes.Contains(logs.Bytes(), []byte(`"recipients":["u***@example.com"]`)) {
+		t.Errorf("expected the masked recipients: %s", logs.Bytes())
+	}
+}
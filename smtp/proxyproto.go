@@ -0,0 +1,262 @@
+package smtp
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+var ErrProxyHeader = errors.New("proxy: invalid header")
+
+// ReadProxyHeader reads a PROXY protocol v1 or v2 header. src and dst are
+// nil for a LOCAL or UNKNOWN connection, i.e. health checks of the
+// balancer.
+func ReadProxyHeader(r *bufio.Reader) (src, dst net.Addr, err error) {
+	b, err := r.Peek(len(proxyV2Signature))
+	if err != nil {
+		return nil, nil, err
+	}
+	if bytes.Equal(b, proxyV2Signature) {
+		return readProxyHeaderV2(r)
+	}
+	if !bytes.HasPrefix(b, []byte("PROXY ")) {
+		return nil, nil, ErrProxyHeader
+	}
+	// v1 headers are at most 107 bytes
+	var line []byte
+	for len(line) < 107 {
+		c, err := r.ReadByte()
+		if err != nil {
+			return nil, nil, err
+		}
+		line = append(line, c)
+		if c == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, nil, ErrProxyHeader
+	}
+	xs := strings.Split(string(line[:len(line)-2]), " ")
+	if len(xs) >= 2 && xs[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(xs) != 6 || (xs[1] != "TCP4" && xs[1] != "TCP6") {
+		return nil, nil, ErrProxyHeader
+	}
+	srcIP, dstIP := net.ParseIP(xs[2]), net.ParseIP(xs[3])
+	srcPort, err1 := strconv.ParseUint(xs[4], 10, 16)
+	dstPort, err2 := strconv.ParseUint(xs[5], 10, 16)
+	if srcIP == nil || dstIP == nil || err1 != nil || err2 != nil ||
+		(srcIP.To4() != nil) != (xs[1] == "TCP4") {
+		return nil, nil, ErrProxyHeader
+	}
+	return &net.TCPAddr{IP: srcIP, Port: int(srcPort)}, &net.TCPAddr{IP: dstIP, Port: int(dstPort)}, nil
+}
+
+func readProxyHeaderV2(r *bufio.Reader) (src, dst net.Addr, err error) {
+	hdr := make([]byte, 16)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, nil, err
+	}
+	if hdr[12]>>4 != 2 {
+		return nil, nil, ErrProxyHeader
+	}
+	body := make([]byte, binary.BigEndian.Uint16(hdr[14:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, nil, err
+	}
+	switch hdr[12] & 0x0f {
+	case 0:
+		// LOCAL
+		return nil, nil, nil
+	case 1:
+	default:
+		return nil, nil, ErrProxyHeader
+	}
+	var n int
+	switch hdr[13] {
+	case 0x11:
+		n = net.IPv4len
+	case 0x21:
+		n = net.IPv6len
+	default:
+		// UNSPEC, UDP and unix sockets
+		return nil, nil, nil
+	}
+	if len(body) < 2*n+4 {
+		return nil, nil, ErrProxyHeader
+	}
+	src = &net.TCPAddr{IP: net.IP(body[:n]), Port: int(binary.BigEndian.Uint16(body[2*n:]))}
+	dst = &net.TCPAddr{IP: net.IP(body[n : 2*n]), Port: int(binary.BigEndian.Uint16(body[2*n+2:]))}
+	return src, dst, nil
+}
+
+// ProxyListener accepts connections from a load balancer prefixed with a
+// PROXY protocol header, whose addresses are returned as the RemoteAddr
+// and LocalAddr of the connections. Connections without a valid header
+// fail on the first I/O.
+type ProxyListener struct {
+	net.Listener
+
+	// Timeout is the time to wait for the header.
+	Timeout time.Duration
+
+	// Networks are the load balancers trusted to send the header.
+	// Connections from other peers are closed, as they could claim any
+	// address. Peers of unix sockets are trusted by the file mode.
+	Networks []*net.IPNet
+}
+
+func NewProxyListener(l net.Listener, networks []*net.IPNet) *ProxyListener {
+	return &ProxyListener{Listener: l, Timeout: 10 * time.Second, Networks: networks}
+}
+
+func (l *ProxyListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := conn.(*net.UnixConn); !ok && !containsIP(l.Networks, conn.RemoteAddr()) {
+			conn.Close()
+			continue
+		}
+		return &proxyConn{Conn: conn, reader: bufio.NewReader(conn), timeout: l.Timeout}, nil
+	}
+}
+
+// peerAddr returns the address of the peer of the connection, i.e. the
+// load balancer rather than the client given by its PROXY header.
+func peerAddr(conn net.Conn) net.Addr {
+	for {
+		switch c := conn.(type) {
+		case *tls.Conn:
+			conn = c.NetConn()
+		case *proxyConn:
+			return c.Conn.RemoteAddr()
+		default:
+			return conn.RemoteAddr()
+		}
+	}
+}
+
+type proxyConn struct {
+	net.Conn
+	reader  *bufio.Reader
+	timeout time.Duration
+
+	once     sync.Once
+	src, dst net.Addr
+	err      error
+}
+
+// init reads the header at the first use of the connection.
+func (c *proxyConn) init() error {
+	c.once.Do(func() {
+		if c.timeout > 0 {
+			c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+			defer c.Conn.SetReadDeadline(time.Time{})
+		}
+		c.src, c.dst, c.err = ReadProxyHeader(c.reader)
+	})
+	return c.err
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	if err := c.init(); err != nil {
+		return 0, err
+	}
+	return c.reader.Read(b)
+}
+
+func (c *proxyConn) Write(b []byte) (int, error) {
+	if err := c.init(); err != nil {
+		return 0, err
+	}
+	return c.Conn.Write(b)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	if c.init() == nil && c.src != nil {
+		return c.src
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *proxyConn) LocalAddr() net.Addr {
+	if c.init() == nil && c.dst != nil {
+		return c.dst
+	}
+	return c.Conn.LocalAddr()
+}
+
+// WriteProxyHeader writes a PROXY protocol header of the version, 1 or 2.
+// The connection is UNKNOWN (v1) or LOCAL (v2) unless both addresses are
+// TCP addresses of the same family.
+func WriteProxyHeader(w io.Writer, version int, src, dst *net.TCPAddr) error {
+	family := ""
+	if src != nil && dst != nil {
+		switch {
+		case src.IP.To4() != nil && dst.IP.To4() != nil:
+			family = "TCP4"
+		case src.IP.To4() == nil && dst.IP.To4() == nil:
+			family = "TCP6"
+		}
+	}
+	switch version {
+	case 1:
+		if len(family) == 0 {
+			_, err := io.WriteString(w, "PROXY UNKNOWN\r\n")
+			return err
+		}
+		_, err := fmt.Fprintf(w, "PROXY %s %s %s %d %d\r\n", family, src.IP, dst.IP, src.Port, dst.Port)
+		return err
+	case 2:
+		var b bytes.Buffer
+		b.Write(proxyV2Signature)
+		switch family {
+		case "TCP4":
+			b.Write([]byte{0x21, 0x11, 0, 12})
+			b.Write(src.IP.To4())
+			b.Write(dst.IP.To4())
+		case "TCP6":
+			b.Write([]byte{0x21, 0x21, 0, 36})
+			b.Write(src.IP.To16())
+			b.Write(dst.IP.To16())
+		default:
+			b.Write([]byte{0x20, 0, 0, 0})
+		}
+		if len(family) > 0 {
+			binary.Write(&b, binary.BigEndian, []uint16{uint16(src.Port), uint16(dst.Port)})
+		}
+		_, err := w.Write(b.Bytes())
+		return err
+	}
+	return fmt.Errorf("proxy: unsupported version %d", version)
+}
+
+// parseTCPAddr returns the address in the form of "host:port", or nil.
+func parseTCPAddr(s string) *net.TCPAddr {
+	host, port, err := net.SplitHostPort(s)
+	if err != nil {
+		return nil
+	}
+	ip := net.ParseIP(host)
+	n, err := strconv.ParseUint(port, 10, 16)
+	if ip == nil || err != nil {
+		return nil
+	}
+	return &net.TCPAddr{IP: ip, Port: int(n)}
+}
@@ -0,0 +1,212 @@
+package smtp
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadProxyHeader(t *testing.T) {
+	v2 := "\r\n\r\n\x00\r\nQUIT\n\x21\x11\x00\x0c" +
+		"\xc0\x00\x02\x01\xc6\x33\x64\x01\xd4\x31\x00\x19"
+	for _, x := range []struct {
+		header string
+		src    string
+		dst    string
+	}{
+		{"PROXY TCP4 192.0.2.1 198.51.100.1 54321 25\r\n", "192.0.2.1:54321", "198.51.100.1:25"},
+		{"PROXY TCP6 2001:db8::1 2001:db8::2 54321 25\r\n", "[2001:db8::1]:54321", "[2001:db8::2]:25"},
+		{"PROXY UNKNOWN\r\n", "<nil>", "<nil>"},
+		{v2, "192.0.2.1:54321", "198.51.100.1:25"},
+		{"\r\n\r\n\x00\r\nQUIT\n\x20\x00\x00\x00", "<nil>", "<nil>"},
+	} {
+		r := bufio.NewReader(strings.NewReader(x.header + "EHLO localhost\r\n"))
+		src, dst, err := ReadProxyHeader(r)
+		if err != nil {
+			t.Errorf("%q: %v", x.header, err)
+			continue
+		}
+		if actual := addrString(src) + " " + addrString(dst); actual != x.src+" "+x.dst {
+			t.Errorf("expected: %s %s, actual: %s", x.src, x.dst, actual)
+		}
+		if line, _ := r.ReadString('\n'); line != "EHLO localhost\r\n" {
+			t.Errorf("unexpected data after the header: %q", line)
+		}
+	}
+	for _, x := range []string{
+		"EHLO localhost\r\n",
+		"PROXY TCP4 192.0.2.1 198.51.100.1 54321\r\n",
+		"PROXY TCP4 2001:db8::1 198.51.100.1 54321 25\r\n",
+		"PROXY TCP4 192.0.2.1 198.51.100.1 54321 65536\r\n",
+		"PROXY TCP4 192.0.2.1 198.51.100.1 54321 25\n",
+		"\r\n\r\n\x00\r\nQUIT\n\x11\x11\x00\x00",
+		"\r\n\r\n\x00\r\nQUIT\n\x21\x11\x00\x04\xc0\x00\x02\x01",
+	} {
+		if _, _, err := ReadProxyHeader(bufio.NewReader(strings.NewReader(x + "            "))); err == nil {
+			t.Errorf("expected an error: %q", x)
+		}
+	}
+}
+
+func addrString(addr net.Addr) string {
+	if addr == nil {
+		return "<nil>"
+	}
+	return addr.String()
+}
+
+func TestProxyListener(t *testing.T) {
+	lsnr, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip(err)
+	}
+	defer lsnr.Close()
+	accepted := make(chan *SMTPState, 1)
+	go func() {
+		conn, err := NewProxyListener(lsnr, loopback).Accept()
+		if err != nil {
+			close(accepted)
+			return
+		}
+		h := NewSMTPHandler(conn, func(st *SMTPState) error {
+			x := *st
+			accepted <- &x
+			return nil
+		})
+		h.Config.AddReceived = true
+		h.Run()
+	}()
+	conn, err := net.Dial("tcp", lsnr.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	body := "Subject: Hello\r\n\r\nHello\r\n"
+	conn.Write([]byte("PROXY TCP4 192.0.2.1 198.51.100.1 54321 25\r\n" +
+		"EHLO localhost\r\n" +
+		"MAIL FROM:<foo@example.net>\r\n" +
+		"RCPT TO:<user1@example.com>\r\n" +
+		"BDAT 25 LAST\r\n" + body +
+		"QUIT\r\n"))
+	st := <-accepted
+	if st == nil {
+		t.Fatal("expected a message")
+	}
+	if expected, actual := "192.0.2.1:54321", st.RemoteAddr; expected != actual {
+		t.Errorf("expected: %s, actual: %s", expected, actual)
+	}
+	if !strings.Contains(strings.Join(st.Headers, "\r\n"), "[192.0.2.1]") {
+		t.Errorf("expected the client address in Received: %v", st.Headers)
+	}
+}
+
+var loopback, _ = ParseNetworks("127.0.0.0/8")
+
+func TestProxyListenerUntrusted(t *testing.T) {
+	lsnr, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip(err)
+	}
+	networks, _ := ParseNetworks("192.0.2.0/24")
+	proxy := NewProxyListener(lsnr, networks)
+	defer proxy.Close()
+	go proxy.Accept()
+	conn, err := net.Dial("tcp", lsnr.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("PROXY TCP4 192.0.2.1 198.51.100.1 54321 25\r\nEHLO localhost\r\n"))
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if n, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Errorf("expected the connection to be closed, actual: %d bytes", n)
+	}
+}
+
+func TestXClientBehindProxy(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+	go func() {
+		client.Write([]byte("PROXY TCP4 192.0.2.1 198.51.100.1 54321 25\r\n" +
+			"EHLO localhost\r\n" +
+			"XCLIENT ADDR=203.0.113.1\r\n" +
+			"QUIT\r\n"))
+	}()
+	output := make(chan string, 1)
+	go func() {
+		b, _ := io.ReadAll(client)
+		output <- string(b)
+	}()
+	conn := &proxyConn{Conn: server, reader: bufio.NewReader(server)}
+	h := NewSMTPHandler(conn, nil)
+	// the forged client rather than the peer is within the networks
+	h.Config.XClientNetworks, _ = ParseNetworks("192.0.2.0/24")
+	h.Run()
+	server.Close()
+	expected := "220 250 550 221"
+	if actual := replyCodes([]byte(<-output)); actual != expected {
+		t.Errorf("expected: %s, actual: %s", expected, actual)
+	}
+}
+
+type addrListener struct {
+	net.Listener
+	addrs chan string
+}
+
+func (l addrListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err == nil {
+		l.addrs <- conn.RemoteAddr().String() + " " + conn.LocalAddr().String()
+	}
+	return conn, err
+}
+
+func TestRouterProxyProtocol(t *testing.T) {
+	for _, x := range []struct {
+		version    int
+		remoteAddr string
+		localAddr  string
+		expected   string
+	}{
+		{1, "192.0.2.1:54321", "198.51.100.1:25", "192.0.2.1:54321 198.51.100.1:25"},
+		{2, "192.0.2.1:54321", "198.51.100.1:25", "192.0.2.1:54321 198.51.100.1:25"},
+		{2, "[2001:db8::1]:54321", "[2001:db8::2]:25", "[2001:db8::1]:54321 [2001:db8::2]:25"},
+		{1, "192.0.2.1:54321", "[2001:db8::2]:25", ""},
+		{2, "pipe", "", ""},
+	} {
+		lsnr, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Skip(err)
+		}
+		addrs := make(chan string, 1)
+		received := serveUpstream(addrListener{NewProxyListener(lsnr, loopback), addrs}, nil)
+		router := NewRouter(lsnr.Addr().String())
+		router.ProxyProtocol = x.version
+		st := &SMTPState{}
+		st.Reset()
+		st.RemoteAddr, st.LocalAddr = x.remoteAddr, x.localAddr
+		st.ReturnTo = "foo@example.net"
+		st.Recipients = []string{"user1@example.com"}
+		st.SetContent([]byte("Hello\r\n"))
+		if err := router.Send(st); err != nil {
+			t.Fatal(err)
+		}
+		<-received
+		lsnr.Close()
+		expected := x.expected
+		if len(expected) == 0 {
+			// the addresses of the connection itself
+			expected = "127.0.0.1:"
+		}
+		if actual := <-addrs; !strings.HasPrefix(actual, expected) {
+			t.Errorf("expected: %s, actual: %s", expected, actual)
+		}
+	}
+	if err := WriteProxyHeader(&strings.Builder{}, 3, nil, nil); err == nil {
+		t.Errorf("expected an error of the version")
+	}
+}
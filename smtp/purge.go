@@ -0,0 +1,112 @@
+package smtp
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// AddressPurger is a store deleting the messages of an address, e.g. a
+// MessageStore or a Quarantine.
+type AddressPurger interface {
+	Purge(address string, dryRun bool) (int, error)
+}
+
+// involves reports whether the address is the sender or a recipient.
+func involves(returnTo string, recipients []string, address string) bool {
+	if strings.EqualFold(returnTo, address) {
+		return true
+	}
+	for _, x := range recipients {
+		if strings.EqualFold(x, address) {
+			return true
+		}
+	}
+	return false
+}
+
+// Purge deletes the messages sent to or from the address, or only counts
+// them if dryRun, and returns the number of them.
+func (s *MessageStore) Purge(address string, dryRun bool) (int, error) {
+	xs, err := s.List("")
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, x := range xs {
+		if !involves(x.ReturnTo, x.Recipients, address) {
+			continue
+		}
+		if !dryRun {
+			if err := s.Delete(x.ID); err != nil {
+				return n, err
+			}
+		}
+		n++
+	}
+	return n, nil
+}
+
+// Purge deletes the messages sent to or from the address, or only counts
+// them if dryRun, and returns the number of them.
+func (q *Quarantine) Purge(address string, dryRun bool) (int, error) {
+	xs, err := q.List()
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, x := range xs {
+		if !involves(x.ReturnTo, x.Recipients, address) {
+			continue
+		}
+		if !dryRun {
+			if err := q.Delete(x.ID); err != nil {
+				return n, err
+			}
+		}
+		n++
+	}
+	return n, nil
+}
+
+type purgeResult struct {
+	Address string `json:"address"`
+	DryRun  bool   `json:"dry_run"`
+	Count   int    `json:"count"`
+}
+
+// PurgeHandler deletes the messages of the stores sent to or from the
+// address given by the query parameter address on DELETE, and replies the
+// number of them as JSON. The messages are only counted with dry_run=true.
+func PurgeHandler(stores ...AddressPurger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "DELETE" {
+			w.Header().Set("Allow", "DELETE")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		address := r.URL.Query().Get("address")
+		if _, err := ParseAddress(address); err != nil || len(address) == 0 {
+			http.Error(w, "invalid address", http.StatusBadRequest)
+			return
+		}
+		var dryRun bool
+		if x := r.URL.Query().Get("dry_run"); len(x) > 0 {
+			var err error
+			if dryRun, err = strconv.ParseBool(x); err != nil {
+				http.Error(w, "invalid dry_run", http.StatusBadRequest)
+				return
+			}
+		}
+		result := purgeResult{Address: address, DryRun: dryRun}
+		for _, s := range stores {
+			n, err := s.Purge(address, dryRun)
+			result.Count += n
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+		writeJSON(w, http.StatusOK, result)
+	})
+}
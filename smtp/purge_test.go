@@ -0,0 +1,69 @@
+package smtp
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPurge(t *testing.T) {
+	s, err := NewMessageStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	q, err := NewQuarantine(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, x := range [][]string{
+		{"foo@example.net", "user1@example.com"},
+		{"bar@example.net", "User1@example.com", "user2@example.com"},
+		{"user1@example.com", "baz@example.net"},
+		{"bar@example.net", "user2@example.com"},
+	} {
+		st := &SMTPState{ReturnTo: x[0], Recipients: x[1:]}
+		st.SetContent([]byte("Hello\r\n"))
+		if _, err := s.Put(st); err != nil {
+			t.Fatal(err)
+		}
+	}
+	st := &SMTPState{ReturnTo: "foo@example.net", Recipients: []string{"user1@example.com"}}
+	st.SetContent([]byte("Hello\r\n"))
+	if _, err := q.Put(st); err != nil {
+		t.Fatal(err)
+	}
+
+	h := PurgeHandler(s, q)
+	purge := func(query string) (int, purgeResult) {
+		var result purgeResult
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("DELETE", "/purge?"+query, nil))
+		json.NewDecoder(w.Body).Decode(&result)
+		return w.Code, result
+	}
+	if code, result := purge("address=user1@example.com&dry_run=true"); code != http.StatusOK || result.Count != 4 || !result.DryRun {
+		t.Errorf("unexpected result: %d, %v", code, result)
+	}
+	if xs, _ := s.List(""); len(xs) != 4 {
+		t.Errorf("unexpected deletion by the dry run: %v", xs)
+	}
+	if code, result := purge("address=user1@example.com"); code != http.StatusOK || result.Count != 4 {
+		t.Errorf("unexpected result: %d, %v", code, result)
+	}
+	xs, _ := s.List("")
+	if len(xs) != 1 || xs[0].ReturnTo != "bar@example.net" {
+		t.Errorf("unexpected messages: %v", xs)
+	}
+	if ys, _ := q.List(); len(ys) != 0 {
+		t.Errorf("unexpected quarantined messages: %v", ys)
+	}
+	if code, _ := purge(""); code != http.StatusBadRequest {
+		t.Errorf("expected: %d, actual: %d", http.StatusBadRequest, code)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/purge?address=user2@example.com", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected: %d, actual: %d", http.StatusMethodNotAllowed, w.Code)
+	}
+}
@@ -0,0 +1,175 @@
+package smtp
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Quarantine keeps messages held by the policy in a directory, each as an
+// envelope file "<id>.json" and the message "<id>.eml".
+type Quarantine struct {
+	Dir string
+
+	// Cipher encrypts the messages held if set.
+	Cipher *MessageCipher
+}
+
+type QuarantinedMessage struct {
+	ID         string    `json:"id"`
+	ReturnTo   string    `json:"return_to"`
+	Recipients []string  `json:"recipients"`
+	Tags       []string  `json:"tags,omitempty"`
+	Subject    string    `json:"subject,omitempty"`
+	Received   time.Time `json:"received"`
+}
+
+func NewQuarantine(dir string) (*Quarantine, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &Quarantine{Dir: dir}, nil
+}
+
+func (q *Quarantine) path(id, ext string) string {
+	return filepath.Join(q.Dir, filepath.Base(id)+ext)
+}
+
+// Put stores the message of the transaction and returns its ID.
+func (q *Quarantine) Put(st *SMTPState) (string, error) {
+	b := make([]byte, 8)
+	rand.Read(b)
+	id := time.Now().UTC().Format("20060102150405") + "-" + hex.EncodeToString(b)
+	f, err := createMessage(q.Cipher, q.path(id, ".eml"))
+	if err != nil {
+		return "", err
+	}
+	_, err = io.Copy(f, st.messageReader())
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(q.path(id, ".eml"))
+		return "", err
+	}
+	subject, _ := headerValue(st.Headers, "Subject")
+	msg := QuarantinedMessage{
+		ID:         id,
+		ReturnTo:   st.ReturnTo,
+		Recipients: st.Recipients,
+		Tags:       st.Tags,
+		Subject:    subject,
+		Received:   time.Now(),
+	}
+	data, err := json.Marshal(msg)
+	if err == nil {
+		err = os.WriteFile(q.path(id, ".json"), data, 0600)
+	}
+	if err != nil {
+		os.Remove(q.path(id, ".eml"))
+		return "", err
+	}
+	return id, nil
+}
+
+func (q *Quarantine) Get(id string) (QuarantinedMessage, error) {
+	var msg QuarantinedMessage
+	data, err := os.ReadFile(q.path(id, ".json"))
+	if err != nil {
+		return msg, err
+	}
+	err = json.Unmarshal(data, &msg)
+	return msg, err
+}
+
+// List returns the quarantined messages in the order of arrival.
+func (q *Quarantine) List() ([]QuarantinedMessage, error) {
+	paths, err := filepath.Glob(filepath.Join(q.Dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths)
+	xs := make([]QuarantinedMessage, 0, len(paths))
+	for _, x := range paths {
+		msg, err := q.Get(strings.TrimSuffix(filepath.Base(x), ".json"))
+		if err != nil {
+			return nil, err
+		}
+		xs = append(xs, msg)
+	}
+	return xs, nil
+}
+
+// Entries returns the messages for the retention.
+func (q *Quarantine) Entries() ([]StoreEntry, error) {
+	return storeEntries(q.Dir)
+}
+
+// Open returns the raw message.
+func (q *Quarantine) Open(id string) (io.ReadCloser, error) {
+	return openMessage(q.Cipher, q.path(id, ".eml"))
+}
+
+// Release passes the message to send, then deletes it.
+func (q *Quarantine) Release(id string, send func(st *SMTPState) error) error {
+	msg, err := q.Get(id)
+	if err != nil {
+		return err
+	}
+	f, err := q.Open(id)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	st := &SMTPState{}
+	st.Reset()
+	st.ReturnTo = msg.ReturnTo
+	st.NullSender = len(msg.ReturnTo) == 0
+	st.Recipients = msg.Recipients
+	st.Tags = msg.Tags
+	for _, x := range msg.Recipients {
+		addr, _ := ParseAddress(x)
+		st.RecipientAddresses = append(st.RecipientAddresses, addr)
+	}
+	if err := st.readMessage(f); err != nil {
+		return err
+	}
+	defer st.Close()
+	if err := send(st); err != nil {
+		return err
+	}
+	return q.Delete(id)
+}
+
+// readMessage sets the headers and the content of the raw message.
+func (st *SMTPState) readMessage(r io.Reader) error {
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadString('\n')
+		line = strings.TrimRight(line, "\r\n")
+		if err != nil || len(line) == 0 {
+			break
+		}
+		st.Headers = append(st.Headers, line)
+	}
+	content, err := io.ReadAll(br)
+	if err != nil {
+		return err
+	}
+	st.SetContent(content)
+	return nil
+}
+
+func (q *Quarantine) Delete(id string) error {
+	if err := os.Remove(q.path(id, ".json")); err != nil {
+		return err
+	}
+	return os.Remove(q.path(id, ".eml"))
+}
@@ -0,0 +1,59 @@
+package smtp
+
+import (
+	"testing"
+)
+
+func TestQuarantine(t *testing.T) {
+	q, err := NewQuarantine(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := &SMTPState{}
+	st.Reset()
+	st.ReturnTo = "foo@example.net"
+	st.Recipients = []string{"user1@example.net"}
+	st.Tags = []string{"spam"}
+	st.Headers = []string{"Subject: Buy now"}
+	st.SetContent([]byte("Buy now\r\n"))
+	id, err := q.Put(st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	xs, err := q.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(xs) != 1 || xs[0].ID != id || xs[0].Subject != "Buy now" {
+		t.Errorf("unexpected list: %v", xs)
+	}
+
+	var released string
+	err = q.Release(id, func(st *SMTPState) error {
+		released = st.String()
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "MAIL FROM: <foo@example.net>\r\n" +
+		"RCPT TO: <user1@example.net>\r\n" +
+		"DATA\r\n" +
+		"Subject: Buy now\r\n" +
+		"\r\n" +
+		"Buy now\r\n"
+	if released != expected {
+		t.Errorf("expected: %s, actual: %s", expected, released)
+	}
+	if xs, _ := q.List(); len(xs) != 0 {
+		t.Errorf("expected the message to be deleted after release: %v", xs)
+	}
+
+	id, _ = q.Put(st)
+	if err := q.Delete(id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := q.Get(id); err == nil {
+		t.Errorf("expected the message to be deleted")
+	}
+}
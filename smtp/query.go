@@ -0,0 +1,307 @@
+package smtp
+
+import (
+	"encoding/base64"
+	"errors"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultQueryLimit = 50
+	MaxQueryLimit     = 1000
+)
+
+var ErrInvalidCursor = errors.New("smtp: invalid cursor")
+
+// MessageQuery selects a page of stored messages. Zero values match any
+// message.
+type MessageQuery struct {
+	To      string
+	From    string
+	Subject string // substring, case-insensitive
+	Since   time.Time
+	Until   time.Time
+
+	// HasAttachments matches the messages with attachments if true, or
+	// those without if false.
+	HasAttachments *bool
+
+	// HasWarnings matches the messages with lint warnings if true, or
+	// those without if false.
+	HasWarnings *bool
+
+	// Tags matches the messages with all of them.
+	Tags []string
+
+	// Tenant matches the messages of the tenant if non-nil.
+	Tenant *string
+
+	// Sort is "received", the default, or "size".
+	Sort string
+	Desc bool
+
+	// Cursor is MessagePage.Next of the previous page.
+	Cursor string
+	Limit  int
+}
+
+type MessagePage struct {
+	Messages []StoredMessage `json:"messages"`
+	Next     string          `json:"next,omitempty"`
+}
+
+func (q MessageQuery) match(msg StoredMessage) bool {
+	if len(q.To) > 0 && !involves("", msg.Recipients, q.To) {
+		return false
+	}
+	if len(q.From) > 0 && !strings.EqualFold(msg.ReturnTo, q.From) {
+		return false
+	}
+	if len(q.Subject) > 0 && !strings.Contains(strings.ToLower(msg.Subject), strings.ToLower(q.Subject)) {
+		return false
+	}
+	if (!q.Since.IsZero() && msg.Received.Before(q.Since)) || (!q.Until.IsZero() && !msg.Received.Before(q.Until)) {
+		return false
+	}
+	if q.HasAttachments != nil && msg.Attachments != *q.HasAttachments {
+		return false
+	}
+	if q.HasWarnings != nil && (len(msg.Warnings) > 0) != *q.HasWarnings {
+		return false
+	}
+	for _, x := range q.Tags {
+		if !containsFold(msg.Tags, x) {
+			return false
+		}
+	}
+	if q.Tenant != nil && !containsFold(msg.Tenants, *q.Tenant) {
+		return false
+	}
+	return true
+}
+
+func (q MessageQuery) key(msg StoredMessage) int64 {
+	if q.Sort == "size" {
+		return msg.Size
+	}
+	return msg.Received.UnixNano()
+}
+
+// less reports whether a message of the key and the ID comes before
+// another in the order of the query. The ID breaks ties.
+func (q MessageQuery) less(k1 int64, id1 string, k2 int64, id2 string) bool {
+	if k1 == k2 {
+		return (id1 < id2) != q.Desc
+	}
+	return (k1 < k2) != q.Desc
+}
+
+// cursor encodes the position after the message.
+func (q MessageQuery) cursor(msg StoredMessage) string {
+	s := strconv.FormatInt(q.key(msg), 10) + ":" + msg.ID
+	return base64.RawURLEncoding.EncodeToString([]byte(s))
+}
+
+func parseCursor(cursor string) (int64, string, error) {
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, "", ErrInvalidCursor
+	}
+	k, id, ok := strings.Cut(string(b), ":")
+	if !ok {
+		return 0, "", ErrInvalidCursor
+	}
+	n, err := strconv.ParseInt(k, 10, 64)
+	if err != nil {
+		return 0, "", ErrInvalidCursor
+	}
+	return n, id, nil
+}
+
+// Query returns a page of the messages matching the query. The cursor
+// stays valid while messages are added or deleted.
+func (s *MessageStore) Query(q MessageQuery) (MessagePage, error) {
+	var page MessagePage
+	if q.Sort != "" && q.Sort != "received" && q.Sort != "size" {
+		return page, errors.New("smtp: unknown sort: " + q.Sort)
+	}
+	limit := q.Limit
+	if limit <= 0 {
+		limit = DefaultQueryLimit
+	}
+	if limit > MaxQueryLimit {
+		limit = MaxQueryLimit
+	}
+	var ck int64
+	var cid string
+	if len(q.Cursor) > 0 {
+		var err error
+		if ck, cid, err = parseCursor(q.Cursor); err != nil {
+			return page, err
+		}
+	}
+	s.mtx.Lock()
+	idx, err := s.loadIndex()
+	if err != nil {
+		s.mtx.Unlock()
+		return page, err
+	}
+	xs := idx.messages(idx.candidates(q))
+	s.mtx.Unlock()
+	matched := make([]StoredMessage, 0)
+	for _, x := range xs {
+		if !q.match(x) {
+			continue
+		}
+		if len(q.Cursor) > 0 && !q.less(ck, cid, q.key(x), x.ID) {
+			continue
+		}
+		matched = append(matched, x)
+	}
+	sort.Slice(matched, func(i, j int) bool {
+		return q.less(q.key(matched[i]), matched[i].ID, q.key(matched[j]), matched[j].ID)
+	})
+	if len(matched) > limit {
+		matched = matched[:limit]
+		page.Next = q.cursor(matched[limit-1])
+	}
+	page.Messages = matched
+	return page, nil
+}
+
+// ParseMessageQuery reads a query from the parameters to, from, subject,
+// since and until in RFC 3339, has_attachments, has_warnings, tag which may
+// be repeated, sort, order of asc or desc, cursor and limit.
+func ParseMessageQuery(v map[string][]string) (MessageQuery, error) {
+	get := func(k string) string {
+		if xs := v[k]; len(xs) > 0 {
+			return xs[0]
+		}
+		return ""
+	}
+	q := MessageQuery{
+		To:      get("to"),
+		From:    get("from"),
+		Subject: get("subject"),
+		Tags:    v["tag"],
+		Sort:    get("sort"),
+		Cursor:  get("cursor"),
+	}
+	for k, t := range map[string]*time.Time{"since": &q.Since, "until": &q.Until} {
+		if x := get(k); len(x) > 0 {
+			var err error
+			if *t, err = time.Parse(time.RFC3339, x); err != nil {
+				return q, errors.New("invalid " + k)
+			}
+		}
+	}
+	for k, p := range map[string]**bool{"has_attachments": &q.HasAttachments, "has_warnings": &q.HasWarnings} {
+		if x := get(k); len(x) > 0 {
+			b, err := strconv.ParseBool(x)
+			if err != nil {
+				return q, errors.New("invalid " + k)
+			}
+			*p = &b
+		}
+	}
+	if q.Sort != "" && q.Sort != "received" && q.Sort != "size" {
+		return q, errors.New("invalid sort")
+	}
+	switch get("order") {
+	case "", "asc":
+	case "desc":
+		q.Desc = true
+	default:
+		return q, errors.New("invalid order")
+	}
+	if x := get("limit"); len(x) > 0 {
+		n, err := strconv.Atoi(x)
+		if err != nil || n < 0 {
+			return q, errors.New("invalid limit")
+		}
+		q.Limit = n
+	}
+	return q, nil
+}
+
+// ServeHTTP lists the messages as a MessagePage in JSON on GET, selected
+// by the parameters of ParseMessageQuery. With a tenancy, clients
+// authenticated by APIAuth below ScopeAdmin only see the messages of
+// their tenant, and admins may select a tenant by the parameter tenant.
+func (s *MessageStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	q, err := ParseMessageQuery(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(s.Tenancy) > 0 {
+		identity, scope, ok := APIIdentity(r)
+		if ok && scope < ScopeAdmin {
+			if len(identity) == 0 {
+				http.Error(w, "no tenant", http.StatusForbidden)
+				return
+			}
+			tenant := s.Tenant(identity)
+			q.Tenant = &tenant
+		} else if r.URL.Query().Has("tenant") {
+			tenant := strings.ToLower(r.URL.Query().Get("tenant"))
+			q.Tenant = &tenant
+		}
+	}
+	page, err := s.Query(q)
+	if err == ErrInvalidCursor {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, page)
+}
+
+// hasAttachments reports whether a part of the multipart message is an
+// attachment, i.e. of the disposition attachment or with a filename.
+func hasAttachments(st *SMTPState) bool {
+	contentType, _ := headerValue(st.Headers, "Content-Type")
+	return partHasAttachments(contentType, st.Content())
+}
+
+func partHasAttachments(contentType string, body io.Reader) bool {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil || !strings.HasPrefix(mediaType, "multipart/") || len(params["boundary"]) == 0 {
+		return false
+	}
+	mr := multipart.NewReader(body, params["boundary"])
+	for {
+		p, err := mr.NextPart()
+		if err != nil {
+			return false
+		}
+		if isAttachment(p.Header) || partHasAttachments(p.Header.Get("Content-Type"), p) {
+			return true
+		}
+	}
+}
+
+func isAttachment(h textproto.MIMEHeader) bool {
+	disposition, params, _ := mime.ParseMediaType(h.Get("Content-Disposition"))
+	if disposition == "attachment" || len(params["filename"]) > 0 {
+		return true
+	}
+	_, params, _ = mime.ParseMediaType(h.Get("Content-Type"))
+	return len(params["name"]) > 0
+}
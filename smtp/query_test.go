@@ -0,0 +1,104 @@
+package smtp
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMessageQuery(t *testing.T) {
+	s, err := NewMessageStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := make([]string, 0)
+	for i, x := range []struct {
+		from, to, subject, body string
+		multipart               bool
+	}{
+		{"foo@example.net", "user1@example.com", "Welcome", "Hello", false},
+		{"bar@example.net", "user2@example.com", "Invoice", "Hello, world", true},
+		{"foo@example.net", "user2@example.com", "Welcome back", "Hi", false},
+		{"foo@example.net", "user1@example.com", "Reminder", "Hello again!", false},
+	} {
+		st := &SMTPState{ReturnTo: x.from, Recipients: []string{x.to}}
+		st.Headers = []string{"Subject: " + x.subject}
+		body := x.body + "\r\n"
+		if x.multipart {
+			st.Headers = append(st.Headers, `Content-Type: multipart/mixed; boundary="b"`)
+			body = "--b\r\nContent-Type: text/plain\r\n\r\n" + body +
+				"--b\r\nContent-Type: application/pdf\r\nContent-Disposition: attachment; filename=\"a.pdf\"\r\n\r\nPDF\r\n--b--\r\n"
+		}
+		st.SetContent([]byte(body))
+		id, err := s.Put(st)
+		if err != nil {
+			t.Fatal(i, err)
+		}
+		ids = append(ids, id)
+	}
+	idsOf := func(page MessagePage) string {
+		xs := make([]string, len(page.Messages))
+		for i, x := range page.Messages {
+			for j, id := range ids {
+				if x.ID == id {
+					xs[i] = string(rune('0' + j))
+				}
+			}
+		}
+		return strings.Join(xs, " ")
+	}
+
+	yes := true
+	fixtures := []struct {
+		q        MessageQuery
+		expected string
+	}{
+		{MessageQuery{}, "0 1 2 3"},
+		{MessageQuery{Desc: true}, "3 2 1 0"},
+		{MessageQuery{To: "USER1@example.com"}, "0 3"},
+		{MessageQuery{From: "foo@example.net", Subject: "welcome"}, "0 2"},
+		{MessageQuery{HasAttachments: &yes}, "1"},
+		{MessageQuery{Sort: "size", Desc: true, Limit: 2}, "1 3"},
+	}
+	for i, fixture := range fixtures {
+		page, err := s.Query(fixture.q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if actual := idsOf(page); actual != fixture.expected {
+			t.Errorf("%d: expected: %s, actual: %s", i, fixture.expected, actual)
+		}
+	}
+
+	// pages stay consistent when a message is deleted in between
+	page, _ := s.Query(MessageQuery{Limit: 2})
+	if idsOf(page) != "0 1" || len(page.Next) == 0 {
+		t.Fatalf("unexpected page: %v", page)
+	}
+	s.Delete(ids[0])
+	page, _ = s.Query(MessageQuery{Limit: 2, Cursor: page.Next})
+	if actual := idsOf(page); actual != "2 3" || len(page.Next) > 0 {
+		t.Errorf("expected: 2 3, actual: %s, %s", actual, page.Next)
+	}
+	if _, err := s.Query(MessageQuery{Cursor: "!"}); err != ErrInvalidCursor {
+		t.Errorf("expected: %v, actual: %v", ErrInvalidCursor, err)
+	}
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/messages?to=user2@example.com&order=desc&limit=1", nil))
+	if err := json.NewDecoder(w.Body).Decode(&page); err != nil {
+		t.Fatal(err)
+	}
+	if actual := idsOf(page); w.Code != http.StatusOK || actual != "2" || len(page.Next) == 0 {
+		t.Errorf("unexpected response: %d, %s", w.Code, actual)
+	}
+	for _, x := range []string{"since=yesterday", "order=random", "sort=subject", "cursor=!"} {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest("GET", "/messages?"+x, nil))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s expected: %d, actual: %d", x, http.StatusBadRequest, w.Code)
+		}
+	}
+}
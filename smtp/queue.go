@@ -0,0 +1,535 @@
+package smtp
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Queue holds messages in a directory until Deliver succeeds, retrying
+// with an exponential backoff. The recipients of a message are queued per
+// domain, so the mail for a domain can be flushed on its own with ETRN.
+// Each entry is an envelope file "<id>.json" and the message "<id>.eml".
+// A message with SMTPState.DeliverAt is held until then.
+type Queue struct {
+	Dir string
+
+	// Deliver sends a queued message, e.g. Router.Send.
+	Deliver func(st *SMTPState) error
+
+	// RetryInterval is the delay before the first retry, doubled for each
+	// attempt up to MaxRetryInterval.
+	RetryInterval    time.Duration
+	MaxRetryInterval time.Duration
+
+	// Expire is how long a message is retried before it is given up.
+	Expire time.Duration
+
+	// ScanInterval is how often Run looks for messages due.
+	ScanInterval time.Duration
+
+	// Classes share the deliveries by priority class. See QueueClass.
+	Classes []QueueClass
+
+	// Concurrency is the maximum number of deliveries at a time across
+	// the classes, or 0 for no limit but those of the classes.
+	Concurrency int
+
+	// Failed is called with each message given up, either expired or
+	// rejected permanently, before it is deleted.
+	Failed func(msg QueuedMessage, err error)
+
+	// Notify queues delivery status notifications from MAILER-DAEMON at
+	// ServerName to the sender of each message given up, and of each
+	// message in DELIVERBY notify mode not delivered by its deadline. The
+	// NOTIFY parameters of the recipients are honoured, and those asking
+	// for SUCCESS are notified when relayed to an upstream without DSN.
+	Notify     bool
+	ServerName string
+
+	// Clock tells the time of queueing and retries. The system clock is
+	// used if nil.
+	Clock Clock
+
+	// mtx serializes the updates of envelopes, and running the passes of
+	// Process.
+	mtx     sync.Mutex
+	running sync.Mutex
+	wakeup  chan struct{}
+}
+
+type QueuedMessage struct {
+	ID         string   `json:"id"`
+	Domain     string   `json:"domain"`
+	ReturnTo   string   `json:"return_to"`
+	Recipients []string `json:"recipients"`
+	Tags       []string `json:"tags,omitempty"`
+	Route      string   `json:"route,omitempty"`
+	Priority   int      `json:"priority,omitempty"`
+	Ret        string   `json:"ret,omitempty"`
+	EnvID      string   `json:"envid,omitempty"`
+
+	// RecipientDSNs are the NOTIFY and ORCPT parameters of Recipients,
+	// if any was given.
+	RecipientDSNs []RecipientDSN `json:"recipient_dsns,omitempty"`
+
+	DeliverBy   time.Time `json:"deliver_by"`
+	ByMode      string    `json:"by_mode,omitempty"`
+	DeliverAt   time.Time `json:"deliver_at"`
+	Notified    bool      `json:"notified,omitempty"`
+	SMTPUTF8    bool      `json:"smtputf8,omitempty"`
+	RequireTLS  bool      `json:"require_tls,omitempty"`
+	TLSOptional bool      `json:"tls_optional,omitempty"`
+	RemoteAddr  string    `json:"remote_addr,omitempty"`
+	LocalAddr   string    `json:"local_addr,omitempty"`
+	Username    string    `json:"username,omitempty"`
+	Queued      time.Time `json:"queued"`
+	Attempts    int       `json:"attempts"`
+	NextAttempt time.Time `json:"next_attempt"`
+	LastError   string    `json:"last_error,omitempty"`
+}
+
+func NewQueue(dir string, deliver func(st *SMTPState) error) (*Queue, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &Queue{
+		Dir:              dir,
+		Deliver:          deliver,
+		RetryInterval:    time.Minute,
+		MaxRetryInterval: time.Hour,
+		Expire:           5 * 24 * time.Hour,
+		ScanInterval:     10 * time.Second,
+		wakeup:           make(chan struct{}, 1),
+	}, nil
+}
+
+func (q *Queue) now() time.Time {
+	return clockNow(q.Clock)
+}
+
+func (q *Queue) path(id, ext string) string {
+	return filepath.Join(q.Dir, filepath.Base(id)+ext)
+}
+
+// recipientDomain returns the lower-cased domain of the i-th recipient.
+func recipientDomain(st *SMTPState, i int) string {
+	if i < len(st.RecipientAddresses) {
+		return strings.ToLower(st.RecipientAddresses[i].Domain)
+	}
+	if j := strings.LastIndex(st.Recipients[i], "@"); j >= 0 {
+		return strings.ToLower(st.Recipients[i][j+1:])
+	}
+	return ""
+}
+
+// Send queues the message for each recipient domain. It can be used as
+// SMTPHandler.Send.
+func (q *Queue) Send(st *SMTPState) error {
+	domains := make([]string, 0)
+	rcpts := make(map[string][]string)
+	for i, x := range st.Recipients {
+		domain := recipientDomain(st, i)
+		if _, ok := rcpts[domain]; !ok {
+			domains = append(domains, domain)
+		}
+		rcpts[domain] = append(rcpts[domain], x)
+	}
+	for _, domain := range domains {
+		if _, err := q.Put(st, domain, rcpts[domain]); err != nil {
+			return err
+		}
+	}
+	q.wake()
+	return nil
+}
+
+// Put queues the message of the transaction for the recipients and
+// returns its ID.
+func (q *Queue) Put(st *SMTPState, domain string, recipients []string) (string, error) {
+	var recipientDSNs []RecipientDSN
+	if len(st.RecipientDSNs) > 0 {
+		for _, x := range recipients {
+			recipientDSNs = append(recipientDSNs, st.recipientDSN(x))
+		}
+	}
+	b := make([]byte, 8)
+	rand.Read(b)
+	now := q.now()
+	next := now
+	if st.DeliverAt.After(now) {
+		next = st.DeliverAt
+	}
+	id := fmt.Sprintf("%s%09d-%s", now.UTC().Format("20060102150405"), now.Nanosecond(), hex.EncodeToString(b))
+	f, err := os.OpenFile(q.path(id, ".eml"), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return "", err
+	}
+	_, err = io.Copy(f, st.messageReader())
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = q.save(QueuedMessage{
+			ID:            id,
+			Domain:        domain,
+			ReturnTo:      st.ReturnTo,
+			Recipients:    recipients,
+			Tags:          st.Tags,
+			Route:         st.Route,
+			Priority:      st.Priority,
+			Ret:           st.Ret,
+			EnvID:         st.EnvID,
+			RecipientDSNs: recipientDSNs,
+			DeliverBy:     st.DeliverBy,
+			ByMode:        st.ByMode,
+			DeliverAt:     st.DeliverAt,
+			SMTPUTF8:      st.SMTPUTF8,
+			RequireTLS:    st.RequireTLS,
+			TLSOptional:   st.TLSOptional,
+			RemoteAddr:    st.RemoteAddr,
+			LocalAddr:     st.LocalAddr,
+			Username:      st.Username,
+			Queued:        now,
+			NextAttempt:   next,
+		})
+	}
+	if err != nil {
+		os.Remove(q.path(id, ".eml"))
+		return "", err
+	}
+	return id, nil
+}
+
+// save writes the envelope through a temporary file, so it is never seen
+// partially written.
+func (q *Queue) save(msg QueuedMessage) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	tmp := q.path(msg.ID, ".tmp")
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, q.path(msg.ID, ".json"))
+}
+
+func (q *Queue) Get(id string) (QueuedMessage, error) {
+	var msg QueuedMessage
+	data, err := os.ReadFile(q.path(id, ".json"))
+	if err != nil {
+		return msg, err
+	}
+	err = json.Unmarshal(data, &msg)
+	return msg, err
+}
+
+// List returns the queued messages in the order of arrival.
+func (q *Queue) List() ([]QueuedMessage, error) {
+	paths, err := filepath.Glob(filepath.Join(q.Dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths)
+	xs := make([]QueuedMessage, 0, len(paths))
+	for _, x := range paths {
+		msg, err := q.Get(strings.TrimSuffix(filepath.Base(x), ".json"))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		xs = append(xs, msg)
+	}
+	return xs, nil
+}
+
+// Open returns the raw message.
+func (q *Queue) Open(id string) (io.ReadCloser, error) {
+	return os.Open(q.path(id, ".eml"))
+}
+
+func (q *Queue) Delete(id string) error {
+	for _, ext := range []string{".json", ".eml"} {
+		if err := os.Remove(q.path(id, ext)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// matchDomain reports whether the domain is the node of ETRN, where
+// "@example.net" matches example.net and its subdomains. An empty node
+// matches every domain.
+func matchDomain(node, domain string) bool {
+	node = strings.ToLower(node)
+	if len(node) == 0 || node == domain {
+		return true
+	}
+	if strings.HasPrefix(node, "@") {
+		return domain == node[1:] || strings.HasSuffix(domain, "."+node[1:])
+	}
+	return false
+}
+
+// Flush makes the messages for the node due immediately and returns their
+// number, except those held until a later time. See matchDomain for the
+// node.
+func (q *Queue) Flush(node string) (int, error) {
+	xs, err := q.List()
+	if err != nil {
+		return 0, err
+	}
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	n := 0
+	now := q.now()
+	for _, x := range xs {
+		if !matchDomain(node, x.Domain) || x.DeliverAt.After(now) {
+			continue
+		}
+		// reload in case it has just been attempted
+		msg, err := q.Get(x.ID)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return n, err
+		}
+		msg.NextAttempt = time.Time{}
+		if err := q.save(msg); err != nil {
+			return n, err
+		}
+		n++
+	}
+	if n > 0 {
+		q.wake()
+	}
+	return n, nil
+}
+
+func (q *Queue) wake() {
+	select {
+	case q.wakeup <- struct{}{}:
+	default:
+	}
+}
+
+func (q *Queue) backoff(attempts int) time.Duration {
+	d := q.RetryInterval
+	for i := 1; i < attempts && d < q.MaxRetryInterval; i++ {
+		d *= 2
+	}
+	if d > q.MaxRetryInterval {
+		d = q.MaxRetryInterval
+	}
+	return d
+}
+
+// isPermanent reports whether the delivery error will not go away by
+// retrying.
+func isPermanent(err error) bool {
+	var tpErr *textproto.Error
+	if errors.As(err, &tpErr) {
+		return tpErr.Code >= 500
+	}
+	return errors.Is(err, ErrRequireTLS) || errors.Is(err, ErrDeliverBy) || errors.Is(err, ErrSMTPUTF8)
+}
+
+// load returns the transaction of the queued message.
+func (q *Queue) load(msg QueuedMessage) (*SMTPState, error) {
+	f, err := q.Open(msg.ID)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	st := &SMTPState{clock: q.Clock}
+	st.Reset()
+	st.ReturnTo = msg.ReturnTo
+	st.NullSender = len(msg.ReturnTo) == 0
+	st.Recipients = msg.Recipients
+	st.Tags = msg.Tags
+	st.Route = msg.Route
+	st.Priority = msg.Priority
+	st.Ret = msg.Ret
+	st.EnvID = msg.EnvID
+	st.RecipientDSNs = msg.RecipientDSNs
+	st.DeliverBy = msg.DeliverBy
+	st.ByMode = msg.ByMode
+	st.DeliverAt = msg.DeliverAt
+	st.SMTPUTF8 = msg.SMTPUTF8
+	st.RequireTLS = msg.RequireTLS
+	st.TLSOptional = msg.TLSOptional
+	st.RemoteAddr = msg.RemoteAddr
+	st.LocalAddr = msg.LocalAddr
+	st.Username = msg.Username
+	for _, x := range msg.Recipients {
+		addr, _ := ParseAddress(x)
+		st.RecipientAddresses = append(st.RecipientAddresses, addr)
+	}
+	if err := st.readMessage(f); err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+// attempt delivers the message with deliver, then settles it.
+func (q *Queue) attempt(msg QueuedMessage, deliver func(st *SMTPState) error) error {
+	st, err := q.load(msg)
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+	err = deliver(st)
+	var errs RecipientErrors
+	if err == nil || errors.As(err, &errs) {
+		// Upstreams offering DSN notify the success themselves.
+		relayed := msg.withRecipients(func(x string) bool {
+			_, failed := errs[x]
+			return !failed && !containsFold(st.dsnRelayed, x)
+		})
+		if err := q.notify(relayed, "relayed", nil); err != nil {
+			return err
+		}
+	}
+	return q.settle(msg, err)
+}
+
+// withRecipients returns the message for the recipients which keep
+// reports true for.
+func (msg QueuedMessage) withRecipients(keep func(x string) bool) QueuedMessage {
+	xs := msg
+	xs.Recipients, xs.RecipientDSNs = nil, nil
+	for i, x := range msg.Recipients {
+		if keep(x) {
+			xs.Recipients = append(xs.Recipients, x)
+			if i < len(msg.RecipientDSNs) {
+				xs.RecipientDSNs = append(xs.RecipientDSNs, msg.RecipientDSNs[i])
+			}
+		}
+	}
+	return xs
+}
+
+// settle deletes the message delivered or given up, and schedules the
+// next attempt otherwise. Of the message delivered to some recipients
+// only, the others are given up or retried on their own.
+func (q *Queue) settle(msg QueuedMessage, err error) error {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	if err == nil {
+		return q.Delete(msg.ID)
+	}
+	var errs RecipientErrors
+	if errors.As(err, &errs) {
+		failed := msg.withRecipients(func(x string) bool {
+			e, ok := errs[x]
+			return ok && isPermanent(e)
+		})
+		if len(failed.Recipients) > 0 {
+			if q.Failed != nil {
+				q.Failed(failed, err)
+			}
+			if err := q.notify(failed, "failed", err); err != nil {
+				return err
+			}
+		}
+		msg = msg.withRecipients(func(x string) bool {
+			e, ok := errs[x]
+			return ok && !isPermanent(e)
+		})
+		if len(msg.Recipients) == 0 {
+			return q.Delete(msg.ID)
+		}
+	}
+	msg.Attempts++
+	msg.LastError = err.Error()
+	now := q.now()
+	if isPermanent(err) || now.Sub(msg.Queued) >= q.Expire {
+		if q.Failed != nil {
+			q.Failed(msg, err)
+		}
+		if err := q.notify(msg, "failed", err); err != nil {
+			return err
+		}
+		return q.Delete(msg.ID)
+	}
+	msg.NextAttempt = now.Add(q.backoff(msg.Attempts))
+	if strings.HasPrefix(msg.ByMode, "R") && msg.NextAttempt.After(msg.DeliverBy) {
+		msg.NextAttempt = msg.DeliverBy
+	}
+	return q.save(msg)
+}
+
+// expire handles the message past its DELIVERBY deadline: in R mode it is
+// given up, and in N mode the sender is notified once. It reports whether
+// the message has been given up.
+func (q *Queue) expire(msg *QueuedMessage, now time.Time) (bool, error) {
+	if len(msg.ByMode) == 0 || now.Before(msg.DeliverBy) {
+		return false, nil
+	}
+	if strings.HasPrefix(msg.ByMode, "R") {
+		return true, q.settle(*msg, ErrDeliverBy)
+	}
+	if msg.Notified {
+		return false, nil
+	}
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	msg.Notified = true
+	if err := q.notify(*msg, "delayed", ErrDeliverBy); err != nil {
+		return false, err
+	}
+	return false, q.save(*msg)
+}
+
+// Process attempts the delivery of every message due, in the order of
+// their MT-PRIORITY, then of arrival, within each class. See dispatch.
+func (q *Queue) Process() error {
+	q.running.Lock()
+	defer q.running.Unlock()
+	xs, err := q.List()
+	if err != nil {
+		return err
+	}
+	now := q.now()
+	due := make([]QueuedMessage, 0, len(xs))
+	for _, msg := range xs {
+		expired, err := q.expire(&msg, now)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if !expired && !msg.NextAttempt.After(now) {
+			due = append(due, msg)
+		}
+	}
+	sort.SliceStable(due, func(i, j int) bool { return due[i].Priority > due[j].Priority })
+	return q.dispatch(due)
+}
+
+// Run processes the queue every ScanInterval and when messages are
+// queued or flushed, until stop is closed.
+func (q *Queue) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(q.ScanInterval)
+	defer ticker.Stop()
+	for {
+		q.Process()
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		case <-q.wakeup:
+		}
+	}
+}
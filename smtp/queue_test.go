@@ -0,0 +1,299 @@
+package smtp
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestQueue(t *testing.T) {
+	content := func(st *SMTPState) string {
+		b, _ := io.ReadAll(st.Content())
+		return string(b)
+	}
+	delivered := make([][]string, 0)
+	var deliverErr error
+	q, err := NewQueue(t.TempDir(), func(st *SMTPState) error {
+		if deliverErr != nil {
+			return deliverErr
+		}
+		delivered = append(delivered, st.Recipients)
+		if len(st.Headers) != 1 || content(st) != "Hello\r\n" {
+			t.Errorf("unexpected message: %v", st.Headers)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	failed := make([]string, 0)
+	q.Failed = func(msg QueuedMessage, err error) {
+		failed = append(failed, msg.Domain)
+	}
+	st := &SMTPState{}
+	st.Reset()
+	st.ReturnTo = "foo@example.net"
+	st.Recipients = []string{"user1@example.net", "user1@example.org", "user2@EXAMPLE.NET"}
+	st.Headers = []string{"Subject: Hello"}
+	st.SetContent([]byte("Hello\r\n"))
+	if err := q.Send(st); err != nil {
+		t.Fatal(err)
+	}
+	xs, err := q.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(xs) != 2 || xs[0].Domain != "example.net" || len(xs[0].Recipients) != 2 || xs[1].Domain != "example.org" {
+		t.Fatalf("unexpected queue: %v", xs)
+	}
+
+	deliverErr = errors.New("connection refused")
+	if err := q.Process(); err != nil {
+		t.Fatal(err)
+	}
+	xs, _ = q.List()
+	if len(xs) != 2 || xs[0].Attempts != 1 || xs[0].LastError != "connection refused" ||
+		time.Until(xs[0].NextAttempt) < 59*time.Second {
+		t.Fatalf("unexpected queue: %v", xs)
+	}
+	// not due yet
+	q.Process()
+	if xs, _ = q.List(); xs[0].Attempts != 1 {
+		t.Errorf("expected: 1, actual: %d", xs[0].Attempts)
+	}
+
+	deliverErr = nil
+	for _, fixture := range []struct {
+		node     string
+		expected int
+	}{
+		{"example.com", 0},
+		{"@org", 1},
+		{"EXAMPLE.NET", 1},
+	} {
+		if n, err := q.Flush(fixture.node); err != nil || n != fixture.expected {
+			t.Errorf("expected: %d, actual: %d %v (%s)", fixture.expected, n, err, fixture.node)
+		}
+	}
+	q.Process()
+	if len(delivered) != 2 || len(delivered[0]) != 2 || delivered[1][0] != "user1@example.org" {
+		t.Errorf("unexpected deliveries: %v", delivered)
+	}
+	if xs, _ = q.List(); len(xs) != 0 {
+		t.Errorf("unexpected queue: %v", xs)
+	}
+
+	st.Recipients = []string{"user1@example.net"}
+	st.RecipientAddresses = nil
+	q.Send(st)
+	deliverErr = &textproto.Error{Code: 550, Msg: "No such user"}
+	q.Process()
+	if xs, _ = q.List(); len(xs) != 0 || len(failed) != 1 || failed[0] != "example.net" {
+		t.Errorf("unexpected queue: %v %v", xs, failed)
+	}
+}
+
+func TestQueueBackoff(t *testing.T) {
+	q := &Queue{RetryInterval: time.Minute, MaxRetryInterval: 10 * time.Minute}
+	for _, fixture := range []struct {
+		attempts int
+		expected time.Duration
+	}{
+		{1, time.Minute},
+		{2, 2 * time.Minute},
+		{4, 8 * time.Minute},
+		{5, 10 * time.Minute},
+		{100, 10 * time.Minute},
+	} {
+		if actual := q.backoff(fixture.attempts); actual != fixture.expected {
+			t.Errorf("expected: %s, actual: %s", fixture.expected, actual)
+		}
+	}
+}
+
+func TestQueuePriority(t *testing.T) {
+	delivered := make([]int, 0)
+	q, err := NewQueue(t.TempDir(), func(st *SMTPState) error {
+		delivered = append(delivered, st.Priority)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, priority := range []int{0, -3, 5, 0, 2} {
+		st := &SMTPState{}
+		st.Reset()
+		st.Recipients = []string{"user1@example.net"}
+		st.Priority = priority
+		st.SetContent([]byte("Hello\r\n"))
+		if err := q.Send(st); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := q.Process(); err != nil {
+		t.Fatal(err)
+	}
+	if expected, actual := "[5 2 0 0 -3]", fmt.Sprint(delivered); actual != expected {
+		t.Errorf("expected: %s, actual: %s", expected, actual)
+	}
+}
+
+func TestQueueDeliverBy(t *testing.T) {
+	q, err := NewQueue(t.TempDir(), func(st *SMTPState) error {
+		if len(st.ReturnTo) == 0 {
+			return errors.New("hold notifications")
+		}
+		return errors.New("connection refused")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.Notify = true
+	send := func(mode string, deadline time.Duration) {
+		st := &SMTPState{}
+		st.Reset()
+		st.ReturnTo = "foo@example.net"
+		st.Recipients = []string{"user1@example.org"}
+		st.DeliverBy = time.Now().Add(deadline)
+		st.ByMode = mode
+		st.SetContent([]byte("Hello\r\n"))
+		if err := q.Send(st); err != nil {
+			t.Fatal(err)
+		}
+	}
+	notifications := func() []string {
+		actions := make([]string, 0)
+		xs, _ := q.List()
+		for _, x := range xs {
+			if len(x.ReturnTo) > 0 {
+				continue
+			}
+			f, _ := q.Open(x.ID)
+			b, _ := io.ReadAll(f)
+			f.Close()
+			if strings.Contains(string(b), "Action: failed") {
+				actions = append(actions, "failed")
+			} else if strings.Contains(string(b), "Action: delayed") {
+				actions = append(actions, "delayed")
+			}
+		}
+		return actions
+	}
+
+	send("R", time.Hour)
+	q.Process()
+	xs, _ := q.List()
+	if len(xs) != 1 || xs[0].NextAttempt.After(xs[0].DeliverBy) {
+		t.Fatalf("unexpected queue: %v", xs)
+	}
+	q.RetryInterval = 2 * time.Hour
+	q.MaxRetryInterval = 2 * time.Hour
+	q.Flush("")
+	q.Process()
+	if xs, _ = q.List(); len(xs) != 1 || !xs[0].NextAttempt.Equal(xs[0].DeliverBy) {
+		t.Fatalf("expected the next attempt at the deadline: %v", xs)
+	}
+
+	send("N", -time.Second)
+	send("R", -time.Second)
+	q.Process()
+	q.Process()
+	if expected, actual := "[delayed failed]", fmt.Sprint(notifications()); actual != expected {
+		t.Errorf("expected: %s, actual: %s", expected, actual)
+	}
+}
+
+func TestQueueClock(t *testing.T) {
+	clock := NewFakeClock(time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC))
+	attempts := 0
+	q, err := NewQueue(t.TempDir(), func(st *SMTPState) error {
+		attempts++
+		return errors.New("connection refused")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.Clock = clock
+	failed := 0
+	q.Failed = func(msg QueuedMessage, err error) {
+		failed++
+	}
+	st := &SMTPState{}
+	st.Reset()
+	st.ReturnTo = "foo@example.net"
+	st.Recipients = []string{"user1@example.net"}
+	st.SetContent([]byte("Hello\r\n"))
+	q.Send(st)
+	q.Process()
+	clock.Advance(59 * time.Second)
+	q.Process()
+	if attempts != 1 {
+		t.Errorf("expected: 1, actual: %d", attempts)
+	}
+	clock.Advance(time.Second)
+	q.Process()
+	if attempts != 2 {
+		t.Errorf("expected: 2, actual: %d", attempts)
+	}
+	clock.Advance(q.Expire)
+	q.Process()
+	if xs, _ := q.List(); len(xs) != 0 || failed != 1 {
+		t.Errorf("unexpected queue: %v %d", xs, failed)
+	}
+}
+
+func TestQueuePartialDelivery(t *testing.T) {
+	attempts := make([]string, 0)
+	q, err := NewQueue(t.TempDir(), func(st *SMTPState) error {
+		if len(st.ReturnTo) == 0 {
+			return errors.New("hold notifications")
+		}
+		attempts = append(attempts, fmt.Sprint(st.Recipients))
+		return RecipientErrors{
+			"user2@example.org": errors.New("connection refused"),
+			"user3@example.org": &textproto.Error{Code: 550, Msg: "5.1.1 No such user"},
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.Notify = true
+	failed := make([]string, 0)
+	q.Failed = func(msg QueuedMessage, err error) {
+		failed = append(failed, msg.Recipients...)
+	}
+	st := &SMTPState{}
+	st.Reset()
+	st.ReturnTo = "foo@example.net"
+	st.Recipients = []string{"user1@example.org", "user2@example.org", "user3@example.org"}
+	st.SetContent([]byte("Hello\r\n"))
+	if err := q.Send(st); err != nil {
+		t.Fatal(err)
+	}
+	q.Process()
+	q.Flush("")
+	q.Process()
+	if expected, actual := "[[user1@example.org user2@example.org user3@example.org] [user2@example.org]]", fmt.Sprint(attempts); actual != expected {
+		t.Errorf("expected: %s, actual: %s", expected, actual)
+	}
+	if expected, actual := "[user3@example.org]", fmt.Sprint(failed); actual != expected {
+		t.Errorf("expected: %s, actual: %s", expected, actual)
+	}
+	xs, _ := q.List()
+	for _, x := range xs {
+		if len(x.ReturnTo) > 0 {
+			continue
+		}
+		f, _ := q.Open(x.ID)
+		b, _ := io.ReadAll(f)
+		f.Close()
+		if body := string(b); !strings.Contains(body, "Final-Recipient: rfc822; user3@example.org\r\nAction: failed\r\nStatus: 5.1.1\r\n") ||
+			strings.Contains(body, "user2@example.org") {
+			t.Errorf("unexpected notification: %s", body)
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package smtp
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// QueueClass is a priority class of queued messages. A message belongs to
+// the first class whose Tag it has, if Tag is set, and whose MinPriority
+// its MT-PRIORITY reaches, or to the last class.
+type QueueClass struct {
+	Name        string
+	Tag         string
+	MinPriority int
+
+	// Weight is how many messages of the class are attempted in turn
+	// before the next class, while the classes compete for
+	// Queue.Concurrency.
+	Weight int
+
+	// Concurrency is the maximum number of deliveries of the class at a
+	// time.
+	Concurrency int
+}
+
+// DefaultQueueClass is the only class unless Queue.Classes is set.
+var DefaultQueueClass = QueueClass{Name: "default", MinPriority: -9, Weight: 1, Concurrency: 1}
+
+// ParseQueueClasses reads classes in the form of "name [option]...", one
+// per line in the order of matching. The options are tag=<tag>,
+// priority=<minimum MT-PRIORITY>, weight=<n> and concurrency=<n>, each 1
+// by default.
+//
+//	urgent   priority=3 weight=4 concurrency=4
+//	bulk     tag=bulk
+//	default  weight=2 concurrency=2
+func ParseQueueClasses(r io.Reader) ([]QueueClass, error) {
+	classes := make([]QueueClass, 0)
+	scanner := bufio.NewScanner(r)
+	n := 0
+	for scanner.Scan() {
+		n++
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		xs := strings.Fields(line)
+		class := QueueClass{Name: xs[0], MinPriority: -9, Weight: 1, Concurrency: 1}
+		for _, x := range xs[1:] {
+			if err := class.setOption(x); err != nil {
+				return nil, fmt.Errorf("line %d: %v", n, err)
+			}
+		}
+		classes = append(classes, class)
+	}
+	return classes, scanner.Err()
+}
+
+func (class *QueueClass) setOption(x string) error {
+	kv := strings.SplitN(x, "=", 2)
+	if len(kv) != 2 {
+		return fmt.Errorf("unknown option: %s", x)
+	}
+	if kv[0] == "tag" {
+		class.Tag = kv[1]
+		return nil
+	}
+	n, err := strconv.Atoi(kv[1])
+	if err != nil {
+		return fmt.Errorf("invalid %s: %s", kv[0], kv[1])
+	}
+	switch kv[0] {
+	case "priority":
+		if n < -9 || n > 9 {
+			return fmt.Errorf("invalid priority: %s", kv[1])
+		}
+		class.MinPriority = n
+	case "weight", "concurrency":
+		if n <= 0 {
+			return fmt.Errorf("invalid %s: %s", kv[0], kv[1])
+		}
+		if kv[0] == "weight" {
+			class.Weight = n
+		} else {
+			class.Concurrency = n
+		}
+	default:
+		return fmt.Errorf("unknown option: %s", kv[0])
+	}
+	return nil
+}
+
+func (class QueueClass) matches(msg QueuedMessage) bool {
+	return (len(class.Tag) == 0 || containsFold(msg.Tags, class.Tag)) && msg.Priority >= class.MinPriority
+}
+
+// Class returns the name of the class of the message.
+func (q *Queue) Class(msg QueuedMessage) string {
+	return q.classes()[q.classify(msg)].Name
+}
+
+func (q *Queue) classes() []QueueClass {
+	if len(q.Classes) == 0 {
+		return []QueueClass{DefaultQueueClass}
+	}
+	return q.Classes
+}
+
+func (q *Queue) classify(msg QueuedMessage) int {
+	classes := q.classes()
+	for i, class := range classes {
+		if class.matches(msg) {
+			return i
+		}
+	}
+	return len(classes) - 1
+}
+
+type classQueue struct {
+	msgs   []QueuedMessage
+	weight int
+	limit  int
+	active int
+}
+
+type attemptResult struct {
+	class *classQueue
+	err   error
+}
+
+// dispatch attempts the messages, in their order within each class, by
+// weighted round robin among the classes within the limits of concurrency.
+// It stops dispatching at an error and returns it.
+func (q *Queue) dispatch(due []QueuedMessage) error {
+	cqs := make([]*classQueue, 0)
+	for _, class := range q.classes() {
+		cq := &classQueue{weight: class.Weight, limit: class.Concurrency}
+		if cq.weight <= 0 {
+			cq.weight = 1
+		}
+		if cq.limit <= 0 {
+			cq.limit = 1
+		}
+		cqs = append(cqs, cq)
+	}
+	for _, msg := range due {
+		cq := cqs[q.classify(msg)]
+		cq.msgs = append(cq.msgs, msg)
+	}
+
+	i, credit, active := 0, cqs[0].weight, 0
+	next := func() *classQueue {
+		if q.Concurrency > 0 && active >= q.Concurrency {
+			return nil
+		}
+		for n := 0; n <= len(cqs); n++ {
+			if cq := cqs[i]; credit > 0 && len(cq.msgs) > 0 && cq.active < cq.limit {
+				credit--
+				return cq
+			}
+			i = (i + 1) % len(cqs)
+			credit = cqs[i].weight
+		}
+		return nil
+	}
+	results := make(chan attemptResult)
+	var err error
+	for {
+		var cq *classQueue
+		if err == nil {
+			cq = next()
+		}
+		if cq != nil {
+			msg := cq.msgs[0]
+			cq.msgs = cq.msgs[1:]
+			cq.active++
+			active++
+			go func() {
+				results <- attemptResult{cq, q.attempt(msg, q.Deliver)}
+			}()
+			continue
+		}
+		if active == 0 {
+			return err
+		}
+		res := <-results
+		res.class.active--
+		active--
+		if res.err != nil && !os.IsNotExist(res.err) && err == nil {
+			err = res.err
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package smtp
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseQueueClasses(t *testing.T) {
+	classes, err := ParseQueueClasses(strings.NewReader(`
+# classes
+urgent   priority=3 weight=4 concurrency=4
+bulk     tag=bulk
+default
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "[{urgent  3 4 4} {bulk bulk -9 1 1} {default  -9 1 1}]"
+	if actual := fmt.Sprint(classes); actual != expected {
+		t.Errorf("expected: %s, actual: %s", expected, actual)
+	}
+	for _, x := range []string{"bulk tag", "bulk weight=0", "bulk priority=10", "bulk limit=1"} {
+		if _, err := ParseQueueClasses(strings.NewReader(x)); err == nil {
+			t.Errorf("expected an error: %s", x)
+		}
+	}
+}
+
+func queueMessages(t *testing.T, q *Queue, n int, priority int, tags ...string) {
+	for i := 0; i < n; i++ {
+		st := &SMTPState{}
+		st.Reset()
+		st.Recipients = []string{"user1@example.net"}
+		st.Priority = priority
+		st.Tags = tags
+		st.SetContent([]byte("Hello\r\n"))
+		if err := q.Send(st); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestQueueClasses(t *testing.T) {
+	var q *Queue
+	delivered := make([]string, 0)
+	q, err := NewQueue(t.TempDir(), func(st *SMTPState) error {
+		delivered = append(delivered, q.Class(QueuedMessage{Priority: st.Priority, Tags: st.Tags}))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.Classes = []QueueClass{
+		{Name: "urgent", MinPriority: 3, Weight: 2, Concurrency: 1},
+		{Name: "bulk", Tag: "bulk", MinPriority: -9, Weight: 1, Concurrency: 1},
+		{Name: "default", MinPriority: -9, Weight: 1, Concurrency: 1},
+	}
+	q.Concurrency = 1
+	queueMessages(t, q, 3, 0, "bulk")
+	queueMessages(t, q, 2, 0)
+	queueMessages(t, q, 3, 5)
+	if err := q.Process(); err != nil {
+		t.Fatal(err)
+	}
+	expected := "urgent urgent bulk default urgent bulk default bulk"
+	if actual := strings.Join(delivered, " "); actual != expected {
+		t.Errorf("expected: %s, actual: %s", expected, actual)
+	}
+}
+
+func TestQueueClassConcurrency(t *testing.T) {
+	var mtx sync.Mutex
+	active := make(map[string]int)
+	peak := make(map[string]int)
+	q, err := NewQueue(t.TempDir(), func(st *SMTPState) error {
+		class := "default"
+		if len(st.Tags) > 0 {
+			class = "bulk"
+		}
+		mtx.Lock()
+		active[class]++
+		active["total"]++
+		for _, x := range []string{class, "total"} {
+			if active[x] > peak[x] {
+				peak[x] = active[x]
+			}
+		}
+		mtx.Unlock()
+		time.Sleep(20 * time.Millisecond)
+		mtx.Lock()
+		active[class]--
+		active["total"]--
+		mtx.Unlock()
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.Classes = []QueueClass{
+		{Name: "bulk", Tag: "bulk", MinPriority: -9, Weight: 1, Concurrency: 2},
+		{Name: "default", MinPriority: -9, Weight: 1, Concurrency: 1},
+	}
+	queueMessages(t, q, 4, 0, "bulk")
+	queueMessages(t, q, 2, 0)
+	if err := q.Process(); err != nil {
+		t.Fatal(err)
+	}
+	if xs, _ := q.List(); len(xs) != 0 {
+		t.Errorf("unexpected queue: %v", xs)
+	}
+	expected := "map[bulk:2 default:1 total:3]"
+	if actual := fmt.Sprint(peak); actual != expected {
+		t.Errorf("expected: %s, actual: %s", expected, actual)
+	}
+}
@@ -0,0 +1,116 @@
+package smtp
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Quota limits the messages of a mailbox. Zero is unlimited.
+type Quota struct {
+	MaxMessages int
+	MaxBytes    int64
+}
+
+// MailboxQuotas limit the mailboxes of a store, answering RCPT with 452
+// once a mailbox is full. The mailbox is the tenant of the store with a
+// tenancy, or the recipient otherwise.
+type MailboxQuotas struct {
+	Store   *MessageStore
+	Default Quota
+
+	quotas map[string]Quota
+}
+
+func NewMailboxQuotas(store *MessageStore, def Quota) *MailboxQuotas {
+	return &MailboxQuotas{Store: store, Default: def, quotas: make(map[string]Quota)}
+}
+
+// Set overrides the default quota of the mailbox, an address or a tenant.
+func (q *MailboxQuotas) Set(mailbox string, quota Quota) {
+	q.quotas[strings.ToLower(mailbox)] = quota
+}
+
+// ParseMailboxQuotas reads the quotas in the form of "mailbox
+// [messages=N] [bytes=N]", one per line. The mailbox "*" is the default.
+func ParseMailboxQuotas(r io.Reader) (*MailboxQuotas, error) {
+	q := NewMailboxQuotas(nil, Quota{})
+	scanner := bufio.NewScanner(r)
+	n := 0
+	for scanner.Scan() {
+		n++
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		xs := strings.Fields(line)
+		var quota Quota
+		for _, x := range xs[1:] {
+			kv := strings.SplitN(x, "=", 2)
+			if len(kv) != 2 || (kv[0] != "messages" && kv[0] != "bytes") {
+				return nil, fmt.Errorf("line %d: unknown option: %s", n, x)
+			}
+			v, err := strconv.ParseInt(kv[1], 10, 64)
+			if err != nil || v < 0 {
+				return nil, fmt.Errorf("line %d: invalid %s: %s", n, kv[0], kv[1])
+			}
+			if kv[0] == "messages" {
+				quota.MaxMessages = int(v)
+			} else {
+				quota.MaxBytes = v
+			}
+		}
+		if xs[0] == "*" {
+			q.Default = quota
+		} else {
+			q.Set(xs[0], quota)
+		}
+	}
+	return q, scanner.Err()
+}
+
+// Usage returns the number and the total size of the messages of the
+// mailbox as listed by List.
+func (s *MessageStore) Usage(mailbox string) (int, int64, error) {
+	xs, err := s.List(mailbox)
+	if err != nil {
+		return 0, 0, err
+	}
+	var size int64
+	for _, x := range xs {
+		size += x.Size
+	}
+	return len(xs), size, nil
+}
+
+// Full reports whether the mailbox of the recipient cannot take the
+// message of the transaction, of the size declared by MAIL if any.
+func (q *MailboxQuotas) Full(st *SMTPState, rcpt string) bool {
+	mailbox := rcpt
+	if q.Store.Tenancy == TenancyUser {
+		if len(st.Username) == 0 {
+			// stored for no tenant
+			return false
+		}
+		mailbox = st.Username
+	}
+	key := strings.ToLower(mailbox)
+	if len(q.Store.Tenancy) > 0 {
+		key = q.Store.Tenant(mailbox)
+	}
+	quota, ok := q.quotas[key]
+	if !ok {
+		quota = q.Default
+	}
+	if quota == (Quota{}) {
+		return false
+	}
+	count, size, err := q.Store.Usage(mailbox)
+	if err != nil {
+		return false
+	}
+	return (quota.MaxMessages > 0 && count >= quota.MaxMessages) ||
+		(quota.MaxBytes > 0 && (size >= quota.MaxBytes || size+st.Size > quota.MaxBytes))
+}
@@ -0,0 +1,48 @@
+package smtp
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMailboxQuotas(t *testing.T) {
+	s, err := NewMessageStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	q, err := ParseMailboxQuotas(strings.NewReader("# quotas\n" +
+		"* messages=2\n" +
+		"big@example.com messages=0 bytes=800\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.Store = s
+	for _, x := range []string{"user1@example.com", "user1@example.com", "big@example.com"} {
+		st := &SMTPState{ReturnTo: "foo@example.net", Recipients: []string{x}}
+		st.SetContent([]byte(strings.Repeat("x", 500) + "\r\n"))
+		s.Put(st)
+	}
+	conn := NewMockConn([]byte("EHLO localhost\r\n" +
+		"MAIL FROM: <foo@example.net> SIZE=400\r\n" +
+		"RCPT TO: <user2@example.com>\r\n" +
+		"RCPT TO: <USER1@example.com>\r\n" +
+		"RCPT TO: <big@example.com>\r\n" +
+		"RSET\r\n" +
+		"MAIL FROM: <foo@example.net> SIZE=100\r\n" +
+		"RCPT TO: <big@example.com>\r\n" +
+		"QUIT\r\n"))
+	h := NewSMTPHandler(conn, nil)
+	h.Config.Quotas = q
+	h.Run()
+	expected := "220 250 250 250 452 452 250 250 250 221"
+	if actual := replyCodes(conn.CloneOutputBuffer()); actual != expected {
+		t.Errorf("expected: %s, actual: %s", expected, actual)
+	}
+	if !strings.Contains(string(conn.CloneOutputBuffer()), "452 4.2.2 Mailbox full\r\n") {
+		t.Errorf("expected 452 4.2.2: %s", conn.CloneOutputBuffer())
+	}
+
+	if _, err := ParseMailboxQuotas(strings.NewReader("* size=1\n")); err == nil {
+		t.Errorf("expected an error of the unknown option")
+	}
+}
@@ -0,0 +1,93 @@
+package smtp
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// RecipientVerdict is the decision of a RecipientValidator.
+type RecipientVerdict int
+
+const (
+	RecipientAccept RecipientVerdict = iota
+	RecipientReject
+	RecipientDefer
+)
+
+// RecipientValidator decides at RCPT whether a recipient exists, e.g. by
+// a user database or an HTTP service. Errors defer the recipient.
+type RecipientValidator interface {
+	ValidateRecipient(ctx context.Context, st *SMTPState, rcpt Address) (RecipientVerdict, error)
+}
+
+// RecipientValidatorFunc adapts a function to RecipientValidator.
+type RecipientValidatorFunc func(ctx context.Context, st *SMTPState, rcpt Address) (RecipientVerdict, error)
+
+func (f RecipientValidatorFunc) ValidateRecipient(ctx context.Context, st *SMTPState, rcpt Address) (RecipientVerdict, error) {
+	return f(ctx, st, rcpt)
+}
+
+// HTTPRecipientValidator asks a service at URL with GET and the query
+// parameters rcpt and from. A 2xx status accepts the recipient, 404 and
+// 410 reject it, and any other status defers it.
+type HTTPRecipientValidator struct {
+	URL    string
+	Client *http.Client
+}
+
+func NewHTTPRecipientValidator(url string) *HTTPRecipientValidator {
+	return &HTTPRecipientValidator{URL: url, Client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+func (v *HTTPRecipientValidator) ValidateRecipient(ctx context.Context, st *SMTPState, rcpt Address) (RecipientVerdict, error) {
+	u, err := url.Parse(v.URL)
+	if err != nil {
+		return RecipientDefer, err
+	}
+	q := u.Query()
+	q.Set("rcpt", rcpt.String())
+	q.Set("from", st.ReturnTo)
+	u.RawQuery = q.Encode()
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return RecipientDefer, err
+	}
+	resp, err := v.Client.Do(req)
+	if err != nil {
+		return RecipientDefer, err
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return RecipientAccept, nil
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone:
+		return RecipientReject, nil
+	}
+	return RecipientDefer, fmt.Errorf("smtp: recipient validator %s: %s", v.URL, resp.Status)
+}
+
+// validateRecipient returns the reply to reject or defer the recipient by
+// the RecipientValidator, if any.
+func validateRecipient(conn *SMTPConnection, rcpt Address) string {
+	v := conn.Config().RecipientValidator
+	if v == nil {
+		return ""
+	}
+	verdict, err := v.ValidateRecipient(context.Background(), conn.State(), rcpt)
+	if err != nil {
+		conn.Logger().Warn("recipient not validated", "rcpt", conn.Config().Privacy.Address(rcpt.String()), "error", err.Error())
+		verdict = RecipientDefer
+	}
+	switch verdict {
+	case RecipientReject:
+		return conn.Config().Catalog.Reply("rcpt.unknown")
+	case RecipientDefer:
+		return conn.Config().Catalog.Reply("rcpt.verify_failed")
+	}
+	return ""
+}
@@ -0,0 +1,65 @@
+package smtp
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRecipientValidator(t *testing.T) {
+	conn := NewMockConn([]byte("EHLO localhost\r\n" +
+		"MAIL FROM: <foo@example.net>\r\n" +
+		"RCPT TO: <user1@example.com>\r\n" +
+		"RCPT TO: <unknown@example.com>\r\n" +
+		"RCPT TO: <busy@example.com>\r\n" +
+		"QUIT\r\n"))
+	h := NewSMTPHandler(conn, nil)
+	h.Config.RecipientValidator = RecipientValidatorFunc(func(ctx context.Context, st *SMTPState, rcpt Address) (RecipientVerdict, error) {
+		switch rcpt.LocalPart {
+		case "unknown":
+			return RecipientReject, nil
+		case "busy":
+			return RecipientDefer, nil
+		}
+		return RecipientAccept, nil
+	})
+	h.Run()
+	expected := "220 250 250 250 550 451 221"
+	if actual := replyCodes(conn.CloneOutputBuffer()); actual != expected {
+		t.Errorf("expected: %s, actual: %s", expected, actual)
+	}
+}
+
+func TestHTTPRecipientValidator(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("from") != "foo@example.net" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		switch r.URL.Query().Get("rcpt") {
+		case "user1@example.com":
+		case "user2@example.com":
+			w.WriteHeader(http.StatusNotFound)
+		default:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+	v := NewHTTPRecipientValidator(server.URL + "/rcpt?key=1")
+	st := &SMTPState{ReturnTo: "foo@example.net"}
+	for _, x := range []struct {
+		local    string
+		expected RecipientVerdict
+		err      bool
+	}{
+		{"user1", RecipientAccept, false},
+		{"user2", RecipientReject, false},
+		{"user3", RecipientDefer, true},
+	} {
+		verdict, err := v.ValidateRecipient(context.Background(), st, Address{x.local, "example.com"})
+		if verdict != x.expected || (err != nil) != x.err {
+			t.Errorf("%s expected: %d, actual: %d, %v", x.local, x.expected, verdict, err)
+		}
+	}
+}
@@ -0,0 +1,668 @@
+package smtp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	netsmtp "net/smtp"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// Router maps recipient domains to upstream relays. A route for
+// ".example.net" matches every subdomain of example.net. The upstream "mx"
+// delivers to the MX hosts of the recipient domain.
+type Router struct {
+	Default   string
+	HelloName string
+
+	// Resolver looks up MX hosts. It defaults to net.DefaultResolver.
+	Resolver Resolver
+
+	// MXPort is the port of MX hosts, 25 by default.
+	MXPort string
+
+	// TLSConfig is used for STARTTLS to MX hosts, which is opportunistic
+	// unless required by the MTA-STS policy of the domain. Other upstreams
+	// are relayed with STARTTLS if offered when it is set.
+	TLSConfig *tls.Config
+
+	// MTASTS enforces MTA-STS policies of the domains if non-nil.
+	MTASTS *MTASTSCache
+
+	// DANE authenticates MX hosts with their TLSA records if non-nil,
+	// taking precedence over MTA-STS.
+	DANE *DANE
+
+	// XForward sends the attributes of the client with XFORWARD to
+	// upstreams other than MX hosts which offer it, e.g. Postfix.
+	XForward bool
+
+	// ProxyProtocol is the version of the PROXY protocol header carrying
+	// the client address sent to upstreams other than MX hosts, 1 or 2. It
+	// is not sent if zero.
+	ProxyProtocol int
+
+	// Throttle limits the deliveries per destination domain if non-nil.
+	Throttle *Throttle
+
+	// SourceAddr is the local address of the connections to upstreams,
+	// an IP address or the name of a network interface, unless the route
+	// has its own. The system chooses one if empty.
+	SourceAddr string
+
+	// Proxy is the SOCKS5 or HTTP CONNECT proxy to connect to upstreams
+	// through if non-nil. See ParseDialProxy.
+	Proxy *url.URL
+
+	// Dialer connects to upstreams and proxies. It defaults to
+	// DefaultDialer.
+	Dialer *Dialer
+
+	routes  map[string]string
+	sources map[string]string
+	auths   map[string]*UpstreamAuth
+}
+
+// Delivery is the recipients relayed to an upstream from the source
+// address.
+type Delivery struct {
+	Upstream   string
+	Source     string
+	Recipients []string
+}
+
+func NewRouter(def string) *Router {
+	return &Router{
+		Default:   def,
+		HelloName: "localhost",
+		routes:    make(map[string]string),
+		sources:   make(map[string]string),
+	}
+}
+
+func (r *Router) Add(domain, upstream string) {
+	r.routes[strings.ToLower(domain)] = upstream
+}
+
+// SetSource sets the source address of the route for the domain. See
+// SourceAddr.
+func (r *Router) SetSource(domain, source string) {
+	r.sources[strings.ToLower(domain)] = source
+}
+
+// match returns the key of the route for the domain.
+func (r *Router) match(domain string) (string, bool) {
+	domain = strings.ToLower(domain)
+	if _, ok := r.routes[domain]; ok {
+		return domain, true
+	}
+	for {
+		i := strings.IndexByte(domain, '.')
+		if i < 0 {
+			break
+		}
+		domain = domain[i+1:]
+		if _, ok := r.routes["."+domain]; ok {
+			return "." + domain, true
+		}
+	}
+	return "", false
+}
+
+// Route returns the upstream for the domain, or an empty string if there
+// is neither a matching route nor a default one.
+func (r *Router) Route(domain string) string {
+	if key, ok := r.match(domain); ok {
+		return r.routes[key]
+	}
+	return r.Default
+}
+
+// Source returns the source address of the connections for the domain.
+func (r *Router) Source(domain string) string {
+	if key, ok := r.match(domain); ok {
+		if x, ok := r.sources[key]; ok {
+			return x
+		}
+	}
+	return r.SourceAddr
+}
+
+// Split groups the recipients of the transaction by upstream, Route of
+// the transaction if set, and source address in the order of their first
+// appearance.
+func (r *Router) Split(st *SMTPState) ([]Delivery, error) {
+	deliveries := make([]Delivery, 0)
+	indexes := make(map[string]int)
+	for i, x := range st.Recipients {
+		domain := ""
+		if i < len(st.RecipientAddresses) {
+			domain = st.RecipientAddresses[i].Domain
+		} else if j := strings.LastIndex(x, "@"); j >= 0 {
+			domain = x[j+1:]
+		}
+		upstream := st.Route
+		if len(upstream) == 0 {
+			upstream = r.Route(domain)
+		}
+		if len(upstream) == 0 {
+			return nil, fmt.Errorf("smtp: no route for %s", x)
+		}
+		if upstream == "mx" {
+			upstream = "mx:" + strings.ToLower(domain)
+		}
+		source := r.Source(domain)
+		j, ok := indexes[upstream+" "+source]
+		if !ok {
+			j = len(deliveries)
+			indexes[upstream+" "+source] = j
+			deliveries = append(deliveries, Delivery{Upstream: upstream, Source: source})
+		}
+		deliveries[j].Recipients = append(deliveries[j].Recipients, x)
+	}
+	return deliveries, nil
+}
+
+// Send relays the message to the upstream of each recipient. It can be
+// used as SMTPHandler.Send. If some upstreams fail only, the error is
+// RecipientErrors, so that the recipients accepted by the others are not
+// retried.
+func (r *Router) Send(st *SMTPState) error {
+	deliveries, err := r.Split(st)
+	if err != nil {
+		return err
+	}
+	errs := make(RecipientErrors)
+	var first error
+	for _, d := range deliveries {
+		if err := r.deliver(d, st); err != nil {
+			for _, x := range d.Recipients {
+				errs[x] = err
+			}
+			if first == nil {
+				first = err
+			}
+		}
+	}
+	if len(errs) == len(st.Recipients) {
+		return first
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func (r *Router) deliver(d Delivery, st *SMTPState) error {
+	if r.Throttle != nil {
+		release, err := r.Throttle.acquireAll(d.Recipients)
+		if err != nil {
+			return err
+		}
+		defer release()
+	}
+	span := st.span.child("smtp.relay", spanKindClient)
+	span.SetAttribute("server.address", d.Upstream)
+	span.SetAttribute("smtp.rcpt_to", d.Recipients)
+	var err error
+	if strings.HasPrefix(d.Upstream, "mx:") {
+		err = r.deliverMX(d.Upstream[3:], d.Source, st, d.Recipients)
+	} else {
+		err = r.relayUpstream(d.Upstream, d.Source, st, d.Recipients)
+	}
+	span.Finish(err)
+	return err
+}
+
+func (r *Router) dialer() *Dialer {
+	if r.Dialer != nil {
+		return r.Dialer
+	}
+	return DefaultDialer
+}
+
+// dial connects to the address from the source address, through Proxy
+// if set.
+func (r *Router) dial(addr, source string) (net.Conn, error) {
+	if r.Proxy == nil {
+		return r.dialer().Dial(addr, source)
+	}
+	conn, err := r.dialer().Dial(r.Proxy.Host, source)
+	if err != nil {
+		return nil, err
+	}
+	pconn, err := proxyConnect(conn, r.Proxy, addr, r.dialer().Timeout)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return pconn, nil
+}
+
+// dialIPs connects to one of the addresses of a host, and returns the
+// connection and the address.
+func (r *Router) dialIPs(ips []net.IP, port, source string) (net.Conn, net.IP, error) {
+	if r.Proxy == nil {
+		return r.dialer().dialIPs(ips, port, source)
+	}
+	primary, fallback := r.dialer().order(ips)
+	err := fmt.Errorf("smtp: no %s address in %v", r.dialer().Family, ips)
+	for _, ip := range append(primary, fallback...) {
+		var conn net.Conn
+		if conn, err = r.dial(net.JoinHostPort(ip.String(), port), source); err == nil {
+			return conn, ip, nil
+		}
+	}
+	return nil, nil, err
+}
+
+// sourceIP returns the IP address of the source, or the first address of
+// the network interface of the name in the family of the remote address,
+// IPv4 if unknown.
+func sourceIP(source string, remote net.IP) (net.IP, error) {
+	if ip := net.ParseIP(source); ip != nil {
+		return ip, nil
+	}
+	ifi, err := net.InterfaceByName(source)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := ifi.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	v4 := remote == nil || remote.To4() != nil
+	for _, x := range addrs {
+		if ipnet, ok := x.(*net.IPNet); ok && (ipnet.IP.To4() != nil) == v4 {
+			return ipnet.IP, nil
+		}
+	}
+	return nil, fmt.Errorf("smtp: no address of %s for %s", source, remote)
+}
+
+// relayUpstream relays the message to the upstream, with STARTTLS if
+// offered and TLSConfig is set, or if required, verifying the certificate
+// for its host name, authenticating with the credentials set by SetAuth.
+func (r *Router) relayUpstream(addr, source string, st *SMTPState, recipients []string) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	conn, err := r.dial(addr, source)
+	if err != nil {
+		return err
+	}
+	if r.ProxyProtocol > 0 {
+		src, dst := parseTCPAddr(st.RemoteAddr), parseTCPAddr(st.LocalAddr)
+		if err := WriteProxyHeader(conn, r.ProxyProtocol, src, dst); err != nil {
+			conn.Close()
+			return err
+		}
+	}
+	c, err := netsmtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	var tlsConfig *tls.Config
+	if st.RequireTLS || r.TLSConfig != nil {
+		tlsConfig = &tls.Config{}
+		if r.TLSConfig != nil {
+			tlsConfig = r.TLSConfig.Clone()
+		}
+		tlsConfig.ServerName = host
+	}
+	return relay(c, r.HelloName, st, recipients, tlsConfig, st.RequireTLS, r.XForward, r.auths[addr])
+}
+
+func (r *Router) resolver() Resolver {
+	if r.Resolver != nil {
+		return r.Resolver
+	}
+	return net.DefaultResolver
+}
+
+// lookupMX returns the MX hosts of the domain in order of preference, or
+// the domain itself if it has none (RFC 5321 section 5.1).
+func (r *Router) lookupMX(ctx context.Context, domain string) ([]string, error) {
+	mxs, err := r.resolver().LookupMX(ctx, domain)
+	if err != nil && !isNotFound(err) {
+		return nil, err
+	}
+	if len(mxs) == 0 {
+		return []string{domain}, nil
+	}
+	sort.SliceStable(mxs, func(i, j int) bool { return mxs[i].Pref < mxs[j].Pref })
+	hosts := make([]string, 0, len(mxs))
+	for _, mx := range mxs {
+		hosts = append(hosts, strings.TrimSuffix(mx.Host, "."))
+	}
+	return hosts, nil
+}
+
+// deliverMX delivers the message to the first MX host of the domain which
+// accepts it. Under an MTA-STS policy in enforce mode, only the hosts
+// matching the policy are tried, and only over TLS with a valid
+// certificate. A host with secure TLSA records is only tried over TLS
+// authenticated with them. A message with "TLS-Required: No" ignores
+// both, and one sent with REQUIRETLS needs either of them.
+func (r *Router) deliverMX(domain, source string, st *SMTPState, recipients []string) error {
+	ctx := context.Background()
+	hosts, err := r.lookupMX(ctx, domain)
+	if err != nil {
+		return err
+	}
+	var policy *MTASTSPolicy
+	if r.MTASTS != nil && !st.TLSOptional {
+		policy = r.MTASTS.Policy(ctx, domain)
+	}
+	enforce := policy != nil && policy.Mode == "enforce"
+	port := r.MXPort
+	if len(port) == 0 {
+		port = "25"
+	}
+	err = fmt.Errorf("smtp: no MX host of %s permitted by the MTA-STS policy", domain)
+	for _, host := range hosts {
+		if enforce && !policy.Match(host) {
+			continue
+		}
+		tlsConfig := &tls.Config{}
+		if r.TLSConfig != nil {
+			tlsConfig = r.TLSConfig.Clone()
+		}
+		tlsConfig.ServerName = host
+		tlsConfig.InsecureSkipVerify = !enforce && !st.RequireTLS
+		requireTLS := enforce || st.RequireTLS
+		authenticated := enforce
+		if r.DANE != nil && !st.TLSOptional {
+			var records []TLSARecord
+			if records, err = r.DANE.lookup(ctx, host, port); err != nil {
+				continue
+			}
+			if len(records) > 0 {
+				r.DANE.configure(tlsConfig, records)
+				requireTLS = true
+				authenticated = true
+			}
+		}
+		if st.RequireTLS && !authenticated {
+			// RFC 8689 section 4.2.1
+			err = fmt.Errorf("%w: %s is not authenticated with MTA-STS or DANE", ErrRequireTLS, host)
+			continue
+		}
+		if err = r.relayHost(ctx, host, port, source, st, recipients, tlsConfig, requireTLS); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+func (r *Router) relayHost(ctx context.Context, host, port, source string, st *SMTPState,
+	recipients []string, tlsConfig *tls.Config, requireTLS bool) error {
+	ips, err := r.resolver().LookupIP(ctx, "ip4", host)
+	if err != nil && !isNotFound(err) {
+		return err
+	}
+	ip6s, err := r.resolver().LookupIP(ctx, "ip6", host)
+	if err != nil && !isNotFound(err) {
+		return err
+	}
+	ips = append(ips, ip6s...)
+	if len(ips) == 0 {
+		return fmt.Errorf("smtp: no address for %s", host)
+	}
+	for len(ips) > 0 {
+		conn, ip, err := r.dialIPs(ips, port, source)
+		if err != nil {
+			return err
+		}
+		// try the others if the host fails to greet
+		xs := make([]net.IP, 0, len(ips))
+		for _, x := range ips {
+			if !x.Equal(ip) {
+				xs = append(xs, x)
+			}
+		}
+		ips = xs
+		c, err := netsmtp.NewClient(conn, host)
+		if err != nil {
+			conn.Close()
+			if len(ips) == 0 {
+				return err
+			}
+			continue
+		}
+		return relay(c, r.HelloName, st, recipients, tlsConfig, requireTLS, false, nil)
+	}
+	return err
+}
+
+// messageReader returns a reader of the message with the Headers. The
+// header section is written as received when the Headers have only been
+// prepended to, e.g. with Received, so that it keeps its exact bytes.
+func (st *SMTPState) messageReader() io.Reader {
+	var b bytes.Buffer
+	if n := len(st.Headers) - len(st.rawHeaderLines); st.rawHeader != nil && n >= 0 &&
+		equalStrings(st.Headers[n:], st.rawHeaderLines) {
+		for _, x := range st.Headers[:n] {
+			b.WriteString(x)
+			b.WriteString("\r\n")
+		}
+		return io.MultiReader(&b, bytes.NewReader(st.rawHeader), st.Content())
+	}
+	for _, x := range st.Headers {
+		b.WriteString(x)
+		b.WriteString("\r\n")
+	}
+	b.WriteString("\r\n")
+	return io.MultiReader(&b, st.Content())
+}
+
+// Relay delivers the message of the transaction to the recipients through
+// the upstream server at addr.
+func Relay(addr, helloName string, st *SMTPState, recipients []string) error {
+	c, err := netsmtp.Dial(addr)
+	if err != nil {
+		return err
+	}
+	return relay(c, helloName, st, recipients, nil, false, false, nil)
+}
+
+// relay sends the message through the client, upgrading the connection
+// with STARTTLS if tlsConfig is non-nil and the server offers it. A
+// message sent with REQUIRETLS fails with ErrRequireTLS unless the
+// server supports it over TLS. The attributes of the client are sent with
+// XFORWARD if forward is set and the server offers it. The client
+// authenticates with auth if non-nil.
+func relay(c *netsmtp.Client, helloName string, st *SMTPState, recipients []string,
+	tlsConfig *tls.Config, requireTLS, forward bool, auth *UpstreamAuth) error {
+	defer c.Close()
+	if err := c.Hello(helloName); err != nil {
+		return err
+	}
+	tlsErr := func(err error) error {
+		if st.RequireTLS {
+			return fmt.Errorf("%w: %v", ErrRequireTLS, err)
+		}
+		return err
+	}
+	if tlsConfig != nil {
+		if ok, _ := c.Extension("STARTTLS"); ok {
+			if err := c.StartTLS(tlsConfig); err != nil {
+				return tlsErr(err)
+			}
+		} else if requireTLS {
+			return tlsErr(fmt.Errorf("smtp: %s does not offer STARTTLS", tlsConfig.ServerName))
+		}
+	}
+	if auth != nil {
+		if err := c.Auth(auth); err != nil {
+			return err
+		}
+	}
+	if forward {
+		if err := xforward(c, st); err != nil {
+			return err
+		}
+	}
+	if err := transaction(c, st, recipients, auth.identityParam(c, st)); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// transaction sends the message to the recipients through the client
+// which has greeted the server, with the MAIL parameters added.
+func transaction(c *netsmtp.Client, st *SMTPState, recipients []string, params string) error {
+	if st.RequireTLS {
+		if ok, _ := c.Extension("REQUIRETLS"); !ok {
+			return fmt.Errorf("%w: smtp: upstream does not support REQUIRETLS", ErrRequireTLS)
+		}
+		params += " REQUIRETLS"
+	}
+	if st.Priority != 0 {
+		if ok, _ := c.Extension("MT-PRIORITY"); ok {
+			params += fmt.Sprintf(" MT-PRIORITY=%d", st.Priority)
+		}
+	}
+	if len(st.ByMode) > 0 {
+		now := clockNow(st.clock)
+		if st.deliverByExpired(now) {
+			return ErrDeliverBy
+		}
+		if ok, _ := c.Extension("DELIVERBY"); ok {
+			params += " BY=" + st.deliverByParam(now)
+		}
+	}
+	if st.SMTPUTF8 {
+		if ok, _ := c.Extension("SMTPUTF8"); !ok {
+			return fmt.Errorf("%w: smtp: upstream does not support SMTPUTF8", ErrSMTPUTF8)
+		}
+		params += " SMTPUTF8"
+	}
+	dsn, _ := c.Extension("DSN")
+	if dsn {
+		if len(st.Ret) > 0 {
+			params += " RET=" + st.Ret
+		}
+		if len(st.EnvID) > 0 {
+			params += " ENVID=" + st.EnvID
+		}
+	}
+	if len(params) > 0 {
+		if err := mailWithParams(c, st.ReturnTo, params); err != nil {
+			return err
+		}
+	} else if err := c.Mail(st.ReturnTo); err != nil {
+		return err
+	}
+	for _, x := range recipients {
+		params := ""
+		if dsn {
+			params = st.recipientDSN(x).String()
+		}
+		if len(params) > 0 {
+			if err := rcptWithParams(c, x, params); err != nil {
+				return err
+			}
+		} else if err := c.Rcpt(x); err != nil {
+			return err
+		}
+		if dsn {
+			st.dsnRelayed = append(st.dsnRelayed, x)
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, st.messageReader()); err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+// mailWithParams sends MAIL with parameters net/smtp does not support,
+// such as REQUIRETLS, MT-PRIORITY, BY, RET and ENVID, and SMTPUTF8 with
+// them.
+func mailWithParams(c *netsmtp.Client, from, params string) error {
+	if ok, _ := c.Extension("8BITMIME"); ok {
+		params += " BODY=8BITMIME"
+	}
+	id, err := c.Text.Cmd("MAIL FROM:<%s>%s", from, params)
+	if err != nil {
+		return err
+	}
+	c.Text.StartResponse(id)
+	defer c.Text.EndResponse(id)
+	_, _, err = c.Text.ReadResponse(250)
+	return err
+}
+
+// rcptWithParams sends RCPT with the DSN parameters net/smtp does not
+// support.
+func rcptWithParams(c *netsmtp.Client, to, params string) error {
+	id, err := c.Text.Cmd("RCPT TO:<%s>%s", to, params)
+	if err != nil {
+		return err
+	}
+	c.Text.StartResponse(id)
+	defer c.Text.EndResponse(id)
+	_, _, err = c.Text.ReadResponse(25)
+	return err
+}
+
+// ParseRoutes reads routes in the form of "domain upstream [source=addr]",
+// one per line. The domain "*" sets the default route. The source is the
+// local IP address or network interface of the connections.
+//
+//	example.net   mx1:25
+//	.example.org  mx source=192.0.2.10
+//	*             default:25 source=eth1
+func ParseRoutes(r io.Reader, router *Router) error {
+	scanner := bufio.NewScanner(r)
+	n := 0
+	for scanner.Scan() {
+		n++
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		xs := strings.Fields(line)
+		if len(xs) != 2 && (len(xs) != 3 || !strings.HasPrefix(xs[2], "source=")) {
+			return fmt.Errorf("line %d: expected \"domain upstream [source=addr]\"", n)
+		}
+		if xs[0] == "*" {
+			router.Default = xs[1]
+		} else {
+			router.Add(xs[0], xs[1])
+		}
+		if len(xs) == 3 {
+			source := strings.TrimPrefix(xs[2], "source=")
+			if xs[0] == "*" {
+				router.SourceAddr = source
+			} else {
+				router.SetSource(xs[0], source)
+			}
+		}
+	}
+	return scanner.Err()
+}
+
+func equalStrings(xs, ys []string) bool {
+	if len(xs) != len(ys) {
+		return false
+	}
+	for i := range xs {
+		if xs[i] != ys[i] {
+			return false
+		}
+	}
+	return true
+}
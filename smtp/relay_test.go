@@ -0,0 +1,405 @@
+package smtp
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCertificate returns a self-signed certificate of the hosts and a
+// pool trusting it.
+func testCertificate(t *testing.T, hosts ...string) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: hosts[0]},
+		DNSNames:              hosts,
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, _ := x509.ParseCertificate(der)
+	pool := x509.NewCertPool()
+	pool.AddCert(leaf)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, pool
+}
+
+// serveUpstream accepts a connection on the listener as an upstream server,
+// offering STARTTLS if cert is non-nil and the extensions over TLS, or
+// without TLS if cert is nil, and
+// sends the transcript of the transaction once the connection is closed.
+func serveUpstream(lsnr net.Listener, cert *tls.Certificate, exts ...string) <-chan string {
+	received := make(chan string, 1)
+	go func() {
+		transcript := ""
+		defer func() { received <- transcript }()
+		conn, err := lsnr.Accept()
+		if err != nil {
+			return
+		}
+		tc := textproto.NewConn(conn)
+		defer func() { tc.Close() }()
+		tc.PrintfLine("220 localhost")
+		secure := false
+		for {
+			line, err := tc.ReadLine()
+			if err != nil {
+				return
+			}
+			switch strings.Fields(line)[0] {
+			case "EHLO":
+				tc.PrintfLine("250-localhost")
+				if secure || cert == nil {
+					for _, x := range exts {
+						tc.PrintfLine("250-%s", x)
+					}
+				} else if cert != nil {
+					tc.PrintfLine("250-STARTTLS")
+				}
+				tc.PrintfLine("250 HELP")
+			case "STARTTLS":
+				tc.PrintfLine("220 Ready to start TLS")
+				tlsConn := tls.Server(conn, &tls.Config{Certificates: []tls.Certificate{*cert}})
+				if err := tlsConn.Handshake(); err != nil {
+					transcript += "TLS failed\r\n"
+					return
+				}
+				transcript += "TLS\r\n"
+				tc = textproto.NewConn(tlsConn)
+				secure = true
+			case "DATA":
+				tc.PrintfLine("354 Go ahead")
+				lines, _ := tc.ReadDotLines()
+				transcript += "DATA\r\n" + strings.Join(lines, "\r\n") + "\r\n"
+				tc.PrintfLine("250 OK")
+			case "QUIT":
+				tc.PrintfLine("221 Bye")
+				return
+			default:
+				transcript += line + "\r\n"
+				tc.PrintfLine("250 OK")
+			}
+		}
+	}()
+	return received
+}
+
+func TestRouterSplit(t *testing.T) {
+	router := NewRouter("")
+	err := ParseRoutes(strings.NewReader(
+		"# internal mail systems\n"+
+			"example.net mx1:25\n"+
+			".example.org mx2:25\n"+
+			"* default:25\n"), router)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := &SMTPState{Recipients: []string{
+		"user1@example.net",
+		"user2@sub.example.org",
+		"user3@example.com",
+		"user4@EXAMPLE.NET",
+	}}
+	deliveries, err := router.Split(st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "mx1:25 [user1@example.net user4@EXAMPLE.NET]," +
+		" mx2:25 [user2@sub.example.org], default:25 [user3@example.com]"
+	xs := make([]string, len(deliveries))
+	for i, d := range deliveries {
+		xs[i] = fmt.Sprintf("%s %s", d.Upstream, d.Recipients)
+	}
+	if actual := strings.Join(xs, ", "); actual != expected {
+		t.Errorf("expected: %s, actual: %s", expected, actual)
+	}
+
+	router.Default = ""
+	if _, err := router.Split(st); err == nil {
+		t.Errorf("expected an error for an unroutable recipient")
+	}
+}
+
+func TestRouterSource(t *testing.T) {
+	router := NewRouter("")
+	err := ParseRoutes(strings.NewReader(
+		"example.net mx1:25 source=192.0.2.10\n"+
+			".example.org mx1:25\n"+
+			"* default:25 source=eth1\n"), router)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := &SMTPState{Recipients: []string{"user1@example.net", "user2@sub.example.org", "user3@example.com"}}
+	deliveries, err := router.Split(st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "[{mx1:25 192.0.2.10 [user1@example.net]} {mx1:25 eth1 [user2@sub.example.org]}" +
+		" {default:25 eth1 [user3@example.com]}]"
+	if actual := fmt.Sprint(deliveries); actual != expected {
+		t.Errorf("expected: %s, actual: %s", expected, actual)
+	}
+	if err := ParseRoutes(strings.NewReader("example.net mx1:25 eth1\n"), router); err == nil {
+		t.Errorf("expected an error for an unknown option")
+	}
+
+	lsnr, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip(err)
+	}
+	defer lsnr.Close()
+	accepted := make(chan string, 1)
+	go func() {
+		conn, err := lsnr.Accept()
+		if err != nil {
+			close(accepted)
+			return
+		}
+		host, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+		accepted <- host
+		conn.Close()
+	}()
+	conn, err := router.dial(lsnr.Addr().String(), "127.0.0.2")
+	if err != nil {
+		t.Skip(err)
+	}
+	conn.Close()
+	if actual := <-accepted; actual != "127.0.0.2" {
+		t.Errorf("expected: 127.0.0.2, actual: %s", actual)
+	}
+}
+
+func TestRelay(t *testing.T) {
+	lsnr, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip(err)
+	}
+	defer lsnr.Close()
+	received := make(chan string, 1)
+	go func() {
+		conn, err := lsnr.Accept()
+		if err != nil {
+			return
+		}
+		tc := textproto.NewConn(conn)
+		defer tc.Close()
+		tc.PrintfLine("220 localhost")
+		transcript := ""
+		for {
+			line, err := tc.ReadLine()
+			if err != nil {
+				return
+			}
+			switch strings.Fields(line)[0] {
+			case "DATA":
+				tc.PrintfLine("354 Go ahead")
+				lines, _ := tc.ReadDotLines()
+				transcript += "DATA\r\n" + strings.Join(lines, "\r\n") + "\r\n"
+				tc.PrintfLine("250 OK")
+			case "QUIT":
+				tc.PrintfLine("221 Bye")
+				received <- transcript
+				return
+			case "EHLO":
+				tc.PrintfLine("250 localhost")
+			default:
+				transcript += line + "\r\n"
+				tc.PrintfLine("250 OK")
+			}
+		}
+	}()
+
+	st := &SMTPState{
+		ReturnTo:   "foo@example.net",
+		Recipients: []string{"user1@example.net"},
+		Headers:    []string{"Subject: Relay"},
+	}
+	st.SetContent([]byte("Relayed\r\n"))
+	if err := Relay(lsnr.Addr().String(), "localhost", st, st.Recipients); err != nil {
+		t.Fatal(err)
+	}
+	expected := "MAIL FROM:<foo@example.net>\r\n" +
+		"RCPT TO:<user1@example.net>\r\n" +
+		"DATA\r\n" +
+		"Subject: Relay\r\n" +
+		"\r\n" +
+		"Relayed\r\n"
+	if actual := <-received; actual != expected {
+		t.Errorf("expected: %s, actual: %s", expected, actual)
+	}
+}
+
+func TestRelayMTPriority(t *testing.T) {
+	for _, exts := range [][]string{{"MT-PRIORITY"}, nil} {
+		lsnr, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Skip(err)
+		}
+		received := serveUpstream(lsnr, nil, exts...)
+		st := &SMTPState{
+			ReturnTo:   "foo@example.net",
+			Recipients: []string{"user1@example.net"},
+			Priority:   -2,
+		}
+		st.SetContent([]byte("Relayed\r\n"))
+		if err := Relay(lsnr.Addr().String(), "localhost", st, st.Recipients); err != nil {
+			t.Fatal(err)
+		}
+		expected := "MAIL FROM:<foo@example.net>\r\n"
+		if len(exts) > 0 {
+			expected = "MAIL FROM:<foo@example.net> MT-PRIORITY=-2\r\n"
+		}
+		if actual := <-received; !strings.HasPrefix(actual, expected) {
+			t.Errorf("expected: %s, actual: %s", expected, actual)
+		}
+		lsnr.Close()
+	}
+}
+
+func TestRelaySMTPUTF8(t *testing.T) {
+	lsnr, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip(err)
+	}
+	defer lsnr.Close()
+	received := serveUpstream(lsnr, nil, "SMTPUTF8", "MT-PRIORITY")
+	st := &SMTPState{
+		ReturnTo:   "foo@example.net",
+		Recipients: []string{"user1@example.net"},
+		Priority:   2,
+		SMTPUTF8:   true,
+	}
+	st.SetContent([]byte("Relayed\r\n"))
+	if err := Relay(lsnr.Addr().String(), "localhost", st, st.Recipients); err != nil {
+		t.Fatal(err)
+	}
+	expected := "MAIL FROM:<foo@example.net> MT-PRIORITY=2 SMTPUTF8\r\n"
+	if actual := <-received; !strings.HasPrefix(actual, expected) {
+		t.Errorf("expected: %s, actual: %s", expected, actual)
+	}
+
+	serveUpstream(lsnr, nil)
+	if err := Relay(lsnr.Addr().String(), "localhost", st, st.Recipients); !errors.Is(err, ErrSMTPUTF8) {
+		t.Errorf("expected: %v, actual: %v", ErrSMTPUTF8, err)
+	}
+	if !isPermanent(ErrSMTPUTF8) {
+		t.Errorf("expected %v to be permanent", ErrSMTPUTF8)
+	}
+}
+
+func TestRelayDSN(t *testing.T) {
+	for _, exts := range [][]string{{"DSN"}, nil} {
+		lsnr, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Skip(err)
+		}
+		received := serveUpstream(lsnr, nil, exts...)
+		st := &SMTPState{
+			ReturnTo:   "foo@example.net",
+			Recipients: []string{"user1@example.net", "user2@example.net"},
+			RecipientDSNs: []RecipientDSN{
+				{Notify: []string{"FAILURE", "DELAY"}, ORcpt: "rfc822;bar@example.org"},
+				{},
+			},
+			Ret:   "HDRS",
+			EnvID: "QQ314159",
+		}
+		st.SetContent([]byte("Relayed\r\n"))
+		if err := Relay(lsnr.Addr().String(), "localhost", st, st.Recipients); err != nil {
+			t.Fatal(err)
+		}
+		expected := "MAIL FROM:<foo@example.net>\r\n" +
+			"RCPT TO:<user1@example.net>\r\n" +
+			"RCPT TO:<user2@example.net>\r\n"
+		if len(exts) > 0 {
+			expected = "MAIL FROM:<foo@example.net> RET=HDRS ENVID=QQ314159\r\n" +
+				"RCPT TO:<user1@example.net> NOTIFY=FAILURE,DELAY ORCPT=rfc822;bar@example.org\r\n" +
+				"RCPT TO:<user2@example.net>\r\n"
+		}
+		if actual := <-received; !strings.HasPrefix(actual, expected) {
+			t.Errorf("expected: %s, actual: %s", expected, actual)
+		}
+		lsnr.Close()
+	}
+}
+
+func TestRelayDeliverBy(t *testing.T) {
+	lsnr, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip(err)
+	}
+	defer lsnr.Close()
+	received := serveUpstream(lsnr, nil, "DELIVERBY")
+	st := &SMTPState{
+		ReturnTo:   "foo@example.net",
+		Recipients: []string{"user1@example.net"},
+		DeliverBy:  time.Now().Add(time.Hour + time.Second),
+		ByMode:     "RT",
+	}
+	st.SetContent([]byte("Relayed\r\n"))
+	if err := Relay(lsnr.Addr().String(), "localhost", st, st.Recipients); err != nil {
+		t.Fatal(err)
+	}
+	expected := "MAIL FROM:<foo@example.net> BY=3600;RT\r\n"
+	if actual := <-received; !strings.HasPrefix(actual, expected) {
+		t.Errorf("expected: %s, actual: %s", expected, actual)
+	}
+
+	serveUpstream(lsnr, nil, "DELIVERBY")
+	st.DeliverBy = time.Now()
+	if err := Relay(lsnr.Addr().String(), "localhost", st, st.Recipients); !errors.Is(err, ErrDeliverBy) {
+		t.Errorf("expected: %v, actual: %v", ErrDeliverBy, err)
+	}
+}
+
+func TestRouterPartialFailure(t *testing.T) {
+	lsnr, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip(err)
+	}
+	defer lsnr.Close()
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip(err)
+	}
+	closed.Close()
+	router := NewRouter(closed.Addr().String())
+	router.Add("example.net", lsnr.Addr().String())
+	received := serveUpstream(lsnr, nil)
+	st := &SMTPState{ReturnTo: "foo@example.net", Recipients: []string{"user1@example.net", "user2@example.com"}}
+	st.SetContent([]byte("Hello\r\n"))
+	err = router.Send(st)
+	var errs RecipientErrors
+	if !errors.As(err, &errs) || len(errs) != 1 || errs["user2@example.com"] == nil {
+		t.Errorf("expected the error of user2@example.com only, actual: %v", err)
+	}
+	if actual := <-received; !strings.Contains(actual, "RCPT TO:<user1@example.net>\r\n") {
+		t.Errorf("expected the delivery to user1@example.net: %s", actual)
+	}
+
+	st.Recipients = []string{"user2@example.com"}
+	if err := router.Send(st); err == nil || errors.As(err, &errs) {
+		t.Errorf("expected the error of the only upstream, actual: %v", err)
+	}
+}
@@ -0,0 +1,61 @@
+package smtp
+
+// CaptureOnlyTag is the tag of the messages with recipients which are not
+// relayed by WithRelayAllowlist.
+const CaptureOnlyTag = "capture-only"
+
+// withRecipients returns a copy of the state with the recipients at the
+// indexes only.
+func (st *SMTPState) withRecipients(indexes ...int) *SMTPState {
+	x := *st
+	x.Recipients = make([]string, 0, len(indexes))
+	x.RecipientAddresses = make([]Address, 0, len(indexes))
+	x.RecipientParams = make([]ESMTPParams, 0, len(indexes))
+	x.RecipientDSNs = make([]RecipientDSN, 0, len(indexes))
+	x.RecipientMailboxes = make([]string, 0, len(indexes))
+	for _, i := range indexes {
+		x.Recipients = append(x.Recipients, st.Recipients[i])
+		if i < len(st.RecipientAddresses) {
+			x.RecipientAddresses = append(x.RecipientAddresses, st.RecipientAddresses[i])
+		}
+		if i < len(st.RecipientParams) {
+			x.RecipientParams = append(x.RecipientParams, st.RecipientParams[i])
+		}
+		if i < len(st.RecipientDSNs) {
+			x.RecipientDSNs = append(x.RecipientDSNs, st.RecipientDSNs[i])
+		}
+		if i < len(st.RecipientMailboxes) {
+			x.RecipientMailboxes = append(x.RecipientMailboxes, st.RecipientMailboxes[i])
+		}
+	}
+	return &x
+}
+
+// WithRelayAllowlist returns a Send function which calls send with the
+// recipients matching one of the glob patterns only, e.g.
+// "*@example.com", and not at all if none does. The other recipients are
+// left to the sinks after it, which capture the message with the
+// CaptureOnlyTag.
+func WithRelayAllowlist(send func(st *SMTPState) error, patterns []string) func(st *SMTPState) error {
+	return func(st *SMTPState) error {
+		allowed := make([]int, 0, len(st.Recipients))
+		for i, rcpt := range st.Recipients {
+			for _, x := range patterns {
+				if sieveMatch(":matches", rcpt, x) {
+					allowed = append(allowed, i)
+					break
+				}
+			}
+		}
+		if len(allowed) < len(st.Recipients) && !containsFold(st.Tags, CaptureOnlyTag) {
+			st.Tags = append(st.Tags, CaptureOnlyTag)
+		}
+		switch len(allowed) {
+		case 0:
+			return nil
+		case len(st.Recipients):
+			return send(st)
+		}
+		return send(st.withRecipients(allowed...))
+	}
+}
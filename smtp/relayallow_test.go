@@ -0,0 +1,32 @@
+package smtp
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestWithRelayAllowlist(t *testing.T) {
+	var relayed []string
+	send := WithRelayAllowlist(func(st *SMTPState) error {
+		relayed = append(relayed, strings.Join(st.Recipients, ","))
+		return nil
+	}, []string{"*@example.com", "qa-*@example.org"})
+
+	st := &SMTPState{Recipients: []string{"user1@example.com", "user2@example.org", "QA-1@example.org"}}
+	st.RecipientAddresses = []Address{{"user1", "example.com"}, {"user2", "example.org"}, {"QA-1", "example.org"}}
+	send(st)
+	send(&SMTPState{Recipients: []string{"user1@example.net"}})
+	allowed := &SMTPState{Recipients: []string{"user1@example.com"}}
+	send(allowed)
+
+	expected := "user1@example.com,QA-1@example.org|user1@example.com"
+	if actual := strings.Join(relayed, "|"); actual != expected {
+		t.Errorf("expected: %s, actual: %s", expected, actual)
+	}
+	if len(st.Recipients) != 3 || !containsFold(st.Tags, CaptureOnlyTag) {
+		t.Errorf("unexpected state: %v, %v", st.Recipients, st.Tags)
+	}
+	if containsFold(allowed.Tags, CaptureOnlyTag) {
+		t.Errorf("unexpected tag: %v", allowed.Tags)
+	}
+}
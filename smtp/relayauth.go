@@ -0,0 +1,121 @@
+package smtp
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	netsmtp "net/smtp"
+	"strings"
+)
+
+var errUnencryptedAuth = errors.New("smtp: unencrypted connection")
+
+// UpstreamAuth is the credentials to authenticate to an upstream with,
+// e.g. a smarthost requiring AUTH. It implements net/smtp.Auth.
+type UpstreamAuth struct {
+	// Mechanism is PLAIN, LOGIN or XOAUTH2.
+	Mechanism string
+	Username  string
+
+	// Secret is the password, or the OAuth 2.0 access token for XOAUTH2.
+	Secret string
+
+	// PassIdentity sends the user the client authenticated as with the
+	// AUTH parameter of MAIL (RFC 4954 section 5), or "<>" if none.
+	PassIdentity bool
+}
+
+// Start begins the authentication by the mechanism, refusing to send the
+// credentials in the clear except to localhost, as net/smtp.PlainAuth.
+func (a *UpstreamAuth) Start(server *netsmtp.ServerInfo) (string, []byte, error) {
+	if !server.TLS && server.Name != "localhost" && server.Name != "127.0.0.1" && server.Name != "::1" {
+		return "", nil, errUnencryptedAuth
+	}
+	offered := false
+	for _, x := range server.Auth {
+		offered = offered || strings.EqualFold(x, a.Mechanism)
+	}
+	if !offered {
+		return "", nil, fmt.Errorf("smtp: %s not offered by %s", a.Mechanism, server.Name)
+	}
+	switch a.Mechanism {
+	case "LOGIN":
+		return a.Mechanism, nil, nil
+	case "XOAUTH2":
+		return a.Mechanism, []byte("user=" + a.Username + "\x01auth=Bearer " + a.Secret + "\x01\x01"), nil
+	}
+	return a.Mechanism, []byte("\x00" + a.Username + "\x00" + a.Secret), nil
+}
+
+// Next answers the LOGIN prompts. The error challenge of XOAUTH2 is
+// answered with an empty response, so that the server fails the
+// authentication with its reply.
+func (a *UpstreamAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+	if a.Mechanism != "LOGIN" {
+		return []byte{}, nil
+	}
+	switch strings.ToLower(strings.TrimSpace(string(fromServer))) {
+	case "username:":
+		return []byte(a.Username), nil
+	case "password:":
+		return []byte(a.Secret), nil
+	}
+	return nil, fmt.Errorf("smtp: unexpected LOGIN challenge: %q", fromServer)
+}
+
+// identityParam returns the AUTH parameter of MAIL passing the identity
+// of the client.
+func (a *UpstreamAuth) identityParam(c *netsmtp.Client, st *SMTPState) string {
+	if a == nil || !a.PassIdentity {
+		return ""
+	}
+	if ok, _ := c.Extension("AUTH"); !ok {
+		return ""
+	}
+	if len(st.Username) == 0 {
+		return " AUTH=<>"
+	}
+	return " AUTH=" + encodeXText(st.Username)
+}
+
+// SetAuth sets the credentials of the upstream, as in the routes. MX hosts
+// are not authenticated to.
+func (r *Router) SetAuth(upstream string, a *UpstreamAuth) {
+	if r.auths == nil {
+		r.auths = make(map[string]*UpstreamAuth)
+	}
+	r.auths[upstream] = a
+}
+
+// ParseUpstreamAuth reads credentials in the form of "upstream mechanism
+// username secret [pass-identity]", one per line.
+//
+//	smtp.example.net:587  plain    relay@example.net  secret
+//	smtp.example.org:587  xoauth2  user@example.org   ya29.token  pass-identity
+func ParseUpstreamAuth(r io.Reader, router *Router) error {
+	scanner := bufio.NewScanner(r)
+	n := 0
+	for scanner.Scan() {
+		n++
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		xs := strings.Fields(line)
+		if len(xs) != 4 && (len(xs) != 5 || xs[4] != "pass-identity") {
+			return fmt.Errorf("line %d: expected \"upstream mechanism username secret [pass-identity]\"", n)
+		}
+		a := &UpstreamAuth{Mechanism: strings.ToUpper(xs[1]), Username: xs[2], Secret: xs[3], PassIdentity: len(xs) == 5}
+		switch a.Mechanism {
+		case "PLAIN", "LOGIN", "XOAUTH2":
+		default:
+			return fmt.Errorf("line %d: unsupported mechanism: %s", n, xs[1])
+		}
+		router.SetAuth(xs[0], a)
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,126 @@
+package smtp
+
+import (
+	"encoding/base64"
+	"net"
+	netsmtp "net/smtp"
+	"net/textproto"
+	"strings"
+	"testing"
+)
+
+// serveAuthUpstream accepts a session authenticated by LOGIN or PLAIN and
+// sends the commands received, with the LOGIN responses decoded.
+func serveAuthUpstream(lsnr net.Listener) <-chan string {
+	received := make(chan string, 1)
+	go func() {
+		transcript := ""
+		defer func() { received <- transcript }()
+		conn, err := lsnr.Accept()
+		if err != nil {
+			return
+		}
+		tc := textproto.NewConn(conn)
+		defer tc.Close()
+		tc.PrintfLine("220 localhost")
+		for {
+			line, err := tc.ReadLine()
+			if err != nil {
+				return
+			}
+			transcript += line + "\r\n"
+			switch strings.Fields(line)[0] {
+			case "EHLO":
+				tc.PrintfLine("250-localhost\r\n250 AUTH PLAIN LOGIN")
+			case "AUTH":
+				if strings.HasPrefix(line, "AUTH LOGIN") {
+					for _, x := range []string{"Username:", "Password:"} {
+						tc.PrintfLine("334 %s", base64.StdEncoding.EncodeToString([]byte(x)))
+						resp, _ := tc.ReadLine()
+						b, _ := base64.StdEncoding.DecodeString(resp)
+						transcript += string(b) + "\r\n"
+					}
+				}
+				tc.PrintfLine("235 2.7.0 Authentication successful")
+			case "DATA":
+				tc.PrintfLine("354 Go ahead")
+				tc.ReadDotLines()
+				tc.PrintfLine("250 OK")
+			case "QUIT":
+				tc.PrintfLine("221 Bye")
+				return
+			default:
+				tc.PrintfLine("250 OK")
+			}
+		}
+	}()
+	return received
+}
+
+func TestUpstreamAuth(t *testing.T) {
+	lsnr, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip(err)
+	}
+	defer lsnr.Close()
+	addr := lsnr.Addr().String()
+	router := NewRouter(addr)
+	if err := ParseUpstreamAuth(strings.NewReader("# smarthost\n"+
+		addr+" login relay@example.net secret pass-identity\n"), router); err != nil {
+		t.Fatal(err)
+	}
+	st := &SMTPState{ReturnTo: "foo@example.net", Recipients: []string{"user1@example.com"}, Username: "alice+test"}
+	st.SetContent([]byte("Hello\r\n"))
+	received := serveAuthUpstream(lsnr)
+	if err := router.Send(st); err != nil {
+		t.Fatal(err)
+	}
+	expected := "EHLO localhost\r\nAUTH LOGIN\r\nrelay@example.net\r\nsecret\r\nMAIL FROM:<foo@example.net> AUTH=alice+2Btest\r\n"
+	if actual := <-received; !strings.HasPrefix(actual, expected) {
+		t.Errorf("expected: %q, actual: %q", expected, actual)
+	}
+
+	// MX hosts and other upstreams are not authenticated to
+	router.SetAuth(addr, nil)
+	received = serveAuthUpstream(lsnr)
+	if err := router.Send(st); err != nil {
+		t.Fatal(err)
+	}
+	if actual := <-received; strings.Contains(actual, "AUTH") {
+		t.Errorf("unexpected AUTH: %q", actual)
+	}
+
+	for _, x := range []string{"smarthost:587 cram-md5 user secret", "smarthost:587 plain user", "smarthost:587 plain user secret yes"} {
+		if err := ParseUpstreamAuth(strings.NewReader(x), router); err == nil {
+			t.Errorf("expected an error: %s", x)
+		}
+	}
+}
+
+func TestUpstreamAuthMechanisms(t *testing.T) {
+	server := &netsmtp.ServerInfo{Name: "smtp.example.net", TLS: true, Auth: []string{"PLAIN", "XOAUTH2"}}
+	a := &UpstreamAuth{Mechanism: "XOAUTH2", Username: "user@example.net", Secret: "token"}
+	proto, resp, err := a.Start(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "user=user@example.net\x01auth=Bearer token\x01\x01"; proto != "XOAUTH2" || string(resp) != expected {
+		t.Errorf("expected: %q, actual: %s %q", expected, proto, resp)
+	}
+	if resp, err := a.Next([]byte(`{"status":"401"}`), true); err != nil || len(resp) != 0 {
+		t.Errorf("expected an empty response: %q, %v", resp, err)
+	}
+	a.Mechanism = "PLAIN"
+	if _, resp, _ := a.Start(server); string(resp) != "\x00user@example.net\x00token" {
+		t.Errorf("unexpected response: %q", resp)
+	}
+	a.Mechanism = "LOGIN"
+	if _, _, err := a.Start(server); err == nil {
+		t.Errorf("expected an error of the mechanism not offered")
+	}
+	server.TLS = false
+	a.Mechanism = "PLAIN"
+	if _, _, err := a.Start(server); err != errUnencryptedAuth {
+		t.Errorf("expected: %v, actual: %v", errUnencryptedAuth, err)
+	}
+}
@@ -0,0 +1,78 @@
+package smtp
+
+import (
+	"regexp"
+)
+
+var defaultEnhancedStatusCodes = map[string]string{
+	"214": "2.0.0",
+	"221": "2.0.0",
+	"235": "2.7.0",
+	"250": "2.0.0",
+	"251": "2.1.5",
+	"252": "2.1.5",
+	"421": "4.3.0",
+	"450": "4.2.0",
+	"451": "4.3.0",
+	"452": "4.3.1",
+	"454": "4.7.0",
+	"500": "5.5.2",
+	"501": "5.5.4",
+	"502": "5.5.1",
+	"503": "5.5.1",
+	"504": "5.5.4",
+	"530": "5.7.0",
+	"535": "5.7.8",
+	"538": "5.7.11",
+	"550": "5.0.0",
+	"551": "5.1.6",
+	"552": "5.3.4",
+	"553": "5.1.3",
+	"554": "5.0.0",
+	"555": "5.5.4",
+}
+
+var enhancedStatusCodePattern = regexp.MustCompile(`^[245]\.[0-9]{1,3}\.[0-9]{1,3}( |$)`)
+
+// withEnhancedStatusCode inserts the default RFC 3463 enhanced status code
+// for the reply code of the line, unless the line already has one.
+func withEnhancedStatusCode(line string) string {
+	if len(line) < 4 || (line[3] != ' ' && line[3] != '-') {
+		return line
+	}
+	code, text := line[:3], line[4:]
+	if hasEnhancedStatusCode(text) {
+		return line
+	}
+	ec, ok := defaultEnhancedStatusCodes[code]
+	if !ok {
+		return line
+	}
+	return code + line[3:4] + ec + " " + text
+}
+
+// hasEnhancedStatusCode is enhancedStatusCodePattern.MatchString without
+// the regexp, which is slow for every reply.
+func hasEnhancedStatusCode(s string) bool {
+	if len(s) < 2 || (s[0] != '2' && s[0] != '4' && s[0] != '5') || s[1] != '.' {
+		return false
+	}
+	i := 2
+	for part := 0; part < 2; part++ {
+		n := 0
+		for i < len(s) && '0' <= s[i] && s[i] <= '9' {
+			i++
+			n++
+		}
+		if n < 1 || n > 3 {
+			return false
+		}
+		if part == 0 {
+			if i >= len(s) || s[i] != '.' {
+				return false
+			}
+			i++
+		}
+	}
+	return i == len(s) || s[i] == ' '
+}
@@ -0,0 +1,33 @@
+package smtp
+
+import (
+	"testing"
+)
+
+func TestWithEnhancedStatusCode(t *testing.T) {
+	tests := map[string]string{
+		"250 OK":                      "250 2.0.0 OK",
+		"250 2.1.5 OK":                "250 2.1.5 OK",
+		"250-8BITMIME":                "250-2.0.0 8BITMIME",
+		"552 Message size exceeds":    "552 5.3.4 Message size exceeds",
+		"220 Service ready":           "220 Service ready",
+		"354 Start mail input":        "354 Start mail input",
+		"334 ":                        "334 ",
+		"250":                         "250",
+		"550 5.1.1 Mailbox not found": "550 5.1.1 Mailbox not found",
+	}
+	for line, expected := range tests {
+		if actual := withEnhancedStatusCode(line); actual != expected {
+			t.Errorf("expected: %s, actual: %s", expected, actual)
+		}
+	}
+}
+
+func TestHasEnhancedStatusCode(t *testing.T) {
+	for _, s := range []string{"2.0.0", "4.7.1 Try later", "5.123.456 x", "5.1234.1", "5.1.",
+		"3.0.0", "2.0.0x", "2..0", "2.0", "", "OK", "5.1.1\tx"} {
+		if expected := enhancedStatusCodePattern.MatchString(s); hasEnhancedStatusCode(s) != expected {
+			t.Errorf("expected: %v, actual: %v (%q)", expected, !expected, s)
+		}
+	}
+}
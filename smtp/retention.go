@@ -0,0 +1,146 @@
+package smtp
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// StoreEntry is a message of a store for the retention.
+type StoreEntry struct {
+	ID       string
+	Size     int64
+	Received time.Time
+}
+
+// RetentionStore is a store a Janitor enforces the retention on, e.g. a
+// MessageStore or a Quarantine.
+type RetentionStore interface {
+	// Entries returns the messages in the order of arrival.
+	Entries() ([]StoreEntry, error)
+	Delete(id string) error
+}
+
+// storeEntries lists the messages of a directory of envelope files
+// "<id>.json" and messages "<id>.eml". The size in the envelope, before
+// any encryption, is preferred to the size of the file.
+func storeEntries(dir string) ([]StoreEntry, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths)
+	xs := make([]StoreEntry, 0, len(paths))
+	for _, x := range paths {
+		data, err := os.ReadFile(x)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		var envelope struct {
+			Size     int64     `json:"size"`
+			Received time.Time `json:"received"`
+		}
+		if err := json.Unmarshal(data, &envelope); err != nil {
+			return nil, err
+		}
+		id := strings.TrimSuffix(filepath.Base(x), ".json")
+		entry := StoreEntry{ID: id, Size: envelope.Size, Received: envelope.Received}
+		if fi, err := os.Stat(filepath.Join(dir, id+".eml")); err == nil && entry.Size == 0 {
+			entry.Size = fi.Size()
+		}
+		xs = append(xs, entry)
+	}
+	return xs, nil
+}
+
+// Retention limits the messages kept by a store. Zero is unlimited.
+type Retention struct {
+	MaxAge   time.Duration
+	MaxCount int
+	MaxBytes int64
+}
+
+// Janitor evicts the messages of the stores beyond the retention, the
+// oldest first, every Interval.
+type Janitor struct {
+	Retention
+	Stores   []RetentionStore
+	Interval time.Duration
+
+	// Metrics counts the evicted messages by reason if set.
+	Metrics *Metrics
+	Clock   Clock
+}
+
+func NewJanitor(r Retention, stores ...RetentionStore) *Janitor {
+	return &Janitor{Retention: r, Stores: stores, Interval: time.Minute}
+}
+
+// Sweep evicts the messages beyond the retention from each store and
+// returns the number of them.
+func (j *Janitor) Sweep() (int, error) {
+	n := 0
+	for _, s := range j.Stores {
+		m, err := j.sweep(s)
+		n += m
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+func (j *Janitor) sweep(s RetentionStore) (int, error) {
+	entries, err := s.Entries()
+	if err != nil {
+		return 0, err
+	}
+	var total int64
+	for _, x := range entries {
+		total += x.Size
+	}
+	n := 0
+	deadline := clockNow(j.Clock).Add(-j.MaxAge)
+	for len(entries) > 0 {
+		x := entries[0]
+		var reason string
+		switch {
+		case j.MaxAge > 0 && x.Received.Before(deadline):
+			reason = "age"
+		case j.MaxCount > 0 && len(entries) > j.MaxCount:
+			reason = "count"
+		case j.MaxBytes > 0 && total > j.MaxBytes:
+			reason = "bytes"
+		default:
+			return n, nil
+		}
+		if err := s.Delete(x.ID); err != nil {
+			return n, err
+		}
+		j.Metrics.add("mproxy_store_evicted_total", 1, "reason", reason)
+		entries = entries[1:]
+		total -= x.Size
+		n++
+	}
+	return n, nil
+}
+
+// Run sweeps the stores every Interval until stop is closed.
+func (j *Janitor) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(j.Interval)
+	defer ticker.Stop()
+	for {
+		j.Sweep()
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package smtp
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestJanitor(t *testing.T) {
+	s, err := NewMessageStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		st := &SMTPState{ReturnTo: "foo@example.net", Recipients: []string{"user1@example.com"}}
+		st.SetContent([]byte(strings.Repeat("x", 96) + "\r\n"))
+		if _, err := s.Put(st); err != nil {
+			t.Fatal(err)
+		}
+	}
+	entries, err := s.Entries()
+	if err != nil || len(entries) != 5 || entries[0].Size != 100 {
+		t.Fatalf("unexpected entries: %v, %v", entries, err)
+	}
+
+	m := NewMetrics()
+	clock := NewFakeClock(time.Now())
+	j := NewJanitor(Retention{MaxCount: 4, MaxBytes: 350}, s)
+	j.Metrics = m
+	j.Clock = clock
+	if n, err := j.Sweep(); n != 2 || err != nil {
+		t.Errorf("expected: 2, actual: %d, %v", n, err)
+	}
+	xs, _ := s.Entries()
+	if len(xs) != 3 || xs[0].ID != entries[2].ID {
+		t.Errorf("expected the newest messages: %v", xs)
+	}
+
+	j.MaxAge = time.Hour
+	if n, _ := j.Sweep(); n != 0 {
+		t.Errorf("expected: 0, actual: %d", n)
+	}
+	clock.Advance(2 * time.Hour)
+	if n, _ := j.Sweep(); n != 3 {
+		t.Errorf("expected: 3, actual: %d", n)
+	}
+	var b strings.Builder
+	m.WriteTo(&b)
+	for _, x := range []string{
+		`mproxy_store_evicted_total{reason="age"} 3`,
+		`mproxy_store_evicted_total{reason="bytes"} 1`,
+		`mproxy_store_evicted_total{reason="count"} 1`,
+	} {
+		if !strings.Contains(b.String(), x) {
+			t.Errorf("expected: %s, actual: %s", x, b.String())
+		}
+	}
+}
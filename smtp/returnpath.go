@@ -0,0 +1,142 @@
+package smtp
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrInvalidBATV is the error of a BATV address whose signature is invalid
+// or expired.
+var ErrInvalidBATV = errors.New("smtp: invalid BATV signature")
+
+// ReturnPath encodes the senders of relayed messages and decodes the
+// recipients of the bounces to them. VERP encodes the recipient into the
+// sender, "bounces+user=example.org@example.com", relaying the message
+// to each recipient separately. BATVKey signs the sender in the form of
+// BATV PRVS, "prvs=0DDDSSSSSS=bounces@example.com", valid for BATVDays.
+type ReturnPath struct {
+	VERP          bool
+	VERPDelimiter string
+
+	BATVKey  []byte
+	BATVDays int
+
+	Clock Clock
+}
+
+func NewReturnPath() *ReturnPath {
+	return &ReturnPath{VERPDelimiter: "+", BATVDays: 7}
+}
+
+// batvDay returns the day number of BATV, days since the epoch modulo
+// 1000.
+func batvDay(t time.Time) int {
+	return int(t.Unix()/86400) % 1000
+}
+
+func (p *ReturnPath) batvSignature(tag, addr string) string {
+	mac := hmac.New(sha1.New, p.BATVKey)
+	mac.Write([]byte(tag + addr))
+	return hex.EncodeToString(mac.Sum(nil)[:3])
+}
+
+// Encode returns the sender of the message relayed to the recipient.
+// The null sender is never encoded.
+func (p *ReturnPath) Encode(sender, rcpt string) string {
+	i := strings.LastIndexByte(sender, '@')
+	if i < 0 {
+		return sender
+	}
+	if p.VERP && len(rcpt) > 0 {
+		sender = sender[:i] + p.VERPDelimiter + strings.Replace(rcpt, "@", "=", 1) + sender[i:]
+	}
+	if len(p.BATVKey) > 0 {
+		tag := fmt.Sprintf("0%03d", (batvDay(clockNow(p.Clock))+p.BATVDays)%1000)
+		sender = "prvs=" + tag + p.batvSignature(tag, sender) + "=" + sender
+	}
+	return sender
+}
+
+// Decode returns the sender and the recipient encoded into the address,
+// which is returned as is with no recipient unless it is encoded. It
+// fails with ErrInvalidBATV for an invalid BATV signature.
+func (p *ReturnPath) Decode(addr string) (string, string, error) {
+	if strings.HasPrefix(strings.ToLower(addr), "prvs=") && len(p.BATVKey) > 0 {
+		xs := strings.SplitN(addr[5:], "=", 2)
+		if len(xs) != 2 || len(xs[0]) != 10 {
+			return addr, "", ErrInvalidBATV
+		}
+		tag, sig, sender := xs[0][:4], xs[0][4:], xs[1]
+		expiry, err := strconv.Atoi(tag[1:])
+		if err != nil || tag[0] != '0' || !hmac.Equal([]byte(strings.ToLower(sig)), []byte(p.batvSignature(tag, sender))) {
+			return addr, "", ErrInvalidBATV
+		}
+		if left := (expiry - batvDay(clockNow(p.Clock)) + 1000) % 1000; left > p.BATVDays {
+			return addr, "", ErrInvalidBATV
+		}
+		addr = sender
+	}
+	i := strings.LastIndexByte(addr, '@')
+	if !p.VERP || i < 0 {
+		return addr, "", nil
+	}
+	local := addr[:i]
+	j := strings.Index(local, p.VERPDelimiter)
+	if j < 0 {
+		return addr, "", nil
+	}
+	rcpt := local[j+len(p.VERPDelimiter):]
+	k := strings.LastIndexByte(rcpt, '=')
+	if k <= 0 || k == len(rcpt)-1 {
+		return addr, "", nil
+	}
+	return local[:j] + addr[i:], rcpt[:k] + "@" + rcpt[k+1:], nil
+}
+
+// WithReturnPath returns a Send function which calls send with the sender
+// encoded, once for each recipient with VERP.
+func WithReturnPath(send func(st *SMTPState) error, p *ReturnPath) func(st *SMTPState) error {
+	return func(st *SMTPState) error {
+		if st.NullSender || len(st.ReturnTo) == 0 {
+			return send(st)
+		}
+		if !p.VERP {
+			x := *st
+			x.ReturnTo = p.Encode(st.ReturnTo, "")
+			return send(&x)
+		}
+		for i, rcpt := range st.Recipients {
+			x := st.withRecipients(i)
+			x.ReturnTo = p.Encode(st.ReturnTo, rcpt)
+			if err := send(x); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// decodeRecipient replaces the encoded recipient of a bounce with the
+// sender it was encoded from, and returns the recipient encoded by VERP
+// if any, or a reply to reject an invalid BATV signature.
+func decodeRecipient(conn *SMTPConnection, addr *Address) (string, string) {
+	p := conn.Config().ReturnPath
+	if p == nil || !conn.State().NullSender {
+		return "", ""
+	}
+	sender, rcpt, err := p.Decode(addr.String())
+	if err != nil {
+		conn.LogSecurityEvent(EventPolicyReject, "stage", "batv", "rcpt", addr.String())
+		return "", conn.Config().Catalog.Reply("rcpt.bad_bounce_signature")
+	}
+	if decoded, err := ParseAddress(sender); err == nil {
+		*addr = decoded
+	}
+	return rcpt, ""
+}
@@ -0,0 +1,88 @@
+package smtp
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReturnPath(t *testing.T) {
+	clock := NewFakeClock(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC))
+	p := NewReturnPath()
+	p.VERP = true
+	p.BATVKey = []byte("s3cret")
+	p.Clock = clock
+	addr := p.Encode("bounces@example.com", "user@example.org")
+	if !strings.HasPrefix(addr, "prvs=0") || !strings.HasSuffix(addr, "=bounces+user=example.org@example.com") {
+		t.Errorf("unexpected address: %s", addr)
+	}
+	sender, rcpt, err := p.Decode(addr)
+	if err != nil || sender != "bounces@example.com" || rcpt != "user@example.org" {
+		t.Errorf("unexpected decoding: %s, %s, %v", sender, rcpt, err)
+	}
+	if sender, rcpt, err := p.Decode("foo@example.com"); err != nil || sender != "foo@example.com" || len(rcpt) > 0 {
+		t.Errorf("unexpected decoding: %s, %s, %v", sender, rcpt, err)
+	}
+
+	forged := addr[:9] + "000000" + addr[15:]
+	if _, _, err := p.Decode(forged); !errors.Is(err, ErrInvalidBATV) {
+		t.Errorf("expected: %v, actual: %v", ErrInvalidBATV, err)
+	}
+	clock.Advance(8 * 24 * time.Hour)
+	if _, _, err := p.Decode(addr); !errors.Is(err, ErrInvalidBATV) {
+		t.Errorf("expected the expiry: %v", err)
+	}
+}
+
+func TestWithReturnPath(t *testing.T) {
+	p := NewReturnPath()
+	p.VERP = true
+	var senders []string
+	send := WithReturnPath(func(st *SMTPState) error {
+		senders = append(senders, st.ReturnTo+" "+strings.Join(st.Recipients, ","))
+		return nil
+	}, p)
+	send(&SMTPState{ReturnTo: "foo@example.net", Recipients: []string{"user1@example.com", "user2@example.org"}})
+	send(&SMTPState{NullSender: true, Recipients: []string{"user1@example.com"}})
+	expected := "foo+user1=example.com@example.net user1@example.com|" +
+		"foo+user2=example.org@example.net user2@example.org|" +
+		" user1@example.com"
+	if actual := strings.Join(senders, "|"); actual != expected {
+		t.Errorf("expected: %s, actual: %s", expected, actual)
+	}
+}
+
+func TestBounceDecoding(t *testing.T) {
+	p := NewReturnPath()
+	p.VERP = true
+	p.BATVKey = []byte("s3cret")
+	addr := p.Encode("bounces@example.com", "user@example.org")
+	conn := NewMockConn([]byte("EHLO localhost\r\n" +
+		"MAIL FROM: <>\r\n" +
+		"RCPT TO: <prvs=0123abcdef=bounces@example.com>\r\n" +
+		"RCPT TO: <" + addr + ">\r\n" +
+		"DATA\r\n" +
+		"Subject: Undelivered\r\n" +
+		"\r\n" +
+		"Hello\r\n" +
+		".\r\n" +
+		"QUIT\r\n"))
+	var st *SMTPState
+	h := NewSMTPHandler(conn, func(x *SMTPState) error {
+		y := *x
+		st = &y
+		return nil
+	})
+	h.Config.ReturnPath = p
+	h.Run()
+	if actual := replyCodes(conn.CloneOutputBuffer()); !strings.HasPrefix(actual, "220 250 250 550 250 ") {
+		t.Errorf("unexpected replies: %s", actual)
+	}
+	if st == nil || st.Recipients[0] != "bounces@example.com" {
+		t.Fatalf("unexpected state: %v", st)
+	}
+	if v, _ := headerValue(st.Headers, "X-VERP-Recipient"); v != "user@example.org" {
+		t.Errorf("expected: user@example.org, actual: %s", v)
+	}
+}
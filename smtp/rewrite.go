@@ -0,0 +1,159 @@
+package smtp
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+)
+
+type HeaderAction int
+
+const (
+	HeaderAdd HeaderAction = iota
+	HeaderRemove
+	HeaderRewrite
+)
+
+// HeaderRule adds, removes or rewrites headers. Name of a remove rule may
+// end with "*" to match every header with the prefix.
+type HeaderRule struct {
+	Action  HeaderAction
+	Name    string
+	Value   string
+	Pattern *regexp.Regexp
+}
+
+type HeaderRules []HeaderRule
+
+func (rule HeaderRule) matches(name string) bool {
+	if strings.HasSuffix(rule.Name, "*") {
+		prefix := strings.TrimSuffix(rule.Name, "*")
+		return len(name) >= len(prefix) && strings.EqualFold(name[:len(prefix)], prefix)
+	}
+	return strings.EqualFold(name, rule.Name)
+}
+
+// Apply returns the headers transformed by the rules in order.
+func (rules HeaderRules) Apply(headers []string) []string {
+	for _, rule := range rules {
+		switch rule.Action {
+		case HeaderAdd:
+			headers = append(headers, rule.Name+": "+rule.Value)
+		case HeaderRemove:
+			headers = rule.remove(headers)
+		case HeaderRewrite:
+			headers = rule.rewrite(headers)
+		}
+	}
+	return headers
+}
+
+func (rule HeaderRule) remove(headers []string) []string {
+	xs := make([]string, 0, len(headers))
+	removing := false
+	for _, x := range headers {
+		if name := headerName(x); len(name) > 0 {
+			removing = rule.matches(name)
+		}
+		if !removing {
+			xs = append(xs, x)
+		}
+	}
+	return xs
+}
+
+func (rule HeaderRule) rewrite(headers []string) []string {
+	xs := make([]string, 0, len(headers))
+	for i := 0; i < len(headers); i++ {
+		name := headerName(headers[i])
+		if len(name) == 0 || !rule.matches(name) {
+			xs = append(xs, headers[i])
+			continue
+		}
+		value, _ := headerValue(headers[i:], name)
+		for i+1 < len(headers) && len(headers[i+1]) > 0 &&
+			(headers[i+1][0] == ' ' || headers[i+1][0] == '\t') {
+			i++
+		}
+		value = rule.Pattern.ReplaceAllString(value, rule.Value)
+		xs = append(xs, name+": "+value)
+	}
+	return xs
+}
+
+// ParseHeaderRules reads rules, one per line, in the forms below. Empty
+// lines and lines starting with "#" are ignored.
+//
+//	add X-Proxy: mproxy
+//	remove X-Internal-*
+//	rewrite From /@internal\.example\.net>/@example.net>/
+func ParseHeaderRules(r io.Reader) (HeaderRules, error) {
+	rules := make(HeaderRules, 0)
+	scanner := bufio.NewScanner(r)
+	n := 0
+	for scanner.Scan() {
+		n++
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		rule, err := parseHeaderRule(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", n, err)
+		}
+		rules = append(rules, rule)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+func parseHeaderRule(line string) (HeaderRule, error) {
+	action, arg := line, ""
+	if i := strings.IndexAny(line, " \t"); i >= 0 {
+		action, arg = line[:i], strings.TrimSpace(line[i+1:])
+	}
+	switch strings.ToLower(action) {
+	case "add":
+		i := strings.IndexByte(arg, ':')
+		if i <= 0 {
+			return HeaderRule{}, fmt.Errorf("invalid header: %s", arg)
+		}
+		return HeaderRule{
+			Action: HeaderAdd,
+			Name:   strings.TrimSpace(arg[:i]),
+			Value:  strings.TrimSpace(arg[i+1:]),
+		}, nil
+	case "remove":
+		if len(arg) == 0 {
+			return HeaderRule{}, fmt.Errorf("missing header name")
+		}
+		return HeaderRule{Action: HeaderRemove, Name: arg}, nil
+	case "rewrite":
+		xs := strings.Fields(arg)
+		if len(xs) < 2 {
+			return HeaderRule{}, fmt.Errorf("invalid rewrite: %s", arg)
+		}
+		name := xs[0]
+		expr := strings.TrimSpace(arg[len(name):])
+		delim := expr[:1]
+		parts := strings.Split(expr[1:], delim)
+		if len(parts) != 3 || len(parts[2]) > 0 {
+			return HeaderRule{}, fmt.Errorf("invalid rewrite: %s", arg)
+		}
+		re, err := regexp.Compile(parts[0])
+		if err != nil {
+			return HeaderRule{}, err
+		}
+		return HeaderRule{
+			Action:  HeaderRewrite,
+			Name:    name,
+			Value:   parts[1],
+			Pattern: re,
+		}, nil
+	}
+	return HeaderRule{}, fmt.Errorf("unknown action: %s", action)
+}
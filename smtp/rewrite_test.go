@@ -0,0 +1,46 @@
+package smtp
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestHeaderRules(t *testing.T) {
+	rules, err := ParseHeaderRules(strings.NewReader(
+		"# strip internal headers\n" +
+			"remove X-Internal-*\n" +
+			"\n" +
+			"rewrite From /@internal\\.example\\.net>/@example.net>/\n" +
+			"add X-Proxy: mproxy\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	headers := []string{
+		"From: Foo",
+		" <foo@internal.example.net>",
+		"X-Internal-Host: db1",
+		"\tdb2",
+		"x-internal-id: 1234",
+		"Subject: Rewrite",
+	}
+	expected := "From: Foo <foo@example.net>\r\n" +
+		"Subject: Rewrite\r\n" +
+		"X-Proxy: mproxy"
+	actual := strings.Join(rules.Apply(headers), "\r\n")
+	if actual != expected {
+		t.Errorf("expected: %s, actual: %s", expected, actual)
+	}
+
+	invalid := []string{
+		"append X-Foo: bar",
+		"add X-Foo",
+		"remove",
+		"rewrite From /foo/",
+		"rewrite From /(/bar/",
+	}
+	for _, x := range invalid {
+		if _, err := ParseHeaderRules(strings.NewReader(x)); err == nil {
+			t.Errorf("expected an error: %s", x)
+		}
+	}
+}
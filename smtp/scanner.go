@@ -0,0 +1,213 @@
+package smtp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ContentScanner scores a message, e.g. spamd or rspamd. ip is the address
+// of the client.
+type ContentScanner interface {
+	Scan(st *SMTPState, ip string) (ScanResult, error)
+}
+
+type ScanResult struct {
+	Spam      bool
+	Score     float64
+	Threshold float64
+	Symbols   []string
+}
+
+// SpamdScanner checks messages with the SPAMC protocol of SpamAssassin.
+type SpamdScanner struct {
+	Addr    string
+	User    string
+	Timeout time.Duration
+}
+
+func NewSpamdScanner(addr string) *SpamdScanner {
+	return &SpamdScanner{Addr: addr, Timeout: 30 * time.Second}
+}
+
+func (s *SpamdScanner) Scan(st *SMTPState, ip string) (ScanResult, error) {
+	var res ScanResult
+	conn, err := net.DialTimeout("tcp", s.Addr, s.Timeout)
+	if err != nil {
+		return res, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(s.Timeout))
+	w := bufio.NewWriter(conn)
+	fmt.Fprintf(w, "SYMBOLS SPAMC/1.5\r\nContent-length: %d\r\n", st.MessageSize())
+	if len(s.User) > 0 {
+		fmt.Fprintf(w, "User: %s\r\n", s.User)
+	}
+	w.WriteString("\r\n")
+	if _, err := io.Copy(w, st.messageReader()); err != nil {
+		return res, err
+	}
+	if err := w.Flush(); err != nil {
+		return res, err
+	}
+	if c, ok := conn.(*net.TCPConn); ok {
+		c.CloseWrite()
+	}
+
+	r := bufio.NewReader(conn)
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return res, err
+	}
+	xs := strings.Fields(line)
+	if len(xs) < 3 || !strings.HasPrefix(xs[0], "SPAMD/") {
+		return res, fmt.Errorf("spamd: unexpected response: %s", strings.TrimSpace(line))
+	}
+	if xs[1] != "0" {
+		return res, fmt.Errorf("spamd: %s", strings.Join(xs[1:], " "))
+	}
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return res, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if len(line) == 0 {
+			break
+		}
+		// Spam: True ; 15.0 / 5.0
+		if i := strings.IndexByte(line, ':'); i > 0 && strings.EqualFold(line[:i], "Spam") {
+			var spam string
+			_, err := fmt.Sscanf(strings.Replace(line[i+1:], ";", " ", 1), "%s %g / %g",
+				&spam, &res.Score, &res.Threshold)
+			if err != nil {
+				return res, fmt.Errorf("spamd: malformed header: %s", line)
+			}
+			res.Spam = strings.EqualFold(spam, "True") || strings.EqualFold(spam, "Yes")
+		}
+	}
+	body, err := io.ReadAll(r)
+	if err != nil {
+		return res, err
+	}
+	for _, x := range strings.Split(strings.TrimSpace(string(body)), ",") {
+		if x = strings.TrimSpace(x); len(x) > 0 {
+			res.Symbols = append(res.Symbols, x)
+		}
+	}
+	return res, nil
+}
+
+// RspamdScanner checks messages with the HTTP protocol of rspamd, e.g.
+// http://localhost:11333.
+type RspamdScanner struct {
+	URL    string
+	Client *http.Client
+}
+
+func NewRspamdScanner(url string) *RspamdScanner {
+	return &RspamdScanner{
+		URL:    strings.TrimSuffix(url, "/"),
+		Client: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+type rspamdResponse struct {
+	Score         float64 `json:"score"`
+	RequiredScore float64 `json:"required_score"`
+	Action        string  `json:"action"`
+	Symbols       map[string]struct {
+		Score float64 `json:"score"`
+	} `json:"symbols"`
+}
+
+func (s *RspamdScanner) Scan(st *SMTPState, ip string) (ScanResult, error) {
+	var res ScanResult
+	req, err := http.NewRequest("POST", s.URL+"/checkv2", st.messageReader())
+	if err != nil {
+		return res, err
+	}
+	req.ContentLength = st.MessageSize()
+	req.Header.Set("From", st.ReturnTo)
+	for _, x := range st.Recipients {
+		req.Header.Add("Rcpt", x)
+	}
+	if len(ip) > 0 {
+		req.Header.Set("IP", ip)
+	}
+	if len(st.ClientName) > 0 {
+		req.Header.Set("Helo", st.ClientName)
+	}
+	if len(st.Username) > 0 {
+		req.Header.Set("User", st.Username)
+	}
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return res, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return res, fmt.Errorf("rspamd: %s", resp.Status)
+	}
+	var x rspamdResponse
+	if err := json.NewDecoder(resp.Body).Decode(&x); err != nil {
+		return res, err
+	}
+	res.Score, res.Threshold = x.Score, x.RequiredScore
+	res.Spam = x.Action != "no action" && x.Action != "greylist"
+	for name := range x.Symbols {
+		res.Symbols = append(res.Symbols, name)
+	}
+	sort.Strings(res.Symbols)
+	return res, nil
+}
+
+// scanHeaders returns the X-Spam-* headers of the result.
+func scanHeaders(res ScanResult) []string {
+	status := "No"
+	if res.Spam {
+		status = "Yes"
+	}
+	score := strconv.FormatFloat(res.Score, 'f', 1, 64)
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "X-Spam-Status: %s, score=%s required=%s", status, score,
+		strconv.FormatFloat(res.Threshold, 'f', 1, 64))
+	if len(res.Symbols) > 0 {
+		fmt.Fprintf(&b, "\r\n\ttests=%s", strings.Join(res.Symbols, ","))
+	}
+	return append([]string{"X-Spam-Score: " + score}, strings.Split(b.String(), "\r\n")...)
+}
+
+// applyScanner scans the message, records the result on the state and adds
+// the headers. It returns the reply of a rejection or an empty string.
+func applyScanner(conn *SMTPConnection) string {
+	config := conn.Config()
+	if config.Scanner == nil {
+		return ""
+	}
+	st := conn.State()
+	res, err := config.Scanner.Scan(st, conn.RemoteIP())
+	if err != nil {
+		return config.Catalog.Reply("message.scanner_unavailable")
+	}
+	st.SpamScore, st.SpamSymbols = res.Score, res.Symbols
+	st.Headers = append(scanHeaders(res), st.Headers...)
+	if res.Spam {
+		st.Tags = append(st.Tags, "spam")
+	}
+	if config.SpamRejectScore > 0 && res.Score >= config.SpamRejectScore {
+		return config.Catalog.Reply("message.spam")
+	}
+	if config.SpamQuarantineScore > 0 && res.Score >= config.SpamQuarantineScore {
+		st.Quarantined = true
+	}
+	return ""
+}
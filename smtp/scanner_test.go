@@ -0,0 +1,148 @@
+package smtp
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func newScanTestState() *SMTPState {
+	st := &SMTPState{}
+	st.Reset()
+	st.ReturnTo = "foo@example.net"
+	st.Recipients = []string{"user1@example.net", "user2@example.net"}
+	st.Headers = []string{"Subject: Buy now"}
+	st.SetContent([]byte("Buy now\r\n"))
+	return st
+}
+
+func TestSpamdScanner(t *testing.T) {
+	lsnr, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip(err)
+	}
+	defer lsnr.Close()
+	received := make(chan string, 1)
+	go func() {
+		conn, err := lsnr.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		request, _ := r.ReadString('\n')
+		size := 0
+		for {
+			line, _ := r.ReadString('\n')
+			line = strings.TrimSpace(line)
+			if len(line) == 0 {
+				break
+			}
+			if strings.HasPrefix(line, "Content-length: ") {
+				size, _ = strconv.Atoi(line[16:])
+			}
+		}
+		b := make([]byte, size)
+		io.ReadFull(r, b)
+		received <- request + string(b)
+		fmt.Fprintf(conn, "SPAMD/1.1 0 EX_OK\r\nContent-length: 19\r\nSpam: True ; 15.5 / 5.0\r\n\r\nBAYES_99,URIBL_BLACK")
+	}()
+
+	res, err := NewSpamdScanner(lsnr.Addr().String()).Scan(newScanTestState(), "192.0.2.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "SYMBOLS SPAMC/1.5\r\nSubject: Buy now\r\n\r\nBuy now\r\n"
+	if actual := <-received; actual != expected {
+		t.Errorf("expected: %q, actual: %q", expected, actual)
+	}
+	if !res.Spam || res.Score != 15.5 || res.Threshold != 5.0 ||
+		strings.Join(res.Symbols, ",") != "BAYES_99,URIBL_BLACK" {
+		t.Errorf("unexpected result: %v", res)
+	}
+}
+
+func TestRspamdScanner(t *testing.T) {
+	var rcpts []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/checkv2" {
+			http.NotFound(w, r)
+			return
+		}
+		rcpts = r.Header.Values("Rcpt")
+		fmt.Fprint(w, `{"score":3.5,"required_score":15,"action":"no action",`+
+			`"symbols":{"R_SPF_ALLOW":{"score":-0.2},"MIME_GOOD":{"score":-0.1}}}`)
+	}))
+	defer srv.Close()
+
+	res, err := NewRspamdScanner(srv.URL).Scan(newScanTestState(), "192.0.2.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Spam || res.Score != 3.5 || strings.Join(res.Symbols, ",") != "MIME_GOOD,R_SPF_ALLOW" {
+		t.Errorf("unexpected result: %v", res)
+	}
+	if strings.Join(rcpts, ",") != "user1@example.net,user2@example.net" {
+		t.Errorf("unexpected recipients: %v", rcpts)
+	}
+}
+
+type stubScanner struct {
+	res ScanResult
+}
+
+func (s stubScanner) Scan(st *SMTPState, ip string) (ScanResult, error) {
+	return s.res, nil
+}
+
+func TestApplyScanner(t *testing.T) {
+	input := "EHLO localhost\r\n" +
+		"MAIL FROM: <foo@example.net>\r\n" +
+		"RCPT TO: <user1@example.net>\r\n" +
+		"DATA\r\n" +
+		"Subject: Buy now\r\n" +
+		"\r\n" +
+		"Buy now\r\n" +
+		".\r\n" +
+		"QUIT\r\n"
+	res := ScanResult{Spam: true, Score: 12, Threshold: 5, Symbols: []string{"BAYES_99"}}
+	var sent *SMTPState
+	conn := NewMockConn([]byte(input))
+	h := NewSMTPHandler(conn, func(st *SMTPState) error {
+		x := *st
+		sent = &x
+		return nil
+	})
+	h.Config.Scanner = stubScanner{res}
+	h.Config.SpamRejectScore = 20
+	h.Run()
+	if sent == nil {
+		t.Fatal("expected the message to be sent")
+	}
+	expected := "X-Spam-Score: 12.0,X-Spam-Status: Yes, score=12.0 required=5.0,\ttests=BAYES_99,Subject: Buy now"
+	if actual := strings.Join(sent.Headers, ","); actual != expected {
+		t.Errorf("expected: %s, actual: %s", expected, actual)
+	}
+	if sent.SpamScore != 12 || len(sent.Tags) != 1 || sent.Tags[0] != "spam" {
+		t.Errorf("unexpected state: %v %v", sent.SpamScore, sent.Tags)
+	}
+
+	conn = NewMockConn([]byte(input))
+	h = NewSMTPHandler(conn, func(st *SMTPState) error {
+		t.Errorf("unexpected message: %s", st)
+		return nil
+	})
+	h.Config.Scanner = stubScanner{res}
+	h.Config.SpamRejectScore = 10
+	h.Run()
+	expected = "220 250 250 250 354 550 221"
+	if actual := replyCodes(conn.CloneOutputBuffer()); actual != expected {
+		t.Errorf("expected: %s, actual: %s", expected, actual)
+	}
+}
@@ -0,0 +1,69 @@
+package smtp
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// DeliverAtHeader holds a message in the queue until the time, given as a
+// date of RFC 5322 or RFC 3339, or as a duration from the arrival such as
+// "+10m". It is removed from the message.
+const DeliverAtHeader = "X-MProxy-Deliver-At"
+
+func parseDeliverAt(v string, now time.Time) (time.Time, error) {
+	v = strings.TrimSpace(v)
+	if strings.HasPrefix(v, "+") {
+		d, err := time.ParseDuration(v[1:])
+		if err != nil || d < 0 {
+			return time.Time{}, fmt.Errorf("smtp: invalid delivery time: %s", v)
+		}
+		return now.Add(d), nil
+	}
+	for _, layout := range []string{time.RFC1123Z, time.RFC1123, time.RFC3339} {
+		if t, err := time.Parse(layout, v); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("smtp: invalid delivery time: %s", v)
+}
+
+// applyDeliverAt sets st.DeliverAt from DeliverAtHeader and removes it.
+func applyDeliverAt(st *SMTPState, now time.Time) error {
+	v, ok := headerValue(st.Headers, DeliverAtHeader)
+	if !ok {
+		return nil
+	}
+	t, err := parseDeliverAt(v, now)
+	if err != nil {
+		return err
+	}
+	st.holdUntil(t)
+	st.Headers = HeaderRule{Action: HeaderRemove, Name: DeliverAtHeader}.remove(st.Headers)
+	return nil
+}
+
+// holdUntil delays the delivery until t unless it is already held longer.
+func (st *SMTPState) holdUntil(t time.Time) {
+	if t.After(st.DeliverAt) {
+		st.DeliverAt = t
+	}
+}
+
+// Schedule holds the queued message until t, or releases it with the zero
+// time.
+func (q *Queue) Schedule(id string, t time.Time) error {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	msg, err := q.Get(id)
+	if err != nil {
+		return err
+	}
+	msg.DeliverAt = t
+	msg.NextAttempt = t
+	if err := q.save(msg); err != nil {
+		return err
+	}
+	q.wake()
+	return nil
+}
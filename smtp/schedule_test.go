@@ -0,0 +1,100 @@
+package smtp
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseDeliverAt(t *testing.T) {
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	for _, fixture := range []struct {
+		value    string
+		expected time.Time
+	}{
+		{"+90m", now.Add(90 * time.Minute)},
+		{"Tue, 02 Jan 2024 12:00:00 +0900", time.Date(2024, 1, 2, 3, 0, 0, 0, time.UTC)},
+		{"2024-01-03T00:00:00Z", time.Date(2024, 1, 3, 0, 0, 0, 0, time.UTC)},
+	} {
+		actual, err := parseDeliverAt(fixture.value, now)
+		if err != nil || !actual.Equal(fixture.expected) {
+			t.Errorf("expected: %v, actual: %v %v (%s)", fixture.expected, actual, err, fixture.value)
+		}
+	}
+	for _, x := range []string{"", "+-1m", "tomorrow", "2024-01-03"} {
+		if _, err := parseDeliverAt(x, now); err == nil {
+			t.Errorf("expected an error: %s", x)
+		}
+	}
+}
+
+func TestDeliverAtHeader(t *testing.T) {
+	var accepted *SMTPState
+	conn := NewMockConn([]byte("EHLO localhost\r\n" +
+		"MAIL FROM: <foo@example.net>\r\n" +
+		"RCPT TO: <user1@example.com>\r\n" +
+		"DATA\r\n" +
+		"Subject: Later\r\n" +
+		"X-MProxy-Deliver-At: +1h\r\n" +
+		"\r\n" +
+		"Hello\r\n" +
+		".\r\n" +
+		"MAIL FROM: <foo@example.net>\r\n" +
+		"RCPT TO: <user1@example.com>\r\n" +
+		"DATA\r\n" +
+		"X-MProxy-Deliver-At: someday\r\n" +
+		"\r\n" +
+		"Hello\r\n" +
+		".\r\n" +
+		"QUIT\r\n"))
+	h := NewSMTPHandler(conn, func(st *SMTPState) error {
+		x := *st
+		accepted = &x
+		return nil
+	})
+	h.Run()
+	expected := "220 250 250 250 354 250 250 250 354 554 221"
+	if actual := replyCodes(conn.CloneOutputBuffer()); actual != expected {
+		t.Errorf("expected: %s, actual: %s", expected, actual)
+	}
+	if accepted == nil || len(accepted.Headers) != 1 || accepted.Headers[0] != "Subject: Later" {
+		t.Fatalf("unexpected state: %v", accepted)
+	}
+	if d := time.Until(accepted.DeliverAt); d < 59*time.Minute || d > time.Hour {
+		t.Errorf("unexpected delivery time: %v", accepted.DeliverAt)
+	}
+}
+
+func TestQueueSchedule(t *testing.T) {
+	delivered := 0
+	q, err := NewQueue(t.TempDir(), func(st *SMTPState) error {
+		delivered++
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := &SMTPState{}
+	st.Reset()
+	st.ReturnTo = "foo@example.net"
+	st.Recipients = []string{"user1@example.net"}
+	st.DeliverAt = time.Now().Add(time.Hour)
+	st.SetContent([]byte("Hello\r\n"))
+	if err := q.Send(st); err != nil {
+		t.Fatal(err)
+	}
+	q.Process()
+	if n, _ := q.Flush(""); n != 0 || delivered != 0 {
+		t.Errorf("expected the message to be held: %d %d", n, delivered)
+	}
+	xs, _ := q.List()
+	if len(xs) != 1 {
+		t.Fatalf("unexpected queue: %v", xs)
+	}
+	if err := q.Schedule(xs[0].ID, time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	q.Process()
+	if delivered != 1 {
+		t.Errorf("expected: 1, actual: %d", delivered)
+	}
+}
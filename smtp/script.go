@@ -0,0 +1,213 @@
+package smtp
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Script is a program in a subset of Starlark, a dialect of Python, whose
+// functions on_rcpt(state) and on_message(state) are called before RCPT
+// adds a recipient and before the message is sent. Register adds them as
+// hooks.
+//
+//	def on_rcpt(state):
+//	    if state.rcpt.endswith("@legacy.example.net"):
+//	        reject(550, "5.1.6 Recipient has moved")
+//
+//	def on_message(state):
+//	    if "[bulk]" in (state.header("Subject") or "").lower():
+//	        state.add_header("Precedence", "bulk")
+//	        state.route = "bulk.example.net:25"
+//
+// The state has the attributes sender, recipients, rcpt (the recipient
+// being added, in on_rcpt only), helo, client_ip, username, tags and
+// route, the upstream relaying the message instead of the routes, which
+// may be set. Its methods are header(name), headers(name), add_tag(tag),
+// and in on_message only add_header(name, value), set_header(name, value)
+// and remove_header(name). reject(code, text) stops the script with the
+// reply. A script fails with a temporary error, logged, if it runs more
+// than MaxSteps statements.
+type Script struct {
+	MaxSteps int
+
+	globals map[string]scriptValue
+}
+
+const DefaultScriptMaxSteps = 100000
+
+var scriptHooks = []string{"on_rcpt", "on_message"}
+
+// ParseScript reads a script and runs its top-level statements, which
+// define the hooks.
+func ParseScript(r io.Reader) (*Script, error) {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	tokens, err := scriptTokenize(string(b))
+	if err != nil {
+		return nil, err
+	}
+	p := &scriptParser{tokens: tokens}
+	stmts, err := p.parseFile()
+	if err != nil {
+		return nil, err
+	}
+	s := &Script{MaxSteps: DefaultScriptMaxSteps, globals: make(map[string]scriptValue)}
+	fr := &scriptFrame{thread: &scriptThread{maxSteps: s.MaxSteps}, globals: s.globals}
+	if _, err := execScript(fr, stmts); err != nil {
+		return nil, err
+	}
+	defined := false
+	for _, name := range scriptHooks {
+		v, ok := s.globals[name]
+		if !ok {
+			continue
+		}
+		if f, ok := v.(*scriptFunc); !ok || len(f.params) != 1 {
+			return nil, fmt.Errorf("script: %s must be a function of the state", name)
+		}
+		defined = true
+	}
+	if !defined {
+		return nil, fmt.Errorf("script: neither %s is defined", strings.Join(scriptHooks, " nor "))
+	}
+	for _, v := range s.globals {
+		scriptFreeze(v)
+	}
+	return s, nil
+}
+
+func (s *Script) Register(h *Hooks) {
+	h.OnRcpt(func(conn *SMTPConnection, rcpt Address) string {
+		return s.call(conn, "on_rcpt", &scriptState{conn: conn, rcpt: rcpt.String()})
+	})
+	h.OnData(func(conn *SMTPConnection) string {
+		return s.call(conn, "on_message", &scriptState{conn: conn, message: true})
+	})
+}
+
+// call calls the hook of the name if defined, and returns the reply given
+// to reject.
+func (s *Script) call(conn *SMTPConnection, name string, state *scriptState) string {
+	f, ok := s.globals[name].(*scriptFunc)
+	if !ok {
+		return ""
+	}
+	_, err := f.call(&scriptThread{maxSteps: s.MaxSteps}, []scriptValue{state})
+	var reject scriptReject
+	if errors.As(err, &reject) {
+		return string(reject)
+	}
+	if err != nil {
+		conn.Logger().Warn("script failed", "hook", name, "error", err.Error())
+		return conn.Config().Catalog.Reply("message.local_error")
+	}
+	return ""
+}
+
+// scriptState is the state given to the hooks.
+type scriptState struct {
+	conn    *SMTPConnection
+	rcpt    string
+	message bool
+}
+
+func scriptStrings(xs []string) *scriptList {
+	l := &scriptList{elems: make([]scriptValue, len(xs))}
+	for i, x := range xs {
+		l.elems[i] = x
+	}
+	return l
+}
+
+func (state *scriptState) attr(name string) (scriptValue, bool) {
+	st := state.conn.State()
+	switch name {
+	case "sender":
+		return st.ReturnTo, true
+	case "recipients":
+		return scriptStrings(st.Recipients), true
+	case "rcpt":
+		if len(state.rcpt) == 0 {
+			return nil, true
+		}
+		return state.rcpt, true
+	case "helo":
+		return st.ClientName, true
+	case "client_ip":
+		return state.conn.RemoteIP(), true
+	case "username":
+		return st.Username, true
+	case "tags":
+		return scriptStrings(st.Tags), true
+	case "route":
+		return st.Route, true
+	case "header", "headers":
+		return scriptMethod(name, func(args []scriptValue) (scriptValue, error) {
+			if err := scriptArgs(args, "s"); err != nil {
+				return nil, err
+			}
+			if name == "headers" {
+				return scriptStrings(headerValues(st.Headers, args[0].(string))), nil
+			}
+			if v, ok := headerValue(st.Headers, args[0].(string)); ok {
+				return v, nil
+			}
+			return nil, nil
+		}), true
+	case "add_tag":
+		return scriptMethod(name, func(args []scriptValue) (scriptValue, error) {
+			if err := scriptArgs(args, "s"); err != nil {
+				return nil, err
+			}
+			tag := args[0].(string)
+			if !validTag(tag) {
+				return nil, fmt.Errorf("invalid tag %s", tag)
+			}
+			if !containsFold(st.Tags, tag) {
+				st.Tags = append(st.Tags, tag)
+			}
+			return nil, nil
+		}), true
+	case "add_header", "set_header", "remove_header":
+		kinds := "ss"
+		if name == "remove_header" {
+			kinds = "s"
+		}
+		return scriptMethod(name, func(args []scriptValue) (scriptValue, error) {
+			if err := scriptArgs(args, kinds); err != nil {
+				return nil, err
+			}
+			if !state.message {
+				return nil, errors.New("the header is only available in on_message")
+			}
+			field := args[0].(string)
+			if len(field) == 0 || strings.ContainsAny(field, ": \t\r\n*") {
+				return nil, fmt.Errorf("invalid header name %s", field)
+			}
+			if name != "add_header" {
+				st.Headers = HeaderRule{Action: HeaderRemove, Name: field}.remove(st.Headers)
+			}
+			if name != "remove_header" {
+				st.Headers = append(st.Headers, field+": "+oneLine(args[1].(string)))
+			}
+			return nil, nil
+		}), true
+	}
+	return nil, false
+}
+
+func (state *scriptState) setAttr(name string, v scriptValue) error {
+	if name != "route" {
+		return fmt.Errorf("cannot set %s", name)
+	}
+	route, ok := v.(string)
+	if !ok {
+		return fmt.Errorf("route must be a string, not %s", scriptType(v))
+	}
+	state.conn.State().Route = strings.TrimSpace(route)
+	return nil
+}
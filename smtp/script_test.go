@@ -0,0 +1,108 @@
+package smtp
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestScript(t *testing.T) {
+	script, err := ParseScript(strings.NewReader(`
+blocked = ["spam@example.org"]
+
+def on_rcpt(state):
+    if state.rcpt in blocked:
+        reject(550, "5.7.1 Recipient " + state.rcpt + " blocked")
+    if state.rcpt.startswith("error@"):
+        state.add_header("X-Never", "set")
+
+def on_message(state):
+    subject = state.header("Subject") or ""
+    if "[bulk]" in subject.lower():
+        state.set_header("Precedence", "bulk")
+        state.remove_header("X-Mailer")
+        state.add_tag("bulk")
+        state.route = "bulk.example.net:25"
+    if state.sender == "reject@example.net":
+        reject(554, "5.7.1 Rejected by script for " + str(len(state.recipients)))
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := NewMockConn([]byte("EHLO localhost\r\n" +
+		"MAIL FROM: <foo@example.net>\r\n" +
+		"RCPT TO: <user1@example.net>\r\n" +
+		"RCPT TO: <spam@example.org>\r\n" +
+		"RCPT TO: <error@example.net>\r\n" +
+		"DATA\r\n" +
+		"Subject: [BULK] News\r\n" +
+		"Precedence: list\r\n" +
+		"X-Mailer: Test\r\n" +
+		"\r\n" +
+		"Hello\r\n" +
+		".\r\n" +
+		"MAIL FROM: <reject@example.net>\r\n" +
+		"RCPT TO: <user1@example.net>\r\n" +
+		"DATA\r\n" +
+		"Subject: Hello\r\n" +
+		"\r\n" +
+		"Hello\r\n" +
+		".\r\n" +
+		"QUIT\r\n"))
+	var sent *SMTPState
+	h := NewSMTPHandler(conn, func(st *SMTPState) error {
+		sent = &SMTPState{Headers: st.Headers, Tags: st.Tags, Route: st.Route}
+		return nil
+	})
+	h.Config.Hooks = &Hooks{}
+	script.Register(h.Config.Hooks)
+	h.Run()
+	out := string(conn.CloneOutputBuffer())
+	expected := "220 250 250 250 550 451 354 250 250 250 354 554 221"
+	if actual := replyCodes([]byte(out)); actual != expected {
+		t.Errorf("expected: %s, actual: %s", expected, actual)
+	}
+	for _, x := range []string{
+		"550 5.7.1 Recipient spam@example.org blocked\r\n",
+		"554 5.7.1 Rejected by script for 1\r\n",
+	} {
+		if !strings.Contains(out, x) {
+			t.Errorf("expected %q in %s", x, out)
+		}
+	}
+	if sent == nil {
+		t.Fatal("expected the message to be sent")
+	}
+	if expected, actual := "Subject: [BULK] News,Precedence: bulk", strings.Join(sent.Headers, ","); !strings.HasSuffix(actual, expected) ||
+		strings.Contains(actual, "X-Mailer") || strings.Contains(actual, "list") {
+		t.Errorf("unexpected headers: %s", actual)
+	}
+	if sent.Route != "bulk.example.net:25" || !containsFold(sent.Tags, "bulk") {
+		t.Errorf("unexpected route and tags: %s %v", sent.Route, sent.Tags)
+	}
+}
+
+func TestParseScriptInvalid(t *testing.T) {
+	for _, x := range []string{
+		"x = 1",
+		"on_rcpt = 1",
+		"def on_message():\n    pass",
+		"def on_rcpt(state):\n    pass\nx = undefined",
+	} {
+		if _, err := ParseScript(strings.NewReader(x)); err == nil {
+			t.Errorf("expected an error: %s", x)
+		}
+	}
+}
+
+func TestRouterScriptRoute(t *testing.T) {
+	router := NewRouter("default:25")
+	router.Add("example.net", "mx1:25")
+	st := &SMTPState{Recipients: []string{"user1@example.net", "user2@example.com"}, Route: "bulk:25"}
+	deliveries, err := router.Split(st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deliveries) != 1 || deliveries[0].Upstream != "bulk:25" || len(deliveries[0].Recipients) != 2 {
+		t.Errorf("unexpected deliveries: %v", deliveries)
+	}
+}
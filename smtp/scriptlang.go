@@ -0,0 +1,1813 @@
+package smtp
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The language of Script is a subset of Starlark: def, if/elif/else, for,
+// return, pass, break and continue, assignments including += -= *= and
+// to attributes and indexes, conditional expressions, and/or/not,
+// comparisons, in, + - * // %, calls with positional arguments, indexes
+// and slices. The values are None, bools, ints, strings, lists and dicts,
+// which are frozen after the script is loaded as in Starlark.
+
+type scriptValue interface{}
+
+type scriptList struct {
+	elems  []scriptValue
+	frozen bool
+}
+
+type scriptDict struct {
+	keys   []scriptValue
+	values map[scriptValue]scriptValue
+	frozen bool
+}
+
+type scriptBuiltin struct {
+	name string
+	fn   func(args []scriptValue) (scriptValue, error)
+}
+
+type scriptFunc struct {
+	name    string
+	params  []string
+	body    []scriptStmt
+	globals map[string]scriptValue
+}
+
+// scriptObject is a value with attributes, such as the state of a hook.
+type scriptObject interface {
+	attr(name string) (scriptValue, bool)
+	setAttr(name string, v scriptValue) error
+}
+
+type scriptError struct {
+	line int
+	msg  string
+}
+
+func (e *scriptError) Error() string {
+	return fmt.Sprintf("script: line %d: %s", e.line, e.msg)
+}
+
+func scriptErrorf(line int, format string, args ...interface{}) error {
+	return &scriptError{line, fmt.Sprintf(format, args...)}
+}
+
+// scriptReject stops the script with the reply given to reject.
+type scriptReject string
+
+func (r scriptReject) Error() string {
+	return "script: rejected with " + string(r)
+}
+
+var errScriptFrozen = errors.New("cannot modify a frozen value")
+
+// scriptThread counts the statements executed by a call.
+type scriptThread struct {
+	steps    int
+	maxSteps int
+	stack    []*scriptFunc
+}
+
+type scriptFrame struct {
+	thread  *scriptThread
+	locals  map[string]scriptValue
+	globals map[string]scriptValue
+	ret     scriptValue
+}
+
+type scriptFlow int
+
+const (
+	scriptNext scriptFlow = iota
+	scriptBreak
+	scriptContinue
+	scriptReturn
+)
+
+// Lexer
+
+type scriptToken struct {
+	kind  byte // 'n' name, '0' int, '"' string, 'o' operator, '\n', '>' indent, '<' dedent, 0 end
+	value string
+	line  int
+}
+
+var scriptOperators = []string{
+	"==", "!=", "<=", ">=", "//", "+=", "-=", "*=",
+	"+", "-", "*", "%", "<", ">", "=", "(", ")", "[", "]", "{", "}", ",", ":", ".",
+}
+
+func scriptTokenize(src string) ([]scriptToken, error) {
+	tokens := make([]scriptToken, 0)
+	indents := []int{0}
+	depth := 0
+	lines := strings.Split(strings.ReplaceAll(src, "\r\n", "\n"), "\n")
+	for i, line := range lines {
+		n := i + 1
+		rest := line
+		if depth == 0 {
+			indent := 0
+			for len(rest) > 0 && (rest[0] == ' ' || rest[0] == '\t') {
+				if rest[0] == '\t' {
+					indent += 8 - indent%8
+				} else {
+					indent++
+				}
+				rest = rest[1:]
+			}
+			if len(strings.TrimSpace(rest)) == 0 || rest[0] == '#' {
+				continue
+			}
+			if indent > indents[len(indents)-1] {
+				indents = append(indents, indent)
+				tokens = append(tokens, scriptToken{'>', "", n})
+			}
+			for indent < indents[len(indents)-1] {
+				indents = indents[:len(indents)-1]
+				tokens = append(tokens, scriptToken{'<', "", n})
+			}
+			if indent != indents[len(indents)-1] {
+				return nil, scriptErrorf(n, "inconsistent indentation")
+			}
+		}
+		for len(rest) > 0 {
+			c := rest[0]
+			switch {
+			case c == ' ' || c == '\t':
+				rest = rest[1:]
+			case c == '#':
+				rest = ""
+			case c >= '0' && c <= '9':
+				j := 1
+				for j < len(rest) && rest[j] >= '0' && rest[j] <= '9' {
+					j++
+				}
+				tokens = append(tokens, scriptToken{'0', rest[:j], n})
+				rest = rest[j:]
+			case c == '_' || (c|0x20 >= 'a' && c|0x20 <= 'z'):
+				j := 1
+				for j < len(rest) && (rest[j] == '_' || (rest[j]|0x20 >= 'a' && rest[j]|0x20 <= 'z') ||
+					(rest[j] >= '0' && rest[j] <= '9')) {
+					j++
+				}
+				tokens = append(tokens, scriptToken{'n', rest[:j], n})
+				rest = rest[j:]
+			case c == '"' || c == '\'':
+				var b strings.Builder
+				j := 1
+				for ; j < len(rest) && rest[j] != c; j++ {
+					if rest[j] != '\\' {
+						b.WriteByte(rest[j])
+						continue
+					}
+					if j++; j == len(rest) {
+						break
+					}
+					switch rest[j] {
+					case 'n':
+						b.WriteByte('\n')
+					case 'r':
+						b.WriteByte('\r')
+					case 't':
+						b.WriteByte('\t')
+					default:
+						b.WriteByte(rest[j])
+					}
+				}
+				if j >= len(rest) {
+					return nil, scriptErrorf(n, "unterminated string")
+				}
+				tokens = append(tokens, scriptToken{'"', b.String(), n})
+				rest = rest[j+1:]
+			default:
+				op := ""
+				for _, x := range scriptOperators {
+					if strings.HasPrefix(rest, x) {
+						op = x
+						break
+					}
+				}
+				if len(op) == 0 {
+					return nil, scriptErrorf(n, "unexpected %q", c)
+				}
+				switch op {
+				case "(", "[", "{":
+					depth++
+				case ")", "]", "}":
+					if depth == 0 {
+						return nil, scriptErrorf(n, "unexpected %q", op)
+					}
+					depth--
+				}
+				tokens = append(tokens, scriptToken{'o', op, n})
+				rest = rest[len(op):]
+			}
+		}
+		if depth == 0 && len(tokens) > 0 && tokens[len(tokens)-1].kind != '\n' {
+			tokens = append(tokens, scriptToken{'\n', "", n})
+		}
+	}
+	if depth > 0 {
+		return nil, scriptErrorf(len(lines), "unclosed bracket")
+	}
+	for len(indents) > 1 {
+		indents = indents[:len(indents)-1]
+		tokens = append(tokens, scriptToken{'<', "", len(lines)})
+	}
+	return append(tokens, scriptToken{0, "", len(lines)}), nil
+}
+
+// Parser
+
+type scriptParser struct {
+	tokens []scriptToken
+	pos    int
+	depth  int // of def
+	loops  int // of for within the def
+}
+
+var scriptKeywords = map[string]bool{
+	"and": true, "break": true, "continue": true, "def": true, "elif": true, "else": true,
+	"for": true, "if": true, "in": true, "not": true, "or": true, "pass": true, "return": true,
+	"None": true, "True": true, "False": true,
+}
+
+func (p *scriptParser) peek() scriptToken {
+	return p.tokens[p.pos]
+}
+
+func (p *scriptParser) next() scriptToken {
+	t := p.tokens[p.pos]
+	if t.kind != 0 {
+		p.pos++
+	}
+	return t
+}
+
+// is reports whether the next token is the operator or keyword.
+func (p *scriptParser) is(value string) bool {
+	t := p.peek()
+	return (t.kind == 'o' || t.kind == 'n') && t.value == value
+}
+
+func (p *scriptParser) accept(value string) bool {
+	if p.is(value) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *scriptParser) expect(value string) error {
+	if !p.accept(value) {
+		return p.unexpected()
+	}
+	return nil
+}
+
+func (p *scriptParser) unexpected() error {
+	t := p.peek()
+	switch t.kind {
+	case 0:
+		return scriptErrorf(t.line, "unexpected end of script")
+	case '\n':
+		return scriptErrorf(t.line, "unexpected end of line")
+	case '>', '<':
+		return scriptErrorf(t.line, "unexpected indentation")
+	}
+	return scriptErrorf(t.line, "unexpected %q", t.value)
+}
+
+func (p *scriptParser) name() (string, error) {
+	t := p.peek()
+	if t.kind != 'n' || scriptKeywords[t.value] {
+		return "", p.unexpected()
+	}
+	p.pos++
+	return t.value, nil
+}
+
+func (p *scriptParser) parseFile() ([]scriptStmt, error) {
+	stmts := make([]scriptStmt, 0)
+	for p.peek().kind != 0 {
+		x, err := p.parseStmt()
+		if err != nil {
+			return nil, err
+		}
+		stmts = append(stmts, x)
+	}
+	return stmts, nil
+}
+
+func (p *scriptParser) parseStmt() (scriptStmt, error) {
+	line := p.peek().line
+	switch {
+	case p.accept("def"):
+		if p.depth > 0 {
+			return nil, scriptErrorf(line, "nested def is not supported")
+		}
+		name, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect("("); err != nil {
+			return nil, err
+		}
+		params := make([]string, 0)
+		for !p.accept(")") {
+			x, err := p.name()
+			if err != nil {
+				return nil, err
+			}
+			params = append(params, x)
+			if !p.is(")") {
+				if err := p.expect(","); err != nil {
+					return nil, err
+				}
+			}
+		}
+		loops := p.loops
+		p.depth, p.loops = p.depth+1, 0
+		body, err := p.parseSuite()
+		p.depth, p.loops = p.depth-1, loops
+		return &scriptDef{line, name, params, body}, err
+	case p.accept("if"):
+		x := &scriptIf{line: line}
+		for {
+			cond, err := p.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+			body, err := p.parseSuite()
+			if err != nil {
+				return nil, err
+			}
+			x.conds = append(x.conds, cond)
+			x.bodies = append(x.bodies, body)
+			if !p.accept("elif") {
+				break
+			}
+		}
+		if p.accept("else") {
+			body, err := p.parseSuite()
+			if err != nil {
+				return nil, err
+			}
+			x.conds = append(x.conds, nil)
+			x.bodies = append(x.bodies, body)
+		}
+		return x, nil
+	case p.accept("for"):
+		name, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect("in"); err != nil {
+			return nil, err
+		}
+		x, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		p.loops++
+		body, err := p.parseSuite()
+		p.loops--
+		return &scriptFor{line, name, x, body}, err
+	}
+	x, err := p.parseSimpleStmt()
+	if err != nil {
+		return nil, err
+	}
+	if p.peek().kind != '\n' {
+		return nil, p.unexpected()
+	}
+	p.pos++
+	return x, nil
+}
+
+func (p *scriptParser) parseSuite() ([]scriptStmt, error) {
+	if err := p.expect(":"); err != nil {
+		return nil, err
+	}
+	if p.peek().kind != '\n' {
+		x, err := p.parseSimpleStmt()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek().kind != '\n' {
+			return nil, p.unexpected()
+		}
+		p.pos++
+		return []scriptStmt{x}, nil
+	}
+	p.pos++
+	if p.peek().kind != '>' {
+		return nil, scriptErrorf(p.peek().line, "expected an indented block")
+	}
+	p.pos++
+	stmts := make([]scriptStmt, 0)
+	for p.peek().kind != '<' {
+		x, err := p.parseStmt()
+		if err != nil {
+			return nil, err
+		}
+		stmts = append(stmts, x)
+	}
+	p.pos++
+	return stmts, nil
+}
+
+func (p *scriptParser) parseSimpleStmt() (scriptStmt, error) {
+	line := p.peek().line
+	switch {
+	case p.accept("pass"):
+		return &scriptPass{}, nil
+	case p.is("break") || p.is("continue"):
+		if p.loops == 0 {
+			return nil, scriptErrorf(line, "%s outside a loop", p.peek().value)
+		}
+		if p.accept("continue") {
+			return &scriptJump{line, scriptContinue}, nil
+		}
+		p.pos++
+		return &scriptJump{line, scriptBreak}, nil
+	case p.accept("return"):
+		if p.depth == 0 {
+			return nil, scriptErrorf(line, "return outside a function")
+		}
+		if p.peek().kind == '\n' {
+			return &scriptReturnStmt{line, nil}, nil
+		}
+		x, err := p.parseExpr()
+		return &scriptReturnStmt{line, x}, err
+	}
+	x, err := p.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+	for _, op := range []string{"=", "+=", "-=", "*="} {
+		if !p.accept(op) {
+			continue
+		}
+		switch x.(type) {
+		case *scriptName, *scriptAttr, *scriptIndex:
+		default:
+			return nil, scriptErrorf(line, "cannot assign to the expression")
+		}
+		y, err := p.parseExpr()
+		return &scriptAssign{line, x, strings.TrimSuffix(op, "="), y}, err
+	}
+	return &scriptExprStmt{line, x}, nil
+}
+
+func (p *scriptParser) parseExpr() (scriptExpr, error) {
+	line := p.peek().line
+	x, err := p.parseOr()
+	if err != nil || !p.accept("if") {
+		return x, err
+	}
+	cond, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect("else"); err != nil {
+		return nil, err
+	}
+	y, err := p.parseExpr()
+	return &scriptCond{line, cond, x, y}, err
+}
+
+func (p *scriptParser) parseOr() (scriptExpr, error) {
+	x, err := p.parseAnd()
+	for err == nil && p.is("or") {
+		line := p.next().line
+		var y scriptExpr
+		y, err = p.parseAnd()
+		x = &scriptBinary{line, "or", x, y}
+	}
+	return x, err
+}
+
+func (p *scriptParser) parseAnd() (scriptExpr, error) {
+	x, err := p.parseNot()
+	for err == nil && p.is("and") {
+		line := p.next().line
+		var y scriptExpr
+		y, err = p.parseNot()
+		x = &scriptBinary{line, "and", x, y}
+	}
+	return x, err
+}
+
+func (p *scriptParser) parseNot() (scriptExpr, error) {
+	if p.is("not") {
+		line := p.next().line
+		x, err := p.parseNot()
+		return &scriptUnary{line, "not", x}, err
+	}
+	return p.parseComparison()
+}
+
+func (p *scriptParser) parseComparison() (scriptExpr, error) {
+	x, err := p.parseArith()
+	if err != nil {
+		return nil, err
+	}
+	line := p.peek().line
+	op := ""
+	for _, y := range []string{"==", "!=", "<=", ">=", "<", ">", "in"} {
+		if p.accept(y) {
+			op = y
+			break
+		}
+	}
+	if len(op) == 0 && p.is("not") && p.tokens[p.pos+1].kind == 'n' && p.tokens[p.pos+1].value == "in" {
+		p.pos += 2
+		op = "not in"
+	}
+	if len(op) == 0 {
+		return x, nil
+	}
+	y, err := p.parseArith()
+	return &scriptBinary{line, op, x, y}, err
+}
+
+func (p *scriptParser) parseArith() (scriptExpr, error) {
+	x, err := p.parseTerm()
+	for err == nil && (p.is("+") || p.is("-")) {
+		t := p.next()
+		var y scriptExpr
+		y, err = p.parseTerm()
+		x = &scriptBinary{t.line, t.value, x, y}
+	}
+	return x, err
+}
+
+func (p *scriptParser) parseTerm() (scriptExpr, error) {
+	x, err := p.parseUnary()
+	for err == nil && (p.is("*") || p.is("//") || p.is("%")) {
+		t := p.next()
+		var y scriptExpr
+		y, err = p.parseUnary()
+		x = &scriptBinary{t.line, t.value, x, y}
+	}
+	return x, err
+}
+
+func (p *scriptParser) parseUnary() (scriptExpr, error) {
+	if p.is("-") {
+		line := p.next().line
+		x, err := p.parseUnary()
+		return &scriptUnary{line, "-", x}, err
+	}
+	return p.parsePostfix()
+}
+
+func (p *scriptParser) parsePostfix() (scriptExpr, error) {
+	x, err := p.parsePrimary()
+	for err == nil {
+		line := p.peek().line
+		switch {
+		case p.accept("."):
+			var name string
+			if name, err = p.name(); err == nil {
+				x = &scriptAttr{line, x, name}
+			}
+		case p.accept("("):
+			var args []scriptExpr
+			if args, err = p.parseList(")"); err == nil {
+				x = &scriptCall{line, x, args}
+			}
+		case p.accept("["):
+			index := &scriptIndex{line: line, x: x}
+			if !p.is(":") {
+				if index.lo, err = p.parseExpr(); err != nil {
+					return nil, err
+				}
+			}
+			if p.accept(":") {
+				index.slice = true
+				if !p.is("]") {
+					if index.hi, err = p.parseExpr(); err != nil {
+						return nil, err
+					}
+				}
+			}
+			x, err = index, p.expect("]")
+		default:
+			return x, nil
+		}
+	}
+	return nil, err
+}
+
+// parseList parses the expressions separated by commas up to the closing
+// bracket.
+func (p *scriptParser) parseList(end string) ([]scriptExpr, error) {
+	xs := make([]scriptExpr, 0)
+	for !p.accept(end) {
+		x, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		xs = append(xs, x)
+		if !p.is(end) {
+			if err := p.expect(","); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return xs, nil
+}
+
+func (p *scriptParser) parsePrimary() (scriptExpr, error) {
+	t := p.peek()
+	switch t.kind {
+	case '0':
+		p.pos++
+		n, err := strconv.ParseInt(t.value, 10, 64)
+		if err != nil {
+			return nil, scriptErrorf(t.line, "invalid int %s", t.value)
+		}
+		return &scriptLiteral{n}, nil
+	case '"':
+		p.pos++
+		s := t.value
+		for p.peek().kind == '"' {
+			s += p.next().value
+		}
+		return &scriptLiteral{s}, nil
+	case 'n':
+		switch t.value {
+		case "None":
+			p.pos++
+			return &scriptLiteral{nil}, nil
+		case "True", "False":
+			p.pos++
+			return &scriptLiteral{t.value == "True"}, nil
+		}
+		name, err := p.name()
+		return &scriptName{t.line, name}, err
+	}
+	switch {
+	case p.accept("("):
+		x, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		return x, p.expect(")")
+	case p.accept("["):
+		xs, err := p.parseList("]")
+		return &scriptListExpr{xs}, err
+	case p.accept("{"):
+		x := &scriptDictExpr{line: t.line}
+		for !p.accept("}") {
+			k, err := p.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect(":"); err != nil {
+				return nil, err
+			}
+			v, err := p.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+			x.keys, x.values = append(x.keys, k), append(x.values, v)
+			if !p.is("}") {
+				if err := p.expect(","); err != nil {
+					return nil, err
+				}
+			}
+		}
+		return x, nil
+	}
+	return nil, p.unexpected()
+}
+
+// Statements
+
+type scriptStmt interface {
+	exec(fr *scriptFrame) (scriptFlow, error)
+}
+
+type scriptDef struct {
+	line   int
+	name   string
+	params []string
+	body   []scriptStmt
+}
+
+type scriptIf struct {
+	line   int
+	conds  []scriptExpr // nil for else
+	bodies [][]scriptStmt
+}
+
+type scriptFor struct {
+	line int
+	name string
+	x    scriptExpr
+	body []scriptStmt
+}
+
+type scriptPass struct{}
+
+type scriptJump struct {
+	line int
+	flow scriptFlow
+}
+
+type scriptReturnStmt struct {
+	line int
+	x    scriptExpr
+}
+
+type scriptAssign struct {
+	line   int
+	target scriptExpr
+	op     string // "" for =, or the operator of an augmented assignment
+	x      scriptExpr
+}
+
+type scriptExprStmt struct {
+	line int
+	x    scriptExpr
+}
+
+func (t *scriptThread) step(line int) error {
+	t.steps++
+	if t.maxSteps > 0 && t.steps > t.maxSteps {
+		return scriptErrorf(line, "too many steps")
+	}
+	return nil
+}
+
+func execScript(fr *scriptFrame, stmts []scriptStmt) (scriptFlow, error) {
+	for _, x := range stmts {
+		flow, err := x.exec(fr)
+		if err != nil || flow != scriptNext {
+			return flow, err
+		}
+	}
+	return scriptNext, nil
+}
+
+func (x *scriptDef) exec(fr *scriptFrame) (scriptFlow, error) {
+	fr.globals[x.name] = &scriptFunc{x.name, x.params, x.body, fr.globals}
+	return scriptNext, fr.thread.step(x.line)
+}
+
+func (x *scriptIf) exec(fr *scriptFrame) (scriptFlow, error) {
+	if err := fr.thread.step(x.line); err != nil {
+		return scriptNext, err
+	}
+	for i, cond := range x.conds {
+		if cond != nil {
+			v, err := cond.eval(fr)
+			if err != nil {
+				return scriptNext, err
+			}
+			if !scriptTruth(v) {
+				continue
+			}
+		}
+		return execScript(fr, x.bodies[i])
+	}
+	return scriptNext, nil
+}
+
+func (x *scriptFor) exec(fr *scriptFrame) (scriptFlow, error) {
+	v, err := x.x.eval(fr)
+	if err != nil {
+		return scriptNext, err
+	}
+	var elems []scriptValue
+	switch v := v.(type) {
+	case *scriptList:
+		elems = append(elems, v.elems...)
+	case *scriptDict:
+		elems = append(elems, v.keys...)
+	default:
+		return scriptNext, scriptErrorf(x.line, "%s is not iterable", scriptType(v))
+	}
+	for _, elem := range elems {
+		if err := fr.thread.step(x.line); err != nil {
+			return scriptNext, err
+		}
+		fr.set(x.name, elem)
+		flow, err := execScript(fr, x.body)
+		if err != nil || flow == scriptReturn {
+			return flow, err
+		}
+		if flow == scriptBreak {
+			break
+		}
+	}
+	return scriptNext, nil
+}
+
+func (x *scriptPass) exec(fr *scriptFrame) (scriptFlow, error) {
+	return scriptNext, nil
+}
+
+func (x *scriptJump) exec(fr *scriptFrame) (scriptFlow, error) {
+	return x.flow, fr.thread.step(x.line)
+}
+
+func (x *scriptReturnStmt) exec(fr *scriptFrame) (scriptFlow, error) {
+	fr.ret = nil
+	if x.x != nil {
+		v, err := x.x.eval(fr)
+		if err != nil {
+			return scriptNext, err
+		}
+		fr.ret = v
+	}
+	return scriptReturn, fr.thread.step(x.line)
+}
+
+func (x *scriptAssign) exec(fr *scriptFrame) (scriptFlow, error) {
+	if err := fr.thread.step(x.line); err != nil {
+		return scriptNext, err
+	}
+	v, err := x.x.eval(fr)
+	if err != nil {
+		return scriptNext, err
+	}
+	if len(x.op) > 0 {
+		old, err := x.target.eval(fr)
+		if err != nil {
+			return scriptNext, err
+		}
+		if v, err = scriptBinaryOp(x.op, old, v); err != nil {
+			return scriptNext, scriptWrap(x.line, err)
+		}
+	}
+	switch target := x.target.(type) {
+	case *scriptName:
+		fr.set(target.name, v)
+	case *scriptAttr:
+		obj, err := target.x.eval(fr)
+		if err != nil {
+			return scriptNext, err
+		}
+		o, ok := obj.(scriptObject)
+		if !ok {
+			return scriptNext, scriptErrorf(x.line, "cannot set attributes of %s", scriptType(obj))
+		}
+		if err := o.setAttr(target.name, v); err != nil {
+			return scriptNext, scriptWrap(x.line, err)
+		}
+	case *scriptIndex:
+		if target.slice {
+			return scriptNext, scriptErrorf(x.line, "cannot assign to a slice")
+		}
+		obj, err := target.x.eval(fr)
+		if err != nil {
+			return scriptNext, err
+		}
+		key, err := target.lo.eval(fr)
+		if err != nil {
+			return scriptNext, err
+		}
+		if err := scriptSetIndex(obj, key, v); err != nil {
+			return scriptNext, scriptWrap(x.line, err)
+		}
+	}
+	return scriptNext, nil
+}
+
+func (x *scriptExprStmt) exec(fr *scriptFrame) (scriptFlow, error) {
+	if err := fr.thread.step(x.line); err != nil {
+		return scriptNext, err
+	}
+	_, err := x.x.eval(fr)
+	return scriptNext, err
+}
+
+func (fr *scriptFrame) set(name string, v scriptValue) {
+	if fr.locals != nil {
+		fr.locals[name] = v
+	} else {
+		fr.globals[name] = v
+	}
+}
+
+// scriptWrap gives the line to an error of an operation or a builtin.
+func scriptWrap(line int, err error) error {
+	var scriptErr *scriptError
+	var reject scriptReject
+	if err == nil || errors.As(err, &scriptErr) || errors.As(err, &reject) {
+		return err
+	}
+	return &scriptError{line, err.Error()}
+}
+
+// Expressions
+
+type scriptExpr interface {
+	eval(fr *scriptFrame) (scriptValue, error)
+}
+
+type scriptLiteral struct {
+	v scriptValue
+}
+
+type scriptName struct {
+	line int
+	name string
+}
+
+type scriptListExpr struct {
+	elems []scriptExpr
+}
+
+type scriptDictExpr struct {
+	line   int
+	keys   []scriptExpr
+	values []scriptExpr
+}
+
+type scriptUnary struct {
+	line int
+	op   string
+	x    scriptExpr
+}
+
+type scriptBinary struct {
+	line int
+	op   string
+	x, y scriptExpr
+}
+
+type scriptCond struct {
+	line int
+	cond scriptExpr
+	x, y scriptExpr
+}
+
+type scriptAttr struct {
+	line int
+	x    scriptExpr
+	name string
+}
+
+type scriptCall struct {
+	line int
+	fn   scriptExpr
+	args []scriptExpr
+}
+
+type scriptIndex struct {
+	line   int
+	x      scriptExpr
+	lo, hi scriptExpr
+	slice  bool
+}
+
+func (x *scriptLiteral) eval(fr *scriptFrame) (scriptValue, error) {
+	return x.v, nil
+}
+
+func (x *scriptName) eval(fr *scriptFrame) (scriptValue, error) {
+	if v, ok := fr.locals[x.name]; ok {
+		return v, nil
+	}
+	if v, ok := fr.globals[x.name]; ok {
+		return v, nil
+	}
+	if v, ok := scriptBuiltins[x.name]; ok {
+		return v, nil
+	}
+	return nil, scriptErrorf(x.line, "undefined: %s", x.name)
+}
+
+func (x *scriptListExpr) eval(fr *scriptFrame) (scriptValue, error) {
+	l := &scriptList{elems: make([]scriptValue, 0, len(x.elems))}
+	for _, elem := range x.elems {
+		v, err := elem.eval(fr)
+		if err != nil {
+			return nil, err
+		}
+		l.elems = append(l.elems, v)
+	}
+	return l, nil
+}
+
+func (x *scriptDictExpr) eval(fr *scriptFrame) (scriptValue, error) {
+	d := newScriptDict()
+	for i := range x.keys {
+		k, err := x.keys[i].eval(fr)
+		if err != nil {
+			return nil, err
+		}
+		v, err := x.values[i].eval(fr)
+		if err != nil {
+			return nil, err
+		}
+		if err := d.set(k, v); err != nil {
+			return nil, scriptWrap(x.line, err)
+		}
+	}
+	return d, nil
+}
+
+func (x *scriptUnary) eval(fr *scriptFrame) (scriptValue, error) {
+	v, err := x.x.eval(fr)
+	if err != nil {
+		return nil, err
+	}
+	if x.op == "not" {
+		return !scriptTruth(v), nil
+	}
+	n, ok := v.(int64)
+	if !ok {
+		return nil, scriptErrorf(x.line, "unsupported operand for -: %s", scriptType(v))
+	}
+	return -n, nil
+}
+
+func (x *scriptBinary) eval(fr *scriptFrame) (scriptValue, error) {
+	v, err := x.x.eval(fr)
+	if err != nil {
+		return nil, err
+	}
+	switch x.op {
+	case "and":
+		if !scriptTruth(v) {
+			return v, nil
+		}
+		return x.y.eval(fr)
+	case "or":
+		if scriptTruth(v) {
+			return v, nil
+		}
+		return x.y.eval(fr)
+	}
+	w, err := x.y.eval(fr)
+	if err != nil {
+		return nil, err
+	}
+	v, err = scriptBinaryOp(x.op, v, w)
+	return v, scriptWrap(x.line, err)
+}
+
+func (x *scriptCond) eval(fr *scriptFrame) (scriptValue, error) {
+	v, err := x.cond.eval(fr)
+	if err != nil {
+		return nil, err
+	}
+	if scriptTruth(v) {
+		return x.x.eval(fr)
+	}
+	return x.y.eval(fr)
+}
+
+func (x *scriptAttr) eval(fr *scriptFrame) (scriptValue, error) {
+	v, err := x.x.eval(fr)
+	if err != nil {
+		return nil, err
+	}
+	if attr, ok := scriptGetAttr(v, x.name); ok {
+		return attr, nil
+	}
+	return nil, scriptErrorf(x.line, "%s has no attribute %s", scriptType(v), x.name)
+}
+
+func (x *scriptCall) eval(fr *scriptFrame) (scriptValue, error) {
+	fn, err := x.fn.eval(fr)
+	if err != nil {
+		return nil, err
+	}
+	args := make([]scriptValue, 0, len(x.args))
+	for _, arg := range x.args {
+		v, err := arg.eval(fr)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, v)
+	}
+	switch fn := fn.(type) {
+	case *scriptBuiltin:
+		v, err := fn.fn(args)
+		if err != nil {
+			return nil, scriptWrap(x.line, fmt.Errorf("%s: %w", fn.name, err))
+		}
+		return v, nil
+	case *scriptFunc:
+		v, err := fn.call(fr.thread, args)
+		return v, scriptWrap(x.line, err)
+	}
+	return nil, scriptErrorf(x.line, "%s is not callable", scriptType(fn))
+}
+
+func (x *scriptIndex) eval(fr *scriptFrame) (scriptValue, error) {
+	v, err := x.x.eval(fr)
+	if err != nil {
+		return nil, err
+	}
+	var lo, hi scriptValue
+	if x.lo != nil {
+		if lo, err = x.lo.eval(fr); err != nil {
+			return nil, err
+		}
+	}
+	if x.hi != nil {
+		if hi, err = x.hi.eval(fr); err != nil {
+			return nil, err
+		}
+	}
+	if x.slice {
+		v, err = scriptSlice(v, lo, hi)
+	} else {
+		v, err = scriptGetIndex(v, lo)
+	}
+	return v, scriptWrap(x.line, err)
+}
+
+func (f *scriptFunc) call(thread *scriptThread, args []scriptValue) (scriptValue, error) {
+	if len(args) != len(f.params) {
+		return nil, fmt.Errorf("%s takes %d arguments, %d given", f.name, len(f.params), len(args))
+	}
+	for _, x := range thread.stack {
+		if x == f {
+			return nil, fmt.Errorf("%s called recursively", f.name)
+		}
+	}
+	thread.stack = append(thread.stack, f)
+	defer func() { thread.stack = thread.stack[:len(thread.stack)-1] }()
+	fr := &scriptFrame{thread: thread, locals: make(map[string]scriptValue), globals: f.globals}
+	for i, x := range f.params {
+		fr.locals[x] = args[i]
+	}
+	if _, err := execScript(fr, f.body); err != nil {
+		return nil, err
+	}
+	return fr.ret, nil
+}
+
+// Values
+
+func newScriptDict() *scriptDict {
+	return &scriptDict{values: make(map[scriptValue]scriptValue)}
+}
+
+func (d *scriptDict) set(k, v scriptValue) error {
+	if d.frozen {
+		return errScriptFrozen
+	}
+	switch k.(type) {
+	case bool, int64, string:
+	default:
+		return fmt.Errorf("unhashable key: %s", scriptType(k))
+	}
+	if _, ok := d.values[k]; !ok {
+		d.keys = append(d.keys, k)
+	}
+	d.values[k] = v
+	return nil
+}
+
+func (d *scriptDict) get(k scriptValue) (scriptValue, bool) {
+	switch k.(type) {
+	case bool, int64, string:
+		v, ok := d.values[k]
+		return v, ok
+	}
+	return nil, false
+}
+
+// scriptFreeze makes the value and the values it contains immutable.
+func scriptFreeze(v scriptValue) {
+	switch v := v.(type) {
+	case *scriptList:
+		if !v.frozen {
+			v.frozen = true
+			for _, x := range v.elems {
+				scriptFreeze(x)
+			}
+		}
+	case *scriptDict:
+		if !v.frozen {
+			v.frozen = true
+			for _, k := range v.keys {
+				scriptFreeze(v.values[k])
+			}
+		}
+	}
+}
+
+func scriptType(v scriptValue) string {
+	switch v.(type) {
+	case nil:
+		return "NoneType"
+	case bool:
+		return "bool"
+	case int64:
+		return "int"
+	case string:
+		return "string"
+	case *scriptList:
+		return "list"
+	case *scriptDict:
+		return "dict"
+	case *scriptFunc:
+		return "function"
+	case *scriptBuiltin:
+		return "builtin_function"
+	}
+	return "object"
+}
+
+func scriptTruth(v scriptValue) bool {
+	switch v := v.(type) {
+	case nil:
+		return false
+	case bool:
+		return v
+	case int64:
+		return v != 0
+	case string:
+		return len(v) > 0
+	case *scriptList:
+		return len(v.elems) > 0
+	case *scriptDict:
+		return len(v.keys) > 0
+	}
+	return true
+}
+
+// scriptString returns the value as str does, where repr quotes strings.
+func scriptString(v scriptValue, repr bool) string {
+	switch v := v.(type) {
+	case nil:
+		return "None"
+	case bool:
+		if v {
+			return "True"
+		}
+		return "False"
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case string:
+		if repr {
+			return strconv.Quote(v)
+		}
+		return v
+	case *scriptList:
+		xs := make([]string, len(v.elems))
+		for i, x := range v.elems {
+			xs[i] = scriptString(x, true)
+		}
+		return "[" + strings.Join(xs, ", ") + "]"
+	case *scriptDict:
+		xs := make([]string, len(v.keys))
+		for i, k := range v.keys {
+			xs[i] = scriptString(k, true) + ": " + scriptString(v.values[k], true)
+		}
+		return "{" + strings.Join(xs, ", ") + "}"
+	case *scriptFunc:
+		return "<function " + v.name + ">"
+	case *scriptBuiltin:
+		return "<built-in function " + v.name + ">"
+	}
+	return "<" + scriptType(v) + ">"
+}
+
+func scriptEqual(x, y scriptValue) bool {
+	switch x := x.(type) {
+	case *scriptList:
+		y, ok := y.(*scriptList)
+		if !ok || len(x.elems) != len(y.elems) {
+			return false
+		}
+		for i := range x.elems {
+			if !scriptEqual(x.elems[i], y.elems[i]) {
+				return false
+			}
+		}
+		return true
+	case *scriptDict:
+		y, ok := y.(*scriptDict)
+		if !ok || len(x.keys) != len(y.keys) {
+			return false
+		}
+		for _, k := range x.keys {
+			if v, ok := y.values[k]; !ok || !scriptEqual(x.values[k], v) {
+				return false
+			}
+		}
+		return true
+	case *scriptBuiltin:
+		return false
+	}
+	switch y.(type) {
+	case *scriptList, *scriptDict, *scriptBuiltin:
+		return false
+	}
+	return x == y
+}
+
+// scriptMaxLen is the maximum length of the strings and lists which
+// scripts build, which would otherwise exhaust the memory well within the
+// steps by doubling one in a loop.
+const scriptMaxLen = 1 << 20
+
+var (
+	errScriptStringTooLong = errors.New("string too long")
+	errScriptListTooLong   = errors.New("list too long")
+)
+
+func scriptBinaryOp(op string, x, y scriptValue) (scriptValue, error) {
+	switch op {
+	case "==":
+		return scriptEqual(x, y), nil
+	case "!=":
+		return !scriptEqual(x, y), nil
+	case "in", "not in":
+		var found bool
+		switch y := y.(type) {
+		case string:
+			s, ok := x.(string)
+			if !ok {
+				return nil, fmt.Errorf("'in <string>' requires a string, not %s", scriptType(x))
+			}
+			found = strings.Contains(y, s)
+		case *scriptList:
+			for _, elem := range y.elems {
+				if scriptEqual(x, elem) {
+					found = true
+					break
+				}
+			}
+		case *scriptDict:
+			_, found = y.get(x)
+		default:
+			return nil, fmt.Errorf("unsupported operand for in: %s", scriptType(y))
+		}
+		return found == (op == "in"), nil
+	}
+	switch x := x.(type) {
+	case int64:
+		y, ok := y.(int64)
+		if !ok {
+			break
+		}
+		switch op {
+		case "+":
+			return x + y, nil
+		case "-":
+			return x - y, nil
+		case "*":
+			return x * y, nil
+		case "//", "%":
+			if y == 0 {
+				return nil, errors.New("division by zero")
+			}
+			// floored as in Python
+			q, r := x/y, x%y
+			if r != 0 && (r < 0) != (y < 0) {
+				q, r = q-1, r+y
+			}
+			if op == "//" {
+				return q, nil
+			}
+			return r, nil
+		case "<":
+			return x < y, nil
+		case "<=":
+			return x <= y, nil
+		case ">":
+			return x > y, nil
+		case ">=":
+			return x >= y, nil
+		}
+	case string:
+		switch y := y.(type) {
+		case string:
+			switch op {
+			case "+":
+				if len(x)+len(y) > scriptMaxLen {
+					return nil, errScriptStringTooLong
+				}
+				return x + y, nil
+			case "<":
+				return x < y, nil
+			case "<=":
+				return x <= y, nil
+			case ">":
+				return x > y, nil
+			case ">=":
+				return x >= y, nil
+			}
+		case int64:
+			if op == "*" {
+				if y < 0 {
+					y = 0
+				}
+				if len(x) > 0 && y > scriptMaxLen/int64(len(x)) {
+					return nil, errScriptStringTooLong
+				}
+				return strings.Repeat(x, int(y)), nil
+			}
+		}
+	case *scriptList:
+		if y, ok := y.(*scriptList); ok && op == "+" {
+			if len(x.elems)+len(y.elems) > scriptMaxLen {
+				return nil, errScriptListTooLong
+			}
+			return &scriptList{elems: append(append([]scriptValue{}, x.elems...), y.elems...)}, nil
+		}
+	}
+	return nil, fmt.Errorf("unsupported operands for %s: %s and %s", op, scriptType(x), scriptType(y))
+}
+
+// scriptIndexOf returns the index in a sequence of the length, counting
+// from the end if negative.
+func scriptIndexOf(v scriptValue, n int) (int, error) {
+	i, ok := v.(int64)
+	if !ok {
+		return 0, fmt.Errorf("index must be an int, not %s", scriptType(v))
+	}
+	if i < 0 {
+		i += int64(n)
+	}
+	if i < 0 || i >= int64(n) {
+		return 0, errors.New("index out of range")
+	}
+	return int(i), nil
+}
+
+func scriptGetIndex(v, key scriptValue) (scriptValue, error) {
+	switch v := v.(type) {
+	case *scriptList:
+		i, err := scriptIndexOf(key, len(v.elems))
+		if err != nil {
+			return nil, err
+		}
+		return v.elems[i], nil
+	case string:
+		i, err := scriptIndexOf(key, len(v))
+		if err != nil {
+			return nil, err
+		}
+		return v[i : i+1], nil
+	case *scriptDict:
+		if x, ok := v.get(key); ok {
+			return x, nil
+		}
+		return nil, fmt.Errorf("key %s not found", scriptString(key, true))
+	}
+	return nil, fmt.Errorf("%s is not indexable", scriptType(v))
+}
+
+func scriptSetIndex(v, key, x scriptValue) error {
+	switch v := v.(type) {
+	case *scriptList:
+		if v.frozen {
+			return errScriptFrozen
+		}
+		i, err := scriptIndexOf(key, len(v.elems))
+		if err != nil {
+			return err
+		}
+		v.elems[i] = x
+		return nil
+	case *scriptDict:
+		return v.set(key, x)
+	}
+	return fmt.Errorf("cannot assign to an index of %s", scriptType(v))
+}
+
+func scriptSlice(v, lo, hi scriptValue) (scriptValue, error) {
+	n := 0
+	switch v := v.(type) {
+	case *scriptList:
+		n = len(v.elems)
+	case string:
+		n = len(v)
+	default:
+		return nil, fmt.Errorf("%s cannot be sliced", scriptType(v))
+	}
+	bound := func(x scriptValue, def int) (int, error) {
+		if x == nil {
+			return def, nil
+		}
+		i, ok := x.(int64)
+		if !ok {
+			return 0, fmt.Errorf("slice index must be an int, not %s", scriptType(x))
+		}
+		if i < 0 {
+			i += int64(n)
+		}
+		if i < 0 {
+			return 0, nil
+		}
+		if i > int64(n) {
+			return n, nil
+		}
+		return int(i), nil
+	}
+	i, err := bound(lo, 0)
+	if err != nil {
+		return nil, err
+	}
+	j, err := bound(hi, n)
+	if err != nil {
+		return nil, err
+	}
+	if j < i {
+		j = i
+	}
+	if s, ok := v.(string); ok {
+		return s[i:j], nil
+	}
+	return &scriptList{elems: append([]scriptValue{}, v.(*scriptList).elems[i:j]...)}, nil
+}
+
+// scriptArgs checks the number and the types of the arguments, where the
+// kinds are "s" for a string, "i" for an int, "l" for a list and "*" for
+// any value. Optional arguments follow a "|".
+func scriptArgs(args []scriptValue, kinds string) error {
+	min, max := len(kinds), len(kinds)
+	if i := strings.IndexByte(kinds, '|'); i >= 0 {
+		kinds = kinds[:i] + kinds[i+1:]
+		min, max = i, len(kinds)
+	}
+	if len(args) < min || len(args) > max {
+		if min == max {
+			return fmt.Errorf("takes %d arguments, %d given", max, len(args))
+		}
+		return fmt.Errorf("takes %d to %d arguments, %d given", min, max, len(args))
+	}
+	for i, x := range args {
+		ok := true
+		switch kinds[i] {
+		case 's':
+			_, ok = x.(string)
+		case 'i':
+			_, ok = x.(int64)
+		case 'l':
+			_, ok = x.(*scriptList)
+		}
+		if !ok {
+			return fmt.Errorf("argument %d must be %s, not %s", i+1,
+				map[byte]string{'s': "a string", 'i': "an int", 'l': "a list"}[kinds[i]], scriptType(x))
+		}
+	}
+	return nil
+}
+
+func scriptMethod(name string, fn func(args []scriptValue) (scriptValue, error)) *scriptBuiltin {
+	return &scriptBuiltin{name, fn}
+}
+
+func scriptGetAttr(v scriptValue, name string) (scriptValue, bool) {
+	switch v := v.(type) {
+	case string:
+		return scriptStringMethod(v, name)
+	case *scriptList:
+		if name == "append" {
+			return scriptMethod(name, func(args []scriptValue) (scriptValue, error) {
+				if err := scriptArgs(args, "*"); err != nil {
+					return nil, err
+				}
+				if v.frozen {
+					return nil, errScriptFrozen
+				}
+				if len(v.elems) >= scriptMaxLen {
+					return nil, errScriptListTooLong
+				}
+				v.elems = append(v.elems, args[0])
+				return nil, nil
+			}), true
+		}
+	case *scriptDict:
+		switch name {
+		case "get":
+			return scriptMethod(name, func(args []scriptValue) (scriptValue, error) {
+				if err := scriptArgs(args, "*|*"); err != nil {
+					return nil, err
+				}
+				if x, ok := v.get(args[0]); ok {
+					return x, nil
+				}
+				if len(args) > 1 {
+					return args[1], nil
+				}
+				return nil, nil
+			}), true
+		case "keys", "values":
+			return scriptMethod(name, func(args []scriptValue) (scriptValue, error) {
+				if err := scriptArgs(args, ""); err != nil {
+					return nil, err
+				}
+				l := &scriptList{elems: make([]scriptValue, 0, len(v.keys))}
+				for _, k := range v.keys {
+					if name == "keys" {
+						l.elems = append(l.elems, k)
+					} else {
+						l.elems = append(l.elems, v.values[k])
+					}
+				}
+				return l, nil
+			}), true
+		}
+	case scriptObject:
+		return v.attr(name)
+	}
+	return nil, false
+}
+
+func scriptStringMethod(s, name string) (scriptValue, bool) {
+	var fn func(args []scriptValue) (scriptValue, error)
+	switch name {
+	case "lower", "upper", "strip":
+		fn = func(args []scriptValue) (scriptValue, error) {
+			if err := scriptArgs(args, ""); err != nil {
+				return nil, err
+			}
+			switch name {
+			case "lower":
+				return strings.ToLower(s), nil
+			case "upper":
+				return strings.ToUpper(s), nil
+			}
+			return strings.TrimSpace(s), nil
+		}
+	case "startswith", "endswith", "find", "count":
+		fn = func(args []scriptValue) (scriptValue, error) {
+			if err := scriptArgs(args, "s"); err != nil {
+				return nil, err
+			}
+			x := args[0].(string)
+			switch name {
+			case "startswith":
+				return strings.HasPrefix(s, x), nil
+			case "endswith":
+				return strings.HasSuffix(s, x), nil
+			case "find":
+				return int64(strings.Index(s, x)), nil
+			}
+			return int64(strings.Count(s, x)), nil
+		}
+	case "split":
+		fn = func(args []scriptValue) (scriptValue, error) {
+			if err := scriptArgs(args, "|s"); err != nil {
+				return nil, err
+			}
+			var xs []string
+			if len(args) == 0 {
+				xs = strings.Fields(s)
+			} else if sep := args[0].(string); len(sep) == 0 {
+				return nil, errors.New("empty separator")
+			} else {
+				xs = strings.Split(s, sep)
+			}
+			l := &scriptList{elems: make([]scriptValue, len(xs))}
+			for i, x := range xs {
+				l.elems[i] = x
+			}
+			return l, nil
+		}
+	case "replace":
+		fn = func(args []scriptValue) (scriptValue, error) {
+			if err := scriptArgs(args, "ss"); err != nil {
+				return nil, err
+			}
+			old, new := args[0].(string), args[1].(string)
+			n := int64(strings.Count(s, old))
+			if int64(len(s))+n*(int64(len(new))-int64(len(old))) > scriptMaxLen {
+				return nil, errScriptStringTooLong
+			}
+			return strings.ReplaceAll(s, old, new), nil
+		}
+	case "join":
+		fn = func(args []scriptValue) (scriptValue, error) {
+			if err := scriptArgs(args, "l"); err != nil {
+				return nil, err
+			}
+			xs := make([]string, 0)
+			size := 0
+			for _, x := range args[0].(*scriptList).elems {
+				v, ok := x.(string)
+				if !ok {
+					return nil, fmt.Errorf("cannot join %s", scriptType(x))
+				}
+				if len(xs) > 0 {
+					size += len(s)
+				}
+				if size += len(v); size > scriptMaxLen {
+					return nil, errScriptStringTooLong
+				}
+				xs = append(xs, v)
+			}
+			return strings.Join(xs, s), nil
+		}
+	default:
+		return nil, false
+	}
+	return scriptMethod(name, fn), true
+}
+
+var scriptBuiltins map[string]scriptValue
+
+func init() {
+	scriptBuiltins = map[string]scriptValue{
+		"len": scriptMethod("len", func(args []scriptValue) (scriptValue, error) {
+			if err := scriptArgs(args, "*"); err != nil {
+				return nil, err
+			}
+			switch x := args[0].(type) {
+			case string:
+				return int64(len(x)), nil
+			case *scriptList:
+				return int64(len(x.elems)), nil
+			case *scriptDict:
+				return int64(len(x.keys)), nil
+			}
+			return nil, fmt.Errorf("%s has no len", scriptType(args[0]))
+		}),
+		"str": scriptMethod("str", func(args []scriptValue) (scriptValue, error) {
+			if err := scriptArgs(args, "*"); err != nil {
+				return nil, err
+			}
+			return scriptString(args[0], false), nil
+		}),
+		"int": scriptMethod("int", func(args []scriptValue) (scriptValue, error) {
+			if err := scriptArgs(args, "*"); err != nil {
+				return nil, err
+			}
+			switch x := args[0].(type) {
+			case int64:
+				return x, nil
+			case bool:
+				if x {
+					return int64(1), nil
+				}
+				return int64(0), nil
+			case string:
+				n, err := strconv.ParseInt(strings.TrimSpace(x), 10, 64)
+				if err != nil {
+					return nil, fmt.Errorf("invalid literal %s", strconv.Quote(x))
+				}
+				return n, nil
+			}
+			return nil, fmt.Errorf("cannot convert %s", scriptType(args[0]))
+		}),
+		"bool": scriptMethod("bool", func(args []scriptValue) (scriptValue, error) {
+			if err := scriptArgs(args, "*"); err != nil {
+				return nil, err
+			}
+			return scriptTruth(args[0]), nil
+		}),
+		"range": scriptMethod("range", func(args []scriptValue) (scriptValue, error) {
+			if err := scriptArgs(args, "i"); err != nil {
+				return nil, err
+			}
+			n := args[0].(int64)
+			if n > 1<<16 {
+				return nil, errors.New("range too large")
+			}
+			l := &scriptList{}
+			for i := int64(0); i < n; i++ {
+				l.elems = append(l.elems, i)
+			}
+			return l, nil
+		}),
+		"sorted": scriptMethod("sorted", func(args []scriptValue) (scriptValue, error) {
+			if err := scriptArgs(args, "l"); err != nil {
+				return nil, err
+			}
+			l := &scriptList{elems: append([]scriptValue{}, args[0].(*scriptList).elems...)}
+			var err error
+			sort.SliceStable(l.elems, func(i, j int) bool {
+				less, e := scriptBinaryOp("<", l.elems[i], l.elems[j])
+				if e != nil {
+					err = e
+					return false
+				}
+				return less.(bool)
+			})
+			return l, err
+		}),
+		"reject": scriptMethod("reject", func(args []scriptValue) (scriptValue, error) {
+			if err := scriptArgs(args, "is"); err != nil {
+				return nil, err
+			}
+			code := args[0].(int64)
+			if code < 400 || code > 599 {
+				return nil, fmt.Errorf("invalid reply code %d", code)
+			}
+			return nil, scriptReject(fmt.Sprintf("%d %s", code, oneLine(args[1].(string))))
+		}),
+	}
+}
@@ -0,0 +1,107 @@
+package smtp
+
+import (
+	"strings"
+	"testing"
+)
+
+// evalScript runs the script and returns the value of the global result.
+func evalScript(t *testing.T, src string) (string, error) {
+	t.Helper()
+	tokens, err := scriptTokenize(src)
+	if err != nil {
+		return "", err
+	}
+	p := &scriptParser{tokens: tokens}
+	stmts, err := p.parseFile()
+	if err != nil {
+		return "", err
+	}
+	fr := &scriptFrame{thread: &scriptThread{maxSteps: 1000}, globals: make(map[string]scriptValue)}
+	if _, err := execScript(fr, stmts); err != nil {
+		return "", err
+	}
+	return scriptString(fr.globals["result"], true), nil
+}
+
+func TestScriptLanguage(t *testing.T) {
+	for _, fixture := range []struct {
+		src      string
+		expected string
+	}{
+		{"result = 1 + 2 * 3 - 4 // 3", "6"},
+		{"result = [-7 // 2, -7 % 2, 7 % -2]", "[-4, 1, -1]"},
+		{"result = 'a' + \"b\" 'c' + 'x' * 3", `"abcxxx"`},
+		{"result = [1 < 2, 'a' >= 'b', 1 == 1 and 2 != 3, not None, 0 or 'x']", `[True, False, True, True, "x"]`},
+		{"result = ['ell' in 'hello', 2 not in [1, 2], 'k' in {'k': 1}]", "[True, False, True]"},
+		{"result = 'yes' if len([1, 2]) == 2 else 'no'", `"yes"`},
+		{"xs = [1, 2, 3]\nresult = [xs[0], xs[-1], xs[1:], xs[:-1], 'hello'[1:3]]", `[1, 3, [2, 3], [1, 2], "el"]`},
+		{"d = {'a': 1}\nd['b'] = 2\nresult = [d.get('b'), d.get('c', 0), d.keys(), d]", `[2, 0, ["a", "b"], {"a": 1, "b": 2}]`},
+		{"result = ' A,b '.strip().lower().split(',') + ['-'.join(['x', 'y'])]", `["a", "b", "x-y"]`},
+		{"result = [str(12) + str(None), int(' 42 '), bool([]), sorted([3, 1, 2]), range(3)]", `["12None", 42, False, [1, 2, 3], [0, 1, 2]]`},
+		{`
+def total(xs):
+    n = 0
+    for x in xs:
+        if x == 3:
+            continue
+        if x > 4:
+            break
+        n += x
+    return n
+
+result = total(range(10))
+`, "7"},
+		{`
+def classify(n):
+    if n < 0:
+        return "negative"
+    elif n == 0: return "zero"
+    else:
+        pass
+    return "positive"
+
+result = [classify(-1), classify(0), classify(1)]
+`, `["negative", "zero", "positive"]`},
+	} {
+		actual, err := evalScript(t, fixture.src)
+		if err != nil {
+			t.Errorf("%s: %v", fixture.src, err)
+		} else if actual != fixture.expected {
+			t.Errorf("expected: %s, actual: %s", fixture.expected, actual)
+		}
+	}
+}
+
+func TestScriptErrors(t *testing.T) {
+	for _, fixture := range []struct {
+		src      string
+		expected string
+	}{
+		{"x = (1 +", "line 1: unclosed bracket"},
+		{"if True:\nx = 1", "line 2: expected an indented block"},
+		{"def f():\n    x = 1\n  y = 2", "line 3: inconsistent indentation"},
+		{"x = 'abc", "line 1: unterminated string"},
+		{"1 = x", "line 1: cannot assign to the expression"},
+		{"break", "line 1: break outside a loop"},
+		{"return 1", "line 1: return outside a function"},
+		{"x = y", "line 1: undefined: y"},
+		{"x = 1 + 'a'", "line 1: unsupported operands for +: int and string"},
+		{"x = [1][2]", "line 1: index out of range"},
+		{"x = 1 // 0", "line 1: division by zero"},
+		{"x = len(1, 2)", "line 1: len: takes 1 arguments, 2 given"},
+		{"def f():\n    return f()\nx = f()", "line 2: f called recursively"},
+		{"def f():\n    for x in range(1000):\n        pass\nf()", "too many steps"},
+		{"x = 'ab' * 4611686018427387904", "line 1: string too long"},
+		{"x = 'ab' * 1000000", "line 1: string too long"},
+		{"def f():\n    s = 'ab'\n    for i in range(100):\n        s = s + s\nf()", "line 4: string too long"},
+		{"def f():\n    l = [1]\n    for i in range(100):\n        l += l\nf()", "line 4: list too long"},
+		{"x = ('a' * 1000).replace('a', 'b' * 2000)", "line 1: replace: string too long"},
+		{"x = ','.join(['a' * 600000, 'b' * 600000])", "line 1: join: string too long"},
+	} {
+		_, err := evalScript(t, fixture.src)
+		if err == nil || !strings.Contains(err.Error(), fixture.expected) {
+			t.Errorf("expected: %s, actual: %v", fixture.expected, err)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package smtp
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	EventAuthFailure  = "auth_failure"
+	EventAuthLockout  = "auth_lockout"
+	EventPolicyReject = "policy_reject"
+	EventRateLimit    = "rate_limit"
+	EventTLSFailure   = "tls_failure"
+)
+
+// SecurityLogger writes one line per security event in the form
+//
+//	2006-01-02T15:04:05Z mproxy event=auth_failure ip=192.0.2.1 user="foo"
+//
+// which is stable enough to be matched by fail2ban or CrowdSec filters.
+type SecurityLogger struct {
+	w   io.Writer
+	mtx sync.Mutex
+}
+
+func NewSecurityLogger(w io.Writer) *SecurityLogger {
+	return &SecurityLogger{w: w}
+}
+
+func (l *SecurityLogger) Log(event, ip string, kvs ...string) error {
+	s := fmt.Sprintf("%s mproxy event=%s ip=%s",
+		time.Now().UTC().Format(time.RFC3339), event, formatLogValue(ip))
+	for i := 0; i+1 < len(kvs); i += 2 {
+		s += fmt.Sprintf(" %s=%s", kvs[i], formatLogValue(kvs[i+1]))
+	}
+	defer l.mtx.Unlock()
+	l.mtx.Lock()
+	_, err := io.WriteString(l.w, s+"\n")
+	return err
+}
+
+func formatLogValue(s string) string {
+	if len(s) == 0 {
+		return "-"
+	}
+	if strings.ContainsAny(s, " \t\r\n\"=") || !strconv.CanBackquote(s) {
+		return strconv.Quote(s)
+	}
+	return s
+}
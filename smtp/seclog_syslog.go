@@ -0,0 +1,26 @@
+//go:build !windows && !plan9
+
+package smtp
+
+import (
+	"log/slog"
+	"log/syslog"
+)
+
+func NewSyslogSecurityLogger(tag string) (*SecurityLogger, error) {
+	w, err := syslog.New(syslog.LOG_AUTH|syslog.LOG_WARNING, tag)
+	if err != nil {
+		return nil, err
+	}
+	return NewSecurityLogger(w), nil
+}
+
+// NewSyslogLogger returns a logger like NewLogger writing to the mail
+// facility of syslog.
+func NewSyslogLogger(tag, level string) (*slog.Logger, error) {
+	w, err := syslog.New(syslog.LOG_MAIL|syslog.LOG_INFO, tag)
+	if err != nil {
+		return nil, err
+	}
+	return NewLogger(w, level)
+}
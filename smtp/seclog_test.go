@@ -0,0 +1,61 @@
+package smtp
+
+import (
+	"bytes"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestSecurityLoggerLog(t *testing.T) {
+	var buf bytes.Buffer
+	l := NewSecurityLogger(&buf)
+	l.Log(EventAuthFailure, "192.0.2.1", "mechanism", "PLAIN", "user", "foo bar")
+	l.Log(EventAuthLockout, "", "user", "")
+	pattern := regexp.MustCompile(
+		`^\S+ mproxy event=auth_failure ip=192\.0\.2\.1 mechanism=PLAIN user="foo bar"\n` +
+			`\S+ mproxy event=auth_lockout ip=- user=-\n$`)
+	if !pattern.MatchString(buf.String()) {
+		t.Errorf("unexpected log lines: %s", buf.String())
+	}
+}
+
+func TestRateLimitEvents(t *testing.T) {
+	conn := NewMockConn([]byte("EHLO localhost\r\n" +
+		"MAIL FROM: <foo@example.net>\r\n" +
+		"RCPT TO: <user1@example.com>\r\n" +
+		"RCPT TO: <user2@example.com>\r\n" +
+		"DATA\r\n" +
+		"Hello\r\n" +
+		".\r\n" +
+		"MAIL FROM: <foo@example.net>\r\n" +
+		"RCPT TO: <user1@example.com>\r\n" +
+		"DATA\r\n" +
+		"Subject: Too large for the budget\r\n" +
+		"\r\n" +
+		"Hello\r\n" +
+		".\r\n" +
+		"QUIT\r\n"))
+	var buf bytes.Buffer
+	sent := 0
+	h := NewSMTPHandler(conn, func(st *SMTPState) error {
+		sent++
+		return ErrThrottled
+	})
+	h.Config.MaxRecipients = 1
+	h.Config.SecurityLog = NewSecurityLogger(&buf)
+	h.Config.MemoryBudget = NewMemoryBudget(20)
+	h.Run()
+	pattern := regexp.MustCompile(`event=rate_limit ip=\S+ limit=(\w+)\n`)
+	var limits []string
+	for _, m := range pattern.FindAllStringSubmatch(buf.String(), -1) {
+		limits = append(limits, m[1])
+	}
+	expected := "220 250 250 250 452 354 451 250 250 354 452 221"
+	if actual := replyCodes(conn.CloneOutputBuffer()); actual != expected {
+		t.Errorf("expected: %s, actual: %s", expected, actual)
+	}
+	if expected, actual := "recipients domain_throttle memory_budget", strings.Join(limits, " "); expected != actual {
+		t.Errorf("expected: %s, actual: %s", expected, actual)
+	}
+}
@@ -0,0 +1,65 @@
+package smtp
+
+import (
+	"context"
+	"net"
+	"strings"
+)
+
+// CheckSenderDomain returns the result of the domain of a sender: "pass"
+// if it has MX or address records, "nullmx" if it has a null MX (RFC
+// 7505), "fail" if it does not exist or has neither, or "temperror" if
+// the lookup failed.
+func CheckSenderDomain(ctx context.Context, r Resolver, domain string) string {
+	mxs, err := r.LookupMX(ctx, domain)
+	if err == nil && len(mxs) > 0 {
+		if len(mxs) == 1 && strings.TrimSuffix(mxs[0].Host, ".") == "" {
+			return "nullmx"
+		}
+		return "pass"
+	}
+	if err != nil && !isNotFound(err) {
+		return "temperror"
+	}
+	ips, err := r.LookupIP(ctx, "ip", domain)
+	if err != nil && !isNotFound(err) {
+		return "temperror"
+	}
+	if len(ips) > 0 {
+		return "pass"
+	}
+	return "fail"
+}
+
+// applySenderDomain checks the domain of the sender at MAIL, returning a
+// reply to reject it if any.
+func applySenderDomain(conn *SMTPConnection) string {
+	config := conn.Config()
+	st := conn.State()
+	domain := st.ReturnToAddress.Domain
+	if !config.CheckSenderDomain || st.NullSender || len(domain) == 0 ||
+		strings.HasPrefix(domain, "[") || net.ParseIP(domain) != nil {
+		return ""
+	}
+	result := CheckSenderDomain(context.Background(), config.resolver(), domain)
+	if result == "pass" {
+		return ""
+	}
+	conn.Logger().Info("sender domain check failed", "domain", domain, "result", result)
+	switch config.SenderDomainAction {
+	case PolicyReject:
+		conn.LogSecurityEvent(EventPolicyReject, "stage", "sender_domain", "result", result)
+		switch result {
+		case "temperror":
+			return conn.Config().Catalog.Reply("mail.domain_lookup_failed")
+		case "nullmx":
+			return conn.Config().Catalog.Reply("mail.null_mx")
+		}
+		return conn.Config().Catalog.Reply("mail.domain_not_found")
+	case PolicyQuarantine:
+		st.Quarantined = true
+	case PolicyTag:
+		st.Tags = append(st.Tags, "sender-domain-"+result)
+	}
+	return ""
+}
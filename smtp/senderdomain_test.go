@@ -0,0 +1,71 @@
+package smtp
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+)
+
+type failingResolver struct {
+	testResolver
+}
+
+func (r *failingResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	return nil, &net.DNSError{Err: "server misbehaving", Name: name, IsTemporary: true}
+}
+
+func TestCheckSenderDomain(t *testing.T) {
+	r := &testResolver{
+		mx: map[string][]string{"example.net": {"mx.example.net"}, "example.org": {""}},
+		ip: map[string][]string{"example.com": {"192.0.2.1"}},
+	}
+	for _, x := range [][]string{
+		{"example.net", "pass"},
+		{"example.com", "pass"},
+		{"example.org", "nullmx"},
+		{"example.invalid", "fail"},
+	} {
+		if actual := CheckSenderDomain(context.Background(), r, x[0]); actual != x[1] {
+			t.Errorf("%s expected: %s, actual: %s", x[0], x[1], actual)
+		}
+	}
+	if actual := CheckSenderDomain(context.Background(), &failingResolver{}, "example.net"); actual != "temperror" {
+		t.Errorf("expected: temperror, actual: %s", actual)
+	}
+}
+
+func TestSenderDomainAction(t *testing.T) {
+	r := &testResolver{mx: map[string][]string{"example.net": {"mx.example.net"}}}
+	run := func(action PolicyAction, resolver Resolver) (string, []string) {
+		var tags []string
+		conn := NewMockConn([]byte("EHLO localhost\r\n" +
+			"MAIL FROM: <foo@example.invalid>\r\n" +
+			"RSET\r\n" +
+			"MAIL FROM: <foo@example.net>\r\n" +
+			"RSET\r\n" +
+			"MAIL FROM: <>\r\n" +
+			"QUIT\r\n"))
+		h := NewSMTPHandler(conn, nil)
+		h.Config.CheckSenderDomain = true
+		h.Config.SenderDomainAction = action
+		h.Config.Resolver = resolver
+		h.Config.Hooks = &Hooks{}
+		h.Config.Hooks.OnMail(func(conn *SMTPConnection) string {
+			tags = append(tags, conn.State().Tags...)
+			return ""
+		})
+		h.Run()
+		return replyCodes(conn.CloneOutputBuffer()), tags
+	}
+	if actual, _ := run(PolicyReject, r); actual != "220 250 550 250 250 250 250 221" {
+		t.Errorf("expected: 220 250 550 250 250 221, actual: %s", actual)
+	}
+	if actual, _ := run(PolicyReject, &failingResolver{}); actual != "220 250 451 250 451 250 250 221" {
+		t.Errorf("expected: 220 250 451 451 250 221, actual: %s", actual)
+	}
+	actual, tags := run(PolicyTag, r)
+	if actual != "220 250 250 250 250 250 250 221" || strings.Join(tags, " ") != "sender-domain-fail" {
+		t.Errorf("unexpected replies: %s, tags: %v", actual, tags)
+	}
+}
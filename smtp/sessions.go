@@ -0,0 +1,211 @@
+package smtp
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var phaseNames = map[SessionPhase]string{
+	PhaseConnected: "connected",
+	PhaseGreeted:   "greeted",
+	PhaseMail:      "mail",
+	PhaseRcpt:      "rcpt",
+	PhaseData:      "data",
+	PhaseDone:      "done",
+}
+
+func (p SessionPhase) String() string {
+	return phaseNames[p]
+}
+
+// Sessions keeps the sessions in progress sharing it, to be listed and
+// terminated by operators. The methods do nothing on nil.
+type Sessions struct {
+	mtx   sync.Mutex
+	conns map[string]*SMTPConnection
+}
+
+func NewSessions() *Sessions {
+	return &Sessions{conns: make(map[string]*SMTPConnection)}
+}
+
+// sessionStatus is the part of a session read by Sessions while it is in
+// progress.
+type sessionStatus struct {
+	mtx        sync.Mutex
+	conn       net.Conn
+	started    time.Time
+	remoteAddr string
+	phase      SessionPhase
+	verb       string
+	bytes      atomic.Int64
+	terminated atomic.Bool
+	shutdown   atomic.Bool
+	done       chan struct{}
+}
+
+type SessionInfo struct {
+	ID         string    `json:"id"`
+	RemoteAddr string    `json:"remote_addr"`
+	Phase      string    `json:"phase"`
+	Verb       string    `json:"verb,omitempty"`
+	Bytes      int64     `json:"bytes"`
+	Started    time.Time `json:"started"`
+	Duration   float64   `json:"duration_seconds"`
+}
+
+func (s *Sessions) add(smtpConn *SMTPConnection) {
+	if s == nil {
+		return
+	}
+	smtpConn.status.conn = smtpConn.handler.Conn()
+	smtpConn.status.started = time.Now()
+	smtpConn.updateStatus("")
+	defer s.mtx.Unlock()
+	s.mtx.Lock()
+	s.conns[smtpConn.ID()] = smtpConn
+}
+
+func (s *Sessions) remove(smtpConn *SMTPConnection) {
+	if s == nil {
+		return
+	}
+	defer s.mtx.Unlock()
+	s.mtx.Lock()
+	delete(s.conns, smtpConn.ID())
+}
+
+// updateStatus records the state of the session with the verb of the
+// command in progress, if any.
+func (smtpConn *SMTPConnection) updateStatus(verb string) {
+	if smtpConn.Config().Sessions == nil {
+		return
+	}
+	st := smtpConn.State()
+	defer smtpConn.status.mtx.Unlock()
+	smtpConn.status.mtx.Lock()
+	smtpConn.status.remoteAddr = st.RemoteAddr
+	smtpConn.status.phase = st.Phase
+	smtpConn.status.verb = verb
+}
+
+// List returns the sessions in the order they started.
+func (s *Sessions) List() []SessionInfo {
+	if s == nil {
+		return nil
+	}
+	now := time.Now()
+	s.mtx.Lock()
+	xs := make([]SessionInfo, 0, len(s.conns))
+	for id, c := range s.conns {
+		c.status.mtx.Lock()
+		xs = append(xs, SessionInfo{
+			ID:         id,
+			RemoteAddr: c.status.remoteAddr,
+			Phase:      c.status.phase.String(),
+			Verb:       c.status.verb,
+			Bytes:      c.status.bytes.Load(),
+			Started:    c.status.started,
+			Duration:   now.Sub(c.status.started).Seconds(),
+		})
+		c.status.mtx.Unlock()
+	}
+	s.mtx.Unlock()
+	sort.Slice(xs, func(i, j int) bool { return xs[i].Started.Before(xs[j].Started) })
+	return xs
+}
+
+// Terminate interrupts the session, which replies 421 and closes the
+// connection. It returns false if there is no such session.
+func (s *Sessions) Terminate(id string) bool {
+	if s == nil {
+		return false
+	}
+	s.mtx.Lock()
+	c, ok := s.conns[id]
+	s.mtx.Unlock()
+	if !ok {
+		return false
+	}
+	c.status.terminated.Store(true)
+	c.status.interrupt()
+	return true
+}
+
+// Shutdown interrupts every session, which replies 421 with the server
+// name and closes the connection, e.g. when the server is stopping. It
+// returns the number of sessions interrupted.
+func (s *Sessions) Shutdown() int {
+	if s == nil {
+		return 0
+	}
+	s.mtx.Lock()
+	conns := make([]*SMTPConnection, 0, len(s.conns))
+	for _, c := range s.conns {
+		conns = append(conns, c)
+	}
+	s.mtx.Unlock()
+	for _, c := range conns {
+		c.status.shutdown.Store(true)
+		c.status.interrupt()
+	}
+	return len(conns)
+}
+
+// interrupt wakes up the session blocked in reading or waiting.
+func (status *sessionStatus) interrupt() {
+	done := status.interrupted()
+	status.mtx.Lock()
+	select {
+	case <-done:
+	default:
+		close(done)
+	}
+	status.mtx.Unlock()
+	status.conn.SetReadDeadline(time.Now())
+}
+
+// interrupted returns the channel closed when the session is interrupted.
+func (status *sessionStatus) interrupted() chan struct{} {
+	defer status.mtx.Unlock()
+	status.mtx.Lock()
+	if status.done == nil {
+		status.done = make(chan struct{})
+	}
+	return status.done
+}
+
+// ServeHTTP lists the sessions as JSON on GET, and terminates the session
+// given by the query parameter id on DELETE.
+func (s *Sessions) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		writeJSON(w, http.StatusOK, s.List())
+	case "DELETE":
+		if !s.Terminate(r.URL.Query().Get("id")) {
+			http.Error(w, "no such session", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "GET, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// sessionReader counts the bytes read for Sessions.
+type sessionReader struct {
+	r      io.Reader
+	status *sessionStatus
+}
+
+func (r sessionReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	r.status.bytes.Add(int64(n))
+	return n, err
+}
@@ -0,0 +1,136 @@
+package smtp
+
+import (
+	"encoding/json"
+	"net"
+	"net/http/httptest"
+	"net/textproto"
+	"testing"
+	"time"
+)
+
+func TestSessions(t *testing.T) {
+	sessions := NewSessions()
+	client, server := net.Pipe()
+	defer client.Close()
+	h := NewSMTPHandler(server, nil)
+	h.Config.Sessions = sessions
+	done := make(chan struct{})
+	go func() {
+		h.Run()
+		close(done)
+	}()
+	tc := textproto.NewConn(client)
+	tc.ReadResponse(220)
+	tc.PrintfLine("HELO localhost")
+	tc.ReadResponse(250)
+	tc.PrintfLine("MAIL FROM:<foo@example.net>")
+	tc.ReadResponse(250)
+
+	var xs []SessionInfo
+	for i := 0; i < 100; i++ {
+		// the status is updated after the reply
+		w := httptest.NewRecorder()
+		sessions.ServeHTTP(w, httptest.NewRequest("GET", "/sessions", nil))
+		if err := json.NewDecoder(w.Body).Decode(&xs); err != nil {
+			t.Fatal(err)
+		}
+		if len(xs) != 1 || len(xs[0].Verb) == 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(xs) != 1 || xs[0].Phase != "mail" || xs[0].Bytes != 45 {
+		t.Fatalf("unexpected sessions: %+v", xs)
+	}
+
+	w := httptest.NewRecorder()
+	sessions.ServeHTTP(w, httptest.NewRequest("DELETE", "/sessions?id=unknown", nil))
+	if w.Code != 404 {
+		t.Errorf("expected: 404, actual: %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	sessions.ServeHTTP(w, httptest.NewRequest("DELETE", "/sessions?id="+xs[0].ID, nil))
+	if w.Code != 204 {
+		t.Errorf("expected: 204, actual: %d", w.Code)
+	}
+	if _, _, err := tc.ReadResponse(421); err != nil {
+		t.Error(err)
+	}
+	<-done
+	if xs := sessions.List(); len(xs) != 0 {
+		t.Errorf("unexpected sessions after the termination: %+v", xs)
+	}
+}
+
+func TestSessionsShutdown(t *testing.T) {
+	sessions := NewSessions()
+	client, server := net.Pipe()
+	defer client.Close()
+	h := NewSMTPHandler(server, nil)
+	h.Config.ServerName = "mx.example.com"
+	h.Config.Sessions = sessions
+	done := make(chan struct{})
+	go func() {
+		h.Run()
+		close(done)
+	}()
+	tc := textproto.NewConn(client)
+	tc.ReadResponse(220)
+	tc.PrintfLine("HELO localhost")
+	tc.ReadResponse(250)
+
+	if n := sessions.Shutdown(); n != 1 {
+		t.Errorf("expected: 1, actual: %d", n)
+	}
+	_, msg, err := tc.ReadResponse(421)
+	if err != nil {
+		t.Error(err)
+	}
+	if expected := "4.3.2 mx.example.com Service closing transmission channel"; msg != expected {
+		t.Errorf("expected: %s, actual: %s", expected, msg)
+	}
+	<-done
+	if n := sessions.Shutdown(); n != 0 {
+		t.Errorf("expected: 0, actual: %d", n)
+	}
+}
+
+func TestSessionsShutdownAuthDelay(t *testing.T) {
+	sessions := NewSessions()
+	client, server := net.Pipe()
+	defer client.Close()
+	h := NewSMTPHandler(server, nil)
+	h.Config.Sessions = sessions
+	h.Config.Authenticate = func(username, password string) bool {
+		return false
+	}
+	h.Config.AuthLimiter = NewAuthLimiter(0, time.Minute)
+	h.Config.AuthLimiter.BaseDelay = time.Hour
+	h.Config.AuthLimiter.Clock = NewFakeClock(time.Now())
+	done := make(chan struct{})
+	go func() {
+		h.Run()
+		close(done)
+	}()
+	tc := textproto.NewConn(client)
+	tc.ReadResponse(220)
+	tc.PrintfLine("EHLO localhost")
+	tc.ReadResponse(250)
+	tc.PrintfLine("AUTH PLAIN AGZvbwB3cm9uZw==")
+	for i := 0; i < 100; i++ {
+		if xs := sessions.List(); len(xs) == 1 && xs[0].Verb == "AUTH" {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// the delay never passes by the clock, but is interrupted
+	if n := sessions.Shutdown(); n != 1 {
+		t.Errorf("expected: 1, actual: %d", n)
+	}
+	if _, _, err := tc.ReadResponse(421); err != nil {
+		t.Error(err)
+	}
+	<-done
+}
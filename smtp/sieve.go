@@ -0,0 +1,531 @@
+package smtp
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// SieveScript is a subset of Sieve (RFC 5228) supporting the actions keep,
+// discard, stop, fileinto and redirect, and the tests header, envelope,
+// exists, allof, anyof, not, true and false.
+type SieveScript struct {
+	commands []sieveCommand
+}
+
+type sieveCommand struct {
+	name string
+	args []string
+
+	// if/elsif/else chain, where the test of else is nil
+	tests  []*sieveTest
+	blocks [][]sieveCommand
+}
+
+type sieveTest struct {
+	name  string
+	match string
+	part  string
+	args  [][]string
+	tests []*sieveTest
+}
+
+// SieveResult is the set of actions taken for a recipient.
+type SieveResult struct {
+	Keep     bool
+	FileInto []string
+	Redirect []string
+}
+
+var errSieveStop = errors.New("sieve: stop")
+
+func ParseSieveScript(r io.Reader) (*SieveScript, error) {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	tokens, err := sieveTokenize(string(b))
+	if err != nil {
+		return nil, err
+	}
+	p := &sieveParser{tokens: tokens}
+	commands, err := p.parseBlock(false)
+	if err != nil {
+		return nil, err
+	}
+	return &SieveScript{commands: commands}, nil
+}
+
+// Evaluate runs the script for the i-th recipient of the transaction.
+func (script *SieveScript) Evaluate(st *SMTPState, i int) SieveResult {
+	ctx := &sieveContext{st: st, rcpt: i, implicitKeep: true}
+	ctx.run(script.commands)
+	res := ctx.result
+	if ctx.implicitKeep {
+		res.Keep = true
+	}
+	return res
+}
+
+type sieveToken struct {
+	kind  byte // 'a' atom, ':' tag, '"' string, or the special character
+	value string
+}
+
+func sieveTokenize(s string) ([]sieveToken, error) {
+	tokens := make([]sieveToken, 0)
+	r := bufio.NewReader(strings.NewReader(s))
+	for {
+		c, err := r.ReadByte()
+		if err == io.EOF {
+			return tokens, nil
+		}
+		switch {
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n':
+		case c == '#':
+			r.ReadString('\n')
+		case c == '/':
+			if next, _ := r.ReadByte(); next != '*' {
+				return nil, fmt.Errorf("sieve: unexpected '/'")
+			}
+			for prev := byte(0); ; {
+				c, err := r.ReadByte()
+				if err != nil {
+					return nil, fmt.Errorf("sieve: unterminated comment")
+				}
+				if prev == '*' && c == '/' {
+					break
+				}
+				prev = c
+			}
+		case c == '"':
+			var b strings.Builder
+			for {
+				c, err := r.ReadByte()
+				if err != nil {
+					return nil, fmt.Errorf("sieve: unterminated string")
+				}
+				if c == '"' {
+					break
+				}
+				if c == '\\' {
+					if c, err = r.ReadByte(); err != nil {
+						return nil, fmt.Errorf("sieve: unterminated string")
+					}
+				}
+				b.WriteByte(c)
+			}
+			tokens = append(tokens, sieveToken{'"', b.String()})
+		case strings.IndexByte("[](),;{}", c) >= 0:
+			tokens = append(tokens, sieveToken{c, string(c)})
+		case c == ':' || c == '_' || isSieveAtomChar(c):
+			var b strings.Builder
+			b.WriteByte(c)
+			for {
+				c, err := r.ReadByte()
+				if err != nil {
+					break
+				}
+				if !isSieveAtomChar(c) && c != '_' {
+					r.UnreadByte()
+					break
+				}
+				b.WriteByte(c)
+			}
+			kind := byte('a')
+			if b.String()[0] == ':' {
+				kind = ':'
+			}
+			tokens = append(tokens, sieveToken{kind, strings.ToLower(b.String())})
+		default:
+			return nil, fmt.Errorf("sieve: unexpected '%c'", c)
+		}
+	}
+}
+
+func isSieveAtomChar(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+}
+
+type sieveParser struct {
+	tokens []sieveToken
+	pos    int
+}
+
+func (p *sieveParser) peek() (sieveToken, bool) {
+	if p.pos >= len(p.tokens) {
+		return sieveToken{}, false
+	}
+	return p.tokens[p.pos], true
+}
+
+func (p *sieveParser) expect(kind byte) (sieveToken, error) {
+	t, ok := p.peek()
+	if !ok || t.kind != kind {
+		return t, fmt.Errorf("sieve: expected '%c' at token %d", kind, p.pos)
+	}
+	p.pos++
+	return t, nil
+}
+
+func (p *sieveParser) parseBlock(nested bool) ([]sieveCommand, error) {
+	commands := make([]sieveCommand, 0)
+	for {
+		t, ok := p.peek()
+		if !ok {
+			if nested {
+				return nil, fmt.Errorf("sieve: missing '}'")
+			}
+			return commands, nil
+		}
+		if t.kind == '}' && nested {
+			p.pos++
+			return commands, nil
+		}
+		cmd, err := p.parseCommand()
+		if err != nil {
+			return nil, err
+		}
+		if cmd.name != "require" {
+			commands = append(commands, cmd)
+		}
+	}
+}
+
+func (p *sieveParser) parseCommand() (sieveCommand, error) {
+	t, err := p.expect('a')
+	if err != nil {
+		return sieveCommand{}, err
+	}
+	cmd := sieveCommand{name: t.value}
+	switch cmd.name {
+	case "if":
+		for {
+			test, err := p.parseTest()
+			if err != nil {
+				return cmd, err
+			}
+			if err := p.parseIfBlock(&cmd, test); err != nil {
+				return cmd, err
+			}
+			next, ok := p.peek()
+			if !ok || next.kind != 'a' {
+				return cmd, nil
+			}
+			switch next.value {
+			case "elsif":
+				p.pos++
+				continue
+			case "else":
+				p.pos++
+				return cmd, p.parseIfBlock(&cmd, nil)
+			}
+			return cmd, nil
+		}
+	case "require", "keep", "discard", "stop", "fileinto", "redirect":
+		for {
+			next, ok := p.peek()
+			if !ok || next.kind == ';' {
+				break
+			}
+			if next.kind == ':' {
+				p.pos++
+				continue
+			}
+			xs, err := p.parseStringList()
+			if err != nil {
+				return cmd, err
+			}
+			cmd.args = append(cmd.args, xs...)
+		}
+		if _, err := p.expect(';'); err != nil {
+			return cmd, err
+		}
+		if (cmd.name == "fileinto" || cmd.name == "redirect") && len(cmd.args) != 1 {
+			return cmd, fmt.Errorf("sieve: %s requires one argument", cmd.name)
+		}
+		return cmd, nil
+	}
+	return cmd, fmt.Errorf("sieve: unsupported command %s", cmd.name)
+}
+
+func (p *sieveParser) parseIfBlock(cmd *sieveCommand, test *sieveTest) error {
+	if _, err := p.expect('{'); err != nil {
+		return err
+	}
+	block, err := p.parseBlock(true)
+	if err != nil {
+		return err
+	}
+	cmd.tests = append(cmd.tests, test)
+	cmd.blocks = append(cmd.blocks, block)
+	return nil
+}
+
+func (p *sieveParser) parseStringList() ([]string, error) {
+	t, ok := p.peek()
+	if ok && t.kind == '"' {
+		p.pos++
+		return []string{t.value}, nil
+	}
+	if _, err := p.expect('['); err != nil {
+		return nil, err
+	}
+	xs := make([]string, 0)
+	for {
+		s, err := p.expect('"')
+		if err != nil {
+			return nil, err
+		}
+		xs = append(xs, s.value)
+		t, ok := p.peek()
+		if ok && t.kind == ',' {
+			p.pos++
+			continue
+		}
+		if _, err := p.expect(']'); err != nil {
+			return nil, err
+		}
+		return xs, nil
+	}
+}
+
+func (p *sieveParser) parseTest() (*sieveTest, error) {
+	t, err := p.expect('a')
+	if err != nil {
+		return nil, err
+	}
+	test := &sieveTest{name: t.value, match: ":is"}
+	switch test.name {
+	case "true", "false":
+		return test, nil
+	case "not":
+		x, err := p.parseTest()
+		if err != nil {
+			return nil, err
+		}
+		test.tests = []*sieveTest{x}
+		return test, nil
+	case "allof", "anyof":
+		if _, err := p.expect('('); err != nil {
+			return nil, err
+		}
+		for {
+			x, err := p.parseTest()
+			if err != nil {
+				return nil, err
+			}
+			test.tests = append(test.tests, x)
+			next, ok := p.peek()
+			if ok && next.kind == ',' {
+				p.pos++
+				continue
+			}
+			if _, err := p.expect(')'); err != nil {
+				return nil, err
+			}
+			return test, nil
+		}
+	case "header", "envelope", "exists":
+		for {
+			next, ok := p.peek()
+			if !ok {
+				return nil, fmt.Errorf("sieve: incomplete %s test", test.name)
+			}
+			if next.kind == ':' {
+				p.pos++
+				switch next.value {
+				case ":is", ":contains", ":matches":
+					test.match = next.value
+				case ":all", ":localpart", ":domain":
+					test.part = next.value
+				case ":comparator":
+					if _, err := p.parseStringList(); err != nil {
+						return nil, err
+					}
+				default:
+					return nil, fmt.Errorf("sieve: unsupported tag %s", next.value)
+				}
+				continue
+			}
+			if next.kind != '"' && next.kind != '[' {
+				break
+			}
+			xs, err := p.parseStringList()
+			if err != nil {
+				return nil, err
+			}
+			test.args = append(test.args, xs)
+		}
+		if (test.name == "exists" && len(test.args) != 1) ||
+			(test.name != "exists" && len(test.args) != 2) {
+			return nil, fmt.Errorf("sieve: invalid arguments of %s", test.name)
+		}
+		return test, nil
+	}
+	return nil, fmt.Errorf("sieve: unsupported test %s", test.name)
+}
+
+type sieveContext struct {
+	st           *SMTPState
+	rcpt         int
+	implicitKeep bool
+	result       SieveResult
+}
+
+func (ctx *sieveContext) run(commands []sieveCommand) error {
+	for _, cmd := range commands {
+		switch cmd.name {
+		case "if":
+			for i, test := range cmd.tests {
+				if test == nil || ctx.test(test) {
+					if err := ctx.run(cmd.blocks[i]); err != nil {
+						return err
+					}
+					break
+				}
+			}
+		case "keep":
+			ctx.result.Keep = true
+		case "discard":
+			ctx.implicitKeep = false
+		case "stop":
+			return errSieveStop
+		case "fileinto":
+			ctx.implicitKeep = false
+			ctx.result.FileInto = append(ctx.result.FileInto, cmd.args[0])
+		case "redirect":
+			ctx.implicitKeep = false
+			ctx.result.Redirect = append(ctx.result.Redirect, cmd.args[0])
+		}
+	}
+	return nil
+}
+
+func (ctx *sieveContext) test(test *sieveTest) bool {
+	switch test.name {
+	case "true":
+		return true
+	case "false":
+		return false
+	case "not":
+		return !ctx.test(test.tests[0])
+	case "allof":
+		for _, x := range test.tests {
+			if !ctx.test(x) {
+				return false
+			}
+		}
+		return true
+	case "anyof":
+		for _, x := range test.tests {
+			if ctx.test(x) {
+				return true
+			}
+		}
+		return false
+	case "exists":
+		for _, name := range test.args[0] {
+			if _, ok := headerValue(ctx.st.Headers, name); !ok {
+				return false
+			}
+		}
+		return true
+	}
+	values := make([]string, 0)
+	for _, name := range test.args[0] {
+		if test.name == "header" {
+			values = append(values, headerValues(ctx.st.Headers, name)...)
+			continue
+		}
+		switch strings.ToLower(name) {
+		case "from":
+			values = append(values, ctx.st.ReturnTo)
+		case "to":
+			if ctx.rcpt < len(ctx.st.Recipients) {
+				values = append(values, ctx.st.Recipients[ctx.rcpt])
+			}
+		}
+	}
+	for _, v := range values {
+		if i := strings.LastIndex(v, "@"); i >= 0 && test.part == ":localpart" {
+			v = v[:i]
+		} else if i >= 0 && test.part == ":domain" {
+			v = v[i+1:]
+		}
+		for _, key := range test.args[1] {
+			if sieveMatch(test.match, v, key) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// sieveMatch compares with the default "i;ascii-casemap" comparator.
+func sieveMatch(match, value, key string) bool {
+	value, key = strings.ToLower(value), strings.ToLower(key)
+	switch match {
+	case ":contains":
+		return strings.Contains(value, key)
+	case ":matches":
+		return sieveGlob(value, key)
+	}
+	return value == key
+}
+
+func sieveGlob(s, pattern string) bool {
+	if len(pattern) == 0 {
+		return len(s) == 0
+	}
+	switch pattern[0] {
+	case '*':
+		for i := 0; i <= len(s); i++ {
+			if sieveGlob(s[i:], pattern[1:]) {
+				return true
+			}
+		}
+		return false
+	case '?':
+		return len(s) > 0 && sieveGlob(s[1:], pattern[1:])
+	case '\\':
+		if len(pattern) > 1 {
+			pattern = pattern[1:]
+		}
+	}
+	return len(s) > 0 && s[0] == pattern[0] && sieveGlob(s[1:], pattern[1:])
+}
+
+// applySieve replaces each recipient by the deliveries the script decides,
+// setting RecipientMailboxes to the folder for fileinto.
+func applySieve(st *SMTPState, script *SieveScript) {
+	var next SMTPState
+	add := func(i int, rcpt string, addr Address, mailbox string) {
+		next.Recipients = append(next.Recipients, rcpt)
+		next.RecipientAddresses = append(next.RecipientAddresses, addr)
+		next.RecipientParams = append(next.RecipientParams, st.RecipientParams[i])
+		next.RecipientDSNs = append(next.RecipientDSNs, st.RecipientDSNs[i])
+		next.RecipientMailboxes = append(next.RecipientMailboxes, mailbox)
+	}
+	for i, rcpt := range st.Recipients {
+		res := script.Evaluate(st, i)
+		if res.Keep {
+			add(i, rcpt, st.RecipientAddresses[i], st.RecipientMailboxes[i])
+		}
+		for _, x := range res.FileInto {
+			add(i, rcpt, st.RecipientAddresses[i], st.RecipientMailboxes[i]+"/"+x)
+		}
+		for _, x := range res.Redirect {
+			if addr, err := ParseAddress(x); err == nil {
+				add(i, addr.String(), addr, addr.String())
+			}
+		}
+	}
+	st.Recipients = next.Recipients
+	st.RecipientAddresses = next.RecipientAddresses
+	st.RecipientParams = next.RecipientParams
+	st.RecipientDSNs = next.RecipientDSNs
+	st.RecipientMailboxes = next.RecipientMailboxes
+}
@@ -0,0 +1,82 @@
+package smtp
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestSieveScript(t *testing.T) {
+	script, err := ParseSieveScript(strings.NewReader(`
+require ["fileinto", "envelope"];
+# sort test mail
+if header :contains "Subject" "[SPAM]" {
+	discard;
+	stop;
+} elsif allof (envelope :domain :is "to" "example.org",
+		header :matches "X-Mailer" "Test*") {
+	fileinto "Tests";
+} elsif not exists "Date" {
+	redirect "admin@example.net";
+	keep;
+} else {
+	fileinto "INBOX.Other";
+}
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := &SMTPState{
+		Recipients: []string{"user1@example.net", "user2@example.org"},
+		Headers:    []string{"Subject: Hello", "X-Mailer: TestMailer 1.0"},
+	}
+	tests := []string{
+		"{true [] [admin@example.net]}",
+		"{false [Tests] []}",
+	}
+	for i, expected := range tests {
+		actual := fmt.Sprintf("%v", script.Evaluate(st, i))
+		if actual != expected {
+			t.Errorf("expected: %s, actual: %s", expected, actual)
+		}
+	}
+	st.Headers = []string{"Subject: [SPAM] Buy now", "Date: Mon, 2 Jan 2006 15:04:05 +0000"}
+	if actual := fmt.Sprintf("%v", script.Evaluate(st, 0)); actual != "{false [] []}" {
+		t.Errorf("expected: {false [] []}, actual: %s", actual)
+	}
+
+	invalid := []string{
+		"vacation \"Away\";",
+		"if header \"Subject\" {}",
+		"if true { keep;",
+		"fileinto;",
+	}
+	for _, x := range invalid {
+		if _, err := ParseSieveScript(strings.NewReader(x)); err == nil {
+			t.Errorf("expected an error: %s", x)
+		}
+	}
+}
+
+func TestApplySieve(t *testing.T) {
+	script, err := ParseSieveScript(strings.NewReader(
+		`if envelope :localpart :is "to" "user1" { discard; } else { fileinto "Archive"; }`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := &SMTPState{}
+	st.Reset()
+	for _, x := range []string{"user1@example.net", "user2@example.net"} {
+		addr, _ := ParseAddress(x)
+		st.Recipients = append(st.Recipients, x)
+		st.RecipientAddresses = append(st.RecipientAddresses, addr)
+		st.RecipientParams = append(st.RecipientParams, nil)
+		st.RecipientDSNs = append(st.RecipientDSNs, RecipientDSN{})
+		st.RecipientMailboxes = append(st.RecipientMailboxes, x)
+	}
+	applySieve(st, script)
+	expected := "user2@example.net/Archive"
+	if actual := strings.Join(st.RecipientMailboxes, " "); actual != expected {
+		t.Errorf("expected: %s, actual: %s", expected, actual)
+	}
+}
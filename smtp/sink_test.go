@@ -0,0 +1,28 @@
+package smtp
+
+import (
+	"testing"
+)
+
+func TestNewSink(t *testing.T) {
+	if s, err := NewSink("kafka://b1:9092,b2:9092/mail"); err != nil {
+		t.Error(err)
+	} else if k := s.(*KafkaSink); len(k.Brokers) != 2 || k.Topic != "mail" {
+		t.Errorf("unexpected sink: %v", k)
+	}
+	if s, err := NewSink("nats://localhost:4222/mail.in"); err != nil {
+		t.Error(err)
+	} else if n := s.(*NATSSink); n.Addr != "localhost:4222" || n.Subject != "mail.in" {
+		t.Errorf("unexpected sink: %v", n)
+	}
+	if s, err := NewSink("amqp://localhost:5672"); err != nil {
+		t.Error(err)
+	} else if a := s.(*AMQPSink); a.VirtualHost != "/" || a.Username != "guest" {
+		t.Errorf("unexpected sink: %v", a)
+	}
+	for _, x := range []string{"kafka://localhost:9092", "nats://localhost", "redis://localhost/mail"} {
+		if _, err := NewSink(x); err == nil {
+			t.Errorf("expected an error: %s", x)
+		}
+	}
+}
@@ -2,155 +2,1540 @@ package smtp
 
 import (
 	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
+	"log/slog"
 	"net"
 	"net/textproto"
-	"regexp"
+	"os"
+	"runtime/debug"
+	"strconv"
 	"strings"
+	"time"
+	"unicode/utf8"
 )
 
-type SMTPState struct {
-	Hello      string
+var (
+	ErrMessageTooLarge = errors.New("smtp: message exceeds maximum size")
+	ErrLineTooLong     = errors.New("smtp: line too long")
+	ErrTooManyHeaders  = errors.New("smtp: too many header lines")
+	ErrBareLineEnding  = errors.New("smtp: bare CR or LF in message")
+	ErrRequireTLS      = errors.New("smtp: REQUIRETLS cannot be met")
+	ErrDeliverBy       = errors.New("smtp: delivery time expired")
+	ErrSMTPUTF8        = errors.New("smtp: SMTPUTF8 is not supported")
+)
+
+type SMTPConfig struct {
 	ServerName string
-	ClientName string
-	ReturnTo   string
-	Recipients []string
-	Headers    []string
-	Content    []byte
+
+	// Authenticate verifies the credentials of AUTH, which is neither
+	// advertised nor accepted if nil.
+	Authenticate func(username, password string) bool
+	AuthLimiter  *AuthLimiter
+	SecurityLog  *SecurityLogger
+	AuthAudit    *AuthAudit
+
+	// Logger logs the sessions if set.
+	Logger *slog.Logger
+
+	// TranscriptDir is the directory to record a Transcript of every
+	// session in if set, with TranscriptMaxBody as Transcript.MaxBody.
+	TranscriptDir     string
+	TranscriptMaxBody int64
+
+	// Privacy redacts addresses in logs, transcripts and optionally APIs
+	// if set.
+	Privacy *Privacy
+
+	// CaptureDir is the directory to record a Capture of every session in
+	// if set.
+	CaptureDir string
+
+	// ListenerName is the name of the listener the configuration is for,
+	// which hooks can refer to.
+	ListenerName string
+
+	// RequireAuth rejects MAIL until the client has authenticated.
+	RequireAuth bool
+
+	// LMTP speaks LMTP (RFC 2033) instead of SMTP: LHLO replaces HELO and
+	// EHLO, and each recipient is answered after the message data.
+	LMTP bool
+
+	// RequireStartTLS rejects commands other than EHLO, STARTTLS, NOOP,
+	// RSET and QUIT until TLS is active.
+	RequireStartTLS bool
+
+	// SenderMatchesLogin rejects senders not owned by the authenticated
+	// user.
+	SenderMatchesLogin bool
+
+	MaxMessageSize int64
+
+	// Limits below use the defaults when zero and are disabled when negative.
+	MaxCommandLineLength int
+	MaxTextLineLength    int
+	MaxRecipients        int
+	MaxHeaderLines       int
+	MaxReceivedHeaders   int
+
+	// SpoolThreshold is the size of a message body kept in memory before it
+	// is moved to a temporary file in SpoolDir. Zero means the default.
+	SpoolThreshold int64
+	SpoolDir       string
+
+	// MemoryBudget is shared by all connections to limit the total size of
+	// messages being received at once.
+	MemoryBudget *MemoryBudget
+
+	// StrictLineEndings rejects messages containing a bare CR or LF to
+	// protect downstream relays from SMTP smuggling.
+	StrictLineEndings bool
+
+	// AddReceived prepends a Received trace header to accepted messages.
+	AddReceived bool
+
+	// FixupHeaders adds missing Message-ID and Date headers, and From too
+	// if FixupFrom is set. An added Message-ID is named by the queue ID,
+	// which a MessageStore stores the message by.
+	FixupHeaders bool
+	FixupFrom    bool
+
+	// HeaderRules are applied to the headers of every accepted message.
+	HeaderRules HeaderRules
+
+	// Mutations rewrite every accepted message after the HeaderRules.
+	Mutations Mutations
+
+	// Aliases rewrite recipients at RCPT time.
+	Aliases *AliasMap
+
+	// VirtualDomains restricts recipients to the domains if set.
+	VirtualDomains *VirtualDomains
+
+	// ReturnPath decodes the recipients of bounces to the senders encoded
+	// on relay with VERP or BATV if set, rejecting invalid signatures.
+	ReturnPath *ReturnPath
+
+	// Access rejects clients, HELO names, senders and recipients by the
+	// Postfix-style access tables if set.
+	Access *AccessMaps
+
+	// RecipientValidator accepts, rejects or defers each recipient at
+	// RCPT if set. Every recipient is accepted otherwise.
+	RecipientValidator RecipientValidator
+
+	// Verify answers VRFY, which is not supported if nil.
+	Verify VerifyFunc
+
+	// MailingLists are expanded by EXPN, which is not supported if nil.
+	MailingLists *MailingLists
+
+	// Quotas answer RCPT with 452 for the full mailboxes of the store if
+	// set.
+	Quotas *MailboxQuotas
+
+	// Sieve filters each recipient of accepted messages.
+	Sieve *SieveScript
+
+	Policy *Policy
+
+	// Quarantine holds messages quarantined by the policy instead of
+	// sending them.
+	Quarantine *Quarantine
+
+	// Queue enables ETRN to flush the queued mail of a domain, restricted
+	// to ETRNDomains if set, and ATRN for authenticated clients to receive
+	// the queued mail of their domains. ATRNDomains maps each user to the
+	// domains it may request; any user may request any domain if nil.
+	Queue       *Queue
+	ETRNDomains []string
+	ATRNDomains map[string][]string
+
+	Hooks *Hooks
+
+	// Scanner scores accepted messages. Messages at or above
+	// SpamRejectScore are rejected, and at or above SpamQuarantineScore
+	// are quarantined. Zero disables each.
+	Scanner             ContentScanner
+	SpamRejectScore     float64
+	SpamQuarantineScore float64
+
+	// VerifyDKIM verifies the signatures of received messages and adds
+	// an Authentication-Results header.
+	VerifyDKIM bool
+
+	// CheckSPF checks the sender at MAIL. Fail and softfail results are
+	// handled by the actions, accepted if empty.
+	CheckSPF          bool
+	SPFFailAction     PolicyAction
+	SPFSoftfailAction PolicyAction
+
+	// CheckSenderDomain verifies at MAIL that the domain of the sender
+	// exists and has MX or address records. Failures are logged and
+	// handled by SenderDomainAction.
+	CheckSenderDomain  bool
+	SenderDomainAction PolicyAction
+
+	// CheckDMARC evaluates DMARC of received messages, checking SPF and
+	// DKIM as needed, and EnforceDMARC applies the policy of the domain.
+	// DMARCReports collects aggregate report data if set.
+	CheckDMARC   bool
+	EnforceDMARC bool
+	DMARCReports *DMARCReports
+
+	// Resolver is used by the authentication checks. net.DefaultResolver
+	// is used if nil.
+	Resolver Resolver
+
+	// Clock tells the time of the sessions, e.g. of Received headers.
+	// The system clock is used if nil.
+	Clock Clock
+
+	// Events receives the lifecycle events of every session.
+	Events *EventBus
+
+	// Metrics counts the activity of every session if set.
+	Metrics *Metrics
+
+	// Tracer records spans of every session if set.
+	Tracer *Tracer
+
+	// Stats keeps the statistics of every session if set.
+	Stats *Stats
+
+	// Sessions keeps every session in progress if set.
+	Sessions *Sessions
+
+	// Drain refuses new sessions and transactions while it is on.
+	Drain *Drain
+
+	// Upgrader passes the listeners opened by ListenerConfig to a new
+	// process on upgrades if set.
+	Upgrader *Upgrader
+
+	// Catalog replaces the replies by the situations if set.
+	Catalog *Catalog
+
+	// Banners replaces the greeting, EHLO and reply texts if set.
+	Banners *Banners
+
+	// TLSConfig enables STARTTLS and REQUIRETLS if set.
+	TLSConfig *tls.Config
+
+	// AuthRequiresTLS hides AUTH and rejects it until TLS is active.
+	AuthRequiresTLS bool
+
+	// XClientNetworks are the proxies allowed to override the attributes
+	// of the client with XCLIENT.
+	XClientNetworks []*net.IPNet
+
+	// ProxyNetworks are the load balancers trusted to send PROXY headers
+	// to the listeners of ListenerConfig.ProxyProtocol.
+	ProxyNetworks []*net.IPNet
+
+	// commands are the commands registered with RegisterCommand.
+	commands map[string]SMTPCommand
+}
+
+const (
+	DefaultMaxCommandLineLength = 512
+	DefaultMaxTextLineLength    = 1000
+	DefaultMaxRecipients        = 100
+	DefaultMaxHeaderLines       = 1000
+	DefaultMaxReceivedHeaders   = 100
+	DefaultSpoolThreshold       = 1 << 20
+)
+
+func (config *SMTPConfig) resolver() Resolver {
+	if config.Resolver != nil {
+		return config.Resolver
+	}
+	return net.DefaultResolver
+}
+
+func (config *SMTPConfig) now() time.Time {
+	return clockNow(config.Clock)
+}
+
+func configLimit(v, def int) int {
+	if v == 0 {
+		return def
+	}
+	if v < 0 {
+		return 0
+	}
+	return v
+}
+
+func (config *SMTPConfig) CommandLineLimit() int {
+	return configLimit(config.MaxCommandLineLength, DefaultMaxCommandLineLength)
+}
+
+func (config *SMTPConfig) TextLineLimit() int {
+	return configLimit(config.MaxTextLineLength, DefaultMaxTextLineLength)
+}
+
+func (config *SMTPConfig) RecipientLimit() int {
+	return configLimit(config.MaxRecipients, DefaultMaxRecipients)
+}
+
+func (config *SMTPConfig) HeaderLineLimit() int {
+	return configLimit(config.MaxHeaderLines, DefaultMaxHeaderLines)
+}
+
+// HopLimit is the number of Received headers beyond which a message is
+// assumed to be looping.
+func (config *SMTPConfig) HopLimit() int {
+	return configLimit(config.MaxReceivedHeaders, DefaultMaxReceivedHeaders)
+}
+
+func (config *SMTPConfig) NewSpool() *Spool {
+	threshold := config.SpoolThreshold
+	if threshold == 0 {
+		threshold = DefaultSpoolThreshold
+	}
+	if threshold < 0 {
+		threshold = 0
+	}
+	return NewSpool(threshold, config.SpoolDir)
+}
+
+// SessionPhase is the position of a session in the command sequence.
+// MAIL, RCPT, DATA and BDAT are only accepted in the phases listed in
+// their handlers; anything else is answered with 503.
+type SessionPhase int
+
+const (
+	PhaseConnected SessionPhase = iota
+	PhaseGreeted
+	PhaseMail
+	PhaseRcpt
+	PhaseData
+	PhaseDone
+)
+
+// SMTPState is the state of a session and its mail transaction. Hooks may
+// read the envelope from an EnvelopeSnapshot, and the message through its
+// Message, whose Header changes the Headers in place.
+type SMTPState struct {
+	Phase              SessionPhase
+	RemoteAddr         string
+	RemoteName         string
+	LocalAddr          string
+	ConnectedAt        time.Time
+	Hello              string
+	ServerName         string
+	ClientName         string
+	Username           string
+	ReturnTo           string
+	ReturnToAddress    Address
+	NullSender         bool
+	MailParams         ESMTPParams
+	Size               int64
+	Body               string
+	SMTPUTF8           bool
+	RequireTLS         bool
+	TLSOptional        bool
+	Ret                string
+	EnvID              string
+	Priority           int
+	DeliverBy          time.Time
+	ByMode             string
+	DeliverAt          time.Time
+	TransactionID      string
+	QueueID            string
+	Recipients         []string
+	RecipientAddresses []Address
+	RecipientParams    []ESMTPParams
+	RecipientDSNs      []RecipientDSN
+	RecipientMailboxes []string
+
+	// VERPRecipients are the recipients decoded from the VERP addresses
+	// of a bounce, i.e. those the bounce is about. They are added to the
+	// message as X-VERP-Recipient headers.
+	VERPRecipients []string
+
+	Headers   []string
+	MessageID string
+	Tags      []string
+
+	// Route is the upstream relaying the message to every recipient
+	// instead of the routes of the Router, if set, e.g. by a Script.
+	Route string
+
+	Quarantined bool
+	SpamScore   float64
+	SpamSymbols []string
+	SPF         SPFResult
+	DKIMResults []DKIMResult
+	DMARC       DMARCResult
+	AuthResults []string
+
+	// TLS is the state of the connection after STARTTLS.
+	TLS *tls.ConnectionState
+
+	// ClientCN and ClientSANs identify the client by its certificate when
+	// it is verified against SMTPConfig.TLSConfig.ClientCAs.
+	ClientCN   string
+	ClientSANs []string
+
+	sessionTags []string
+	rcptGroups  [][]string
+	dsnRelayed  []string
+
+	// clock is the Clock of the session or the queue which the state is
+	// of, telling the time left of DELIVERBY.
+	clock        Clock
+	xclientHelo  string
+	xclientProto string
+
+	// rawHeader is the header section as received, including the blank
+	// line, and rawHeaderLines the Headers parsed from it.
+	rawHeader      []byte
+	rawHeaderLines []string
+
+	content       *Spool
+	chunks        *Spool
+	chunkOverflow bool
+	discarded     bool
+	span          *Span
+}
+
+type RecipientDSN struct {
+	Notify []string `json:"notify,omitempty"`
+	ORcpt  string   `json:"orcpt,omitempty"`
+}
+
+func (dsn RecipientDSN) String() string {
+	s := ""
+	if len(dsn.Notify) > 0 {
+		s += " NOTIFY=" + strings.Join(dsn.Notify, ",")
+	}
+	if len(dsn.ORcpt) > 0 {
+		s += " ORCPT=" + dsn.ORcpt
+	}
+	return s
+}
+
+// recipientDSN returns the DSN parameters given to the recipient.
+func (st *SMTPState) recipientDSN(rcpt string) RecipientDSN {
+	for i, x := range st.Recipients {
+		if x == rcpt && i < len(st.RecipientDSNs) {
+			return st.RecipientDSNs[i]
+		}
+	}
+	return RecipientDSN{}
+}
+
+func (st *SMTPState) HasStarted() bool {
+	return len(st.Hello) > 0
+}
+
+func (st *SMTPState) InTransaction() bool {
+	return st.Phase == PhaseMail || st.Phase == PhaseRcpt || st.Phase == PhaseData
+}
+
+func (st *SMTPState) Reset() {
+	st.endSpan(errTransactionAborted)
+	if st.HasStarted() {
+		st.Phase = PhaseGreeted
+	} else {
+		st.Phase = PhaseConnected
+	}
+	st.ReturnTo = ""
+	st.ReturnToAddress = Address{}
+	st.NullSender = false
+	st.MailParams = nil
+	st.Size = 0
+	st.Body = ""
+	st.SMTPUTF8 = false
+	st.RequireTLS = false
+	st.TLSOptional = false
+	st.Ret = ""
+	st.EnvID = ""
+	st.Priority = 0
+	st.DeliverBy = time.Time{}
+	st.ByMode = ""
+	st.DeliverAt = time.Time{}
+	st.TransactionID = ""
+	st.QueueID = ""
+	st.Recipients = make([]string, 0)
+	st.RecipientAddresses = make([]Address, 0)
+	st.RecipientParams = make([]ESMTPParams, 0)
+	st.RecipientDSNs = make([]RecipientDSN, 0)
+	st.RecipientMailboxes = make([]string, 0)
+	st.VERPRecipients = nil
+	st.Headers = make([]string, 0)
+	st.MessageID = ""
+	st.Tags = append([]string{}, st.sessionTags...)
+	st.Route = ""
+	st.Quarantined = false
+	st.SpamScore = 0
+	st.SpamSymbols = nil
+	st.SPF = SPFResult{}
+	st.DKIMResults = nil
+	st.DMARC = DMARCResult{}
+	st.AuthResults = nil
+	st.rcptGroups = nil
+	st.dsnRelayed = nil
+	st.rawHeader = nil
+	st.rawHeaderLines = nil
+	st.Close()
+	st.chunkOverflow = false
+	st.discarded = false
+}
+
+// Content returns a new reader of the message body received by DATA or
+// BDAT. The body may be spooled to a temporary file, which is removed by
+// Reset or Close.
+func (st *SMTPState) Content() io.Reader {
+	if st.content == nil {
+		return bytes.NewReader(nil)
+	}
+	return st.content.Reader()
+}
+
+// Raw returns a new reader of the message as received by DATA or BDAT,
+// after dot-unstuffing and with CRLF line endings, regardless of the
+// changes to Headers since. It is the Headers and the content otherwise.
+func (st *SMTPState) Raw() io.Reader {
+	if st.rawHeader == nil {
+		return st.messageReader()
+	}
+	return io.MultiReader(bytes.NewReader(st.rawHeader), st.Content())
+}
+
+func (st *SMTPState) ContentSize() int64 {
+	if st.content == nil {
+		return 0
+	}
+	return st.content.Size()
+}
+
+// MessageSize returns the size of the message including the headers.
+func (st *SMTPState) MessageSize() int64 {
+	size := st.ContentSize() + 2
+	for _, x := range st.Headers {
+		size += int64(len(x)) + 2
+	}
+	return size
+}
+
+func (st *SMTPState) SetContent(b []byte) {
+	st.setContent(NewSpool(0, ""))
+	st.content.Write(b)
+}
+
+func (st *SMTPState) setContent(s *Spool) {
+	if st.content != nil {
+		st.content.Close()
+	}
+	st.content = s
+}
+
+// Close releases the message body and any pending BDAT chunks.
+func (st *SMTPState) Close() error {
+	st.endSpan(errTransactionAborted)
+	var err error
+	if st.content != nil {
+		err = st.content.Close()
+		st.content = nil
+	}
+	if st.chunks != nil {
+		st.chunks.Close()
+		st.chunks = nil
+	}
+	return err
+}
+
+// String returns the transaction as the commands and the message.
+func (st *SMTPState) String() string {
+	var b strings.Builder
+	b.Grow(int(st.MessageSize()) + 64*(len(st.Recipients)+2))
+	st.WriteTo(&b)
+	return b.String()
+}
+
+// Bytes is String as a byte slice.
+func (st *SMTPState) Bytes() []byte {
+	var b bytes.Buffer
+	b.Grow(int(st.MessageSize()) + 64*(len(st.Recipients)+2))
+	st.WriteTo(&b)
+	return b.Bytes()
+}
+
+// WriteTo writes the transaction as String does, streaming the content so
+// that large messages are not held in memory.
+func (st *SMTPState) WriteTo(w io.Writer) (int64, error) {
+	var b strings.Builder
+	b.WriteString("MAIL FROM: <" + st.ReturnTo + ">")
+	if len(st.Body) > 0 {
+		b.WriteString(" BODY=" + st.Body)
+	}
+	if st.SMTPUTF8 {
+		b.WriteString(" SMTPUTF8")
+	}
+	if st.RequireTLS {
+		b.WriteString(" REQUIRETLS")
+	}
+	if len(st.Ret) > 0 {
+		b.WriteString(" RET=" + st.Ret)
+	}
+	if len(st.EnvID) > 0 {
+		b.WriteString(" ENVID=" + st.EnvID)
+	}
+	if st.Priority != 0 {
+		fmt.Fprintf(&b, " MT-PRIORITY=%d", st.Priority)
+	}
+	if len(st.ByMode) > 0 {
+		b.WriteString(" BY=" + st.deliverByParam(clockNow(st.clock)))
+	}
+	b.WriteString("\r\n")
+	for i, x := range st.Recipients {
+		b.WriteString("RCPT TO: <" + x + ">")
+		if i < len(st.RecipientDSNs) {
+			b.WriteString(st.RecipientDSNs[i].String())
+		}
+		b.WriteString("\r\n")
+	}
+	b.WriteString("DATA\r\n")
+	for _, x := range st.Headers {
+		b.WriteString(x)
+		b.WriteString("\r\n")
+	}
+	b.WriteString("\r\n")
+	n, err := io.WriteString(w, b.String())
+	if err != nil {
+		return int64(n), err
+	}
+	m, err := io.Copy(w, st.Content())
+	return int64(n) + m, err
+}
+
+type SMTPConnection struct {
+	handler   *SMTPHandler
+	reader    *textproto.Reader
+	writer    *textproto.Writer
+	smtpState *SMTPState
+	id        string
+
+	// line is reused to read lines.
+	line []byte
+
+	// lastReply is the last line written for the metrics and the log of
+	// commands.
+	lastReply string
+
+	span       *Span
+	transcript *Transcript
+	capture    *Capture
+
+	// pending are the commands whose replies are not flushed yet.
+	pending []pendingCommand
+
+	status sessionStatus
+}
+
+func NewSMTPConnection(h *SMTPHandler) *SMTPConnection {
+	b := make([]byte, 8)
+	rand.Read(b)
+	smtpConn := &SMTPConnection{
+		handler:   h,
+		smtpState: &SMTPState{},
+		id:        hex.EncodeToString(b),
+		line:      *linePool.Get().(*[]byte),
+	}
+	smtpConn.setReader(h.Conn())
+	smtpConn.setWriter(h.Conn())
+	return smtpConn
+}
+
+// setReader reads commands and data from r, counting the bytes if the
+// metrics or Sessions are enabled and recording them if captured.
+func (smtpConn *SMTPConnection) setReader(r io.Reader) {
+	if m := smtpConn.Config().Metrics; m != nil {
+		r = countingReader{r, m}
+	}
+	if c := smtpConn.capture; c != nil {
+		r = captureReader{r, c}
+	}
+	if smtpConn.Config().Sessions != nil {
+		r = sessionReader{r, &smtpConn.status}
+	}
+	smtpConn.reader = textproto.NewReader(newPooledReader(r))
+}
+
+// setWriter writes replies to w, recording them if captured.
+func (smtpConn *SMTPConnection) setWriter(w io.Writer) {
+	if c := smtpConn.capture; c != nil {
+		w = captureWriter{w, c}
+	}
+	smtpConn.writer = textproto.NewWriter(newPooledWriter(w))
+}
+
+// ID returns the random identifier of the session.
+func (smtpConn *SMTPConnection) ID() string {
+	return smtpConn.id
+}
+
+func (smtpConn *SMTPConnection) publish(e Event) {
+	smtpConn.Config().Events.Publish(e)
+}
+
+// rejectMessage answers the reply to the end of message data.
+func (smtpConn *SMTPConnection) rejectMessage(reply string) error {
+	st := smtpConn.State()
+	smtpConn.Config().Metrics.add("mproxy_messages_total", 1, "result", "rejected")
+	smtpConn.publish(MessageRejected{
+		SessionID:  smtpConn.ID(),
+		ReturnTo:   st.ReturnTo,
+		Recipients: st.Recipients,
+		Reply:      reply,
+		Time:       smtpConn.Config().now(),
+	})
+	st.span.SetAttribute("smtp.reply", reply)
+	st.endSpan(errors.New(reply))
+	privacy := smtpConn.Config().Privacy
+	smtpConn.Logger().Info("message rejected", "from", privacy.Address(st.ReturnTo),
+		"recipients", privacy.Addresses(st.Recipients), "reply", privacy.Text(reply))
+	if smtpConn.Config().LMTP {
+		return smtpConn.lmtpReplies(func([]string) string { return reply })
+	}
+	return smtpConn.Write(reply)
+}
+
+func (smtpConn *SMTPConnection) acceptMessage(success string) error {
+	st := smtpConn.State()
+	smtpConn.Config().Metrics.add("mproxy_messages_total", 1, "result", "accepted")
+	smtpConn.publish(MessageAccepted{
+		SessionID:   smtpConn.ID(),
+		QueueID:     st.QueueID,
+		MessageID:   st.MessageID,
+		ReturnTo:    st.ReturnTo,
+		Recipients:  st.Recipients,
+		Headers:     append([]string(nil), st.Headers...),
+		Size:        st.MessageSize(),
+		Tags:        st.Tags,
+		Quarantined: st.Quarantined,
+		Time:        smtpConn.Config().now(),
+	})
+	st.span.SetAttribute("smtp.message_size", st.MessageSize())
+	if len(success) > 0 {
+		st.span.SetAttribute("smtp.reply", success)
+	}
+	st.endSpan(nil)
+	privacy := smtpConn.Config().Privacy
+	smtpConn.Config().Stats.message(privacy.api().Address(st.ReturnTo), privacy.api().Addresses(st.Recipients),
+		st.MessageSize(), smtpConn.Config().now())
+	smtpConn.Logger().Info("message accepted", "from", privacy.Address(st.ReturnTo), "recipients", privacy.Addresses(st.Recipients),
+		"message_id", st.MessageID, "size", st.MessageSize())
+	if smtpConn.Config().LMTP {
+		return smtpConn.lmtpReplies(func([]string) string { return success })
+	}
+	return smtpConn.Write(success)
+}
+
+func (smtpConn *SMTPConnection) State() *SMTPState {
+	return smtpConn.smtpState
+}
+
+func (smtpConn *SMTPConnection) Config() *SMTPConfig {
+	return smtpConn.handler.Config
+}
+
+// RemoteIP returns the address of the client, which may be given by a
+// proxy with XCLIENT.
+func (smtpConn *SMTPConnection) RemoteIP() string {
+	addr := smtpConn.State().RemoteAddr
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+func (smtpConn *SMTPConnection) LogSecurityEvent(event string, kvs ...string) {
+	if event == EventAuthFailure {
+		smtpConn.Config().Metrics.add("mproxy_auth_failures_total", 1)
+	}
+	if p := smtpConn.Config().Privacy; p != nil {
+		kvs = append([]string(nil), kvs...)
+		for i := 1; i < len(kvs); i += 2 {
+			if kvs[i-1] == "user" {
+				kvs[i] = p.Address(kvs[i])
+			} else {
+				kvs[i] = p.Text(kvs[i])
+			}
+		}
+	}
+	if l := smtpConn.Config().SecurityLog; l != nil {
+		l.Log(event, smtpConn.RemoteIP(), kvs...)
+	}
+	args := []interface{}{"event", event}
+	for i := 0; i+1 < len(kvs); i += 2 {
+		args = append(args, kvs[i], kvs[i+1])
+	}
+	smtpConn.Logger().Warn("security event", args...)
+}
+
+func (smtpConn *SMTPConnection) ReadLine() (string, error) {
+	if err := smtpConn.flushIfIdle(); err != nil {
+		return "", err
+	}
+	return smtpConn.reader.ReadLine()
+}
+
+// ReadLineLimit reads a line whose length including CRLF is at most max
+// bytes. A longer line is consumed and discarded, then ErrLineTooLong is
+// returned so that the following line can still be read.
+func (smtpConn *SMTPConnection) ReadLineLimit(max int) (string, error) {
+	if err := smtpConn.flushIfIdle(); err != nil {
+		return "", err
+	}
+	return smtpConn.readLineLimit(max)
+}
+
+func (smtpConn *SMTPConnection) readLineLimit(max int) (string, error) {
+	line, _, err := smtpConn.readRawLineLimit(max)
+	return string(line), err
+}
+
+// readRawLineLimit is readLineLimit that also reports whether the line was
+// terminated by a bare LF or contains a bare CR instead of ending with CRLF.
+// The line is only valid until the next read.
+func (smtpConn *SMTPConnection) readRawLineLimit(max int) ([]byte, bool, error) {
+	line := smtpConn.line[:0]
+	defer func() { smtpConn.line = line[:0] }()
+	tooLong := false
+	for {
+		b, err := smtpConn.reader.R.ReadSlice('\n')
+		if err == io.EOF && len(line)+len(b) > 0 {
+			err = nil
+		}
+		if err != nil && err != bufio.ErrBufferFull {
+			return nil, false, err
+		}
+		if !tooLong {
+			line = append(line, b...)
+			if max > 0 && len(line) > max+2 {
+				tooLong = true
+				line = line[:0]
+			}
+		}
+		if err == nil {
+			break
+		}
+	}
+	if tooLong {
+		return nil, false, ErrLineTooLong
+	}
+	b, bare := TrimLineEnding(line)
+	if max > 0 && len(b)+2 > max {
+		return nil, false, ErrLineTooLong
+	}
+	return b, bare, nil
+}
+
+func (smtpConn *SMTPConnection) ReadBytesTo(w io.Writer, n int64) error {
+	smtpConn.transcript.write("C:", fmt.Sprintf("[%d octets]", n))
+	_, err := io.CopyN(w, smtpConn.reader.R, n)
+	return err
+}
+
+func (smtpConn *SMTPConnection) ReadBytes(n int64) ([]byte, error) {
+	var buf bytes.Buffer
+	if _, err := io.CopyN(&buf, smtpConn.reader.R, n); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (smtpConn *SMTPConnection) Discard(n int64) error {
+	smtpConn.transcript.write("C:", fmt.Sprintf("[%d octets discarded]", n))
+	_, err := io.CopyN(io.Discard, smtpConn.reader.R, n)
+	return err
+}
+
+func (smtpConn *SMTPConnection) ReadDotLines() ([]string, error) {
+	if err := smtpConn.Flush(); err != nil {
+		return nil, err
+	}
+	return smtpConn.reader.ReadDotLines()
+}
+
+// ReadDotLinesLimit reads lines up to the terminating dot like ReadDotLines,
+// but stops buffering once the total size exceeds maxSize bytes or a line
+// exceeds maxLineLength bytes. The rest of the data is consumed and
+// discarded, then ErrMessageTooLarge or ErrLineTooLong is returned.
+func (smtpConn *SMTPConnection) ReadDotLinesLimit(maxSize int64, maxLineLength int) ([]string, error) {
+	lines := make([]string, 0)
+	err := smtpConn.ReadDotLinesFunc(maxSize, maxLineLength, func(line string) error {
+		lines = append(lines, line)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return lines, nil
+}
+
+// ReadDotLinesFunc is the streaming version of ReadDotLinesLimit that calls
+// f for each dot-unstuffed line instead of buffering them. Once a limit is
+// exceeded or f returns an error, the rest of the data is discarded and the
+// error is returned after the terminating dot.
+//
+// With StrictLineEndings enabled, only CRLF.CRLF ends the data and a bare CR
+// or LF results in ErrBareLineEnding, so that the message can not be read
+// differently by a downstream relay.
+func (smtpConn *SMTPConnection) ReadDotLinesFunc(maxSize int64, maxLineLength int, f func(line string) error) error {
+	return smtpConn.readDotLines(maxSize, maxLineLength, func(b []byte) error {
+		return f(string(b))
+	})
+}
+
+// readDotLines is ReadDotLinesFunc passing the lines as byte slices, which
+// are only valid until f returns.
+func (smtpConn *SMTPConnection) readDotLines(maxSize int64, maxLineLength int, f func(b []byte) error) error {
+	if err := smtpConn.Flush(); err != nil {
+		return err
+	}
+	strict := smtpConn.Config().StrictLineEndings
+	size := int64(0)
+	var limitErr error
+	for {
+		b, bare, err := smtpConn.readRawLineLimit(maxLineLength)
+		if err == ErrLineTooLong {
+			smtpConn.transcript.data([]byte("[line too long]"))
+			if limitErr == nil {
+				limitErr = err
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		smtpConn.transcript.data(b)
+		if strict && bare {
+			if limitErr == nil {
+				limitErr = ErrBareLineEnding
+			}
+			continue
+		}
+		b, end := UnstuffDataLine(b)
+		if end {
+			break
+		}
+		size += int64(len(b)) + 2
+		if maxSize > 0 && size > maxSize && limitErr == nil {
+			limitErr = ErrMessageTooLarge
+		}
+		if limitErr == nil {
+			limitErr = f(b)
+		}
+	}
+	return limitErr
+}
+
+// Write queues the reply lines and flushes them unless the client has
+// already pipelined further commands, in which case the replies are
+// sent together once the pending input is consumed (RFC 2920).
+func (smtpConn *SMTPConnection) Write(msg ...string) error {
+	for i, x := range msg {
+		msg[i] = smtpConn.Config().Banners.reply(smtpConn, withEnhancedStatusCode(x))
+	}
+	return smtpConn.WriteRaw(msg...)
+}
+
+// Reply writes the reply of the situation by SMTPConfig.Catalog.
+func (smtpConn *SMTPConnection) Reply(key string, args ...string) error {
+	return smtpConn.Write(smtpConn.Config().Catalog.Reply(key, args...))
+}
+
+// WriteRaw is the same as Write but sends the lines as they are, for the
+// greeting and EHLO replies that must not carry enhanced status codes.
+func (smtpConn *SMTPConnection) WriteRaw(msg ...string) error {
+	w := smtpConn.writer.W
+	for _, x := range msg {
+		w.WriteString(x)
+		if _, err := w.WriteString("\r\n"); err != nil {
+			return err
+		}
+		smtpConn.lastReply = x
+		smtpConn.transcript.server(x)
+	}
+	return smtpConn.flushIfIdle()
+}
+
+func (smtpConn *SMTPConnection) Flush() error {
+	if err := smtpConn.writer.W.Flush(); err != nil {
+		return err
+	}
+	if len(smtpConn.pending) > 0 {
+		smtpConn.observePending()
+	}
+	return nil
+}
+
+func (smtpConn *SMTPConnection) flushIfIdle() error {
+	if smtpConn.reader.R.Buffered() > 0 {
+		return nil
+	}
+	return smtpConn.Flush()
+}
+
+func (smtpConn *SMTPConnection) Send(st *SMTPState) error {
+	return smtpConn.handler.Send(st)
+}
+
+func (smtpConn *SMTPConnection) Quit() error {
+	if err := smtpConn.Flush(); err != nil {
+		smtpConn.handler.Close()
+		return err
+	}
+	return smtpConn.handler.Close()
+}
+
+type SMTPCommand interface {
+	Execute(conn *SMTPConnection, s string) error
+}
+
+type HelloCommand struct {
+}
+
+func (cmnd *HelloCommand) Execute(conn *SMTPConnection, s string) error {
+	cmd, err := ParseCommand(s)
+	if err != nil || len(strings.Fields(cmd.Arg)) == 0 {
+		return conn.Reply("helo.syntax")
+	}
+	if (cmd.Verb == "LHLO") != conn.Config().LMTP {
+		return conn.Reply("command.unknown")
+	}
+	st := conn.State()
+	st.Hello = cmd.Verb
+	st.ClientName = strings.Fields(cmd.Arg)[0]
+	if len(st.xclientProto) > 0 {
+		st.Hello = st.xclientProto
+	}
+	if len(st.xclientHelo) > 0 {
+		st.ClientName = st.xclientHelo
+	}
+	st.Reset()
+	reply := conn.Config().Access.checkHelo(conn)
+	if len(reply) == 0 {
+		reply = conn.Config().Hooks.runHelo(conn)
+	}
+	if len(reply) > 0 {
+		st.Hello = ""
+		st.ClientName = ""
+		st.Reset()
+		return conn.Write(reply)
+	}
+	keywords := extensions(conn)
+	lines := make([]string, 0, len(keywords)+1)
+	lines = append(lines, "250-"+conn.Config().Banners.ehlo(conn))
+	for i, x := range keywords {
+		if i == len(keywords)-1 {
+			lines = append(lines, "250 "+x)
+		} else {
+			lines = append(lines, "250-"+x)
+		}
+	}
+	return conn.WriteRaw(lines...)
+}
+
+// extensions returns the EHLO keywords enabled for the connection.
+func extensions(conn *SMTPConnection) []string {
+	st := conn.State()
+	var keywords []string
+	if conn.Config().Authenticate != nil && (!conn.Config().AuthRequiresTLS || st.TLS != nil) {
+		keywords = append(keywords, "AUTH PLAIN")
+	}
+	keywords = append(keywords,
+		"PIPELINING",
+		"8BITMIME",
+		"SMTPUTF8",
+		"CHUNKING",
+		"DSN",
+		"ENHANCEDSTATUSCODES",
+		"MT-PRIORITY",
+		"DELIVERBY",
+		fmt.Sprintf("SIZE %d", conn.Config().MaxMessageSize),
+	)
+	if conn.Config().Queue != nil {
+		keywords = append(keywords, "ETRN", "ATRN")
+	}
+	if xclientTrusted(conn) {
+		keywords = append(keywords, "XCLIENT NAME ADDR PORT PROTO HELO LOGIN DESTADDR DESTPORT")
+	}
+	if conn.Config().TLSConfig != nil {
+		if st.TLS == nil {
+			keywords = append(keywords, "STARTTLS")
+		} else {
+			keywords = append(keywords, "REQUIRETLS")
+		}
+	}
+	return append(keywords, "HELP")
+}
+
+var mailParameters = []string{"SIZE", "BODY", "SMTPUTF8", "REQUIRETLS", "RET", "ENVID", "MT-PRIORITY", "BY"}
+
+type MailCommand struct {
+}
+
+func (cmnd *MailCommand) Execute(conn *SMTPConnection, line string) error {
+	if !conn.State().HasStarted() {
+		return conn.Reply("session.not_started")
+	}
+	if conn.State().InTransaction() {
+		return conn.Reply("mail.sender_exists")
+	}
+	if conn.Config().RequireAuth && len(conn.State().Username) == 0 {
+		return conn.Reply("auth.required")
+	}
+	if conn.Config().Drain.Draining() {
+		if err := conn.Reply("session.draining"); err != nil {
+			return err
+		}
+		return conn.Quit()
+	}
+	cmd, err := ParseCommand(line)
+	if err != nil {
+		return conn.Reply("mail.syntax")
+	}
+	addr, params, err := ParsePathArgument(cmd.Arg, "FROM")
+	if err != nil {
+		return conn.Reply("mail.syntax")
+	}
+	if key := params.Unsupported(mailParameters); len(key) > 0 {
+		return conn.Reply("param.unsupported", key)
+	}
+	size := int64(0)
+	if v, ok := params["SIZE"]; ok {
+		size, err = strconv.ParseInt(v, 10, 64)
+		if err != nil || size < 0 {
+			return conn.Reply("mail.size_invalid")
+		}
+	}
+	body := ""
+	if v, ok := params["BODY"]; ok {
+		body = strings.ToUpper(v)
+		if body != "7BIT" && body != "8BITMIME" {
+			return conn.Reply("mail.body_invalid")
+		}
+	}
+	smtpUTF8 := false
+	if v, ok := params["SMTPUTF8"]; ok {
+		if len(v) > 0 {
+			return conn.Reply("mail.smtputf8_value")
+		}
+		smtpUTF8 = true
+	}
+	requireTLS := false
+	if v, ok := params["REQUIRETLS"]; ok {
+		if len(v) > 0 {
+			return conn.Reply("mail.requiretls_value")
+		}
+		if conn.State().TLS == nil {
+			return conn.Reply("mail.requiretls_without_tls")
+		}
+		requireTLS = true
+	}
+	ret := ""
+	if v, ok := params["RET"]; ok {
+		ret = strings.ToUpper(v)
+		if ret != "FULL" && ret != "HDRS" {
+			return conn.Reply("mail.ret_invalid")
+		}
+	}
+	envID := ""
+	if v, ok := params["ENVID"]; ok {
+		if len(v) == 0 || len(v) > 100 || !isXText(v) {
+			return conn.Reply("mail.envid_invalid")
+		}
+		envID = v
+	}
+	priority := 0
+	if v, ok := params["MT-PRIORITY"]; ok {
+		// RFC 6710
+		n, err := strconv.Atoi(v)
+		if err != nil || n < -9 || n > 9 {
+			return conn.Reply("mail.priority_invalid")
+		}
+		priority = n
+	}
+	var deliverBy time.Time
+	byMode := ""
+	if v, ok := params["BY"]; ok {
+		if deliverBy, byMode, err = parseDeliverBy(v, conn.Config().now()); err != nil {
+			return conn.Reply("mail.by_invalid")
+		}
+	}
+	if key := checkAddressEncoding(addr, smtpUTF8); len(key) > 0 {
+		return conn.Reply(key)
+	}
+	address := Address{}
+	if len(addr) > 0 {
+		if address, err = ParseAddress(addr); err != nil {
+			return conn.Reply("mail.bad_address")
+		}
+		addr = address.String()
+	}
+	if conn.Config().SenderMatchesLogin && !senderMatchesLogin(address, conn.State().Username) {
+		return conn.Reply("mail.not_owned")
+	}
+	max := conn.Config().MaxMessageSize
+	if max > 0 && size > max {
+		return conn.Reply("message.too_big")
+	}
+	st := conn.State()
+	st.Reset()
+	st.Phase = PhaseMail
+	st.ReturnTo = addr
+	st.ReturnToAddress = address
+	st.NullSender = len(addr) == 0
+	st.MailParams = params
+	st.Size = size
+	st.Body = body
+	st.SMTPUTF8 = smtpUTF8
+	st.TransactionID = newTransactionID()
+	st.span = conn.span.Child("smtp.transaction")
+	st.span.SetAttribute("smtp.transaction_id", st.TransactionID)
+	st.span.SetAttribute("smtp.mail_from", addr)
+	st.RequireTLS = requireTLS
+	st.Ret = ret
+	st.EnvID = envID
+	st.Priority = priority
+	st.DeliverBy = deliverBy
+	st.ByMode = byMode
+	reply := conn.Config().Access.checkSender(conn)
+	if len(reply) == 0 {
+		reply = applySPF(conn)
+	}
+	if len(reply) == 0 {
+		reply = applySenderDomain(conn)
+	}
+	if len(reply) == 0 {
+		reply = applyPolicy(conn, StageMail, "")
+	}
+	if len(reply) == 0 {
+		reply = conn.Config().Hooks.runMail(conn)
+	}
+	if len(reply) > 0 {
+		st.Reset()
+		return conn.Write(reply)
+	}
+	return conn.Reply("mail.ok")
 }
 
-func (st *SMTPState) HasStarted() bool {
-	return len(st.Hello) > 0
-}
+var recipientParameters = []string{"NOTIFY", "ORCPT"}
 
-func (st *SMTPState) Reset() {
-	st.ReturnTo = ""
-	st.Recipients = make([]string, 0)
-	st.Headers = make([]string, 0)
-	st.Content = make([]byte, 0)
+type RecipientCommand struct {
 }
 
-func (st *SMTPState) String() string {
-	s := ""
-	s += fmt.Sprintf("MAIL FROM: <%s>\r\n", st.ReturnTo)
-	for _, x := range st.Recipients {
-		s += fmt.Sprintf("RCPT TO: <%s>\r\n", x)
+func (cmnd *RecipientCommand) Execute(conn *SMTPConnection, line string) error {
+	if !conn.State().HasStarted() {
+		return conn.Reply("session.not_started")
 	}
-	s += "DATA\r\n"
-	for _, x := range st.Headers {
-		s += fmt.Sprintf("%s\r\n", x)
+	if phase := conn.State().Phase; phase != PhaseMail && phase != PhaseRcpt {
+		return conn.Reply("rcpt.need_mail")
 	}
-	s += "\r\n"
-	s += string(st.Content)
-	return s
-}
-
-type SMTPConnection struct {
-	handler   *SMTPHandler
-	reader    *textproto.Reader
-	writer    *textproto.Writer
-	smtpState *SMTPState
-}
-
-func NewSMTPConnection(h *SMTPHandler) *SMTPConnection {
-	return &SMTPConnection{
-		handler:   h,
-		reader:    textproto.NewReader(bufio.NewReader(h.Conn())),
-		writer:    textproto.NewWriter(bufio.NewWriter(h.Conn())),
-		smtpState: &SMTPState{},
+	limit := conn.Config().RecipientLimit()
+	if limit > 0 && len(conn.State().Recipients) >= limit {
+		conn.LogSecurityEvent(EventRateLimit, "limit", "recipients")
+		return conn.Reply("rcpt.too_many")
 	}
+	cmd, err := ParseCommand(line)
+	if err != nil {
+		return conn.Reply("rcpt.syntax")
+	}
+	addr, params, err := ParsePathArgument(cmd.Arg, "TO")
+	if err != nil || len(addr) == 0 {
+		return conn.Reply("rcpt.syntax")
+	}
+	if key := params.Unsupported(recipientParameters); len(key) > 0 {
+		return conn.Reply("param.unsupported", key)
+	}
+	dsn := RecipientDSN{}
+	if v, ok := params["NOTIFY"]; ok {
+		notify, ok := parseNotify(v)
+		if !ok {
+			return conn.Reply("rcpt.notify_invalid")
+		}
+		dsn.Notify = notify
+	}
+	if v, ok := params["ORCPT"]; ok {
+		if !isValidORcpt(v) {
+			return conn.Reply("rcpt.orcpt_invalid")
+		}
+		dsn.ORcpt = v
+	}
+	st := conn.State()
+	if key := checkAddressEncoding(addr, st.SMTPUTF8); len(key) > 0 {
+		return conn.Reply(key)
+	}
+	address, err := ParseAddress(addr)
+	if err != nil {
+		return conn.Reply("rcpt.bad_address")
+	}
+	verpRecipient, reply := decodeRecipient(conn, &address)
+	if len(reply) > 0 {
+		return conn.Write(reply)
+	}
+	catchAll := ""
+	if domains := conn.Config().VirtualDomains; domains != nil {
+		if !domains.Accepts(address.Domain) {
+			return conn.Reply("rcpt.relay_denied")
+		}
+		if x := domains.Mailbox(address); x != address.String() {
+			catchAll = x
+		}
+	}
+	if reply := conn.Config().Access.checkRecipient(conn, address); len(reply) > 0 {
+		return conn.Write(reply)
+	}
+	if reply := applyPolicy(conn, StageRcpt, address.String()); len(reply) > 0 {
+		return conn.Write(reply)
+	}
+	if reply := validateRecipient(conn, address); len(reply) > 0 {
+		return conn.Write(reply)
+	}
+	if reply := conn.Config().Hooks.runRcpt(conn, address); len(reply) > 0 {
+		return conn.Write(reply)
+	}
+	addresses := []Address{address}
+	if aliases := conn.Config().Aliases; aliases != nil {
+		xs, ok, err := aliases.Resolve(address)
+		if err != nil {
+			return conn.Reply("rcpt.bad_alias")
+		}
+		if ok {
+			addresses = xs
+		}
+	}
+	if limit > 0 && len(st.Recipients)+len(addresses) > limit {
+		conn.LogSecurityEvent(EventRateLimit, "limit", "recipients")
+		return conn.Reply("rcpt.too_many")
+	}
+	if quotas := conn.Config().Quotas; quotas != nil {
+		for _, x := range addresses {
+			if quotas.Full(st, x.String()) {
+				return conn.Reply("rcpt.mailbox_full")
+			}
+		}
+	}
+	st.Phase = PhaseRcpt
+	group := make([]string, 0, len(addresses))
+	for _, x := range addresses {
+		group = append(group, x.String())
+		st.Recipients = append(st.Recipients, x.String())
+		st.RecipientAddresses = append(st.RecipientAddresses, x)
+		st.RecipientParams = append(st.RecipientParams, params)
+		st.RecipientDSNs = append(st.RecipientDSNs, dsn)
+		mailbox := x.String()
+		if len(catchAll) > 0 {
+			mailbox = catchAll
+		}
+		st.RecipientMailboxes = append(st.RecipientMailboxes, mailbox)
+	}
+	st.rcptGroups = append(st.rcptGroups, group)
+	if len(verpRecipient) > 0 {
+		st.VERPRecipients = append(st.VERPRecipients, verpRecipient)
+	}
+	return conn.Reply("rcpt.ok")
 }
 
-func (smtpConn *SMTPConnection) State() *SMTPState {
-	return smtpConn.smtpState
-}
-
-func (smtpConn *SMTPConnection) ReadLine() (string, error) {
-	return smtpConn.reader.ReadLine()
+func parseNotify(s string) ([]string, bool) {
+	xs := strings.Split(strings.ToUpper(s), ",")
+	for _, x := range xs {
+		switch x {
+		case "NEVER":
+			if len(xs) > 1 {
+				return nil, false
+			}
+		case "SUCCESS", "FAILURE", "DELAY":
+		default:
+			return nil, false
+		}
+	}
+	return xs, true
 }
 
-func (smtpConn *SMTPConnection) ReadDotLines() ([]string, error) {
-	return smtpConn.reader.ReadDotLines()
+func isValidORcpt(s string) bool {
+	xs := strings.SplitN(s, ";", 2)
+	return len(xs) == 2 && len(xs[0]) > 0 && len(xs[1]) > 0 && isXText(xs[1])
 }
 
-func (smtpConn *SMTPConnection) Write(msg ...string) error {
-	for _, x := range msg {
-		if err := smtpConn.writer.PrintfLine(x); err != nil {
-			return err
+// isXText reports whether s is a valid xtext as defined in RFC 3461.
+func isXText(s string) bool {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '+':
+			if i+2 >= len(s) || !isUpperHex(s[i+1]) || !isUpperHex(s[i+2]) {
+				return false
+			}
+			i += 2
+		case c < '!' || c > '~' || c == '=':
+			return false
 		}
 	}
-	return nil
+	return true
 }
 
-func (smtpConn *SMTPConnection) Send(st *SMTPState) error {
-	return smtpConn.handler.Send(st)
+func isUpperHex(c byte) bool {
+	return ('0' <= c && c <= '9') || ('A' <= c && c <= 'F')
 }
 
-func (smtpConn *SMTPConnection) Quit() error {
-	return smtpConn.handler.Close()
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
 }
 
-type SMTPCommand interface {
-	Execute(conn *SMTPConnection, s string) error
+// checkAddressEncoding returns the situation of the reply refusing the
+// address, or an empty string.
+func checkAddressEncoding(addr string, smtpUTF8 bool) string {
+	if isASCII(addr) {
+		return ""
+	}
+	if !utf8.ValidString(addr) {
+		return "address.not_utf8"
+	}
+	if !smtpUTF8 {
+		return "address.needs_smtputf8"
+	}
+	return ""
 }
 
-type HelloCommand struct {
+type AuthCommand struct {
 }
 
-func (cmnd *HelloCommand) Execute(conn *SMTPConnection, s string) error {
-	if conn.State().HasStarted() {
-		return conn.Write("550 Session has started")
+func (cmnd *AuthCommand) Execute(conn *SMTPConnection, line string) error {
+	st := conn.State()
+	if !st.HasStarted() {
+		return conn.Reply("session.not_started")
 	}
-	xs := strings.SplitN(strings.TrimSpace(s), " ", 2)
-	if len(xs) < 2 {
-		return conn.Write("550 Invalid syntax (EHLO|HELO) domain")
+	xs := strings.Fields(line)
+	mechanism := ""
+	if len(xs) > 1 {
+		mechanism = strings.ToUpper(xs[1])
+	}
+	auth := conn.Config().Authenticate
+	if auth == nil {
+		conn.auditAuth(mechanism, "", AuthUnsupported)
+		return conn.Reply("auth.unavailable")
+	}
+	if conn.Config().AuthRequiresTLS && st.TLS == nil {
+		conn.auditAuth(mechanism, "", AuthTLSRequired)
+		return conn.Reply("auth.encryption_required")
+	}
+	if len(st.Username) > 0 {
+		return conn.Reply("auth.already")
+	}
+	if st.InTransaction() {
+		return conn.Reply("auth.in_transaction")
+	}
+	if len(xs) < 2 || len(xs) > 3 {
+		conn.auditAuth(mechanism, "", AuthInvalid)
+		return conn.Reply("auth.syntax")
+	}
+	if mechanism != "PLAIN" {
+		conn.auditAuth(mechanism, "", AuthUnsupported)
+		return conn.Reply("auth.unknown_mechanism")
 	}
-	st := conn.State()
-	st.Hello = xs[0]
-	st.ClientName = xs[1]
-	return conn.Write(
-		"250-"+st.ServerName,
-		"250-AUTH PLAIN",
-		"250 HELP",
-	)
-}
 
-var mailCommandPattern = regexp.MustCompile("^MAIL FROM: *<([^>]+)> *$")
+	limiter := conn.Config().AuthLimiter
+	ipKey := "ip:" + conn.RemoteIP()
+	if limiter != nil && limiter.Locked(ipKey) {
+		conn.auditAuth(mechanism, "", AuthLocked)
+		return cmnd.reject(conn, "")
+	}
 
-type MailCommand struct {
-}
+	resp := ""
+	if len(xs) == 3 {
+		resp = xs[2]
+	} else {
+		if err := conn.Write("334 "); err != nil {
+			return err
+		}
+		var err error
+		if resp, err = conn.ReadLine(); err != nil {
+			return err
+		}
+		conn.transcript.write("C:", "***")
+	}
+	if resp == "*" {
+		conn.auditAuth(mechanism, "", AuthCancelled)
+		return conn.Reply("auth.cancelled")
+	}
+	username, password, ok := decodePlainAuth(resp)
+	if !ok {
+		conn.auditAuth(mechanism, "", AuthInvalid)
+		return conn.Reply("auth.plain_invalid")
+	}
 
-func (cmnd *MailCommand) Execute(conn *SMTPConnection, line string) error {
-	if !conn.State().HasStarted() {
-		return conn.Write("550 Session has not started yet.")
+	userKey := "user:" + username
+	if limiter != nil && limiter.Locked(userKey) {
+		conn.auditAuth(mechanism, username, AuthLocked)
+		return cmnd.reject(conn, username)
+	}
+	if auth(username, password) {
+		if limiter != nil {
+			limiter.Succeed(ipKey, userKey)
+		}
+		st.Username = username
+		if reply := conn.Config().Hooks.runAuth(conn); len(reply) > 0 {
+			st.Username = ""
+			conn.auditAuth(mechanism, username, AuthRejected)
+			return conn.Write(reply)
+		}
+		conn.auditAuth(mechanism, username, AuthSuccess)
+		return conn.Reply("auth.ok")
 	}
-	xs := mailCommandPattern.FindStringSubmatch(line)
-	if xs == nil || len(xs) != 2 {
-		return conn.Write("550 Invalid syntax MAIL FROM: <foo@example.net>")
+	conn.auditAuth(mechanism, username, AuthFailure)
+	conn.LogSecurityEvent(EventAuthFailure, "mechanism", "PLAIN", "user", username)
+	if limiter != nil {
+		select {
+		case <-clockAfter(limiter.Clock, limiter.Fail(ipKey, userKey)):
+		case <-conn.status.interrupted():
+			// the session replies 421 instead
+			return nil
+		}
+		if limiter.Locked(ipKey, userKey) {
+			return cmnd.reject(conn, username)
+		}
 	}
-	conn.State().ReturnTo = xs[1]
-	return conn.Write("250 OK")
+	return conn.Reply("auth.invalid")
 }
 
-var recipientCommandPattern = regexp.MustCompile("^RCPT TO: *<([^>]+)> *$")
-
-type RecipientCommand struct {
+func (cmnd *AuthCommand) reject(conn *SMTPConnection, username string) error {
+	conn.LogSecurityEvent(EventAuthLockout, "user", username)
+	if err := conn.Reply("auth.too_many_failures"); err != nil {
+		return err
+	}
+	return conn.Quit()
 }
 
-func (cmnd *RecipientCommand) Execute(conn *SMTPConnection, line string) error {
-	if !conn.State().HasStarted() {
-		return conn.Write("550 Session has not started yet.")
+func decodePlainAuth(s string) (string, string, bool) {
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return "", "", false
 	}
-
-	// TODO: Check if MAIL FROM is specified?
-
-	xs := recipientCommandPattern.FindStringSubmatch(line)
-	if xs == nil || len(xs) != 2 {
-		return conn.Write("550 Invalid syntax RCPT TO: <foo@example.net>")
+	xs := strings.Split(string(b), "\x00")
+	if len(xs) != 3 || len(xs[1]) == 0 {
+		return "", "", false
 	}
-	st := conn.State()
-	st.Recipients = append(st.Recipients, xs[1])
-	return conn.Write("250 OK")
+	return xs[1], xs[2], true
 }
 
 type ResetCommand struct {
@@ -158,82 +1543,376 @@ type ResetCommand struct {
 
 func (cmnd *ResetCommand) Execute(conn *SMTPConnection, line string) error {
 	conn.State().Reset()
-	return conn.Write("250 OK")
+	return conn.Reply("rset.ok")
 }
 
 type VerifyCommand struct {
 }
 
 func (cmnd *VerifyCommand) Execute(conn *SMTPConnection, line string) error {
-	return conn.Write("550 VRFY not supported")
+	verify := conn.Config().Verify
+	if verify == nil {
+		return conn.Reply("vrfy.not_supported")
+	}
+	cmd, err := ParseCommand(line)
+	if err != nil || len(cmd.Arg) == 0 {
+		return conn.Reply("vrfy.syntax")
+	}
+	return conn.Write(verify(cmd.Arg))
 }
 
 type NoopCommand struct {
 }
 
 func (cmnd *NoopCommand) Execute(conn *SMTPConnection, line string) error {
-	return conn.Write("250 OK")
+	return conn.Reply("noop.ok")
 }
 
 type QuitCommand struct {
 }
 
 func (cmnd *QuitCommand) Execute(conn *SMTPConnection, line string) error {
-	if err := conn.Quit(); err != nil {
+	if err := conn.Reply("quit.ok"); err != nil {
 		return err
 	}
-	return conn.Write("221 Bye")
+	return conn.Quit()
 }
 
 type DataCommand struct {
 }
 
 func (cmnd *DataCommand) Execute(conn *SMTPConnection, line string) error {
-	var err error
-	if err = conn.Write("250 OK"); err != nil {
+	st := conn.State()
+	if !st.HasStarted() {
+		return conn.Reply("session.not_started")
+	}
+	if st.Phase != PhaseRcpt {
+		return conn.Reply("data.need_rcpt")
+	}
+	if err := conn.Reply("data.start"); err != nil {
 		return err
 	}
-	lines, err := conn.ReadDotLines()
+	st.Phase = PhaseData
+	defer st.Reset()
+	config := conn.Config()
+	mb := newMessageBuilder(config)
+	defer mb.release()
+	span := st.span.Child("smtp.data")
+	err := conn.readDotLines(config.MaxMessageSize, config.TextLineLimit(), mb.add)
+	span.SetAttribute("smtp.message_size", mb.body.Size())
+	span.Finish(err)
+	st.Phase = PhaseDone
+	if reply, ok := messageErrorReply(conn, err); ok {
+		mb.body.Close()
+		return conn.rejectMessage(reply)
+	}
 	if err != nil {
+		mb.body.Close()
 		return err
 	}
-	headers := make([]string, 0)
-	content := make([]byte, 0)
-	inBody := false
-	for _, x := range lines {
-		if !inBody && len(strings.TrimSpace(x)) == 0 {
-			inBody = true
-			continue
+	return deliverMessage(conn, mb)
+}
+
+// messageBuilder splits message lines into the header lines and the body,
+// which is written to a spool.
+type messageBuilder struct {
+	headers    []string
+	rawHeader  []byte
+	body       *Spool
+	inBody     bool
+	maxHeaders int
+	budget     *MemoryBudget
+	reserved   int64
+}
+
+func newMessageBuilder(config *SMTPConfig) *messageBuilder {
+	return &messageBuilder{
+		headers:    make([]string, 0),
+		body:       config.NewSpool(),
+		maxHeaders: config.HeaderLineLimit(),
+		budget:     config.MemoryBudget,
+	}
+}
+
+func (mb *messageBuilder) release() {
+	mb.budget.Release(mb.reserved)
+	mb.reserved = 0
+}
+
+func (mb *messageBuilder) addLine(line string) error {
+	return mb.add([]byte(line))
+}
+
+var crlf = []byte("\r\n")
+
+// add adds a line without copying it but for the header.
+func (mb *messageBuilder) add(line []byte) error {
+	n := int64(len(line)) + 2
+	if !mb.budget.Reserve(n) {
+		return ErrInsufficientStorage
+	}
+	mb.reserved += n
+	if !mb.inBody {
+		mb.rawHeader = append(append(mb.rawHeader, line...), crlf...)
+	}
+	if !mb.inBody && len(bytes.TrimSpace(line)) == 0 {
+		mb.inBody = true
+		return nil
+	}
+	if mb.inBody {
+		if _, err := mb.body.Write(line); err != nil {
+			return err
 		}
-		if inBody {
-			content = append(content, []byte(x+"\r\n")...)
-		} else {
-			headers = append(headers, x)
+		_, err := mb.body.Write(crlf)
+		return err
+	}
+	if mb.maxHeaders > 0 && len(mb.headers) >= mb.maxHeaders {
+		return ErrTooManyHeaders
+	}
+	mb.headers = append(mb.headers, string(line))
+	return nil
+}
+
+func messageErrorReply(conn *SMTPConnection, err error) (string, bool) {
+	key := ""
+	switch err {
+	case nil:
+		return "", false
+	case ErrMessageTooLarge:
+		key = "message.too_big"
+	case ErrLineTooLong:
+		key = "message.line_too_long"
+	case ErrTooManyHeaders:
+		key = "message.too_many_headers"
+	case ErrInsufficientStorage:
+		conn.LogSecurityEvent(EventRateLimit, "limit", "memory_budget")
+		key = "storage.insufficient"
+	case ErrBareLineEnding:
+		key = "message.bare_line_ending"
+	}
+	if _, ok := err.(*os.PathError); ok {
+		key = "storage.insufficient"
+	}
+	if len(key) == 0 {
+		return "", false
+	}
+	return conn.Config().Catalog.Reply(key), true
+}
+
+// deliverMessage passes the built message to the handler and answers the
+// reply, with the queue ID assigned to the message if accepted.
+func deliverMessage(conn *SMTPConnection, mb *messageBuilder) error {
+	st := conn.State()
+	st.QueueID = newQueueID(conn.Config().now())
+	success := conn.Config().Catalog.Reply("data.queued", st.QueueID)
+	if conn.Config().LMTP {
+		success = conn.Config().Catalog.Reply("lmtp.accepted")
+	}
+	if err := mb.body.Flush(); err != nil {
+		mb.body.Close()
+		return conn.rejectMessage(conn.Config().Catalog.Reply("storage.insufficient"))
+	}
+	if limit := conn.Config().HopLimit(); limit > 0 && countHeaders(mb.headers, "Received") > limit {
+		mb.body.Close()
+		return conn.rejectMessage(conn.Config().Catalog.Reply("message.loop"))
+	}
+	st.Headers = mb.headers
+	st.rawHeader, st.rawHeaderLines = mb.rawHeader, append([]string{}, mb.headers...)
+	st.setContent(mb.body)
+	if v, ok := headerValue(st.Headers, "TLS-Required"); ok && !st.RequireTLS {
+		// RFC 8689 section 5: the header is ignored under REQUIRETLS
+		st.TLSOptional = strings.EqualFold(strings.TrimSpace(v), "No")
+	}
+	if err := applyDeliverAt(st, conn.Config().now()); err != nil {
+		return conn.rejectMessage(conn.Config().Catalog.Reply("message.deliver_at_invalid", DeliverAtHeader))
+	}
+	applyDKIM(conn)
+	if reply := applyDMARC(conn); len(reply) > 0 {
+		return conn.rejectMessage(reply)
+	}
+	if conn.Config().FixupHeaders {
+		fixupHeaders(st, conn.Config().now(), conn.Config().FixupFrom)
+	} else if id, ok := headerValue(st.Headers, "Message-ID"); ok {
+		st.MessageID = id
+	}
+	st.Headers = conn.Config().HeaderRules.Apply(st.Headers)
+	if err := conn.Config().Mutations.Apply(st, conn.Config().ListenerName, conn.Config().now()); err != nil {
+		conn.Logger().Warn("message not mutated", "error", err.Error())
+	}
+	for _, x := range st.VERPRecipients {
+		st.Headers = append(st.Headers, "X-VERP-Recipient: "+x)
+	}
+	if len(st.AuthResults) > 0 {
+		st.Headers = append(authResultsHeader(st), removeAuthResults(st.Headers, st.ServerName)...)
+	}
+	if conn.Config().AddReceived {
+		st.Headers = append(receivedHeader(st, conn.RemoteIP(), conn.Config().now()), st.Headers...)
+	}
+	if reply := applyScanner(conn); len(reply) > 0 {
+		return conn.rejectMessage(reply)
+	}
+	if reply := applyPolicy(conn, StageData, ""); len(reply) > 0 {
+		return conn.rejectMessage(reply)
+	}
+	if reply := conn.Config().Hooks.runData(conn); len(reply) > 0 {
+		return conn.rejectMessage(reply)
+	}
+	if q := conn.Config().Quarantine; q != nil && st.Quarantined {
+		if _, err := q.Put(st); err != nil {
+			return conn.rejectMessage(conn.Config().Catalog.Reply("message.local_error"))
+		}
+		return conn.acceptMessage(success)
+	}
+	discarded := st.discarded
+	if script := conn.Config().Sieve; script != nil {
+		applySieve(st, script)
+		discarded = discarded || len(st.Recipients) == 0
+	}
+	if !discarded {
+		if err := conn.Send(st); err != nil {
+			var errs RecipientErrors
+			if conn.Config().LMTP && errors.As(err, &errs) {
+				return conn.deliverRecipients(errs, success)
+			}
+			if errors.Is(err, ErrRequireTLS) {
+				return conn.rejectMessage(conn.Config().Catalog.Reply("message.requiretls"))
+			}
+			if errors.Is(err, ErrSMTPUTF8) {
+				return conn.rejectMessage(conn.Config().Catalog.Reply("message.smtputf8"))
+			}
+			if errors.Is(err, ErrThrottled) {
+				conn.LogSecurityEvent(EventRateLimit, "limit", "domain_throttle")
+				return conn.rejectMessage(conn.Config().Catalog.Reply("message.deferred"))
+			}
+			var protoErr *textproto.Error
+			if errors.As(err, &protoErr) && protoErr.Code/100 == 4 {
+				return conn.rejectMessage(conn.Config().Catalog.Reply("message.deferred"))
+			}
+			return conn.rejectMessage(conn.Config().Catalog.Reply("message.failed"))
 		}
 	}
+	return conn.acceptMessage(success)
+}
+
+type ChunkCommand struct {
+}
+
+func (cmnd *ChunkCommand) Execute(conn *SMTPConnection, line string) error {
+	if !conn.State().HasStarted() {
+		return conn.Reply("session.not_started")
+	}
+	if phase := conn.State().Phase; phase != PhaseRcpt && phase != PhaseData {
+		return conn.Reply("bdat.need_rcpt")
+	}
+	cmd, err := ParseCommand(line)
+	if err != nil {
+		return conn.Reply("bdat.syntax")
+	}
+	xs := strings.Fields(cmd.Arg)
+	if len(xs) < 1 || len(xs) > 2 || (len(xs) == 2 && strings.ToUpper(xs[1]) != "LAST") {
+		return conn.Reply("bdat.syntax")
+	}
+	size, err := strconv.ParseInt(xs[0], 10, 64)
+	if err != nil || size < 0 {
+		return conn.Reply("bdat.chunk_invalid")
+	}
+	last := len(xs) == 2
 	st := conn.State()
-	st.Headers = headers
-	st.Content = content
-	return conn.Send(st)
+	st.Phase = PhaseData
+	if last {
+		defer st.Reset()
+	}
+	config := conn.Config()
+	if st.chunks == nil {
+		st.chunks = config.NewSpool()
+	}
+	max := config.MaxMessageSize
+	if st.chunkOverflow || (max > 0 && st.chunks.Size()+size > max) {
+		if err := conn.Discard(size); err != nil {
+			return err
+		}
+		st.chunks.Close()
+		st.chunks = nil
+		st.chunkOverflow = !last
+		return conn.Reply("message.too_big")
+	}
+	if !config.MemoryBudget.Reserve(size) {
+		conn.LogSecurityEvent(EventRateLimit, "limit", "memory_budget")
+		if err := conn.Discard(size); err != nil {
+			return err
+		}
+		st.chunks.Close()
+		st.chunks = nil
+		st.chunkOverflow = !last
+		return conn.Reply("storage.insufficient")
+	}
+	defer config.MemoryBudget.Release(size)
+	span := st.span.Child("smtp.bdat")
+	span.SetAttribute("smtp.chunk_size", size)
+	err = conn.ReadBytesTo(st.chunks, size)
+	span.Finish(err)
+	if err != nil {
+		return err
+	}
+	if !last {
+		return conn.Reply("bdat.chunk_ok", strconv.FormatInt(size, 10))
+	}
+	chunks := st.chunks
+	st.chunks = nil
+	defer chunks.Close()
+	mb := newMessageBuilder(config)
+	defer mb.release()
+	r := newPooledReader(chunks.Reader())
+	defer putPooledReader(r)
+	for {
+		line, err := r.ReadString('\n')
+		if len(line) > 0 {
+			line = strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r")
+			if err := mb.addLine(line); err != nil {
+				mb.body.Close()
+				reply, _ := messageErrorReply(conn, err)
+				return conn.rejectMessage(reply)
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			mb.body.Close()
+			return conn.rejectMessage(conn.Config().Catalog.Reply("storage.insufficient"))
+		}
+	}
+	return deliverMessage(conn, mb)
 }
 
 type SMTPHandler struct {
 	conn    net.Conn
 	closing bool
 
-	Send func(st *SMTPState) error
+	Config *SMTPConfig
+	Send   func(st *SMTPState) error
 }
 
 var smtpCommandMap = map[string]SMTPCommand{
 	"HELO": &HelloCommand{},
 	"EHLO": &HelloCommand{},
+	"LHLO": &HelloCommand{},
 	"MAIL": &MailCommand{},
 	"RCPT": &RecipientCommand{},
+	"AUTH": &AuthCommand{},
 	"RSET": &ResetCommand{},
 	"VRFY": &VerifyCommand{},
+	"EXPN": &ExpandCommand{},
 	"NOOP": &NoopCommand{},
+	"HELP": &HelpCommand{},
 	"QUIT": &QuitCommand{},
 	"DATA": &DataCommand{},
+	"BDAT": &ChunkCommand{},
+
+	"ATRN":     &ATRNCommand{},
+	"ETRN":     &ETRNCommand{},
+	"STARTTLS": &StartTLSCommand{},
+	"XCLIENT":  &XClientCommand{},
 }
 
 func NewSMTPHandler(conn net.Conn, f func(st *SMTPState) error) *SMTPHandler {
@@ -245,6 +1924,7 @@ func NewSMTPHandler(conn net.Conn, f func(st *SMTPState) error) *SMTPHandler {
 	return &SMTPHandler{
 		conn:    conn,
 		closing: false,
+		Config:  &SMTPConfig{},
 		Send:    f,
 	}
 }
@@ -253,34 +1933,179 @@ func (h *SMTPHandler) Conn() net.Conn {
 	return h.conn
 }
 
-func (h *SMTPHandler) Run() error {
+func (h *SMTPHandler) Run() (err error) {
 	defer h.Close()
 	smtpConn := NewSMTPConnection(h)
-	smtpConn.Write("220 Simple Mail Transfer service ready")
+	defer smtpConn.release()
+	defer func() {
+		if x := recover(); x != nil {
+			err = smtpConn.recoverPanic(x)
+		}
+	}()
+	defer smtpConn.State().Close()
+	smtpConn.State().ServerName = h.Config.ServerName
+	smtpConn.State().ConnectedAt = h.Config.now()
+	smtpConn.State().clock = h.Config.Clock
+	defer h.Config.Hooks.runClose(smtpConn)
+	if addr := h.conn.RemoteAddr(); addr != nil {
+		smtpConn.State().RemoteAddr = addr.String()
+	}
+	if addr := h.conn.LocalAddr(); addr != nil {
+		smtpConn.State().LocalAddr = addr.String()
+	}
+	smtpConn.publish(SessionStarted{SessionID: smtpConn.ID(), RemoteAddr: smtpConn.State().RemoteAddr, Time: h.Config.now()})
+	smtpConn.span = h.Config.Tracer.Start("smtp.session")
+	smtpConn.span.SetAttribute("smtp.session_id", smtpConn.ID())
+	smtpConn.span.SetAttribute("client.address", smtpConn.RemoteIP())
+	defer func() {
+		smtpConn.State().endSpan(errTransactionAborted)
+		smtpConn.span.SetAttribute("smtp.helo", smtpConn.State().ClientName)
+		smtpConn.span.Finish(nil)
+	}()
+	h.Config.Metrics.sessionStarted()
+	smtpConn.Logger().Info("session started", "local_addr", smtpConn.State().LocalAddr)
+	if dir := h.Config.TranscriptDir; len(dir) > 0 {
+		t, err := OpenTranscript(dir, smtpConn.ID(), h.Config.now())
+		if err != nil {
+			smtpConn.Logger().Warn("transcript not recorded", "error", err.Error())
+		} else {
+			t.MaxBody = h.Config.TranscriptMaxBody
+			t.Privacy = h.Config.Privacy
+			smtpConn.transcript = t
+			defer t.Close()
+		}
+	}
+	if dir := h.Config.CaptureDir; len(dir) > 0 {
+		c, err := OpenCapture(dir, smtpConn.ID(), h.Config.now())
+		if err != nil {
+			smtpConn.Logger().Warn("session not captured", "error", err.Error())
+		} else {
+			smtpConn.capture = c
+			smtpConn.setReader(h.Conn())
+			smtpConn.setWriter(h.Conn())
+			defer c.Close()
+		}
+	}
+	defer func() {
+		smtpConn.Logger().Info("session closed")
+		h.Config.Metrics.sessionClosed()
+		smtpConn.publish(SessionClosed{SessionID: smtpConn.ID(), Time: h.Config.now()})
+	}()
+	if tlsConn, ok := h.conn.(*tls.Conn); ok {
+		// implicit TLS (RFC 8314)
+		err := tlsConn.Handshake()
+		h.Config.Metrics.handshake(err)
+		if err != nil {
+			smtpConn.LogSecurityEvent(EventTLSFailure, "error", err.Error())
+			return err
+		}
+		smtpConn.State().setTLS(tlsConn.ConnectionState())
+	}
+	reply := ""
+	if h.Config.Drain.Draining() {
+		reply = h.Config.Catalog.Reply("session.draining")
+	}
+	if len(reply) == 0 {
+		reply = h.Config.Access.checkClient(smtpConn)
+	}
+	if len(reply) == 0 {
+		reply = applyPolicy(smtpConn, StageConnect, "")
+	}
+	if len(reply) == 0 {
+		reply = h.Config.Hooks.runConnect(smtpConn)
+	}
+	if len(reply) > 0 {
+		smtpConn.Write(reply)
+		return smtpConn.Quit()
+	}
+	smtpConn.WriteRaw(h.Config.Banners.greeting(smtpConn))
+	h.Config.Sessions.add(smtpConn)
+	defer h.Config.Sessions.remove(smtpConn)
+	err = h.serve(smtpConn)
+	if smtpConn.status.shutdown.Load() {
+		smtpConn.Reply("session.shutdown", h.Config.ServerName)
+		return smtpConn.Quit()
+	}
+	if smtpConn.status.terminated.Load() {
+		smtpConn.Reply("session.terminated")
+		return smtpConn.Quit()
+	}
+	return err
+}
+
+// serve processes the commands of the session.
+func (h *SMTPHandler) serve(smtpConn *SMTPConnection) error {
 	for !h.closing {
-		line, err := smtpConn.ReadLine()
+		line, err := smtpConn.ReadLineLimit(h.Config.CommandLineLimit())
+		if err == ErrLineTooLong {
+			smtpConn.transcript.client("[line too long]")
+			if err := smtpConn.Reply("command.too_long"); err != nil {
+				return err
+			}
+			continue
+		}
 		if err != nil {
 			return err
 		}
-		xs := strings.SplitN(strings.TrimSpace(line), " ", 2)
-		if len(xs) == 0 {
-			if err := smtpConn.Write("550 Command must not be empty"); err != nil {
+		start := time.Now()
+		smtpConn.transcript.client(line)
+		cmd, err := ParseCommand(line)
+		if err == ErrEmptyCommand {
+			if err := smtpConn.Reply("command.empty"); err != nil {
 				return err
 			}
+			continue
+		}
+		if h.Config.Events != nil {
+			smtpConn.publish(CommandReceived{SessionID: smtpConn.ID(), Verb: cmd.Verb, Time: h.Config.now()})
 		}
-		if cmnd, ok := smtpCommandMap[xs[0]]; ok {
-			if err := cmnd.Execute(smtpConn, line); err != nil {
+		if cmnd, ok := h.Config.command(cmd.Verb); ok && err == nil {
+			if h.Config.RequireStartTLS && smtpConn.State().TLS == nil && !preTLSCommands[cmd.Verb] {
+				if err := smtpConn.Reply("starttls.required"); err != nil {
+					return err
+				}
+				continue
+			}
+			smtpConn.lastReply = ""
+			smtpConn.updateStatus(cmd.Verb)
+			var err error
+			if reply := h.Config.Hooks.runCommand(smtpConn, cmd.Verb); len(reply) > 0 {
+				err = smtpConn.Write(reply)
+			} else {
+				err = cmnd.Execute(smtpConn, line)
+			}
+			smtpConn.updateStatus("")
+			h.Config.Metrics.command(cmd.Verb, smtpConn.lastReply)
+			smtpConn.logCommand(cmd.Verb, smtpConn.lastReply)
+			h.Config.Stats.reply(smtpConn.lastReply, h.Config.now())
+			smtpConn.commandDone(cmd.Verb, start)
+			if err != nil {
 				return err
 			}
 		} else {
-			if err := smtpConn.Write("550 Command not recognized"); err != nil {
+			h.Config.Metrics.command("other", "500")
+			smtpConn.logCommand(cmd.Verb, "500")
+			h.Config.Stats.reply("500", h.Config.now())
+			if err := smtpConn.Reply("command.unknown"); err != nil {
 				return err
 			}
+			smtpConn.commandDone("other", start)
 		}
 	}
 	return nil
 }
 
+// recoverPanic logs the panic of the session with the stack, then replies
+// 421 to the client on a best-effort basis so that a malformed session
+// does not take down the process.
+func (smtpConn *SMTPConnection) recoverPanic(x interface{}) error {
+	smtpConn.Logger().Error("session panicked", "panic", fmt.Sprint(x), "stack", string(debug.Stack()))
+	smtpConn.Config().Metrics.add("mproxy_session_panics_total", 1)
+	smtpConn.WriteRaw("421 4.3.0 Internal error")
+	smtpConn.Flush()
+	return fmt.Errorf("smtp: session panicked: %v", x)
+}
+
 func (h *SMTPHandler) Close() error {
 	h.closing = true
 	return h.conn.Close()
@@ -1,7 +1,13 @@
 package smtp
 
 import (
+	"errors"
+	"fmt"
+	"io"
 	"net"
+	"os"
+	"regexp"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -94,6 +100,26 @@ func (mc *MockConn) IsClosed() bool {
 	return mc.closed
 }
 
+// replyCodes returns the codes of the final reply lines separated by spaces.
+func replyCodes(b []byte) string {
+	codes := make([]string, 0)
+	for _, x := range strings.Split(string(b), "\r\n") {
+		if len(x) >= 4 && x[3] == ' ' {
+			codes = append(codes, x[:3])
+		}
+	}
+	return strings.Join(codes, " ")
+}
+
+var queueIDPattern = regexp.MustCompile(`queued as \S+`)
+
+// withoutQueueIDs returns the replies with the queue IDs replaced by <id>.
+func withoutQueueIDs(b []byte) string {
+	return queueIDPattern.ReplaceAllString(string(b), "queued as <id>")
+}
+
+const startMailInput = "354 Start mail input; end with <CRLF>.<CRLF>\r\n"
+
 func TestSMTPStateString(t *testing.T) {
 	st := SMTPState{
 		ReturnTo:   "foo@example.net",
@@ -104,9 +130,9 @@ func TestSMTPStateString(t *testing.T) {
 			"Cc: User2<user2@example.net>",
 			"Subject: Reveal SMTP State Stringer",
 		},
-		Content: []byte("This is a test message.\r\n" +
-			"Are you sure?\r\n"),
 	}
+	st.SetContent([]byte("This is a test message.\r\n" +
+		"Are you sure?\r\n"))
 	expected := "MAIL FROM: <foo@example.net>\r\n" +
 		"RCPT TO: <user1@example.net>\r\n" +
 		"RCPT TO: <user2@example.net>\r\n" +
@@ -123,6 +149,20 @@ func TestSMTPStateString(t *testing.T) {
 	if expected != actual {
 		t.Errorf("expected: %s, actual: %s", expected, actual)
 	}
+	if actual := string(st.Bytes()); expected != actual {
+		t.Errorf("expected: %s, actual: %s", expected, actual)
+	}
+
+	// streamed from a spool file
+	spool := NewSpool(16, t.TempDir())
+	spool.Write([]byte("This is a test message.\r\nAre you sure?\r\n"))
+	st.setContent(spool)
+	defer st.Close()
+	var b strings.Builder
+	n, err := st.WriteTo(&b)
+	if err != nil || n != int64(len(expected)) || b.String() != expected {
+		t.Errorf("expected: %s, actual: %s (%d, %v)", expected, b.String(), n, err)
+	}
 }
 
 func TestSMTPConnectionSend(t *testing.T) {
@@ -141,10 +181,20 @@ func TestHelloCommand(t *testing.T) {
 	smtpConn := NewSMTPConnection(NewSMTPHandler(conn, nil))
 	st := smtpConn.State()
 	st.ServerName = "test-server"
+	smtpConn.Config().Authenticate = func(username, password string) bool { return false }
 	cmd := &HelloCommand{}
 	cmd.Execute(smtpConn, "EHLO test-client")
 	expected := "250-test-server\r\n" +
 		"250-AUTH PLAIN\r\n" +
+		"250-PIPELINING\r\n" +
+		"250-8BITMIME\r\n" +
+		"250-SMTPUTF8\r\n" +
+		"250-CHUNKING\r\n" +
+		"250-DSN\r\n" +
+		"250-ENHANCEDSTATUSCODES\r\n" +
+		"250-MT-PRIORITY\r\n" +
+		"250-DELIVERBY\r\n" +
+		"250-SIZE 0\r\n" +
 		"250 HELP\r\n"
 	actual := string(conn.CloneOutputBuffer())
 	if actual != expected {
@@ -169,18 +219,173 @@ func TestMailCommand(t *testing.T) {
 	if st.ReturnTo != "foo@example.net" {
 		t.Errorf("expected: foo@example.net, actual: %s", st.ReturnTo)
 	}
-	expected := "250 OK\r\n"
+	expected := "250 2.1.0 OK\r\n"
+	actual := string(conn.CloneOutputBuffer())
+	if actual != expected {
+		t.Errorf("expected: %s, actual: %s", expected, actual)
+	}
+}
+
+func TestMailCommandNullSender(t *testing.T) {
+	conn := NewMockConn([]byte{})
+	smtpConn := NewSMTPConnection(NewSMTPHandler(conn, nil))
+	st := smtpConn.State()
+	st.Hello = "EHLO"
+	cmd := &MailCommand{}
+	cmd.Execute(smtpConn, "MAIL FROM:<>")
+	expected := "250 2.1.0 OK\r\n"
+	actual := string(conn.CloneOutputBuffer())
+	if actual != expected {
+		t.Errorf("expected: %s, actual: %s", expected, actual)
+	}
+	if !st.NullSender || st.ReturnTo != "" {
+		t.Errorf("expected the null sender, actual: %s", st.ReturnTo)
+	}
+	if s := st.String(); s[:15] != "MAIL FROM: <>\r\n" {
+		t.Errorf("unexpected String(): %s", s)
+	}
+	st.Reset()
+	if st.NullSender {
+		t.Error("NullSender must be reset")
+	}
+}
+
+func TestMailCommandAddressSyntax(t *testing.T) {
+	conn := NewMockConn([]byte{})
+	smtpConn := NewSMTPConnection(NewSMTPHandler(conn, nil))
+	st := smtpConn.State()
+	st.Hello = "EHLO"
+	mail := &MailCommand{}
+	rcpt := &RecipientCommand{}
+	mail.Execute(smtpConn, "MAIL FROM: <foo..bar@example.net>")
+	mail.Execute(smtpConn, "MAIL FROM: <@relay.example.net:\"foo>bar\"@example.net>")
+	rcpt.Execute(smtpConn, "RCPT TO: <user1@@example.net>")
+	rcpt.Execute(smtpConn, "RCPT TO: <postmaster@[192.0.2.1]>")
+	expected := "501 5.1.7 Bad sender address syntax\r\n" +
+		"250 2.1.0 OK\r\n" +
+		"501 5.1.3 Bad recipient address syntax\r\n" +
+		"250 2.1.5 OK\r\n"
+	actual := string(conn.CloneOutputBuffer())
+	if actual != expected {
+		t.Errorf("expected: %s, actual: %s", expected, actual)
+	}
+	if st.ReturnTo != "\"foo>bar\"@example.net" ||
+		st.ReturnToAddress.LocalPart != "foo>bar" {
+		t.Errorf("unexpected return path: %s", st.ReturnTo)
+	}
+	if len(st.RecipientAddresses) != 1 ||
+		st.RecipientAddresses[0].Domain != "[192.0.2.1]" {
+		t.Errorf("unexpected recipients: %v", st.RecipientAddresses)
+	}
+}
+
+func TestMailCommandUnsupportedParameter(t *testing.T) {
+	conn := NewMockConn([]byte{})
+	smtpConn := NewSMTPConnection(NewSMTPHandler(conn, nil))
+	st := smtpConn.State()
+	st.Hello = "EHLO"
+	cmd := &MailCommand{}
+	cmd.Execute(smtpConn, "MAIL FROM: <foo@example.net> X-UNKNOWN=1")
+	expected := "555 5.5.4 Unsupported parameter X-UNKNOWN\r\n"
+	actual := string(conn.CloneOutputBuffer())
+	if actual != expected {
+		t.Errorf("expected: %s, actual: %s", expected, actual)
+	}
+	if len(st.ReturnTo) > 0 {
+		t.Errorf("ReturnTo must be empty")
+	}
+}
+
+func TestMailCommandSize(t *testing.T) {
+	conn := NewMockConn([]byte{})
+	h := NewSMTPHandler(conn, nil)
+	h.Config.MaxMessageSize = 1024
+	smtpConn := NewSMTPConnection(h)
+	st := smtpConn.State()
+	st.Hello = "EHLO"
+	cmd := &MailCommand{}
+	cmd.Execute(smtpConn, "MAIL FROM: <foo@example.net> SIZE=1024")
+	if st.Size != 1024 {
+		t.Errorf("expected: 1024, actual: %d", st.Size)
+	}
+	conn.ResetOutputBuffer()
+	st.Reset()
+	cmd.Execute(smtpConn, "MAIL FROM: <foo@example.net> SIZE=1025")
+	expected := "552 5.3.4 Message size exceeds fixed maximum message size\r\n"
+	actual := string(conn.CloneOutputBuffer())
+	if actual != expected {
+		t.Errorf("expected: %s, actual: %s", expected, actual)
+	}
+	conn.ResetOutputBuffer()
+	st.Reset()
+	cmd.Execute(smtpConn, "MAIL FROM: <foo@example.net> SIZE=abc")
+	expected = "501 5.5.4 Invalid SIZE parameter\r\n"
+	actual = string(conn.CloneOutputBuffer())
+	if actual != expected {
+		t.Errorf("expected: %s, actual: %s", expected, actual)
+	}
+}
+
+func TestMailCommandBody(t *testing.T) {
+	conn := NewMockConn([]byte{})
+	smtpConn := NewSMTPConnection(NewSMTPHandler(conn, nil))
+	st := smtpConn.State()
+	st.Hello = "EHLO"
+	cmd := &MailCommand{}
+	cmd.Execute(smtpConn, "MAIL FROM: <foo@example.net> BODY=8bitmime")
+	if st.Body != "8BITMIME" {
+		t.Errorf("expected: 8BITMIME, actual: %s", st.Body)
+	}
+	conn.ResetOutputBuffer()
+	st.Reset()
+	cmd.Execute(smtpConn, "MAIL FROM: <foo@example.net> BODY=BINARYMIME")
+	expected := "501 5.5.4 Invalid BODY parameter\r\n"
 	actual := string(conn.CloneOutputBuffer())
 	if actual != expected {
 		t.Errorf("expected: %s, actual: %s", expected, actual)
 	}
 }
 
+func TestMailCommandSMTPUTF8(t *testing.T) {
+	conn := NewMockConn([]byte{})
+	smtpConn := NewSMTPConnection(NewSMTPHandler(conn, nil))
+	st := smtpConn.State()
+	st.Hello = "EHLO"
+	mail := &MailCommand{}
+	rcpt := &RecipientCommand{}
+	mail.Execute(smtpConn, "MAIL FROM: <用户@例子.广告>")
+	expected := "553 5.6.7 Non-ASCII address requires SMTPUTF8\r\n"
+	actual := string(conn.CloneOutputBuffer())
+	if actual != expected {
+		t.Errorf("expected: %s, actual: %s", expected, actual)
+	}
+	conn.ResetOutputBuffer()
+	mail.Execute(smtpConn, "MAIL FROM: <用户@例子.广告> SMTPUTF8")
+	rcpt.Execute(smtpConn, "RCPT TO: <θσερ@παράδειγμα.δοκιμή>")
+	expected = "250 2.1.0 OK\r\n250 2.1.5 OK\r\n"
+	actual = string(conn.CloneOutputBuffer())
+	if actual != expected {
+		t.Errorf("expected: %s, actual: %s", expected, actual)
+	}
+	if !st.SMTPUTF8 || st.ReturnTo != "用户@例子.广告" ||
+		st.Recipients[0] != "θσερ@παράδειγμα.δοκιμή" {
+		t.Errorf("unexpected state: %v", st)
+	}
+	conn.ResetOutputBuffer()
+	rcpt.Execute(smtpConn, "RCPT TO: <\xff@example.net>")
+	expected = "501 5.6.7 Address is not valid UTF-8\r\n"
+	actual = string(conn.CloneOutputBuffer())
+	if actual != expected {
+		t.Errorf("expected: %s, actual: %s", expected, actual)
+	}
+}
+
 func TestRecipientCommand(t *testing.T) {
 	conn := NewMockConn([]byte{})
 	smtpConn := NewSMTPConnection(NewSMTPHandler(conn, nil))
 	st := smtpConn.State()
 	st.Hello = "EHLO"
+	st.Phase = PhaseMail
 	cmd := &RecipientCommand{}
 	conn.ResetOutputBuffer()
 	cmd.Execute(smtpConn, "RCPT TO: <user1@example.net>")
@@ -188,7 +393,7 @@ func TestRecipientCommand(t *testing.T) {
 		st.Recipients[0] != "user1@example.net" {
 		t.Errorf("expected: [user1@example.net], actual: %s", st.Recipients)
 	}
-	expected := "250 OK\r\n"
+	expected := "250 2.1.5 OK\r\n"
 	actual := string(conn.CloneOutputBuffer())
 	if actual != expected {
 		t.Errorf("expected: %s, actual: %s", expected, actual)
@@ -203,6 +408,76 @@ func TestRecipientCommand(t *testing.T) {
 	}
 }
 
+func TestMTPriority(t *testing.T) {
+	for _, fixture := range []struct {
+		line     string
+		expected string
+		priority int
+	}{
+		{"MAIL FROM: <foo@example.net>", "250", 0},
+		{"MAIL FROM: <foo@example.net> MT-PRIORITY=3", "250", 3},
+		{"MAIL FROM: <foo@example.net> MT-PRIORITY=-9", "250", -9},
+		{"MAIL FROM: <foo@example.net> MT-PRIORITY=10", "501", 0},
+		{"MAIL FROM: <foo@example.net> MT-PRIORITY=high", "501", 0},
+	} {
+		conn := NewMockConn([]byte{})
+		smtpConn := NewSMTPConnection(NewSMTPHandler(conn, nil))
+		st := smtpConn.State()
+		st.Hello = "EHLO"
+		(&MailCommand{}).Execute(smtpConn, fixture.line)
+		if actual := replyCodes(conn.CloneOutputBuffer()); actual != fixture.expected {
+			t.Errorf("expected: %s, actual: %s (%s)", fixture.expected, actual, fixture.line)
+		}
+		if st.Priority != fixture.priority {
+			t.Errorf("expected: %d, actual: %d (%s)", fixture.priority, st.Priority, fixture.line)
+		}
+	}
+}
+
+func TestDSNParameters(t *testing.T) {
+	conn := NewMockConn([]byte{})
+	smtpConn := NewSMTPConnection(NewSMTPHandler(conn, nil))
+	st := smtpConn.State()
+	st.Hello = "EHLO"
+	mail := &MailCommand{}
+	rcpt := &RecipientCommand{}
+	mail.Execute(smtpConn, "MAIL FROM: <foo@example.net> RET=HDRS ENVID=QQ314159")
+	rcpt.Execute(smtpConn,
+		"RCPT TO: <user1@example.net> NOTIFY=SUCCESS,FAILURE ORCPT=rfc822;user1+2Bx@example.net")
+	rcpt.Execute(smtpConn, "RCPT TO: <user2@example.net>")
+	expected := "250 2.1.0 OK\r\n250 2.1.5 OK\r\n250 2.1.5 OK\r\n"
+	actual := string(conn.CloneOutputBuffer())
+	if actual != expected {
+		t.Errorf("expected: %s, actual: %s", expected, actual)
+	}
+	if st.Ret != "HDRS" || st.EnvID != "QQ314159" {
+		t.Errorf("unexpected RET/ENVID: %s %s", st.Ret, st.EnvID)
+	}
+	if len(st.RecipientDSNs) != 2 {
+		t.Fatalf("expected 2 DSN entries, actual: %d", len(st.RecipientDSNs))
+	}
+	expectedDSN := " NOTIFY=SUCCESS,FAILURE ORCPT=rfc822;user1+2Bx@example.net"
+	if st.RecipientDSNs[0].String() != expectedDSN {
+		t.Errorf("expected: %s, actual: %s", expectedDSN, st.RecipientDSNs[0])
+	}
+	if st.RecipientDSNs[1].String() != "" {
+		t.Errorf("expected no DSN parameters, actual: %s", st.RecipientDSNs[1])
+	}
+
+	invalid := []string{
+		"RCPT TO: <user3@example.net> NOTIFY=NEVER,SUCCESS",
+		"RCPT TO: <user3@example.net> NOTIFY=SOMETIMES",
+		"RCPT TO: <user3@example.net> ORCPT=user3@example.net",
+	}
+	for _, x := range invalid {
+		conn.ResetOutputBuffer()
+		rcpt.Execute(smtpConn, x)
+		if actual := string(conn.CloneOutputBuffer()); actual[:4] != "501 " {
+			t.Errorf("%s must be rejected, actual: %s", x, actual)
+		}
+	}
+}
+
 func TestResetCommand(t *testing.T) {
 	conn := NewMockConn([]byte{})
 	smtpConn := NewSMTPConnection(NewSMTPHandler(conn, nil))
@@ -212,11 +487,11 @@ func TestResetCommand(t *testing.T) {
 	st.ReturnTo = "foo@example.net"
 	st.Recipients = []string{"user1@example.net"}
 	st.Headers = []string{"Subject: Awesome products here"}
-	st.Content = []byte("Please visit our online shop!")
+	st.SetContent([]byte("Please visit our online shop!"))
 	cmd := &ResetCommand{}
 	conn.ResetOutputBuffer()
 	cmd.Execute(smtpConn, "RSET")
-	expected := "250 OK\r\n"
+	expected := "250 2.0.0 OK\r\n"
 	actual := string(conn.CloneOutputBuffer())
 	if actual != expected {
 		t.Errorf("expected: %s, actual: %s", expected, actual)
@@ -230,7 +505,7 @@ func TestResetCommand(t *testing.T) {
 	if len(st.Headers) > 0 {
 		t.Errorf("Headers must be empty")
 	}
-	if len(st.Content) > 0 {
+	if st.ContentSize() > 0 {
 		t.Errorf("Content must be empty")
 	}
 }
@@ -244,7 +519,7 @@ func TestQuitCommand(t *testing.T) {
 	cmd := &QuitCommand{}
 	conn.ResetOutputBuffer()
 	cmd.Execute(smtpConn, "QUIT")
-	expected := "221 Bye\r\n"
+	expected := "221 2.0.0 Bye\r\n"
 	actual := string(conn.CloneOutputBuffer())
 	if actual != expected {
 		t.Errorf("expected: %s, actual: %s", expected, actual)
@@ -253,3 +528,641 @@ func TestQuitCommand(t *testing.T) {
 		t.Error("net.Conn must be closed")
 	}
 }
+
+func TestAuthCommand(t *testing.T) {
+	conn := NewMockConn([]byte{})
+	h := NewSMTPHandler(conn, nil)
+	h.Config.Authenticate = func(username, password string) bool {
+		return username == "foo" && password == "secret"
+	}
+	h.Config.AuthLimiter = NewAuthLimiter(2, time.Minute)
+	h.Config.AuthLimiter.BaseDelay = 0
+	smtpConn := NewSMTPConnection(h)
+	st := smtpConn.State()
+	st.Hello = "EHLO"
+	cmd := &AuthCommand{}
+
+	// "\x00foo\x00wrong"
+	cmd.Execute(smtpConn, "AUTH PLAIN AGZvbwB3cm9uZw==")
+	expected := "535 5.7.8 Authentication credentials invalid\r\n"
+	actual := string(conn.CloneOutputBuffer())
+	if actual != expected {
+		t.Errorf("expected: %s, actual: %s", expected, actual)
+	}
+	if len(st.Username) > 0 {
+		t.Errorf("Username must be empty")
+	}
+
+	// "\x00foo\x00secret"
+	conn.ResetOutputBuffer()
+	cmd.Execute(smtpConn, "AUTH PLAIN AGZvbwBzZWNyZXQ=")
+	expected = "235 2.7.0 Authentication successful\r\n"
+	actual = string(conn.CloneOutputBuffer())
+	if actual != expected {
+		t.Errorf("expected: %s, actual: %s", expected, actual)
+	}
+	if st.Username != "foo" {
+		t.Errorf("expected: foo, actual: %s", st.Username)
+	}
+}
+
+func TestAuthCommandLockout(t *testing.T) {
+	conn := NewMockConn([]byte{})
+	h := NewSMTPHandler(conn, nil)
+	h.Config.Authenticate = func(username, password string) bool {
+		return false
+	}
+	h.Config.AuthLimiter = NewAuthLimiter(2, time.Minute)
+	h.Config.AuthLimiter.BaseDelay = 0
+	smtpConn := NewSMTPConnection(h)
+	smtpConn.State().Hello = "EHLO"
+	cmd := &AuthCommand{}
+	cmd.Execute(smtpConn, "AUTH PLAIN AGZvbwB3cm9uZw==")
+	conn.ResetOutputBuffer()
+	cmd.Execute(smtpConn, "AUTH PLAIN AGZvbwB3cm9uZw==")
+	expected := "421 4.7.0 Too many authentication failures\r\n"
+	actual := string(conn.CloneOutputBuffer())
+	if actual != expected {
+		t.Errorf("expected: %s, actual: %s", expected, actual)
+	}
+	if !conn.IsClosed() {
+		t.Error("net.Conn must be closed")
+	}
+}
+
+func TestCaseInsensitiveCommands(t *testing.T) {
+	conn := NewMockConn([]byte("ehlo test-client\r\n" +
+		"mail from:<foo@example.net>\r\n" +
+		"Rcpt To:  <user1@example.net>\r\n" +
+		"quit\r\n"))
+	h := NewSMTPHandler(conn, nil)
+	h.Run()
+	expected := "220 250 250 250 221"
+	if actual := replyCodes(conn.CloneOutputBuffer()); actual != expected {
+		t.Errorf("expected: %s, actual: %s", expected, actual)
+	}
+}
+
+func TestCommandSequence(t *testing.T) {
+	conn := NewMockConn([]byte("EHLO test-client\r\n" +
+		"RCPT TO: <user1@example.net>\r\n" +
+		"DATA\r\n" +
+		"MAIL FROM: <foo@example.net>\r\n" +
+		"MAIL FROM: <foo@example.net>\r\n" +
+		"DATA\r\n" +
+		"RCPT TO: <user1@example.net>\r\n" +
+		"RSET\r\n" +
+		"RCPT TO: <user1@example.net>\r\n" +
+		"QUIT\r\n"))
+	h := NewSMTPHandler(conn, nil)
+	h.Run()
+	expected := "220 250 503 503 250 503 503 250 250 503 221"
+	if actual := replyCodes(conn.CloneOutputBuffer()); actual != expected {
+		t.Errorf("expected: %s, actual: %s", expected, actual)
+	}
+}
+
+func TestDataCommandQueueID(t *testing.T) {
+	store, err := NewMessageStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := NewMockConn([]byte("EHLO localhost\r\n" +
+		"MAIL FROM: <foo@example.net>\r\n" +
+		"RCPT TO: <user1@example.com>\r\n" +
+		"DATA\r\n" +
+		"Subject: Queued\r\n" +
+		"\r\n" +
+		"Hello\r\n" +
+		".\r\n" +
+		"RCPT TO: <user2@example.com>\r\n" +
+		"MAIL FROM: <bar@example.net>\r\n" +
+		"QUIT\r\n"))
+	h := NewSMTPHandler(conn, store.Publish)
+	var logs strings.Builder
+	h.Config.Logger, _ = NewLogger(&logs, "info")
+	h.Run()
+	expected := "220 250 250 250 354 250 503 250 221"
+	if actual := replyCodes(conn.CloneOutputBuffer()); actual != expected {
+		t.Errorf("expected: %s, actual: %s", expected, actual)
+	}
+	id := queueIDPattern.FindString(string(conn.CloneOutputBuffer()))[len("queued as "):]
+	if _, err := store.Get(id); err != nil {
+		t.Errorf("expected the message stored as %s: %v", id, err)
+	}
+	if !strings.Contains(logs.String(), `"queue_id":"`+id+`"`) {
+		t.Errorf("expected the queue ID in the logs: %s", logs.String())
+	}
+}
+
+func TestDataCommandSendError(t *testing.T) {
+	conn := NewMockConn([]byte("Subject: Failed\r\n\r\nfoo\r\n.\r\n"))
+	h := NewSMTPHandler(conn, func(st *SMTPState) error {
+		return errors.New("unavailable")
+	})
+	smtpConn := NewSMTPConnection(h)
+	smtpConn.State().Hello = "EHLO"
+	smtpConn.State().Phase = PhaseRcpt
+	cmd := &DataCommand{}
+	if err := cmd.Execute(smtpConn, "DATA"); err != nil {
+		t.Fatal(err)
+	}
+	expected := startMailInput + "554 5.3.0 Transaction failed\r\n"
+	actual := string(conn.CloneOutputBuffer())
+	if actual != expected {
+		t.Errorf("expected: %s, actual: %s", expected, actual)
+	}
+}
+
+func TestUnexpectedCommandReplies(t *testing.T) {
+	conn := NewMockConn([]byte("MAIL FROM: <foo@example.net>\r\n" +
+		"EHLO test-client\r\n" +
+		"EHLO test-client\r\n" +
+		"MAIL FROM foo@example.net\r\n" +
+		"VRFY foo\r\n" +
+		"QUIT\r\n"))
+	h := NewSMTPHandler(conn, nil)
+	h.Run()
+	expected := "220 503 250 250 501 502 221"
+	if actual := replyCodes(conn.CloneOutputBuffer()); actual != expected {
+		t.Errorf("expected: %s, actual: %s", expected, actual)
+	}
+}
+
+func TestAuthWithoutAuthenticator(t *testing.T) {
+	conn := NewMockConn([]byte("EHLO localhost\r\n" +
+		"AUTH PLAIN AGZvbwBiYXI=\r\n" +
+		"QUIT\r\n"))
+	h := NewSMTPHandler(conn, nil)
+	h.Run()
+	expected := "220 250 502 221"
+	if actual := replyCodes(conn.CloneOutputBuffer()); actual != expected {
+		t.Errorf("expected: %s, actual: %s", expected, actual)
+	}
+	if strings.Contains(string(conn.CloneOutputBuffer()), "AUTH PLAIN") {
+		t.Errorf("unexpected AUTH: %s", conn.CloneOutputBuffer())
+	}
+}
+
+func TestHelloWithoutDomain(t *testing.T) {
+	conn := NewMockConn([]byte("EHLO \v\r\n" +
+		"HELO \t \r\n" +
+		"QUIT\r\n"))
+	h := NewSMTPHandler(conn, nil)
+	h.Run()
+	expected := "220 501 501 221"
+	if actual := replyCodes(conn.CloneOutputBuffer()); actual != expected {
+		t.Errorf("expected: %s, actual: %s", expected, actual)
+	}
+}
+
+func TestDataCommandMaxMessageSize(t *testing.T) {
+	conn := NewMockConn([]byte("Subject: Too large\r\n" +
+		"\r\n" +
+		"0123456789\r\n" +
+		"0123456789\r\n" +
+		".\r\n" +
+		"NOOP\r\n"))
+	sent := false
+	h := NewSMTPHandler(conn, func(st *SMTPState) error {
+		sent = true
+		return nil
+	})
+	h.Config.MaxMessageSize = 32
+	smtpConn := NewSMTPConnection(h)
+	smtpConn.State().Hello = "EHLO"
+	smtpConn.State().Phase = PhaseRcpt
+	cmd := &DataCommand{}
+	cmd.Execute(smtpConn, "DATA")
+	line, _ := smtpConn.ReadLine()
+	if line != "NOOP" {
+		t.Errorf("expected: NOOP, actual: %s", line)
+	}
+	smtpConn.Flush()
+	expected := startMailInput +
+		"552 5.3.4 Message size exceeds fixed maximum message size\r\n"
+	actual := string(conn.CloneOutputBuffer())
+	if actual != expected {
+		t.Errorf("expected: %s, actual: %s", expected, actual)
+	}
+	if sent {
+		t.Error("oversize message must not be sent")
+	}
+}
+
+func TestSMTPHandlerPipelining(t *testing.T) {
+	conn := NewMockConn([]byte("EHLO test-client\r\n" +
+		"MAIL FROM: <foo@example.net>\r\n" +
+		"RCPT TO: <user1@example.net>\r\n" +
+		"XXXX\r\n" +
+		"\r\n" +
+		"RCPT TO: <user2@example.net>\r\n" +
+		"QUIT\r\n"))
+	h := NewSMTPHandler(conn, nil)
+	h.Run()
+	expected := "220 Simple Mail Transfer service ready\r\n" +
+		"250-\r\n" +
+		"250-PIPELINING\r\n" +
+		"250-8BITMIME\r\n" +
+		"250-SMTPUTF8\r\n" +
+		"250-CHUNKING\r\n" +
+		"250-DSN\r\n" +
+		"250-ENHANCEDSTATUSCODES\r\n" +
+		"250-MT-PRIORITY\r\n" +
+		"250-DELIVERBY\r\n" +
+		"250-SIZE 0\r\n" +
+		"250 HELP\r\n" +
+		"250 2.1.0 OK\r\n" +
+		"250 2.1.5 OK\r\n" +
+		"500 5.5.2 Command not recognized\r\n" +
+		"500 5.5.2 Command must not be empty\r\n" +
+		"250 2.1.5 OK\r\n" +
+		"221 2.0.0 Bye\r\n"
+	actual := string(conn.CloneOutputBuffer())
+	if actual != expected {
+		t.Errorf("expected: %s, actual: %s", expected, actual)
+	}
+}
+
+func TestDataCommand8Bit(t *testing.T) {
+	conn := NewMockConn([]byte("Subject: =?UTF-8?Q?Caf=C3=A9?=\r\n" +
+		"\r\n" +
+		"Caf\xc3\xa9 \xe9\xff\r\n" +
+		".\r\n"))
+	var content []byte
+	h := NewSMTPHandler(conn, func(st *SMTPState) error {
+		content, _ = io.ReadAll(st.Content())
+		return nil
+	})
+	smtpConn := NewSMTPConnection(h)
+	smtpConn.State().Hello = "EHLO"
+	smtpConn.State().Phase = PhaseRcpt
+	smtpConn.State().Body = "8BITMIME"
+	cmd := &DataCommand{}
+	cmd.Execute(smtpConn, "DATA")
+	expected := "Caf\xc3\xa9 \xe9\xff\r\n"
+	if string(content) != expected {
+		t.Errorf("expected: %q, actual: %q", expected, content)
+	}
+}
+
+func TestDataCommandSpool(t *testing.T) {
+	body := strings.Repeat("0123456789abcdef\r\n", 64)
+	conn := NewMockConn([]byte("Subject: Spooled\r\n\r\n" + body + ".\r\n"))
+	var spooled bool
+	var content []byte
+	h := NewSMTPHandler(conn, func(st *SMTPState) error {
+		spooled = st.content.IsSpooled()
+		content, _ = io.ReadAll(st.Content())
+		return nil
+	})
+	h.Config.SpoolThreshold = 256
+	h.Config.SpoolDir = t.TempDir()
+	smtpConn := NewSMTPConnection(h)
+	smtpConn.State().Hello = "EHLO"
+	smtpConn.State().Phase = PhaseRcpt
+	cmd := &DataCommand{}
+	cmd.Execute(smtpConn, "DATA")
+	if !spooled {
+		t.Errorf("expected the body to be spooled")
+	}
+	if string(content) != body {
+		t.Errorf("expected: %q, actual: %q", body, content)
+	}
+	smtpConn.State().Reset()
+	entries, _ := os.ReadDir(h.Config.SpoolDir)
+	if len(entries) != 0 {
+		t.Errorf("expected the spool file to be removed, actual: %d files", len(entries))
+	}
+}
+
+func TestDataCommandMemoryBudget(t *testing.T) {
+	conn := NewMockConn([]byte("Subject: Budget\r\n\r\n" +
+		strings.Repeat("x", 100) + "\r\n.\r\nNOOP\r\n"))
+	h := NewSMTPHandler(conn, func(st *SMTPState) error {
+		return nil
+	})
+	h.Config.MemoryBudget = NewMemoryBudget(64)
+	smtpConn := NewSMTPConnection(h)
+	smtpConn.State().Hello = "EHLO"
+	smtpConn.State().Phase = PhaseRcpt
+	cmd := &DataCommand{}
+	cmd.Execute(smtpConn, "DATA")
+	if _, err := smtpConn.ReadLine(); err != nil {
+		t.Fatal(err)
+	}
+	smtpConn.Flush()
+	expected := "354 452"
+	actual := replyCodes(conn.CloneOutputBuffer())
+	if actual != expected {
+		t.Errorf("expected: %s, actual: %s", expected, actual)
+	}
+	if used := h.Config.MemoryBudget.Used(); used != 0 {
+		t.Errorf("expected the budget to be released, actual: %d", used)
+	}
+}
+
+func TestDataCommandStrictLineEndings(t *testing.T) {
+	data := "Subject: Smuggling\r\n\r\nhello\n.\nMAIL FROM:<evil@example.net>\r\n" +
+		".\r\nNOOP\r\n"
+	for _, strict := range []bool{false, true} {
+		conn := NewMockConn([]byte(data))
+		sent := false
+		h := NewSMTPHandler(conn, func(st *SMTPState) error {
+			sent = true
+			return nil
+		})
+		h.Config.StrictLineEndings = strict
+		smtpConn := NewSMTPConnection(h)
+		smtpConn.State().Hello = "EHLO"
+		smtpConn.State().Phase = PhaseRcpt
+		cmd := &DataCommand{}
+		cmd.Execute(smtpConn, "DATA")
+		line, err := smtpConn.ReadLine()
+		if err != nil {
+			t.Fatal(err)
+		}
+		smtpConn.Flush()
+		if strict {
+			if sent {
+				t.Errorf("expected the message to be rejected")
+			}
+			if line != "NOOP" {
+				t.Errorf("expected: NOOP, actual: %s", line)
+			}
+			expected := "354 554"
+			actual := replyCodes(conn.CloneOutputBuffer())
+			if actual != expected {
+				t.Errorf("expected: %s, actual: %s", expected, actual)
+			}
+		} else {
+			if !sent {
+				t.Errorf("expected the message to be sent")
+			}
+			if line != "MAIL FROM:<evil@example.net>" {
+				t.Errorf("expected: MAIL FROM:<evil@example.net>, actual: %s", line)
+			}
+		}
+	}
+}
+
+func TestDataCommandRoutingLoop(t *testing.T) {
+	data := strings.Repeat("Received: from localhost\r\n", 4) + "\r\nLoop\r\n.\r\n"
+	conn := NewMockConn([]byte(data))
+	sent := false
+	h := NewSMTPHandler(conn, func(st *SMTPState) error {
+		sent = true
+		return nil
+	})
+	h.Config.MaxReceivedHeaders = 3
+	smtpConn := NewSMTPConnection(h)
+	smtpConn.State().Hello = "EHLO"
+	smtpConn.State().Phase = PhaseRcpt
+	cmd := &DataCommand{}
+	cmd.Execute(smtpConn, "DATA")
+	smtpConn.Flush()
+	if sent {
+		t.Errorf("expected the message to be rejected")
+	}
+	expected := startMailInput + "554 5.4.6 Routing loop detected\r\n"
+	actual := string(conn.CloneOutputBuffer())
+	if actual != expected {
+		t.Errorf("expected: %s, actual: %s", expected, actual)
+	}
+}
+
+func TestChunkCommand(t *testing.T) {
+	chunk1 := "Subject: Chunked\r\n\r\nThis is "
+	chunk2 := "a chunked message.\r\n"
+	conn := NewMockConn([]byte(chunk1 + chunk2))
+	var headers []string
+	var content []byte
+	h := NewSMTPHandler(conn, func(st *SMTPState) error {
+		headers = st.Headers
+		content, _ = io.ReadAll(st.Content())
+		return nil
+	})
+	smtpConn := NewSMTPConnection(h)
+	smtpConn.State().Hello = "EHLO"
+	smtpConn.State().Phase = PhaseRcpt
+	cmd := &ChunkCommand{}
+	cmd.Execute(smtpConn, fmt.Sprintf("BDAT %d", len(chunk1)))
+	cmd.Execute(smtpConn, fmt.Sprintf("BDAT %d LAST", len(chunk2)))
+	expected := fmt.Sprintf("250 2.0.0 %d octets received\r\n", len(chunk1)) +
+		"250 2.0.0 Ok: queued as <id>\r\n"
+	actual := withoutQueueIDs(conn.CloneOutputBuffer())
+	if actual != expected {
+		t.Errorf("expected: %s, actual: %s", expected, actual)
+	}
+	if len(headers) != 1 || headers[0] != "Subject: Chunked" {
+		t.Errorf("expected: [Subject: Chunked], actual: %s", headers)
+	}
+	if string(content) != "This is a chunked message.\r\n" {
+		t.Errorf("unexpected content: %q", content)
+	}
+}
+
+func TestChunkCommandMaxMessageSize(t *testing.T) {
+	conn := NewMockConn([]byte("0123456789" + "0123456789" + "NOOP\r\n"))
+	h := NewSMTPHandler(conn, nil)
+	h.Config.MaxMessageSize = 15
+	smtpConn := NewSMTPConnection(h)
+	smtpConn.State().Hello = "EHLO"
+	smtpConn.State().Phase = PhaseRcpt
+	cmd := &ChunkCommand{}
+	cmd.Execute(smtpConn, "BDAT 10")
+	cmd.Execute(smtpConn, "BDAT 10 LAST")
+	line, _ := smtpConn.ReadLine()
+	if line != "NOOP" {
+		t.Errorf("expected: NOOP, actual: %s", line)
+	}
+	smtpConn.Flush()
+	expected := "250 2.0.0 10 octets received\r\n" +
+		"552 5.3.4 Message size exceeds fixed maximum message size\r\n"
+	actual := string(conn.CloneOutputBuffer())
+	if actual != expected {
+		t.Errorf("expected: %s, actual: %s", expected, actual)
+	}
+}
+
+func TestCommandLineLimit(t *testing.T) {
+	conn := NewMockConn([]byte("NOOP " + strings.Repeat("x", 600) + "\r\n" +
+		"NOOP\r\n" +
+		"QUIT\r\n"))
+	h := NewSMTPHandler(conn, nil)
+	h.Run()
+	expected := "220 500 250 221"
+	if actual := replyCodes(conn.CloneOutputBuffer()); actual != expected {
+		t.Errorf("expected: %s, actual: %s", expected, actual)
+	}
+}
+
+func TestRecipientLimit(t *testing.T) {
+	conn := NewMockConn([]byte{})
+	h := NewSMTPHandler(conn, nil)
+	h.Config.MaxRecipients = 2
+	smtpConn := NewSMTPConnection(h)
+	st := smtpConn.State()
+	st.Hello = "EHLO"
+	st.Phase = PhaseMail
+	cmd := &RecipientCommand{}
+	cmd.Execute(smtpConn, "RCPT TO: <user1@example.net>")
+	cmd.Execute(smtpConn, "RCPT TO: <user2@example.net>")
+	cmd.Execute(smtpConn, "RCPT TO: <user3@example.net>")
+	expected := "250 250 452"
+	if actual := replyCodes(conn.CloneOutputBuffer()); actual != expected {
+		t.Errorf("expected: %s, actual: %s", expected, actual)
+	}
+	if len(st.Recipients) != 2 {
+		t.Errorf("expected 2 recipients, actual: %d", len(st.Recipients))
+	}
+}
+
+func TestRecipientAliases(t *testing.T) {
+	conn := NewMockConn([]byte{})
+	h := NewSMTPHandler(conn, nil)
+	h.Config.Aliases = NewAliasMap()
+	h.Config.Aliases.Add("team@example.net", "user1@example.net", "user2@example.net")
+	smtpConn := NewSMTPConnection(h)
+	st := smtpConn.State()
+	st.Hello = "EHLO"
+	st.Phase = PhaseMail
+	cmd := &RecipientCommand{}
+	cmd.Execute(smtpConn, "RCPT TO: <team@example.net>")
+	cmd.Execute(smtpConn, "RCPT TO: <user3@example.net>")
+	expected := "user1@example.net user2@example.net user3@example.net"
+	if actual := strings.Join(st.Recipients, " "); actual != expected {
+		t.Errorf("expected: %s, actual: %s", expected, actual)
+	}
+	if len(st.RecipientDSNs) != 3 {
+		t.Errorf("expected 3 DSNs, actual: %d", len(st.RecipientDSNs))
+	}
+}
+
+func TestRecipientVirtualDomains(t *testing.T) {
+	conn := NewMockConn([]byte{})
+	h := NewSMTPHandler(conn, nil)
+	domains, err := ParseVirtualDomains(strings.NewReader(
+		"example.net\n" +
+			"example.org catchall\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.Config.VirtualDomains = domains
+	smtpConn := NewSMTPConnection(h)
+	st := smtpConn.State()
+	st.Hello = "EHLO"
+	st.Phase = PhaseMail
+	cmd := &RecipientCommand{}
+	cmd.Execute(smtpConn, "RCPT TO: <user1@example.net>")
+	cmd.Execute(smtpConn, "RCPT TO: <user2@Example.org>")
+	cmd.Execute(smtpConn, "RCPT TO: <user3@example.com>")
+	expected := "250 250 550"
+	if actual := replyCodes(conn.CloneOutputBuffer()); actual != expected {
+		t.Errorf("expected: %s, actual: %s", expected, actual)
+	}
+	expected = "user1@example.net catchall"
+	if actual := strings.Join(st.RecipientMailboxes, " "); actual != expected {
+		t.Errorf("expected: %s, actual: %s", expected, actual)
+	}
+}
+
+func TestMailCommandPolicy(t *testing.T) {
+	conn := NewMockConn([]byte{})
+	h := NewSMTPHandler(conn, nil)
+	policy, err := ParsePolicy(strings.NewReader(
+		"mail sender *@spam.example.net reject 550 5.7.1 Sender rejected\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.Config.Policy = policy
+	smtpConn := NewSMTPConnection(h)
+	st := smtpConn.State()
+	st.Hello = "EHLO"
+	cmd := &MailCommand{}
+	cmd.Execute(smtpConn, "MAIL FROM: <foo@spam.example.net>")
+	cmd.Execute(smtpConn, "MAIL FROM: <foo@example.net>")
+	expected := "550 5.7.1 Sender rejected\r\n" + "250 2.1.0 OK\r\n"
+	actual := string(conn.CloneOutputBuffer())
+	if actual != expected {
+		t.Errorf("expected: %s, actual: %s", expected, actual)
+	}
+}
+
+func TestDataCommandLineLimits(t *testing.T) {
+	tests := []struct {
+		input    string
+		config   SMTPConfig
+		expected string
+	}{
+		{
+			"Subject: Long line\r\n\r\n" + strings.Repeat("x", 999) + "\r\n.\r\n",
+			SMTPConfig{},
+			"552 5.3.4 Message line too long\r\n",
+		},
+		{
+			"Subject: Long line\r\n\r\n" + strings.Repeat("x", 999) + "\r\n.\r\n",
+			SMTPConfig{MaxTextLineLength: -1},
+			"250 2.0.0 Ok: queued as <id>\r\n",
+		},
+		{
+			"X-1: 1\r\nX-2: 2\r\nX-3: 3\r\n\r\nfoo\r\n.\r\n",
+			SMTPConfig{MaxHeaderLines: 2},
+			"552 5.3.4 Too many header lines\r\n",
+		},
+	}
+	for _, test := range tests {
+		conn := NewMockConn([]byte(test.input))
+		h := NewSMTPHandler(conn, nil)
+		h.Config = &test.config
+		smtpConn := NewSMTPConnection(h)
+		smtpConn.State().Hello = "EHLO"
+		smtpConn.State().Phase = PhaseRcpt
+		cmd := &DataCommand{}
+		cmd.Execute(smtpConn, "DATA")
+		expected := startMailInput + test.expected
+		actual := withoutQueueIDs(conn.CloneOutputBuffer())
+		if actual != expected {
+			t.Errorf("expected: %s, actual: %s", expected, actual)
+		}
+	}
+}
+
+func TestRawMessage(t *testing.T) {
+	raw := "Subject: Raw\r\n" +
+		"X-Folded: a\r\n" +
+		"\t b\r\n" +
+		" \r\n" +
+		"Hello\r\n" +
+		".hidden\r\n"
+	var sent, original string
+	conn := NewMockConn([]byte("EHLO localhost\r\n" +
+		"MAIL FROM: <foo@example.net>\r\n" +
+		"RCPT TO: <user1@example.com>\r\n" +
+		"DATA\r\n" +
+		strings.ReplaceAll(raw, "\r\n.", "\r\n..") +
+		".\r\n" +
+		"QUIT\r\n"))
+	h := NewSMTPHandler(conn, func(st *SMTPState) error {
+		b, _ := io.ReadAll(st.messageReader())
+		sent = string(b)
+		b, _ = io.ReadAll(st.Raw())
+		original = string(b)
+		return nil
+	})
+	h.Config.AddReceived = true
+	h.Run()
+	if original != raw {
+		t.Errorf("expected: %q, actual: %q", raw, original)
+	}
+	if !strings.HasPrefix(sent, "Received: ") || !strings.HasSuffix(sent, "\r\n"+raw) {
+		t.Errorf("unexpected message: %q", sent)
+	}
+
+	st := &SMTPState{Headers: []string{"Subject: Built"}}
+	st.SetContent([]byte("Hello\r\n"))
+	b, _ := io.ReadAll(st.Raw())
+	if expected := "Subject: Built\r\n\r\nHello\r\n"; string(b) != expected {
+		t.Errorf("expected: %q, actual: %q", expected, b)
+	}
+}
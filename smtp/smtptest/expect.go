@@ -0,0 +1,163 @@
+package smtptest
+
+import (
+	"bytes"
+	"fmt"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// Expectation is a set of conditions on a message of the server, e.g.
+//
+//	s.Expect().From("foo@example.net").To("user1@example.com").
+//		SubjectContains("Welcome").Within(5 * time.Second)
+type Expectation struct {
+	s          *Server
+	conditions []condition
+}
+
+type condition struct {
+	desc   string
+	actual func(m Message) string
+	match  func(m Message) bool
+}
+
+// Expect begins an expectation which any message matches.
+func (s *Server) Expect() *Expectation {
+	return &Expectation{s: s}
+}
+
+func (e *Expectation) add(desc string, actual func(m Message) string, match func(m Message) bool) *Expectation {
+	e.conditions = append(e.conditions, condition{desc, actual, match})
+	return e
+}
+
+// From expects the envelope sender, compared case-insensitively.
+func (e *Expectation) From(addr string) *Expectation {
+	return e.add(fmt.Sprintf("from %s", addr),
+		func(m Message) string { return m.From },
+		func(m Message) bool { return strings.EqualFold(m.From, addr) })
+}
+
+// To expects an envelope recipient, compared case-insensitively.
+func (e *Expectation) To(addr string) *Expectation {
+	return e.add(fmt.Sprintf("to %s", addr),
+		func(m Message) string { return strings.Join(m.To, ", ") },
+		func(m Message) bool {
+			for _, x := range m.To {
+				if strings.EqualFold(x, addr) {
+					return true
+				}
+			}
+			return false
+		})
+}
+
+// Subject expects the decoded subject.
+func (e *Expectation) Subject(s string) *Expectation {
+	return e.add(fmt.Sprintf("subject %q", s),
+		Message.Subject,
+		func(m Message) bool { return m.Subject() == s })
+}
+
+// SubjectContains expects the decoded subject to contain s.
+func (e *Expectation) SubjectContains(s string) *Expectation {
+	return e.add(fmt.Sprintf("subject containing %q", s),
+		Message.Subject,
+		func(m Message) bool { return strings.Contains(m.Subject(), s) })
+}
+
+// Header expects a header field of the value.
+func (e *Expectation) Header(name, value string) *Expectation {
+	return e.add(fmt.Sprintf("%s %q", name, value),
+		func(m Message) string { return strings.Join(m.Header[textproto.CanonicalMIMEHeaderKey(name)], ", ") },
+		func(m Message) bool {
+			for _, x := range m.Header[textproto.CanonicalMIMEHeaderKey(name)] {
+				if x == value {
+					return true
+				}
+			}
+			return false
+		})
+}
+
+// BodyContains expects the body to contain s.
+func (e *Expectation) BodyContains(s string) *Expectation {
+	return e.add(fmt.Sprintf("body containing %q", s),
+		func(m Message) string { return abbreviate(string(m.Body), 60) },
+		func(m Message) bool { return bytes.Contains(m.Body, []byte(s)) })
+}
+
+// Within waits up to timeout for a message matching the expectation and
+// returns the first one. The test fails with the conditions unmet by each
+// message if none matches.
+func (e *Expectation) Within(timeout time.Duration) Message {
+	e.s.t.Helper()
+	m, report := e.within(timeout)
+	if len(report) > 0 {
+		e.s.t.Fatal(report)
+	}
+	return m
+}
+
+// within returns the first message matching, or the report of the
+// mismatches on timeout.
+func (e *Expectation) within(timeout time.Duration) (Message, string) {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	for {
+		s := e.s
+		s.mtx.Lock()
+		messages := s.messages
+		notify := s.notify
+		s.mtx.Unlock()
+		for _, m := range messages {
+			if e.matches(m) {
+				return m, ""
+			}
+		}
+		select {
+		case <-notify:
+		case <-deadline.C:
+			return Message{}, e.report(timeout, messages)
+		}
+	}
+}
+
+func (e *Expectation) matches(m Message) bool {
+	for _, c := range e.conditions {
+		if !c.match(m) {
+			return false
+		}
+	}
+	return true
+}
+
+func (e *Expectation) report(timeout time.Duration, messages []Message) string {
+	var b strings.Builder
+	descs := make([]string, len(e.conditions))
+	for i, c := range e.conditions {
+		descs[i] = c.desc
+	}
+	fmt.Fprintf(&b, "smtptest: no message %s within %s", strings.Join(descs, ", "), timeout)
+	if len(messages) == 0 {
+		b.WriteString("; no messages received")
+	}
+	for i, m := range messages {
+		fmt.Fprintf(&b, "\n  message %d:", i+1)
+		for _, c := range e.conditions {
+			if !c.match(m) {
+				fmt.Fprintf(&b, "\n    expected %s, actual %q", c.desc, c.actual(m))
+			}
+		}
+	}
+	return b.String()
+}
+
+func abbreviate(s string, n int) string {
+	if len(s) > n {
+		return s[:n] + "..."
+	}
+	return s
+}
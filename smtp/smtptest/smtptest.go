@@ -0,0 +1,180 @@
+// Package smtptest provides an in-process SMTP server keeping the messages
+// it accepts in memory, for tests of code sending mail.
+package smtptest
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"mime"
+	"net"
+	"net/mail"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tachesimazzoca/go-mproxy/smtp"
+)
+
+var ErrTimeout = errors.New("smtptest: timed out waiting for a message")
+
+// Message is a message accepted by the server.
+type Message struct {
+	From     string
+	To       []string
+	Header   mail.Header
+	Body     []byte
+	Data     []byte
+	Received time.Time
+}
+
+// Server listens on an ephemeral port of the loopback interface.
+type Server struct {
+	// Addr is the address to connect to, e.g. 127.0.0.1:49152.
+	Addr string
+
+	// Config is shared by the sessions, which may be modified before
+	// connecting to the server.
+	Config *smtp.SMTPConfig
+
+	t        testing.TB
+	lsnr     net.Listener
+	mtx      sync.Mutex
+	messages []Message
+	waited   int
+	notify   chan struct{}
+	conns    map[net.Conn]bool
+	wg       sync.WaitGroup
+}
+
+// NewServer starts a server which is closed when the test ends.
+func NewServer(t testing.TB) *Server {
+	lsnr, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("smtptest: failed to listen: %v", err)
+	}
+	s := &Server{
+		Addr:   lsnr.Addr().String(),
+		Config: &smtp.SMTPConfig{ServerName: "localhost"},
+		t:      t,
+		lsnr:   lsnr,
+		notify: make(chan struct{}),
+		conns:  make(map[net.Conn]bool),
+	}
+	s.wg.Add(1)
+	go s.serve()
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.lsnr.Accept()
+		if err != nil {
+			return
+		}
+		h := smtp.NewSMTPHandler(conn, s.accept)
+		h.Config = s.Config
+		s.mtx.Lock()
+		s.conns[conn] = true
+		s.mtx.Unlock()
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			h.Run()
+			s.mtx.Lock()
+			delete(s.conns, conn)
+			s.mtx.Unlock()
+		}()
+	}
+}
+
+func (s *Server) accept(st *smtp.SMTPState) error {
+	var b bytes.Buffer
+	for _, x := range st.Headers {
+		b.WriteString(x + "\r\n")
+	}
+	b.WriteString("\r\n")
+	if _, err := io.Copy(&b, st.Content()); err != nil {
+		return err
+	}
+	m := Message{
+		From:     st.ReturnTo,
+		To:       append([]string{}, st.Recipients...),
+		Data:     b.Bytes(),
+		Received: time.Now(),
+	}
+	if msg, err := mail.ReadMessage(bytes.NewReader(m.Data)); err == nil {
+		m.Header = msg.Header
+		m.Body, _ = io.ReadAll(msg.Body)
+	} else {
+		m.Header = mail.Header{}
+		m.Body = m.Data
+	}
+	defer s.mtx.Unlock()
+	s.mtx.Lock()
+	s.messages = append(s.messages, m)
+	close(s.notify)
+	s.notify = make(chan struct{})
+	return nil
+}
+
+// Messages returns the accepted messages in the order they were accepted.
+func (s *Server) Messages() []Message {
+	defer s.mtx.Unlock()
+	s.mtx.Lock()
+	return append([]Message{}, s.messages...)
+}
+
+// WaitForMessage returns the next message not returned by WaitForMessage
+// yet, waiting up to timeout for it to be accepted.
+func (s *Server) WaitForMessage(timeout time.Duration) (Message, error) {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	for {
+		s.mtx.Lock()
+		if s.waited < len(s.messages) {
+			m := s.messages[s.waited]
+			s.waited++
+			s.mtx.Unlock()
+			return m, nil
+		}
+		notify := s.notify
+		s.mtx.Unlock()
+		select {
+		case <-notify:
+		case <-deadline.C:
+			return Message{}, ErrTimeout
+		}
+	}
+}
+
+// Reset discards the accepted messages.
+func (s *Server) Reset() {
+	defer s.mtx.Unlock()
+	s.mtx.Lock()
+	s.messages = nil
+	s.waited = 0
+}
+
+// Close stops the server, closing the connections in progress.
+func (s *Server) Close() {
+	s.lsnr.Close()
+	s.mtx.Lock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mtx.Unlock()
+	s.wg.Wait()
+}
+
+// Subject returns the decoded Subject header of the message.
+func (m Message) Subject() string {
+	v := m.Header.Get("Subject")
+	if x, err := new(mime.WordDecoder).DecodeHeader(v); err == nil {
+		return x
+	}
+	return strings.TrimSpace(v)
+}
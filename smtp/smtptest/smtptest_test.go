@@ -0,0 +1,80 @@
+package smtptest
+
+import (
+	netsmtp "net/smtp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// send sends the message with BDAT.
+func send(t *testing.T, addr, from, to, msg string) {
+	c, err := netsmtp.Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.Mail(from)
+	c.Rcpt(to)
+	id, _ := c.Text.Cmd("BDAT %d LAST", len(msg))
+	c.Text.W.WriteString(msg)
+	c.Text.W.Flush()
+	c.Text.StartResponse(id)
+	if _, _, err := c.Text.ReadResponse(250); err != nil {
+		t.Fatal(err)
+	}
+	c.Text.EndResponse(id)
+}
+
+func TestServer(t *testing.T) {
+	s := NewServer(t)
+	send(t, s.Addr, "foo@example.net", "user1@example.com",
+		"Subject: =?UTF-8?Q?Welcome_=E2=9C=93?=\r\n\r\nHello\r\n")
+	m, err := s.WaitForMessage(5 * time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.From != "foo@example.net" || len(m.To) != 1 || m.To[0] != "user1@example.com" {
+		t.Errorf("unexpected envelope: %s %v", m.From, m.To)
+	}
+	if expected := "Welcome ✓"; m.Subject() != expected {
+		t.Errorf("expected: %s, actual: %s", expected, m.Subject())
+	}
+	if expected := "Hello\r\n"; string(m.Body) != expected {
+		t.Errorf("expected: %q, actual: %q", expected, m.Body)
+	}
+	if _, err := s.WaitForMessage(10 * time.Millisecond); err != ErrTimeout {
+		t.Errorf("expected: %v, actual: %v", ErrTimeout, err)
+	}
+	if n := len(s.Messages()); n != 1 {
+		t.Errorf("expected: 1, actual: %d", n)
+	}
+	s.Reset()
+	if n := len(s.Messages()); n != 0 {
+		t.Errorf("expected: 0, actual: %d", n)
+	}
+}
+
+func TestExpect(t *testing.T) {
+	s := NewServer(t)
+	send(t, s.Addr, "foo@example.net", "user1@example.com",
+		"Subject: Welcome aboard\r\nX-Campaign: signup\r\n\r\nHello\r\n")
+	m := s.Expect().From("FOO@example.net").To("user1@example.com").
+		SubjectContains("Welcome").Header("x-campaign", "signup").BodyContains("Hello").
+		Within(5 * time.Second)
+	if m.Subject() != "Welcome aboard" {
+		t.Errorf("unexpected message: %v", m)
+	}
+
+	_, report := s.Expect().From("foo@example.net").Subject("Goodbye").within(10 * time.Millisecond)
+	expected := "smtptest: no message from foo@example.net, subject \"Goodbye\" within 10ms\n" +
+		"  message 1:\n" +
+		"    expected subject \"Goodbye\", actual \"Welcome aboard\""
+	if report != expected {
+		t.Errorf("expected: %s, actual: %s", expected, report)
+	}
+	s.Reset()
+	if _, report := s.Expect().within(time.Millisecond); !strings.HasSuffix(report, "; no messages received") {
+		t.Errorf("unexpected report: %s", report)
+	}
+}
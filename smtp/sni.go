@@ -0,0 +1,75 @@
+package smtp
+
+import (
+	"crypto/tls"
+	"errors"
+	"strings"
+	"sync"
+)
+
+// CertificateSelector selects the certificate of the server name
+// indicated by the client, so one listener can serve several domains. A
+// name "*.example.net" matches a single leftmost label. The certificate of
+// Default, or the first one added, is served to other clients.
+type CertificateSelector struct {
+	Default func(hello *tls.ClientHelloInfo) (*tls.Certificate, error)
+
+	mtx   sync.RWMutex
+	names map[string]func(hello *tls.ClientHelloInfo) (*tls.Certificate, error)
+}
+
+func NewCertificateSelector() *CertificateSelector {
+	return &CertificateSelector{
+		names: make(map[string]func(hello *tls.ClientHelloInfo) (*tls.Certificate, error)),
+	}
+}
+
+// Add serves the certificate returned by getCertificate for the name.
+func (s *CertificateSelector) Add(name string, getCertificate func(hello *tls.ClientHelloInfo) (*tls.Certificate, error)) {
+	defer s.mtx.Unlock()
+	s.mtx.Lock()
+	if s.Default == nil {
+		s.Default = getCertificate
+	}
+	s.names[strings.ToLower(strings.TrimSuffix(name, "."))] = getCertificate
+}
+
+// AddLoader serves the certificate of the loader for each DNS name in it.
+func (s *CertificateSelector) AddLoader(l *CertificateLoader) error {
+	cert, err := l.GetCertificate(nil)
+	if err != nil {
+		return err
+	}
+	leaf := cert.Leaf
+	if leaf == nil {
+		return errors.New("tls: certificate is not parsed")
+	}
+	names := leaf.DNSNames
+	if len(names) == 0 && len(leaf.Subject.CommonName) > 0 {
+		names = []string{leaf.Subject.CommonName}
+	}
+	for _, x := range names {
+		s.Add(x, l.GetCertificate)
+	}
+	return nil
+}
+
+// GetCertificate can be used as tls.Config.GetCertificate.
+func (s *CertificateSelector) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.mtx.RLock()
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	f, ok := s.names[name]
+	if !ok {
+		if i := strings.IndexByte(name, '.'); i > 0 {
+			f, ok = s.names["*"+name[i:]]
+		}
+	}
+	if !ok {
+		f = s.Default
+	}
+	s.mtx.RUnlock()
+	if f == nil {
+		return nil, errors.New("tls: no certificate")
+	}
+	return f(hello)
+}
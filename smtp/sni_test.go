@@ -0,0 +1,91 @@
+package smtp
+
+import (
+	"crypto/tls"
+	"net"
+	netsmtp "net/smtp"
+	"testing"
+	"time"
+)
+
+func TestCertificateSelector(t *testing.T) {
+	dir := t.TempDir()
+	net1, _ := testCertificate(t, "mx.example.net", "*.example.net")
+	org, _ := testCertificate(t, "mx.example.org")
+	s := NewCertificateSelector()
+	certFile, keyFile := writeTestCertificate(t, dir, net1, time.Now())
+	l, err := NewCertificateLoader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AddLoader(l); err != nil {
+		t.Fatal(err)
+	}
+	s.Add("mx.example.org", func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		return &org, nil
+	})
+	for name, expected := range map[string]tls.Certificate{
+		"mx.example.net":    net1,
+		"smtp.example.net":  net1,
+		"MX.EXAMPLE.ORG.":   org,
+		"a.b.example.org":   net1,
+		"":                  net1,
+		"mail.example.com":  net1,
+		"smtp.example.org":  net1,
+		"mx.example.org.cn": net1,
+	} {
+		cert, err := s.GetCertificate(&tls.ClientHelloInfo{ServerName: name})
+		if err != nil || string(cert.Certificate[0]) != string(expected.Certificate[0]) {
+			t.Errorf("%s: unexpected certificate", name)
+		}
+	}
+}
+
+func TestImplicitTLS(t *testing.T) {
+	cert, pool := testCertificate(t, "mx.example.com")
+	lsnr, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip(err)
+	}
+	defer lsnr.Close()
+	s := NewCertificateSelector()
+	s.Add("mx.example.com", func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		return &cert, nil
+	})
+	config := &tls.Config{GetCertificate: s.GetCertificate}
+	secure := make(chan bool, 1)
+	go func() {
+		conn, err := tls.NewListener(lsnr, config).Accept()
+		if err != nil {
+			secure <- false
+			return
+		}
+		h := NewSMTPHandler(conn, nil)
+		h.Config.TLSConfig = config
+		h.Config.Hooks = &Hooks{}
+		h.Config.Hooks.OnHelo(func(conn *SMTPConnection) string {
+			secure <- conn.State().TLS != nil && conn.State().TLS.ServerName == "mx.example.com"
+			return ""
+		})
+		h.Run()
+	}()
+	conn, err := tls.Dial("tcp", lsnr.Addr().String(), &tls.Config{ServerName: "mx.example.com", RootCAs: pool})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := netsmtp.NewClient(conn, "mx.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := c.Hello("localhost"); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		t.Errorf("unexpected STARTTLS")
+	}
+	if !<-secure {
+		t.Errorf("expected a TLS session")
+	}
+	c.Quit()
+}
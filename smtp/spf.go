@@ -0,0 +1,453 @@
+package smtp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Resolver is the subset of *net.Resolver used by the authentication
+// checks.
+type Resolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+	LookupIP(ctx context.Context, network, host string) ([]net.IP, error)
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+	LookupAddr(ctx context.Context, addr string) ([]string, error)
+}
+
+// SPFResult is the result of an SPF check (RFC 7208) of an identity,
+// "mailfrom" or "helo": none, neutral, pass, fail, softfail, temperror or
+// permerror.
+type SPFResult struct {
+	Result   string
+	Identity string
+	Domain   string
+}
+
+func (res SPFResult) String() string {
+	if res.Identity == "helo" {
+		return "spf=" + res.Result + " smtp.helo=" + res.Domain
+	}
+	return "spf=" + res.Result + " smtp.mailfrom=" + res.Domain
+}
+
+const (
+	maxSPFLookups     = 10
+	maxSPFVoidLookups = 2
+)
+
+var errSPFPermanent = errors.New("spf: permanent error")
+
+type spfChecker struct {
+	ctx         context.Context
+	resolver    Resolver
+	ip          net.IP
+	sender      string
+	helo        string
+	lookups     int
+	voidLookups int
+}
+
+// CheckSPF evaluates check_host() for the client IP and the domain of the
+// sender, or of helo if the sender is empty.
+func CheckSPF(ctx context.Context, r Resolver, ip net.IP, sender, helo string) SPFResult {
+	res := SPFResult{Identity: "mailfrom"}
+	if len(sender) == 0 {
+		res.Identity = "helo"
+		sender = "postmaster@" + helo
+	} else if !strings.Contains(sender, "@") {
+		sender = "postmaster@" + sender
+	}
+	res.Domain = sender[strings.LastIndex(sender, "@")+1:]
+	c := &spfChecker{ctx: ctx, resolver: r, ip: ip, sender: sender, helo: helo}
+	res.Result = c.checkHost(res.Domain, 0)
+	return res
+}
+
+func isSPFDomain(domain string) bool {
+	labels := strings.Split(strings.TrimSuffix(domain, "."), ".")
+	if len(labels) < 2 || len(domain) > 253 {
+		return false
+	}
+	for _, x := range labels {
+		if len(x) == 0 || len(x) > 63 {
+			return false
+		}
+	}
+	return true
+}
+
+func isNotFound(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
+}
+
+func (c *spfChecker) checkHost(domain string, depth int) string {
+	if !isSPFDomain(domain) || depth > maxSPFLookups {
+		return "none"
+	}
+	txts, err := c.resolver.LookupTXT(c.ctx, domain)
+	if err != nil {
+		if isNotFound(err) {
+			return "none"
+		}
+		return "temperror"
+	}
+	records := make([]string, 0)
+	for _, x := range txts {
+		if strings.EqualFold(x, "v=spf1") || strings.HasPrefix(strings.ToLower(x), "v=spf1 ") {
+			records = append(records, x)
+		}
+	}
+	if len(records) == 0 {
+		return "none"
+	}
+	if len(records) > 1 {
+		return "permerror"
+	}
+
+	redirect := ""
+	terms := strings.Fields(records[0])[1:]
+	for _, term := range terms {
+		if i := strings.IndexByte(term, '='); i > 0 && !strings.ContainsAny(term[:i], ":/") {
+			if strings.EqualFold(term[:i], "redirect") {
+				redirect = term[i+1:]
+			}
+			continue
+		}
+		qualifier := byte('+')
+		if strings.IndexByte("+-~?", term[0]) >= 0 {
+			qualifier, term = term[0], term[1:]
+		}
+		match, err := c.mechanism(domain, term, depth)
+		if err == errSPFPermanent {
+			return "permerror"
+		}
+		if err != nil {
+			return err.Error()
+		}
+		if match {
+			return map[byte]string{'+': "pass", '-': "fail", '~': "softfail", '?': "neutral"}[qualifier]
+		}
+	}
+	if len(redirect) > 0 {
+		if c.lookups++; c.lookups > maxSPFLookups {
+			return "permerror"
+		}
+		target, err := c.expand(redirect, domain)
+		if err != nil {
+			return "permerror"
+		}
+		res := c.checkHost(target, depth+1)
+		if res == "none" {
+			return "permerror"
+		}
+		return res
+	}
+	return "neutral"
+}
+
+// mechanism returns whether the mechanism matches. The error is
+// errSPFPermanent, or one whose message is the result to return.
+func (c *spfChecker) mechanism(domain, term string, depth int) (bool, error) {
+	name, arg := term, ""
+	if i := strings.IndexAny(term, ":/"); i >= 0 {
+		name, arg = term[:i], term[i:]
+	}
+	name = strings.ToLower(name)
+	switch name {
+	case "all":
+		return len(arg) == 0, nil
+	case "ip4", "ip6":
+		if !strings.HasPrefix(arg, ":") {
+			return false, errSPFPermanent
+		}
+		cidr := arg[1:]
+		if !strings.Contains(cidr, "/") {
+			if name == "ip4" {
+				cidr += "/32"
+			} else {
+				cidr += "/128"
+			}
+		}
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil || (name == "ip4") != (ipnet.IP.To4() != nil) {
+			return false, errSPFPermanent
+		}
+		return ipnet.Contains(c.ip), nil
+	case "a", "mx", "ptr", "exists", "include":
+	default:
+		return false, errSPFPermanent
+	}
+
+	if c.lookups++; c.lookups > maxSPFLookups {
+		return false, errSPFPermanent
+	}
+	target, cidr4, cidr6 := domain, 32, 128
+	if strings.HasPrefix(arg, ":") {
+		spec := arg[1:]
+		if i := strings.IndexByte(spec, '/'); i >= 0 && name != "include" && name != "exists" {
+			spec, arg = spec[:i], spec[i:]
+		} else {
+			arg = ""
+		}
+		var err error
+		if target, err = c.expand(spec, domain); err != nil {
+			return false, errSPFPermanent
+		}
+	} else if (name == "include" || name == "exists") || (len(arg) > 0 && arg[0] != '/') {
+		return false, errSPFPermanent
+	}
+	if strings.HasPrefix(arg, "/") && (name == "a" || name == "mx") {
+		xs := strings.SplitN(arg[1:], "//", 2)
+		var err4, err6 error
+		if len(xs[0]) > 0 {
+			cidr4, err4 = strconv.Atoi(xs[0])
+		}
+		if len(xs) == 2 {
+			cidr6, err6 = strconv.Atoi(xs[1])
+		}
+		if err4 != nil || err6 != nil || cidr4 > 32 || cidr6 > 128 {
+			return false, errSPFPermanent
+		}
+	}
+
+	switch name {
+	case "include":
+		switch c.checkHost(target, depth+1) {
+		case "pass":
+			return true, nil
+		case "temperror":
+			return false, errors.New("temperror")
+		case "permerror", "none":
+			return false, errSPFPermanent
+		}
+		return false, nil
+	case "exists":
+		ips, err := c.lookupIP(target, "ip4")
+		if err != nil {
+			return false, err
+		}
+		return len(ips) > 0, nil
+	case "a":
+		return c.matchHost(target, cidr4, cidr6)
+	case "mx":
+		mxs, err := c.resolver.LookupMX(c.ctx, target)
+		if err != nil && !isNotFound(err) {
+			return false, errors.New("temperror")
+		}
+		if len(mxs) == 0 {
+			return false, c.void()
+		}
+		if len(mxs) > maxSPFLookups {
+			return false, errSPFPermanent
+		}
+		for _, mx := range mxs {
+			if ok, err := c.matchHost(strings.TrimSuffix(mx.Host, "."), cidr4, cidr6); ok || err != nil {
+				return ok, err
+			}
+		}
+		return false, nil
+	case "ptr":
+		names, err := c.resolver.LookupAddr(c.ctx, c.ip.String())
+		if err != nil {
+			return false, nil
+		}
+		for i, x := range names {
+			if i == maxSPFLookups {
+				break
+			}
+			x = strings.ToLower(strings.TrimSuffix(x, "."))
+			t := strings.ToLower(target)
+			if x != t && !strings.HasSuffix(x, "."+t) {
+				continue
+			}
+			if ok, _ := c.matchHost(x, 32, 128); ok {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+	return false, nil
+}
+
+func (c *spfChecker) void() error {
+	if c.voidLookups++; c.voidLookups > maxSPFVoidLookups {
+		return errSPFPermanent
+	}
+	return nil
+}
+
+func (c *spfChecker) lookupIP(host, network string) ([]net.IP, error) {
+	ips, err := c.resolver.LookupIP(c.ctx, network, host)
+	if err != nil {
+		if isNotFound(err) {
+			return nil, c.void()
+		}
+		return nil, errors.New("temperror")
+	}
+	return ips, nil
+}
+
+func (c *spfChecker) matchHost(host string, cidr4, cidr6 int) (bool, error) {
+	network, bits, size := "ip6", cidr6, 128
+	if c.ip.To4() != nil {
+		network, bits, size = "ip4", cidr4, 32
+	}
+	ips, err := c.lookupIP(host, network)
+	if err != nil {
+		return false, err
+	}
+	mask := net.CIDRMask(bits, size)
+	for _, x := range ips {
+		if x.Mask(mask).Equal(c.ip.Mask(mask)) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// expand expands the macros of a domain-spec (RFC 7208 section 7).
+func (c *spfChecker) expand(s, domain string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '%' {
+			b.WriteByte(s[i])
+			continue
+		}
+		if i+1 >= len(s) {
+			return "", errSPFPermanent
+		}
+		i++
+		switch s[i] {
+		case '%':
+			b.WriteByte('%')
+			continue
+		case '_':
+			b.WriteByte(' ')
+			continue
+		case '-':
+			b.WriteString("%20")
+			continue
+		case '{':
+		default:
+			return "", errSPFPermanent
+		}
+		end := strings.IndexByte(s[i:], '}')
+		if end < 2 {
+			return "", errSPFPermanent
+		}
+		macro := s[i+1 : i+end]
+		i += end
+		value, err := c.macroValue(macro[0], domain)
+		if err != nil {
+			return "", err
+		}
+		spec := macro[1:]
+		digits := 0
+		for len(spec) > 0 && spec[0] >= '0' && spec[0] <= '9' {
+			digits = digits*10 + int(spec[0]-'0')
+			spec = spec[1:]
+		}
+		reverse := false
+		if len(spec) > 0 && (spec[0] == 'r' || spec[0] == 'R') {
+			reverse, spec = true, spec[1:]
+		}
+		delims := "."
+		if len(spec) > 0 {
+			if strings.Trim(spec, ".-+,/_=") != "" {
+				return "", errSPFPermanent
+			}
+			delims = spec
+		}
+		parts := strings.FieldsFunc(value, func(r rune) bool {
+			return strings.ContainsRune(delims, r)
+		})
+		if reverse {
+			for l, r := 0, len(parts)-1; l < r; l, r = l+1, r-1 {
+				parts[l], parts[r] = parts[r], parts[l]
+			}
+		}
+		if digits > 0 && digits < len(parts) {
+			parts = parts[len(parts)-digits:]
+		}
+		b.WriteString(strings.Join(parts, "."))
+	}
+	return b.String(), nil
+}
+
+func (c *spfChecker) macroValue(letter byte, domain string) (string, error) {
+	at := strings.LastIndex(c.sender, "@")
+	switch letter | 0x20 {
+	case 's':
+		return c.sender, nil
+	case 'l':
+		return c.sender[:at], nil
+	case 'o':
+		return c.sender[at+1:], nil
+	case 'd':
+		return domain, nil
+	case 'h':
+		return c.helo, nil
+	case 'i':
+		if ip4 := c.ip.To4(); ip4 != nil {
+			return ip4.String(), nil
+		}
+		nibbles := make([]string, 0, 32)
+		for _, x := range c.ip.To16() {
+			nibbles = append(nibbles, fmt.Sprintf("%x", x>>4), fmt.Sprintf("%x", x&0xf))
+		}
+		return strings.Join(nibbles, "."), nil
+	case 'v':
+		if c.ip.To4() != nil {
+			return "in-addr", nil
+		}
+		return "ip6", nil
+	case 'p':
+		return "unknown", nil
+	}
+	return "", errSPFPermanent
+}
+
+// applySPF checks the sender of the transaction and records the result on
+// the state. It returns the reply of a rejection or an empty string.
+func applySPF(conn *SMTPConnection) string {
+	config := conn.Config()
+	if !config.CheckSPF && !config.CheckDMARC {
+		return ""
+	}
+	st := conn.State()
+	ip := net.ParseIP(conn.RemoteIP())
+	if ip == nil {
+		return ""
+	}
+	sender := st.ReturnTo
+	if st.NullSender {
+		sender = ""
+	}
+	st.SPF = CheckSPF(context.Background(), config.resolver(), ip, sender, st.ClientName)
+	st.AuthResults = append(st.AuthResults, st.SPF.String())
+	if !config.CheckSPF {
+		return ""
+	}
+	action := PolicyAccept
+	switch st.SPF.Result {
+	case "fail":
+		action = config.SPFFailAction
+	case "softfail":
+		action = config.SPFSoftfailAction
+	}
+	switch action {
+	case PolicyReject:
+		conn.LogSecurityEvent(EventPolicyReject, "stage", "spf", "result", st.SPF.Result)
+		return conn.Config().Catalog.Reply("mail.spf_failed")
+	case PolicyQuarantine:
+		st.Quarantined = true
+	case PolicyTag:
+		st.Tags = append(st.Tags, "spf-"+st.SPF.Result)
+	}
+	return ""
+}
@@ -0,0 +1,161 @@
+package smtp
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+)
+
+type testResolver struct {
+	txt map[string][]string
+	ip  map[string][]string
+	mx  map[string][]string
+	ptr map[string][]string
+}
+
+func notFound(name string) error {
+	return &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (r *testResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	if xs, ok := r.txt[name]; ok {
+		return xs, nil
+	}
+	return nil, notFound(name)
+}
+
+func (r *testResolver) LookupIP(ctx context.Context, network, host string) ([]net.IP, error) {
+	ips := make([]net.IP, 0)
+	for _, x := range r.ip[host] {
+		ip := net.ParseIP(x)
+		if network == "ip" || (network == "ip4") == (ip.To4() != nil) {
+			ips = append(ips, ip)
+		}
+	}
+	if len(ips) == 0 {
+		return nil, notFound(host)
+	}
+	return ips, nil
+}
+
+func (r *testResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	xs, ok := r.mx[name]
+	if !ok {
+		return nil, notFound(name)
+	}
+	mxs := make([]*net.MX, 0)
+	for _, x := range xs {
+		mxs = append(mxs, &net.MX{Host: x + ".", Pref: 10})
+	}
+	return mxs, nil
+}
+
+func (r *testResolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	if xs, ok := r.ptr[addr]; ok {
+		return xs, nil
+	}
+	return nil, notFound(addr)
+}
+
+func TestCheckSPF(t *testing.T) {
+	r := &testResolver{
+		txt: map[string][]string{
+			"example.net":         {"v=spf1 ip4:192.0.2.0/24 a:mail.example.net/32 mx include:_spf.example.net -all"},
+			"_spf.example.net":    {"v=spf1 ip6:2001:db8::/32 ~all"},
+			"example.org":         {"some verification", "v=spf1 redirect=example.net"},
+			"example.com":         {"v=spf1 exists:%{ir}.%{l1r+-}._spf.%{d} ?all"},
+			"soft.example.net":    {"v=spf1 ~all"},
+			"ptr.example.net":     {"v=spf1 ptr -all"},
+			"loop.example.net":    {"v=spf1 include:loop.example.net -all"},
+			"multiple.example.ne": {"v=spf1 -all", "v=spf1 +all"},
+			"syntax.example.net":  {"v=spf1 ip4:bogus -all"},
+		},
+		ip: map[string][]string{
+			"mail.example.net":               {"198.51.100.1"},
+			"mx.example.net":                 {"198.51.100.2"},
+			"1.2.0.192.foo._spf.example.com": {"127.0.0.2"},
+			"host.ptr.example.net":           {"203.0.113.9"},
+		},
+		mx: map[string][]string{
+			"example.net": {"mx.example.net"},
+		},
+		ptr: map[string][]string{
+			"203.0.113.9": {"host.ptr.example.net."},
+		},
+	}
+	for _, x := range []struct {
+		ip       string
+		sender   string
+		expected string
+	}{
+		{"192.0.2.1", "foo@example.net", "pass"},
+		{"198.51.100.1", "foo@example.net", "pass"},
+		{"198.51.100.2", "foo@example.net", "pass"},
+		{"2001:db8::1", "foo@example.net", "pass"},
+		{"2001:db9::1", "foo@example.net", "fail"},
+		{"203.0.113.1", "foo@example.net", "fail"},
+		{"203.0.113.1", "foo@example.org", "fail"},
+		{"192.0.2.1", "foo@example.org", "pass"},
+		{"192.0.2.1", "foo-bar@example.com", "pass"},
+		{"192.0.2.2", "foo@example.com", "neutral"},
+		{"192.0.2.1", "foo@soft.example.net", "softfail"},
+		{"203.0.113.9", "foo@ptr.example.net", "pass"},
+		{"203.0.113.8", "foo@ptr.example.net", "fail"},
+		{"192.0.2.1", "foo@loop.example.net", "permerror"},
+		{"192.0.2.1", "foo@multiple.example.ne", "permerror"},
+		{"192.0.2.1", "foo@syntax.example.net", "permerror"},
+		{"192.0.2.1", "foo@unknown.example.net", "none"},
+	} {
+		res := CheckSPF(context.Background(), r, net.ParseIP(x.ip), x.sender, "mail.example.net")
+		if res.Result != x.expected {
+			t.Errorf("%s %s expected: %s, actual: %s", x.ip, x.sender, x.expected, res.Result)
+		}
+	}
+	res := CheckSPF(context.Background(), r, net.ParseIP("192.0.2.1"), "", "example.net")
+	if res.String() != "spf=pass smtp.helo=example.net" {
+		t.Errorf("unexpected result: %s", res)
+	}
+}
+
+func TestApplySPF(t *testing.T) {
+	r := &testResolver{txt: map[string][]string{
+		"example.net": {"v=spf1 -all"},
+		"example.org": {"v=spf1 ~all"},
+	}}
+	for _, x := range []struct {
+		sender   string
+		action   PolicyAction
+		expected string
+	}{
+		{"foo@example.net", PolicyReject, "220 250 550 221"},
+		{"foo@example.net", "", "220 250 250 221"},
+		{"foo@example.org", PolicyReject, "220 250 550 221"},
+	} {
+		conn := &tcpMockConn{NewMockConn([]byte("EHLO localhost\r\n" +
+			"MAIL FROM: <" + x.sender + ">\r\n" +
+			"QUIT\r\n")), "192.0.2.1:25"}
+		h := NewSMTPHandler(conn, nil)
+		h.Config.CheckSPF = true
+		h.Config.Resolver = r
+		h.Config.SPFFailAction = x.action
+		h.Config.SPFSoftfailAction = x.action
+		h.Run()
+		if actual := replyCodes(conn.CloneOutputBuffer()); actual != x.expected {
+			t.Errorf("%s expected: %s, actual: %s", x.sender, x.expected, actual)
+		}
+		if x.action == PolicyReject && !strings.Contains(string(conn.CloneOutputBuffer()), "5.7.23") {
+			t.Errorf("expected 5.7.23: %s", conn.CloneOutputBuffer())
+		}
+	}
+}
+
+type tcpMockConn struct {
+	*MockConn
+	addr string
+}
+
+func (c *tcpMockConn) RemoteAddr() net.Addr {
+	addr, _ := net.ResolveTCPAddr("tcp", c.addr)
+	return addr
+}
@@ -0,0 +1,94 @@
+package smtp
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"os"
+)
+
+// Spool buffers message content in memory up to a threshold and moves it
+// to a temporary file once the threshold is exceeded.
+type Spool struct {
+	threshold int64
+	dir       string
+	buf       bytes.Buffer
+	file      *os.File
+	writer    *bufio.Writer
+	size      int64
+}
+
+func NewSpool(threshold int64, dir string) *Spool {
+	return &Spool{
+		threshold: threshold,
+		dir:       dir,
+	}
+}
+
+func (s *Spool) Write(p []byte) (int, error) {
+	if s.file == nil && s.threshold > 0 && s.size+int64(len(p)) > s.threshold {
+		f, err := os.CreateTemp(s.dir, "mproxy-spool-*")
+		if err != nil {
+			return 0, err
+		}
+		if _, err := f.Write(s.buf.Bytes()); err != nil {
+			f.Close()
+			os.Remove(f.Name())
+			return 0, err
+		}
+		s.file = f
+		s.writer = bufio.NewWriter(f)
+		s.buf = bytes.Buffer{}
+	}
+	var n int
+	var err error
+	if s.file != nil {
+		n, err = s.writer.Write(p)
+	} else {
+		n, err = s.buf.Write(p)
+	}
+	s.size += int64(n)
+	return n, err
+}
+
+func (s *Spool) Flush() error {
+	if s.writer == nil {
+		return nil
+	}
+	return s.writer.Flush()
+}
+
+func (s *Spool) Size() int64 {
+	return s.size
+}
+
+func (s *Spool) IsSpooled() bool {
+	return s.file != nil
+}
+
+// Reader returns a new reader from the beginning of the content. Each
+// reader is independent, so the content can be read more than once.
+func (s *Spool) Reader() io.Reader {
+	if s.file != nil {
+		s.Flush()
+		return io.NewSectionReader(s.file, 0, s.size)
+	}
+	return bytes.NewReader(s.buf.Bytes())
+}
+
+// Close releases the content and removes the temporary file if any.
+func (s *Spool) Close() error {
+	s.buf = bytes.Buffer{}
+	s.size = 0
+	if s.file == nil {
+		return nil
+	}
+	f := s.file
+	s.file = nil
+	s.writer = nil
+	err := f.Close()
+	if rerr := os.Remove(f.Name()); err == nil {
+		err = rerr
+	}
+	return err
+}
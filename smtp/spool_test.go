@@ -0,0 +1,39 @@
+package smtp
+
+import (
+	"io"
+	"os"
+	"testing"
+)
+
+func TestSpool(t *testing.T) {
+	dir := t.TempDir()
+	s := NewSpool(8, dir)
+	s.Write([]byte("0123"))
+	if s.IsSpooled() {
+		t.Error("content must be in memory under the threshold")
+	}
+	s.Write([]byte("456789"))
+	if !s.IsSpooled() {
+		t.Error("content must be spooled over the threshold")
+	}
+	s.Write([]byte("abc"))
+	if s.Size() != 13 {
+		t.Errorf("expected: 13, actual: %d", s.Size())
+	}
+	for i := 0; i < 2; i++ {
+		b, err := io.ReadAll(s.Reader())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != "0123456789abc" {
+			t.Errorf("expected: 0123456789abc, actual: %s", b)
+		}
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if files, _ := os.ReadDir(dir); len(files) > 0 {
+		t.Errorf("spool file must be removed: %v", files)
+	}
+}
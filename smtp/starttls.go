@@ -0,0 +1,47 @@
+package smtp
+
+import (
+	"crypto/tls"
+)
+
+type StartTLSCommand struct {
+}
+
+// Execute upgrades the connection to TLS (RFC 3207). Input pipelined after
+// the command is discarded, and the session starts over without the
+// client's greeting.
+func (cmnd *StartTLSCommand) Execute(conn *SMTPConnection, line string) error {
+	st := conn.State()
+	config := conn.Config().TLSConfig
+	if config == nil {
+		return conn.Reply("starttls.unavailable")
+	}
+	if st.TLS != nil {
+		return conn.Reply("starttls.active")
+	}
+	if cmd, err := ParseCommand(line); err != nil || len(cmd.Arg) > 0 {
+		return conn.Reply("starttls.syntax")
+	}
+	if err := conn.Reply("starttls.ready"); err != nil {
+		return err
+	}
+	if err := conn.Flush(); err != nil {
+		return err
+	}
+	tlsConn := tls.Server(conn.handler.conn, config)
+	err := tlsConn.Handshake()
+	conn.Config().Metrics.handshake(err)
+	if err != nil {
+		conn.LogSecurityEvent(EventTLSFailure, "error", err.Error())
+		return err
+	}
+	conn.handler.conn = tlsConn
+	conn.setReader(tlsConn)
+	conn.setWriter(tlsConn)
+	st.setTLS(tlsConn.ConnectionState())
+	st.Hello = ""
+	st.ClientName = ""
+	st.Username = ""
+	st.Reset()
+	return nil
+}
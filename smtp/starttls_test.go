@@ -0,0 +1,173 @@
+package smtp
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	netsmtp "net/smtp"
+	"strings"
+	"testing"
+)
+
+// serveTLS runs a handler with STARTTLS enabled for a connection on the
+// listener and sends the states it accepts.
+func serveTLS(lsnr net.Listener, cert tls.Certificate) <-chan *SMTPState {
+	accepted := make(chan *SMTPState, 1)
+	go func() {
+		conn, err := lsnr.Accept()
+		if err != nil {
+			close(accepted)
+			return
+		}
+		h := NewSMTPHandler(conn, func(st *SMTPState) error {
+			x := *st
+			accepted <- &x
+			return nil
+		})
+		h.Config.ServerName = "mx.example.com"
+		h.Config.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+		h.Run()
+	}()
+	return accepted
+}
+
+func TestStartTLS(t *testing.T) {
+	cert, pool := testCertificate(t, "mx.example.com")
+	lsnr, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip(err)
+	}
+	defer lsnr.Close()
+	accepted := serveTLS(lsnr, cert)
+
+	c, err := netsmtp.Dial(lsnr.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := c.Hello("localhost"); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := c.Extension("REQUIRETLS"); ok {
+		t.Errorf("unexpected REQUIRETLS before STARTTLS")
+	}
+	if err := c.StartTLS(&tls.Config{ServerName: "mx.example.com", RootCAs: pool}); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		t.Errorf("unexpected STARTTLS after STARTTLS")
+	}
+	if err := mailWithParams(c, "foo@example.net", " REQUIRETLS"); err != nil {
+		t.Fatal(err)
+	}
+	c.Rcpt("user1@example.com")
+	body := "Subject: TLS\r\n\r\nHello\r\n"
+	id, _ := c.Text.Cmd("BDAT %d LAST", len(body))
+	c.Text.W.WriteString(body)
+	c.Text.W.Flush()
+	c.Text.StartResponse(id)
+	if _, _, err := c.Text.ReadResponse(250); err != nil {
+		t.Fatal(err)
+	}
+	c.Text.EndResponse(id)
+	c.Quit()
+	st := <-accepted
+	if st == nil || st.TLS == nil || !st.RequireTLS {
+		t.Errorf("unexpected state: %v", st)
+	}
+}
+
+func TestRequireTLSWithoutTLS(t *testing.T) {
+	conn := NewMockConn([]byte("EHLO localhost\r\n" +
+		"MAIL FROM: <foo@example.net> REQUIRETLS\r\n" +
+		"STARTTLS foo\r\n" +
+		"QUIT\r\n"))
+	h := NewSMTPHandler(conn, nil)
+	h.Config.TLSConfig = &tls.Config{}
+	h.Run()
+	expected := "220 250 530 501 221"
+	if actual := replyCodes(conn.CloneOutputBuffer()); actual != expected {
+		t.Errorf("expected: %s, actual: %s", expected, actual)
+	}
+	if !strings.Contains(string(conn.CloneOutputBuffer()), "250-STARTTLS\r\n") {
+		t.Errorf("expected STARTTLS: %s", conn.CloneOutputBuffer())
+	}
+}
+
+func TestTLSRequiredHeader(t *testing.T) {
+	var optional bool
+	conn := NewMockConn([]byte("EHLO localhost\r\n" +
+		"MAIL FROM: <foo@example.net>\r\n" +
+		"RCPT TO: <user1@example.com>\r\n" +
+		"DATA\r\n" +
+		"TLS-Required: No\r\n" +
+		"\r\n" +
+		"Hello\r\n" +
+		".\r\n" +
+		"QUIT\r\n"))
+	h := NewSMTPHandler(conn, func(st *SMTPState) error {
+		optional = st.TLSOptional
+		return nil
+	})
+	h.Run()
+	if !optional {
+		t.Errorf("expected TLSOptional")
+	}
+}
+
+func TestRelayRequireTLS(t *testing.T) {
+	cert, pool := testCertificate(t, "localhost")
+	lsnr, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip(err)
+	}
+	defer lsnr.Close()
+	_, port, _ := net.SplitHostPort(lsnr.Addr().String())
+	st := &SMTPState{ReturnTo: "foo@example.net", Recipients: []string{"user1@example.com"}, RequireTLS: true}
+	st.SetContent([]byte("Hello\r\n"))
+
+	router := NewRouter("localhost:" + port)
+	router.TLSConfig = &tls.Config{RootCAs: pool}
+	received := serveUpstream(lsnr, &cert, "REQUIRETLS")
+	if err := router.Send(st); err != nil {
+		t.Fatal(err)
+	}
+	expected := "TLS\r\nMAIL FROM:<foo@example.net> REQUIRETLS\r\n"
+	if actual := <-received; !strings.HasPrefix(actual, expected) {
+		t.Errorf("expected: %q, actual: %q", expected, actual)
+	}
+
+	// the upstream offers STARTTLS but not REQUIRETLS
+	received = serveUpstream(lsnr, &cert)
+	if err := router.Send(st); !errors.Is(err, ErrRequireTLS) {
+		t.Errorf("expected: %v, actual: %v", ErrRequireTLS, err)
+	}
+	<-received
+}
+
+func TestAuthRequiresTLS(t *testing.T) {
+	conn := NewMockConn([]byte("EHLO localhost\r\n" +
+		"AUTH PLAIN AGZvbwBiYXI=\r\n" +
+		"QUIT\r\n"))
+	h := NewSMTPHandler(conn, nil)
+	h.Config.TLSConfig = &tls.Config{}
+	h.Config.AuthRequiresTLS = true
+	h.Config.Authenticate = func(username, password string) bool { return true }
+	h.Run()
+	expected := "220 250 538 221"
+	if actual := replyCodes(conn.CloneOutputBuffer()); actual != expected {
+		t.Errorf("expected: %s, actual: %s", expected, actual)
+	}
+	if strings.Contains(string(conn.CloneOutputBuffer()), "AUTH PLAIN") {
+		t.Errorf("unexpected AUTH: %s", conn.CloneOutputBuffer())
+	}
+
+	conn = NewMockConn([]byte("EHLO localhost\r\nQUIT\r\n"))
+	h = NewSMTPHandler(conn, nil)
+	h.Config.TLSConfig = &tls.Config{}
+	h.Config.Authenticate = func(username, password string) bool { return true }
+	h.Run()
+	if !strings.Contains(string(conn.CloneOutputBuffer()), "250-AUTH PLAIN\r\n") {
+		t.Errorf("expected AUTH without the option: %s", conn.CloneOutputBuffer())
+	}
+}
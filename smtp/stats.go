@@ -0,0 +1,185 @@
+package smtp
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Stats keeps per-second statistics of accepted messages and replies for
+// Retention, to be summarized over a rolling window.
+type Stats struct {
+	Retention time.Duration
+
+	// Clock tells the end of the windows summarized, and should be the
+	// Clock of the sessions. The system clock is used if nil.
+	Clock Clock
+
+	mtx     sync.Mutex
+	buckets []statsBucket
+}
+
+type statsBucket struct {
+	second     int64
+	messages   int64
+	bytes      int64
+	senders    map[string]int
+	recipients map[string]int
+	replies    map[string]int
+}
+
+func NewStats(retention time.Duration) *Stats {
+	n := int(retention / time.Second)
+	if n < 1 {
+		n = 1
+	}
+	return &Stats{Retention: retention, buckets: make([]statsBucket, n)}
+}
+
+// bucket returns the bucket of the second, clearing it if it was used
+// for an earlier second. It must be called with mtx held.
+func (s *Stats) bucket(now time.Time) *statsBucket {
+	sec := now.Unix()
+	b := &s.buckets[int(sec%int64(len(s.buckets)))]
+	if b.second != sec {
+		*b = statsBucket{
+			second:     sec,
+			senders:    make(map[string]int),
+			recipients: make(map[string]int),
+			replies:    make(map[string]int),
+		}
+	}
+	return b
+}
+
+func (s *Stats) message(from string, recipients []string, size int64, now time.Time) {
+	if s == nil {
+		return
+	}
+	if len(from) == 0 {
+		from = "<>"
+	}
+	defer s.mtx.Unlock()
+	s.mtx.Lock()
+	b := s.bucket(now)
+	b.messages++
+	b.bytes += size
+	b.senders[from]++
+	for _, x := range recipients {
+		b.recipients[x]++
+	}
+}
+
+func (s *Stats) reply(reply string, now time.Time) {
+	if s == nil || len(reply) < 3 {
+		return
+	}
+	defer s.mtx.Unlock()
+	s.mtx.Lock()
+	s.bucket(now).replies[reply[:3]]++
+}
+
+type StatsSummary struct {
+	Window            float64        `json:"window_seconds"`
+	Messages          int64          `json:"messages"`
+	Bytes             int64          `json:"bytes"`
+	MessagesPerSecond float64        `json:"messages_per_second"`
+	BytesPerSecond    float64        `json:"bytes_per_second"`
+	AverageSize       float64        `json:"average_message_size"`
+	TopSenders        []StatsCount   `json:"top_senders"`
+	TopRecipients     []StatsCount   `json:"top_recipients"`
+	Replies           map[string]int `json:"replies"`
+}
+
+type StatsCount struct {
+	Address string `json:"address"`
+	Count   int    `json:"count"`
+}
+
+// Summary summarizes the last window, up to Retention, with the top
+// senders and recipients.
+func (s *Stats) Summary(window time.Duration, top int) StatsSummary {
+	return s.summary(window, top, clockNow(s.Clock))
+}
+
+func (s *Stats) summary(window time.Duration, top int, now time.Time) StatsSummary {
+	n := int64(window / time.Second)
+	if n < 1 {
+		n = 1
+	}
+	if n > int64(len(s.buckets)) {
+		n = int64(len(s.buckets))
+	}
+	sum := StatsSummary{Window: float64(n), Replies: make(map[string]int)}
+	senders := make(map[string]int)
+	recipients := make(map[string]int)
+	s.mtx.Lock()
+	for _, b := range s.buckets {
+		if b.second <= now.Unix()-n || b.second > now.Unix() {
+			continue
+		}
+		sum.Messages += b.messages
+		sum.Bytes += b.bytes
+		for k, v := range b.senders {
+			senders[k] += v
+		}
+		for k, v := range b.recipients {
+			recipients[k] += v
+		}
+		for k, v := range b.replies {
+			sum.Replies[k] += v
+		}
+	}
+	s.mtx.Unlock()
+	sum.MessagesPerSecond = float64(sum.Messages) / sum.Window
+	sum.BytesPerSecond = float64(sum.Bytes) / sum.Window
+	if sum.Messages > 0 {
+		sum.AverageSize = float64(sum.Bytes) / float64(sum.Messages)
+	}
+	sum.TopSenders = topCounts(senders, top)
+	sum.TopRecipients = topCounts(recipients, top)
+	return sum
+}
+
+func topCounts(counts map[string]int, top int) []StatsCount {
+	xs := make([]StatsCount, 0, len(counts))
+	for k, v := range counts {
+		xs = append(xs, StatsCount{k, v})
+	}
+	sort.Slice(xs, func(i, j int) bool {
+		if xs[i].Count != xs[j].Count {
+			return xs[i].Count > xs[j].Count
+		}
+		return xs[i].Address < xs[j].Address
+	})
+	if len(xs) > top {
+		xs = xs[:top]
+	}
+	return xs
+}
+
+// ServeHTTP answers the summary as JSON, over the window and with the
+// number of top addresses given by the query parameters, e.g.
+// ?window=5m&top=10, which default to 1m and 10.
+func (s *Stats) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	window, top := time.Minute, 10
+	if v := r.URL.Query().Get("window"); len(v) > 0 {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			http.Error(w, "invalid window", http.StatusBadRequest)
+			return
+		}
+		window = d
+	}
+	if v := r.URL.Query().Get("top"); len(v) > 0 {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			http.Error(w, "invalid top", http.StatusBadRequest)
+			return
+		}
+		top = n
+	}
+	writeJSON(w, http.StatusOK, s.Summary(window, top))
+}
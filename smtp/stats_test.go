@@ -0,0 +1,51 @@
+package smtp
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestStats(t *testing.T) {
+	s := NewStats(time.Hour)
+	now := time.Unix(1700000000, 0)
+	s.message("foo@example.net", []string{"user1@example.com", "user2@example.com"}, 1000, now.Add(-2*time.Minute))
+	s.message("foo@example.net", []string{"user1@example.com"}, 3000, now.Add(-30*time.Second))
+	s.message("", []string{"user1@example.com"}, 2000, now)
+	s.reply("250 2.0.0 OK", now)
+	s.reply("550 5.1.1 Unknown user", now)
+	s.reply("250 OK", now.Add(-time.Second))
+
+	sum := s.summary(time.Minute, 1, now)
+	expected := "2 5000 2500 [{<> 1}] [{user1@example.com 2}] map[250:2 550:1]"
+	actual := fmt.Sprint(sum.Messages, sum.Bytes, sum.AverageSize, sum.TopSenders, sum.TopRecipients, sum.Replies)
+	if actual != expected {
+		t.Errorf("expected: %s, actual: %s", expected, actual)
+	}
+	sum = s.summary(5*time.Minute, 10, now)
+	if sum.Messages != 3 || sum.MessagesPerSecond != 0.01 || len(sum.TopRecipients) != 2 {
+		t.Errorf("unexpected summary: %+v", sum)
+	}
+	// the bucket of an hour ago is reused
+	s.message("bar@example.net", nil, 100, now.Add(time.Hour-2*time.Minute))
+	if sum := s.summary(5*time.Minute, 10, now); sum.Messages != 2 {
+		t.Errorf("unexpected messages: %d", sum.Messages)
+	}
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/stats?window=2h&top=3", nil))
+	var x StatsSummary
+	if err := json.NewDecoder(w.Body).Decode(&x); err != nil {
+		t.Fatal(err)
+	}
+	if x.Window != 3600 {
+		t.Errorf("expected the window up to the retention: %v", x.Window)
+	}
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/stats?window=x", nil))
+	if w.Code != 400 {
+		t.Errorf("expected: 400, actual: %d", w.Code)
+	}
+}
@@ -0,0 +1,58 @@
+package smtp
+
+import (
+	"io"
+	"net"
+	"time"
+)
+
+type stdioConn struct {
+	r io.Reader
+	w io.Writer
+}
+
+// NewStdioConn returns a connection reading from r and writing to w, e.g.
+// the standard input and output of a process run by inetd or as an SSH
+// forced command. It has no addresses and ignores deadlines.
+func NewStdioConn(r io.Reader, w io.Writer) net.Conn {
+	return &stdioConn{r, w}
+}
+
+func (c *stdioConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *stdioConn) Write(b []byte) (int, error) {
+	return c.w.Write(b)
+}
+
+// Close closes the reader and the writer if they are closers.
+func (c *stdioConn) Close() error {
+	if x, ok := c.r.(io.Closer); ok {
+		x.Close()
+	}
+	if x, ok := c.w.(io.Closer); ok {
+		return x.Close()
+	}
+	return nil
+}
+
+func (c *stdioConn) LocalAddr() net.Addr {
+	return nil
+}
+
+func (c *stdioConn) RemoteAddr() net.Addr {
+	return nil
+}
+
+func (c *stdioConn) SetDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *stdioConn) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *stdioConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
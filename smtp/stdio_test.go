@@ -0,0 +1,32 @@
+package smtp
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestStdioConn(t *testing.T) {
+	in := strings.NewReader("EHLO localhost\r\n" +
+		"MAIL FROM:<foo@example.net>\r\n" +
+		"RCPT TO:<user1@example.com>\r\n" +
+		"BDAT 7 LAST\r\nHello\r\n" +
+		"QUIT\r\n")
+	var out bytes.Buffer
+	var received *SMTPState
+	h := NewSMTPHandler(NewStdioConn(in, &out), func(st *SMTPState) error {
+		x := *st
+		received = &x
+		return nil
+	})
+	h.Config.AddReceived = true
+	h.Run()
+	expected := "220 250 250 250 250 221"
+	if actual := replyCodes(out.Bytes()); actual != expected {
+		t.Errorf("expected: %s, actual: %s", expected, actual)
+	}
+	if received == nil || len(received.RemoteAddr) > 0 ||
+		!strings.HasPrefix(strings.Join(received.Headers, "\r\n"), "Received: from localhost\r\n") {
+		t.Errorf("unexpected state: %v", received)
+	}
+}
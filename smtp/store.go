@@ -0,0 +1,265 @@
+package smtp
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MessageStore keeps accepted messages in a directory, each as an envelope
+// file "<id>.json" and the message "<id>.eml", so they can be fetched by
+// mail clients. It is a Sink. The envelopes are indexed in memory once
+// listed, assuming the directory is only changed through the store.
+type MessageStore struct {
+	Dir string
+
+	// Cipher encrypts the messages stored if set.
+	Cipher *MessageCipher
+
+	// Tenancy partitions the messages by TenancyUser or TenancyDomain if
+	// set, so each mailbox holds the messages of its tenant only.
+	Tenancy string
+
+	// Dedup detects duplicates of the messages stored within DedupWindow,
+	// or ever if zero, by DedupMessageID or DedupContent if set. The
+	// duplicates are counted on the message stored first, or stored with
+	// the DuplicateTag if DedupTag is set.
+	Dedup       string
+	DedupWindow time.Duration
+	DedupTag    bool
+
+	// Clock tells the time of receipt, which the DedupWindow counts from.
+	// The system clock is used if nil.
+	Clock Clock
+
+	// mtx serializes the updates of envelopes and the index.
+	mtx   sync.Mutex
+	index *messageIndex
+}
+
+type StoredMessage struct {
+	ID         string    `json:"id"`
+	ReturnTo   string    `json:"return_to"`
+	Recipients []string  `json:"recipients"`
+	Subject    string    `json:"subject,omitempty"`
+	Size       int64     `json:"size"`
+	Received   time.Time `json:"received"`
+
+	Attachments bool `json:"attachments,omitempty"`
+
+	// Warnings are the problems of the message found by LintMessage.
+	Warnings []string `json:"warnings,omitempty"`
+
+	// Tags are those of the transaction, e.g. by the policy or hooks,
+	// and those added by Tag.
+	Tags []string `json:"tags,omitempty"`
+
+	// Tenants are those the message belongs to by the tenancy.
+	Tenants []string `json:"tenants,omitempty"`
+
+	// DedupKey is the key to detect duplicates of the message, Duplicates
+	// the number of duplicates collapsed into it, and DuplicateOf the ID
+	// of the message it is a duplicate of.
+	DedupKey    string `json:"dedup_key,omitempty"`
+	Duplicates  int    `json:"duplicates,omitempty"`
+	DuplicateOf string `json:"duplicate_of,omitempty"`
+
+	// Connection is the transport the message was received over.
+	Connection *ConnectionInfo `json:"connection,omitempty"`
+}
+
+const (
+	// TenancyUser partitions the messages by the authenticated user who
+	// sent them. Messages sent without AUTH belong to no tenant.
+	TenancyUser = "user"
+	// TenancyDomain partitions the messages by the domains of the
+	// recipients.
+	TenancyDomain = "domain"
+)
+
+// tenants returns the tenants of the transaction by the tenancy.
+func (s *MessageStore) tenants(st *SMTPState) []string {
+	var xs []string
+	switch s.Tenancy {
+	case TenancyUser:
+		if len(st.Username) > 0 {
+			xs = append(xs, strings.ToLower(st.Username))
+		}
+	case TenancyDomain:
+		for i := range st.Recipients {
+			if d := recipientDomain(st, i); len(d) > 0 && !containsFold(xs, d) {
+				xs = append(xs, d)
+			}
+		}
+	}
+	return xs
+}
+
+// Tenant returns the tenant of an authenticated identity, i.e. the user,
+// or the domain of the user in the form of an address for TenancyDomain.
+func (s *MessageStore) Tenant(identity string) string {
+	if i := strings.LastIndexByte(identity, '@'); i >= 0 && s.Tenancy == TenancyDomain {
+		return strings.ToLower(identity[i+1:])
+	}
+	return strings.ToLower(identity)
+}
+
+func NewMessageStore(dir string) (*MessageStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &MessageStore{Dir: dir}, nil
+}
+
+func (s *MessageStore) path(id, ext string) string {
+	return filepath.Join(s.Dir, filepath.Base(id)+ext)
+}
+
+func (s *MessageStore) Publish(st *SMTPState) error {
+	_, err := s.Put(st)
+	return err
+}
+
+// Put stores the message of the transaction and returns its ID, the queue
+// ID unless already stored, or the ID of the message stored first if
+// collapsed as a duplicate.
+func (s *MessageStore) Put(st *SMTPState) (string, error) {
+	key := s.dedupKey(st)
+	var orig StoredMessage
+	if len(key) > 0 {
+		s.mtx.Lock()
+		var ok bool
+		orig, ok = s.original(key, clockNow(s.Clock))
+		if ok && !s.DedupTag {
+			err := s.collapse(orig)
+			s.mtx.Unlock()
+			return orig.ID, err
+		}
+		s.mtx.Unlock()
+	}
+	id := st.QueueID
+	if _, err := os.Stat(s.path(id, ".eml")); len(id) == 0 || err == nil {
+		id = newQueueID(clockNow(s.Clock))
+	}
+	f, err := createMessage(s.Cipher, s.path(id, ".eml"))
+	if err != nil {
+		return "", err
+	}
+	n, err := io.Copy(f, st.messageReader())
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(s.path(id, ".eml"))
+		return "", err
+	}
+	subject, _ := headerValue(st.Headers, "Subject")
+	msg := StoredMessage{
+		ID:         id,
+		ReturnTo:   st.ReturnTo,
+		Recipients: st.Recipients,
+		Subject:    subject,
+		Size:       n,
+		Received:   clockNow(s.Clock),
+
+		Attachments: hasAttachments(st),
+		Warnings:    LintMessage(st),
+		Tags:        st.Tags,
+		Tenants:     s.tenants(st),
+		DedupKey:    key,
+		DuplicateOf: orig.ID,
+		Connection:  st.connection(),
+	}
+	if len(msg.DuplicateOf) > 0 {
+		msg.Tags = append(append([]string{}, msg.Tags...), DuplicateTag)
+	}
+	data, err := json.Marshal(msg)
+	if err == nil {
+		err = os.WriteFile(s.path(id, ".json"), data, 0600)
+	}
+	if err != nil {
+		os.Remove(s.path(id, ".eml"))
+		return "", err
+	}
+	s.indexAdd(msg)
+	return id, nil
+}
+
+func (s *MessageStore) Get(id string) (StoredMessage, error) {
+	var msg StoredMessage
+	data, err := os.ReadFile(s.path(id, ".json"))
+	if err != nil {
+		return msg, err
+	}
+	err = json.Unmarshal(data, &msg)
+	return msg, err
+}
+
+// List returns the messages of the mailbox in the order of arrival. With
+// a tenancy, the mailbox of an authenticated identity holds the messages
+// of its tenant. Otherwise a mailbox in the form of an address holds the
+// messages addressed to it; any other name, e.g. an empty string, holds
+// every message.
+func (s *MessageStore) List(mailbox string) ([]StoredMessage, error) {
+	defer s.mtx.Unlock()
+	s.mtx.Lock()
+	idx, err := s.loadIndex()
+	if err != nil {
+		return nil, err
+	}
+	if len(s.Tenancy) > 0 {
+		return idx.messages(idx.tenants[s.Tenant(mailbox)]), nil
+	}
+	if strings.Contains(mailbox, "@") {
+		return idx.messages(idx.to[strings.ToLower(mailbox)]), nil
+	}
+	return idx.messages(idx.ids), nil
+}
+
+// listFiles reads every envelope file in the order of arrival.
+func (s *MessageStore) listFiles() ([]StoredMessage, error) {
+	paths, err := filepath.Glob(filepath.Join(s.Dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths)
+	xs := make([]StoredMessage, 0, len(paths))
+	for _, x := range paths {
+		msg, err := s.Get(strings.TrimSuffix(filepath.Base(x), ".json"))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		xs = append(xs, msg)
+	}
+	return xs, nil
+}
+
+// Entries returns the messages for the retention.
+func (s *MessageStore) Entries() ([]StoreEntry, error) {
+	return storeEntries(s.Dir)
+}
+
+// Open returns the raw message.
+func (s *MessageStore) Open(id string) (io.ReadCloser, error) {
+	return openMessage(s.Cipher, s.path(id, ".eml"))
+}
+
+// Delete removes the message. Deleting a message which no longer exists
+// is not an error, as mail clients may delete it concurrently.
+func (s *MessageStore) Delete(id string) error {
+	for _, ext := range []string{".json", ".eml"} {
+		if err := os.Remove(s.path(id, ext)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	s.indexRemove(id)
+	return nil
+}
@@ -0,0 +1,78 @@
+package smtp
+
+import (
+	"io"
+	"testing"
+)
+
+func storeMessage(t *testing.T, s *MessageStore, rcpts []string, body string) string {
+	st := &SMTPState{}
+	st.Reset()
+	st.ReturnTo = "foo@example.net"
+	st.Recipients = rcpts
+	st.Headers = []string{"Subject: Hello"}
+	st.SetContent([]byte(body))
+	defer st.Close()
+	id, err := s.Put(st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+func TestMessageStore(t *testing.T) {
+	s, err := NewMessageStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	id1 := storeMessage(t, s, []string{"user1@example.net"}, "one\r\n")
+	id2 := storeMessage(t, s, []string{"user2@example.net", "user1@example.net"}, "two\r\n")
+	storeMessage(t, s, []string{"user3@example.net"}, "three\r\n")
+
+	for _, fixture := range []struct {
+		mailbox  string
+		expected int
+	}{
+		{"", 3},
+		{"user", 3},
+		{"USER1@example.net", 2},
+		{"user3@example.net", 1},
+		{"user4@example.net", 0},
+	} {
+		xs, err := s.List(fixture.mailbox)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(xs) != fixture.expected {
+			t.Errorf("expected: %d, actual: %d (%s)", fixture.expected, len(xs), fixture.mailbox)
+		}
+	}
+
+	msg, err := s.Get(id1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "Subject: Hello\r\n\r\none\r\n"
+	if msg.Subject != "Hello" || msg.Size != int64(len(expected)) {
+		t.Errorf("unexpected message: %v", msg)
+	}
+	f, err := s.Open(id1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := io.ReadAll(f)
+	f.Close()
+	if string(b) != expected {
+		t.Errorf("expected: %q, actual: %q", expected, b)
+	}
+
+	if err := s.Delete(id2); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Delete(id2); err != nil {
+		t.Errorf("expected: nil, actual: %v", err)
+	}
+	if xs, _ := s.List("user1@example.net"); len(xs) != 1 || xs[0].ID != id1 {
+		t.Errorf("unexpected list: %v", xs)
+	}
+}
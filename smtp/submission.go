@@ -0,0 +1,32 @@
+package smtp
+
+import "strings"
+
+// commands accepted before STARTTLS when RequireStartTLS is set
+var preTLSCommands = map[string]bool{
+	"EHLO": true, "HELO": true, "STARTTLS": true, "NOOP": true, "RSET": true, "QUIT": true,
+}
+
+// senderMatchesLogin reports whether the sender belongs to the user, i.e.
+// the address is the username, or the local part is the username without
+// a domain.
+func senderMatchesLogin(sender Address, username string) bool {
+	if len(username) == 0 || len(sender.LocalPart) == 0 {
+		return false
+	}
+	if strings.Contains(username, "@") {
+		return strings.EqualFold(sender.String(), username)
+	}
+	return strings.EqualFold(sender.LocalPart, username)
+}
+
+// submission sets up the configuration for message submission (RFC
+// 6409): STARTTLS before anything else, AUTH before MAIL, senders owned
+// by the user and the missing Date and Message-ID headers added.
+func (config *SMTPConfig) submission() {
+	config.RequireStartTLS = true
+	config.RequireAuth = true
+	config.AuthRequiresTLS = true
+	config.SenderMatchesLogin = true
+	config.FixupHeaders = true
+}
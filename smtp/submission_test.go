@@ -0,0 +1,126 @@
+package smtp
+
+import (
+	"crypto/tls"
+	netsmtp "net/smtp"
+	"net/textproto"
+	"testing"
+)
+
+func errorCode(err error) int {
+	if x, ok := err.(*textproto.Error); ok {
+		return x.Code
+	}
+	return 0
+}
+
+func TestSenderMatchesLogin(t *testing.T) {
+	for _, x := range []struct {
+		sender   string
+		username string
+		expected bool
+	}{
+		{"foo@example.net", "foo@example.net", true},
+		{"Foo@Example.NET", "foo@example.net", true},
+		{"foo@example.org", "foo@example.net", false},
+		{"foo@example.org", "foo", true},
+		{"bar@example.org", "foo", false},
+		{"", "foo", false},
+		{"foo@example.net", "", false},
+	} {
+		var sender Address
+		if len(x.sender) > 0 {
+			sender, _ = ParseAddress(x.sender)
+		}
+		if actual := senderMatchesLogin(sender, x.username); actual != x.expected {
+			t.Errorf("%s %s expected: %v, actual: %v", x.sender, x.username, x.expected, actual)
+		}
+	}
+}
+
+func TestSubmission(t *testing.T) {
+	cert, pool := testCertificate(t, "mx.example.com")
+	lc := ListenerConfig{Name: "submission", Address: "127.0.0.1:0", Submission: true}
+	if _, err := lc.Listen(lc.Config(&SMTPConfig{})); err == nil {
+		t.Errorf("expected an error without a certificate")
+	}
+	config := lc.Config(&SMTPConfig{
+		ServerName: "mx.example.com",
+		TLSConfig:  &tls.Config{Certificates: []tls.Certificate{cert}},
+		Authenticate: func(username, password string) bool {
+			return username == "foo@example.net" && password == "secret"
+		},
+	})
+	lsnr, err := lc.Listen(config)
+	if err != nil {
+		t.Skip(err)
+	}
+	defer lsnr.Close()
+	accepted := make(chan *SMTPState, 1)
+	go func() {
+		conn, err := lsnr.Accept()
+		if err != nil {
+			close(accepted)
+			return
+		}
+		h := NewSMTPHandler(conn, func(st *SMTPState) error {
+			x := *st
+			accepted <- &x
+			return nil
+		})
+		h.Config = config
+		h.Run()
+	}()
+
+	c, err := netsmtp.Dial(lsnr.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := c.Hello("localhost"); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := c.Extension("AUTH"); ok {
+		t.Errorf("unexpected AUTH before STARTTLS")
+	}
+	if err := c.Mail("foo@example.net"); errorCode(err) != 530 {
+		t.Errorf("expected STARTTLS to be required: %v", err)
+	}
+	if err := c.StartTLS(&tls.Config{ServerName: "mx.example.com", RootCAs: pool}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Mail("foo@example.net"); errorCode(err) != 530 {
+		t.Errorf("expected AUTH to be required: %v", err)
+	}
+	c.Reset()
+	if err := c.Auth(netsmtp.PlainAuth("", "foo@example.net", "secret", "127.0.0.1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Mail("bar@example.net"); errorCode(err) != 553 {
+		t.Errorf("expected the sender to be rejected: %v", err)
+	}
+	if err := c.Mail("foo@example.net"); err != nil {
+		t.Fatal(err)
+	}
+	c.Rcpt("user1@example.com")
+	body := "Subject: Hello\r\n\r\nHello\r\n"
+	id, _ := c.Text.Cmd("BDAT %d LAST", len(body))
+	c.Text.W.WriteString(body)
+	c.Text.W.Flush()
+	c.Text.StartResponse(id)
+	if _, _, err := c.Text.ReadResponse(250); err != nil {
+		t.Fatal(err)
+	}
+	c.Text.EndResponse(id)
+	c.Quit()
+	st := <-accepted
+	if st == nil || st.Username != "foo@example.net" {
+		t.Fatalf("unexpected state: %v", st)
+	}
+	if _, ok := headerValue(st.Headers, "Message-ID"); !ok {
+		t.Errorf("expected Message-ID: %v", st.Headers)
+	}
+	if _, ok := headerValue(st.Headers, "Date"); !ok {
+		t.Errorf("expected Date: %v", st.Headers)
+	}
+}
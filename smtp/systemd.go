@@ -0,0 +1,57 @@
+package smtp
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ActivatedListener is a socket passed by the service manager. Name is
+// its FileDescriptorName in the systemd socket unit.
+type ActivatedListener struct {
+	net.Listener
+	Name string
+}
+
+// SystemdListeners returns the sockets passed with systemd socket
+// activation (sd_listen_fds), or none if the process is not activated. The
+// environment variables are unset so child processes do not inherit them.
+func SystemdListeners() ([]ActivatedListener, error) {
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+	defer os.Unsetenv("LISTEN_FDNAMES")
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return nil, nil
+	}
+	return fileListeners(3, n, strings.Split(os.Getenv("LISTEN_FDNAMES"), ":"))
+}
+
+// fileListeners returns the listeners of the n file descriptors from
+// start, closing the descriptors which are duplicated by the listeners.
+func fileListeners(start, n int, names []string) ([]ActivatedListener, error) {
+	listeners := make([]ActivatedListener, 0, n)
+	for i := 0; i < n; i++ {
+		name := ""
+		if i < len(names) {
+			name = names[i]
+		}
+		f := os.NewFile(uintptr(start+i), name)
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			for _, x := range listeners {
+				x.Close()
+			}
+			return nil, fmt.Errorf("systemd: fd %d: %v", start+i, err)
+		}
+		listeners = append(listeners, ActivatedListener{l, name})
+	}
+	return listeners, nil
+}
@@ -0,0 +1,55 @@
+//go:build !windows && !plan9
+
+package smtp
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+	"testing"
+)
+
+func TestSystemdListeners(t *testing.T) {
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()+1))
+	os.Setenv("LISTEN_FDS", "1")
+	if xs, err := SystemdListeners(); err != nil || len(xs) != 0 {
+		t.Errorf("unexpected listeners of another process: %v, %v", xs, err)
+	}
+	if len(os.Getenv("LISTEN_FDS")) > 0 {
+		t.Errorf("expected LISTEN_FDS to be unset")
+	}
+
+	lsnr, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip(err)
+	}
+	defer lsnr.Close()
+	f, err := lsnr.(*net.TCPListener).File()
+	if err != nil {
+		t.Skip(err)
+	}
+	fd, err := syscall.Dup(int(f.Fd()))
+	f.Close()
+	if err != nil {
+		t.Skip(err)
+	}
+	xs, err := fileListeners(fd, 1, []string{"smtp"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer xs[0].Close()
+	if expected, actual := "smtp "+lsnr.Addr().String(), xs[0].Name+" "+xs[0].Addr().String(); expected != actual {
+		t.Errorf("expected: %s, actual: %s", expected, actual)
+	}
+	go func() {
+		if conn, err := net.Dial("tcp", lsnr.Addr().String()); err == nil {
+			conn.Close()
+		}
+	}()
+	conn, err := xs[0].Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+}
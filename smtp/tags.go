@@ -0,0 +1,99 @@
+package smtp
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"strings"
+)
+
+var ErrInvalidTag = errors.New("smtp: invalid tag")
+
+// validTag reports whether a tag is of letters, digits and "-_.:/".
+func validTag(tag string) bool {
+	if len(tag) == 0 || len(tag) > 64 {
+		return false
+	}
+	for _, c := range tag {
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || strings.ContainsRune("-_.:/", c)) {
+			return false
+		}
+	}
+	return true
+}
+
+// Tag adds the tags to the stored message and removes the others given,
+// and returns the message updated.
+func (s *MessageStore) Tag(id string, add, remove []string) (StoredMessage, error) {
+	for _, x := range append(append([]string{}, add...), remove...) {
+		if !validTag(x) {
+			return StoredMessage{}, ErrInvalidTag
+		}
+	}
+	defer s.mtx.Unlock()
+	s.mtx.Lock()
+	msg, err := s.Get(id)
+	if err != nil {
+		return msg, err
+	}
+	tags := make([]string, 0, len(msg.Tags)+len(add))
+	for _, x := range append(msg.Tags, add...) {
+		if !containsFold(tags, x) && !containsFold(remove, x) {
+			tags = append(tags, x)
+		}
+	}
+	msg.Tags = tags
+	if err := s.writeEnvelope(msg); err != nil {
+		return msg, err
+	}
+	if s.index != nil {
+		s.index.add(msg)
+	}
+	return msg, nil
+}
+
+// writeEnvelope replaces the envelope file of the message. s.mtx must be
+// held.
+func (s *MessageStore) writeEnvelope(msg StoredMessage) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	tmp := s.path(msg.ID, ".json.tmp")
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path(msg.ID, ".json"))
+}
+
+// TagsHandler adds the tags given by the query parameter tag to the
+// message of the parameter id on PUT, or removes them on DELETE, and
+// replies the message updated as JSON.
+func (s *MessageStore) TagsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		var add, remove []string
+		switch r.Method {
+		case "PUT":
+			add = q["tag"]
+		case "DELETE":
+			remove = q["tag"]
+		default:
+			w.Header().Set("Allow", "PUT, DELETE")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		msg, err := s.Tag(q.Get("id"), add, remove)
+		switch {
+		case err == ErrInvalidTag:
+			http.Error(w, "invalid tag", http.StatusBadRequest)
+		case os.IsNotExist(err):
+			http.Error(w, "no such message", http.StatusNotFound)
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		default:
+			writeJSON(w, http.StatusOK, msg)
+		}
+	})
+}
@@ -0,0 +1,60 @@
+package smtp
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestTags(t *testing.T) {
+	s, err := NewMessageStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := &SMTPState{ReturnTo: "foo@example.net", Recipients: []string{"user1@example.com"}, Tags: []string{"spam"}}
+	st.SetContent([]byte("Hello\r\n"))
+	id1, _ := s.Put(st)
+	st.Tags = nil
+	id2, _ := s.Put(st)
+
+	msg, err := s.Tag(id2, []string{"welcome-flow", "ci-run-1234"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if actual := strings.Join(msg.Tags, " "); actual != "welcome-flow ci-run-1234" {
+		t.Errorf("expected: welcome-flow ci-run-1234, actual: %s", actual)
+	}
+	if _, err := s.Tag(id1, []string{"bad tag"}, nil); err != ErrInvalidTag {
+		t.Errorf("expected: %v, actual: %v", ErrInvalidTag, err)
+	}
+
+	h := s.TagsHandler()
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("DELETE", "/messages/tags?id="+id2+"&tag=WELCOME-FLOW", nil))
+	json.NewDecoder(w.Body).Decode(&msg)
+	if w.Code != http.StatusOK || strings.Join(msg.Tags, " ") != "ci-run-1234" {
+		t.Errorf("unexpected response: %d, %v", w.Code, msg.Tags)
+	}
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("PUT", "/messages/tags?id="+id1+"&tag=ci-run-1234&tag=spam", nil))
+	json.NewDecoder(w.Body).Decode(&msg)
+	if w.Code != http.StatusOK || strings.Join(msg.Tags, " ") != "spam ci-run-1234" {
+		t.Errorf("unexpected response: %d, %v", w.Code, msg.Tags)
+	}
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("PUT", "/messages/tags?id=none&tag=spam", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected: %d, actual: %d", http.StatusNotFound, w.Code)
+	}
+
+	page, _ := s.Query(MessageQuery{Tags: []string{"ci-run-1234"}})
+	if len(page.Messages) != 2 {
+		t.Errorf("expected 2 messages: %v", page.Messages)
+	}
+	page, _ = s.Query(MessageQuery{Tags: []string{"ci-run-1234", "spam"}})
+	if len(page.Messages) != 1 || page.Messages[0].ID != id1 {
+		t.Errorf("expected the message %s: %v", id1, page.Messages)
+	}
+}
@@ -0,0 +1,85 @@
+package smtp
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestTenancy(t *testing.T) {
+	s, err := NewMessageStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Tenancy = TenancyUser
+	for _, x := range [][]string{
+		{"alice", "user1@example.com"},
+		{"bob", "user1@example.com"},
+		{"Alice", "user2@example.org"},
+		{"", "user3@example.com"},
+	} {
+		st := &SMTPState{Username: x[0], ReturnTo: "foo@example.net", Recipients: []string{x[1]}}
+		st.SetContent([]byte("Hello\r\n"))
+		if _, err := s.Put(st); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the mailboxes of POP3 and IMAP
+	if xs, _ := s.List("alice"); len(xs) != 2 || xs[1].Recipients[0] != "user2@example.org" {
+		t.Errorf("expected the messages of alice: %v", xs)
+	}
+	if xs, _ := s.List("carol"); len(xs) != 0 {
+		t.Errorf("unexpected messages of carol: %v", xs)
+	}
+
+	a := NewAPIAuth()
+	a.AddUser("alice", "p4ss", ScopeRead)
+	a.AddUser("admin", "p4ss", ScopeAdmin)
+	a.AddToken("s3cret", ScopeRead)
+	h := a.Protect(s)
+	list := func(r *http.Request) (int, []string) {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		var page MessagePage
+		json.NewDecoder(w.Body).Decode(&page)
+		xs := make([]string, len(page.Messages))
+		for i, x := range page.Messages {
+			xs[i] = strings.Join(x.Tenants, ",")
+		}
+		return w.Code, xs
+	}
+	r := httptest.NewRequest("GET", "/messages?tenant=bob", nil)
+	r.SetBasicAuth("alice", "p4ss")
+	if code, xs := list(r); code != http.StatusOK || strings.Join(xs, " ") != "alice alice" {
+		t.Errorf("unexpected response: %d, %v", code, xs)
+	}
+	r = httptest.NewRequest("GET", "/messages", nil)
+	r.SetBasicAuth("admin", "p4ss")
+	if _, xs := list(r); len(xs) != 4 {
+		t.Errorf("expected every message: %v", xs)
+	}
+	r = httptest.NewRequest("GET", "/messages?tenant=bob", nil)
+	r.SetBasicAuth("admin", "p4ss")
+	if _, xs := list(r); strings.Join(xs, " ") != "bob" {
+		t.Errorf("expected the messages of bob: %v", xs)
+	}
+	r = httptest.NewRequest("GET", "/messages", nil)
+	r.Header.Set("Authorization", "Bearer s3cret")
+	if code, _ := list(r); code != http.StatusForbidden {
+		t.Errorf("expected: %d, actual: %d", http.StatusForbidden, code)
+	}
+
+	s.Tenancy = TenancyDomain
+	st := &SMTPState{ReturnTo: "foo@example.net", Recipients: []string{"user1@Example.com", "user2@example.org", "user3@example.com"}}
+	st.SetContent([]byte("Hello\r\n"))
+	id, _ := s.Put(st)
+	msg, _ := s.Get(id)
+	if actual := strings.Join(msg.Tenants, " "); actual != "example.com example.org" {
+		t.Errorf("expected: example.com example.org, actual: %s", actual)
+	}
+	if xs, _ := s.List("postmaster@example.org"); len(xs) != 1 || xs[0].ID != id {
+		t.Errorf("expected the message of example.org: %v", xs)
+	}
+}
@@ -0,0 +1,221 @@
+package smtp
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrThrottled is returned when a delivery cannot start within the limits
+// of its destination domain. It is temporary, so queued messages are
+// retried later.
+var ErrThrottled = errors.New("smtp: destination domain throttled")
+
+// DomainLimit limits the relaying to a destination domain: Rate messages
+// per minute and Connections at a time, unlimited if zero. A limit for
+// ".example.net" applies to every subdomain of example.net, and one for
+// "*" to the other domains, each domain counted on its own.
+type DomainLimit struct {
+	Domain      string
+	Rate        int
+	Connections int
+}
+
+// Throttle enforces the limits of destination domains on Router.Send.
+type Throttle struct {
+	// MaxWait is how long a delivery waits for the limits before it fails
+	// with ErrThrottled.
+	MaxWait time.Duration
+
+	// Clock tells the time of deliveries counted against the rates. The
+	// system clock is used if nil.
+	Clock Clock
+
+	mtx     sync.Mutex
+	limits  map[string]DomainLimit
+	domains map[string]*domainUsage
+}
+
+type domainUsage struct {
+	connections int
+	sent        []time.Time
+	released    chan struct{}
+}
+
+func NewThrottle(limits []DomainLimit) *Throttle {
+	t := &Throttle{
+		MaxWait: 30 * time.Second,
+		limits:  make(map[string]DomainLimit),
+		domains: make(map[string]*domainUsage),
+	}
+	for _, x := range limits {
+		t.limits[strings.ToLower(x.Domain)] = x
+	}
+	return t
+}
+
+// ParseDomainLimits reads limits in the form of "domain [option]...", one
+// per line. The options are rate=<messages per minute> and
+// connections=<n>.
+//
+//	example.com   rate=60 connections=2
+//	.example.net  rate=10
+//	*             connections=5
+func ParseDomainLimits(r io.Reader) ([]DomainLimit, error) {
+	limits := make([]DomainLimit, 0)
+	scanner := bufio.NewScanner(r)
+	n := 0
+	for scanner.Scan() {
+		n++
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		xs := strings.Fields(line)
+		limit := DomainLimit{Domain: xs[0]}
+		for _, x := range xs[1:] {
+			kv := strings.SplitN(x, "=", 2)
+			if len(kv) != 2 || (kv[0] != "rate" && kv[0] != "connections") {
+				return nil, fmt.Errorf("line %d: unknown option: %s", n, x)
+			}
+			v, err := strconv.Atoi(kv[1])
+			if err != nil || v < 0 {
+				return nil, fmt.Errorf("line %d: invalid %s: %s", n, kv[0], kv[1])
+			}
+			if kv[0] == "rate" {
+				limit.Rate = v
+			} else {
+				limit.Connections = v
+			}
+		}
+		limits = append(limits, limit)
+	}
+	return limits, scanner.Err()
+}
+
+// Limit returns the limit of the domain.
+func (t *Throttle) Limit(domain string) (DomainLimit, bool) {
+	domain = strings.ToLower(domain)
+	if x, ok := t.limits[domain]; ok {
+		return x, true
+	}
+	for d := domain; ; {
+		i := strings.IndexByte(d, '.')
+		if i < 0 {
+			break
+		}
+		d = d[i+1:]
+		if x, ok := t.limits["."+d]; ok {
+			return x, true
+		}
+	}
+	x, ok := t.limits["*"]
+	return x, ok
+}
+
+// Acquire waits until a delivery to the domain is allowed and returns the
+// function to call when it is done.
+func (t *Throttle) Acquire(domain string) (func(), error) {
+	domain = strings.ToLower(domain)
+	limit, ok := t.Limit(domain)
+	if !ok || (limit.Rate == 0 && limit.Connections == 0) {
+		return func() {}, nil
+	}
+	deadline := clockNow(t.Clock).Add(t.MaxWait)
+	for {
+		now := clockNow(t.Clock)
+		wait, released := t.reserve(domain, limit, now)
+		if wait == 0 {
+			return func() { t.release(domain) }, nil
+		}
+		left := deadline.Sub(now)
+		if left <= 0 {
+			return nil, fmt.Errorf("%w: %s", ErrThrottled, domain)
+		}
+		if wait < 0 || wait > left {
+			wait = left
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-released:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+// reserve counts a delivery to the domain if the limit allows it, and
+// returns 0. Otherwise it returns how long to wait for the rate, or -1 for
+// a connection, and the channel closed when a connection is released.
+func (t *Throttle) reserve(domain string, limit DomainLimit, now time.Time) (time.Duration, <-chan struct{}) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	u, ok := t.domains[domain]
+	if !ok {
+		u = &domainUsage{released: make(chan struct{})}
+		t.domains[domain] = u
+	}
+	for len(u.sent) > 0 && now.Sub(u.sent[0]) >= time.Minute {
+		u.sent = u.sent[1:]
+	}
+	if limit.Connections > 0 && u.connections >= limit.Connections {
+		return -1, u.released
+	}
+	if limit.Rate > 0 && len(u.sent) >= limit.Rate {
+		return u.sent[0].Add(time.Minute).Sub(now), u.released
+	}
+	u.connections++
+	u.sent = append(u.sent, now)
+	return 0, nil
+}
+
+func (t *Throttle) release(domain string) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	u := t.domains[domain]
+	u.connections--
+	close(u.released)
+	u.released = make(chan struct{})
+	for len(u.sent) > 0 && time.Since(u.sent[0]) >= time.Minute {
+		u.sent = u.sent[1:]
+	}
+	if u.connections == 0 && len(u.sent) == 0 {
+		delete(t.domains, domain)
+	}
+}
+
+// acquireAll acquires the domains of the recipients in order, so
+// concurrent deliveries never wait for each other's domains.
+func (t *Throttle) acquireAll(recipients []string) (func(), error) {
+	domains := make([]string, 0)
+	for _, x := range recipients {
+		if i := strings.LastIndex(x, "@"); i >= 0 {
+			domains = append(domains, strings.ToLower(x[i+1:]))
+		}
+	}
+	sort.Strings(domains)
+	releases := make([]func(), 0)
+	releaseAll := func() {
+		for _, f := range releases {
+			f()
+		}
+	}
+	for i, x := range domains {
+		if i > 0 && x == domains[i-1] {
+			continue
+		}
+		release, err := t.Acquire(x)
+		if err != nil {
+			releaseAll()
+			return nil, err
+		}
+		releases = append(releases, release)
+	}
+	return releaseAll, nil
+}
@@ -0,0 +1,106 @@
+package smtp
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseDomainLimits(t *testing.T) {
+	limits, err := ParseDomainLimits(strings.NewReader(`
+# limits
+example.com   rate=60 connections=2
+.example.net  rate=10
+*             connections=5
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	throttle := NewThrottle(limits)
+	for _, fixture := range []struct {
+		domain   string
+		expected string
+	}{
+		{"EXAMPLE.COM", "{example.com 60 2}"},
+		{"mail.example.net", "{.example.net 10 0}"},
+		{"example.org", "{* 0 5}"},
+	} {
+		limit, _ := throttle.Limit(fixture.domain)
+		if actual := fmt.Sprint(limit); actual != fixture.expected {
+			t.Errorf("expected: %s, actual: %s", fixture.expected, actual)
+		}
+	}
+	for _, x := range []string{"example.com rate", "example.com rate=-1", "example.com burst=1"} {
+		if _, err := ParseDomainLimits(strings.NewReader(x)); err == nil {
+			t.Errorf("expected an error: %s", x)
+		}
+	}
+}
+
+func TestThrottle(t *testing.T) {
+	throttle := NewThrottle([]DomainLimit{
+		{Domain: "example.com", Connections: 1},
+		{Domain: "example.net", Rate: 2},
+	})
+	throttle.MaxWait = 50 * time.Millisecond
+
+	release, err := throttle.Acquire("example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := throttle.Acquire("example.com"); !errors.Is(err, ErrThrottled) {
+		t.Errorf("expected: %v, actual: %v", ErrThrottled, err)
+	}
+	if _, err := throttle.Acquire("example.org"); err != nil {
+		t.Errorf("unexpected error for an unlimited domain: %v", err)
+	}
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		release()
+	}()
+	if _, err := throttle.Acquire("example.com"); err != nil {
+		t.Errorf("expected the connection to be released: %v", err)
+	}
+
+	now := time.Now()
+	limit, _ := throttle.Limit("example.net")
+	for i, expected := range []time.Duration{0, 0, 30 * time.Second} {
+		if wait, _ := throttle.reserve("example.net", limit, now.Add(time.Duration(i)*15*time.Second)); wait != expected {
+			t.Errorf("expected: %v, actual: %v", expected, wait)
+		}
+	}
+	if wait, _ := throttle.reserve("example.net", limit, now.Add(time.Minute)); wait != 0 {
+		t.Errorf("expected the rate to be recovered: %v", wait)
+	}
+}
+
+func TestRouterThrottle(t *testing.T) {
+	lsnr, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip(err)
+	}
+	defer lsnr.Close()
+	router := NewRouter(lsnr.Addr().String())
+	router.Throttle = NewThrottle([]DomainLimit{{Domain: "*", Rate: 1}})
+	router.Throttle.MaxWait = 0
+	st := &SMTPState{ReturnTo: "foo@example.net", Recipients: []string{"user1@example.com", "user2@example.com"}}
+	st.SetContent([]byte("Hello\r\n"))
+
+	received := serveUpstream(lsnr, nil)
+	if err := router.Send(st); err != nil {
+		t.Fatal(err)
+	}
+	<-received
+	if err := router.Send(st); !errors.Is(err, ErrThrottled) {
+		t.Errorf("expected: %v, actual: %v", ErrThrottled, err)
+	}
+	st.Recipients = []string{"user1@example.org"}
+	received = serveUpstream(lsnr, nil)
+	if err := router.Send(st); err != nil {
+		t.Errorf("unexpected error for another domain: %v", err)
+	}
+	<-received
+}
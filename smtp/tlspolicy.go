@@ -0,0 +1,130 @@
+package smtp
+
+import (
+	"crypto/tls"
+	"fmt"
+	"strings"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+var tlsCurves = map[string]tls.CurveID{
+	"X25519": tls.X25519,
+	"P256":   tls.CurveP256,
+	"P384":   tls.CurveP384,
+	"P521":   tls.CurveP521,
+}
+
+// TLSPolicy pins the TLS parameters of the listener or of upstream
+// connections. Empty fields leave the defaults of crypto/tls.
+type TLSPolicy struct {
+	// MinVersion is one of "1.0", "1.1", "1.2" or "1.3".
+	MinVersion string
+
+	// CipherSuites are the names of the TLS 1.0-1.2 suites to allow, e.g.
+	// TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256. TLS 1.3 suites are not
+	// configurable.
+	CipherSuites []string
+
+	// Curves are X25519, P256, P384 or P521 in order of preference.
+	Curves []string
+
+	// ALPN are the protocols to negotiate.
+	ALPN []string
+
+	DisableSessionTickets bool
+}
+
+// ParseTLSPolicy parses a policy in the form of comma separated
+// "key=value", where key is min, ciphers, curves, alpn or tickets, lists
+// are separated by ":" and tickets is on or off, e.g.
+// "min=1.2,ciphers=TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,tickets=off".
+func ParseTLSPolicy(s string) (*TLSPolicy, error) {
+	p := &TLSPolicy{}
+	for _, x := range strings.Split(s, ",") {
+		x = strings.TrimSpace(x)
+		if len(x) == 0 {
+			continue
+		}
+		kv := strings.SplitN(x, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("tls: malformed policy: %s", x)
+		}
+		list := strings.Split(kv[1], ":")
+		switch kv[0] {
+		case "min":
+			p.MinVersion = kv[1]
+		case "ciphers":
+			p.CipherSuites = list
+		case "curves":
+			p.Curves = list
+		case "alpn":
+			p.ALPN = list
+		case "tickets":
+			switch kv[1] {
+			case "on":
+				p.DisableSessionTickets = false
+			case "off":
+				p.DisableSessionTickets = true
+			default:
+				return nil, fmt.Errorf("tls: tickets must be on or off: %s", kv[1])
+			}
+		default:
+			return nil, fmt.Errorf("tls: unknown policy key: %s", kv[0])
+		}
+	}
+	return p, p.Apply(&tls.Config{})
+}
+
+// Apply validates the policy and sets it to the config.
+func (p *TLSPolicy) Apply(config *tls.Config) error {
+	if len(p.MinVersion) > 0 {
+		v, ok := tlsVersions[p.MinVersion]
+		if !ok {
+			return fmt.Errorf("tls: unknown version: %s", p.MinVersion)
+		}
+		config.MinVersion = v
+	}
+	if len(p.CipherSuites) > 0 {
+		if config.MinVersion == tls.VersionTLS13 {
+			return fmt.Errorf("tls: cipher suites are not configurable with TLS 1.3")
+		}
+		secure := make(map[string]*tls.CipherSuite)
+		for _, x := range tls.CipherSuites() {
+			secure[x.Name] = x
+		}
+		ids := make([]uint16, 0, len(p.CipherSuites))
+		for _, name := range p.CipherSuites {
+			x, ok := secure[name]
+			if !ok {
+				return fmt.Errorf("tls: unknown or insecure cipher suite: %s", name)
+			}
+			if len(x.SupportedVersions) == 1 && x.SupportedVersions[0] == tls.VersionTLS13 {
+				return fmt.Errorf("tls: TLS 1.3 cipher suites are not configurable: %s", name)
+			}
+			ids = append(ids, x.ID)
+		}
+		config.CipherSuites = ids
+	}
+	if len(p.Curves) > 0 {
+		curves := make([]tls.CurveID, 0, len(p.Curves))
+		for _, name := range p.Curves {
+			c, ok := tlsCurves[name]
+			if !ok {
+				return fmt.Errorf("tls: unknown curve: %s", name)
+			}
+			curves = append(curves, c)
+		}
+		config.CurvePreferences = curves
+	}
+	if len(p.ALPN) > 0 {
+		config.NextProtos = p.ALPN
+	}
+	config.SessionTicketsDisabled = p.DisableSessionTickets
+	return nil
+}
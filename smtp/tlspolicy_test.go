@@ -0,0 +1,42 @@
+package smtp
+
+import (
+	"crypto/tls"
+	"testing"
+)
+
+func TestParseTLSPolicy(t *testing.T) {
+	p, err := ParseTLSPolicy("min=1.2,ciphers=TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256:TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256," +
+		"curves=X25519:P256,alpn=smtp,tickets=off")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &tls.Config{}
+	if err := p.Apply(config); err != nil {
+		t.Fatal(err)
+	}
+	if config.MinVersion != tls.VersionTLS12 || len(config.CipherSuites) != 2 ||
+		config.CipherSuites[1] != tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 {
+		t.Errorf("unexpected config: %v %v", config.MinVersion, config.CipherSuites)
+	}
+	if len(config.CurvePreferences) != 2 || config.CurvePreferences[0] != tls.X25519 {
+		t.Errorf("unexpected curves: %v", config.CurvePreferences)
+	}
+	if len(config.NextProtos) != 1 || !config.SessionTicketsDisabled {
+		t.Errorf("unexpected config: %v %v", config.NextProtos, config.SessionTicketsDisabled)
+	}
+	for _, x := range []string{
+		"min=1.4",
+		"ciphers=TLS_RSA_WITH_RC4_128_SHA",
+		"ciphers=TLS_AES_128_GCM_SHA256",
+		"min=1.3,ciphers=TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256",
+		"curves=P224",
+		"tickets=maybe",
+		"max=1.3",
+		"min",
+	} {
+		if _, err := ParseTLSPolicy(x); err == nil {
+			t.Errorf("expected an error: %s", x)
+		}
+	}
+}
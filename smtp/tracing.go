@@ -0,0 +1,280 @@
+package smtp
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// OTLP span kinds
+const (
+	spanKindInternal = 1
+	spanKindServer   = 2
+	spanKindClient   = 3
+)
+
+var errTransactionAborted = errors.New("transaction aborted")
+
+// Tracer records a span of each session, with a child span of each mail
+// transaction and its DATA read, sink writes and relay attempts, and
+// exports them in batches to an OpenTelemetry collector over OTLP/HTTP
+// with the JSON encoding. Relay attempts of queued messages are not traced.
+type Tracer struct {
+	// Endpoint is the URL of the collector, e.g.
+	// http://localhost:4318/v1/traces.
+	Endpoint    string
+	ServiceName string
+
+	// BatchSize is the number of spans which triggers an export before
+	// Interval. Spans are dropped beyond four batches while the collector
+	// is unavailable.
+	BatchSize int
+	Interval  time.Duration
+	Client    *http.Client
+
+	mtx    sync.Mutex
+	spans  []*Span
+	wakeup chan struct{}
+}
+
+func NewTracer(endpoint string) *Tracer {
+	return &Tracer{
+		Endpoint:    endpoint,
+		ServiceName: "mproxy",
+		BatchSize:   512,
+		Interval:    5 * time.Second,
+		Client:      &http.Client{Timeout: 10 * time.Second},
+		wakeup:      make(chan struct{}, 1),
+	}
+}
+
+// Span is an operation of a trace. The methods of a nil Span do nothing,
+// so spans need not be checked when tracing is disabled.
+type Span struct {
+	Name     string
+	TraceID  [16]byte
+	SpanID   [8]byte
+	ParentID [8]byte
+	Start    time.Time
+	End      time.Time
+	Err      error
+
+	tracer     *Tracer
+	kind       int
+	attributes []spanAttribute
+}
+
+type spanAttribute struct {
+	key   string
+	value interface{}
+}
+
+// Start begins the root span of a new trace, or returns nil if t is nil.
+func (t *Tracer) Start(name string) *Span {
+	if t == nil {
+		return nil
+	}
+	s := &Span{Name: name, Start: time.Now(), tracer: t, kind: spanKindServer}
+	rand.Read(s.TraceID[:])
+	rand.Read(s.SpanID[:])
+	return s
+}
+
+// Child begins a span within s.
+func (s *Span) Child(name string) *Span {
+	return s.child(name, spanKindInternal)
+}
+
+func (s *Span) child(name string, kind int) *Span {
+	if s == nil {
+		return nil
+	}
+	c := &Span{Name: name, TraceID: s.TraceID, ParentID: s.SpanID, Start: time.Now(), tracer: s.tracer, kind: kind}
+	rand.Read(c.SpanID[:])
+	return c
+}
+
+// SetAttribute sets a string, integer, bool or []string attribute.
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	for i, x := range s.attributes {
+		if x.key == key {
+			s.attributes[i].value = value
+			return
+		}
+	}
+	s.attributes = append(s.attributes, spanAttribute{key, value})
+}
+
+// Finish ends the span, failed with err if non-nil, and records it for
+// the export.
+func (s *Span) Finish(err error) {
+	if s == nil || !s.End.IsZero() {
+		return
+	}
+	s.End = time.Now()
+	s.Err = err
+	s.tracer.record(s)
+}
+
+func (t *Tracer) record(s *Span) {
+	t.mtx.Lock()
+	if len(t.spans) < 4*t.BatchSize {
+		t.spans = append(t.spans, s)
+	}
+	full := len(t.spans) >= t.BatchSize
+	t.mtx.Unlock()
+	if full {
+		select {
+		case t.wakeup <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Run exports the recorded spans every Interval until stop is closed,
+// then exports the rest.
+func (t *Tracer) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(t.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			t.Flush()
+			return
+		case <-ticker.C:
+		case <-t.wakeup:
+		}
+		t.Flush()
+	}
+}
+
+// Flush exports the recorded spans. The spans are kept for the next
+// export on failure.
+func (t *Tracer) Flush() error {
+	t.mtx.Lock()
+	spans := t.spans
+	t.spans = nil
+	t.mtx.Unlock()
+	for len(spans) > 0 {
+		n := len(spans)
+		if n > t.BatchSize {
+			n = t.BatchSize
+		}
+		if err := t.export(spans[:n]); err != nil {
+			t.mtx.Lock()
+			t.spans = append(spans, t.spans...)
+			if len(t.spans) > 4*t.BatchSize {
+				t.spans = t.spans[:4*t.BatchSize]
+			}
+			t.mtx.Unlock()
+			return err
+		}
+		spans = spans[n:]
+	}
+	return nil
+}
+
+func (t *Tracer) export(spans []*Span) error {
+	payload, err := json.Marshal(t.payload(spans))
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", t.Endpoint, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := t.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("smtp: OTLP export to %s: %s", t.Endpoint, resp.Status)
+	}
+	return nil
+}
+
+// payload returns an ExportTraceServiceRequest in the OTLP/JSON encoding.
+func (t *Tracer) payload(spans []*Span) map[string]interface{} {
+	xs := make([]map[string]interface{}, len(spans))
+	for i, s := range spans {
+		x := map[string]interface{}{
+			"traceId":           hex.EncodeToString(s.TraceID[:]),
+			"spanId":            hex.EncodeToString(s.SpanID[:]),
+			"name":              s.Name,
+			"kind":              s.kind,
+			"startTimeUnixNano": strconv.FormatInt(s.Start.UnixNano(), 10),
+			"endTimeUnixNano":   strconv.FormatInt(s.End.UnixNano(), 10),
+			"attributes":        otlpAttributes(s.attributes),
+		}
+		if s.ParentID != [8]byte{} {
+			x["parentSpanId"] = hex.EncodeToString(s.ParentID[:])
+		}
+		if s.Err != nil {
+			x["status"] = map[string]interface{}{"code": 2, "message": s.Err.Error()}
+		}
+		xs[i] = x
+	}
+	resource := otlpAttributes([]spanAttribute{{"service.name", t.ServiceName}})
+	return map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{"attributes": resource},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]interface{}{"name": "github.com/tachesimazzoca/go-mproxy/smtp"},
+				"spans": xs,
+			}},
+		}},
+	}
+}
+
+func otlpAttributes(attributes []spanAttribute) []interface{} {
+	xs := make([]interface{}, len(attributes))
+	for i, x := range attributes {
+		xs[i] = map[string]interface{}{"key": x.key, "value": otlpValue(x.value)}
+	}
+	return xs
+}
+
+func otlpValue(v interface{}) map[string]interface{} {
+	switch x := v.(type) {
+	case bool:
+		return map[string]interface{}{"boolValue": x}
+	case int:
+		return map[string]interface{}{"intValue": strconv.Itoa(x)}
+	case int64:
+		return map[string]interface{}{"intValue": strconv.FormatInt(x, 10)}
+	case []string:
+		values := make([]interface{}, len(x))
+		for i, y := range x {
+			values[i] = otlpValue(y)
+		}
+		return map[string]interface{}{"arrayValue": map[string]interface{}{"values": values}}
+	}
+	return map[string]interface{}{"stringValue": fmt.Sprint(v)}
+}
+
+// endSpan finishes the span of the transaction, if any.
+func (st *SMTPState) endSpan(err error) {
+	if st.span == nil {
+		return
+	}
+	st.span.SetAttribute("smtp.rcpt_to", st.Recipients)
+	if len(st.MessageID) > 0 {
+		st.span.SetAttribute("smtp.message_id", st.MessageID)
+	}
+	st.span.Finish(err)
+	st.span = nil
+}
@@ -0,0 +1,84 @@
+package smtp
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestTracer(t *testing.T) {
+	conn := NewMockConn([]byte("EHLO localhost\r\n" +
+		"MAIL FROM: <foo@example.net>\r\n" +
+		"RCPT TO: <user1@example.com>\r\n" +
+		"DATA\r\n" +
+		"Subject: Trace\r\n" +
+		"\r\n" +
+		"Hello\r\n" +
+		".\r\n" +
+		"MAIL FROM: <bar@example.net>\r\n" +
+		"QUIT\r\n"))
+	h := NewSMTPHandler(conn, func(st *SMTPState) error { return nil })
+	h.Config.Tracer = NewTracer("")
+	h.Run()
+
+	spans := h.Config.Tracer.spans
+	names := make([]string, len(spans))
+	for i, s := range spans {
+		names[i] = s.Name
+	}
+	expected := "smtp.data smtp.transaction smtp.transaction smtp.session"
+	if actual := strings.Join(names, " "); actual != expected {
+		t.Fatalf("expected: %s, actual: %s", expected, actual)
+	}
+	session := spans[3]
+	for _, s := range spans[:3] {
+		if s.TraceID != session.TraceID {
+			t.Errorf("expected the trace of the session: %s", s.Name)
+		}
+	}
+	if spans[0].ParentID != spans[1].SpanID || spans[1].ParentID != session.SpanID {
+		t.Errorf("unexpected parents: %v", spans)
+	}
+	if spans[1].Err != nil || !errors.Is(spans[2].Err, errTransactionAborted) {
+		t.Errorf("unexpected errors: %v, %v", spans[1].Err, spans[2].Err)
+	}
+
+	var payload struct {
+		ResourceSpans []struct {
+			ScopeSpans []struct {
+				Spans []struct {
+					Name       string `json:"name"`
+					Attributes []struct {
+						Key string `json:"key"`
+					} `json:"attributes"`
+				} `json:"spans"`
+			} `json:"scopeSpans"`
+		} `json:"resourceSpans"`
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		json.NewDecoder(req.Body).Decode(&payload)
+	}))
+	defer server.Close()
+	h.Config.Tracer.Endpoint = server.URL
+	if err := h.Config.Tracer.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if len(h.Config.Tracer.spans) != 0 {
+		t.Errorf("unexpected spans after the export: %d", len(h.Config.Tracer.spans))
+	}
+	xs := payload.ResourceSpans[0].ScopeSpans[0].Spans
+	if len(xs) != 4 || xs[1].Name != "smtp.transaction" {
+		t.Fatalf("unexpected spans: %v", xs)
+	}
+	keys := make([]string, 0)
+	for _, x := range xs[1].Attributes {
+		keys = append(keys, x.Key)
+	}
+	expected = "smtp.transaction_id smtp.mail_from smtp.message_size smtp.reply smtp.rcpt_to"
+	if actual := strings.Join(keys, " "); actual != expected {
+		t.Errorf("expected: %s, actual: %s", expected, actual)
+	}
+}
@@ -0,0 +1,103 @@
+package smtp
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Transcript records the dialogue of a session, one line per command,
+// reply or message line with a timestamp and a direction marker:
+//
+//	2006-01-02T15:04:05.000000Z C: MAIL FROM:<foo@example.net>
+//	2006-01-02T15:04:05.000000Z S: 250 2.1.0 OK
+//
+// AUTH credentials are masked. The methods of a nil Transcript do nothing.
+type Transcript struct {
+	// MaxBody is the number of bytes of each message recorded, or 0 to
+	// record whole messages.
+	MaxBody int64
+
+	// Privacy redacts the addresses and omits the messages if set.
+	Privacy *Privacy
+
+	f         *os.File
+	mtx       sync.Mutex
+	body      int64
+	truncated bool
+}
+
+// OpenTranscript creates the transcript file of the session in dir.
+func OpenTranscript(dir, sessionID string, now time.Time) (*Transcript, error) {
+	name := now.UTC().Format("20060102T150405") + "-" + sessionID + ".log"
+	f, err := os.OpenFile(filepath.Join(dir, name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &Transcript{f: f}, nil
+}
+
+func (t *Transcript) write(marker, line string) {
+	if t == nil {
+		return
+	}
+	line = t.Privacy.Text(line)
+	defer t.mtx.Unlock()
+	t.mtx.Lock()
+	fmt.Fprintf(t.f, "%s %s %s\n", time.Now().UTC().Format("2006-01-02T15:04:05.000000Z"), marker, line)
+}
+
+// client records a command line, masking the initial response of AUTH.
+func (t *Transcript) client(line string) {
+	if t == nil {
+		return
+	}
+	if xs := strings.Fields(line); len(xs) > 2 && strings.EqualFold(xs[0], "AUTH") {
+		line = xs[0] + " " + xs[1] + " ***"
+	}
+	t.write("C:", line)
+}
+
+func (t *Transcript) server(line string) {
+	t.write("S:", line)
+}
+
+// data records a line of message data as received, up to MaxBody bytes
+// of each message.
+func (t *Transcript) data(b []byte) {
+	if t == nil {
+		return
+	}
+	line := string(b)
+	if line == "." {
+		t.write("C:", line)
+		t.body, t.truncated = 0, false
+		return
+	}
+	t.body += int64(len(line)) + 2
+	if t.Privacy != nil {
+		if !t.truncated {
+			t.write("C:", "[omitted]")
+			t.truncated = true
+		}
+		return
+	}
+	if t.MaxBody > 0 && t.body > t.MaxBody {
+		if !t.truncated {
+			t.write("C:", "[truncated]")
+			t.truncated = true
+		}
+		return
+	}
+	t.write("C:", line)
+}
+
+func (t *Transcript) Close() error {
+	if t == nil {
+		return nil
+	}
+	return t.f.Close()
+}
@@ -0,0 +1,67 @@
+package smtp
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestTranscript(t *testing.T) {
+	dir := t.TempDir()
+	conn := NewMockConn([]byte("EHLO localhost\r\n" +
+		"AUTH PLAIN AGZvbwBiYXI=\r\n" +
+		"MAIL FROM: <foo@example.net>\r\n" +
+		"RCPT TO: <user1@example.com>\r\n" +
+		"DATA\r\n" +
+		"Subject: Transcript\r\n" +
+		"\r\n" +
+		"Hello\r\n" +
+		".\r\n" +
+		"QUIT\r\n"))
+	h := NewSMTPHandler(conn, func(st *SMTPState) error { return nil })
+	h.Config.TranscriptDir = dir
+	h.Config.Authenticate = func(username, password string) bool { return true }
+	h.Config.TranscriptMaxBody = 24
+	h.Run()
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*.log"))
+	if len(files) != 1 {
+		t.Fatalf("expected a transcript: %v", files)
+	}
+	b, err := os.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	for i, x := range lines {
+		// strip the timestamps
+		lines[i] = x[strings.IndexByte(x, ' ')+1:]
+	}
+	expected := []string{
+		"S: 220 Simple Mail Transfer service ready",
+		"C: EHLO localhost",
+	}
+	if actual := lines[:2]; strings.Join(actual, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("expected: %v, actual: %v", expected, actual)
+	}
+	expected = []string{
+		"C: AUTH PLAIN ***",
+		"C: DATA",
+		"S: 354 Start mail input; end with <CRLF>.<CRLF>",
+		"C: Subject: Transcript",
+		"C: ",
+		"C: [truncated]",
+		"C: .",
+		"C: QUIT",
+	}
+	s := strings.Join(lines, "\n")
+	for _, x := range expected {
+		if !strings.Contains(s, x+"\n") && !strings.HasSuffix(s, x) {
+			t.Errorf("expected %q in the transcript:\n%s", x, s)
+		}
+	}
+	if strings.Contains(s, "AGZvbwBiYXI=") || strings.Contains(s, "Hello") {
+		t.Errorf("unexpected credentials or truncated body:\n%s", s)
+	}
+}
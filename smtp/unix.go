@@ -0,0 +1,34 @@
+package smtp
+
+import (
+	"errors"
+	"net"
+	"os"
+)
+
+// ListenUnix listens on a Unix domain socket at path with the permissions
+// of mode, replacing a stale socket left by a previous process. The
+// socket file is removed when the listener is closed.
+func ListenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, errors.New("unix: not a socket: " + path)
+		}
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, errors.New("unix: socket in use: " + path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	lsnr, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		lsnr.Close()
+		return nil, err
+	}
+	return lsnr, nil
+}
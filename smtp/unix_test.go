@@ -0,0 +1,75 @@
+package smtp
+
+import (
+	"net"
+	netsmtp "net/smtp"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestListenUnix(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "smtp.sock")
+	lsnr, err := ListenUnix(path, 0660)
+	if err != nil {
+		t.Skip(err)
+	}
+	if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != 0660 {
+		t.Errorf("unexpected mode: %v, %v", fi, err)
+	}
+	accepted := make(chan *SMTPState, 1)
+	go func() {
+		conn, err := lsnr.Accept()
+		if err != nil {
+			close(accepted)
+			return
+		}
+		h := NewSMTPHandler(conn, nil)
+		h.Config.Hooks = &Hooks{}
+		h.Config.Hooks.OnHelo(func(conn *SMTPConnection) string {
+			x := *conn.State()
+			accepted <- &x
+			return ""
+		})
+		h.Run()
+	}()
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := netsmtp.NewClient(conn, "localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Hello("localhost"); err != nil {
+		t.Fatal(err)
+	}
+	c.Quit()
+	if st := <-accepted; st == nil || st.ClientName != "localhost" {
+		t.Errorf("unexpected state: %v", st)
+	}
+
+	go lsnr.Accept()
+	if _, err := ListenUnix(path, 0660); err == nil {
+		t.Errorf("expected an error of the socket in use")
+	}
+
+	// a stale socket is replaced
+	lsnr.(*net.UnixListener).SetUnlinkOnClose(false)
+	lsnr.Close()
+	lsnr, err = ListenUnix(path, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lsnr.Close()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("expected the socket to be removed: %v", err)
+	}
+
+	file := filepath.Join(dir, "file")
+	os.WriteFile(file, nil, 0600)
+	if _, err := ListenUnix(file, 0600); err == nil {
+		t.Errorf("expected an error of a regular file")
+	}
+}
@@ -0,0 +1,188 @@
+package smtp
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// upgradeEnv names the listeners passed to a new process by Upgrade, in
+// the order of their file descriptors from 3. The descriptor after them
+// is the pipe to signal the readiness on.
+const upgradeEnv = "MPROXY_UPGRADE_FDS"
+
+var ErrUpgradeFailed = errors.New("smtp: new process not ready")
+
+// Upgrader passes the listening sockets to a new process of the binary,
+// e.g. a new version of it, so deploys do not refuse connections: the new
+// process inherits the sockets and accepts connections on them once ready,
+// while the old process stops accepting and drains its sessions. The
+// methods of a nil Upgrader only open the listeners.
+type Upgrader struct {
+	// Path and Args are the executable and the arguments of the new
+	// process, the executable and the arguments of this one by default.
+	Path string
+	Args []string
+
+	mtx       sync.Mutex
+	inherited map[string]net.Listener
+	listeners []namedListener
+	ready     *os.File
+}
+
+type namedListener struct {
+	name string
+	net.Listener
+}
+
+// NewUpgrader returns an upgrader with the listeners inherited from the
+// old process, if started by Upgrade.
+func NewUpgrader() (*Upgrader, error) {
+	u := &Upgrader{Args: os.Args[1:], inherited: make(map[string]net.Listener)}
+	names := os.Getenv(upgradeEnv)
+	os.Unsetenv(upgradeEnv)
+	if len(names) == 0 {
+		return u, nil
+	}
+	xs := strings.Split(names, ":")
+	listeners, err := fileListeners(3, len(xs), xs)
+	if err != nil {
+		return nil, err
+	}
+	for _, x := range listeners {
+		u.inherited[x.Name] = x.Listener
+	}
+	u.ready = os.NewFile(uintptr(3+len(xs)), "ready")
+	return u, nil
+}
+
+// Inherited reports whether the process was started by Upgrade.
+func (u *Upgrader) Inherited() bool {
+	return u != nil && u.ready != nil
+}
+
+// Listen returns the listener of the name inherited from the old process,
+// or opens it by listen, and keeps it to pass to a new process.
+func (u *Upgrader) Listen(name string, listen func() (net.Listener, error)) (net.Listener, error) {
+	if u == nil {
+		return listen()
+	}
+	defer u.mtx.Unlock()
+	u.mtx.Lock()
+	l, ok := u.inherited[name]
+	delete(u.inherited, name)
+	if !ok {
+		var err error
+		if l, err = listen(); err != nil {
+			return nil, err
+		}
+	}
+	u.listeners = append(u.listeners, namedListener{name, l})
+	return l, nil
+}
+
+// Ready tells the old process that this one accepts connections, and
+// closes the inherited listeners not opened by Listen.
+func (u *Upgrader) Ready() error {
+	if u == nil {
+		return nil
+	}
+	u.mtx.Lock()
+	for _, l := range u.inherited {
+		l.Close()
+	}
+	u.inherited = nil
+	ready := u.ready
+	u.ready = nil
+	u.mtx.Unlock()
+	if ready == nil {
+		return nil
+	}
+	defer ready.Close()
+	_, err := ready.Write([]byte{1})
+	return err
+}
+
+// Upgrade starts a new process with the listeners and waits until it is
+// ready, killing it unless ready within timeout. The caller should then
+// Close the listeners and drain the sessions.
+func (u *Upgrader) Upgrade(timeout time.Duration) (*os.Process, error) {
+	path := u.Path
+	if len(path) == 0 {
+		var err error
+		if path, err = os.Executable(); err != nil {
+			return nil, err
+		}
+	}
+	u.mtx.Lock()
+	names := make([]string, 0, len(u.listeners))
+	files := make([]*os.File, 0, len(u.listeners)+1)
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	for _, x := range u.listeners {
+		l, ok := x.Listener.(interface{ File() (*os.File, error) })
+		if !ok {
+			u.mtx.Unlock()
+			return nil, fmt.Errorf("smtp: listener %s cannot be passed", x.name)
+		}
+		f, err := l.File()
+		if err != nil {
+			u.mtx.Unlock()
+			return nil, err
+		}
+		names = append(names, x.name)
+		files = append(files, f)
+	}
+	u.mtx.Unlock()
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	files = append(files, w)
+
+	cmd := exec.Command(path, u.Args...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.Env = append(os.Environ(), upgradeEnv+"="+strings.Join(names, ":"))
+	cmd.ExtraFiles = files
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	w.Close()
+	go cmd.Wait()
+	r.SetReadDeadline(time.Now().Add(timeout))
+	if n, _ := r.Read(make([]byte, 1)); n != 1 {
+		cmd.Process.Kill()
+		return nil, ErrUpgradeFailed
+	}
+	return cmd.Process, nil
+}
+
+// Close closes the listeners so the new process accepts every
+// connection. The sockets of unix listeners are left for it.
+func (u *Upgrader) Close() error {
+	if u == nil {
+		return nil
+	}
+	defer u.mtx.Unlock()
+	u.mtx.Lock()
+	var err error
+	for _, x := range u.listeners {
+		if l, ok := x.Listener.(*net.UnixListener); ok {
+			l.SetUnlinkOnClose(false)
+		}
+		if cerr := x.Close(); err == nil {
+			err = cerr
+		}
+	}
+	u.listeners = nil
+	return err
+}
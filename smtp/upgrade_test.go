@@ -0,0 +1,96 @@
+//go:build !windows && !plan9
+
+package smtp
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// TestUpgradeChild is the new process of TestUpgrade, serving a
+// connection on the inherited listener.
+func TestUpgradeChild(t *testing.T) {
+	if len(os.Getenv(upgradeEnv)) == 0 {
+		t.Skip("not upgraded")
+	}
+	u, err := NewUpgrader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !u.Inherited() {
+		t.Fatal("expected the inherited listeners")
+	}
+	lsnr, err := u.Listen("smtp", func() (net.Listener, error) {
+		return nil, errors.New("not inherited")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := u.Ready(); err != nil {
+		t.Fatal(err)
+	}
+	conn, err := lsnr.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte("220 new\r\n"))
+	conn.Close()
+}
+
+func TestUpgrade(t *testing.T) {
+	u, err := NewUpgrader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Inherited() {
+		t.Skip("upgraded")
+	}
+	lsnr, err := u.Listen("smtp", func() (net.Listener, error) {
+		return net.Listen("tcp", "127.0.0.1:0")
+	})
+	if err != nil {
+		t.Skip(err)
+	}
+	addr := lsnr.Addr().String()
+	u.Path = os.Args[0]
+	u.Args = []string{"-test.run=^TestUpgradeChild$"}
+	p, err := u.Upgrade(10 * time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Kill()
+	if err := u.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := lsnr.Accept(); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("expected: %v, actual: %v", net.ErrClosed, err)
+	}
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "220 new\r\n"; line != expected {
+		t.Errorf("expected: %q, actual: %q", expected, line)
+	}
+}
+
+func TestUpgradeNotReady(t *testing.T) {
+	u := &Upgrader{Path: "/bin/true"}
+	if _, err := os.Stat(u.Path); err != nil {
+		t.Skip(err)
+	}
+	if _, err := u.Upgrade(10 * time.Second); !errors.Is(err, ErrUpgradeFailed) {
+		t.Errorf("expected: %v, actual: %v", ErrUpgradeFailed, err)
+	}
+}
@@ -0,0 +1,60 @@
+package smtp
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Users verifies the credentials of SMTP AUTH, POP3 and IMAP clients.
+type Users struct {
+	passwords map[string]string
+}
+
+func NewUsers() *Users {
+	return &Users{passwords: make(map[string]string)}
+}
+
+// Add sets the password of the user, either in plain text or in the form
+// of "{SHA256}" and the base64 encoded SHA-256 digest of the password.
+func (u *Users) Add(username, password string) {
+	u.passwords[username] = password
+}
+
+// ParseUsers reads users in the form of "username password", one per line.
+func ParseUsers(r io.Reader) (*Users, error) {
+	u := NewUsers()
+	scanner := bufio.NewScanner(r)
+	n := 0
+	for scanner.Scan() {
+		n++
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		xs := strings.Fields(line)
+		if len(xs) != 2 {
+			return nil, fmt.Errorf("line %d: expected 2 fields", n)
+		}
+		u.Add(xs[0], xs[1])
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// Authenticate reports whether the password is that of the user. It is
+// suitable as SMTPConfig.Authenticate.
+func (u *Users) Authenticate(username, password string) bool {
+	expected, ok := u.passwords[username]
+	if digest, hashed := strings.CutPrefix(expected, "{SHA256}"); hashed {
+		sum := sha256.Sum256([]byte(password))
+		password = base64.StdEncoding.EncodeToString(sum[:])
+		expected = digest
+	}
+	return secureEqual(expected, password) && ok
+}
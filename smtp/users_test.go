@@ -0,0 +1,32 @@
+package smtp
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestUsers(t *testing.T) {
+	u, err := ParseUsers(strings.NewReader("# users\n" +
+		"foo secret\n" +
+		"bar {SHA256}K7gNU3sdo+OL0wNhqoVWhr3g6s1xYv72ol/pe/Unols=\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, x := range []struct {
+		username, password string
+		expected           bool
+	}{
+		{"foo", "secret", true},
+		{"foo", "Secret", false},
+		{"bar", "secret", true},
+		{"bar", "{SHA256}K7gNU3sdo+OL0wNhqoVWhr3g6s1xYv72ol/pe/Unols=", false},
+		{"baz", "", false},
+	} {
+		if actual := u.Authenticate(x.username, x.password); actual != x.expected {
+			t.Errorf("expected: %v, actual: %v (%s)", x.expected, actual, x.username)
+		}
+	}
+	if _, err := ParseUsers(strings.NewReader("foo\n")); err == nil {
+		t.Errorf("expected an error")
+	}
+}
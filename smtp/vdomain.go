@@ -0,0 +1,64 @@
+package smtp
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// VirtualDomains is the set of domains the proxy accepts mail for. A domain
+// may have a catch-all mailbox receiving mail for all of its addresses.
+type VirtualDomains struct {
+	domains map[string]string
+}
+
+func NewVirtualDomains() *VirtualDomains {
+	return &VirtualDomains{domains: make(map[string]string)}
+}
+
+func (v *VirtualDomains) Add(domain, catchAll string) {
+	v.domains[strings.ToLower(domain)] = catchAll
+}
+
+func (v *VirtualDomains) Accepts(domain string) bool {
+	_, ok := v.domains[strings.ToLower(domain)]
+	return ok
+}
+
+// Mailbox returns the name of the mailbox the address is delivered to,
+// which is the address itself unless its domain has a catch-all.
+func (v *VirtualDomains) Mailbox(addr Address) string {
+	if x := v.domains[strings.ToLower(addr.Domain)]; len(x) > 0 {
+		return x
+	}
+	return addr.String()
+}
+
+// ParseVirtualDomains reads domains in the form of "domain [catch-all]",
+// one per line.
+func ParseVirtualDomains(r io.Reader) (*VirtualDomains, error) {
+	v := NewVirtualDomains()
+	scanner := bufio.NewScanner(r)
+	n := 0
+	for scanner.Scan() {
+		n++
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		xs := strings.Fields(line)
+		if len(xs) > 2 || !isValidDomain(xs[0]) {
+			return nil, fmt.Errorf("line %d: expected \"domain [catch-all]\"", n)
+		}
+		catchAll := ""
+		if len(xs) == 2 {
+			catchAll = xs[1]
+		}
+		v.Add(xs[0], catchAll)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
@@ -0,0 +1,73 @@
+package smtp
+
+import (
+	"bufio"
+	"io"
+	"strings"
+)
+
+// VerifyFunc answers VRFY with the reply for the argument, e.g.
+// "250 <user1@example.com>", "251 User not local; will forward",
+// "252 Cannot VRFY user, but will accept message" or "550 No such user".
+type VerifyFunc func(arg string) string
+
+// verifyAddress parses the address of a VRFY argument in the form of
+// "user@example.com", "<user@example.com>" or "Name <user@example.com>".
+func verifyAddress(arg string) (Address, bool) {
+	if i := strings.LastIndex(arg, "<"); i >= 0 && strings.HasSuffix(arg, ">") {
+		arg = arg[i+1 : len(arg)-1]
+	}
+	addr, err := ParseAddress(arg)
+	return addr, err == nil
+}
+
+// VerifyVirtualDomains answers 252 for addresses of the domains, whose
+// mailboxes are not known, and 550 for the others.
+func VerifyVirtualDomains(v *VirtualDomains) VerifyFunc {
+	return func(arg string) string {
+		addr, ok := verifyAddress(arg)
+		if !ok {
+			return "501 5.1.3 Invalid address"
+		}
+		if !v.Accepts(addr.Domain) {
+			return "550 5.1.2 Domain not accepted"
+		}
+		return "252 2.1.5 Cannot VRFY user, but will accept message"
+	}
+}
+
+// VerifyList answers 250 for the addresses of the list, compared
+// case-insensitively, and 550 for the others.
+func VerifyList(addrs []string) VerifyFunc {
+	known := make(map[string]bool)
+	for _, x := range addrs {
+		known[strings.ToLower(x)] = true
+	}
+	return func(arg string) string {
+		addr, ok := verifyAddress(arg)
+		if !ok {
+			return "501 5.1.3 Invalid address"
+		}
+		if !known[strings.ToLower(addr.String())] {
+			return "550 5.1.1 No such user"
+		}
+		return "250 2.1.5 <" + addr.String() + ">"
+	}
+}
+
+// ParseVerifyList reads the addresses of VerifyList, one per line.
+func ParseVerifyList(r io.Reader) (VerifyFunc, error) {
+	addrs := make([]string, 0)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		addrs = append(addrs, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return VerifyList(addrs), nil
+}
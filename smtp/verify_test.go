@@ -0,0 +1,38 @@
+package smtp
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestVerify(t *testing.T) {
+	domains := NewVirtualDomains()
+	domains.Add("example.com", "")
+	list, err := ParseVerifyList(strings.NewReader("# fixtures\nuser1@example.com\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, fixture := range []struct {
+		verify   VerifyFunc
+		expected string
+	}{
+		{nil, "220 250 502 502 502 221"},
+		{VerifyVirtualDomains(domains), "220 250 252 550 501 221"},
+		{list, "220 250 250 550 501 221"},
+	} {
+		conn := NewMockConn([]byte("EHLO localhost\r\n" +
+			"VRFY User1 <USER1@example.com>\r\n" +
+			"VRFY user2@example.org\r\n" +
+			"VRFY\r\n" +
+			"QUIT\r\n"))
+		h := NewSMTPHandler(conn, nil)
+		h.Config.Verify = fixture.verify
+		h.Run()
+		if actual := replyCodes(conn.CloneOutputBuffer()); actual != fixture.expected {
+			t.Errorf("expected: %s, actual: %s", fixture.expected, actual)
+		}
+	}
+	if reply := list("<user1@example.com>"); reply != "250 2.1.5 <user1@example.com>" {
+		t.Errorf("unexpected reply: %s", reply)
+	}
+}
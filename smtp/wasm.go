@@ -0,0 +1,1985 @@
+package smtp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"math/bits"
+	"time"
+)
+
+// This file is an interpreter of WebAssembly 1.0 modules, with the
+// sign-extension, non-trapping conversion and bulk memory operations which
+// compilers emit by default. Modules may import functions only, and have at
+// most a memory and a table. Modules are validated as they are decoded,
+// within the limits below, so that the interpreter only meets the traps of
+// the specification.
+
+const (
+	wasmPageSize = 65536
+	wasmMaxDepth = 1000
+
+	// The limits of modules, which keep a small module from making the
+	// parser or an instance allocate without bound
+	wasmMaxEntries   = 100000
+	wasmMaxParams    = 1000
+	wasmMaxLocals    = 50000
+	wasmMaxTableSize = 100000
+	wasmMaxPages     = 65536
+	wasmMaxFrames    = 1 << 20
+
+	wasmI32 = 0x7F
+	wasmI64 = 0x7E
+	wasmF32 = 0x7D
+	wasmF64 = 0x7C
+)
+
+type wasmFuncType struct {
+	params, results []byte
+}
+
+func (t wasmFuncType) equal(u wasmFuncType) bool {
+	return bytes.Equal(t.params, u.params) && bytes.Equal(t.results, u.results)
+}
+
+func (t wasmFuncType) String() string {
+	names := func(xs []byte) string {
+		s := ""
+		for i, x := range xs {
+			if i > 0 {
+				s += " "
+			}
+			s += map[byte]string{wasmI32: "i32", wasmI64: "i64", wasmF32: "f32", wasmF64: "f64"}[x]
+		}
+		return s
+	}
+	return "(" + names(t.params) + ") -> (" + names(t.results) + ")"
+}
+
+type wasmImport struct {
+	module, name string
+	typ          uint32
+}
+
+type wasmFunc struct {
+	typ    uint32
+	locals []byte
+	code   []wasmInstr
+}
+
+// wasmInstr is a decoded instruction. Opcodes after the prefix 0xFC are
+// 0xFC00 plus the sub-opcode.
+type wasmInstr struct {
+	op      uint16
+	imm     uint64
+	block   *wasmBlock
+	targets []uint32
+}
+
+// wasmBlock is the signature of a block, loop or if, and the positions of
+// its else and end.
+type wasmBlock struct {
+	sig             wasmFuncType
+	params, results int
+	els, end        int
+}
+
+type wasmGlobal struct {
+	typ     byte
+	mutable bool
+	init    []wasmInstr
+}
+
+type wasmElem struct {
+	offset []wasmInstr
+	funcs  []uint32
+}
+
+type wasmData struct {
+	passive bool
+	offset  []wasmInstr
+	init    []byte
+}
+
+type wasmExport struct {
+	kind  byte
+	index uint32
+}
+
+type wasmModule struct {
+	types   []wasmFuncType
+	imports []wasmImport
+	funcs   []wasmFunc
+	table   *[2]uint32
+	memory  *[2]uint32
+	globals []wasmGlobal
+	exports map[string]wasmExport
+	start   int64
+	elems   []wasmElem
+	datas   []wasmData
+
+	// dataCount is the number of data segments declared before the code,
+	// which memory.init and data.drop require.
+	dataCount *uint32
+}
+
+// funcType returns the type of the function of the index, counting the
+// imports first.
+func (m *wasmModule) funcType(f uint32) (wasmFuncType, error) {
+	var typ uint32
+	switch {
+	case int(f) < len(m.imports):
+		typ = m.imports[f].typ
+	case int(f) < len(m.imports)+len(m.funcs):
+		typ = m.funcs[int(f)-len(m.imports)].typ
+	default:
+		return wasmFuncType{}, fmt.Errorf("unknown function %d", f)
+	}
+	return m.types[typ], nil
+}
+
+type wasmReader struct {
+	b   []byte
+	pos int
+}
+
+var errWASMEOF = errors.New("unexpected end")
+
+func (r *wasmReader) eof() bool {
+	return r.pos >= len(r.b)
+}
+
+func (r *wasmReader) byte() (byte, error) {
+	if r.pos >= len(r.b) {
+		return 0, errWASMEOF
+	}
+	r.pos++
+	return r.b[r.pos-1], nil
+}
+
+func (r *wasmReader) bytes(n uint32) ([]byte, error) {
+	if uint64(n) > uint64(len(r.b)-r.pos) {
+		return nil, errWASMEOF
+	}
+	r.pos += int(n)
+	return r.b[r.pos-int(n) : r.pos], nil
+}
+
+func (r *wasmReader) uleb(size uint) (uint64, error) {
+	var v uint64
+	for shift := uint(0); ; shift += 7 {
+		b, err := r.byte()
+		if err != nil {
+			return 0, err
+		}
+		if shift >= size || (shift+7 > size && b&0x7F>>(size-shift) != 0) {
+			return 0, errors.New("integer too large")
+		}
+		v |= uint64(b&0x7F) << shift
+		if b&0x80 == 0 {
+			return v, nil
+		}
+	}
+}
+
+func (r *wasmReader) sleb(size uint) (int64, error) {
+	var v int64
+	for shift := uint(0); ; shift += 7 {
+		b, err := r.byte()
+		if err != nil {
+			return 0, err
+		}
+		if shift >= size {
+			return 0, errors.New("integer too large")
+		}
+		v |= int64(b&0x7F) << shift
+		if b&0x80 == 0 {
+			if shift+7 < 64 && b&0x40 != 0 {
+				v |= -1 << (shift + 7)
+			}
+			if shift+7 > size {
+				// The unused bits must extend the sign.
+				if w := 64 - size; v<<w>>w != v {
+					return 0, errors.New("integer too large")
+				}
+			}
+			return v, nil
+		}
+	}
+}
+
+func (r *wasmReader) u32() (uint32, error) {
+	v, err := r.uleb(32)
+	return uint32(v), err
+}
+
+func (r *wasmReader) name() (string, error) {
+	n, err := r.u32()
+	if err != nil {
+		return "", err
+	}
+	b, err := r.bytes(n)
+	return string(b), err
+}
+
+func (r *wasmReader) valtype() (byte, error) {
+	t, err := r.byte()
+	if err != nil {
+		return 0, err
+	}
+	switch t {
+	case wasmI32, wasmI64, wasmF32, wasmF64:
+		return t, nil
+	}
+	return 0, fmt.Errorf("unsupported value type 0x%02x", t)
+}
+
+func (r *wasmReader) limits() (*[2]uint32, error) {
+	flag, err := r.byte()
+	if err != nil {
+		return nil, err
+	}
+	min, err := r.u32()
+	if err != nil {
+		return nil, err
+	}
+	max := uint32(math.MaxUint32)
+	switch flag {
+	case 0:
+	case 1:
+		if max, err = r.u32(); err != nil {
+			return nil, err
+		}
+		if max < min {
+			return nil, errors.New("the maximum of limits is less than the minimum")
+		}
+	default:
+		return nil, fmt.Errorf("unsupported limits 0x%02x", flag)
+	}
+	return &[2]uint32{min, max}, nil
+}
+
+// parseWASM decodes a module in the binary format.
+func parseWASM(b []byte) (*wasmModule, error) {
+	m, err := decodeWASM(b)
+	if err != nil {
+		return nil, fmt.Errorf("wasm: %w", err)
+	}
+	return m, nil
+}
+
+func decodeWASM(b []byte) (*wasmModule, error) {
+	if len(b) < 8 || string(b[:4]) != "\x00asm" {
+		return nil, errors.New("not a module")
+	}
+	if v := binary.LittleEndian.Uint32(b[4:]); v != 1 {
+		return nil, fmt.Errorf("unsupported version %d", v)
+	}
+	m := &wasmModule{exports: make(map[string]wasmExport), start: -1}
+	var funcTypes []uint32
+	r := &wasmReader{b: b, pos: 8}
+	for !r.eof() {
+		id, err := r.byte()
+		if err != nil {
+			return nil, err
+		}
+		size, err := r.u32()
+		if err != nil {
+			return nil, err
+		}
+		body, err := r.bytes(size)
+		if err != nil {
+			return nil, err
+		}
+		s := &wasmReader{b: body}
+		switch id {
+		case 0:
+			continue
+		case 12:
+			var n uint32
+			n, err = s.u32()
+			m.dataCount = &n
+		case 1:
+			err = s.vec(func() error {
+				if form, err := s.byte(); err != nil {
+					return err
+				} else if form != 0x60 {
+					return fmt.Errorf("unsupported type 0x%02x", form)
+				}
+				var t wasmFuncType
+				for _, xs := range []*[]byte{&t.params, &t.results} {
+					if err := s.vec(func() error {
+						v, err := s.valtype()
+						*xs = append(*xs, v)
+						if len(*xs) > wasmMaxParams {
+							return errors.New("too many parameters or results")
+						}
+						return err
+					}); err != nil {
+						return err
+					}
+				}
+				m.types = append(m.types, t)
+				return nil
+			})
+		case 2:
+			err = s.vec(func() error {
+				var imp wasmImport
+				var err error
+				if imp.module, err = s.name(); err != nil {
+					return err
+				}
+				if imp.name, err = s.name(); err != nil {
+					return err
+				}
+				if kind, err := s.byte(); err != nil {
+					return err
+				} else if kind != 0 {
+					return fmt.Errorf("import %s.%s is not a function", imp.module, imp.name)
+				}
+				if imp.typ, err = s.u32(); err != nil {
+					return err
+				}
+				if int(imp.typ) >= len(m.types) {
+					return fmt.Errorf("unknown type %d", imp.typ)
+				}
+				m.imports = append(m.imports, imp)
+				return nil
+			})
+		case 3:
+			err = s.vec(func() error {
+				typ, err := s.u32()
+				if int(typ) >= len(m.types) {
+					return fmt.Errorf("unknown type %d", typ)
+				}
+				funcTypes = append(funcTypes, typ)
+				return err
+			})
+		case 4:
+			err = s.vec(func() error {
+				if m.table != nil {
+					return errors.New("multiple tables")
+				}
+				if t, err := s.byte(); err != nil {
+					return err
+				} else if t != 0x70 {
+					return fmt.Errorf("unsupported table type 0x%02x", t)
+				}
+				var err error
+				m.table, err = s.limits()
+				if err == nil && m.table[0] > wasmMaxTableSize {
+					return fmt.Errorf("table of %d elements too large", m.table[0])
+				}
+				return err
+			})
+		case 5:
+			err = s.vec(func() error {
+				if m.memory != nil {
+					return errors.New("multiple memories")
+				}
+				var err error
+				m.memory, err = s.limits()
+				if err == nil && (m.memory[0] > wasmMaxPages || (m.memory[1] != math.MaxUint32 && m.memory[1] > wasmMaxPages)) {
+					return errors.New("memory too large")
+				}
+				return err
+			})
+		case 6:
+			err = s.vec(func() error {
+				var g wasmGlobal
+				var err error
+				if g.typ, err = s.valtype(); err != nil {
+					return err
+				}
+				mut, err := s.byte()
+				if err != nil {
+					return err
+				}
+				if mut > 1 {
+					return fmt.Errorf("invalid mutability 0x%02x", mut)
+				}
+				g.mutable = mut == 1
+				if g.init, err = s.constExpr(); err != nil {
+					return err
+				}
+				if t, err := m.constType(g.init); err != nil {
+					return err
+				} else if t != g.typ {
+					return errors.New("type mismatch of the initial value of a global")
+				}
+				m.globals = append(m.globals, g)
+				return nil
+			})
+		case 7:
+			err = s.vec(func() error {
+				name, err := s.name()
+				if err != nil {
+					return err
+				}
+				var e wasmExport
+				if e.kind, err = s.byte(); err != nil {
+					return err
+				}
+				if e.index, err = s.u32(); err != nil {
+					return err
+				}
+				if _, ok := m.exports[name]; ok {
+					return fmt.Errorf("duplicate export %s", name)
+				}
+				m.exports[name] = e
+				return nil
+			})
+		case 8:
+			var f uint32
+			f, err = s.u32()
+			m.start = int64(f)
+		case 9:
+			err = s.vec(func() error {
+				flags, err := s.u32()
+				if err != nil {
+					return err
+				}
+				var e wasmElem
+				switch flags {
+				case 0:
+					e.offset, err = s.constExpr()
+				case 2:
+					if _, err = s.u32(); err == nil {
+						if e.offset, err = s.constExpr(); err == nil {
+							var kind byte
+							if kind, err = s.byte(); err == nil && kind != 0 {
+								err = fmt.Errorf("unsupported element kind 0x%02x", kind)
+							}
+						}
+					}
+				default:
+					return fmt.Errorf("unsupported element segment 0x%02x", flags)
+				}
+				if err != nil {
+					return err
+				}
+				if err := m.offsetType(e.offset); err != nil {
+					return err
+				}
+				err = s.vec(func() error {
+					f, err := s.u32()
+					e.funcs = append(e.funcs, f)
+					return err
+				})
+				m.elems = append(m.elems, e)
+				return err
+			})
+		case 10:
+			i := 0
+			err = s.vec(func() error {
+				if i >= len(funcTypes) {
+					return errors.New("more function bodies than functions")
+				}
+				n, err := s.u32()
+				if err != nil {
+					return err
+				}
+				body, err := s.bytes(n)
+				if err != nil {
+					return err
+				}
+				f, err := m.decodeFunc(funcTypes[i], body, funcTypes)
+				if err != nil {
+					return fmt.Errorf("function %d: %w", len(m.imports)+i, err)
+				}
+				m.funcs = append(m.funcs, f)
+				i++
+				return nil
+			})
+		case 11:
+			err = s.vec(func() error {
+				flags, err := s.u32()
+				if err != nil {
+					return err
+				}
+				var d wasmData
+				switch flags {
+				case 0:
+					d.offset, err = s.constExpr()
+				case 1:
+					d.passive = true
+				case 2:
+					if _, err = s.u32(); err == nil {
+						d.offset, err = s.constExpr()
+					}
+				default:
+					return fmt.Errorf("unsupported data segment 0x%02x", flags)
+				}
+				if err != nil {
+					return err
+				}
+				if !d.passive {
+					if err := m.offsetType(d.offset); err != nil {
+						return err
+					}
+				}
+				n, err := s.u32()
+				if err != nil {
+					return err
+				}
+				d.init, err = s.bytes(n)
+				m.datas = append(m.datas, d)
+				return err
+			})
+		default:
+			return nil, fmt.Errorf("unknown section %d", id)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !s.eof() {
+			return nil, fmt.Errorf("section %d has trailing bytes", id)
+		}
+	}
+	if len(m.funcs) != len(funcTypes) {
+		return nil, errors.New("functions without bodies")
+	}
+	if m.dataCount != nil && int(*m.dataCount) != len(m.datas) {
+		return nil, errors.New("the data count differs from the data segments")
+	}
+	nfuncs := uint32(len(m.imports) + len(m.funcs))
+	for name, e := range m.exports {
+		var ok bool
+		switch e.kind {
+		case 0:
+			ok = e.index < nfuncs
+		case 1:
+			ok = m.table != nil && e.index == 0
+		case 2:
+			ok = m.memory != nil && e.index == 0
+		case 3:
+			ok = int(e.index) < len(m.globals)
+		}
+		if !ok {
+			return nil, fmt.Errorf("export %s of unknown index %d", name, e.index)
+		}
+	}
+	if m.start >= int64(nfuncs) {
+		return nil, fmt.Errorf("unknown start function %d", m.start)
+	}
+	if m.start >= 0 {
+		if t, _ := m.funcType(uint32(m.start)); len(t.params)+len(t.results) > 0 {
+			return nil, errors.New("the start function takes or returns values")
+		}
+	}
+	for _, e := range m.elems {
+		if m.table == nil {
+			return nil, errors.New("elements without a table")
+		}
+		for _, f := range e.funcs {
+			if f >= nfuncs {
+				return nil, fmt.Errorf("element of unknown function %d", f)
+			}
+		}
+	}
+	return m, nil
+}
+
+func (r *wasmReader) vec(f func() error) error {
+	n, err := r.u32()
+	if err != nil {
+		return err
+	}
+	if n > wasmMaxEntries {
+		return fmt.Errorf("too many entries: %d", n)
+	}
+	for i := uint32(0); i < n; i++ {
+		if err := f(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// constExpr decodes a constant expression up to its end.
+func (r *wasmReader) constExpr() ([]wasmInstr, error) {
+	var code []wasmInstr
+	for {
+		op, err := r.byte()
+		if err != nil {
+			return nil, err
+		}
+		in := wasmInstr{op: uint16(op)}
+		switch op {
+		case 0x0B:
+			return code, nil
+		case 0x23:
+			v, err := r.u32()
+			if err != nil {
+				return nil, err
+			}
+			in.imm = uint64(v)
+		case 0x41, 0x42, 0x43, 0x44:
+			if err := r.constImm(&in); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("unsupported constant instruction 0x%02x", op)
+		}
+		code = append(code, in)
+	}
+}
+
+// constType returns the type of a constant expression, which may only get
+// the immutable globals defined before.
+func (m *wasmModule) constType(code []wasmInstr) (byte, error) {
+	if len(code) != 1 {
+		return 0, errors.New("invalid constant expression")
+	}
+	switch code[0].op {
+	case 0x23:
+		if code[0].imm >= uint64(len(m.globals)) || m.globals[code[0].imm].mutable {
+			return 0, fmt.Errorf("constant expression of invalid global %d", code[0].imm)
+		}
+		return m.globals[code[0].imm].typ, nil
+	case 0x41:
+		return wasmI32, nil
+	case 0x42:
+		return wasmI64, nil
+	case 0x43:
+		return wasmF32, nil
+	}
+	return wasmF64, nil
+}
+
+func (m *wasmModule) offsetType(code []wasmInstr) error {
+	t, err := m.constType(code)
+	if err == nil && t != wasmI32 {
+		err = errors.New("type mismatch of an offset")
+	}
+	return err
+}
+
+func (r *wasmReader) constImm(in *wasmInstr) error {
+	switch in.op {
+	case 0x41:
+		v, err := r.sleb(32)
+		in.imm = uint64(uint32(v))
+		return err
+	case 0x42:
+		v, err := r.sleb(64)
+		in.imm = uint64(v)
+		return err
+	case 0x43:
+		b, err := r.bytes(4)
+		if err == nil {
+			in.imm = uint64(binary.LittleEndian.Uint32(b))
+		}
+		return err
+	default:
+		b, err := r.bytes(8)
+		if err == nil {
+			in.imm = binary.LittleEndian.Uint64(b)
+		}
+		return err
+	}
+}
+
+func (m *wasmModule) blockType(r *wasmReader) (*wasmBlock, error) {
+	if r.pos < len(r.b) {
+		switch r.b[r.pos] {
+		case 0x40:
+			r.pos++
+			return &wasmBlock{}, nil
+		case wasmI32, wasmI64, wasmF32, wasmF64:
+			r.pos++
+			return &wasmBlock{sig: wasmFuncType{results: r.b[r.pos-1 : r.pos]}, results: 1}, nil
+		}
+	}
+	i, err := r.sleb(33)
+	if err != nil {
+		return nil, err
+	}
+	if i < 0 || i >= int64(len(m.types)) {
+		return nil, fmt.Errorf("unknown block type %d", i)
+	}
+	t := m.types[i]
+	return &wasmBlock{sig: t, params: len(t.params), results: len(t.results)}, nil
+}
+
+// decodeFunc decodes the locals and instructions of a function body,
+// resolving the else and end of each block, and validates it. funcTypes are
+// the types of the functions defined in the module.
+func (m *wasmModule) decodeFunc(typ uint32, body []byte, funcTypes []uint32) (wasmFunc, error) {
+	f := wasmFunc{typ: typ}
+	nfuncs := len(m.imports) + len(funcTypes)
+	r := &wasmReader{b: body}
+	if err := r.vec(func() error {
+		n, err := r.u32()
+		if err != nil {
+			return err
+		}
+		t, err := r.valtype()
+		if err != nil {
+			return err
+		}
+		if uint64(len(f.locals))+uint64(n) > wasmMaxLocals {
+			return errors.New("too many locals")
+		}
+		f.locals = append(f.locals, bytes.Repeat([]byte{t}, int(n))...)
+		return nil
+	}); err != nil {
+		return f, err
+	}
+	var blocks []*wasmBlock
+	for {
+		if r.eof() {
+			return f, errors.New("missing end")
+		}
+		op, _ := r.byte()
+		in := wasmInstr{op: uint16(op)}
+		var err error
+		switch {
+		case op == 0x02 || op == 0x03 || op == 0x04:
+			if in.block, err = m.blockType(r); err == nil {
+				in.block.els = -1
+				blocks = append(blocks, in.block)
+			}
+		case op == 0x05:
+			if len(blocks) == 0 || blocks[len(blocks)-1].els != -1 {
+				return f, errors.New("unexpected else")
+			}
+			in.block = blocks[len(blocks)-1]
+			in.block.els = len(f.code)
+		case op == 0x0B:
+			if len(blocks) > 0 {
+				in.block = blocks[len(blocks)-1]
+				in.block.end = len(f.code)
+				blocks = blocks[:len(blocks)-1]
+			} else {
+				f.code = append(f.code, in)
+				if !r.eof() {
+					return f, errors.New("instructions after the end")
+				}
+				return f, m.validateFunc(&f, funcTypes)
+			}
+		case op == 0x0C || op == 0x0D || op == 0x10 || (op >= 0x20 && op <= 0x24):
+			var v uint32
+			v, err = r.u32()
+			in.imm = uint64(v)
+			if err == nil && op == 0x10 && int(v) >= nfuncs {
+				err = fmt.Errorf("unknown function %d", v)
+			}
+		case op == 0x0E:
+			err = r.vec(func() error {
+				l, err := r.u32()
+				in.targets = append(in.targets, l)
+				return err
+			})
+			if err == nil {
+				var l uint32
+				l, err = r.u32()
+				in.imm = uint64(l)
+			}
+		case op == 0x11:
+			var typ, table uint32
+			if typ, err = r.u32(); err == nil {
+				table, err = r.u32()
+			}
+			if err == nil && (int(typ) >= len(m.types) || table != 0) {
+				err = errors.New("invalid call_indirect")
+			}
+			in.imm = uint64(typ)
+		case op == 0x1C:
+			err = r.vec(func() error {
+				_, err := r.valtype()
+				return err
+			})
+			in.op = 0x1B
+		case op >= 0x28 && op <= 0x3E:
+			var align, off uint32
+			if align, err = r.u32(); err == nil {
+				off, err = r.u32()
+				in.imm = uint64(off)
+				if err == nil && (align >= 4 || 1<<align > wasmMemSizes[op-0x28]) {
+					err = errors.New("alignment larger than natural")
+				}
+			}
+		case op == 0x3F || op == 0x40:
+			var b byte
+			if b, err = r.byte(); err == nil && b != 0 {
+				err = errors.New("invalid memory index")
+			}
+		case op >= 0x41 && op <= 0x44:
+			err = r.constImm(&in)
+		case op == 0x00 || op == 0x01 || op == 0x0F || op == 0x1A || op == 0x1B || (op >= 0x45 && op <= 0xC4):
+		case op == 0xFC:
+			var sub uint32
+			if sub, err = r.u32(); err != nil {
+				break
+			}
+			in.op = 0xFC00 | uint16(sub)
+			switch {
+			case sub <= 7:
+			case sub == 8:
+				var d uint32
+				if d, err = r.u32(); err == nil {
+					in.imm = uint64(d)
+					_, err = r.byte()
+				}
+			case sub == 9:
+				var d uint32
+				d, err = r.u32()
+				in.imm = uint64(d)
+			case sub == 10:
+				if _, err = r.byte(); err == nil {
+					_, err = r.byte()
+				}
+			case sub == 11:
+				_, err = r.byte()
+			default:
+				err = fmt.Errorf("unsupported instruction 0xfc %d", sub)
+			}
+		default:
+			err = fmt.Errorf("unsupported instruction 0x%02x", op)
+		}
+		if err != nil {
+			return f, err
+		}
+		f.code = append(f.code, in)
+	}
+}
+
+// wasmMemSizes are the sizes of the loads and stores from 0x28 to 0x3E.
+var wasmMemSizes = [...]uint32{4, 8, 4, 8, 1, 1, 2, 2, 1, 1, 2, 2, 4, 4, 4, 8, 4, 8, 1, 2, 1, 2, 4}
+
+// wasmOpTypes are the operand and result types of the instructions which
+// take no immediates but memory arguments.
+var wasmOpTypes = map[uint16]wasmFuncType{}
+
+func init() {
+	def := func(from, to uint16, params, results string) {
+		for op := from; op <= to; op++ {
+			wasmOpTypes[op] = wasmFuncType{params: []byte(params), results: []byte(results)}
+		}
+	}
+	const i, I, f, F = "\x7F", "\x7E", "\x7D", "\x7C"
+	def(0x28, 0x28, i, i)
+	def(0x29, 0x29, i, I)
+	def(0x2A, 0x2A, i, f)
+	def(0x2B, 0x2B, i, F)
+	def(0x2C, 0x2F, i, i)
+	def(0x30, 0x35, i, I)
+	def(0x36, 0x36, i+i, "")
+	def(0x37, 0x37, i+I, "")
+	def(0x38, 0x38, i+f, "")
+	def(0x39, 0x39, i+F, "")
+	def(0x3A, 0x3B, i+i, "")
+	def(0x3C, 0x3E, i+I, "")
+	def(0x3F, 0x3F, "", i)
+	def(0x40, 0x40, i, i)
+	def(0x41, 0x41, "", i)
+	def(0x42, 0x42, "", I)
+	def(0x43, 0x43, "", f)
+	def(0x44, 0x44, "", F)
+	def(0x45, 0x45, i, i)
+	def(0x46, 0x4F, i+i, i)
+	def(0x50, 0x50, I, i)
+	def(0x51, 0x5A, I+I, i)
+	def(0x5B, 0x60, f+f, i)
+	def(0x61, 0x66, F+F, i)
+	def(0x67, 0x69, i, i)
+	def(0x6A, 0x78, i+i, i)
+	def(0x79, 0x7B, I, I)
+	def(0x7C, 0x8A, I+I, I)
+	def(0x8B, 0x91, f, f)
+	def(0x92, 0x98, f+f, f)
+	def(0x99, 0x9F, F, F)
+	def(0xA0, 0xA6, F+F, F)
+	def(0xA7, 0xA7, I, i)
+	def(0xA8, 0xA9, f, i)
+	def(0xAA, 0xAB, F, i)
+	def(0xAC, 0xAD, i, I)
+	def(0xAE, 0xAF, f, I)
+	def(0xB0, 0xB1, F, I)
+	def(0xB2, 0xB3, i, f)
+	def(0xB4, 0xB5, I, f)
+	def(0xB6, 0xB6, F, f)
+	def(0xB7, 0xB8, i, F)
+	def(0xB9, 0xBA, I, F)
+	def(0xBB, 0xBB, f, F)
+	def(0xBC, 0xBC, f, i)
+	def(0xBD, 0xBD, F, I)
+	def(0xBE, 0xBE, i, f)
+	def(0xBF, 0xBF, I, F)
+	def(0xC0, 0xC1, i, i)
+	def(0xC2, 0xC4, I, I)
+	def(0xFC00, 0xFC01, f, i)
+	def(0xFC02, 0xFC03, F, i)
+	def(0xFC04, 0xFC05, f, I)
+	def(0xFC06, 0xFC07, F, I)
+	def(0xFC08, 0xFC08, i+i+i, "")
+	def(0xFC0A, 0xFC0B, i+i+i, "")
+}
+
+// wasmCtrl is a block being validated.
+type wasmCtrl struct {
+	op              uint16
+	params, results []byte
+	height          int
+	unreachable     bool
+}
+
+// labels returns the types a branch to the block takes.
+func (c *wasmCtrl) labels() []byte {
+	if c.op == 0x03 {
+		return c.params
+	}
+	return c.results
+}
+
+// wasmValidator checks the types of the operands of a function body as
+// the algorithm in the appendix of the specification, where 0 is the type
+// of an operand unknown after an unconditional branch.
+type wasmValidator struct {
+	vals  []byte
+	ctrls []wasmCtrl
+}
+
+func (v *wasmValidator) push(ts ...byte) {
+	v.vals = append(v.vals, ts...)
+}
+
+func (v *wasmValidator) pop(expected byte) (byte, error) {
+	c := &v.ctrls[len(v.ctrls)-1]
+	if len(v.vals) == c.height {
+		if c.unreachable {
+			return expected, nil
+		}
+		return 0, errors.New("type mismatch: no operand")
+	}
+	t := v.vals[len(v.vals)-1]
+	v.vals = v.vals[:len(v.vals)-1]
+	if t == 0 {
+		return expected, nil
+	}
+	if expected != 0 && t != expected {
+		return 0, fmt.Errorf("type mismatch: expected %s, found %s",
+			wasmFuncType{params: []byte{expected}}.String(), wasmFuncType{params: []byte{t}}.String())
+	}
+	return t, nil
+}
+
+func (v *wasmValidator) pops(ts []byte) error {
+	for i := len(ts) - 1; i >= 0; i-- {
+		if _, err := v.pop(ts[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (v *wasmValidator) pushCtrl(op uint16, sig wasmFuncType) {
+	v.ctrls = append(v.ctrls, wasmCtrl{op: op, params: sig.params, results: sig.results, height: len(v.vals)})
+	v.push(sig.params...)
+}
+
+func (v *wasmValidator) popCtrl() (wasmCtrl, error) {
+	c := v.ctrls[len(v.ctrls)-1]
+	if err := v.pops(c.results); err != nil {
+		return c, err
+	}
+	if len(v.vals) != c.height {
+		return c, errors.New("type mismatch: operands left at the end of a block")
+	}
+	v.ctrls = v.ctrls[:len(v.ctrls)-1]
+	return c, nil
+}
+
+func (v *wasmValidator) label(l uint64) (*wasmCtrl, error) {
+	if l >= uint64(len(v.ctrls)) {
+		return nil, fmt.Errorf("unknown label %d", l)
+	}
+	return &v.ctrls[len(v.ctrls)-1-int(l)], nil
+}
+
+func (v *wasmValidator) unreachable() {
+	c := &v.ctrls[len(v.ctrls)-1]
+	v.vals = v.vals[:c.height]
+	c.unreachable = true
+}
+
+// validateFunc checks the types in a decoded function body, so that the
+// interpreter never finds the operands of an instruction missing or of
+// another type.
+func (m *wasmModule) validateFunc(f *wasmFunc, funcTypes []uint32) error {
+	funcType := func(i uint64) (wasmFuncType, error) {
+		switch {
+		case i < uint64(len(m.imports)):
+			return m.types[m.imports[i].typ], nil
+		case i < uint64(len(m.imports)+len(funcTypes)):
+			return m.types[funcTypes[i-uint64(len(m.imports))]], nil
+		}
+		return wasmFuncType{}, fmt.Errorf("unknown function %d", i)
+	}
+	typ := m.types[f.typ]
+	locals := append(append([]byte(nil), typ.params...), f.locals...)
+	v := &wasmValidator{}
+	v.pushCtrl(0x02, wasmFuncType{results: typ.results})
+	for pc := range f.code {
+		if err := m.validateInstr(v, &f.code[pc], locals, funcType); err != nil {
+			return fmt.Errorf("instruction %d: %w", pc, err)
+		}
+	}
+	return nil
+}
+
+func (m *wasmModule) validateInstr(v *wasmValidator, in *wasmInstr, locals []byte, funcType func(uint64) (wasmFuncType, error)) error {
+	op := in.op
+	if (op >= 0x28 && op <= 0x40) || op == 0xFC08 || op == 0xFC0A || op == 0xFC0B {
+		if m.memory == nil {
+			return errors.New("memory instruction without a memory")
+		}
+	}
+	if op == 0xFC08 || op == 0xFC09 {
+		if m.dataCount == nil || in.imm >= uint64(*m.dataCount) {
+			return fmt.Errorf("unknown data segment %d", in.imm)
+		}
+	}
+	if t, ok := wasmOpTypes[op]; ok {
+		if err := v.pops(t.params); err != nil {
+			return err
+		}
+		v.push(t.results...)
+		return nil
+	}
+	switch op {
+	case 0x00:
+		v.unreachable()
+	case 0x01, 0xFC09:
+	case 0x02, 0x03, 0x04:
+		if op == 0x04 {
+			if _, err := v.pop(wasmI32); err != nil {
+				return err
+			}
+		}
+		if err := v.pops(in.block.sig.params); err != nil {
+			return err
+		}
+		v.pushCtrl(op, in.block.sig)
+	case 0x05:
+		if v.ctrls[len(v.ctrls)-1].op != 0x04 {
+			return errors.New("else without if")
+		}
+		c, err := v.popCtrl()
+		if err != nil {
+			return err
+		}
+		v.pushCtrl(0x05, wasmFuncType{params: c.params, results: c.results})
+	case 0x0B:
+		c, err := v.popCtrl()
+		if err != nil {
+			return err
+		}
+		if c.op == 0x04 && !bytes.Equal(c.params, c.results) {
+			return errors.New("type mismatch: if without else")
+		}
+		if len(v.ctrls) > 0 {
+			v.push(c.results...)
+		}
+	case 0x0C:
+		l, err := v.label(in.imm)
+		if err != nil {
+			return err
+		}
+		if err := v.pops(l.labels()); err != nil {
+			return err
+		}
+		v.unreachable()
+	case 0x0D:
+		if _, err := v.pop(wasmI32); err != nil {
+			return err
+		}
+		l, err := v.label(in.imm)
+		if err != nil {
+			return err
+		}
+		if err := v.pops(l.labels()); err != nil {
+			return err
+		}
+		v.push(l.labels()...)
+	case 0x0E:
+		if _, err := v.pop(wasmI32); err != nil {
+			return err
+		}
+		def, err := v.label(in.imm)
+		if err != nil {
+			return err
+		}
+		for _, target := range in.targets {
+			l, err := v.label(uint64(target))
+			if err != nil {
+				return err
+			}
+			if len(l.labels()) != len(def.labels()) {
+				return errors.New("type mismatch: br_table targets of different arities")
+			}
+			// The operands are checked against each target in turn.
+			vals := append([]byte(nil), v.vals...)
+			if err := v.pops(l.labels()); err != nil {
+				return err
+			}
+			v.vals = vals
+		}
+		if err := v.pops(def.labels()); err != nil {
+			return err
+		}
+		v.unreachable()
+	case 0x0F:
+		if err := v.pops(v.ctrls[0].results); err != nil {
+			return err
+		}
+		v.unreachable()
+	case 0x10, 0x11:
+		var t wasmFuncType
+		if op == 0x10 {
+			var err error
+			if t, err = funcType(in.imm); err != nil {
+				return err
+			}
+		} else {
+			if m.table == nil {
+				return errors.New("call_indirect without a table")
+			}
+			if _, err := v.pop(wasmI32); err != nil {
+				return err
+			}
+			t = m.types[in.imm]
+		}
+		if err := v.pops(t.params); err != nil {
+			return err
+		}
+		v.push(t.results...)
+	case 0x1A:
+		_, err := v.pop(0)
+		return err
+	case 0x1B:
+		if _, err := v.pop(wasmI32); err != nil {
+			return err
+		}
+		t, err := v.pop(0)
+		if err != nil {
+			return err
+		}
+		u, err := v.pop(t)
+		if err != nil {
+			return err
+		}
+		v.push(u)
+	case 0x20, 0x21, 0x22:
+		if in.imm >= uint64(len(locals)) {
+			return fmt.Errorf("unknown local %d", in.imm)
+		}
+		t := locals[in.imm]
+		if op != 0x20 {
+			if _, err := v.pop(t); err != nil {
+				return err
+			}
+		}
+		if op != 0x21 {
+			v.push(t)
+		}
+	case 0x23, 0x24:
+		if in.imm >= uint64(len(m.globals)) {
+			return fmt.Errorf("unknown global %d", in.imm)
+		}
+		g := m.globals[in.imm]
+		if op == 0x23 {
+			v.push(g.typ)
+			break
+		}
+		if !g.mutable {
+			return fmt.Errorf("global %d is immutable", in.imm)
+		}
+		_, err := v.pop(g.typ)
+		return err
+	default:
+		return fmt.Errorf("unsupported instruction 0x%02x", op)
+	}
+	return nil
+}
+
+// wasmTrap is a runtime error of a module, raised as a panic in the
+// interpreter.
+type wasmTrap string
+
+func (t wasmTrap) Error() string {
+	return "wasm: " + string(t)
+}
+
+var errWASMTimeout = wasmTrap("timeout")
+
+// wasmHostFunc is a function imported by a module.
+type wasmHostFunc struct {
+	typ wasmFuncType
+	fn  func(in *wasmInstance, args []uint64) []uint64
+}
+
+// wasmInstance is an instantiated module, whose calls run until the
+// deadline.
+type wasmInstance struct {
+	module   *wasmModule
+	hosts    []wasmHostFunc
+	mem      []byte
+	maxPages uint32
+	globals  []uint64
+	table    []int64
+	dropped  []bool
+	deadline time.Time
+	steps    uint
+	depth    int
+	frames   int
+}
+
+// instantiate creates an instance linking the imports to the host
+// functions, and runs the start function.
+func (m *wasmModule) instantiate(hosts map[string]wasmHostFunc, maxPages uint32, deadline time.Time) (in *wasmInstance, err error) {
+	in = &wasmInstance{module: m, maxPages: maxPages, deadline: deadline}
+	for _, imp := range m.imports {
+		h, ok := hosts[imp.module+"."+imp.name]
+		if !ok {
+			return nil, fmt.Errorf("wasm: unknown import %s.%s", imp.module, imp.name)
+		}
+		if !h.typ.equal(m.types[imp.typ]) {
+			return nil, fmt.Errorf("wasm: import %s.%s is not %s", imp.module, imp.name, h.typ)
+		}
+		in.hosts = append(in.hosts, h)
+	}
+	if m.memory != nil {
+		if m.memory[1] < in.maxPages {
+			in.maxPages = m.memory[1]
+		}
+		if m.memory[0] > in.maxPages {
+			return nil, fmt.Errorf("wasm: the memory of %d pages exceeds the limit", m.memory[0])
+		}
+		in.mem = make([]byte, int(m.memory[0])*wasmPageSize)
+	} else {
+		in.maxPages = 0
+	}
+	defer in.recover(&err)
+	for _, g := range m.globals {
+		in.globals = append(in.globals, in.constValue(g.init))
+	}
+	if m.table != nil {
+		in.table = make([]int64, m.table[0])
+		for i := range in.table {
+			in.table[i] = -1
+		}
+	}
+	for _, e := range m.elems {
+		off := uint64(uint32(in.constValue(e.offset)))
+		if off+uint64(len(e.funcs)) > uint64(len(in.table)) {
+			return nil, errors.New("wasm: elements out of the table")
+		}
+		for i, f := range e.funcs {
+			in.table[off+uint64(i)] = int64(f)
+		}
+	}
+	in.dropped = make([]bool, len(m.datas))
+	for i, d := range m.datas {
+		if d.passive {
+			continue
+		}
+		off := uint64(uint32(in.constValue(d.offset)))
+		if off+uint64(len(d.init)) > uint64(len(in.mem)) {
+			return nil, errors.New("wasm: data out of the memory")
+		}
+		copy(in.mem[off:], d.init)
+		in.dropped[i] = true
+	}
+	if m.start >= 0 {
+		in.call(uint32(m.start), nil)
+	}
+	return in, nil
+}
+
+// recover turns a trap, or any panic of a malformed module, into the error.
+func (in *wasmInstance) recover(err *error) {
+	if x := recover(); x != nil {
+		switch x := x.(type) {
+		case wasmTrap:
+			*err = x
+		case error:
+			*err = fmt.Errorf("wasm: %w", x)
+		default:
+			*err = fmt.Errorf("wasm: %v", x)
+		}
+	}
+}
+
+func (in *wasmInstance) constValue(code []wasmInstr) uint64 {
+	if len(code) != 1 {
+		panic(wasmTrap("invalid constant expression"))
+	}
+	if code[0].op == 0x23 {
+		if code[0].imm >= uint64(len(in.globals)) {
+			panic(wasmTrap("unknown global"))
+		}
+		return in.globals[code[0].imm]
+	}
+	return code[0].imm
+}
+
+// invoke calls the exported function with the arguments.
+func (in *wasmInstance) invoke(name string, args ...uint64) (results []uint64, err error) {
+	e, ok := in.module.exports[name]
+	if !ok || e.kind != 0 {
+		return nil, fmt.Errorf("wasm: no function %s is exported", name)
+	}
+	typ, _ := in.module.funcType(e.index)
+	if len(args) != len(typ.params) {
+		return nil, fmt.Errorf("wasm: %s is %s", name, typ)
+	}
+	defer in.recover(&err)
+	return in.call(e.index, args), nil
+}
+
+// memory returns the range of the memory, or traps if it is out of bounds.
+func (in *wasmInstance) memory(addr, n uint64) []byte {
+	if addr+n > uint64(len(in.mem)) {
+		panic(wasmTrap("out of bounds memory access"))
+	}
+	return in.mem[addr : addr+n]
+}
+
+type wasmLabel struct {
+	height, arity, cont int
+}
+
+func (in *wasmInstance) call(f uint32, args []uint64) []uint64 {
+	m := in.module
+	if int(f) < len(m.imports) {
+		return in.hosts[f].fn(in, args)
+	}
+	if in.depth >= wasmMaxDepth {
+		panic(wasmTrap("call stack exhausted"))
+	}
+	in.depth++
+	defer func() { in.depth-- }()
+	fn := &m.funcs[int(f)-len(m.imports)]
+	typ := m.types[fn.typ]
+	code := fn.code
+	locals := make([]uint64, len(typ.params)+len(fn.locals))
+	copy(locals, args)
+	in.frames += len(locals)
+	defer func() { in.frames -= len(locals) }()
+	if in.frames > wasmMaxFrames {
+		panic(wasmTrap("call stack exhausted"))
+	}
+	stack := make([]uint64, 0, 16)
+	labels := []wasmLabel{{arity: len(typ.results), cont: len(code)}}
+
+	pop := func() uint64 {
+		v := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		return v
+	}
+	push := func(v uint64) {
+		stack = append(stack, v)
+	}
+	br := func(n int) int {
+		l := labels[len(labels)-1-n]
+		copy(stack[l.height:], stack[len(stack)-l.arity:])
+		stack = stack[:l.height+l.arity]
+		labels = labels[:len(labels)-1-n]
+		return l.cont
+	}
+	addr := func(ins *wasmInstr, n uint64) []byte {
+		return in.memory(uint64(uint32(pop()))+ins.imm, n)
+	}
+	i32 := func(v uint32) { push(uint64(v)) }
+	b2i := func(b bool) {
+		if b {
+			push(1)
+		} else {
+			push(0)
+		}
+	}
+	f32 := func(v float32) { push(uint64(math.Float32bits(v))) }
+	f64 := func(v float64) { push(math.Float64bits(v)) }
+	popF32 := func() float32 { return math.Float32frombits(uint32(pop())) }
+	popF64 := func() float64 { return math.Float64frombits(pop()) }
+
+	for pc := 0; pc < len(code); {
+		in.steps++
+		if in.steps&0xFFF == 0 && time.Now().After(in.deadline) {
+			panic(errWASMTimeout)
+		}
+		ins := &code[pc]
+		pc++
+		switch op := ins.op; {
+		case op == 0x00:
+			panic(wasmTrap("unreachable"))
+		case op == 0x01:
+		case op == 0x02:
+			labels = append(labels, wasmLabel{height: len(stack) - ins.block.params, arity: ins.block.results, cont: ins.block.end + 1})
+		case op == 0x03:
+			labels = append(labels, wasmLabel{height: len(stack) - ins.block.params, arity: ins.block.params, cont: pc - 1})
+		case op == 0x04:
+			c := uint32(pop())
+			labels = append(labels, wasmLabel{height: len(stack) - ins.block.params, arity: ins.block.results, cont: ins.block.end + 1})
+			if c == 0 {
+				if ins.block.els >= 0 {
+					pc = ins.block.els + 1
+				} else {
+					pc = ins.block.end
+				}
+			}
+		case op == 0x05:
+			pc = ins.block.end
+		case op == 0x0B:
+			labels = labels[:len(labels)-1]
+		case op == 0x0C:
+			pc = br(int(ins.imm))
+		case op == 0x0D:
+			if uint32(pop()) != 0 {
+				pc = br(int(ins.imm))
+			}
+		case op == 0x0E:
+			i := uint32(pop())
+			if int(i) < len(ins.targets) {
+				pc = br(int(ins.targets[i]))
+			} else {
+				pc = br(int(ins.imm))
+			}
+		case op == 0x0F:
+			pc = br(len(labels) - 1)
+		case op == 0x10, op == 0x11:
+			f := uint32(ins.imm)
+			if op == 0x11 {
+				i := uint32(pop())
+				if int(i) >= len(in.table) || in.table[i] < 0 {
+					panic(wasmTrap("undefined element"))
+				}
+				f = uint32(in.table[i])
+				if t, _ := m.funcType(f); !t.equal(m.types[ins.imm]) {
+					panic(wasmTrap("indirect call type mismatch"))
+				}
+			}
+			t, err := m.funcType(f)
+			if err != nil {
+				panic(wasmTrap(err.Error()))
+			}
+			n := len(stack) - len(t.params)
+			results := in.call(f, append([]uint64(nil), stack[n:]...))
+			if len(results) != len(t.results) {
+				panic(wasmTrap("invalid results of a host function"))
+			}
+			stack = append(stack[:n], results...)
+		case op == 0x1A:
+			pop()
+		case op == 0x1B:
+			c := uint32(pop())
+			b := pop()
+			if c == 0 {
+				stack[len(stack)-1] = b
+			}
+		case op == 0x20:
+			push(locals[ins.imm])
+		case op == 0x21:
+			locals[ins.imm] = pop()
+		case op == 0x22:
+			locals[ins.imm] = stack[len(stack)-1]
+		case op == 0x23:
+			push(in.globals[ins.imm])
+		case op == 0x24:
+			if !m.globals[ins.imm].mutable {
+				panic(wasmTrap("immutable global"))
+			}
+			in.globals[ins.imm] = pop()
+
+		case op == 0x28:
+			i32(binary.LittleEndian.Uint32(addr(ins, 4)))
+		case op == 0x29:
+			push(binary.LittleEndian.Uint64(addr(ins, 8)))
+		case op == 0x2A:
+			i32(binary.LittleEndian.Uint32(addr(ins, 4)))
+		case op == 0x2B:
+			push(binary.LittleEndian.Uint64(addr(ins, 8)))
+		case op == 0x2C:
+			i32(uint32(int8(addr(ins, 1)[0])))
+		case op == 0x2D:
+			i32(uint32(addr(ins, 1)[0]))
+		case op == 0x2E:
+			i32(uint32(int16(binary.LittleEndian.Uint16(addr(ins, 2)))))
+		case op == 0x2F:
+			i32(uint32(binary.LittleEndian.Uint16(addr(ins, 2))))
+		case op == 0x30:
+			push(uint64(int8(addr(ins, 1)[0])))
+		case op == 0x31:
+			push(uint64(addr(ins, 1)[0]))
+		case op == 0x32:
+			push(uint64(int16(binary.LittleEndian.Uint16(addr(ins, 2)))))
+		case op == 0x33:
+			push(uint64(binary.LittleEndian.Uint16(addr(ins, 2))))
+		case op == 0x34:
+			push(uint64(int32(binary.LittleEndian.Uint32(addr(ins, 4)))))
+		case op == 0x35:
+			push(uint64(binary.LittleEndian.Uint32(addr(ins, 4))))
+		case op >= 0x36 && op <= 0x3E:
+			v := pop()
+			switch op {
+			case 0x36, 0x38, 0x3E:
+				binary.LittleEndian.PutUint32(addr(ins, 4), uint32(v))
+			case 0x37, 0x39:
+				binary.LittleEndian.PutUint64(addr(ins, 8), v)
+			case 0x3A, 0x3C:
+				addr(ins, 1)[0] = byte(v)
+			default:
+				binary.LittleEndian.PutUint16(addr(ins, 2), uint16(v))
+			}
+		case op == 0x3F:
+			i32(uint32(len(in.mem) / wasmPageSize))
+		case op == 0x40:
+			n := uint32(pop())
+			pages := uint32(len(in.mem) / wasmPageSize)
+			if uint64(pages)+uint64(n) > uint64(in.maxPages) {
+				i32(math.MaxUint32)
+			} else {
+				in.mem = append(in.mem, make([]byte, int(n)*wasmPageSize)...)
+				i32(pages)
+			}
+		case op >= 0x41 && op <= 0x44:
+			push(ins.imm)
+
+		case op == 0x45:
+			b2i(uint32(pop()) == 0)
+		case op >= 0x46 && op <= 0x4F:
+			b, a := uint32(pop()), uint32(pop())
+			switch op {
+			case 0x46:
+				b2i(a == b)
+			case 0x47:
+				b2i(a != b)
+			case 0x48:
+				b2i(int32(a) < int32(b))
+			case 0x49:
+				b2i(a < b)
+			case 0x4A:
+				b2i(int32(a) > int32(b))
+			case 0x4B:
+				b2i(a > b)
+			case 0x4C:
+				b2i(int32(a) <= int32(b))
+			case 0x4D:
+				b2i(a <= b)
+			case 0x4E:
+				b2i(int32(a) >= int32(b))
+			default:
+				b2i(a >= b)
+			}
+		case op == 0x50:
+			b2i(pop() == 0)
+		case op >= 0x51 && op <= 0x5A:
+			b, a := pop(), pop()
+			switch op {
+			case 0x51:
+				b2i(a == b)
+			case 0x52:
+				b2i(a != b)
+			case 0x53:
+				b2i(int64(a) < int64(b))
+			case 0x54:
+				b2i(a < b)
+			case 0x55:
+				b2i(int64(a) > int64(b))
+			case 0x56:
+				b2i(a > b)
+			case 0x57:
+				b2i(int64(a) <= int64(b))
+			case 0x58:
+				b2i(a <= b)
+			case 0x59:
+				b2i(int64(a) >= int64(b))
+			default:
+				b2i(a >= b)
+			}
+		case op >= 0x5B && op <= 0x66:
+			var a, b float64
+			if op <= 0x60 {
+				b, a = float64(popF32()), float64(popF32())
+			} else {
+				b, a = popF64(), popF64()
+				op -= 6
+			}
+			switch op {
+			case 0x5B:
+				b2i(a == b)
+			case 0x5C:
+				b2i(a != b)
+			case 0x5D:
+				b2i(a < b)
+			case 0x5E:
+				b2i(a > b)
+			case 0x5F:
+				b2i(a <= b)
+			default:
+				b2i(a >= b)
+			}
+
+		case op >= 0x67 && op <= 0x69:
+			a := uint32(pop())
+			switch op {
+			case 0x67:
+				i32(uint32(bits.LeadingZeros32(a)))
+			case 0x68:
+				i32(uint32(bits.TrailingZeros32(a)))
+			default:
+				i32(uint32(bits.OnesCount32(a)))
+			}
+		case op >= 0x6A && op <= 0x78:
+			b, a := uint32(pop()), uint32(pop())
+			i32(wasmI32Binary(op, a, b))
+		case op >= 0x79 && op <= 0x7B:
+			a := pop()
+			switch op {
+			case 0x79:
+				push(uint64(bits.LeadingZeros64(a)))
+			case 0x7A:
+				push(uint64(bits.TrailingZeros64(a)))
+			default:
+				push(uint64(bits.OnesCount64(a)))
+			}
+		case op >= 0x7C && op <= 0x8A:
+			b, a := pop(), pop()
+			push(wasmI64Binary(op, a, b))
+
+		case op == 0x8B, op == 0x8C, op == 0x99, op == 0x9A:
+			// The sign is changed in the bits, which keeps NaNs intact.
+			sign := uint64(1) << 31
+			if op >= 0x99 {
+				sign = 1 << 63
+			}
+			if op == 0x8B || op == 0x99 {
+				push(pop() &^ sign)
+			} else {
+				push(pop() ^ sign)
+			}
+		case op >= 0x8D && op <= 0x91:
+			f32(float32(wasmFloatUnary(op, float64(popF32()), true)))
+		case op >= 0x92 && op <= 0x98:
+			b, a := popF32(), popF32()
+			switch op {
+			case 0x92:
+				f32(a + b)
+			case 0x93:
+				f32(a - b)
+			case 0x94:
+				f32(a * b)
+			case 0x95:
+				f32(a / b)
+			case 0x96:
+				f32(float32(math.Min(float64(a), float64(b))))
+			case 0x97:
+				f32(float32(math.Max(float64(a), float64(b))))
+			default:
+				i32(math.Float32bits(a)&^(1<<31) | math.Float32bits(b)&(1<<31))
+			}
+		case op >= 0x9B && op <= 0x9F:
+			f64(wasmFloatUnary(op-0x0E, popF64(), false))
+		case op >= 0xA0 && op <= 0xA6:
+			b, a := popF64(), popF64()
+			switch op {
+			case 0xA0:
+				f64(a + b)
+			case 0xA1:
+				f64(a - b)
+			case 0xA2:
+				f64(a * b)
+			case 0xA3:
+				f64(a / b)
+			case 0xA4:
+				f64(math.Min(a, b))
+			case 0xA5:
+				f64(math.Max(a, b))
+			default:
+				f64(math.Copysign(a, b))
+			}
+
+		case op == 0xA7:
+			i32(uint32(pop()))
+		case op == 0xA8:
+			i32(uint32(int32(wasmTrunc(float64(popF32()), -1<<31, 1<<31))))
+		case op == 0xA9:
+			i32(uint32(wasmTrunc(float64(popF32()), 0, 1<<32)))
+		case op == 0xAA:
+			i32(uint32(int32(wasmTrunc(popF64(), -1<<31, 1<<31))))
+		case op == 0xAB:
+			i32(uint32(wasmTrunc(popF64(), 0, 1<<32)))
+		case op == 0xAC:
+			push(uint64(int32(uint32(pop()))))
+		case op == 0xAD:
+			push(uint64(uint32(pop())))
+		case op == 0xAE:
+			push(uint64(int64(wasmTrunc(float64(popF32()), -1<<63, 1<<63))))
+		case op == 0xAF:
+			push(wasmTruncU64(float64(popF32())))
+		case op == 0xB0:
+			push(uint64(int64(wasmTrunc(popF64(), -1<<63, 1<<63))))
+		case op == 0xB1:
+			push(wasmTruncU64(popF64()))
+		case op == 0xB2:
+			f32(float32(int32(uint32(pop()))))
+		case op == 0xB3:
+			f32(float32(uint32(pop())))
+		case op == 0xB4:
+			f32(float32(int64(pop())))
+		case op == 0xB5:
+			f32(float32(pop()))
+		case op == 0xB6:
+			f32(float32(popF64()))
+		case op == 0xB7:
+			f64(float64(int32(uint32(pop()))))
+		case op == 0xB8:
+			f64(float64(uint32(pop())))
+		case op == 0xB9:
+			f64(float64(int64(pop())))
+		case op == 0xBA:
+			f64(float64(pop()))
+		case op == 0xBB:
+			f64(float64(popF32()))
+		case op >= 0xBC && op <= 0xBF:
+			// Reinterpretations keep the bits.
+		case op == 0xC0:
+			i32(uint32(int8(pop())))
+		case op == 0xC1:
+			i32(uint32(int16(pop())))
+		case op == 0xC2:
+			push(uint64(int8(pop())))
+		case op == 0xC3:
+			push(uint64(int16(pop())))
+		case op == 0xC4:
+			push(uint64(int32(pop())))
+
+		case op >= 0xFC00 && op <= 0xFC07:
+			var x float64
+			if op&2 == 0 {
+				x = float64(popF32())
+			} else {
+				x = popF64()
+			}
+			switch op {
+			case 0xFC00, 0xFC02:
+				i32(uint32(int32(wasmTruncSat(x, math.MinInt32, math.MaxInt32))))
+			case 0xFC01, 0xFC03:
+				i32(uint32(wasmTruncSat(x, 0, math.MaxUint32)))
+			case 0xFC04, 0xFC06:
+				push(uint64(wasmTruncSatI64(x)))
+			default:
+				push(wasmTruncSatU64(x))
+			}
+		case op == 0xFC08:
+			n, s, d := uint64(uint32(pop())), uint64(uint32(pop())), uint64(uint32(pop()))
+			if ins.imm >= uint64(len(m.datas)) {
+				panic(wasmTrap("unknown data segment"))
+			}
+			var data []byte
+			if !in.dropped[ins.imm] {
+				data = m.datas[ins.imm].init
+			}
+			if s+n > uint64(len(data)) {
+				panic(wasmTrap("out of bounds memory access"))
+			}
+			copy(in.memory(d, n), data[s:])
+		case op == 0xFC09:
+			if ins.imm >= uint64(len(m.datas)) {
+				panic(wasmTrap("unknown data segment"))
+			}
+			in.dropped[ins.imm] = true
+		case op == 0xFC0A:
+			n, s, d := uint64(uint32(pop())), uint64(uint32(pop())), uint64(uint32(pop()))
+			src := in.memory(s, n)
+			copy(in.memory(d, n), src)
+		case op == 0xFC0B:
+			n, v, d := uint64(uint32(pop())), byte(pop()), uint64(uint32(pop()))
+			b := in.memory(d, n)
+			for i := range b {
+				b[i] = v
+			}
+		default:
+			panic(wasmTrap(fmt.Sprintf("unsupported instruction 0x%02x", op)))
+		}
+	}
+	return stack[len(stack)-len(typ.results):]
+}
+
+func wasmI32Binary(op uint16, a, b uint32) uint32 {
+	switch op {
+	case 0x6A:
+		return a + b
+	case 0x6B:
+		return a - b
+	case 0x6C:
+		return a * b
+	case 0x6D, 0x6F:
+		if b == 0 {
+			panic(wasmTrap("integer divide by zero"))
+		}
+		if op == 0x6F {
+			if b == math.MaxUint32 {
+				return 0
+			}
+			return uint32(int32(a) % int32(b))
+		}
+		if int32(a) == math.MinInt32 && int32(b) == -1 {
+			panic(wasmTrap("integer overflow"))
+		}
+		return uint32(int32(a) / int32(b))
+	case 0x6E, 0x70:
+		if b == 0 {
+			panic(wasmTrap("integer divide by zero"))
+		}
+		if op == 0x70 {
+			return a % b
+		}
+		return a / b
+	case 0x71:
+		return a & b
+	case 0x72:
+		return a | b
+	case 0x73:
+		return a ^ b
+	case 0x74:
+		return a << (b & 31)
+	case 0x75:
+		return uint32(int32(a) >> (b & 31))
+	case 0x76:
+		return a >> (b & 31)
+	case 0x77:
+		return bits.RotateLeft32(a, int(b&31))
+	default:
+		return bits.RotateLeft32(a, -int(b&31))
+	}
+}
+
+func wasmI64Binary(op uint16, a, b uint64) uint64 {
+	switch op {
+	case 0x7C:
+		return a + b
+	case 0x7D:
+		return a - b
+	case 0x7E:
+		return a * b
+	case 0x7F, 0x81:
+		if b == 0 {
+			panic(wasmTrap("integer divide by zero"))
+		}
+		if op == 0x81 {
+			if b == math.MaxUint64 {
+				return 0
+			}
+			return uint64(int64(a) % int64(b))
+		}
+		if int64(a) == math.MinInt64 && int64(b) == -1 {
+			panic(wasmTrap("integer overflow"))
+		}
+		return uint64(int64(a) / int64(b))
+	case 0x80, 0x82:
+		if b == 0 {
+			panic(wasmTrap("integer divide by zero"))
+		}
+		if op == 0x82 {
+			return a % b
+		}
+		return a / b
+	case 0x83:
+		return a & b
+	case 0x84:
+		return a | b
+	case 0x85:
+		return a ^ b
+	case 0x86:
+		return a << (b & 63)
+	case 0x87:
+		return uint64(int64(a) >> (b & 63))
+	case 0x88:
+		return a >> (b & 63)
+	case 0x89:
+		return bits.RotateLeft64(a, int(b&63))
+	default:
+		return bits.RotateLeft64(a, -int(b&63))
+	}
+}
+
+// wasmFloatUnary computes the rounding or square root of the f32 opcode,
+// rounding the square root once more for a float32 operand.
+func wasmFloatUnary(op uint16, x float64, single bool) float64 {
+	switch op {
+	case 0x8D:
+		return math.Ceil(x)
+	case 0x8E:
+		return math.Floor(x)
+	case 0x8F:
+		return math.Trunc(x)
+	case 0x90:
+		return math.RoundToEven(x)
+	default:
+		if single {
+			return float64(float32(math.Sqrt(x)))
+		}
+		return math.Sqrt(x)
+	}
+}
+
+// wasmTrunc truncates x, trapping unless the result is in [min, max).
+func wasmTrunc(x, min, max float64) float64 {
+	if math.IsNaN(x) {
+		panic(wasmTrap("invalid conversion to integer"))
+	}
+	x = math.Trunc(x)
+	if x < min || x >= max {
+		panic(wasmTrap("integer overflow"))
+	}
+	return x
+}
+
+func wasmTruncU64(x float64) uint64 {
+	x = wasmTrunc(x, 0, 1<<64)
+	if x >= 1<<63 {
+		return uint64(x-(1<<63)) | 1<<63
+	}
+	return uint64(x)
+}
+
+func wasmTruncSat(x, min, max float64) int64 {
+	switch {
+	case math.IsNaN(x):
+		return 0
+	case x <= min:
+		return int64(min)
+	case x >= max:
+		return int64(max)
+	}
+	return int64(math.Trunc(x))
+}
+
+func wasmTruncSatI64(x float64) int64 {
+	switch {
+	case math.IsNaN(x):
+		return 0
+	case x <= math.MinInt64:
+		return math.MinInt64
+	case x >= 1<<63:
+		return math.MaxInt64
+	}
+	return int64(x)
+}
+
+func wasmTruncSatU64(x float64) uint64 {
+	switch {
+	case math.IsNaN(x) || x <= 0:
+		return 0
+	case x >= 1<<64:
+		return math.MaxUint64
+	case x >= 1<<63:
+		return uint64(x-(1<<63)) | 1<<63
+	}
+	return uint64(x)
+}
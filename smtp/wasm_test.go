@@ -0,0 +1,468 @@
+package smtp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testWASMFunc is a function of a test module, whose types are given as
+// strings of i, I, f and F for i32, i64, f32 and f64.
+type testWASMFunc struct {
+	params, results, locals string
+	export                  string
+	code                    []byte
+}
+
+type testWASMModule struct {
+	imports []testWASMFunc // of the module "mproxy", named by export
+	funcs   []testWASMFunc
+	pages   int // of the memory exported as "memory", if not 0
+	data    string
+	table   []uint32
+}
+
+func testLEB(v uint64) []byte {
+	var b []byte
+	for {
+		c := byte(v & 0x7F)
+		v >>= 7
+		if v == 0 {
+			return append(b, c)
+		}
+		b = append(b, c|0x80)
+	}
+}
+
+func testSLEB(v int64) []byte {
+	var b []byte
+	for {
+		c := byte(v & 0x7F)
+		v >>= 7
+		if (v == 0 && c&0x40 == 0) || (v == -1 && c&0x40 != 0) {
+			return append(b, c)
+		}
+		b = append(b, c|0x80)
+	}
+}
+
+func testVec(xs ...[]byte) []byte {
+	b := testLEB(uint64(len(xs)))
+	for _, x := range xs {
+		b = append(b, x...)
+	}
+	return b
+}
+
+func testName(s string) []byte {
+	return append(testLEB(uint64(len(s))), s...)
+}
+
+func testValTypes(s string) []byte {
+	b := testLEB(uint64(len(s)))
+	for _, c := range s {
+		b = append(b, map[rune]byte{'i': wasmI32, 'I': wasmI64, 'f': wasmF32, 'F': wasmF64}[c])
+	}
+	return b
+}
+
+// testI32 returns the instruction i32.const v.
+func testI32(v int32) []byte {
+	return append([]byte{0x41}, testSLEB(int64(v))...)
+}
+
+func testI64(v int64) []byte {
+	return append([]byte{0x42}, testSLEB(v)...)
+}
+
+func testCode(xs ...[]byte) []byte {
+	var b []byte
+	for _, x := range xs {
+		b = append(b, x...)
+	}
+	return b
+}
+
+func (m testWASMModule) bytes() []byte {
+	b := []byte("\x00asm\x01\x00\x00\x00")
+	section := func(id byte, xs ...[]byte) {
+		if len(xs) > 0 {
+			body := testVec(xs...)
+			b = append(append(append(b, id), testLEB(uint64(len(body)))...), body...)
+		}
+	}
+	var types, imports, funcs, exports, codes [][]byte
+	for _, f := range append(append([]testWASMFunc(nil), m.imports...), m.funcs...) {
+		types = append(types, testCode([]byte{0x60}, testValTypes(f.params), testValTypes(f.results)))
+	}
+	for i, f := range m.imports {
+		imports = append(imports, testCode(testName("mproxy"), testName(f.export), []byte{0}, testLEB(uint64(i))))
+	}
+	for i, f := range m.funcs {
+		idx := len(m.imports) + i
+		funcs = append(funcs, testLEB(uint64(idx)))
+		if len(f.export) > 0 {
+			exports = append(exports, testCode(testName(f.export), []byte{0}, testLEB(uint64(idx))))
+		}
+		var locals [][]byte
+		for _, c := range f.locals {
+			locals = append(locals, testCode([]byte{1}, testValTypes(string(c))[1:]))
+		}
+		body := testCode(testVec(locals...), f.code, []byte{0x0B})
+		codes = append(codes, append(testLEB(uint64(len(body))), body...))
+	}
+	section(1, types...)
+	section(2, imports...)
+	section(3, funcs...)
+	if len(m.table) > 0 {
+		section(4, testCode([]byte{0x70, 0}, testLEB(uint64(len(m.table)))))
+	}
+	if m.pages > 0 {
+		section(5, testCode([]byte{0}, testLEB(uint64(m.pages))))
+		exports = append(exports, testCode(testName("memory"), []byte{2, 0}))
+	}
+	section(7, exports...)
+	if len(m.table) > 0 {
+		var elems [][]byte
+		for _, f := range m.table {
+			elems = append(elems, testLEB(uint64(f)))
+		}
+		section(9, testCode([]byte{0}, testI32(0), []byte{0x0B}, testVec(elems...)))
+	}
+	section(10, codes...)
+	if len(m.data) > 0 {
+		section(11, testCode([]byte{0}, testI32(0), []byte{0x0B}, testName(m.data)))
+	}
+	return b
+}
+
+func (m testWASMModule) instantiate(t *testing.T, timeout time.Duration) *wasmInstance {
+	t.Helper()
+	mod, err := parseWASM(m.bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	in, err := mod.instantiate(nil, 4, time.Now().Add(timeout))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return in
+}
+
+func TestWASMNumeric(t *testing.T) {
+	f32 := func(v float32) uint64 { return uint64(math.Float32bits(v)) }
+	fbits := math.Float64bits
+	for _, tc := range []struct {
+		params, results string
+		code            []byte
+		args            []uint64
+		expected        uint64
+		trap            string
+	}{
+		{"ii", "i", []byte{0x20, 0, 0x20, 1, 0x6A}, []uint64{2, 3}, 5, ""},
+		{"ii", "i", []byte{0x20, 0, 0x20, 1, 0x6B}, []uint64{0, 1}, math.MaxUint32, ""},
+		{"ii", "i", []byte{0x20, 0, 0x20, 1, 0x6D}, []uint64{uint64(uint32(0xFFFFFFF9)), 2}, uint64(uint32(0xFFFFFFFD)), ""},
+		{"ii", "i", []byte{0x20, 0, 0x20, 1, 0x6D}, []uint64{1, 0}, 0, "integer divide by zero"},
+		{"ii", "i", []byte{0x20, 0, 0x20, 1, 0x6D}, []uint64{1 << 31, math.MaxUint32}, 0, "integer overflow"},
+		{"ii", "i", []byte{0x20, 0, 0x20, 1, 0x6F}, []uint64{1 << 31, math.MaxUint32}, 0, ""},
+		{"ii", "i", []byte{0x20, 0, 0x20, 1, 0x6F}, []uint64{uint64(uint32(0xFFFFFFF9)), 2}, math.MaxUint32, ""},
+		{"ii", "i", []byte{0x20, 0, 0x20, 1, 0x75}, []uint64{1 << 31, 33}, 0xC0000000, ""},
+		{"ii", "i", []byte{0x20, 0, 0x20, 1, 0x77}, []uint64{0x80000001, 1}, 3, ""},
+		{"ii", "i", []byte{0x20, 0, 0x20, 1, 0x49}, []uint64{1, math.MaxUint32}, 1, ""},
+		{"ii", "i", []byte{0x20, 0, 0x20, 1, 0x48}, []uint64{1, math.MaxUint32}, 0, ""},
+		{"i", "i", []byte{0x20, 0, 0x67}, []uint64{1}, 31, ""},
+		{"i", "i", []byte{0x20, 0, 0xC0}, []uint64{0x80}, 0xFFFFFF80, ""},
+		{"I", "I", []byte{0x20, 0, 0x20, 0, 0x7E}, []uint64{1 << 32}, 0, ""},
+		{"I", "I", []byte{0x20, 0, 0x42, 3, 0x80}, []uint64{10}, 3, ""},
+		{"i", "I", []byte{0x20, 0, 0xAC}, []uint64{math.MaxUint32}, math.MaxUint64, ""},
+		{"I", "i", []byte{0x20, 0, 0xA7}, []uint64{1<<32 | 7}, 7, ""},
+		{"FF", "F", []byte{0x20, 0, 0x20, 1, 0xA0}, []uint64{fbits(1.5), fbits(2.25)}, fbits(3.75), ""},
+		{"FF", "F", []byte{0x20, 0, 0x20, 1, 0xA4}, []uint64{fbits(0), fbits(math.Copysign(0, -1))}, fbits(math.Copysign(0, -1)), ""},
+		{"F", "F", []byte{0x20, 0, 0x9E}, []uint64{fbits(2.5)}, fbits(2), ""},
+		{"F", "F", []byte{0x20, 0, 0x9A}, []uint64{fbits(2.5)}, fbits(-2.5), ""},
+		{"F", "i", []byte{0x20, 0, 0xAA}, []uint64{fbits(-3.9)}, uint64(uint32(0xFFFFFFFD)), ""},
+		{"F", "i", []byte{0x20, 0, 0xAB}, []uint64{fbits(-1)}, 0, "integer overflow"},
+		{"F", "i", []byte{0x20, 0, 0xAB}, []uint64{fbits(-0.5)}, 0, ""},
+		{"F", "i", []byte{0x20, 0, 0xAA}, []uint64{fbits(math.NaN())}, 0, "invalid conversion to integer"},
+		{"F", "i", []byte{0x20, 0, 0xFC, 2}, []uint64{fbits(1e10)}, math.MaxInt32, ""},
+		{"F", "I", []byte{0x20, 0, 0xFC, 7}, []uint64{fbits(-5)}, 0, ""},
+		{"f", "f", []byte{0x20, 0, 0x20, 0, 0x94}, []uint64{f32(1.5)}, f32(2.25), ""},
+		{"f", "F", []byte{0x20, 0, 0xBB}, []uint64{f32(0.5)}, fbits(0.5), ""},
+		{"I", "F", []byte{0x20, 0, 0xBA}, []uint64{math.MaxUint64}, fbits(1 << 64), ""},
+	} {
+		in := testWASMModule{funcs: []testWASMFunc{{params: tc.params, results: tc.results, export: "f", code: tc.code}}}.
+			instantiate(t, time.Second)
+		rs, err := in.invoke("f", tc.args...)
+		if len(tc.trap) > 0 {
+			if err == nil || !strings.Contains(err.Error(), tc.trap) {
+				t.Errorf("% x: expected the trap %s, actual: %v", tc.code, tc.trap, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("% x: %v", tc.code, err)
+			continue
+		}
+		if expected, actual := tc.expected, rs[0]; expected != actual {
+			t.Errorf("% x: expected: %#x, actual: %#x", tc.code, expected, actual)
+		}
+	}
+}
+
+func TestWASMControl(t *testing.T) {
+	in := testWASMModule{
+		funcs: []testWASMFunc{
+			// The factorial by a loop
+			{params: "I", results: "I", locals: "I", export: "fact", code: testCode(
+				testI64(1), []byte{0x21, 1},
+				[]byte{0x02, 0x40, 0x03, 0x40},
+				[]byte{0x20, 0, 0x50, 0x0D, 1},
+				[]byte{0x20, 1, 0x20, 0, 0x7E, 0x21, 1},
+				[]byte{0x20, 0}, testI64(1), []byte{0x7D, 0x21, 0},
+				[]byte{0x0C, 0, 0x0B, 0x0B},
+				[]byte{0x20, 1},
+			)},
+			// The Fibonacci number by recursion
+			{params: "i", results: "i", export: "fib", code: testCode(
+				[]byte{0x20, 0}, testI32(2), []byte{0x48},
+				[]byte{0x04, wasmI32, 0x20, 0, 0x05},
+				[]byte{0x20, 0}, testI32(1), []byte{0x6B, 0x10, 1},
+				[]byte{0x20, 0}, testI32(2), []byte{0x6B, 0x10, 1, 0x6A},
+				[]byte{0x0B},
+			)},
+			// A switch of blocks returning 10, 20 or 30
+			{params: "i", results: "i", export: "switch", code: testCode(
+				[]byte{0x02, 0x40, 0x02, 0x40, 0x02, 0x40},
+				[]byte{0x20, 0, 0x0E, 2, 0, 1, 2},
+				[]byte{0x0B}, testI32(10), []byte{0x0F},
+				[]byte{0x0B}, testI32(20), []byte{0x0F},
+				[]byte{0x0B}, testI32(30),
+			)},
+			// A block yielding a value through br_if
+			{params: "i", results: "i", export: "select", code: testCode(
+				[]byte{0x02, wasmI32}, testI32(7), []byte{0x20, 0, 0x0D, 0, 0x1A}, testI32(8), []byte{0x0B},
+			)},
+			// A call through the table
+			{params: "i", results: "i", export: "indirect", code: testCode(
+				testI32(10), []byte{0x20, 0, 0x11, 5, 0},
+			)},
+			{params: "i", results: "i", code: testCode(testI32(-1), []byte{0x20, 0, 0x6C})},
+		},
+		table: []uint32{1, 5, 0},
+	}.instantiate(t, time.Second)
+	for _, tc := range []struct {
+		name     string
+		arg      uint64
+		expected uint64
+		trap     string
+	}{
+		{"fact", 0, 1, ""},
+		{"fact", 20, 2432902008176640000, ""},
+		{"fib", 20, 6765, ""},
+		{"switch", 0, 10, ""},
+		{"switch", 1, 20, ""},
+		{"switch", 9, 30, ""},
+		{"select", 1, 7, ""},
+		{"select", 0, 8, ""},
+		{"indirect", 0, 55, ""},
+		{"indirect", 1, uint64(uint32(0xFFFFFFF6)), ""},
+		{"indirect", 2, 0, "indirect call type mismatch"},
+		{"indirect", 3, 0, "undefined element"},
+	} {
+		rs, err := in.invoke(tc.name, tc.arg)
+		if len(tc.trap) > 0 {
+			if err == nil || !strings.Contains(err.Error(), tc.trap) {
+				t.Errorf("%s(%d): expected the trap %s, actual: %v", tc.name, tc.arg, tc.trap, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s(%d): %v", tc.name, tc.arg, err)
+			continue
+		}
+		if rs[0] != tc.expected {
+			t.Errorf("%s(%d): expected: %d, actual: %d", tc.name, tc.arg, tc.expected, rs[0])
+		}
+	}
+}
+
+func TestWASMMemory(t *testing.T) {
+	in := testWASMModule{
+		funcs: []testWASMFunc{
+			{params: "i", results: "I", export: "load", code: []byte{0x20, 0, 0x29, 3, 1}},
+			{params: "ii", export: "store8", code: []byte{0x20, 0, 0x20, 1, 0x3A, 0, 0}},
+			{params: "i", results: "i", export: "grow", code: []byte{0x20, 0, 0x40, 0}},
+			{results: "i", export: "size", code: []byte{0x3F, 0}},
+			{params: "iii", export: "copy", code: []byte{0x20, 0, 0x20, 1, 0x20, 2, 0xFC, 10, 0, 0}},
+		},
+		pages: 1,
+		data:  "\x00hello, world",
+	}.instantiate(t, time.Second)
+	call := func(name string, args ...uint64) (uint64, error) {
+		rs, err := in.invoke(name, args...)
+		if len(rs) == 0 {
+			return 0, err
+		}
+		return rs[0], err
+	}
+	if v, err := call("load", 0); err != nil || v != binary.LittleEndian.Uint64([]byte("hello, w")) {
+		t.Errorf("unexpected load: %#x %v", v, err)
+	}
+	if _, err := call("copy", 100, 1, 5); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := call("store8", 103, 'p'); err != nil {
+		t.Fatal(err)
+	}
+	if expected, actual := "helpo", string(in.mem[100:105]); expected != actual {
+		t.Errorf("expected: %s, actual: %s", expected, actual)
+	}
+	if _, err := call("load", wasmPageSize-8); err == nil || !strings.Contains(err.Error(), "out of bounds") {
+		t.Errorf("expected out of bounds, actual: %v", err)
+	}
+	for _, tc := range []struct {
+		name     string
+		args     []uint64
+		expected uint64
+	}{
+		{"grow", []uint64{2}, 1},
+		{"size", nil, 3},
+		{"grow", []uint64{2}, math.MaxUint32},
+		{"grow", []uint64{1}, 3},
+		{"size", nil, 4},
+		{"load", []uint64{wasmPageSize - 8}, 0},
+	} {
+		if v, err := call(tc.name, tc.args...); err != nil || v != tc.expected {
+			t.Errorf("%s%v: expected: %d, actual: %d %v", tc.name, tc.args, tc.expected, v, err)
+		}
+	}
+}
+
+func TestWASMLimits(t *testing.T) {
+	in := testWASMModule{
+		funcs: []testWASMFunc{
+			{export: "spin", code: []byte{0x03, 0x40, 0x0C, 0, 0x0B}},
+			{export: "recurse", code: []byte{0x10, 1}},
+			{export: "unreachable", code: []byte{0x00}},
+			{export: "deep", locals: strings.Repeat("I", wasmMaxLocals), code: []byte{0x10, 3}},
+			{export: "fill", code: testCode(testI32(wasmPageSize-1), testI32(0), testI32(2), []byte{0xFC, 11, 0})},
+		},
+		pages: 1,
+	}.instantiate(t, 50*time.Millisecond)
+	start := time.Now()
+	if _, err := in.invoke("spin"); !errors.Is(err, errWASMTimeout) {
+		t.Errorf("expected the timeout, actual: %v", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("the timeout took %s", d)
+	}
+	in.deadline = time.Now().Add(time.Minute)
+	for name, expected := range map[string]string{
+		"recurse":     "call stack exhausted",
+		"deep":        "call stack exhausted",
+		"unreachable": "unreachable",
+		"fill":        "out of bounds memory access",
+		"missing":     "no function missing",
+	} {
+		if _, err := in.invoke(name); err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("%s: expected %q, actual: %v", name, expected, err)
+		}
+		if in.depth != 0 || in.frames != 0 {
+			t.Errorf("%s: expected the frames to be unwound: %d %d", name, in.depth, in.frames)
+		}
+	}
+
+	mod, err := parseWASM(testWASMModule{pages: 5}.bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mod.instantiate(nil, 4, time.Now().Add(time.Second)); err == nil || !strings.Contains(err.Error(), "exceeds the limit") {
+		t.Errorf("expected the memory to exceed the limit, actual: %v", err)
+	}
+}
+
+func TestParseWASMLimits(t *testing.T) {
+	module := func(id byte, body ...byte) []byte {
+		return append(append([]byte("\x00asm\x01\x00\x00\x00"), id), append(testLEB(uint64(len(body))), body...)...)
+	}
+	for _, tc := range []struct {
+		b        []byte
+		expected string
+	}{
+		{module(4, testCode([]byte{1, 0x70, 0}, testLEB(1<<30))...), "table of 1073741824 elements too large"},
+		{module(5, testCode([]byte{1, 0}, testLEB(wasmMaxPages+1))...), "memory too large"},
+		{module(5, testCode([]byte{1, 1, 0}, testLEB(wasmMaxPages+1))...), "memory too large"},
+		{module(1, testLEB(1<<20)...), "too many entries"},
+		{module(1, testCode([]byte{1, 0x60}, testLEB(wasmMaxParams+1), bytes.Repeat([]byte{wasmI32}, wasmMaxParams+1), []byte{0})...),
+			"too many parameters"},
+		{testWASMModule{funcs: []testWASMFunc{{locals: strings.Repeat("i", wasmMaxLocals+1)}}}.bytes(), "too many locals"},
+	} {
+		if _, err := parseWASM(tc.b); err == nil || !strings.Contains(err.Error(), tc.expected) {
+			t.Errorf("expected %q, actual: %v", tc.expected, err)
+		}
+	}
+}
+
+func TestParseWASMValidation(t *testing.T) {
+	for _, tc := range []struct {
+		fn       testWASMFunc
+		pages    int
+		expected string
+	}{
+		{testWASMFunc{code: testCode(testI64(1), testI64(2), []byte{0x6A, 0x1A})}, 0, "type mismatch: expected (i32)"},
+		{testWASMFunc{code: []byte{0x1A}}, 0, "type mismatch: no operand"},
+		{testWASMFunc{results: "i"}, 0, "type mismatch: no operand"},
+		{testWASMFunc{results: "F", code: testI64(1)}, 0, "type mismatch: expected (f64)"},
+		{testWASMFunc{code: testI32(1)}, 0, "operands left at the end of a block"},
+		{testWASMFunc{code: []byte{0x20, 5, 0x1A}}, 0, "unknown local 5"},
+		{testWASMFunc{params: "I", code: []byte{0x20, 0, 0x21, 1}, locals: "i"}, 0, "type mismatch"},
+		{testWASMFunc{code: []byte{0x0C, 3}}, 0, "unknown label 3"},
+		{testWASMFunc{code: testCode(testI32(0), []byte{0x28, 2, 0, 0x1A})}, 0, "without a memory"},
+		{testWASMFunc{code: testCode(testI32(0), []byte{0x28, 3, 0, 0x1A})}, 1, "alignment larger than natural"},
+		{testWASMFunc{code: testCode(testI32(0), []byte{0x11, 0, 0})}, 0, "without a table"},
+		{testWASMFunc{code: testCode(testI32(1), []byte{0x04, wasmI32}, testI32(2), []byte{0x0B, 0x1A})}, 0, "if without else"},
+		{testWASMFunc{code: []byte{0x02, 0x40, 0x05, 0x0B}}, 0, "else without if"},
+		{testWASMFunc{code: testCode([]byte{0x02, wasmI32, 0x02, 0x40}, testI32(0), []byte{0x0E, 1, 1, 0, 0x0B}, testI32(0), []byte{0x0B, 0x1A})},
+			0, "different arities"},
+		{testWASMFunc{code: testCode(testI32(0), testI32(0), testI32(0), []byte{0xFC, 8, 0, 0})}, 1, "unknown data segment 0"},
+		{testWASMFunc{code: testCode(testI32(0), testI64(0), []byte{0x1B, 0x1A})}, 0, "type mismatch"},
+	} {
+		m := testWASMModule{funcs: []testWASMFunc{tc.fn}, pages: tc.pages}
+		if _, err := parseWASM(m.bytes()); err == nil || !strings.Contains(err.Error(), tc.expected) {
+			t.Errorf("% x: expected %q, actual: %v", tc.fn.code, tc.expected, err)
+		}
+	}
+	// The operands after an unconditional branch are of any type.
+	for _, code := range [][]byte{
+		{0x00, 0x6A, 0x1A},
+		testCode([]byte{0x02, wasmI64}, testI64(1), []byte{0x0C, 0, 0x7C, 0x0B, 0x1A}),
+		testCode([]byte{0x02, 0x40}, testI32(0), []byte{0x0E, 0, 0, 0x1A, 0x0B}),
+	} {
+		if _, err := parseWASM(testWASMModule{funcs: []testWASMFunc{{code: code}}}.bytes()); err != nil {
+			t.Errorf("% x: %v", code, err)
+		}
+	}
+}
+
+func TestParseWASMInvalid(t *testing.T) {
+	valid := testWASMModule{funcs: []testWASMFunc{{export: "f"}}}.bytes()
+	for _, b := range [][]byte{
+		nil,
+		[]byte("\x00asm\x02\x00\x00\x00"),
+		valid[:len(valid)-1],
+		append(append([]byte(nil), valid...), 0x0B),
+		testWASMModule{funcs: []testWASMFunc{{code: []byte{0xD2, 0}}}}.bytes(),
+		testWASMModule{funcs: []testWASMFunc{{code: []byte{0x10, 9}}}}.bytes(),
+		testWASMModule{funcs: []testWASMFunc{{code: []byte{0x05}}}}.bytes(),
+		testWASMModule{funcs: []testWASMFunc{{code: []byte{0x02, 0x40}}}}.bytes(),
+		testWASMModule{funcs: []testWASMFunc{{code: testCode(testI32(0), []byte{0x41, 0x80, 0x80, 0x80, 0x80, 0x70})}}}.bytes(),
+	} {
+		if _, err := parseWASM(b); err == nil {
+			t.Errorf("expected an error: % x", b)
+		}
+	}
+}
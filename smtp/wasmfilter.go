@@ -0,0 +1,216 @@
+package smtp
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// WASMFilter is a message filter compiled to WebAssembly, which may be
+// written in any language targeting it. Register adds a hook which runs the
+// filter before each message is sent, in a fresh instance whose failures,
+// traps and timeouts never reach other messages or the server.
+//
+// The module exports its memory and the functions
+//
+//	alloc(len i32) -> i32
+//	filter(ptr i32, len i32) -> i32
+//
+// The transaction, as written by SMTPState.WriteTo, is copied to the address
+// returned by alloc and given to filter, which returns one of the actions
+// WASMAccept, WASMReject, WASMTempFail or WASMQuarantine. The module may
+// import these functions of the module "mproxy":
+//
+//	reply(code i32, ptr i32, len i32)   the reply of a rejection
+//	add_header(name_ptr i32, name_len i32, value_ptr i32, value_len i32)
+//	add_tag(ptr i32, len i32)
+//	log(ptr i32, len i32)
+//
+// Headers and tags are applied only when the message is accepted or
+// quarantined. A filter failing to return an action within Timeout, or
+// growing its memory beyond MaxMemory, fails the message with a temporary
+// error unless FailOpen is set.
+type WASMFilter struct {
+	Name      string
+	Timeout   time.Duration
+	MaxMemory int64
+	FailOpen  bool
+
+	module *wasmModule
+}
+
+const (
+	WASMAccept = iota
+	WASMReject
+	WASMTempFail
+	WASMQuarantine
+)
+
+const (
+	DefaultWASMTimeout   = 5 * time.Second
+	DefaultWASMMaxMemory = 64 << 20
+
+	wasmRejectReply   = "550 5.7.1 Message rejected by filter"
+	wasmTempFailReply = "451 4.7.1 Message deferred by filter"
+)
+
+var (
+	wasmI32x2 = wasmFuncType{params: []byte{wasmI32, wasmI32}}
+	wasmI32x3 = wasmFuncType{params: []byte{wasmI32, wasmI32, wasmI32}}
+	wasmI32x4 = wasmFuncType{params: []byte{wasmI32, wasmI32, wasmI32, wasmI32}}
+)
+
+// ParseWASMFilter reads a module in the binary format, which must export
+// the memory and the functions of the filter.
+func ParseWASMFilter(r io.Reader) (*WASMFilter, error) {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	m, err := parseWASM(b)
+	if err != nil {
+		return nil, err
+	}
+	if e, ok := m.exports["memory"]; !ok || e.kind != 2 || m.memory == nil {
+		return nil, errors.New("wasm: no memory is exported")
+	}
+	for name, typ := range map[string]wasmFuncType{
+		"alloc":  {params: []byte{wasmI32}, results: []byte{wasmI32}},
+		"filter": {params: []byte{wasmI32, wasmI32}, results: []byte{wasmI32}},
+	} {
+		e, ok := m.exports[name]
+		if !ok || e.kind != 0 {
+			return nil, fmt.Errorf("wasm: no function %s is exported", name)
+		}
+		if t, _ := m.funcType(e.index); !t.equal(typ) {
+			return nil, fmt.Errorf("wasm: %s is not %s", name, typ)
+		}
+	}
+	return &WASMFilter{
+		Timeout:   DefaultWASMTimeout,
+		MaxMemory: DefaultWASMMaxMemory,
+		module:    m,
+	}, nil
+}
+
+func (f *WASMFilter) Register(h *Hooks) {
+	h.OnData(func(conn *SMTPConnection) string {
+		return f.data(conn)
+	})
+}
+
+func (f *WASMFilter) data(conn *SMTPConnection) string {
+	st := conn.State()
+	res, err := f.Run(st)
+	if err != nil {
+		conn.Logger().Warn("wasm filter failed", "filter", f.Name, "error", err.Error())
+		if f.FailOpen {
+			return ""
+		}
+		return conn.Config().Catalog.Reply("message.local_error")
+	}
+	for _, x := range res.Logs {
+		conn.Logger().Info("wasm filter", "filter", f.Name, "message", x)
+	}
+	switch res.Action {
+	case WASMReject, WASMTempFail:
+		return res.Reply
+	case WASMQuarantine:
+		st.Quarantined = true
+	}
+	for _, x := range res.Headers {
+		st.Headers = append(st.Headers, x[0]+": "+x[1])
+	}
+	for _, tag := range res.Tags {
+		if !containsFold(st.Tags, tag) {
+			st.Tags = append(st.Tags, tag)
+		}
+	}
+	return ""
+}
+
+// WASMResult is what a filter decided about a message.
+type WASMResult struct {
+	Action  int
+	Reply   string
+	Headers [][2]string
+	Tags    []string
+	Logs    []string
+}
+
+// Run runs the filter for the transaction, without changing it.
+func (f *WASMFilter) Run(st *SMTPState) (WASMResult, error) {
+	var res WASMResult
+	var b bytes.Buffer
+	if _, err := st.WriteTo(&b); err != nil {
+		return res, err
+	}
+	str := func(in *wasmInstance, ptr, n uint64) string {
+		return string(in.memory(uint64(uint32(ptr)), uint64(uint32(n))))
+	}
+	hosts := map[string]wasmHostFunc{
+		"mproxy.reply": {typ: wasmI32x3, fn: func(in *wasmInstance, args []uint64) []uint64 {
+			code := int32(args[0])
+			if code < 400 || code > 599 {
+				panic(wasmTrap(fmt.Sprintf("invalid reply code %d", code)))
+			}
+			res.Reply = fmt.Sprintf("%d %s", code, oneLine(str(in, args[1], args[2])))
+			return nil
+		}},
+		"mproxy.add_header": {typ: wasmI32x4, fn: func(in *wasmInstance, args []uint64) []uint64 {
+			name := str(in, args[0], args[1])
+			if len(name) == 0 || strings.ContainsAny(name, ": \t\r\n") {
+				panic(wasmTrap(fmt.Sprintf("invalid header name %q", name)))
+			}
+			res.Headers = append(res.Headers, [2]string{name, oneLine(str(in, args[2], args[3]))})
+			return nil
+		}},
+		"mproxy.add_tag": {typ: wasmI32x2, fn: func(in *wasmInstance, args []uint64) []uint64 {
+			tag := str(in, args[0], args[1])
+			if !validTag(tag) {
+				panic(wasmTrap(fmt.Sprintf("invalid tag %q", tag)))
+			}
+			res.Tags = append(res.Tags, tag)
+			return nil
+		}},
+		"mproxy.log": {typ: wasmI32x2, fn: func(in *wasmInstance, args []uint64) []uint64 {
+			res.Logs = append(res.Logs, oneLine(str(in, args[0], args[1])))
+			return nil
+		}},
+	}
+	in, err := f.module.instantiate(hosts, uint32(f.MaxMemory/wasmPageSize), time.Now().Add(f.Timeout))
+	if err != nil {
+		return res, err
+	}
+	rs, err := in.invoke("alloc", uint64(b.Len()))
+	if err != nil {
+		return res, err
+	}
+	ptr := uint64(uint32(rs[0]))
+	if ptr+uint64(b.Len()) > uint64(len(in.mem)) {
+		return res, fmt.Errorf("wasm: alloc returned %d out of the memory", ptr)
+	}
+	copy(in.mem[ptr:], b.Bytes())
+	if rs, err = in.invoke("filter", ptr, uint64(b.Len())); err != nil {
+		return res, err
+	}
+	res.Action = int(int32(rs[0]))
+	switch res.Action {
+	case WASMAccept, WASMQuarantine:
+		res.Reply = ""
+	case WASMReject:
+		if !strings.HasPrefix(res.Reply, "5") {
+			res.Reply = wasmRejectReply
+		}
+	case WASMTempFail:
+		if !strings.HasPrefix(res.Reply, "4") {
+			res.Reply = wasmTempFailReply
+		}
+	default:
+		return res, fmt.Errorf("wasm: unknown action %d", res.Action)
+	}
+	return res, nil
+}
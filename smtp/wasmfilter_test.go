@@ -0,0 +1,175 @@
+package smtp
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testWASMFilter returns a filter whose alloc returns 1024, and whose
+// filter runs the code.
+func testWASMFilter(t *testing.T, filter []byte) *WASMFilter {
+	t.Helper()
+	m := testWASMModule{
+		imports: []testWASMFunc{
+			{params: "iii", export: "reply"},
+			{params: "iiii", export: "add_header"},
+			{params: "ii", export: "add_tag"},
+			{params: "ii", export: "log"},
+		},
+		funcs: []testWASMFunc{
+			{params: "i", results: "i", export: "alloc", code: testI32(1024)},
+			{params: "ii", results: "i", locals: "i", export: "filter", code: filter},
+		},
+		pages: 1,
+		data:  "X-Filter" + "clean" + "5.7.1 No spam",
+	}
+	f, err := ParseWASMFilter(bytes.NewReader(m.bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Name = "test"
+	return f
+}
+
+func testWASMFilterSession(t *testing.T, f *WASMFilter, body string) (string, *SMTPState) {
+	t.Helper()
+	conn := NewMockConn([]byte("EHLO localhost\r\n" +
+		"MAIL FROM: <foo@example.net>\r\n" +
+		"RCPT TO: <user1@example.net>\r\n" +
+		"DATA\r\n" +
+		"Subject: Hello\r\n" +
+		"\r\n" +
+		body + "\r\n" +
+		".\r\n" +
+		"QUIT\r\n"))
+	var sent *SMTPState
+	h := NewSMTPHandler(conn, func(st *SMTPState) error {
+		sent = &SMTPState{Headers: st.Headers, Tags: st.Tags, Quarantined: st.Quarantined}
+		return nil
+	})
+	h.Config.Hooks = &Hooks{}
+	f.Register(h.Config.Hooks)
+	h.Run()
+	return string(conn.CloneOutputBuffer()), sent
+}
+
+func TestWASMFilter(t *testing.T) {
+	// Rejects a message containing "spam", or adds a header and a tag.
+	f := testWASMFilter(t, testCode(
+		[]byte{0x02, 0x40, 0x03, 0x40},
+		[]byte{0x20, 2}, testI32(4), []byte{0x6A, 0x20, 1, 0x4B, 0x0D, 1},
+		[]byte{0x20, 0, 0x20, 2, 0x6A, 0x28, 2, 0}, testI32(0x6d617073), []byte{0x46},
+		[]byte{0x04, 0x40}, testI32(550), testI32(13), testI32(13), []byte{0x10, 0}, testI32(1), []byte{0x0F, 0x0B},
+		[]byte{0x20, 2}, testI32(1), []byte{0x6A, 0x21, 2, 0x0C, 0, 0x0B, 0x0B},
+		testI32(0), testI32(8), testI32(8), testI32(5), []byte{0x10, 1},
+		testI32(8), testI32(5), []byte{0x10, 2},
+		testI32(8), testI32(5), []byte{0x10, 3},
+		testI32(0),
+	))
+	out, sent := testWASMFilterSession(t, f, "Buy cheap spam")
+	if expected, actual := "220 250 250 250 354 550 221", replyCodes([]byte(out)); expected != actual {
+		t.Errorf("expected: %s, actual: %s", expected, actual)
+	}
+	if !strings.Contains(out, "550 5.7.1 No spam\r\n") || sent != nil {
+		t.Errorf("expected the message to be rejected: %s", out)
+	}
+	out, sent = testWASMFilterSession(t, f, "Hello")
+	if expected, actual := "220 250 250 250 354 250 221", replyCodes([]byte(out)); expected != actual {
+		t.Errorf("expected: %s, actual: %s", expected, actual)
+	}
+	if sent == nil {
+		t.Fatal("expected the message to be sent")
+	}
+	if expected, actual := "Subject: Hello,X-Filter: clean", strings.Join(sent.Headers, ","); expected != actual {
+		t.Errorf("expected: %s, actual: %s", expected, actual)
+	}
+	if !containsFold(sent.Tags, "clean") || sent.Quarantined {
+		t.Errorf("unexpected tags: %v", sent.Tags)
+	}
+}
+
+func TestWASMFilterActions(t *testing.T) {
+	for _, tc := range []struct {
+		code        []byte
+		failOpen    bool
+		expected    string
+		quarantined bool
+	}{
+		{testI32(2), false, "451 4.7.1 Message deferred by filter", false},
+		{testCode(testI32(450), testI32(13), testI32(5), []byte{0x10, 0}, testI32(2)), false, "450 5.7.1", false},
+		{testCode(testI32(550), testI32(13), testI32(5), []byte{0x10, 0}, testI32(2)), false, "451 4.7.1 Message deferred by filter", false},
+		{testI32(1), false, "550 5.7.1 Message rejected by filter", false},
+		{testI32(3), false, "250 ", true},
+		{testI32(9), false, "451 4.3.0", false},
+		{testI32(9), true, "250 ", false},
+		{[]byte{0x00}, false, "451 4.3.0", false},
+		{testCode(testI32(200), testI32(0), testI32(0), []byte{0x10, 0}, testI32(1)), false, "451 4.3.0", false},
+		{testCode(testI32(0), testI32(1<<20), []byte{0x10, 3}, testI32(0)), false, "451 4.3.0", false},
+		{[]byte{0x03, 0x40, 0x0C, 0, 0x0B, 0x41, 0}, false, "451 4.3.0", false},
+		{[]byte{0x03, 0x40, 0x0C, 0, 0x0B, 0x41, 0}, true, "250 ", false},
+	} {
+		f := testWASMFilter(t, tc.code)
+		f.Timeout = 50 * time.Millisecond
+		f.FailOpen = tc.failOpen
+		out, sent := testWASMFilterSession(t, f, "Hello")
+		lines := strings.Split(out, "\r\n")
+		if actual := lines[len(lines)-3]; !strings.HasPrefix(actual, tc.expected) {
+			t.Errorf("% x: expected: %s, actual: %s", tc.code, tc.expected, actual)
+		}
+		if sent != nil && sent.Quarantined != tc.quarantined {
+			t.Errorf("% x: expected quarantined: %v", tc.code, tc.quarantined)
+		}
+	}
+}
+
+func TestWASMFilterMemory(t *testing.T) {
+	// Grows the memory by 2 pages, failing over the limit.
+	f := testWASMFilter(t, testCode(testI32(2), []byte{0x40, 0}, testI32(-1), []byte{0x46}))
+	st := &SMTPState{ReturnTo: "foo@example.net"}
+	res, err := f.Run(st)
+	if err != nil || res.Action != WASMAccept {
+		t.Errorf("expected the memory to grow: %v %v", res, err)
+	}
+	f.MaxMemory = 2 * wasmPageSize
+	res, err = f.Run(st)
+	if err != nil || res.Action != WASMReject {
+		t.Errorf("expected the memory not to grow: %v %v", res, err)
+	}
+}
+
+func TestParseWASMFilterInvalid(t *testing.T) {
+	for _, m := range []testWASMModule{
+		{funcs: []testWASMFunc{
+			{params: "i", results: "i", export: "alloc", code: testI32(0)},
+			{params: "ii", results: "i", export: "filter", code: testI32(0)},
+		}},
+		{funcs: []testWASMFunc{
+			{params: "i", results: "i", export: "alloc", code: testI32(0)},
+		}, pages: 1},
+		{funcs: []testWASMFunc{
+			{params: "i", results: "i", export: "alloc", code: testI32(0)},
+			{params: "i", results: "i", export: "filter", code: testI32(0)},
+		}, pages: 1},
+	} {
+		if _, err := ParseWASMFilter(bytes.NewReader(m.bytes())); err == nil {
+			t.Errorf("expected an error: %+v", m)
+		}
+	}
+	m := testWASMModule{
+		imports: []testWASMFunc{{params: "i", export: "reply"}},
+		funcs: []testWASMFunc{
+			{params: "i", results: "i", export: "alloc", code: testI32(0)},
+			{params: "ii", results: "i", export: "filter", code: testI32(0)},
+		},
+		pages: 1,
+	}
+	f, err := ParseWASMFilter(bytes.NewReader(m.bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Run(&SMTPState{}); err == nil || !strings.Contains(err.Error(), "import mproxy.reply") {
+		t.Errorf("expected the import to mismatch, actual: %v", err)
+	}
+}
@@ -0,0 +1,155 @@
+package smtp
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// Webhook posts accepted messages as JSON to URL. The payload is signed
+// with Secret in the X-Mproxy-Signature header as "sha256=<hex>".
+type Webhook struct {
+	URL          string
+	Secret       string
+	EnvelopeOnly bool
+
+	// Recipients are glob patterns, one of which a recipient has to match
+	// for the message to be posted. Empty matches every message.
+	Recipients []string
+
+	MaxRetries int
+	RetryDelay time.Duration
+	Client     *http.Client
+}
+
+type webhookPayload struct {
+	MessageID  string    `json:"message_id,omitempty"`
+	ReturnTo   string    `json:"return_to"`
+	Recipients []string  `json:"recipients"`
+	Tags       []string  `json:"tags,omitempty"`
+	Headers    []string  `json:"headers,omitempty"`
+	Body       string    `json:"body,omitempty"`
+	Received   time.Time `json:"received"`
+
+	Connection *ConnectionInfo `json:"connection,omitempty"`
+}
+
+func NewWebhook(url string) *Webhook {
+	return &Webhook{
+		URL:        url,
+		MaxRetries: 3,
+		RetryDelay: time.Second,
+		Client:     &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (w *Webhook) matches(st *SMTPState) bool {
+	if len(w.Recipients) == 0 {
+		return true
+	}
+	for _, rcpt := range st.Recipients {
+		for _, x := range w.Recipients {
+			if sieveMatch(":matches", rcpt, x) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (w *Webhook) sign(payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(w.Secret))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Post sends the payload, retrying with a doubling delay on network errors
+// and 5xx responses.
+func (w *Webhook) Post(payload []byte) error {
+	delay := w.RetryDelay
+	var err error
+	for i := 0; i <= w.MaxRetries; i++ {
+		if i > 0 {
+			time.Sleep(delay)
+			delay *= 2
+		}
+		var req *http.Request
+		req, err = http.NewRequest("POST", w.URL, bytes.NewReader(payload))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		if len(w.Secret) > 0 {
+			req.Header.Set("X-Mproxy-Signature", w.sign(payload))
+		}
+		var resp *http.Response
+		resp, err = w.Client.Do(req)
+		if err != nil {
+			continue
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode < 300 {
+			return nil
+		}
+		err = fmt.Errorf("smtp: webhook %s: %s", w.URL, resp.Status)
+		if resp.StatusCode < 500 {
+			return err
+		}
+	}
+	return err
+}
+
+// WithWebhooks returns a Send function which calls send, then posts the
+// message to the matching webhooks in the background.
+func WithWebhooks(send func(st *SMTPState) error, hooks ...*Webhook) func(st *SMTPState) error {
+	return func(st *SMTPState) error {
+		if err := send(st); err != nil {
+			return err
+		}
+		var full, envelope []byte
+		for _, w := range hooks {
+			if !w.matches(st) {
+				continue
+			}
+			var payload []byte
+			if w.EnvelopeOnly {
+				if envelope == nil {
+					envelope = newWebhookPayload(st, false)
+				}
+				payload = envelope
+			} else {
+				if full == nil {
+					full = newWebhookPayload(st, true)
+				}
+				payload = full
+			}
+			go w.Post(payload)
+		}
+		return nil
+	}
+}
+
+func newWebhookPayload(st *SMTPState, withMessage bool) []byte {
+	p := webhookPayload{
+		MessageID:  st.MessageID,
+		ReturnTo:   st.ReturnTo,
+		Recipients: st.Recipients,
+		Tags:       st.Tags,
+		Received:   time.Now(),
+		Connection: st.connection(),
+	}
+	if withMessage {
+		p.Headers = st.Headers
+		body, _ := io.ReadAll(st.Content())
+		p.Body = string(body)
+	}
+	b, _ := json.Marshal(p)
+	return b
+}
@@ -0,0 +1,66 @@
+package smtp
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWebhook(t *testing.T) {
+	type request struct {
+		signature string
+		payload   webhookPayload
+	}
+	requests := make(chan request, 2)
+	failures := 1
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failures > 0 {
+			failures--
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		b, _ := io.ReadAll(r.Body)
+		var p webhookPayload
+		json.Unmarshal(b, &p)
+		requests <- request{r.Header.Get("X-Mproxy-Signature"), p}
+	}))
+	defer srv.Close()
+
+	hook := NewWebhook(srv.URL)
+	hook.Secret = "secret"
+	hook.RetryDelay = time.Millisecond
+	ignored := NewWebhook(srv.URL)
+	ignored.Recipients = []string{"*@example.org"}
+	send := WithWebhooks(func(st *SMTPState) error {
+		return nil
+	}, hook, ignored)
+
+	st := &SMTPState{}
+	st.Reset()
+	st.ReturnTo = "foo@example.net"
+	st.Recipients = []string{"user1@example.net"}
+	st.Headers = []string{"Subject: Webhook"}
+	st.SetContent([]byte("Hello\r\n"))
+	if err := send(st); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case req := <-requests:
+		if req.payload.ReturnTo != "foo@example.net" || req.payload.Body != "Hello\r\n" {
+			t.Errorf("unexpected payload: %v", req.payload)
+		}
+		if len(req.signature) != len("sha256=")+64 {
+			t.Errorf("unexpected signature: %s", req.signature)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("webhook was not posted")
+	}
+	select {
+	case req := <-requests:
+		t.Errorf("unexpected request: %v", req.payload)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
@@ -0,0 +1,72 @@
+package smtp
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+var ErrOverloaded = errors.New("smtp: worker pool overloaded")
+
+// WorkerPool runs sessions on a fixed number of workers instead of a
+// goroutine per connection, for predictable resource usage under load.
+// Connections wait in a queue of QueueSize while the workers are busy, and
+// are replied 421 and closed once the queue is full.
+type WorkerPool struct {
+	Workers   int
+	QueueSize int
+
+	jobs chan *SMTPHandler
+	wg   sync.WaitGroup
+}
+
+// NewWorkerPool starts the workers.
+func NewWorkerPool(workers, queueSize int) *WorkerPool {
+	p := &WorkerPool{
+		Workers:   workers,
+		QueueSize: queueSize,
+		jobs:      make(chan *SMTPHandler, queueSize),
+	}
+	p.wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go p.work()
+	}
+	return p
+}
+
+func (p *WorkerPool) work() {
+	defer p.wg.Done()
+	for h := range p.jobs {
+		h.Run()
+	}
+}
+
+// Serve queues the session of the handler. When the queue is full, the
+// connection is shed with a 421 reply and ErrOverloaded is returned.
+func (p *WorkerPool) Serve(h *SMTPHandler) error {
+	select {
+	case p.jobs <- h:
+		return nil
+	default:
+	}
+	h.Config.Metrics.add("mproxy_connections_shed_total", 1)
+	conn := h.Conn()
+	if l := h.Config.SecurityLog; l != nil {
+		ip := ""
+		if addr := conn.RemoteAddr(); addr != nil {
+			ip, _, _ = net.SplitHostPort(addr.String())
+		}
+		l.Log(EventRateLimit, ip, "limit", "connections")
+	}
+	conn.SetWriteDeadline(time.Now().Add(time.Second))
+	conn.Write([]byte("421 4.3.2 Too many connections, try again later\r\n"))
+	h.Close()
+	return ErrOverloaded
+}
+
+// Close stops the workers once the sessions queued are finished.
+func (p *WorkerPool) Close() {
+	close(p.jobs)
+	p.wg.Wait()
+}
@@ -0,0 +1,53 @@
+package smtp
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestWorkerPool(t *testing.T) {
+	p := NewWorkerPool(1, 1)
+	started, block := make(chan struct{}), make(chan struct{})
+	h1 := NewSMTPHandler(NewMockConn([]byte("QUIT\r\n")), nil)
+	h1.Config.Hooks = &Hooks{}
+	h1.Config.Hooks.OnConnect(func(conn *SMTPConnection) string {
+		close(started)
+		<-block
+		return ""
+	})
+	if err := p.Serve(h1); err != nil {
+		t.Fatal(err)
+	}
+	<-started
+
+	// queued while the worker is busy, then shed
+	queued := NewMockConn([]byte("QUIT\r\n"))
+	shed := NewMockConn([]byte("QUIT\r\n"))
+	metrics := NewMetrics()
+	if err := p.Serve(NewSMTPHandler(queued, nil)); err != nil {
+		t.Fatal(err)
+	}
+	var log strings.Builder
+	h := NewSMTPHandler(shed, nil)
+	h.Config.Metrics = metrics
+	h.Config.SecurityLog = NewSecurityLogger(&log)
+	if err := p.Serve(h); err != ErrOverloaded {
+		t.Errorf("expected: %v, actual: %v", ErrOverloaded, err)
+	}
+	if expected := "421 4.3.2 "; !strings.HasPrefix(string(shed.CloneOutputBuffer()), expected) || !shed.IsClosed() {
+		t.Errorf("unexpected reply: %s", shed.CloneOutputBuffer())
+	}
+	var b strings.Builder
+	metrics.WriteTo(&b)
+	if !strings.Contains(b.String(), "mproxy_connections_shed_total 1\n") {
+		t.Errorf("expected the shed connection: %s", b.String())
+	}
+	if !strings.Contains(log.String(), "event=rate_limit ip=- limit=connections\n") {
+		t.Errorf("expected a rate limit event: %s", log.String())
+	}
+	close(block)
+	p.Close()
+	if actual := replyCodes(queued.CloneOutputBuffer()); !strings.HasPrefix(actual, "220 221") {
+		t.Errorf("unexpected replies of the queued session: %s", actual)
+	}
+}
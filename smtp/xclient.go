@@ -0,0 +1,176 @@
+package smtp
+
+import (
+	"net"
+	"strconv"
+	"strings"
+)
+
+var xclientAttributes = map[string]bool{
+	"NAME": true, "ADDR": true, "PORT": true, "PROTO": true,
+	"HELO": true, "LOGIN": true, "DESTADDR": true, "DESTPORT": true,
+}
+
+// ParseNetworks parses comma separated addresses or CIDR blocks.
+func ParseNetworks(s string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0)
+	for _, x := range strings.Split(s, ",") {
+		x = strings.TrimSpace(x)
+		if len(x) == 0 {
+			continue
+		}
+		if !strings.Contains(x, "/") {
+			if strings.Contains(x, ":") {
+				x += "/128"
+			} else {
+				x += "/32"
+			}
+		}
+		_, ipnet, err := net.ParseCIDR(x)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, ipnet)
+	}
+	return networks, nil
+}
+
+func containsIP(networks []*net.IPNet, addr net.Addr) bool {
+	if addr == nil {
+		return false
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	for _, x := range networks {
+		if ip != nil && x.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// decodeXText decodes an xtext as defined in RFC 3461.
+func decodeXText(s string) (string, bool) {
+	if !isXText(s) {
+		return "", false
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '+' {
+			n, _ := strconv.ParseUint(s[i+1:i+3], 16, 8)
+			b.WriteByte(byte(n))
+			i += 2
+		} else {
+			b.WriteByte(s[i])
+		}
+	}
+	return b.String(), true
+}
+
+// xclientTrusted reports whether the peer of the connection, rather than
+// the client it may stand for, is allowed to use XCLIENT.
+func xclientTrusted(conn *SMTPConnection) bool {
+	return containsIP(conn.Config().XClientNetworks, peerAddr(conn.handler.Conn()))
+}
+
+type XClientCommand struct {
+}
+
+// Execute overrides the attributes of the client with those given by a
+// trusted proxy as in the Postfix XCLIENT extension. The session starts
+// over with a new greeting. A value of [UNAVAILABLE] or [TEMPUNAVAIL]
+// clears the attribute.
+func (cmnd *XClientCommand) Execute(conn *SMTPConnection, line string) error {
+	if !xclientTrusted(conn) {
+		return conn.Reply("xclient.denied")
+	}
+	st := conn.State()
+	if st.InTransaction() {
+		return conn.Reply("transaction.in_progress")
+	}
+	cmd, err := ParseCommand(line)
+	if err != nil || len(cmd.Arg) == 0 {
+		return conn.Reply("xclient.syntax")
+	}
+	attrs := make(map[string]string)
+	for _, x := range strings.Fields(cmd.Arg) {
+		kv := strings.SplitN(x, "=", 2)
+		name := strings.ToUpper(kv[0])
+		if len(kv) != 2 || !xclientAttributes[name] {
+			return conn.Reply("xclient.bad_attribute", kv[0])
+		}
+		v, ok := decodeXText(kv[1])
+		if !ok {
+			return conn.Reply("xclient.bad_value", x)
+		}
+		if v == "[UNAVAILABLE]" || v == "[TEMPUNAVAIL]" {
+			v = ""
+		}
+		attrs[name] = v
+	}
+	remote, ok1 := joinAddr(st.RemoteAddr, attrs, "ADDR", "PORT")
+	local, ok2 := joinAddr(st.LocalAddr, attrs, "DESTADDR", "DESTPORT")
+	if !ok1 || !ok2 {
+		return conn.Reply("xclient.bad_address")
+	}
+	st.RemoteAddr, st.LocalAddr = remote, local
+	if v, ok := attrs["NAME"]; ok {
+		st.RemoteName = v
+	}
+	if v, ok := attrs["HELO"]; ok {
+		st.xclientHelo = v
+	}
+	if v, ok := attrs["PROTO"]; ok {
+		switch strings.ToUpper(v) {
+		case "SMTP":
+			st.xclientProto = "HELO"
+		case "ESMTP":
+			st.xclientProto = "EHLO"
+		case "":
+			st.xclientProto = ""
+		default:
+			return conn.Reply("xclient.bad_protocol", v)
+		}
+	}
+	if v, ok := attrs["LOGIN"]; ok {
+		st.Username = v
+	}
+	st.Hello = ""
+	st.ClientName = ""
+	st.Reset()
+	return conn.WriteRaw("220 " + st.ServerName + " Simple Mail Transfer service ready")
+}
+
+// joinAddr replaces the host and the port of addr with the attributes. It
+// returns an empty string if the host is unavailable.
+func joinAddr(addr string, attrs map[string]string, hostKey, portKey string) (string, bool) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		host, port = "", ""
+	}
+	if v, ok := attrs[hostKey]; ok {
+		if strings.HasPrefix(strings.ToUpper(v), "IPV6:") {
+			v = v[5:]
+		}
+		if len(v) > 0 && net.ParseIP(v) == nil {
+			return "", false
+		}
+		host = v
+	}
+	if v, ok := attrs[portKey]; ok {
+		if _, err := strconv.ParseUint(v, 10, 16); len(v) > 0 && err != nil {
+			return "", false
+		}
+		port = v
+	}
+	if len(host) == 0 {
+		return "", true
+	}
+	if len(port) == 0 {
+		port = "0"
+	}
+	return net.JoinHostPort(host, port), true
+}
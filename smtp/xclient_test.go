@@ -0,0 +1,70 @@
+package smtp
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestXClient(t *testing.T) {
+	networks, err := ParseNetworks("192.0.2.0/24, 2001:db8::1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ParseNetworks("192.0.2.0/33"); err == nil {
+		t.Errorf("expected an error")
+	}
+	conn := &tcpMockConn{NewMockConn([]byte("EHLO proxy.example.net\r\n" +
+		"XCLIENT NAME=client.example.org ADDR=198.51.100.1 PORT=54321 HELO=client.example.org LOGIN=foo\r\n" +
+		"EHLO proxy.example.net\r\n" +
+		"MAIL FROM:<foo@example.org>\r\n" +
+		"XCLIENT ADDR=198.51.100.2\r\n" +
+		"RSET\r\n" +
+		"XCLIENT ADDR=example.org\r\n" +
+		"XCLIENT USER=foo\r\n" +
+		"XCLIENT NAME=[UNAVAILABLE] ADDR=IPV6:2001:db8::2 PROTO=SMTP\r\n" +
+		"EHLO proxy.example.net\r\n" +
+		"QUIT\r\n")), "192.0.2.1:1025"}
+	h := NewSMTPHandler(conn, nil)
+	h.Config.ServerName = "mx.example.com"
+	h.Config.XClientNetworks = networks
+	var states []SMTPState
+	h.Config.Hooks = &Hooks{}
+	h.Config.Hooks.OnHelo(func(conn *SMTPConnection) string {
+		states = append(states, *conn.State())
+		return ""
+	})
+	h.Run()
+	expected := "220 250 220 250 250 503 250 501 501 220 250 221"
+	if actual := replyCodes(conn.CloneOutputBuffer()); actual != expected {
+		t.Errorf("expected: %s, actual: %s", expected, actual)
+	}
+	if !strings.Contains(string(conn.CloneOutputBuffer()), "250-XCLIENT ") {
+		t.Errorf("expected XCLIENT: %s", conn.CloneOutputBuffer())
+	}
+	if len(states) != 3 {
+		t.Fatalf("unexpected states: %v", states)
+	}
+	st := states[1]
+	actual := strings.Join([]string{st.RemoteAddr, st.RemoteName, st.ClientName, st.Username, st.Hello}, " ")
+	if expected := "198.51.100.1:54321 client.example.org client.example.org foo EHLO"; actual != expected {
+		t.Errorf("expected: %s, actual: %s", expected, actual)
+	}
+	st = states[2]
+	actual = strings.Join([]string{st.RemoteAddr, st.RemoteName, st.ClientName, st.Hello}, " ")
+	if expected := "[2001:db8::2]:54321  client.example.org HELO"; actual != expected {
+		t.Errorf("expected: %s, actual: %s", expected, actual)
+	}
+
+	conn = &tcpMockConn{NewMockConn([]byte("EHLO localhost\r\n" +
+		"XCLIENT ADDR=198.51.100.1\r\n" +
+		"QUIT\r\n")), "203.0.113.1:1025"}
+	h = NewSMTPHandler(conn, nil)
+	h.Config.XClientNetworks = networks
+	h.Run()
+	if expected, actual := "220 250 550 221", replyCodes(conn.CloneOutputBuffer()); expected != actual {
+		t.Errorf("expected: %s, actual: %s", expected, actual)
+	}
+	if strings.Contains(string(conn.CloneOutputBuffer()), "XCLIENT") {
+		t.Errorf("unexpected XCLIENT: %s", conn.CloneOutputBuffer())
+	}
+}
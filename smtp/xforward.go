@@ -0,0 +1,88 @@
+package smtp
+
+import (
+	"fmt"
+	"net"
+	netsmtp "net/smtp"
+	"strings"
+)
+
+// encodeXText encodes s as an xtext as defined in RFC 3461.
+func encodeXText(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c < '!' || c > '~' || c == '+' || c == '=' {
+			fmt.Fprintf(&b, "+%02X", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// xforwardAttributes returns the attributes of the client of the
+// transaction for the Postfix XFORWARD extension.
+func xforwardAttributes(st *SMTPState) map[string]string {
+	attrs := map[string]string{
+		"NAME": st.RemoteName,
+		"HELO": st.ClientName,
+	}
+	if host, port, err := net.SplitHostPort(st.RemoteAddr); err == nil {
+		if strings.Contains(host, ":") {
+			host = "IPV6:" + host
+		}
+		attrs["ADDR"], attrs["PORT"] = host, port
+	}
+	switch strings.ToUpper(st.Hello) {
+	case "HELO":
+		attrs["PROTO"] = "SMTP"
+	case "EHLO":
+		attrs["PROTO"] = "ESMTP"
+	}
+	for k, v := range attrs {
+		if len(v) == 0 {
+			attrs[k] = "[UNAVAILABLE]"
+		}
+	}
+	return attrs
+}
+
+// xforward sends the attributes of the client supported by the server,
+// split into commands within the line length limit of 512.
+func xforward(c *netsmtp.Client, st *SMTPState) error {
+	ok, supported := c.Extension("XFORWARD")
+	if !ok {
+		return nil
+	}
+	attrs := xforwardAttributes(st)
+	line := ""
+	send := func() error {
+		if len(line) == 0 {
+			return nil
+		}
+		id, err := c.Text.Cmd("XFORWARD%s", line)
+		if err != nil {
+			return err
+		}
+		c.Text.StartResponse(id)
+		defer c.Text.EndResponse(id)
+		_, _, err = c.Text.ReadResponse(250)
+		line = ""
+		return err
+	}
+	for _, name := range strings.Fields(strings.ToUpper(supported)) {
+		v, ok := attrs[name]
+		if !ok {
+			continue
+		}
+		x := " " + name + "=" + encodeXText(v)
+		if len("XFORWARD")+len(line)+len(x) > 510 {
+			if err := send(); err != nil {
+				return err
+			}
+		}
+		line += x
+	}
+	return send()
+}
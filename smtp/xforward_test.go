@@ -0,0 +1,42 @@
+package smtp
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestRouterXForward(t *testing.T) {
+	lsnr, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip(err)
+	}
+	defer lsnr.Close()
+	received := serveUpstream(lsnr, nil, "XFORWARD NAME ADDR PORT PROTO HELO SOURCE")
+	router := NewRouter(lsnr.Addr().String())
+	router.XForward = true
+	st := &SMTPState{}
+	st.Reset()
+	st.Hello = "EHLO"
+	st.ClientName = "client example"
+	st.RemoteAddr = "[2001:db8::1]:54321"
+	st.ReturnTo = "foo@example.net"
+	st.Recipients = []string{"user1@example.com"}
+	st.SetContent([]byte("Hello\r\n"))
+	if err := router.Send(st); err != nil {
+		t.Fatal(err)
+	}
+	expected := "XFORWARD NAME=[UNAVAILABLE] ADDR=IPV6:2001:db8::1 PORT=54321 PROTO=ESMTP HELO=client+20example\r\n" +
+		"MAIL FROM:<foo@example.net>"
+	if actual := <-received; !strings.HasPrefix(actual, expected) {
+		t.Errorf("expected: %s, actual: %s", expected, actual)
+	}
+
+	received = serveUpstream(lsnr, nil)
+	if err := router.Send(st); err != nil {
+		t.Fatal(err)
+	}
+	if actual := <-received; strings.Contains(actual, "XFORWARD") {
+		t.Errorf("unexpected XFORWARD: %s", actual)
+	}
+}
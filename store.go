@@ -0,0 +1,72 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/tachesimazzoca/go-mproxy/smtp"
+)
+
+func runStore(args []string) error {
+	fs := flag.NewFlagSet("store", flag.ExitOnError)
+	dir := fs.String("store", "store", "directory of the message store")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: mproxy store [flags] backup|restore [file.tar.gz]|compact")
+		fmt.Fprintln(fs.Output(), "The archive is written to stdout or read from stdin without a file.")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() == 0 || fs.NArg() > 2 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	s, err := smtp.NewMessageStore(*dir)
+	if err != nil {
+		return err
+	}
+	switch fs.Arg(0) {
+	case "backup":
+		var w io.Writer = os.Stdout
+		if fs.NArg() == 2 {
+			f, err := os.OpenFile(fs.Arg(1), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			w = f
+		}
+		n, err := s.Backup(w)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "%d messages backed up\n", n)
+	case "restore":
+		var r io.Reader = os.Stdin
+		if fs.NArg() == 2 {
+			f, err := os.Open(fs.Arg(1))
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			r = f
+		}
+		n, err := s.Restore(r)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "%d messages restored\n", n)
+	case "compact":
+		res, err := s.Compact()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%d incomplete messages and %d temporary files removed, %d bytes freed\n",
+			res.Incomplete, res.Temporary, res.Bytes)
+	default:
+		fs.Usage()
+		os.Exit(2)
+	}
+	return nil
+}
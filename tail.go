@@ -0,0 +1,107 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"mime"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/tachesimazzoca/go-mproxy/smtp"
+)
+
+func runTail(args []string) error {
+	fs := flag.NewFlagSet("tail", flag.ExitOnError)
+	from := fs.String("from", "", "show only messages from this sender, or from any sender of this @domain")
+	to := fs.String("to", "", "show only messages to this recipient, or to any recipient of this @domain")
+	headers := fs.Bool("headers", false, "print the full header of each message after its summary")
+	rejected := fs.Bool("rejected", false, "also show rejected messages")
+	user := fs.String("user", "", "user to authenticate to the API with")
+	password := fs.String("password", "", "password of -user")
+	token := fs.String("token", "", "bearer token to authenticate to the API with")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: mproxy tail [flags] http://host:port")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	events := "message.accepted"
+	if *rejected {
+		events += ",message.rejected"
+	}
+	req, err := http.NewRequest("GET", strings.TrimSuffix(fs.Arg(0), "/")+"/events?events="+events, nil)
+	if err != nil {
+		return err
+	}
+	if len(*user) > 0 {
+		req.SetBasicAuth(*user, *password)
+	}
+	if len(*token) > 0 {
+		req.Header.Set("Authorization", "Bearer "+*token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.New(req.URL.String() + ": " + resp.Status)
+	}
+	match := func(returnTo string, recipients []string) bool {
+		if len(*from) > 0 && !matchAddress(*from, returnTo) {
+			return false
+		}
+		if len(*to) == 0 {
+			return true
+		}
+		for _, x := range recipients {
+			if matchAddress(*to, x) {
+				return true
+			}
+		}
+		return false
+	}
+	dec := new(mime.WordDecoder)
+	return smtp.ReadEvents(resp.Body, func(e smtp.Event) error {
+		switch e := e.(type) {
+		case smtp.MessageAccepted:
+			if !match(e.ReturnTo, e.Recipients) {
+				return nil
+			}
+			subject := smtp.Header(e.Headers).Get("Subject")
+			if s, err := dec.DecodeHeader(subject); err == nil {
+				subject = s
+			}
+			fmt.Printf("%s\taccepted\t%s\t%s\t%s\t%d\t%s\n", e.Time.Format(time.RFC3339), e.QueueID,
+				e.ReturnTo, strings.Join(e.Recipients, ","), e.Size, subject)
+			if *headers {
+				for _, x := range e.Headers {
+					fmt.Println(x)
+				}
+				fmt.Println()
+			}
+		case smtp.MessageRejected:
+			if !match(e.ReturnTo, e.Recipients) {
+				return nil
+			}
+			fmt.Printf("%s\trejected\t-\t%s\t%s\t%s\n", e.Time.Format(time.RFC3339),
+				e.ReturnTo, strings.Join(e.Recipients, ","), strings.TrimSpace(e.Reply))
+		}
+		return nil
+	})
+}
+
+// matchAddress reports whether the address is the filter, or of the domain
+// of a filter starting with "@".
+func matchAddress(filter, address string) bool {
+	if strings.HasPrefix(filter, "@") {
+		return strings.HasSuffix(strings.ToLower(address), strings.ToLower(filter))
+	}
+	return strings.EqualFold(filter, address)
+}